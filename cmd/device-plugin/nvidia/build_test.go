@@ -0,0 +1,57 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// TestBuildModes builds the device plugin with NVML, which needs cgo, and with the nogpu
+// tag without cgo, which must start and report that it can't serve GPUs.
+func TestBuildModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the device plugin")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+	dir := t.TempDir()
+	build := func(name string, env []string, args ...string) string {
+		bin := filepath.Join(dir, name)
+		cmd := exec.Command(goBin, append(append([]string{"build", "-o", bin}, args...), ".")...)
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		assert.NilError(t, err, string(out))
+		return bin
+	}
+
+	out, err := exec.Command(build("device-plugin", []string{"CGO_ENABLED=1"}), "--help").CombinedOutput()
+	assert.NilError(t, err, string(out))
+	assert.Assert(t, strings.Contains(string(out), "--enable-persistence-mode"), string(out))
+
+	nogpu := build("device-plugin-nogpu", []string{"CGO_ENABLED=0"}, "-tags", "nogpu")
+	out, err = exec.Command(nogpu, "--metrics-bind=", "--runtime-socket=").CombinedOutput()
+	assert.ErrorContains(t, err, "exit status")
+	assert.Assert(t, strings.Contains(string(out), "built without NVML support"), string(out))
+}
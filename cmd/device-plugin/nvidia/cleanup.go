@@ -0,0 +1,85 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/nvidiadevice"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newCleanupCmd() *cobra.Command {
+	var (
+		nodeName string
+		all      bool
+		opts     nvidiadevice.CleanupOptions
+	)
+	cmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "remove what the device plugin left on the node, so the stock NVIDIA device plugin can take over",
+		Long: `Remove the runtime socket, stale device plugin sockets and container directories on this
+node, and the annotations and taints the device plugin added to the node. Run it in a Job or
+DaemonSet on the host after uninstalling the chart. With --all the annotations and taints of
+every node are removed, host files only on this node.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := util.GetClient()
+			if client == nil {
+				return fmt.Errorf("no connection to the API server")
+			}
+			ctx := context.Background()
+			nodes := []string{nodeName}
+			if all {
+				list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+				if err != nil {
+					return err
+				}
+				nodes = nodes[:0]
+				for _, n := range list.Items {
+					nodes = append(nodes, n.Name)
+				}
+			} else if nodeName == "" {
+				return fmt.Errorf("--node-name or NODE_NAME is required without --all")
+			}
+			for _, n := range nodes {
+				o := opts
+				o.Files = opts.Files && n == nodeName
+				report, err := nvidiadevice.Cleanup(ctx, client, n, o)
+				report.Print(cmd.OutOrStdout(), opts.DryRun)
+				if err != nil {
+					return fmt.Errorf("clean up node %v: %v", n, err)
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&nodeName, "node-name", viper.GetString("node-name"), "the node this command runs on")
+	cmd.Flags().BoolVar(&all, "all", false, "remove the annotations and taints of all nodes")
+	cmd.Flags().BoolVar(&opts.Files, "files", true, "remove the sockets and container directories on this node")
+	cmd.Flags().StringVar(&config.RuntimeSocketFlag, "runtime-socket", "/var/lib/vgpu/vgpu.sock", "runtime socket")
+	cmd.Flags().StringVar(&config.DevicePluginPath, "device-plugin-path", pluginapi.DevicePluginPath, "the directory of the kubelet and device plugin sockets")
+	cmd.Flags().BoolVar(&opts.ZeroResources, "zero-resources", false, "set the capacity of the GPU resources registered by the plugin to 0")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "only print what would be removed")
+	return cmd
+}
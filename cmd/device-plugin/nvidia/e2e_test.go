@@ -0,0 +1,360 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/nvidiadevice"
+	vgputesting "4pd.io/k8s-vgpu/pkg/testing"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const e2eTimeout = 10 * time.Second
+
+func setupRun(t *testing.T) {
+	oldClient, oldNVML := util.GetClient(), nvidiadevice.NewNVML()
+	oldPluginPath, oldCacheRoot := config.DevicePluginPath, config.ContainerCacheRoot
+	oldNode, oldSplit, oldScaling := config.NodeName, config.DeviceSplitCount, config.DeviceMemoryScaling
+	oldFlavor, oldStrategy, oldEnforcement := config.RuntimeFlavor, config.DeviceListStrategy, config.Enforcement
+	oldSkip, oldHeartbeat, oldLimitSync := config.SkipPreflight, config.HeartbeatInterval, config.LimitSyncInterval
+	oldMig, oldMetrics, oldPersistence := migStrategyFlag, metricsBindFlag, config.EnablePersistenceMode
+	oldLockFile, oldLockConflict, oldLockRetry := config.NodeLockFile, config.OnLockConflict, nodeLockRetryInterval
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		nvidiadevice.SetNVML(oldNVML)
+		config.DevicePluginPath, config.ContainerCacheRoot = oldPluginPath, oldCacheRoot
+		config.NodeName, config.DeviceSplitCount, config.DeviceMemoryScaling = oldNode, oldSplit, oldScaling
+		config.RuntimeFlavor, config.DeviceListStrategy, config.Enforcement = oldFlavor, oldStrategy, oldEnforcement
+		config.SkipPreflight, config.HeartbeatInterval, config.LimitSyncInterval = oldSkip, oldHeartbeat, oldLimitSync
+		migStrategyFlag, metricsBindFlag, config.EnablePersistenceMode = oldMig, oldMetrics, oldPersistence
+		config.NodeLockFile, config.OnLockConflict, nodeLockRetryInterval = oldLockFile, oldLockConflict, oldLockRetry
+	})
+	assert.NilError(t, util.SetResourcePrefix(util.DefaultResourcePrefix))
+	config.DevicePluginPath, config.ContainerCacheRoot = t.TempDir(), t.TempDir()
+	config.NodeName, config.DeviceSplitCount, config.DeviceMemoryScaling = "node1", 2, 1
+	config.RuntimeFlavor = nvidiadevice.RuntimeFlavorContainerd
+	config.DeviceListStrategy = nvidiadevice.DeviceListStrategyEnvvar
+	config.Enforcement = nvidiadevice.EnforcementHook
+	config.SkipPreflight = []string{"nvidia-runtime", "runtime-hook", "toolkit-version"}
+	config.HeartbeatInterval, config.LimitSyncInterval = 0, 0
+	migStrategyFlag, metricsBindFlag = nvidiadevice.MigStrategyNone, ""
+	config.EnablePersistenceMode = true
+	config.NodeLockFile = filepath.Join(t.TempDir(), "device-plugin.lock")
+	t.Setenv("NODE_NAME", "node1")
+}
+
+func healthy(devices []*pluginapi.Device, unhealthy ...string) bool {
+	if len(devices) == 0 {
+		return false
+	}
+	for _, d := range devices {
+		want := pluginapi.Healthy
+		for _, id := range unhealthy {
+			if d.ID == id {
+				want = pluginapi.Unhealthy
+			}
+		}
+		if d.Health != want {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRunEndToEnd(t *testing.T) {
+	setupRun(t)
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{
+		util.MaxSharesAnnotation: "1",
+	}}})
+	util.SetClient(client)
+	gpus := vgputesting.NewFakeNVML(
+		vgputesting.FakeDevice{UUID: "GPU-0", Model: "A100", Memory: 16000, Free: 16000, Persistence: true},
+		vgputesting.FakeDevice{UUID: "GPU-1", Model: "A100", Memory: 16000, Free: 16000},
+	)
+	kubelet := vgputesting.NewFakeKubelet(config.DevicePluginPath)
+	assert.NilError(t, kubelet.Start())
+	defer kubelet.Stop()
+	sched := vgputesting.NewFakeScheduler(client)
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(runDeps{
+			nvml:     gpus,
+			profiles: func(*nvidiadevice.Profile) ([]*nvidiadevice.Profile, error) { return nil, nil },
+			signals:  signals,
+		})
+	}()
+	ctx := context.Background()
+	resource := util.ResourceName
+
+	// enumeration and registration
+	devices, err := kubelet.WaitForDevices(resource, e2eTimeout, func(d []*pluginapi.Device) bool { return healthy(d) })
+	assert.NilError(t, err)
+	assert.Equal(t, len(devices), 4)
+	assert.Assert(t, gpus.Initialized())
+	for _, uuid := range []string{"GPU-0", "GPU-1"} {
+		on, err := gpus.PersistenceMode(uuid)
+		assert.NilError(t, err)
+		assert.Assert(t, on, uuid)
+	}
+	assert.Equal(t, len(kubelet.Registrations()), 1)
+	assert.Equal(t, kubelet.Registrations()[0].Endpoint, "nvidia-gpu.sock")
+	registered, err := sched.WaitForRegistration(ctx, "node1", e2eTimeout, func(d []*api.DeviceInfo) bool {
+		return len(d) == 2 && d[0].Health && d[1].Health
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, registered[0].Id, "GPU-0")
+	assert.Equal(t, registered[0].Count, int32(2))
+	assert.Equal(t, registered[0].Devmem, int32(16000))
+	assert.Equal(t, registered[0].Type, "NVIDIA-A100")
+	assert.Equal(t, registered[0].Maxshares, int32(1))
+
+	// allocation
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	}
+	_, err = sched.Bind(ctx, pod, "node1", util.PodDevices{{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 3000, Usedcores: 30}}})
+	assert.NilError(t, err)
+	res, err := kubelet.Allocate(ctx, resource, "GPU-1-0")
+	assert.NilError(t, err)
+	envs := res.ContainerResponses[0].Envs
+	assert.Equal(t, envs["NVIDIA_VISIBLE_DEVICES"], "GPU-1")
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "3000m")
+	assert.Equal(t, envs[nvidiadevice.EnforcementEnv], nvidiadevice.EnforcementHook)
+	pod, err = client.CoreV1().Pods("default").Get(ctx, "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.DeviceBindPhase], util.DeviceBindSuccess)
+
+	// health flap
+	gpus.Xid("GPU-1", 31)
+	gpus.Xid("GPU-1", 79)
+	_, err = kubelet.WaitForDevices(resource, e2eTimeout, func(d []*pluginapi.Device) bool {
+		return healthy(d, "GPU-1-0", "GPU-1-1")
+	})
+	assert.NilError(t, err)
+	registered, err = sched.WaitForRegistration(ctx, "node1", e2eTimeout, func(d []*api.DeviceInfo) bool {
+		return len(d) == 2 && d[0].Health && !d[1].Health
+	})
+	assert.NilError(t, err)
+
+	// kubelet restart
+	assert.NilError(t, kubelet.Restart())
+	_, err = kubelet.WaitForDevices(resource, e2eTimeout, func(d []*pluginapi.Device) bool {
+		return healthy(d, "GPU-1-0", "GPU-1-1")
+	})
+	assert.NilError(t, err)
+	assert.Assert(t, len(kubelet.Registrations()) >= 2)
+
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(e2eTimeout):
+		t.Fatal("run didn't return after SIGTERM")
+	}
+	assert.Assert(t, !gpus.Initialized())
+	// persistence mode is only disabled where the plugin enabled it
+	on, err := gpus.PersistenceMode("GPU-0")
+	assert.NilError(t, err)
+	assert.Assert(t, on)
+	on, err = gpus.PersistenceMode("GPU-1")
+	assert.NilError(t, err)
+	assert.Assert(t, !on)
+}
+
+func TestRunOffline(t *testing.T) {
+	setupRun(t)
+	util.SetClient(nil)
+	gpus := vgputesting.NewFakeNVML(vgputesting.FakeDevice{UUID: "GPU-0", Model: "A100", Memory: 16000, Free: 16000})
+	kubelet := vgputesting.NewFakeKubelet(config.DevicePluginPath)
+	assert.NilError(t, kubelet.Start())
+	defer kubelet.Stop()
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(runDeps{
+			nvml:     gpus,
+			profiles: func(*nvidiadevice.Profile) ([]*nvidiadevice.Profile, error) { return nil, nil },
+			signals:  signals,
+		})
+	}()
+	resource := util.ResourceName
+	_, err := kubelet.WaitForDevices(resource, e2eTimeout, func(d []*pluginapi.Device) bool { return healthy(d) })
+	assert.NilError(t, err)
+
+	// without a scheduler assignment each device kubelet picks is a slice of its GPU
+	res, err := kubelet.Allocate(context.Background(), resource, "GPU-0-1")
+	assert.NilError(t, err)
+	envs := res.ContainerResponses[0].Envs
+	assert.Equal(t, envs["NVIDIA_VISIBLE_DEVICES"], "GPU-0")
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "8000m")
+	assert.Equal(t, envs[nvidiadevice.EnforcementEnv], nvidiadevice.EnforcementHook)
+	_, err = os.Stat(filepath.Join(config.ContainerCacheRoot, "offline_GPU-0-1"))
+	assert.NilError(t, err)
+
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(e2eTimeout):
+		t.Fatal("run didn't return after SIGTERM")
+	}
+}
+
+func TestRunHonorsNodeLock(t *testing.T) {
+	setupRun(t)
+	util.SetClient(fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}))
+	kubelet := vgputesting.NewFakeKubelet(config.DevicePluginPath)
+	assert.NilError(t, kubelet.Start())
+	defer kubelet.Stop()
+	profiles := func(*nvidiadevice.Profile) ([]*nvidiadevice.Profile, error) { return nil, nil }
+	start := func(gpus *vgputesting.FakeNVML, signals chan os.Signal) chan error {
+		done := make(chan error, 1)
+		go func() { done <- run(runDeps{nvml: gpus, profiles: profiles, signals: signals}) }()
+		return done
+	}
+	stop := func(signals chan os.Signal, done chan error) {
+		signals <- syscall.SIGTERM
+		select {
+		case err := <-done:
+			assert.NilError(t, err)
+		case <-time.After(e2eTimeout):
+			t.Fatal("run didn't return after SIGTERM")
+		}
+	}
+
+	first := vgputesting.NewFakeNVML(vgputesting.FakeDevice{UUID: "GPU-0", Model: "A100", Memory: 16000, Free: 16000})
+	firstSignals := make(chan os.Signal, 1)
+	firstDone := start(first, firstSignals)
+	_, err := kubelet.WaitForDevices(util.ResourceName, e2eTimeout, func(d []*pluginapi.Device) bool { return healthy(d) })
+	assert.NilError(t, err)
+	assert.Equal(t, len(kubelet.Registrations()), 1)
+
+	// the second instance exits by default
+	second := vgputesting.NewFakeNVML(vgputesting.FakeDevice{UUID: "GPU-0", Model: "A100", Memory: 16000, Free: 16000})
+	err = run(runDeps{nvml: second, profiles: profiles, signals: make(chan os.Signal)})
+	assert.Assert(t, errors.Is(err, nvidiadevice.ErrNodeLocked), err)
+	assert.Assert(t, !second.Initialized())
+
+	// or waits for the first one to go
+	config.OnLockConflict, nodeLockRetryInterval = nvidiadevice.LockConflictWait, 10*time.Millisecond
+	secondSignals := make(chan os.Signal, 1)
+	secondDone := start(second, secondSignals)
+	time.Sleep(100 * time.Millisecond)
+	assert.Assert(t, !second.Initialized())
+	assert.Equal(t, len(kubelet.Registrations()), 1)
+
+	stop(firstSignals, firstDone)
+	deadline := time.Now().Add(e2eTimeout)
+	for len(kubelet.Registrations()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, len(kubelet.Registrations()), 2)
+	assert.Assert(t, second.Initialized())
+	stop(secondSignals, secondDone)
+
+	// a waiting instance stops on a signal
+	holder, err := nvidiadevice.TryNodeLock(config.NodeLockFile)
+	assert.NilError(t, err)
+	defer holder.Release()
+	third := vgputesting.NewFakeNVML()
+	thirdSignals := make(chan os.Signal, 1)
+	stop(thirdSignals, start(third, thirdSignals))
+	assert.Assert(t, !third.Initialized())
+}
+
+func TestRunRefusesUnsafeReload(t *testing.T) {
+	setupRun(t)
+	oldAllow := config.AllowUnsafeReload
+	t.Cleanup(func() { config.AllowUnsafeReload = oldAllow })
+	config.AllowUnsafeReload = false
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{
+				util.AssignedIDsAnnotations: "GPU-0,NVIDIA,3000,30:;",
+			}},
+			Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c"}}},
+		}
+	}
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, pod("a"), pod("b"))
+	util.SetClient(client)
+	gpus := vgputesting.NewFakeNVML(vgputesting.FakeDevice{UUID: "GPU-0", Model: "A100", Memory: 16000, Free: 16000})
+	kubelet := vgputesting.NewFakeKubelet(config.DevicePluginPath)
+	assert.NilError(t, kubelet.Start())
+	defer kubelet.Stop()
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(runDeps{
+			nvml:     gpus,
+			profiles: func(*nvidiadevice.Profile) ([]*nvidiadevice.Profile, error) { return nil, nil },
+			signals:  signals,
+		})
+	}()
+	ctx := context.Background()
+	resource := util.ResourceName
+	devices, err := kubelet.WaitForDevices(resource, e2eTimeout, func(d []*pluginapi.Device) bool { return healthy(d) })
+	assert.NilError(t, err)
+	assert.Equal(t, len(devices), 2)
+	reload := func(split string) []*pluginapi.Device {
+		t.Helper()
+		node, err := client.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+		assert.NilError(t, err)
+		node.Annotations = map[string]string{util.DeviceSplitCountAnnotation: split}
+		_, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+		registrations := len(kubelet.Registrations())
+		signals <- syscall.SIGHUP
+		deadline := time.Now().Add(e2eTimeout)
+		for len(kubelet.Registrations()) == registrations && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		devices, err := kubelet.WaitForDevices(resource, e2eTimeout, func(d []*pluginapi.Device) bool { return healthy(d) })
+		assert.NilError(t, err)
+		return devices
+	}
+
+	// two containers run on the GPU, it can't be split in one
+	assert.Equal(t, len(reload("1")), 2)
+	assert.Equal(t, len(reload("3")), 3)
+
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		assert.NilError(t, err)
+	case <-time.After(e2eTimeout):
+		t.Fatal("run didn't return after SIGTERM")
+	}
+}
@@ -16,22 +16,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
 	"syscall"
+	"time"
 
 	"4pd.io/k8s-vgpu/pkg/version"
 
 	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
 	nvidiadevice "4pd.io/k8s-vgpu/pkg/device-plugin/nvidiadevice"
 	"4pd.io/k8s-vgpu/pkg/util"
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -41,10 +44,14 @@ var (
 	//nvidiaDriverRootFlag string
 	//enableLegacyPreferredFlag bool
 	migStrategyFlag string
+	metricsBindFlag string
 
 	rootCmd = &cobra.Command{
 		Use:   "device-plugin",
 		Short: "kubernetes vgpu device-plugin",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return util.SetResourcePrefix(util.ResourcePrefix)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			if err := start(); err != nil {
 				klog.Fatal(err)
@@ -59,7 +66,14 @@ type devicePluginConfigs struct {
 		Devicememoryscaling float64 `json:"devicememoryscaling"`
 		Devicesplitcount    int     `json:"devicesplitcount"`
 		Migstrategy         string  `json:"migstrategy"`
+		// Profiles expose groups of GPUs as separate resources
+		Profiles []*nvidiadevice.Profile `json:"profiles"`
 	} `json:"nodeconfig"`
+	// Modelconfig caps the containers sharing the GPUs of a model on all nodes
+	Modelconfig []struct {
+		Model              string `json:"model"`
+		Maxsharesperdevice uint   `json:"maxsharesperdevice"`
+	} `json:"modelconfig"`
 }
 
 func init() {
@@ -71,45 +85,189 @@ func init() {
 
 	rootCmd.Flags().StringVar(&migStrategyFlag, "mig-strategy", "none", "the desired strategy for exposing MIG devices on GPUs that support it:\n\t\t[none | single | mixed]")
 	rootCmd.Flags().BoolVar(&failOnInitErrorFlag, "fail-on-init-error", true, "fail the plugin if an error is encountered during initialization, otherwise block indefinitely")
-	rootCmd.Flags().StringVar(&config.RuntimeSocketFlag, "runtime-socket", "/var/lib/vgpu/vgpu.sock", "runtime socket")
+	rootCmd.Flags().StringVar(&config.RuntimeSocketFlag, "runtime-socket", "/var/lib/vgpu/vgpu.sock", "runtime socket, where the device states are served to agents on the node")
+	rootCmd.Flags().StringVar(&config.DevicePluginPath, "device-plugin-path", pluginapi.DevicePluginPath, "the directory of the kubelet and device plugin sockets")
 	rootCmd.Flags().UintVar(&config.DeviceSplitCount, "device-split-count", 2, "the number for NVIDIA device split")
+	rootCmd.Flags().StringToIntVar(&config.DeviceSplitCountMap, "device-split-count-map", nil, "the number for NVIDIA device split of single GPUs, by UUID, e.g. GPU-<uuid>=8,GPU-<uuid>=2, over that of their profile")
+	rootCmd.Flags().UintVar(&config.MaxSharesPerDevice, "max-shares-per-device", 0, "the maximum number of containers sharing a GPU even if memory is left, overridden per GPU model by the config file and per node by the max-shares-per-device annotation, 0 leaves the split count as the limit")
+	rootCmd.Flags().UintVar(&config.MaxSharesPerDevice, "max-containers-per-gpu", 0, "another name of --max-shares-per-device")
 	rootCmd.Flags().Float64Var(&config.DeviceMemoryScaling, "device-memory-scaling", 1.0, "the ratio for NVIDIA device memory scaling")
 	rootCmd.Flags().Float64Var(&config.DeviceCoresScaling, "device-cores-scaling", 1.0, "the ratio for NVIDIA device cores scaling")
+	rootCmd.Flags().Float64Var(&config.MaxScaling, "max-scaling", config.MaxScaling, "the largest memory and cores scaling ratio accepted, also from the config file")
+	rootCmd.Flags().StringVar(&config.ScalingDimensions, "scaling-dimensions", nvidiadevice.ScalingBoth, "the capacities the scaling ratios apply to, the other ratio is ignored:\n\t\t[memory | cores | both]")
 	rootCmd.Flags().StringVar(&config.NodeName, "node-name", viper.GetString("node-name"), "node name")
+	rootCmd.Flags().Float64Var(&config.ManagedMemoryRatio, "managed-memory-ratio", config.ManagedMemoryRatio, "the device plus host memory budget of pods allowed to use managed memory, as a multiple of their device memory")
 	rootCmd.Flags().BoolVar(&config.DisableCoreLimit, "disable-core-limit", false, "If set, the core utilization limit will be ignored")
+	rootCmd.Flags().BoolVar(&config.RequireSchedulerApproval, "require-scheduler-approval", true, "reject pods that were not assigned devices by the vgpu scheduler, disable for debugging only")
+	rootCmd.Flags().DurationVar(&config.RegisterTimeout, "register-timeout", 5*time.Second, "timeout of each attempt to register with kubelet")
+	rootCmd.Flags().IntVar(&config.RegisterRetries, "register-retries", 3, "number of times a failed registration with kubelet is retried")
+	rootCmd.Flags().DurationVar(&config.APITimeout, "api-timeout", config.APITimeout, "timeout of each api server request registering the devices, and of dialing and probing the api server")
+	rootCmd.Flags().DurationVar(&config.APIKeepalive, "api-keepalive", config.APIKeepalive, "how long a connection to the api server may stay silent before it is probed, at least 5s")
+	rootCmd.Flags().DurationVar(&config.NodeUpdateInterval, "node-update-interval", config.NodeUpdateInterval, "how often the devices are reported in the node annotations, jittered by 10%, the scheduler needs a report within 60s")
+	rootCmd.Flags().Float64Var(&config.NodeUpdateQPS, "node-update-qps", config.NodeUpdateQPS, "the most patches of the node a second made to report the devices, changes in between are coalesced")
+	rootCmd.Flags().BoolVar(&config.StrictBindTimeMemoryCheck, "strict-bind-time-memory-check", false, "fail the allocation if a GPU has less free memory than the pod's limit")
+	rootCmd.Flags().BoolVar(&config.VerifyDeviceFreeMemory, "verify-device-free-memory", false, "check the GPUs of a container for memory held by processes of terminated pods when it is allocated, and report them in a DeviceMemoryLeakDetected event")
+	rootCmd.Flags().StringVar(&config.OnLeak, "on-leak", config.OnLeak, "what the allocation does when processes of terminated pods hold the memory of a container:\n\t\t[fail | warn]")
+	rootCmd.Flags().BoolVar(&config.ReapLeakedProcesses, "reap-leaked-processes", false, "kill the processes of terminated pods found holding GPU memory with --verify-device-free-memory")
+	rootCmd.Flags().DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 30*time.Second, "how often container heartbeats are checked for GPU activity, 0 disables it")
+	rootCmd.Flags().DurationVar(&config.LimitSyncInterval, "limit-sync-interval", 10*time.Second, "how often the memory limits of running containers are updated after their pods were resized, 0 disables it")
+	rootCmd.Flags().DurationVar(&config.MemoryWatchdogInterval, "memory-watchdog-interval", 5*time.Second, "how often the memory containers use is checked against their limits in cgroup enforcement, processes of containers over their limit are killed. 0 disables it, which leaves shared GPUs unlimited, so the device plugin falls back to none enforcement")
+	rootCmd.Flags().DurationVar(&config.NVMLQueryTimeout, "nvml-query-timeout", 5*time.Second, "timeout of each NVML query, a GPU whose queries time out is reported unhealthy")
+	rootCmd.Flags().DurationVar(&config.AllocateSlowThreshold, "allocate-slow-threshold", 2*time.Second, "Allocate calls taking longer log the time of each phase, five times as long records an event on the pod")
+	rootCmd.Flags().DurationVar(&config.AllocateTimeout, "allocate-timeout", 30*time.Second, "Allocate calls taking longer fail and are rolled back")
+	rootCmd.Flags().DurationVar(&config.UnhealthyGracePeriod, "unhealthy-grace-period", 0, "how long a GPU must keep failing health checks before it is reported unhealthy, and keep passing them before it recovers, 0 reports changes at once")
+	rootCmd.Flags().Int32Var(&config.MinPlausibleMemory, "min-plausible-memory", 1024, "the least device memory in MiB a GPU may report, smaller values are taken for NVML glitches and the last good value is kept")
+	rootCmd.Flags().UintVar(&config.CoreLimitGranularity, "core-limit-granularity", 1, "the step in percent the hook library enforces core limits in, core requests are rounded to the nearest step and smaller ones rejected")
+	rootCmd.Flags().UintVar(&config.CoreBurstThreshold, "core-burst-threshold", 80, "GPU utilization in percent from which pods with the gpucores-burst annotation are held to their core share while another tenant is busy, 0 disables bursting")
+	rootCmd.Flags().BoolVar(&config.EnablePersistenceMode, "enable-persistence-mode", false, "enable persistence mode of the GPUs at startup and disable it again on shutdown where it was off, needs root")
+	rootCmd.Flags().BoolVar(&config.EnableNVMLAccounting, "enable-nvml-accounting", false, "enable accounting mode of the GPUs while the plugin runs, for the usage of containers whose hook library doesn't measure kernel time, needs root")
+	rootCmd.Flags().BoolVar(&config.ForceComputeModeDefault, "force-compute-mode-default", false, "reset GPUs in EXCLUSIVE_PROCESS or PROHIBITED compute mode to DEFAULT instead of registering them unsplit, needs root")
+	rootCmd.Flags().StringVar(&config.NodeLockFile, "node-lock-file", config.NodeLockFile, "file locked by the one device plugin serving the node, nothing is locked if empty")
+	rootCmd.Flags().StringVar(&config.OnLockConflict, "on-lock-conflict", config.OnLockConflict, "what to do while another device plugin holds the node lock:\n\t\t[exit | wait]")
+	rootCmd.Flags().BoolVar(&config.IdleCoreReclaim, "idle-core-reclaim", false, "lend the cores of containers that launched no kernel for --idle-core-period to the other containers on their GPUs, until they launch one again")
+	rootCmd.Flags().DurationVar(&config.IdleCorePeriod, "idle-core-period", config.IdleCorePeriod, "how long a container must launch no kernel before its cores are lent with --idle-core-reclaim")
+	rootCmd.Flags().BoolVar(&config.Offline, "offline", false, "run without the api server, as a static pod on nodes that can't reach it, which is also done when the api server doesn't answer at startup")
+	rootCmd.Flags().BoolVar(&config.CoexistWithLegacyAllocations, "coexist-with-legacy-allocations", false, "advertise no slices of the gpus kubelet assigned to pods under --legacy-resource-name, while migrating from the stock nvidia device plugin, and bring them in one by one as the pods end")
+	rootCmd.Flags().StringVar(&config.LegacyResourceName, "legacy-resource-name", config.LegacyResourceName, "the resource name the gpus of the pods of the stock nvidia device plugin are assigned under, with --coexist-with-legacy-allocations")
+	rootCmd.Flags().BoolVar(&config.DrainMigrate, "drain-migrate", false, "while the node is cordoned, evict its vgpu pods one at a time, respecting their pod disruption budgets, so they are scheduled on other nodes")
+	rootCmd.Flags().BoolVar(&config.AllowUnsafeReload, "allow-unsafe-reload", false, "apply the configuration reloaded on SIGHUP even when the containers running wouldn't fit the capacity it gives their gpus")
+	rootCmd.Flags().BoolVar(&config.CheckCapacity, "check-capacity", false, "check once the gpus are sampled that the memory advertised for their slices agrees with the limits the slices are enforced with, and log mismatches")
+	rootCmd.Flags().BoolVar(&config.InjectAssignmentEnv, "inject-assignment-env", false, "set VGPU_ASSIGNED_UUID, VGPU_MEMORY_LIMIT_MIB and VGPU_CORE_LIMIT in containers")
+	rootCmd.Flags().StringVar(&config.LimitDelivery, "limit-delivery", config.LimitDelivery, "how the limits are passed to containers, env sets them in environment variables, file writes them to "+nvidiadevice.LimitConfigPath+" for shims that read a config file:\n\t\t[env | file]")
+	rootCmd.Flags().BoolVar(&config.ManageNodeTaints, "manage-node-taints", false, "taint the node while none of its GPUs is healthy")
+	rootCmd.Flags().BoolVar(&config.MeasureExternalMemory, "measure-external-memory", false, "measure the device memory used by processes without vgpus of this plugin, like node daemons, and register it as unavailable")
+	rootCmd.Flags().StringSliceVar(&config.SkipPreflight, "skip-preflight", nil, "names of the NVIDIA container toolkit preflight checks to skip:\n\t\t[nvidia-runtime | runtime-hook | toolkit-version]")
+	rootCmd.Flags().BoolVar(&config.EnableDeviceBlacklist, "enable-device-blacklist", false, "let GPUs be taken out of scheduling and put back with PUT and DELETE on /blacklist/<uuid> of the runtime socket")
+	rootCmd.Flags().StringVar(&config.CheckpointFile, "checkpoint-file", config.CheckpointFile, "file keeping the GPUs blacklisted at runtime across restarts, nothing is kept if empty")
+	rootCmd.Flags().StringVar(&metricsBindFlag, "metrics-bind", ":9396", "bind address of the metrics and of the readiness probe on /readyz, disabled if empty")
+	rootCmd.Flags().BoolVar(&config.StrictDeviceVisibility, "strict-device-visibility", false, "pass only the device nodes of the allocated GPUs to containers, also when the hook library enforces limits")
+	rootCmd.Flags().StringVar(&config.DeviceListStrategy, "device-list-strategy", nvidiadevice.DeviceListStrategyAuto, "how the allocated GPUs are passed to the container runtime, auto picks it by runtime flavor:\n\t\t[auto | envvar | volume-mounts | cdi-annotations]")
+	rootCmd.Flags().StringVar(&config.RuntimeFlavor, "runtime-flavor", nvidiadevice.RuntimeFlavorAuto, "the container runtime of the node:\n\t\t[auto | docker | containerd | crio]")
+	rootCmd.Flags().StringVar(&config.Enforcement, "enforcement", nvidiadevice.EnforcementAuto, "the mechanism used to enforce limits:\n\t\t[auto | hook | cgroup | none]")
+	rootCmd.Flags().StringSliceVar(&config.HookCapabilities, "hook-capabilities", nil, "what the hook library enforces beyond memory and core limits, the libvgpu.so of this project neither:\n\t\t[memory-bandwidth | memory-tiers]")
 
 	rootCmd.PersistentFlags().AddGoFlagSet(util.GlobalFlagSet())
 	rootCmd.AddCommand(version.VersionCmd)
+	rootCmd.AddCommand(util.NewConfigCmd("http://127.0.0.1:9396"))
+	rootCmd.AddCommand(newCleanupCmd())
 }
 
-func readFromConfigFile() error {
+// readFromConfigFile returns the profiles of the node in the config file and sets the
+// node settings it has on def, the default profile.
+func readFromConfigFile(def *nvidiadevice.Profile) ([]*nvidiadevice.Profile, error) {
 	jsonbyte, err := ioutil.ReadFile("/config/config.json")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var deviceConfigs devicePluginConfigs
 	err = json.Unmarshal(jsonbyte, &deviceConfigs)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var profiles []*nvidiadevice.Profile
 	fmt.Println("json=", deviceConfigs)
 	for _, val := range deviceConfigs.Nodeconfig {
 		if strings.Compare(os.Getenv("NODE_NAME"), val.Name) == 0 {
 			fmt.Println("Reading config from file", val.Name)
 			if val.Devicememoryscaling > 0 {
-				config.DeviceMemoryScaling = val.Devicememoryscaling
+				if err := config.ValidateScaling("memory", val.Devicememoryscaling); err != nil {
+					return nil, fmt.Errorf("node %v: %v", val.Name, err)
+				}
+			}
+			if val.Devicesplitcount > 0 {
+				if err := config.ValidateSplitCount(uint(val.Devicesplitcount)); err != nil {
+					return nil, fmt.Errorf("node %v: %v", val.Name, err)
+				}
+			}
+			if val.Devicememoryscaling > 0 {
+				def.DeviceMemoryScaling = val.Devicememoryscaling
 			}
 			if val.Devicesplitcount > 0 {
-				config.DeviceSplitCount = uint(val.Devicesplitcount)
+				def.DeviceSplitCount = uint(val.Devicesplitcount)
 			}
+			profiles = val.Profiles
 		}
 	}
+	for _, val := range deviceConfigs.Modelconfig {
+		if config.ModelMaxShares == nil {
+			config.ModelMaxShares = make(map[string]uint)
+		}
+		config.ModelMaxShares[val.Model] = val.Maxsharesperdevice
+	}
+	return profiles, nil
+}
+
+// validateAPITimeouts rejects timeouts that would fail every request or none, and raises
+// the keepalive to config.MinAPIKeepalive.
+func validateAPITimeouts() error {
+	if config.APITimeout <= 0 {
+		return fmt.Errorf("--api-timeout must be positive, got %v", config.APITimeout)
+	}
+	if config.APIKeepalive <= 0 {
+		return fmt.Errorf("--api-keepalive must be positive, got %v", config.APIKeepalive)
+	}
+	if config.APIKeepalive < config.MinAPIKeepalive {
+		klog.Warningf("--api-keepalive %v raised to %v", config.APIKeepalive, config.MinAPIKeepalive)
+		config.APIKeepalive = config.MinAPIKeepalive
+	}
 	return nil
 }
 
+// runDeps are what run takes from the node, tests pass fakes instead.
+type runDeps struct {
+	nvml     nvidiadevice.NVML
+	profiles func(def *nvidiadevice.Profile) ([]*nvidiadevice.Profile, error)
+	signals  <-chan os.Signal
+}
+
 func start() error {
+	if err := validateAPITimeouts(); err != nil {
+		return err
+	}
+	if err := nvidiadevice.ValidateScalingDimensions(config.ScalingDimensions); err != nil {
+		return err
+	}
+	if err := nvidiadevice.ValidateOnLeak(config.OnLeak); err != nil {
+		return err
+	}
+	if err := nvidiadevice.ValidateLimitDelivery(config.LimitDelivery); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if err := nvidiadevice.ValidateLockConflict(config.OnLockConflict); err != nil {
+		return err
+	}
+	if config.CoreLimitGranularity < 1 || config.CoreLimitGranularity > 100 {
+		return fmt.Errorf("--core-limit-granularity must be between 1 and 100, got %v", config.CoreLimitGranularity)
+	}
+	if config.IdleCoreReclaim && config.IdleCorePeriod <= 0 {
+		return fmt.Errorf("--idle-core-period must be positive, got %v", config.IdleCorePeriod)
+	}
+	if config.IdleCoreReclaim && config.LimitSyncInterval <= 0 {
+		klog.Warningf("--idle-core-reclaim has no effect with --limit-sync-interval=0")
+	}
+	connectAPI()
+	return run(runDeps{
+		nvml:     nvidiadevice.NewNVML(),
+		profiles: readFromConfigFile,
+		signals:  NewOSWatcher(syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT),
+	})
+}
+
+// run serves the GPUs to kubelet until a signal other than SIGHUP or SIGUSR2 arrives,
+// restarting the plugins whenever kubelet restarts. SIGUSR2 enumerates the devices again.
+func run(deps runDeps) error {
+	if len(config.NodeLockFile) > 0 {
+		lock, err := lockNode(deps.signals)
+		if err != nil || lock == nil {
+			return err
+		}
+		defer lock.Release()
+	}
 	klog.Info("Loading NVML")
-	if err := nvml.Init(); err != nil {
+	if err := deps.nvml.Init(); err != nil {
 		klog.Infof("Failed to initialize NVML: %v.", err)
 		klog.Infof("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
 		klog.Infof("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
@@ -120,34 +278,183 @@ func start() error {
 		}
 		select {}
 	}
-	defer func() { klog.Info("Shutdown of NVML returned:", nvml.Shutdown()) }()
+	defer func() { klog.Info("Shutdown of NVML returned:", deps.nvml.Shutdown()) }()
+	nvidiadevice.SetNVML(deps.nvml)
+	if config.EnablePersistenceMode {
+		defer nvidiadevice.EnablePersistenceMode()()
+	}
+	if config.EnableNVMLAccounting {
+		defer nvidiadevice.EnableAccountingMode()()
+	}
 
 	/*Loading config files*/
 	fmt.Println("NodeName=", config.NodeName)
-	err := readFromConfigFile()
+	def, profiles := loadProfiles(deps)
+
+	flavor, err := nvidiadevice.DetectRuntimeFlavor(config.RuntimeFlavor, nvidiadevice.DefaultRuntimeEnv())
 	if err != nil {
-		fmt.Printf("failed to load config file %s", err.Error())
+		return err
+	}
+	if flavor == "" {
+		klog.Warningf("Could not detect the container runtime, pass --runtime-flavor if GPUs don't show up in containers")
+	}
+	config.RuntimeFlavor = flavor
+	config.DeviceListStrategy, err = nvidiadevice.RuntimeDeviceListStrategy(config.DeviceListStrategy, flavor)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Passing GPUs to containers with the %q device list strategy for the %q runtime", config.DeviceListStrategy, flavor)
+	if err := preflight(); err != nil {
+		if failOnInitErrorFlag {
+			return err
+		}
+		klog.Warningf("Continuing despite %v", err)
+	}
+	config.Enforcement, err = nvidiadevice.DetectEnforcement(config.Enforcement)
+	if err != nil {
+		return err
+	}
+	if config.Enforcement == nvidiadevice.EnforcementCgroup && (config.MemoryWatchdogInterval <= 0 || util.GetClient() == nil) {
+		klog.Warningf("The memory watchdog can't run without --memory-watchdog-interval and the api server, falling back to %s enforcement, which refuses shared GPUs", nvidiadevice.EnforcementNone)
+		config.Enforcement = nvidiadevice.EnforcementNone
+	}
+	klog.Infof("Using %s enforcement", config.Enforcement)
+	if err := nvidiadevice.CheckHookCapabilities(config.HookCapabilities); err != nil {
+		return err
+	}
+	config.MemoryBandwidthLimit = nvidiadevice.DetectMemoryBandwidthLimit(config.Enforcement, config.HookCapabilities)
+	if !config.MemoryBandwidthLimit {
+		klog.Infof("Memory bandwidth limits aren't enforced, that takes hook enforcement and --hook-capabilities=%v", nvidiadevice.HookMemoryBandwidth)
+	}
+	config.MemoryTiers = nvidiadevice.DetectMemoryTiers(config.Enforcement, config.HookCapabilities)
+	if !config.MemoryTiers {
+		klog.Infof("Memory tiers aren't enforced, that takes hook enforcement and --hook-capabilities=%v", nvidiadevice.HookMemoryTiers)
+	}
+
+	var usage *nvidiadevice.UsageTracker
+	if config.HeartbeatInterval > 0 && util.GetClient() != nil {
+		stopHeartbeats := make(chan struct{})
+		defer close(stopHeartbeats)
+		monitor := nvidiadevice.NewHeartbeatMonitor(config.NodeName, util.GetClient())
+		usage = monitor.Usage()
+		go monitor.Run(config.HeartbeatInterval, stopHeartbeats)
+	}
+	if config.LimitSyncInterval > 0 && util.GetClient() != nil {
+		stopLimitSync := make(chan struct{})
+		defer close(stopLimitSync)
+		go nvidiadevice.NewLimitSyncer(config.NodeName, util.GetClient()).Run(config.LimitSyncInterval, stopLimitSync)
+	}
+	if config.Enforcement == nvidiadevice.EnforcementCgroup {
+		stopWatchdog := make(chan struct{})
+		defer close(stopWatchdog)
+		go nvidiadevice.NewMemoryWatchdog(config.NodeName, util.GetClient()).Run(config.MemoryWatchdogInterval, stopWatchdog)
 	}
 
 	klog.Info("Starting FS watcher.")
-	watcher, err := NewFSWatcher(pluginapi.DevicePluginPath)
+	watcher, err := NewFSWatcher(config.DevicePluginPath)
 	if err != nil {
 		return fmt.Errorf("failed to create FS watcher: %v", err)
 	}
 	defer watcher.Close()
 
-	klog.Info("Starting OS watcher.")
-	sigs := NewOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
 	cache := nvidiadevice.NewDeviceCache()
 	cache.Start()
 	defer cache.Stop()
+	go nvidiadevice.ExportDeviceMetrics(cache)
+	if err := cache.SetProfiles(def, profiles); err != nil {
+		return fmt.Errorf("invalid device profiles: %v", err)
+	}
+	if config.EnableDeviceBlacklist && len(config.CheckpointFile) > 0 {
+		checkpoint, err := nvidiadevice.ReadCheckpoint(config.CheckpointFile)
+		if err != nil {
+			return err
+		}
+		for _, id := range checkpoint.Blacklist {
+			if _, err := cache.SetBlacklisted(id, true); err != nil {
+				klog.Warningf("ignoring blacklisted device: %v", err)
+			}
+		}
+	}
+	for _, p := range cache.Profiles() {
+		klog.Infof("Profile %q: %d devices as %v, split %d, memory scaling %v", p.Name,
+			len(cache.ProfileDevices(p.Name)), p.ResourceName(), p.DeviceSplitCount, p.MemoryScaling())
+	}
+	for id, count := range config.DeviceSplitCountMap {
+		klog.Infof("Device %v: split %d of profile %q", id, count, cache.DeviceProfile(id).Name)
+	}
+	nvidiadevice.LogScalingPolicy(cache.Profiles())
+	if config.CheckCapacity {
+		stopCheck := make(chan struct{})
+		defer close(stopCheck)
+		go nvidiadevice.LogCapacityCheck(cache, stopCheck)
+	}
+
+	var migration *nvidiadevice.LegacyMigration
+	if config.CoexistWithLegacyAllocations {
+		// the GPUs of legacy pods must be held before the plugins advertise any slice
+		migration = nvidiadevice.NewLegacyMigration(cache)
+		if err := migration.Sync(); err != nil {
+			klog.Warningf("Holding all GPUs until kubelet lists the devices of %v: %v", config.LegacyResourceName, err)
+		}
+		stopMigration := make(chan struct{})
+		defer close(stopMigration)
+		go migration.Run(stopMigration)
+	}
+
+	if len(config.RuntimeSocketFlag) > 0 {
+		service := nvidiadevice.NewRuntimeService(cache, config.NodeName, util.GetClient())
+		service.SetUsageTracker(usage)
+		service.SetLegacyMigration(migration)
+		go func() {
+			if err := service.Serve(config.RuntimeSocketFlag); err != nil {
+				klog.Errorf("serve device states on %v: %v", config.RuntimeSocketFlag, err)
+			}
+		}()
+		defer service.Stop()
+	}
+
+	if config.ManageNodeTaints && util.GetClient() != nil {
+		stopTaints := make(chan struct{})
+		defer close(stopTaints)
+		go nvidiadevice.NewNodeTaintManager(cache, config.NodeName, util.GetClient()).Run(stopTaints)
+	}
+	if config.DrainMigrate && util.GetClient() != nil {
+		stopMigrate := make(chan struct{})
+		defer close(stopMigrate)
+		go nvidiadevice.NewDrainMigrator(config.NodeName, util.GetClient()).Run(stopMigrate)
+	}
 
 	register := nvidiadevice.NewDeviceRegister(cache)
-	register.Start()
-	defer register.Stop()
+	if config.MeasureExternalMemory && util.GetClient() != nil {
+		register.SetExternalMemory(nvidiadevice.NewExternalMemory(cache, config.NodeName, util.GetClient()))
+	}
+	register.SetUsageTracker(usage)
+	ready := register.Ready
+	if util.GetClient() != nil {
+		register.Start()
+		defer register.Stop()
+	} else {
+		// there is no scheduler to report the devices to
+		ready = func() error { return nil }
+	}
+
+	if len(metricsBindFlag) > 0 {
+		go serveMetrics(metricsBindFlag, func() interface{} {
+			return nvidiadevice.NewEffectiveConfig(cache, migStrategyFlag)
+		}, ready)
+	}
+
+	var leaks *nvidiadevice.LeakCheck
+	if config.VerifyDeviceFreeMemory && util.GetClient() != nil {
+		leaks = nvidiadevice.NewLeakCheck(config.NodeName, util.GetClient())
+	}
+	var recorder record.EventRecorder
+	if util.GetClient() != nil {
+		recorder = nvidiadevice.NewEventRecorder(config.NodeName, util.GetClient())
+	}
 
 	var plugins []*nvidiadevice.NvidiaDevicePlugin
+	disconnected := make(chan string, 1)
 restart:
 	// If we are restarting, idempotently stop any running plugins before
 	// recreating them below.
@@ -160,6 +467,16 @@ restart:
 		return fmt.Errorf("error creating MIG strategy: %v", err)
 	}
 	plugins = migStrategy.GetPlugins(cache)
+	// drop a disconnect reported by the plugins stopped above
+	select {
+	case <-disconnected:
+	default:
+	}
+	for _, p := range plugins {
+		p.SetDisconnectChannel(disconnected)
+		p.SetLeakCheck(leaks)
+		p.SetEventRecorder(recorder)
+	}
 
 	/*plugins = []*device_plugin.NvidiaDevicePlugin{
 		device_plugin.NewNvidiaDevicePlugin(
@@ -206,26 +523,42 @@ events:
 			goto restart
 
 		// Detect a kubelet restart by watching for a newly created
-		// 'pluginapi.KubeletSocket' file. When this occurs, restart this loop,
+		// kubelet socket file. When this occurs, restart this loop,
 		// restarting all of the plugins in the process.
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				klog.Infof("inotify: %s created, restarting.", pluginapi.KubeletSocket)
+			if event.Name == nvidiadevice.KubeletSocket() && event.Op&fsnotify.Create == fsnotify.Create {
+				klog.Infof("inotify: %s created, restarting.", event.Name)
 				goto restart
 			}
 
+		// A lost ListAndWatch stream means kubelet no longer sees our devices,
+		// which happens on kubelet restarts that keep the socket file.
+		case name := <-disconnected:
+			klog.Infof("ListAndWatch stream of %s lost, restarting.", name)
+			goto restart
+
 		// Watch for any other fs errors and log them.
 		case err := <-watcher.Errors:
 			klog.Infof("inotify: %s", err)
 
 		// Watch for any signals from the OS. On SIGHUP, restart this loop,
-		// restarting all of the plugins in the process. On all other
-		// signals, exit the loop and exit the program.
-		case s := <-sigs:
+		// restarting all of the plugins in the process. On SIGUSR2, enumerate
+		// the devices again. On all other signals, exit the loop and exit the
+		// program.
+		case s := <-deps.signals:
 			switch s {
 			case syscall.SIGHUP:
-				klog.Info("Received SIGHUP, restarting.")
+				klog.Info("Received SIGHUP, reloading the configuration and restarting.")
+				if err := reloadConfig(deps, cache); err != nil {
+					klog.Errorf("Keeping the current configuration: %v", err)
+				}
 				goto restart
+			case syscall.SIGUSR2:
+				klog.Info("Received SIGUSR2, enumerating the devices again.")
+				if refreshDevices(cache, plugins) {
+					klog.Info("Devices added to a resource without any, restarting.")
+					goto restart
+				}
 			default:
 				klog.Infof("Received signal %v, shutting down.", s)
 				for _, p := range plugins {
@@ -238,6 +571,167 @@ events:
 	return nil
 }
 
+// loadProfiles returns the default profile of the flags with the node settings of the
+// config file and then of the annotations of the node over it, and the profiles of the
+// config file.
+func loadProfiles(deps runDeps) (*nvidiadevice.Profile, []*nvidiadevice.Profile) {
+	def := nvidiadevice.DefaultProfile()
+	profiles, err := deps.profiles(def)
+	if err != nil {
+		fmt.Printf("failed to load config file %s", err.Error())
+	}
+	if util.GetClient() == nil {
+		return def, profiles
+	}
+	node, err := util.GetNode(config.NodeName)
+	if err != nil {
+		klog.Warningf("Ignoring the node overrides of the device settings: %v", err)
+		return def, profiles
+	}
+	if err := nvidiadevice.ApplyNodeOverrides(def, node); err != nil {
+		klog.Warningf("Ignoring the node overrides of the device settings: %v", err)
+	}
+	return def, profiles
+}
+
+// reloadConfig loads the configuration again over the node settings of the flags, so an
+// override removed from the node no longer applies, and gives cache its profiles. Unless
+// --allow-unsafe-reload, it keeps the current configuration when the containers running
+// on the node wouldn't fit the capacity of the new one. Nothing changes until the plan
+// is accepted, the plugins keep serving the profiles of cache meanwhile.
+func reloadConfig(deps runDeps, cache *nvidiadevice.DeviceCache) error {
+	def, profiles := loadProfiles(deps)
+	err := nvidiadevice.ValidateProfiles(def, profiles)
+	if err == nil {
+		allocations := nvidiadevice.NodeAllocations(context.Background(), util.GetClient(), config.NodeName)
+		res := cache.PlanProfiles(def, profiles, allocations)
+		if !res.Safe && !config.AllowUnsafeReload {
+			var b strings.Builder
+			res.Write(&b)
+			err = fmt.Errorf("unsafe change, pass --allow-unsafe-reload to apply it anyway\n%v", b.String())
+		} else if !res.Safe {
+			klog.Warningf("Applying an unsafe change with --allow-unsafe-reload")
+		}
+	}
+	if err == nil {
+		err = cache.SetProfiles(def, profiles)
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range cache.Profiles() {
+		klog.Infof("Profile %q: %d devices as %v, split %d, memory scaling %v", p.Name,
+			len(cache.ProfileDevices(p.Name)), p.ResourceName(), p.DeviceSplitCount, p.MemoryScaling())
+	}
+	return nil
+}
+
+// nodeLockRetryInterval is how often a waiting device plugin tries the node lock.
+var nodeLockRetryInterval = time.Second
+
+// lockNode takes config.NodeLockFile before anything touches the node. While another device
+// plugin holds it, it fails with --on-lock-conflict=exit, and retries every
+// nodeLockRetryInterval with wait. It returns no lock when a signal other than SIGHUP
+// arrives while waiting.
+func lockNode(signals <-chan os.Signal) (*nvidiadevice.NodeLock, error) {
+	var ticker *time.Ticker
+	for {
+		lock, err := nvidiadevice.TryNodeLock(config.NodeLockFile)
+		if err == nil {
+			return lock, nil
+		}
+		if !errors.Is(err, nvidiadevice.ErrNodeLocked) || config.OnLockConflict != nvidiadevice.LockConflictWait {
+			return nil, err
+		}
+		if ticker == nil {
+			klog.Warningf("%v, waiting for it", err)
+			ticker = time.NewTicker(nodeLockRetryInterval)
+			defer ticker.Stop()
+		}
+		select {
+		case <-ticker.C:
+		case s := <-signals:
+			if s != syscall.SIGHUP && s != syscall.SIGUSR2 {
+				klog.Infof("Received signal %v while waiting for the node lock, shutting down.", s)
+				return nil, nil
+			}
+		}
+	}
+}
+
+// refreshDevices enumerates the devices of cache again, and tells whether a plugin that
+// had no devices got some, it is only started by a restart.
+func refreshDevices(cache *nvidiadevice.DeviceCache, plugins []*nvidiadevice.NvidiaDevicePlugin) bool {
+	idle := make(map[*nvidiadevice.NvidiaDevicePlugin]bool)
+	for _, p := range plugins {
+		idle[p] = len(p.Devices()) == 0
+	}
+	// the sampler may be waiting for NVML before and after enumerating
+	ctx, cancel := context.WithTimeout(context.Background(), 3*config.NVMLQueryTimeout)
+	defer cancel()
+	res, err := cache.Refresh(ctx)
+	if err != nil {
+		klog.Errorf("Refresh devices: %v", err)
+		return false
+	}
+	klog.Infof("Refreshed devices: added %v, removed %v, memory changed %v", res.Added, res.Removed, res.Resized)
+	for _, p := range plugins {
+		if idle[p] && len(p.Devices()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// connectAPI sets the client of the api server, unless the plugin runs offline or the
+// api server doesn't answer, when it logs the features that are off once.
+func connectAPI() {
+	if !config.Offline {
+		client, err := util.NewClientWithKeepalive(config.APITimeout, config.APIKeepalive)
+		if err == nil {
+			_, err = client.Discovery().ServerVersion()
+		}
+		if err == nil {
+			util.SetClient(client)
+			return
+		}
+		klog.Errorf("connect to the api server: %v", err)
+		config.Offline = true
+	}
+	klog.Warningf("Running without the api server: node annotations and labels, events, node taints, drain migration, " +
+		"heartbeat and limit sync, external memory measurement and allocation reports are off, " +
+		"containers get the memory of the GPU slices kubelet picks for them")
+}
+
+// preflight checks that the node's NVIDIA container toolkit works with the plugin
+// and reports the result on the node.
+func preflight() error {
+	results, err := nvidiadevice.RunPreflight(nvidiadevice.DefaultPreflightEnv(), config.SkipPreflight)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			klog.Infof("Preflight check %s skipped", r.Name)
+		case r.Err != nil:
+			klog.Errorf("Preflight check %s failed: %v", r.Name, r.Err)
+		default:
+			klog.Infof("Preflight check %s passed", r.Name)
+		}
+	}
+	if client := util.GetClient(); client != nil {
+		recorder := nvidiadevice.NewEventRecorder(config.NodeName, client)
+		if err := nvidiadevice.ReportPreflight(context.Background(), client, recorder, config.NodeName, results); err != nil {
+			klog.Errorf("report preflight result: %v", err)
+		}
+	}
+	if err := nvidiadevice.PreflightError(results); err != nil {
+		return fmt.Errorf("preflight failed: %v", err)
+	}
+	return nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		klog.Fatal(err)
@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	nvidiadevice "4pd.io/k8s-vgpu/pkg/device-plugin/nvidiadevice"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+// serveMetrics serves the metrics, the effective configuration returned by effective
+// and the readiness returned by ready on /readyz.
+func serveMetrics(addr string, effective func() interface{}, ready func() error) {
+	klog.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, metricsHandler(effective, ready)); err != nil {
+		klog.Errorf("metrics server stopped: %v", err)
+	}
+}
+
+func metricsHandler(effective func() interface{}, ready func() error) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(nvidiadevice.Metrics()...)
+	reg.MustRegister(util.APIMetrics()...)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.Handle(util.ConfigPath, util.ConfigHandler(effective))
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
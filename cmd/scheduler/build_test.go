@@ -0,0 +1,52 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// TestBuildWithoutCgo builds the scheduler without cgo, natively and for arm64
+// control-plane nodes, which fails if anything it imports links NVML, and runs the
+// native binary.
+func TestBuildWithoutCgo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the scheduler")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+	dir := t.TempDir()
+	for _, arch := range []string{runtime.GOARCH, "arm64"} {
+		cmd := exec.Command(goBin, "build", "-o", filepath.Join(dir, "scheduler-"+arch), ".")
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOARCH="+arch)
+		out, err := cmd.CombinedOutput()
+		assert.NilError(t, err, string(out))
+	}
+
+	out, err := exec.Command(filepath.Join(dir, "scheduler-"+runtime.GOARCH), "--help").CombinedOutput()
+	assert.NilError(t, err, string(out))
+	assert.Assert(t, strings.Contains(string(out), "--http_bind"), string(out))
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	schedulerv1beta2 "k8s.io/kube-scheduler/config/v1beta2"
+	"sigs.k8s.io/yaml"
+)
+
+// extenderOptions are the flags of print-extender-config.
+type extenderOptions struct {
+	schedulerName string
+	filterURL     string
+	bindURL       string
+	timeout       time.Duration
+	profiles      []string
+}
+
+// schedulerConfiguration is the part of a KubeSchedulerConfiguration the vGPU scheduler
+// needs, the upstream type has no omitempty on its other fields.
+type schedulerConfiguration struct {
+	APIVersion string                      `json:"apiVersion"`
+	Kind       string                      `json:"kind"`
+	Profiles   []schedulerProfile          `json:"profiles"`
+	Extenders  []schedulerv1beta2.Extender `json:"extenders"`
+}
+
+type schedulerProfile struct {
+	SchedulerName string `json:"schedulerName"`
+}
+
+func newPrintExtenderConfigCmd() *cobra.Command {
+	o := extenderOptions{
+		schedulerName: "4pd-scheduler",
+		filterURL:     "https://127.0.0.1:443",
+		timeout:       30 * time.Second,
+	}
+	cmd := &cobra.Command{
+		Use:   "print-extender-config",
+		Short: "print the KubeSchedulerConfiguration calling this scheduler as an extender",
+		Long: `Print the KubeSchedulerConfiguration of a kube-scheduler calling this scheduler as an
+extender, with the resources it manages, so kube-scheduler only calls it for pods asking for
+them. Pass the resource flags the scheduler runs with, and the profiles of the device plugins.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := yaml.Marshal(extenderConfig(o))
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&o.schedulerName, "scheduler-name", o.schedulerName, "the scheduler name of the kube-scheduler profile")
+	cmd.Flags().StringVar(&o.filterURL, "filter-url", o.filterURL, "the url kube-scheduler calls the filter of the extender at")
+	cmd.Flags().StringVar(&o.bindURL, "bind-url", "", "the url kube-scheduler calls the bind of the extender at, the filter url if empty")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", o.timeout, "timeout of the calls to the extender")
+	cmd.Flags().StringSliceVar(&o.profiles, "profiles", nil, "names of the device plugin profiles, whose GPUs are resources of their own")
+	return cmd
+}
+
+// extenderConfig returns the configuration of the extender at the urls of o, which
+// manages the vGPU and MLU resources, and ignores what the device plugins advertise.
+func extenderConfig(o extenderOptions) schedulerConfiguration {
+	names := []string{util.ResourceName}
+	for _, p := range o.profiles {
+		names = append(names, util.ProfileResourceName(p))
+	}
+	names = append(names, util.ResourceMem, util.ResourceCores, util.ResourceMemPercentage, util.ResourcePriority,
+		util.MLUResourceCount, util.MLUResourceMemory)
+	var managed []schedulerv1beta2.ExtenderManagedResource
+	for _, name := range names {
+		managed = append(managed, schedulerv1beta2.ExtenderManagedResource{Name: name, IgnoredByScheduler: true})
+	}
+	extender := func(url string) schedulerv1beta2.Extender {
+		return schedulerv1beta2.Extender{
+			URLPrefix:        url,
+			Weight:           1,
+			EnableHTTPS:      strings.HasPrefix(url, "https://"),
+			TLSConfig:        &schedulerv1beta2.ExtenderTLSConfig{Insecure: true},
+			HTTPTimeout:      metav1.Duration{Duration: o.timeout},
+			NodeCacheCapable: true,
+			ManagedResources: managed,
+		}
+	}
+	filter := extender(o.filterURL)
+	filter.FilterVerb = "filter"
+	c := schedulerConfiguration{
+		APIVersion: fmt.Sprint(schedulerv1beta2.SchemeGroupVersion),
+		Kind:       "KubeSchedulerConfiguration",
+		Profiles:   []schedulerProfile{{SchedulerName: o.schedulerName}},
+		Extenders:  []schedulerv1beta2.Extender{filter},
+	}
+	if o.bindURL == "" || o.bindURL == o.filterURL {
+		c.Extenders[0].BindVerb = "bind"
+		return c
+	}
+	bind := extender(o.bindURL)
+	bind.BindVerb = "bind"
+	c.Extenders = append(c.Extenders, bind)
+	return c
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	schedulerv1beta2 "k8s.io/kube-scheduler/config/v1beta2"
+	"sigs.k8s.io/yaml"
+)
+
+func TestExtenderConfig(t *testing.T) {
+	o := extenderOptions{schedulerName: "vgpu", filterURL: "https://127.0.0.1:443", timeout: 30 * time.Second, profiles: []string{"training"}}
+	c := extenderConfig(o)
+	assert.Equal(t, c.APIVersion, "kubescheduler.config.k8s.io/v1beta2")
+	assert.Equal(t, len(c.Extenders), 1)
+	e := c.Extenders[0]
+	assert.Equal(t, e.FilterVerb, "filter")
+	assert.Equal(t, e.BindVerb, "bind")
+	assert.Assert(t, e.EnableHTTPS && e.NodeCacheCapable)
+	var names []string
+	for _, r := range e.ManagedResources {
+		assert.Assert(t, r.IgnoredByScheduler, r.Name)
+		names = append(names, r.Name)
+	}
+	assert.DeepEqual(t, names, []string{"nvidia.com/gpu", "nvidia.com/gpu-training", "nvidia.com/gpumem", "nvidia.com/gpucores",
+		"nvidia.com/gpumem-percentage", "vgputaskpriority", "cambricon.com/mlunum", "cambricon.com/mlumem"})
+
+	o.bindURL = "http://vgpu-bind:8080"
+	c = extenderConfig(o)
+	assert.Equal(t, len(c.Extenders), 2)
+	assert.Equal(t, c.Extenders[0].BindVerb, "")
+	assert.Equal(t, c.Extenders[1].URLPrefix, "http://vgpu-bind:8080")
+	assert.Equal(t, c.Extenders[1].FilterVerb, "")
+	assert.Equal(t, c.Extenders[1].BindVerb, "bind")
+	assert.Assert(t, !c.Extenders[1].EnableHTTPS)
+}
+
+func TestPrintExtenderConfig(t *testing.T) {
+	cmd := newPrintExtenderConfigCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--scheduler-name", "vgpu", "--timeout", "10s"})
+	assert.NilError(t, cmd.Execute())
+	assert.Assert(t, strings.Contains(out.String(), "kind: KubeSchedulerConfiguration\n"), out.String())
+	// the output is read back by kube-scheduler
+	var c struct {
+		Profiles  []schedulerProfile          `json:"profiles"`
+		Extenders []schedulerv1beta2.Extender `json:"extenders"`
+	}
+	assert.NilError(t, yaml.Unmarshal(out.Bytes(), &c))
+	assert.Equal(t, c.Profiles[0].SchedulerName, "vgpu")
+	assert.Equal(t, c.Extenders[0].HTTPTimeout.Duration, 10*time.Second)
+}
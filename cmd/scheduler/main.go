@@ -16,15 +16,18 @@
 package main
 
 import (
-	"net/http"
+	"context"
+	"os/signal"
+	"syscall"
+	"time"
+	// the time zones of the schedule policy, the image may have none
+	_ "time/tzdata"
 
 	"4pd.io/k8s-vgpu/pkg/util"
 	"4pd.io/k8s-vgpu/pkg/version"
 
 	"4pd.io/k8s-vgpu/pkg/scheduler"
 	"4pd.io/k8s-vgpu/pkg/scheduler/config"
-	"4pd.io/k8s-vgpu/pkg/scheduler/routes"
-	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/cobra"
 	"k8s.io/klog/v2"
 )
@@ -38,50 +41,115 @@ var (
 	rootCmd     = &cobra.Command{
 		Use:   "scheduler",
 		Short: "kubernetes vgpu scheduler",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return util.SetResourcePrefix(util.ResourcePrefix)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			start()
 		},
 	}
 )
 
+// priorityMemoryScaling is parsed into config.PriorityMemoryScaling
+var priorityMemoryScaling map[string]string
+
 func init() {
 	rootCmd.Flags().SortFlags = false
 	rootCmd.PersistentFlags().SortFlags = false
 
+	rootCmd.Flags().StringSliceVar(&components, "components", []string{componentExtender, componentWebhook, componentMetrics}, "components served by this process, any of extender, filter, bind, webhook and metrics, extender is filter and bind")
 	rootCmd.Flags().StringVar(&config.HttpBind, "http_bind", "127.0.0.1:8080", "http server bind address")
+	rootCmd.Flags().StringVar(&webhookBind, "webhook_bind", "", "webhook bind address, shares the extender server if empty")
+	rootCmd.Flags().StringVar(&metricsBind, "metrics_bind", ":9395", "metrics bind address")
 	rootCmd.Flags().StringVar(&tlsCertFile, "cert_file", "", "tls cert file")
 	rootCmd.Flags().StringVar(&tlsKeyFile, "key_file", "", "tls key file")
 	rootCmd.Flags().StringVar(&config.SchedulerName, "scheduler-name", "", "the name to be added to pod.spec.schedulerName if not empty")
 	rootCmd.Flags().Int32Var(&config.DefaultMem, "default-mem", 5000, "default gpu device memory to allocate")
 	rootCmd.Flags().Int32Var(&config.DefaultCores, "default-cores", 0, "default gpu core percentage to allocate")
+	rootCmd.Flags().DurationVar(&config.BindTimeout, "bind-timeout", 10*time.Second, "timeout for the api server calls made while binding a pod")
+	rootCmd.Flags().IntVar(&config.BindWorkers, "bind-workers", 16, "the number of bind requests handled concurrently")
+	rootCmd.Flags().DurationVar(&config.NodeStatusInterval, "node-status-interval", 30*time.Second, "how often changed VGPUNodeStatus objects are written, 0 disables them")
+	rootCmd.Flags().BoolVar(&config.SliceRequests, "slice-requests", false, "charge containers asking for vgpus without memory the device memory divided by the split count, instead of the default memory")
+	rootCmd.Flags().Float64Var(&config.MaxMemoryScaling, "max-memory-scaling", 0, "the largest device memory scaling accepted from nodes, devices advertising more are capped, 0 disables the cap")
+	rootCmd.Flags().StringToStringVar(&priorityMemoryScaling, "priority-memory-scaling", nil, "the memory scaling pods of a priority class are scheduled against, by class name, e.g. high=1,low=2; 1 holds the class to the physical memory of the GPUs, classes not listed may use all the memory the GPUs advertise")
+	rootCmd.Flags().StringSliceVar(&config.GuaranteedPriorityClasses, "guaranteed-priority-classes", nil, "priority classes whose pods are only placed where the physical memory of the GPUs covers them, the device plugin tells their containers the guaranteed memory tier")
+	rootCmd.Flags().StringSliceVar(&config.BestEffortPriorityClasses, "besteffort-priority-classes", nil, "priority classes whose pods may use all the memory the GPUs advertise with a memory scaling above 1, the device plugin tells their containers the best-effort memory tier")
+	rootCmd.Flags().BoolVar(&config.FairSharing, "fair-sharing", false, "give freed gpus to the pending pods of the namespace using the least gpu memory first")
+	rootCmd.Flags().DurationVar(&config.FairSharingStarvationTimeout, "fair-sharing-starvation-timeout", 5*time.Minute, "how long a pod may be held back for fair sharing")
+	rootCmd.Flags().IntVar(&config.PlacementHistorySize, "placement-history-size", 16, "how many placement keys the devices are remembered of on each node, to place pods with the same key on them again, 0 disables placement keys")
+	rootCmd.Flags().StringVar(&config.NamespaceQuotaConfigMap, "namespace-quota-configmap", "", "namespace/name of the ConfigMap with the GPU memory in MiB each namespace may be assigned on a node, keyed by namespace, empty disables quotas")
+	rootCmd.Flags().BoolVar(&config.GPUNodeAffinity, "gpu-node-affinity", false, "have the webhook require the node label the device plugin sets on GPU nodes in the node affinity of pods asking for vGPUs, so kube-scheduler filters out other nodes before calling the extender. Enable it once every device plugin sets the label")
+	rootCmd.Flags().StringVar(&config.UnmanagedGPUEnv, "unmanaged-gpu-env", scheduler.UnmanagedGPUEnvReject, "what the webhook does with containers setting NVIDIA_VISIBLE_DEVICES or NVIDIA_DRIVER_CAPABILITIES without asking for vGPUs, which would get GPUs past the accounting:\n\t\t[reject | strip | allow]")
+	rootCmd.Flags().Float64Var(&config.ScoreWeightSpread, "score-weight-spread", config.ScoreWeightSpread, "weight of the share of slices free on the GPUs a pod would get in the score of a node, negative to binpack")
+	rootCmd.Flags().Float64Var(&config.ScoreWeightDevices, "score-weight-devices", config.ScoreWeightDevices, "weight of the number of GPUs a pod would leave to others in the score of a node")
+	rootCmd.Flags().Float64Var(&config.ScoreWeightPlacement, "score-weight-placement", config.ScoreWeightPlacement, "weight of the share of GPUs pods with the placement key of a pod got lately in the score of a node")
+	rootCmd.Flags().Float64Var(&config.ScoreWeightModel, "score-weight-model", config.ScoreWeightModel, "weight of the share of GPUs of the model listed first in the use-gputype annotation of a pod in the score of a node")
+	rootCmd.Flags().Float64Var(&config.ScoreWeightTopology, "score-weight-topology", config.ScoreWeightTopology, "weight of how well the GPUs a pod would get for each of its multi-GPU containers are connected, e.g. by NVLink, in the score of a node")
+	rootCmd.Flags().BoolVar(&config.AllowZeroMemory, "allow-zero-memory", false, "grant containers setting the device memory to 0 the zero memory floor on each GPU, instead of rejecting their pods")
+	rootCmd.Flags().Int32Var(&config.ZeroMemoryFloor, "zero-memory-floor", config.ZeroMemoryFloor, "the device memory in MiB granted with --allow-zero-memory")
+	rootCmd.Flags().BoolVar(&util.RedactTenantInfo, "redact-tenant-info", false, "log hashes instead of the namespaces and names of pods, also in events and traces")
+	rootCmd.Flags().StringVar(&config.DRADriverName, "dra-driver-name", "", "allocate vGPUs to the resource.k8s.io/v1alpha2 ResourceClaims of the ResourceClasses with this driver name from the same devices as pods, empty disables it; needs --alpha-dra-claims")
+	rootCmd.Flags().BoolVar(&config.AlphaDRAClaims, "alpha-dra-claims", false, "enable the allocation of ResourceClaims (alpha): no kubelet plugin hands the devices of a claim to containers yet, claims only reserve them")
+	rootCmd.Flags().DurationVar(&config.EfficiencyWindow, "efficiency-window", config.EfficiencyWindow, "how long the usage device plugins report of containers is kept for the efficiency report")
+	rootCmd.Flags().Float64Var(&config.RightSizingSafetyFactor, "right-sizing-safety-factor", config.RightSizingSafetyFactor, "the factor of the peak usage of containers the efficiency report recommends as their requests")
+	rootCmd.Flags().DurationVar(&config.EfficiencyReportInterval, "efficiency-report-interval", config.EfficiencyReportInterval, "how often the metrics component logs the efficiency report, 0 only serves it")
+	rootCmd.Flags().Int64Var(&config.SelectionSeed, "selection-seed", 0, "seed of the random order of the nodes with the best score, to replay the choices of a simulation; 0 picks the first of them by name")
+	rootCmd.Flags().IntVar(&config.DebugPageLimit, "debug-page-limit", config.DebugPageLimit, "items the usage, pending demand and report endpoints serve per page unless the request sets limit, 0 serves all")
+	rootCmd.Flags().IntVar(&config.DebugResponseLimit, "debug-response-limit", config.DebugResponseLimit, "bytes of items after which the usage, pending demand and report endpoints end a page early, 0 disables the limit")
+	rootCmd.Flags().StringVar(&config.RequestProfileFile, "request-profile-file", "", "JSON file of the request profiles, e.g. small, pods ask for with the vgpu-profile annotation, read again when it changes; empty disables them")
+	rootCmd.Flags().StringVar(&config.SchedulePolicyFile, "schedule-policy-file", "", "JSON file of the time windows during which pods are preferred on or get to themselves some GPUs, read again when it changes; empty disables them")
+	rootCmd.Flags().DurationVar(&config.AllocationTimeout, "allocation-timeout", 2*time.Minute, "how long to wait for the device plugin to report the allocation of a bound pod before checking the pod's status, 0 disables it")
 	rootCmd.PersistentFlags().AddGoFlagSet(util.GlobalFlagSet())
 	rootCmd.AddCommand(version.VersionCmd)
+	rootCmd.AddCommand(util.NewConfigCmd("http://127.0.0.1:9395"))
+	rootCmd.AddCommand(newPurgeNodeCmd("http://127.0.0.1:9395"))
+	rootCmd.AddCommand(newPrintExtenderConfigCmd())
 }
 
 func start() {
+	if config.AllowZeroMemory && config.ZeroMemoryFloor <= 0 {
+		klog.Fatalf("zero memory floor %v isn't positive", config.ZeroMemoryFloor)
+	}
+	if err := scheduler.ParsePriorityMemoryScaling(priorityMemoryScaling); err != nil {
+		klog.Fatal(err)
+	}
+	if err := scheduler.ValidateMemoryTiers(); err != nil {
+		klog.Fatal(err)
+	}
 	sher = scheduler.NewScheduler()
-	sher.Start()
-	defer sher.Stop()
-
-	// start monitor metrics
-	go sher.RegisterFromNodeAnnotatons()
-	go initmetrics()
-
-	// start http server
-	router := httprouter.New()
-	router.POST("/filter", routes.PredicateRoute(sher))
-	router.POST("/bind", routes.Bind(sher))
-	router.POST("/webhook", routes.WebHookRoute())
-	klog.Info("listen on ", config.HttpBind)
-	if len(tlsCertFile) == 0 || len(tlsKeyFile) == 0 {
-		if err := http.ListenAndServe(config.HttpBind, router); err != nil {
-			klog.Fatal("Listen and Serve error, ", err)
-		}
-	} else {
-		if err := http.ListenAndServeTLS(config.HttpBind, tlsCertFile, tlsKeyFile, router); err != nil {
-			klog.Fatal("Listen and Serve error, ", err)
+	if config.SchedulePolicyFile != "" {
+		if err := sher.LoadSchedulePolicy(config.SchedulePolicyFile); err != nil {
+			klog.Fatal(err)
 		}
 	}
+	servers, err := newServers(sher)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	if err := listen(servers); err != nil {
+		klog.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// the webhook alone doesn't need the device state
+	if enabled(componentExtender) || enabled(componentFilter) || enabled(componentBind) || enabled(componentMetrics) {
+		sher.Start()
+		defer sher.Stop()
+		go sher.RegisterFromNodeAnnotatons()
+	}
+	if enabled(componentMetrics) && config.EfficiencyReportInterval > 0 {
+		go sher.LogEfficiency(ctx, config.EfficiencyReportInterval)
+	}
+	// claims are allocated where pods are filtered, to share the accounting of devices
+	if config.DRADriverName != "" && !config.AlphaDRAClaims {
+		klog.Warningf("--dra-driver-name %v ignored without --alpha-dra-claims, no kubelet plugin hands the devices of claims to containers", config.DRADriverName)
+	} else if config.DRADriverName != "" && (enabled(componentExtender) || enabled(componentFilter)) {
+		go sher.RunClaimController(ctx, config.DRADriverName)
+	}
+	if err := serve(ctx, servers); err != nil {
+		klog.Fatal("Listen and Serve error, ", err)
+	}
 }
 
 func main() {
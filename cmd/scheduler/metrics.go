@@ -2,15 +2,13 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 
+	"4pd.io/k8s-vgpu/pkg/scheduler"
+	"4pd.io/k8s-vgpu/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 // ClusterManager is an example for a system that might have been built without
@@ -53,11 +51,6 @@ type ClusterManagerCollector struct {
 	ClusterManager *ClusterManager
 }
 
-// Descriptors used by the ClusterManagerCollector below.
-var (
-	clientset *kubernetes.Clientset
-)
-
 // Describe is implemented with DescribeByCollect. That's possible because the
 // Collect method will always return the same two metrics with the same two
 // descriptors.
@@ -87,6 +80,11 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 		"Number of containers sharing this GPU",
 		[]string{"nodeid", "deviceuuid"}, nil,
 	)
+	nodevGPUSharedMaxDesc := prometheus.NewDesc(
+		"GPUDeviceSharedMax",
+		"Number of containers allowed to share this GPU",
+		[]string{"nodeid", "deviceuuid"}, nil,
+	)
 
 	nodeGPUCoreAllocatedDesc := prometheus.NewDesc(
 		"GPUDeviceCoreAllocated",
@@ -103,6 +101,11 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 		"GPU Memory Allocated Percentage on a certain GPU",
 		[]string{"nodeid", "deviceuuid"}, nil,
 	)
+	nodeGPUExclusive := prometheus.NewDesc(
+		"vgpu_device_exclusive_passthrough",
+		"1 if a pod got the whole GPU, dedicated or for exclusive passthrough",
+		[]string{"nodeid", "deviceuuid"}, nil,
+	)
 	nu := sher.InspectAllNodesUsage()
 	for nodeID, val := range *nu {
 		for _, devs := range val.Devices {
@@ -124,6 +127,12 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 				float64(devs.Used),
 				nodeID, devs.Id,
 			)
+			ch <- prometheus.MustNewConstMetric(
+				nodevGPUSharedMaxDesc,
+				prometheus.GaugeValue,
+				float64(devs.Shares()),
+				nodeID, devs.Id,
+			)
 
 			ch <- prometheus.MustNewConstMetric(
 				nodeGPUCoreAllocatedDesc,
@@ -143,6 +152,43 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 				float64(devs.Usedmem)/float64(devs.Totalmem),
 				nodeID, devs.Id,
 			)
+			exclusive := 0.0
+			if devs.Exclusive {
+				exclusive = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				nodeGPUExclusive,
+				prometheus.GaugeValue,
+				exclusive,
+				nodeID, devs.Id,
+			)
+		}
+	}
+
+	namespaceQuotaDesc := prometheus.NewDesc(
+		"vgpu_namespace_memory_quota_bytes",
+		"GPU memory the pods of a namespace may be assigned on each node",
+		[]string{"namespace"}, nil,
+	)
+	namespaceQuotaUsedDesc := prometheus.NewDesc(
+		"vgpu_namespace_memory_quota_used_bytes",
+		"GPU memory assigned to the pods of a namespace with a quota on a node",
+		[]string{"namespace", "nodeid"}, nil,
+	)
+	for _, q := range sher.NamespaceQuotas() {
+		ch <- prometheus.MustNewConstMetric(
+			namespaceQuotaDesc,
+			prometheus.GaugeValue,
+			float64(q.Quota)*float64(1024)*float64(1024),
+			q.Namespace,
+		)
+		for nodeID, used := range q.Used {
+			ch <- prometheus.MustNewConstMetric(
+				namespaceQuotaUsedDesc,
+				prometheus.GaugeValue,
+				float64(used)*float64(1024)*float64(1024),
+				q.Namespace, nodeID,
+			)
 		}
 	}
 
@@ -163,6 +209,9 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 	)
 	schedpods, _ := sher.GetScheduledPods()
 	for _, val := range schedpods {
+		if val.Claim {
+			continue
+		}
 		for ctridx, ctrval := range val.Devices {
 			for _, ctrdevval := range ctrval {
 				fmt.Println("Collecting", val.Namespace, val.NodeID, val.Name, ctrdevval.UUID, ctrdevval.Usedcores, ctrdevval.Usedmem)
@@ -217,26 +266,20 @@ func NewClusterManager(zone string, reg prometheus.Registerer) *ClusterManager {
 	return c
 }
 
-func initmetrics() {
+func metricsHandler(s *scheduler.Scheduler) http.Handler {
 	// Since we are dealing with custom Collector implementations, it might
 	// be a good idea to try it out with a pedantic registry.
 	fmt.Println("Initializing metrics...")
 	reg := prometheus.NewRegistry()
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
-	clientset, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
 
 	// Construct cluster managers. In real code, we would assign them to
 	// variables to then do something with them.
 	NewClusterManager("vGPU", reg)
 	//NewClusterManager("ca", reg)
+	reg.MustRegister(util.APIMetrics()...)
+	reg.MustRegister(scheduler.Metrics()...)
+	reg.MustRegister(scheduler.PendingDemandCollector(s))
+	reg.MustRegister(scheduler.EfficiencyCollector(s))
 
 	// Add the standard process and Go metrics to the custom registry.
 	//reg.MustRegister(
@@ -244,6 +287,5 @@ func initmetrics() {
 	//	prometheus.NewGoCollector(),
 	//)
 
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	log.Fatal(http.ListenAndServe(":9395", nil))
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 }
@@ -0,0 +1,51 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/client"
+	"github.com/spf13/cobra"
+)
+
+func newPurgeNodeCmd(endpoint string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "purge-node NODE",
+		Short: "make the running scheduler forget a decommissioned node",
+		Long: `Remove the devices the running scheduler registered for NODE, the annotations vGPU
+components wrote to the Node and its VGPUNodeStatus. Stop the device plugin on the node first,
+or it registers the node again.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client.New(endpoint)
+			if err != nil {
+				return err
+			}
+			removed, err := c.PurgeNode(cmd.Context(), args[0])
+			if err != nil {
+				return fmt.Errorf("purge node %v: %w", args[0], err)
+			}
+			for _, r := range removed {
+				fmt.Fprintf(cmd.OutOrStdout(), "%v: removed %v\n", args[0], r)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&endpoint, "endpoint", endpoint, "address of the running scheduler")
+	return cmd
+}
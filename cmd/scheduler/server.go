@@ -0,0 +1,195 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/scheduler/routes"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/julienschmidt/httprouter"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// componentExtender serves both componentFilter and componentBind, they can be
+	// enabled on their own to scale them apart behind distinct endpoints.
+	componentExtender = "extender"
+	componentFilter   = "filter"
+	componentBind     = "bind"
+	componentWebhook  = "webhook"
+	componentMetrics  = "metrics"
+
+	shutdownTimeout = 30 * time.Second
+)
+
+var (
+	components  []string
+	webhookBind string
+	metricsBind string
+)
+
+// server is a single listener, components configured with the same address share it.
+type server struct {
+	addr       string
+	tls        bool
+	components []string
+	router     *httprouter.Router
+	http       *http.Server
+	ln         net.Listener
+}
+
+func enabled(component string) bool {
+	for _, c := range components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// newServers groups the enabled components by bind address. An ephemeral port (":0")
+// always gets a listener of its own.
+func newServers(s *scheduler.Scheduler) ([]*server, error) {
+	var servers []*server
+	byAddr := make(map[string]*server)
+	get := func(addr string) *server {
+		if srv, ok := byAddr[addr]; ok {
+			return srv
+		}
+		router := httprouter.New()
+		router.Handler(http.MethodGet, scheduler.OpenAPIPath, scheduler.OpenAPIHandler())
+		srv := &server{addr: addr, router: router, http: &http.Server{Addr: addr, Handler: router}}
+		if !strings.HasSuffix(addr, ":0") {
+			byAddr[addr] = srv
+		}
+		servers = append(servers, srv)
+		return srv
+	}
+	useTLS := len(tlsCertFile) > 0 && len(tlsKeyFile) > 0
+	seen := make(map[string]bool)
+	for _, c := range components {
+		if seen[c] {
+			return nil, fmt.Errorf("component %q enabled twice", c)
+		}
+		seen[c] = true
+		if seen[componentExtender] && (seen[componentFilter] || seen[componentBind]) {
+			return nil, fmt.Errorf("component %q already serves %s and %s", componentExtender, componentFilter, componentBind)
+		}
+		var srv *server
+		switch c {
+		case componentExtender:
+			srv = get(config.HttpBind)
+			srv.tls = useTLS
+			srv.router.POST(scheduler.FilterPath, routes.PredicateRoute(s))
+			srv.router.POST(scheduler.BindPath, routes.Bind(s))
+		case componentFilter:
+			srv = get(config.HttpBind)
+			srv.tls = useTLS
+			srv.router.POST(scheduler.FilterPath, routes.PredicateRoute(s))
+		case componentBind:
+			srv = get(config.HttpBind)
+			srv.tls = useTLS
+			srv.router.POST(scheduler.BindPath, routes.Bind(s))
+		case componentWebhook:
+			addr := webhookBind
+			if len(addr) == 0 {
+				addr = config.HttpBind
+			}
+			srv = get(addr)
+			srv.tls = useTLS
+			srv.router.POST(scheduler.WebhookPath, routes.WebHookRoute())
+		case componentMetrics:
+			srv = get(metricsBind)
+			srv.router.Handler(http.MethodGet, scheduler.MetricsPath, metricsHandler(s))
+			srv.router.Handler(http.MethodGet, scheduler.PendingDemandPath, scheduler.PendingDemandHandler(s))
+			srv.router.Handler(http.MethodGet, scheduler.EfficiencyReportPath, scheduler.EfficiencyReportHandler(s))
+			srv.router.Handler(http.MethodGet, scheduler.UsagePath, scheduler.UsageHandler(s))
+			srv.router.DELETE(scheduler.PurgeNodePath+":node", routes.PurgeNode(s))
+			srv.router.Handler(http.MethodGet, util.ConfigPath, util.ConfigHandler(func() interface{} {
+				return config.Effective()
+			}))
+		default:
+			return nil, fmt.Errorf("unknown component %q, must be one of %s, %s, %s, %s, %s",
+				c, componentExtender, componentFilter, componentBind, componentWebhook, componentMetrics)
+		}
+		srv.components = append(srv.components, c)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no component enabled")
+	}
+	return servers, nil
+}
+
+// listen opens all listeners up front, so a component that can't bind its address
+// fails the whole process before anything is served.
+func listen(servers []*server) error {
+	for i, srv := range servers {
+		ln, err := net.Listen("tcp", srv.addr)
+		if err != nil {
+			for _, opened := range servers[:i] {
+				opened.ln.Close()
+			}
+			return fmt.Errorf("listen on %s for %v: %w", srv.addr, srv.components, err)
+		}
+		srv.ln = ln
+	}
+	return nil
+}
+
+// serve runs all servers until ctx is done or one of them fails, then drains them all.
+func serve(ctx context.Context, servers []*server) error {
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *server) {
+			klog.Infof("listen on %s for %v", srv.ln.Addr(), srv.components)
+			var err error
+			if srv.tls {
+				err = srv.http.ServeTLS(srv.ln, tlsCertFile, tlsKeyFile)
+			} else {
+				err = srv.http.Serve(srv.ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("serve %v: %w", srv.components, err)
+			}
+		}(srv)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		klog.Info("shutting down http servers")
+	case err = <-errCh:
+		klog.Errorf("%v, shutting down http servers", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if serr := srv.http.Shutdown(shutdownCtx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+const admissionReview = `{
+	"apiVersion": "admission.k8s.io/v1",
+	"kind": "AdmissionReview",
+	"request": {
+		"uid": "1",
+		"kind": {"group": "", "version": "v1", "kind": "Pod"},
+		"resource": {"group": "", "version": "v1", "resource": "pods"},
+		"operation": "CREATE",
+		"object": {"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "p"}, "spec": {"containers": [{"name": "c", "image": "busybox"}]}}
+	}
+}`
+
+func setupComponents(t *testing.T, enabled ...string) {
+	oldComponents, oldHttpBind, oldWebhookBind, oldMetricsBind := components, config.HttpBind, webhookBind, metricsBind
+	t.Cleanup(func() {
+		components, config.HttpBind, webhookBind, metricsBind = oldComponents, oldHttpBind, oldWebhookBind, oldMetricsBind
+	})
+	components = enabled
+	config.HttpBind = "127.0.0.1:0"
+	webhookBind = "127.0.0.1:0"
+	metricsBind = "127.0.0.1:0"
+}
+
+func TestServeAllComponents(t *testing.T) {
+	setupComponents(t, componentExtender, componentWebhook, componentMetrics)
+	sher = scheduler.NewScheduler()
+	servers, err := newServers(sher)
+	assert.NilError(t, err)
+	assert.Equal(t, len(servers), 3)
+	assert.NilError(t, listen(servers))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, servers) }()
+
+	resp, err := http.Post("http://"+servers[0].ln.Addr().String()+"/filter", "application/json",
+		strings.NewReader(`{"Pod": {"metadata": {"name": "p"}}, "NodeNames": ["node1"]}`))
+	assert.NilError(t, err)
+	var filterResult extenderv1.ExtenderFilterResult
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&filterResult))
+	resp.Body.Close()
+	assert.DeepEqual(t, *filterResult.NodeNames, []string{"node1"})
+
+	resp, err = http.Post("http://"+servers[1].ln.Addr().String()+"/webhook", "application/json",
+		strings.NewReader(admissionReview))
+	assert.NilError(t, err)
+	var review admissionv1.AdmissionReview
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&review))
+	resp.Body.Close()
+	assert.Assert(t, review.Response.Allowed)
+
+	resp, err = http.Get("http://" + servers[2].ln.Addr().String() + "/metrics")
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	for _, s := range servers {
+		resp, err = http.Get("http://" + s.ln.Addr().String() + scheduler.OpenAPIPath)
+		assert.NilError(t, err)
+		var doc struct {
+			Paths map[string]interface{} `json:"paths"`
+		}
+		assert.NilError(t, json.NewDecoder(resp.Body).Decode(&doc))
+		resp.Body.Close()
+		assert.Equal(t, len(doc.Paths), len(scheduler.OpenAPI().Paths))
+	}
+
+	var out bytes.Buffer
+	cmd := util.NewConfigCmd("http://" + servers[2].ln.Addr().String())
+	cmd.SetOut(&out)
+	cmd.SetArgs(nil)
+	assert.NilError(t, cmd.Execute())
+	var effective config.EffectiveConfig
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &effective))
+	assert.DeepEqual(t, effective, *config.Effective())
+
+	out.Reset()
+	cmd = newPurgeNodeCmd("http://" + servers[2].ln.Addr().String())
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"node1"})
+	assert.NilError(t, cmd.Execute())
+	assert.Equal(t, out.String(), "")
+
+	cancel()
+	assert.NilError(t, <-done)
+}
+
+func TestListenFailsWhenAddressInUse(t *testing.T) {
+	setupComponents(t, componentWebhook, componentMetrics)
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer busy.Close()
+	metricsBind = busy.Addr().String()
+
+	servers, err := newServers(scheduler.NewScheduler())
+	assert.NilError(t, err)
+	assert.ErrorContains(t, listen(servers), "metrics")
+	// the webhook listener opened before the failure is released again
+	ln, err := net.Listen("tcp", servers[0].ln.Addr().String())
+	assert.NilError(t, err)
+	ln.Close()
+}
+
+func TestNewServersRejectsUnknownComponent(t *testing.T) {
+	setupComponents(t, componentExtender, "dashboard")
+	_, err := newServers(scheduler.NewScheduler())
+	assert.ErrorContains(t, err, "unknown component")
+}
+
+func TestServeFilterAndBindApart(t *testing.T) {
+	setupComponents(t, componentFilter)
+	servers, err := newServers(scheduler.NewScheduler())
+	assert.NilError(t, err)
+	assert.NilError(t, listen(servers))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, servers) }()
+
+	addr := "http://" + servers[0].ln.Addr().String()
+	resp, err := http.Post(addr+"/filter", "application/json",
+		strings.NewReader(`{"Pod": {"metadata": {"name": "p"}}, "NodeNames": ["node1"]}`))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	resp, err = http.Post(addr+"/bind", "application/json", strings.NewReader(`{}`))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	cancel()
+	assert.NilError(t, <-done)
+
+	setupComponents(t, componentExtender, componentBind)
+	_, err = newServers(scheduler.NewScheduler())
+	assert.ErrorContains(t, err, "already serves")
+}
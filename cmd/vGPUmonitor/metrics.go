@@ -98,6 +98,9 @@ func (cc ClusterManagerCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- ctrvGPUdesc
 	ch <- ctrvGPUlimitdesc
 	ch <- hostGPUUtilizationdesc
+	ch <- podGPUMemorydesc
+	ch <- podGPUProcessesdesc
+	ch <- unmanagedGPUProcessesdesc
 	//prometheus.DescribeByCollect(cc, ch)
 }
 
@@ -153,6 +156,7 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 		}
 		devnum, err := nvml.GetDeviceCount()
 		var ii uint
+		var procs []gpuProcess
 		if err != nil {
 			fmt.Println("nvml GetDeviceCount err=", err.Error())
 		} else {
@@ -161,6 +165,11 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 				if err != nil {
 					fmt.Println(err.Error())
 				}
+				devprocs, err := deviceProcesses(hdev)
+				if err != nil {
+					fmt.Println("processes error", err.Error())
+				}
+				procs = append(procs, devprocs...)
 				hstatus, err := hdev.Status()
 				if err != nil {
 					fmt.Println("hstatus error", err.Error())
@@ -188,6 +197,8 @@ func (cc ClusterManagerCollector) Collect(ch chan<- prometheus.Metric) {
 		pods, err := clientset.CoreV1().Pods("").List(context.TODO(), v1.ListOptions{})
 		if err != nil {
 			fmt.Println("err=", err.Error())
+		} else {
+			collectPodGPUUsage(ch, procs, pods.Items)
 		}
 		for _, val := range pods.Items {
 			for sridx := range srPodList {
@@ -276,6 +287,7 @@ func initmetrics() {
 		fmt.Println(err.Error())
 		return
 	}
+	unmanaged = newUnmanagedReporter(clientset)
 
 	// Construct cluster managers. In real code, we would assign them to
 	// variables to then do something with them.
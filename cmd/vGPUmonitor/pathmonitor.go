@@ -28,10 +28,17 @@ var lock sync.Mutex
 
 func checkfiles(fpath string) (*sharedRegionT, error) {
 	fmt.Println("Checking path", fpath)
-	files, err := ioutil.ReadDir(fpath)
+	entries, err := ioutil.ReadDir(fpath)
 	if err != nil {
 		return nil, err
 	}
+	// the device plugin keeps the generation and the heartbeat next to the cache file
+	var files []os.FileInfo
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".cache") {
+			files = append(files, e)
+		}
+	}
 	if len(files) > 1 {
 		return nil, errors.New("cache num not matched")
 	}
@@ -39,7 +46,6 @@ func checkfiles(fpath string) (*sharedRegionT, error) {
 		return nil, nil
 	}
 	for _, val := range files {
-		strings.Contains(val.Name(), ".cache")
 		cachefile := fpath + "/" + val.Name()
 		nc := nvidiaCollector{
 			cudevshrPath: cachefile,
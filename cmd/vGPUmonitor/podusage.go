@@ -0,0 +1,173 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	podGPUMemorydesc = prometheus.NewDesc(
+		"vgpu_pod_gpu_memory_usage_bytes",
+		"GPU memory used by the processes of a container as reported by NVML",
+		[]string{"namespace", "pod", "container", "deviceuuid"}, nil,
+	)
+	podGPUProcessesdesc = prometheus.NewDesc(
+		"vgpu_pod_gpu_processes",
+		"Number of processes of a container running on a GPU",
+		[]string{"namespace", "pod", "container", "deviceuuid"}, nil,
+	)
+)
+
+// containerIDPattern matches the container id at the end of a cgroup path, both for
+// cgroupfs (/kubepods/burstable/pod<uid>/<id>) and systemd (cri-containerd-<id>.scope).
+var containerIDPattern = regexp.MustCompile(`([0-9a-f]{64})(\.scope)?$`)
+
+type gpuProcess struct {
+	pid        uint
+	deviceUUID string
+	memory     uint64
+}
+
+type containerRef struct {
+	namespace string
+	pod       string
+	container string
+}
+
+type podGPUUsage struct {
+	containerRef
+	deviceUUID string
+	memory     uint64
+	processes  int
+}
+
+// containerIDFromCgroup returns the container id found in the content of /proc/<pid>/cgroup.
+func containerIDFromCgroup(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if m := containerIDPattern.FindStringSubmatch(fields[2]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func processContainerID(pid uint) (string, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	return containerIDFromCgroup(string(content)), nil
+}
+
+// podContainers indexes the running containers of pods by container id, without the
+// runtime prefix of ContainerStatus.ContainerID.
+func podContainers(pods []corev1.Pod) map[string]containerRef {
+	res := make(map[string]containerRef)
+	for _, p := range pods {
+		for _, s := range p.Status.ContainerStatuses {
+			i := strings.Index(s.ContainerID, "://")
+			if i < 0 {
+				continue
+			}
+			res[s.ContainerID[i+3:]] = containerRef{namespace: p.Namespace, pod: p.Name, container: s.Name}
+		}
+	}
+	return res
+}
+
+// aggregatePodGPUUsage sums the GPU processes per container and device, processes not
+// belonging to a pod are skipped.
+func aggregatePodGPUUsage(procs []gpuProcess, pods []corev1.Pod, containerID func(pid uint) (string, error)) []podGPUUsage {
+	containers := podContainers(pods)
+	index := make(map[string]int)
+	var res []podGPUUsage
+	for _, proc := range procs {
+		id, err := containerID(proc.pid)
+		if err != nil || id == "" {
+			continue
+		}
+		ref, ok := containers[id]
+		if !ok {
+			continue
+		}
+		key := id + "/" + proc.deviceUUID
+		i, ok := index[key]
+		if !ok {
+			i = len(res)
+			index[key] = i
+			res = append(res, podGPUUsage{containerRef: ref, deviceUUID: proc.deviceUUID})
+		}
+		res[i].memory += proc.memory
+		res[i].processes++
+	}
+	return res
+}
+
+func deviceProcesses(dev *nvml.Device) ([]gpuProcess, error) {
+	infos, err := dev.GetAllRunningProcesses()
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]gpuProcess, 0, len(infos))
+	for _, info := range infos {
+		// NVML reports MiB
+		procs = append(procs, gpuProcess{pid: info.PID, deviceUUID: dev.UUID, memory: info.MemoryUsed * 1024 * 1024})
+	}
+	return procs, nil
+}
+
+func collectPodGPUUsage(ch chan<- prometheus.Metric, procs []gpuProcess, pods []corev1.Pod) {
+	usage := aggregatePodGPUUsage(procs, pods, processContainerID)
+	for _, u := range usage {
+		ch <- prometheus.MustNewConstMetric(
+			podGPUMemorydesc,
+			prometheus.GaugeValue,
+			float64(u.memory),
+			u.namespace, u.pod, u.container, u.deviceUUID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			podGPUProcessesdesc,
+			prometheus.GaugeValue,
+			float64(u.processes),
+			u.namespace, u.pod, u.container, u.deviceUUID,
+		)
+	}
+	outside := unmanagedGPUUsage(usage, pods)
+	for _, u := range outside {
+		ch <- prometheus.MustNewConstMetric(
+			unmanagedGPUProcessesdesc,
+			prometheus.GaugeValue,
+			float64(u.processes),
+			u.namespace, u.pod, u.container, u.deviceUUID,
+		)
+	}
+	if unmanaged != nil {
+		unmanaged.report(outside, pods)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testContainerID = "3f1c2a9b8e7d6c5b4a3f2e1d0c9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b"
+
+func TestContainerIDFromCgroup(t *testing.T) {
+	for name, content := range map[string]string{
+		"cgroupfs": "12:devices:/kubepods/burstable/pod0b6c1a2e-uid/" + testContainerID + "\n",
+		"systemd":  "0::/kubepods.slice/kubepods-besteffort.slice/cri-containerd-" + testContainerID + ".scope\n",
+		"docker":   "4:memory:/system.slice/docker-" + testContainerID + ".scope\n1:name=systemd:/",
+	} {
+		assert.Equal(t, containerIDFromCgroup(content), testContainerID, name)
+	}
+	assert.Equal(t, containerIDFromCgroup("0::/user.slice/user-0.slice/session-1.scope\n"), "")
+}
+
+func TestAggregatePodGPUUsage(t *testing.T) {
+	pods := []corev1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default"},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "c", ContainerID: "containerd://" + testContainerID},
+		}},
+	}}
+	procs := []gpuProcess{
+		{pid: 1, deviceUUID: "GPU-0", memory: 100},
+		{pid: 2, deviceUUID: "GPU-0", memory: 200},
+		{pid: 2, deviceUUID: "GPU-1", memory: 50},
+		// not a container
+		{pid: 3, deviceUUID: "GPU-0", memory: 400},
+		// gone before its cgroup was read
+		{pid: 4, deviceUUID: "GPU-0", memory: 800},
+	}
+	containerID := func(pid uint) (string, error) {
+		switch pid {
+		case 1, 2:
+			return testContainerID, nil
+		case 3:
+			return "", nil
+		}
+		return "", errors.New("no such process")
+	}
+	ref := containerRef{namespace: "default", pod: "p", container: "c"}
+	assert.DeepEqual(t, aggregatePodGPUUsage(procs, pods, containerID), []podGPUUsage{
+		{containerRef: ref, deviceUUID: "GPU-0", memory: 300, processes: 2},
+		{containerRef: ref, deviceUUID: "GPU-1", memory: 50, processes: 1},
+	}, cmp.AllowUnexported(podGPUUsage{}, containerRef{}))
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+var unmanagedGPUProcessesdesc = prometheus.NewDesc(
+	"vgpu_unmanaged_gpu_processes",
+	"Number of processes of a container running on a GPU vGPU didn't allocate to it",
+	[]string{"namespace", "pod", "container", "deviceuuid"}, nil,
+)
+
+// unmanagedReason is the reason of the events about containers using GPUs outside vGPU accounting.
+const unmanagedReason = "UnmanagedGPUUsage"
+
+// allocatedDevices returns the UUIDs of the GPUs assigned to each container, by the
+// scheduler or as reported by the device plugin.
+func allocatedDevices(pods []corev1.Pod) map[containerRef]map[string]bool {
+	res := make(map[containerRef]map[string]bool)
+	for _, p := range pods {
+		for _, anno := range []string{util.AssignedIDsAnnotations, util.AllocatedIDsAnnotations} {
+			pd, err := annotations.DecodePodDevices(p.Annotations[anno])
+			if err != nil {
+				continue
+			}
+			for i, devs := range pd {
+				if i >= len(p.Spec.Containers) {
+					break
+				}
+				ref := containerRef{namespace: p.Namespace, pod: p.Name, container: p.Spec.Containers[i].Name}
+				for _, d := range devs {
+					if res[ref] == nil {
+						res[ref] = make(map[string]bool)
+					}
+					res[ref][d.UUID] = true
+				}
+			}
+		}
+	}
+	return res
+}
+
+// unmanagedGPUUsage returns the usage of the containers on GPUs they weren't allocated,
+// e.g. through NVIDIA_VISIBLE_DEVICES=all without asking for vGPUs.
+func unmanagedGPUUsage(usage []podGPUUsage, pods []corev1.Pod) []podGPUUsage {
+	allocated := allocatedDevices(pods)
+	var res []podGPUUsage
+	for _, u := range usage {
+		if !allocated[u.containerRef][u.deviceUUID] {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// unmanagedReporter reports each container using a GPU outside vGPU accounting once with
+// an event on its pod, until it stops using the GPU.
+type unmanagedReporter struct {
+	mu       sync.Mutex
+	recorder record.EventRecorder
+	reported map[string]bool
+}
+
+var unmanaged *unmanagedReporter
+
+func newUnmanagedReporter(client kubernetes.Interface) *unmanagedReporter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &unmanagedReporter{
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "vgpu-monitor", Host: os.Getenv("NODE_NAME")}),
+		reported: make(map[string]bool),
+	}
+}
+
+func (r *unmanagedReporter) report(usage []podGPUUsage, pods []corev1.Pod) {
+	byName := make(map[string]*corev1.Pod, len(pods))
+	for i := range pods {
+		byName[pods[i].Namespace+"/"+pods[i].Name] = &pods[i]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, u := range usage {
+		key := fmt.Sprintf("%v/%v/%v/%v", u.namespace, u.pod, u.container, u.deviceUUID)
+		seen[key] = true
+		pod, ok := byName[u.namespace+"/"+u.pod]
+		if r.reported[key] || !ok {
+			continue
+		}
+		r.reported[key] = true
+		r.recorder.Eventf(pod, corev1.EventTypeWarning, unmanagedReason,
+			"container %v runs %d processes on GPU %v, which vGPU didn't allocate to it, they are not accounted", u.container, u.processes, u.deviceUUID)
+	}
+	for key := range r.reported {
+		if !seen[key] {
+			delete(r.reported, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/google/go-cmp/cmp"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestUnmanagedGPUUsage(t *testing.T) {
+	assigned := annotations.EncodePodDevices(annotations.PodDevices{{{UUID: "GPU-0", Type: "NVIDIA", Usedmem: 1000}}, {}})
+	pods := []corev1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Name: "train", Namespace: "default", Annotations: map[string]string{util.AssignedIDsAnnotations: assigned}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "vgpu"}, {Name: "sidecar"}}},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Name: "sneaky", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	}}
+	vgpu := containerRef{namespace: "default", pod: "train", container: "vgpu"}
+	sidecar := containerRef{namespace: "default", pod: "train", container: "sidecar"}
+	sneaky := containerRef{namespace: "default", pod: "sneaky", container: "c"}
+	usage := []podGPUUsage{
+		{containerRef: vgpu, deviceUUID: "GPU-0", processes: 1},
+		// a GPU the container wasn't allocated
+		{containerRef: vgpu, deviceUUID: "GPU-1", processes: 1},
+		{containerRef: sidecar, deviceUUID: "GPU-0", processes: 2},
+		{containerRef: sneaky, deviceUUID: "GPU-0", processes: 1},
+	}
+	outside := unmanagedGPUUsage(usage, pods)
+	assert.DeepEqual(t, outside, usage[1:], cmp.AllowUnexported(podGPUUsage{}, containerRef{}))
+
+	recorder := record.NewFakeRecorder(10)
+	r := &unmanagedReporter{recorder: recorder, reported: make(map[string]bool)}
+	r.report(outside, pods)
+	assert.Equal(t, len(recorder.Events), 3)
+	assert.Equal(t, <-recorder.Events, "Warning UnmanagedGPUUsage container vgpu runs 1 processes on GPU GPU-1, which vGPU didn't allocate to it, they are not accounted")
+	<-recorder.Events
+	<-recorder.Events
+
+	// reported once while the usage lasts, and again when it comes back
+	r.report(outside, pods)
+	assert.Equal(t, len(recorder.Events), 0)
+	r.report(outside[:2], pods)
+	assert.Equal(t, len(recorder.Events), 0)
+	r.report(outside, pods)
+	assert.Equal(t, <-recorder.Events, "Warning UnmanagedGPUUsage container c runs 1 processes on GPU GPU-0, which vGPU didn't allocate to it, they are not accounted")
+}
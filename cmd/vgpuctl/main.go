@@ -0,0 +1,43 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/version"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "vgpuctl",
+	Short: "operate the vgpu components of a node",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return util.SetResourcePrefix(util.ResourcePrefix)
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().AddGoFlagSet(util.GlobalFlagSet())
+	rootCmd.AddCommand(version.VersionCmd)
+	rootCmd.AddCommand(newPlanCmd())
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		klog.Fatal(err)
+	}
+}
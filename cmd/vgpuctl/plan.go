@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/plan"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// planPath is served on the runtime socket of the device plugin.
+const planPath = "/plan"
+
+// newClient connects to the API server for --apply, tests replace it.
+var newClient = util.NewClient
+
+// planOptions are the flags of the plan command, splitCount and memoryScaling are the
+// settings to plan, 0 keeps the current one.
+type planOptions struct {
+	splitCount    uint
+	memoryScaling float64
+	socket        string
+	node          string
+	apply         bool
+	force         bool
+}
+
+func newPlanCmd() *cobra.Command {
+	var opts planOptions
+	cmd := &cobra.Command{
+		Use:   "plan",
+		Short: "show what changing the split count or memory scaling of a node does to its running containers",
+		Long: `Ask the device plugin on the runtime socket for the capacity every GPU of the node would
+be advertised with under a new --device-split-count and --device-memory-scaling, the containers
+that wouldn't fit it, and whether the change is safe. With --apply, a safe change is written to
+the node annotations overriding the settings, which the device plugin reads on SIGHUP or restart;
+--force writes an unsafe change too.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPlan(cmd.Context(), cmd.OutOrStdout(), opts)
+		},
+	}
+	cmd.Flags().UintVar(&opts.splitCount, "device-split-count", 0, "the split count to plan, 0 keeps the current one")
+	cmd.Flags().Float64Var(&opts.memoryScaling, "device-memory-scaling", 0, "the memory scaling to plan, 0 keeps the current one")
+	cmd.Flags().StringVar(&opts.socket, "runtime-socket", "/var/lib/vgpu/vgpu.sock", "runtime socket of the device plugin")
+	cmd.Flags().StringVar(&opts.node, "node", os.Getenv("NODE_NAME"), "the node the device plugin runs on, for --apply")
+	cmd.Flags().BoolVar(&opts.apply, "apply", false, "write the settings to the node annotations if the change is safe")
+	cmd.Flags().BoolVar(&opts.force, "force", false, "with --apply, write the settings even if the change is unsafe")
+	return cmd
+}
+
+func runPlan(ctx context.Context, out io.Writer, opts planOptions) error {
+	if opts.splitCount == 0 && opts.memoryScaling == 0 {
+		return fmt.Errorf("--device-split-count or --device-memory-scaling is required")
+	}
+	if opts.apply && opts.node == "" {
+		return fmt.Errorf("--node or NODE_NAME is required with --apply")
+	}
+	res, err := fetchPlan(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := res.Write(out); err != nil {
+		return err
+	}
+	if !opts.apply {
+		return nil
+	}
+	if !res.Safe && !opts.force {
+		return fmt.Errorf("not applying an unsafe change without --force")
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := applyPlan(ctx, client, opts); err != nil {
+		return fmt.Errorf("annotate node %v: %v", opts.node, err)
+	}
+	fmt.Fprintf(out, "Annotated node %v, send SIGHUP to its device plugin or restart it to apply the change.\n", opts.node)
+	return nil
+}
+
+// fetchPlan asks the device plugin listening on opts.socket for the plan.
+func fetchPlan(ctx context.Context, opts planOptions) (plan.Plan, error) {
+	var res plan.Plan
+	query := url.Values{}
+	if opts.splitCount > 0 {
+		query.Set("deviceSplitCount", strconv.FormatUint(uint64(opts.splitCount), 10))
+	}
+	if opts.memoryScaling > 0 {
+		query.Set("deviceMemoryScaling", strconv.FormatFloat(opts.memoryScaling, 'g', -1, 64))
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", opts.socket)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+planPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return res, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return res, fmt.Errorf("plan: %v: %s", resp.Status, msg)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// applyPlan writes the settings of opts to the annotations of opts.node.
+func applyPlan(ctx context.Context, client kubernetes.Interface, opts planOptions) error {
+	annotations := map[string]string{}
+	if opts.splitCount > 0 {
+		annotations[util.DeviceSplitCountAnnotation] = strconv.FormatUint(uint64(opts.splitCount), 10)
+	}
+	if opts.memoryScaling > 0 {
+		annotations[util.DeviceMemoryScalingAnnotation] = strconv.FormatFloat(opts.memoryScaling, 'g', -1, 64)
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Nodes().Patch(ctx, opts.node, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/plan"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// servePlan answers the plan requests on a runtime socket with safe and records their queries.
+func servePlan(t *testing.T, safe bool, queries *[]string) string {
+	socket := filepath.Join(t.TempDir(), "vgpu.sock")
+	ln, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc(planPath, func(w http.ResponseWriter, r *http.Request) {
+		*queries = append(*queries, r.URL.RawQuery)
+		json.NewEncoder(w).Encode(plan.Plan{Devices: []plan.DevicePlan{{ID: "GPU-0"}}, Safe: safe})
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func TestRunPlan(t *testing.T) {
+	assert.NilError(t, util.SetResourcePrefix(util.DefaultResourcePrefix))
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	oldClient := newClient
+	t.Cleanup(func() { newClient = oldClient })
+	newClient = func() (kubernetes.Interface, error) { return client, nil }
+	ctx := context.Background()
+	annotations := func() map[string]string {
+		node, err := client.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+		assert.NilError(t, err)
+		return node.Annotations
+	}
+
+	var queries []string
+	opts := planOptions{splitCount: 4, memoryScaling: 1.5, socket: servePlan(t, false, &queries), node: "node1"}
+	var out strings.Builder
+	assert.NilError(t, runPlan(ctx, &out, opts))
+	assert.DeepEqual(t, queries, []string{"deviceMemoryScaling=1.5&deviceSplitCount=4"})
+	assert.Assert(t, strings.Contains(out.String(), "Unsafe to apply"), out.String())
+
+	// an unsafe change is only applied with --force
+	opts.apply = true
+	assert.ErrorContains(t, runPlan(ctx, &out, opts), "without --force")
+	assert.Equal(t, len(annotations()), 0)
+	opts.force = true
+	assert.NilError(t, runPlan(ctx, &out, opts))
+	assert.DeepEqual(t, annotations(), map[string]string{
+		util.DeviceSplitCountAnnotation:    "4",
+		util.DeviceMemoryScalingAnnotation: "1.5",
+	})
+
+	// a safe change is applied, the settings not planned are left as they are
+	queries = nil
+	opts = planOptions{splitCount: 2, socket: servePlan(t, true, &queries), node: "node1", apply: true}
+	out.Reset()
+	assert.NilError(t, runPlan(ctx, &out, opts))
+	assert.DeepEqual(t, queries, []string{"deviceSplitCount=2"})
+	assert.Assert(t, strings.Contains(out.String(), "Annotated node node1"), out.String())
+	assert.DeepEqual(t, annotations(), map[string]string{
+		util.DeviceSplitCountAnnotation:    "2",
+		util.DeviceMemoryScalingAnnotation: "1.5",
+	})
+
+	assert.ErrorContains(t, runPlan(ctx, &out, planOptions{socket: opts.socket}), "is required")
+	assert.ErrorContains(t, runPlan(ctx, &out, planOptions{splitCount: 2, socket: opts.socket, apply: true}), "--node")
+}
@@ -32,6 +32,9 @@ type DeviceInfo struct {
 	Devmem               int32    `protobuf:"varint,3,opt,name=devmem,proto3" json:"devmem,omitempty"`
 	Type                 string   `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
 	Health               bool     `protobuf:"varint,5,opt,name=health,proto3" json:"health,omitempty"`
+	Physmem              int32    `protobuf:"varint,6,opt,name=physmem,proto3" json:"physmem,omitempty"`
+	Maxshares            int32    `protobuf:"varint,7,opt,name=maxshares,proto3" json:"maxshares,omitempty"`
+	Overcommitted        bool     `protobuf:"varint,8,opt,name=overcommitted,proto3" json:"overcommitted,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -105,6 +108,27 @@ func (m *DeviceInfo) GetHealth() bool {
 	return false
 }
 
+func (m *DeviceInfo) GetPhysmem() int32 {
+	if m != nil {
+		return m.Physmem
+	}
+	return 0
+}
+
+func (m *DeviceInfo) GetMaxshares() int32 {
+	if m != nil {
+		return m.Maxshares
+	}
+	return 0
+}
+
+func (m *DeviceInfo) GetOvercommitted() bool {
+	if m != nil {
+		return m.Overcommitted
+	}
+	return false
+}
+
 type RegisterRequest struct {
 	Node                 string        `protobuf:"bytes,1,opt,name=node,proto3" json:"node,omitempty"`
 	Devices              []*DeviceInfo `protobuf:"bytes,2,rep,name=devices,proto3" json:"devices,omitempty"`
@@ -280,26 +304,29 @@ func init() {
 func init() { proto.RegisterFile("pkg/api/device_register.proto", fileDescriptor_f726eb77a5b37099) }
 
 var fileDescriptor_f726eb77a5b37099 = []byte{
-	// 297 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x91, 0xcd, 0x4a, 0xf3, 0x40,
-	0x14, 0x86, 0xbf, 0x49, 0x7f, 0xbe, 0x7a, 0x4a, 0x8d, 0x0c, 0x45, 0x06, 0xc1, 0x10, 0xb2, 0x8a,
-	0x9b, 0x14, 0x2a, 0x78, 0x01, 0x22, 0x88, 0x3b, 0x19, 0x71, 0x5d, 0x62, 0x73, 0x4c, 0x07, 0xd3,
-	0x64, 0x9c, 0x99, 0x06, 0x72, 0x27, 0x5e, 0x92, 0x4b, 0x2f, 0x41, 0xe2, 0x8d, 0x48, 0x26, 0x09,
-	0xc5, 0xea, 0x2a, 0xe7, 0x3d, 0x3f, 0x39, 0xcf, 0x7b, 0x06, 0xce, 0xe5, 0x4b, 0xba, 0x88, 0xa5,
-	0x58, 0x24, 0x58, 0x8a, 0x35, 0xae, 0x14, 0xa6, 0x42, 0x1b, 0x54, 0x91, 0x54, 0x85, 0x29, 0xe8,
-	0x20, 0x96, 0x22, 0x28, 0x01, 0x6e, 0x6c, 0xf5, 0x2e, 0x7f, 0x2e, 0xe8, 0x31, 0x38, 0x22, 0x61,
-	0xc4, 0x27, 0xe1, 0x11, 0x77, 0x44, 0x42, 0xe7, 0x30, 0x5a, 0x17, 0xbb, 0xdc, 0x30, 0xc7, 0x27,
-	0xe1, 0x88, 0xb7, 0x82, 0x9e, 0xc2, 0x38, 0xc1, 0x72, 0x8b, 0x5b, 0x36, 0xb0, 0xe9, 0x4e, 0x51,
-	0x0a, 0x43, 0x53, 0x49, 0x64, 0x43, 0x3b, 0x6f, 0xe3, 0xa6, 0x77, 0x83, 0x71, 0x66, 0x36, 0x6c,
-	0xe4, 0x93, 0x70, 0xc2, 0x3b, 0x15, 0xdc, 0x83, 0xcb, 0x3b, 0x1c, 0x8e, 0xaf, 0x3b, 0xd4, 0xa6,
-	0x19, 0xcf, 0x8b, 0x04, 0xbb, 0xf5, 0x36, 0xa6, 0x17, 0xf0, 0xbf, 0x85, 0xd7, 0xcc, 0xf1, 0x07,
-	0xe1, 0x74, 0xe9, 0x46, 0xb1, 0x14, 0xd1, 0x1e, 0x99, 0xf7, 0xf5, 0xc0, 0x85, 0xd9, 0xfe, 0x8f,
-	0x32, 0xab, 0x82, 0x15, 0x4c, 0xdb, 0xbe, 0x47, 0x1d, 0xa7, 0xf8, 0xcb, 0x5b, 0x4f, 0xeb, 0xfc,
-	0xa4, 0xfd, 0xd3, 0x99, 0xbd, 0x83, 0x42, 0x6d, 0xad, 0xd9, 0x3b, 0x28, 0xd4, 0xcb, 0x5b, 0x98,
-	0xb5, 0x0b, 0x1e, 0x50, 0x35, 0x1f, 0x7a, 0x05, 0x93, 0x1e, 0x81, 0xce, 0x2d, 0xe8, 0x81, 0xc7,
-	0x33, 0x7a, 0x90, 0x95, 0x59, 0x15, 0x92, 0xeb, 0x93, 0xf7, 0xda, 0x23, 0x1f, 0xb5, 0x47, 0x3e,
-	0x6b, 0x8f, 0xbc, 0x7d, 0x79, 0xff, 0x9e, 0xc6, 0xf6, 0x89, 0x2e, 0xbf, 0x03, 0x00, 0x00, 0xff,
-	0xff, 0xbb, 0x8c, 0x40, 0xc6, 0xc3, 0x01, 0x00, 0x00,
+	// 341 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0xcf, 0x4a, 0xeb, 0x40,
+	0x14, 0xc6, 0xef, 0xa4, 0xff, 0x4f, 0xe9, 0xed, 0x65, 0x28, 0x97, 0x41, 0x34, 0x84, 0xe0, 0x22,
+	0x6e, 0x5a, 0xa8, 0xe0, 0x03, 0x88, 0x20, 0xee, 0x24, 0xe2, 0xba, 0x8c, 0xcd, 0xb1, 0x19, 0x6c,
+	0x3a, 0xe3, 0xcc, 0xb4, 0x98, 0x37, 0xf1, 0x91, 0x5c, 0xba, 0xf0, 0x01, 0xa4, 0xbe, 0x88, 0x64,
+	0x92, 0x50, 0x5a, 0x5d, 0x65, 0xbe, 0xef, 0x4c, 0xbe, 0x9c, 0xef, 0x47, 0xe0, 0x44, 0x3d, 0x2d,
+	0x26, 0x5c, 0x89, 0x49, 0x82, 0x1b, 0x31, 0xc7, 0x99, 0xc6, 0x85, 0x30, 0x16, 0xf5, 0x58, 0x69,
+	0x69, 0x25, 0x6d, 0x70, 0x25, 0xc2, 0x0f, 0x02, 0x70, 0xe5, 0xc6, 0x37, 0xab, 0x47, 0x49, 0xff,
+	0x82, 0x27, 0x12, 0x46, 0x02, 0x12, 0xf5, 0x62, 0x4f, 0x24, 0x74, 0x04, 0xad, 0xb9, 0x5c, 0xaf,
+	0x2c, 0xf3, 0x02, 0x12, 0xb5, 0xe2, 0x52, 0xd0, 0xff, 0xd0, 0x4e, 0x70, 0x93, 0x61, 0xc6, 0x1a,
+	0xce, 0xae, 0x14, 0xa5, 0xd0, 0xb4, 0xb9, 0x42, 0xd6, 0x74, 0xef, 0xbb, 0x73, 0x71, 0x37, 0x45,
+	0xbe, 0xb4, 0x29, 0x6b, 0x05, 0x24, 0xea, 0xc6, 0x95, 0xa2, 0x0c, 0x3a, 0x2a, 0xcd, 0x4d, 0x11,
+	0xd2, 0x76, 0x21, 0xb5, 0xa4, 0xc7, 0xd0, 0xcb, 0xf8, 0x8b, 0x49, 0xb9, 0x46, 0xc3, 0x3a, 0x6e,
+	0xb6, 0x33, 0xe8, 0x29, 0x0c, 0xe4, 0x06, 0xf5, 0x5c, 0x66, 0x99, 0xb0, 0x16, 0x13, 0xd6, 0x75,
+	0xb1, 0xfb, 0x66, 0x78, 0x0b, 0xc3, 0xb8, 0x6a, 0x1b, 0xe3, 0xf3, 0x1a, 0x8d, 0x2d, 0x96, 0x5b,
+	0xc9, 0x04, 0xab, 0x72, 0xee, 0x4c, 0xcf, 0xa0, 0x53, 0xb2, 0x31, 0xcc, 0x0b, 0x1a, 0x51, 0x7f,
+	0x3a, 0x1c, 0x73, 0x25, 0xc6, 0x3b, 0x20, 0x71, 0x3d, 0x0f, 0x87, 0x30, 0xd8, 0x25, 0xaa, 0x65,
+	0x1e, 0xce, 0xa0, 0x5f, 0xde, 0xbb, 0x37, 0x7c, 0x81, 0x3f, 0xc8, 0xd5, 0x2c, 0xbc, 0x7d, 0x16,
+	0xbf, 0x72, 0x73, 0x94, 0x8b, 0xb6, 0xcd, 0x9a, 0xb2, 0x46, 0x33, 0xbd, 0x86, 0x41, 0xf9, 0x81,
+	0x3b, 0xd4, 0xc5, 0x83, 0x5e, 0x40, 0xb7, 0x5e, 0x81, 0x8e, 0xdc, 0xa2, 0x07, 0x1d, 0x8f, 0xe8,
+	0x81, 0xab, 0x96, 0x79, 0x44, 0x2e, 0xff, 0xbd, 0x6d, 0x7d, 0xf2, 0xbe, 0xf5, 0xc9, 0xe7, 0xd6,
+	0x27, 0xaf, 0x5f, 0xfe, 0x9f, 0x87, 0xb6, 0xfb, 0x03, 0xce, 0xbf, 0x07, 0x00, 0x38, 0x92, 0xa6,
+	0x55, 0x22, 0x02, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -440,6 +467,26 @@ func (m *DeviceInfo) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Overcommitted {
+		i--
+		if m.Overcommitted {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x40
+	}
+	if m.Maxshares != 0 {
+		i = encodeVarintDeviceRegister(dAtA, i, uint64(m.Maxshares))
+		i--
+		dAtA[i] = 0x38
+	}
+	if m.Physmem != 0 {
+		i = encodeVarintDeviceRegister(dAtA, i, uint64(m.Physmem))
+		i--
+		dAtA[i] = 0x30
+	}
 	if m.Health {
 		i--
 		if m.Health {
@@ -637,6 +684,15 @@ func (m *DeviceInfo) Size() (n int) {
 	if m.Health {
 		n += 2
 	}
+	if m.Physmem != 0 {
+		n += 1 + sovDeviceRegister(uint64(m.Physmem))
+	}
+	if m.Maxshares != 0 {
+		n += 1 + sovDeviceRegister(uint64(m.Maxshares))
+	}
+	if m.Overcommitted {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -860,6 +916,64 @@ func (m *DeviceInfo) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Health = bool(v != 0)
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Physmem", wireType)
+			}
+			m.Physmem = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDeviceRegister
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Physmem |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Maxshares", wireType)
+			}
+			m.Maxshares = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDeviceRegister
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Maxshares |= int32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Overcommitted", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDeviceRegister
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Overcommitted = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDeviceRegister(dAtA[iNdEx:])
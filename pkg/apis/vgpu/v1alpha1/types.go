@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VGPUNodeStatusSpec is empty, the object is named after the node it describes.
+type VGPUNodeStatusSpec struct{}
+
+// VGPUDeviceStatus is the sharing state of a single device.
+type VGPUDeviceStatus struct {
+	// ID is the device UUID.
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Health bool   `json:"health"`
+	// Capacity is the number of tasks the device can be shared by, the split count or
+	// the lower max shares the device plugin registered.
+	Capacity int32 `json:"capacity"`
+	// Allocated is the number of tasks the device is shared by.
+	Allocated int32 `json:"allocated"`
+	// TotalMemory and AllocatedMemory are in MiB.
+	TotalMemory     int32 `json:"totalMemory"`
+	AllocatedMemory int32 `json:"allocatedMemory"`
+	// AdvertisedMemory is the memory the device plugin reported, set only when the
+	// scheduler capped it to the cluster memory scaling limit in TotalMemory.
+	AdvertisedMemory int32 `json:"advertisedMemory,omitempty"`
+	// AllocatedCores is the sum of the core percentages allocated on the device.
+	AllocatedCores int32 `json:"allocatedCores"`
+	// Exclusive is set when a pod got the whole device, dedicated or for exclusive
+	// passthrough.
+	Exclusive bool `json:"exclusive,omitempty"`
+	// Drained is set while the device is drained for maintenance with the drain-device
+	// annotation of its node.
+	Drained bool `json:"drained,omitempty"`
+}
+
+// VGPUPlacementKey is a placement key pods were placed on the node with lately.
+type VGPUPlacementKey struct {
+	Key string `json:"key"`
+	// Devices are the UUIDs of the devices pods with the key were placed on, most recent first.
+	Devices []string `json:"devices,omitempty"`
+}
+
+// VGPUNodeStatusStatus summarizes the devices of a node and what is allocated on them.
+type VGPUNodeStatusStatus struct {
+	DeviceCount int32 `json:"deviceCount"`
+	// TotalMemory and AllocatedMemory are in MiB.
+	TotalMemory     int64              `json:"totalMemory"`
+	AllocatedMemory int64              `json:"allocatedMemory"`
+	Devices         []VGPUDeviceStatus `json:"devices,omitempty"`
+	// PlacementKeys are the placement keys used on the node lately, most recent first. The
+	// scheduler prefers their devices for pods with the same key, also after a restart.
+	PlacementKeys []VGPUPlacementKey `json:"placementKeys,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=vns
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Devices",type=integer,JSONPath=`.status.deviceCount`
+// +kubebuilder:printcolumn:name="Total Memory",type=integer,JSONPath=`.status.totalMemory`
+// +kubebuilder:printcolumn:name="Allocated Memory",type=integer,JSONPath=`.status.allocatedMemory`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VGPUNodeStatus reports the vGPU usage of the node with the same name.
+type VGPUNodeStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VGPUNodeStatusSpec   `json:"spec,omitempty"`
+	Status VGPUNodeStatusStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// VGPUNodeStatusList contains a list of VGPUNodeStatus.
+type VGPUNodeStatusList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VGPUNodeStatus `json:"items"`
+}
+
+// GPURequestSpec is what the containers of a pod referencing the GPURequest ask for. The
+// webhook turns it into the resource limits and pod annotations it stands for.
+type GPURequestSpec struct {
+	// Count is the number of vGPUs each container gets.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	Count int32 `json:"count,omitempty"`
+	// Memory is the device memory of each vGPU in MiB.
+	// +kubebuilder:validation:Minimum=1
+	Memory int32 `json:"memory,omitempty"`
+	// MemoryPercentage is the share of the memory of each GPU instead, at most one of
+	// Memory and MemoryPercentage is set.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	MemoryPercentage int32 `json:"memoryPercentage,omitempty"`
+	// Cores is the percentage of the cores of each GPU.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	Cores int32 `json:"cores,omitempty"`
+	// Models are the GPU types the pod may run on, ExcludedModels those it must not run
+	// on, matched against the device type like nvidia.com/use-gputype. At most one of
+	// them is set.
+	Models         []string `json:"models,omitempty"`
+	ExcludedModels []string `json:"excludedModels,omitempty"`
+	// Distinct places every vGPU of the pod on a physical GPU of its own.
+	Distinct bool `json:"distinct,omitempty"`
+	// PlacementKey has the scheduler prefer the GPUs pods with the same key ran on.
+	PlacementKey string `json:"placementKey,omitempty"`
+	// Exclusive gives the containers whole GPUs without the hook library.
+	Exclusive bool `json:"exclusive,omitempty"`
+	// Containers are the names of the containers getting the vGPUs. Empty means every
+	// container of the pod that isn't privileged and doesn't ask for devices itself.
+	Containers []string `json:"containers,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=gpureq
+// +kubebuilder:printcolumn:name="Count",type=integer,JSONPath=`.spec.count`
+// +kubebuilder:printcolumn:name="Memory",type=integer,JSONPath=`.spec.memory`
+// +kubebuilder:printcolumn:name="Cores",type=integer,JSONPath=`.spec.cores`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GPURequest describes the vGPUs of pods in its namespace that reference it with the
+// gpu-request annotation.
+type GPURequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GPURequestSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GPURequestList contains a list of GPURequest.
+type GPURequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GPURequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VGPUNodeStatus{}, &VGPUNodeStatusList{}, &GPURequest{}, &GPURequestList{})
+}
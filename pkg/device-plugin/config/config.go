@@ -16,6 +16,14 @@
 
 package config
 
+import (
+	"fmt"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"k8s.io/klog/v2"
+)
+
 var (
 	DeviceSplitCount    uint
 	DeviceMemoryScaling float64
@@ -23,4 +31,238 @@ var (
 	NodeName            string
 	RuntimeSocketFlag   string
 	DisableCoreLimit    bool
+	// DevicePluginPath is the directory of the kubelet registration socket and of the plugin
+	// sockets, it differs from the default on nodes with a custom kubelet root.
+	DevicePluginPath = "/var/lib/kubelet/device-plugins/"
+	// ContainerCacheRoot holds the shared region cache directory of every vGPU container.
+	ContainerCacheRoot = "/usr/local/vgpu/containers"
+	// ManagedMemoryRatio is the device plus host memory budget of containers allowed to
+	// use CUDA managed memory, as a multiple of the device memory allocated to them.
+	ManagedMemoryRatio = 2.0
+	// RequireSchedulerApproval rejects Allocate calls for pods the vGPU scheduler didn't assign to this node.
+	RequireSchedulerApproval = true
+	// RegisterTimeout bounds each attempt to register with kubelet.
+	RegisterTimeout = 5 * time.Second
+	// RegisterRetries is how many times a failed registration is retried before giving up.
+	RegisterRetries int
+	// StrictBindTimeMemoryCheck fails Allocate when a GPU has less free memory than the container's limit.
+	StrictBindTimeMemoryCheck bool
+	// VerifyDeviceFreeMemory checks the GPUs of each container for memory held by processes
+	// of terminated pods when it is allocated, see nvidiadevice.LeakCheck.
+	VerifyDeviceFreeMemory bool
+	// OnLeak is what Allocate does when it finds such memory: fail or warn.
+	OnLeak = "fail"
+	// ReapLeakedProcesses kills the processes of terminated pods found holding memory.
+	ReapLeakedProcesses bool
+	// HeartbeatInterval is how often container heartbeats are read, 0 disables it.
+	HeartbeatInterval = 30 * time.Second
+	// LimitSyncInterval is how often the memory limits of running containers are set to
+	// those of their pods, which change with in-place resize, 0 disables it.
+	LimitSyncInterval = 10 * time.Second
+	// MemoryWatchdogInterval is how often the memory the containers use is checked against
+	// their limits in cgroup enforcement, see nvidiadevice.MemoryWatchdog.
+	MemoryWatchdogInterval = 5 * time.Second
+	// NVMLQueryTimeout bounds each NVML query of the device sampler, a device whose query
+	// takes longer is reported unhealthy until NVML answers again.
+	NVMLQueryTimeout = 5 * time.Second
+	// AllocateSlowThreshold is how long an Allocate call may take before the time of its
+	// phases is logged, an event is recorded on the pod from five times as long.
+	AllocateSlowThreshold = 2 * time.Second
+	// AllocateTimeout bounds each Allocate call, kubelet waits for it without a deadline.
+	AllocateTimeout = 30 * time.Second
+	// UnhealthyGracePeriod is how long a device must keep failing its health checks before
+	// it is reported unhealthy, and keep passing them before it is reported healthy again.
+	UnhealthyGracePeriod time.Duration
+	// CoreBurstThreshold is the GPU utilization in percent from which containers allowed to
+	// burst are held to their share of the cores while another tenant is busy, 0 disables bursting.
+	CoreBurstThreshold uint = 80
+	// MinPlausibleMemory is the least device memory in MiB NVML may report for a device,
+	// smaller values, and 0 always, are taken for driver glitches and ignored.
+	MinPlausibleMemory int32 = 1024
+	// EnablePersistenceMode turns on persistence mode of the GPUs while the plugin runs.
+	EnablePersistenceMode bool
+	// StrictDeviceVisibility passes the device nodes of the allocated GPUs to every container,
+	// so the device cgroup hides the other GPUs even if NVIDIA_VISIBLE_DEVICES is overridden.
+	StrictDeviceVisibility bool
+	// DeviceListStrategy is how the allocated GPUs are passed to the NVIDIA container runtime,
+	// see the nvidiadevice.DeviceListStrategy constants.
+	DeviceListStrategy string
+	// RuntimeFlavor is the container runtime of the node, it picks the DeviceListStrategy
+	// unless one is chosen, see nvidiadevice.DetectRuntimeFlavor.
+	RuntimeFlavor string
+	// InjectAssignmentEnv tells containers the UUIDs of their GPUs and their limits.
+	InjectAssignmentEnv bool
+	// LimitDelivery is how the limits are passed to containers, in environment variables or
+	// in a file, see the nvidiadevice.LimitDelivery constants.
+	LimitDelivery = "env"
+	// ManageNodeTaints taints the node while none of its GPUs is healthy.
+	ManageNodeTaints bool
+	// MeasureExternalMemory takes the device memory used by processes that didn't get the
+	// device from this plugin out of the registered memory.
+	MeasureExternalMemory bool
+	// SkipPreflight names the preflight checks not to run.
+	SkipPreflight []string
+	// Enforcement is the mechanism used to isolate containers, see nvidiadevice.DetectEnforcement.
+	Enforcement string
+	// HookCapabilities lists what the hook library enforces beyond memory and core limits,
+	// see nvidiadevice.CheckHookCapabilities.
+	HookCapabilities []string
+	// MemoryBandwidthLimit is set when the hook library enforces memory bandwidth limits,
+	// see nvidiadevice.DetectMemoryBandwidthLimit.
+	MemoryBandwidthLimit bool
+	// MemoryTiers is set when the hook library reclaims memory by memory tier, see
+	// nvidiadevice.DetectMemoryTiers.
+	MemoryTiers bool
+	// MaxSharesPerDevice caps the containers sharing a GPU below the split count, 0 leaves
+	// the split count as the only limit.
+	MaxSharesPerDevice uint
+	// ModelMaxShares overrides MaxSharesPerDevice for GPUs of a model, as NVML names it,
+	// e.g. "Tesla T4". It is read from the config file.
+	ModelMaxShares map[string]uint
+	// EnableDeviceBlacklist lets operators take GPUs out of scheduling on the runtime socket.
+	EnableDeviceBlacklist bool
+	// CheckpointFile keeps what was set at runtime, like the blacklisted GPUs, across
+	// restarts, nothing is kept if empty.
+	CheckpointFile = "/var/lib/vgpu/checkpoint.json"
+	// APITimeout bounds each API server request made to register the devices, and dialing
+	// and probing the API server.
+	APITimeout = 10 * time.Second
+	// APIKeepalive is how long a connection to the API server may stay silent before it is
+	// probed, it is raised to MinAPIKeepalive.
+	APIKeepalive = 30 * time.Second
+	// NodeUpdateInterval is how often the devices are reported in the node annotations, each
+	// report delayed by up to NodeUpdateJitter of it so the nodes don't write at once.
+	NodeUpdateInterval = 30 * time.Second
+	// NodeUpdateQPS caps the patches of the node made to report the devices, changes made
+	// in between, like several GPUs turning unhealthy, go out in one patch.
+	NodeUpdateQPS = 0.2
+	// CoreLimitGranularity is the step in percent the hook library enforces core limits in,
+	// core requests are rounded to the nearest step.
+	CoreLimitGranularity uint = 1
+	// ScalingDimensions is "memory", "cores" or "both", the capacities the scaling factors
+	// may oversubscribe, empty means both.
+	ScalingDimensions string
+	// MaxScaling caps the memory and cores scaling ratios, a larger ratio is a typo rather
+	// than a plan.
+	MaxScaling = 10.0
+	// EnableNVMLAccounting turns on accounting mode of the GPUs while the plugin runs, the
+	// usage of containers whose hook doesn't measure kernel time is taken from it.
+	EnableNVMLAccounting bool
+	// ForceComputeModeDefault resets GPUs outside the DEFAULT compute mode to it, rather
+	// than registering them unsplit.
+	ForceComputeModeDefault bool
+	// NodeLockFile is flocked by the one device plugin serving a node, empty disables the lock.
+	NodeLockFile = "/var/lib/vgpu/device-plugin.lock"
+	// OnLockConflict is "exit" or "wait", what a device plugin does while another one
+	// holds NodeLockFile.
+	OnLockConflict = "exit"
+	// IdleCoreReclaim lends the cores of containers idle for IdleCorePeriod to the others
+	// on their GPUs, until they launch a kernel again.
+	IdleCoreReclaim bool
+	IdleCorePeriod  = 5 * time.Minute
+	// Offline runs the plugin without the API server, as when none answers at startup:
+	// containers get slices of the GPUs kubelet picks, and what needs the API is off.
+	Offline bool
+	// CoexistWithLegacyAllocations keeps the GPUs kubelet assigned under LegacyResourceName,
+	// by the stock NVIDIA device plugin this one replaced, out of the pool until their pods
+	// are gone.
+	CoexistWithLegacyAllocations bool
+	LegacyResourceName           = "nvidia.com/gpu"
+	// DrainMigrate evicts the vGPU pods of the node one at a time while it is cordoned.
+	DrainMigrate bool
+	// CheckCapacity checks at startup that the advertised capacity of the devices agrees
+	// with the limits their slices are enforced with.
+	CheckCapacity bool
+	// AllowUnsafeReload applies a configuration reloaded on SIGHUP even when the containers
+	// running wouldn't fit the capacity it gives their devices.
+	AllowUnsafeReload bool
+	// DeviceSplitCountMap overrides the split count of the GPUs with the UUIDs, over that of
+	// their profile, so cards of different sizes on a node are split differently.
+	DeviceSplitCountMap map[string]int
 )
+
+// MinAPIKeepalive keeps probes of idle API server connections from adding to its load.
+const MinAPIKeepalive = 5 * time.Second
+
+// MaxDeviceSplitCount bounds the tasks a device is split for, the scheduler and the hook
+// library aren't tested beyond.
+const MaxDeviceSplitCount = 64
+
+// Validate checks the split count and the scaling ratios, a ratio of 0 would advertise
+// devices without memory and fail every pod on the node. It warns about oversubscribing
+// memory and cores at once.
+func Validate() error {
+	if err := ValidateNodeUpdates(); err != nil {
+		return err
+	}
+	if MaxScaling < 1 {
+		return fmt.Errorf("the maximum scaling must be at least 1, got %v", MaxScaling)
+	}
+	if ManagedMemoryRatio < 1 {
+		return fmt.Errorf("the managed memory ratio must be at least 1, got %v", ManagedMemoryRatio)
+	}
+	if err := ValidateSplitCount(DeviceSplitCount); err != nil {
+		return err
+	}
+	for uuid, count := range DeviceSplitCountMap {
+		if count < 1 {
+			return fmt.Errorf("device %v: the device split count must be at least 1, got %v", uuid, count)
+		}
+		if err := ValidateSplitCount(uint(count)); err != nil {
+			return fmt.Errorf("device %v: %v", uuid, err)
+		}
+	}
+	if err := ValidateScaling("memory", DeviceMemoryScaling); err != nil {
+		return err
+	}
+	if err := ValidateScaling("cores", DeviceCoresScaling); err != nil {
+		return err
+	}
+	if DeviceMemoryScaling > 1 && DeviceCoresScaling > 1 && ScalingDimensions != "memory" && ScalingDimensions != "cores" {
+		klog.Warningf("!!! Memory scaling %v and cores scaling %v oversubscribe both memory and cores, tasks on a busy device may run out of memory while they are throttled. Choose one with --scaling-dimensions unless this is intended !!!", DeviceMemoryScaling, DeviceCoresScaling)
+	}
+	return nil
+}
+
+// NodeUpdateJitter is the share of NodeUpdateInterval each report is delayed by at most.
+const NodeUpdateJitter = 0.1
+
+// ValidateNodeUpdates checks that the devices are reported often enough for the handshake of
+// the scheduler, which waits util.HandshakeTimeout for an answer to a request it makes every
+// util.HandshakePollInterval.
+func ValidateNodeUpdates() error {
+	if NodeUpdateInterval <= 0 {
+		return fmt.Errorf("the node update interval must be positive, got %v", NodeUpdateInterval)
+	}
+	if !(NodeUpdateQPS > 0) {
+		return fmt.Errorf("the node update qps must be greater than 0, got %v", NodeUpdateQPS)
+	}
+	slowest := time.Duration(float64(NodeUpdateInterval)*(1+NodeUpdateJitter)) + util.HandshakePollInterval
+	if slowest >= util.HandshakeTimeout {
+		return fmt.Errorf("a node update interval of %v leaves the scheduler waiting up to %v for a report, it takes the devices of nodes away after %v", NodeUpdateInterval, slowest, util.HandshakeTimeout)
+	}
+	if qps := 1 / NodeUpdateInterval.Seconds(); NodeUpdateQPS < qps {
+		return fmt.Errorf("a node update qps of %v can't keep up with an update every %v", NodeUpdateQPS, NodeUpdateInterval)
+	}
+	return nil
+}
+
+// ValidateSplitCount checks the number of tasks a device is split for.
+func ValidateSplitCount(count uint) error {
+	if count < 1 || count > MaxDeviceSplitCount {
+		return fmt.Errorf("the device split count must be between 1 and %v, got %v", MaxDeviceSplitCount, count)
+	}
+	return nil
+}
+
+// ValidateScaling checks the scaling ratio of the named capacity, it must be above 0 and
+// at most MaxScaling.
+func ValidateScaling(capacity string, scaling float64) error {
+	if !(scaling > 0) {
+		return fmt.Errorf("the %v scaling must be greater than 0, got %v, 1 disables scaling", capacity, scaling)
+	}
+	if scaling > MaxScaling {
+		return fmt.Errorf("the %v scaling %v is above the maximum scaling %v", capacity, scaling, MaxScaling)
+	}
+	return nil
+}
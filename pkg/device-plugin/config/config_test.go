@@ -0,0 +1,133 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestValidate(t *testing.T) {
+	oldSplit, oldMem, oldCores, oldMax := DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, MaxScaling
+	t.Cleanup(func() {
+		DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, MaxScaling = oldSplit, oldMem, oldCores, oldMax
+	})
+	for name, tc := range map[string]struct {
+		split      uint
+		memory     float64
+		cores      float64
+		maxScaling float64
+		err        string
+	}{
+		"defaults":             {split: 10, memory: 1, cores: 1, maxScaling: 10},
+		"split count 1":        {split: 1, memory: 1, cores: 1, maxScaling: 10},
+		"split count 64":       {split: 64, memory: 1, cores: 1, maxScaling: 10},
+		"split count 0":        {split: 0, memory: 1, cores: 1, maxScaling: 10, err: "the device split count must be between 1 and 64, got 0"},
+		"split count 65":       {split: 65, memory: 1, cores: 1, maxScaling: 10, err: "the device split count must be between 1 and 64, got 65"},
+		"memory scaling 0":     {split: 10, memory: 0, cores: 1, maxScaling: 10, err: "the memory scaling must be greater than 0, got 0"},
+		"memory scaling -1":    {split: 10, memory: -1, cores: 1, maxScaling: 10, err: "the memory scaling must be greater than 0, got -1"},
+		"memory scaling 0.5":   {split: 10, memory: 0.5, cores: 1, maxScaling: 10},
+		"memory scaling max":   {split: 10, memory: 10, cores: 1, maxScaling: 10},
+		"memory scaling above": {split: 10, memory: 10.5, cores: 1, maxScaling: 10, err: "the memory scaling 10.5 is above the maximum scaling 10"},
+		"cores scaling 0":      {split: 10, memory: 1, cores: 0, maxScaling: 10, err: "the cores scaling must be greater than 0, got 0"},
+		"cores scaling max":    {split: 10, memory: 1, cores: 10, maxScaling: 10},
+		"cores scaling above":  {split: 10, memory: 1, cores: 11, maxScaling: 10, err: "the cores scaling 11 is above the maximum scaling 10"},
+		"raised maximum":       {split: 10, memory: 20, cores: 1, maxScaling: 20},
+		"lowered maximum":      {split: 10, memory: 2, cores: 1, maxScaling: 1.5, err: "the memory scaling 2 is above the maximum scaling 1.5"},
+		"maximum below 1":      {split: 10, memory: 0.5, cores: 1, maxScaling: 0.5, err: "the maximum scaling must be at least 1, got 0.5"},
+		"both scaled, warns":   {split: 10, memory: 2, cores: 2, maxScaling: 10},
+		"split before scaling": {split: 0, memory: 0, cores: 1, maxScaling: 10, err: "device split count"},
+	} {
+		DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, MaxScaling = tc.split, tc.memory, tc.cores, tc.maxScaling
+		err := Validate()
+		if tc.err == "" {
+			assert.NilError(t, err, name)
+		} else {
+			assert.ErrorContains(t, err, tc.err, name)
+		}
+	}
+}
+
+func TestValidateManagedMemoryRatio(t *testing.T) {
+	oldSplit, oldMem, oldCores, oldRatio := DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, ManagedMemoryRatio
+	t.Cleanup(func() {
+		DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, ManagedMemoryRatio = oldSplit, oldMem, oldCores, oldRatio
+	})
+	DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling = 10, 1, 1
+	for ratio, ok := range map[float64]bool{1: true, 2.5: true, 0.5: false, 0: false} {
+		ManagedMemoryRatio = ratio
+		if err := Validate(); ok {
+			assert.NilError(t, err, ratio)
+		} else {
+			assert.ErrorContains(t, err, "the managed memory ratio must be at least 1", ratio)
+		}
+	}
+}
+
+func TestValidateSplitCountMap(t *testing.T) {
+	oldSplit, oldMem, oldCores, oldMap := DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, DeviceSplitCountMap
+	t.Cleanup(func() {
+		DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling, DeviceSplitCountMap = oldSplit, oldMem, oldCores, oldMap
+	})
+	DeviceSplitCount, DeviceMemoryScaling, DeviceCoresScaling = 10, 1, 1
+	for name, tc := range map[string]struct {
+		counts map[string]int
+		err    string
+	}{
+		"none":  {},
+		"mixed": {counts: map[string]int{"GPU-a": 8, "GPU-b": 2, "GPU-c": 1}},
+		"0":     {counts: map[string]int{"GPU-a": 8, "GPU-b": 0}, err: "device GPU-b: the device split count must be at least 1, got 0"},
+		"-1":    {counts: map[string]int{"GPU-b": -1}, err: "device GPU-b: the device split count must be at least 1, got -1"},
+		"65":    {counts: map[string]int{"GPU-b": 65}, err: "device GPU-b: the device split count must be between 1 and 64, got 65"},
+	} {
+		DeviceSplitCountMap = tc.counts
+		err := Validate()
+		if tc.err == "" {
+			assert.NilError(t, err, name)
+		} else {
+			assert.ErrorContains(t, err, tc.err, name)
+		}
+	}
+}
+
+func TestValidateNodeUpdates(t *testing.T) {
+	oldInterval, oldQPS := NodeUpdateInterval, NodeUpdateQPS
+	t.Cleanup(func() { NodeUpdateInterval, NodeUpdateQPS = oldInterval, oldQPS })
+	for name, tc := range map[string]struct {
+		interval time.Duration
+		qps      float64
+		err      string
+	}{
+		"defaults":        {interval: 30 * time.Second, qps: 0.2},
+		"40s":             {interval: 40 * time.Second, qps: 0.2},
+		"too slow":        {interval: 45 * time.Second, qps: 0.2, err: "takes the devices of nodes away after 1m0s"},
+		"0":               {interval: 0, qps: 0.2, err: "the node update interval must be positive"},
+		"qps 0":           {interval: 30 * time.Second, err: "the node update qps must be greater than 0"},
+		"qps behind":      {interval: 10 * time.Second, qps: 0.05, err: "can't keep up with an update every 10s"},
+		"qps just enough": {interval: 10 * time.Second, qps: 0.1},
+	} {
+		NodeUpdateInterval, NodeUpdateQPS = tc.interval, tc.qps
+		err := ValidateNodeUpdates()
+		if tc.err == "" {
+			assert.NilError(t, err, name)
+		} else {
+			assert.ErrorContains(t, err, tc.err, name)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
 	flags "github.com/jessevdk/go-flags"
 )
 
@@ -33,6 +34,7 @@ type Options struct {
 	EnableDeviceType   bool   `long:"enable-device-type" description:"enable device registration with type info"`
 	CnmonPath          string `long:"cnmon-path" description:"host cnmon path"`
 	SocketPath         string `long:"socket-path" description:"socket path for communication between deviceplugin and container runtime"`
+	ResourcePrefix     string `long:"resource-prefix" description:"prefix of the annotations and labels written by vgpu components" default:"4pd.io"`
 }
 
 func ParseFlags() Options {
@@ -56,7 +58,15 @@ func ParseFlags() Options {
 		}
 		os.Exit(code)
 	}
+	if err := util.SetResourcePrefix(options.ResourcePrefix); err != nil {
+		log.Fatalf("Failed to parse options: %v", err)
+	}
 	config.DeviceSplitCount = options.VirtualizationNum
+	config.DeviceMemoryScaling = 1
+	config.DeviceCoresScaling = 1
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Failed to parse options: %v", err)
+	}
 	config.RuntimeSocketFlag = options.SocketPath
 	log.Printf("Parsed options: %v\n", options)
 	return options
@@ -27,6 +27,7 @@ import (
 	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
 	"4pd.io/k8s-vgpu/pkg/device-plugin/mlu/cndev"
 	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 )
 
 type DevListFunc func() []*pluginapi.Device
@@ -85,7 +86,7 @@ func (r *DeviceRegister) RegistrInAnnotation() error {
 		klog.Errorln("get node error", err.Error())
 		return err
 	}
-	encodeddevices := util.EncodeNodeDevices(*devices)
+	encodeddevices := annotations.EncodeNodeDevices(*devices)
 	annos[util.NodeMLUHandshake] = "Reported " + time.Now().String()
 	annos[util.NodeMLUDeviceRegistered] = encodeddevices
 	klog.Infoln("Reporting devices", encodeddevices, "in", time.Now().String())
@@ -0,0 +1,156 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// containerIDPattern finds the container ID at the end of a cgroup path, as written by
+// docker, containerd and cri-o with the cgroupfs or systemd driver.
+var containerIDPattern = regexp.MustCompile(`([0-9a-f]{64})(\.scope)?\s*$`)
+
+// processCgroup returns the UID of the pod and the ID of the container the process runs
+// in, "" for processes outside pods.
+func processCgroup(procRoot string, pid uint) (uid, containerID string) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.FormatUint(uint64(pid), 10), "cgroup"))
+	if err != nil {
+		klog.V(4).Infof("read cgroup of process %v: %v", pid, err)
+		return "", ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		m := podUIDPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		uid = strings.ReplaceAll(m[1], "_", "-")
+		if c := containerIDPattern.FindStringSubmatch(line); c != nil {
+			return uid, c[1]
+		}
+	}
+	return uid, ""
+}
+
+// EnableAccountingMode turns accounting mode on for the GPUs having it off, so NVML keeps
+// the utilization of each process, and returns a function turning it off again on those
+// GPUs. Setting it needs root, a GPU that fails is logged and left as it was.
+func EnableAccountingMode() (restore func()) {
+	n, err := nvmlLib.DeviceCount()
+	if err != nil {
+		klog.Errorf("enable accounting mode: %v", err)
+		return func() {}
+	}
+	if n > util.DeviceLimit {
+		n = util.DeviceLimit
+	}
+	var enabled []string
+	for i := uint(0); i < n; i++ {
+		d, err := nvmlLib.Device(i)
+		if err != nil {
+			klog.Errorf("enable accounting mode of GPU %d: %v", i, err)
+			continue
+		}
+		on, err := nvmlLib.AccountingMode(d.UUID)
+		if err != nil {
+			klog.Errorf("get accounting mode of %v: %v", d.UUID, err)
+			continue
+		}
+		if on {
+			klog.Infof("Accounting mode of %v is enabled already", d.UUID)
+			continue
+		}
+		if err := nvmlLib.SetAccountingMode(d.UUID, true); err != nil {
+			klog.Errorf("enable accounting mode of %v: %v", d.UUID, err)
+			continue
+		}
+		klog.Infof("Enabled accounting mode of %v", d.UUID)
+		enabled = append(enabled, d.UUID)
+	}
+	return func() {
+		for _, uuid := range enabled {
+			if err := nvmlLib.SetAccountingMode(uuid, false); err != nil {
+				klog.Errorf("disable accounting mode of %v: %v", uuid, err)
+				continue
+			}
+			klog.Infof("Disabled accounting mode of %v again", uuid)
+		}
+	}
+}
+
+// accountProcesses returns the NVML accounting of the processes on the GPUs of the node,
+// keyed by <pod uid>_<container name> like the cache directories. Processes outside the
+// given pods are left out.
+func accountProcesses(lib NVML, procRoot string, pods map[string]*corev1.Pod) map[string][]ProcessUsage {
+	n, err := lib.DeviceCount()
+	if err != nil {
+		klog.Errorf("account GPU processes: %v", err)
+		return nil
+	}
+	if n > util.DeviceLimit {
+		n = util.DeviceLimit
+	}
+	res := make(map[string][]ProcessUsage)
+	for i := uint(0); i < n; i++ {
+		d, err := lib.Device(i)
+		if err != nil {
+			klog.V(4).Infof("account processes of GPU %d: %v", i, err)
+			continue
+		}
+		procs, err := lib.Processes(d.UUID)
+		if err != nil {
+			klog.V(4).Infof("list processes of %v: %v", d.UUID, err)
+			continue
+		}
+		for _, p := range procs {
+			uid, id := processCgroup(procRoot, p.PID)
+			ctr := containerName(pods[uid], id)
+			if ctr == "" {
+				continue
+			}
+			stats, err := lib.AccountingStats(d.UUID, p.PID)
+			if err != nil {
+				klog.V(4).Infof("get accounting of process %v on %v: %v", p.PID, d.UUID, err)
+				continue
+			}
+			key := uid + "_" + ctr
+			res[key] = append(res[key], ProcessUsage{UUID: d.UUID, PID: p.PID, Stats: stats})
+		}
+	}
+	return res
+}
+
+// containerName returns the name of the container of pod with the given runtime ID.
+func containerName(pod *corev1.Pod, id string) string {
+	if pod == nil || id == "" {
+		return ""
+	}
+	for _, s := range pod.Status.ContainerStatuses {
+		// IDs are prefixed with the runtime, like containerd://
+		if _, cid, ok := strings.Cut(s.ContainerID, "://"); ok && cid == id {
+			return s.Name
+		}
+	}
+	return ""
+}
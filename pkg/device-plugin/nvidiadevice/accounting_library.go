@@ -0,0 +1,113 @@
+//go:build !nogpu
+
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+// #include <stdlib.h>
+//
+// typedef struct nvmlDevice_st *nvmlDevice_t;
+//
+// typedef struct {
+// 	unsigned int gpuUtilization;
+// 	unsigned int memoryUtilization;
+// 	unsigned long long maxMemoryUsage;
+// 	unsigned long long time;
+// 	unsigned long long startTime;
+// 	unsigned int isRunning;
+// 	unsigned int reserved[5];
+// } nvmlAccountingStats_t;
+//
+// // The NVML bindings don't wrap the accounting functions either, see symbol_library.go.
+// extern void *nvml_symbol(const char *name);
+//
+// static int accounting_device(const char *uuid, nvmlDevice_t *dev) {
+// 	int (*by_uuid)(const char *, nvmlDevice_t *) = nvml_symbol("nvmlDeviceGetHandleByUUID");
+// 	if (by_uuid == NULL)
+// 		return -1;
+// 	return by_uuid(uuid, dev);
+// }
+//
+// // nvml_accounting_mode reads the mode of the GPU into mode if set is negative, and sets
+// // it to set otherwise. It returns -1 if NVML isn't loaded.
+// static int nvml_accounting_mode(const char *uuid, int set, int *mode) {
+// 	int (*get)(nvmlDevice_t, int *) = nvml_symbol("nvmlDeviceGetAccountingMode");
+// 	int (*put)(nvmlDevice_t, int) = nvml_symbol("nvmlDeviceSetAccountingMode");
+// 	if (get == NULL || put == NULL)
+// 		return -1;
+// 	nvmlDevice_t dev;
+// 	int ret = accounting_device(uuid, &dev);
+// 	if (ret != 0)
+// 		return ret;
+// 	if (set < 0)
+// 		return get(dev, mode);
+// 	return put(dev, set);
+// }
+//
+// static int nvml_accounting_stats(const char *uuid, unsigned int pid, nvmlAccountingStats_t *stats) {
+// 	int (*get)(nvmlDevice_t, unsigned int, nvmlAccountingStats_t *) = nvml_symbol("nvmlDeviceGetAccountingStats");
+// 	if (get == NULL)
+// 		return -1;
+// 	nvmlDevice_t dev;
+// 	int ret = accounting_device(uuid, &dev);
+// 	if (ret != 0)
+// 		return ret;
+// 	return get(dev, pid, stats);
+// }
+import "C"
+
+import (
+	"time"
+	"unsafe"
+)
+
+func nvmlAccountingMode(uuid string, set C.int) (bool, error) {
+	cuuid := C.CString(uuid)
+	defer C.free(unsafe.Pointer(cuuid))
+	var mode C.int
+	if ret := C.nvml_accounting_mode(cuuid, set, &mode); ret != 0 {
+		return false, nvmlError(ret)
+	}
+	return mode != 0, nil
+}
+
+func (nvmlLibrary) AccountingMode(uuid string) (bool, error) {
+	return nvmlAccountingMode(uuid, -1)
+}
+
+func (nvmlLibrary) SetAccountingMode(uuid string, enabled bool) error {
+	var set C.int
+	if enabled {
+		set = 1
+	}
+	_, err := nvmlAccountingMode(uuid, set)
+	return err
+}
+
+func (nvmlLibrary) AccountingStats(uuid string, pid uint) (AccountingStats, error) {
+	cuuid := C.CString(uuid)
+	defer C.free(unsafe.Pointer(cuuid))
+	var stats C.nvmlAccountingStats_t
+	if ret := C.nvml_accounting_stats(cuuid, C.uint(pid), &stats); ret != 0 {
+		return AccountingStats{}, nvmlError(ret)
+	}
+	return AccountingStats{
+		GPUUtilization: uint(stats.gpuUtilization),
+		MaxMemoryUsage: uint64(stats.maxMemoryUsage),
+		Time:           time.Duration(stats.time) * time.Millisecond,
+	}, nil
+}
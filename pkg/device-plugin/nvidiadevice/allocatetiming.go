@@ -0,0 +1,133 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nvidiadevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// The phases of an Allocate call, the phase label of AllocateDuration.
+const (
+	// AllocatePhaseLookup finds the pod the devices are for and decodes its annotations.
+	AllocatePhaseLookup = "lookup"
+	// AllocatePhaseSelect checks the devices the scheduler assigned and takes them from the pod.
+	AllocatePhaseSelect = "select"
+	// AllocatePhaseLimits creates the container directory the hook library shares its limits in.
+	AllocatePhaseLimits = "limits"
+	// AllocatePhaseResponse builds the responses and reports the devices allocated.
+	AllocatePhaseResponse = "response"
+	// AllocatePhaseTotal is the whole call.
+	AllocatePhaseTotal = "total"
+)
+
+var allocatePhases = []string{AllocatePhaseLookup, AllocatePhaseSelect, AllocatePhaseLimits, AllocatePhaseResponse}
+
+// slowAllocateEventFactor is how many times config.AllocateSlowThreshold an Allocate call
+// takes before a warning event is recorded on its pod.
+const slowAllocateEventFactor = 5
+
+// allocateNow is the clock Allocate calls are timed with.
+var allocateNow = time.Now
+
+// allocateTiming breaks the time of an Allocate call down into its phases, which starts
+// in AllocatePhaseLookup. The phases repeated for each container add up.
+type allocateTiming struct {
+	start  time.Time
+	phase  string
+	since  time.Time
+	phases map[string]time.Duration
+}
+
+func newAllocateTiming() *allocateTiming {
+	now := allocateNow()
+	return &allocateTiming{start: now, phase: AllocatePhaseLookup, since: now, phases: make(map[string]time.Duration)}
+}
+
+// begin ends the phase running and starts phase, "" stops the timing.
+func (t *allocateTiming) begin(phase string) {
+	now := allocateNow()
+	if t.phase != "" {
+		t.phases[t.phase] += now.Sub(t.since)
+	}
+	t.phase, t.since = phase, now
+}
+
+// total is the time from the start of the call to the start of the phase running, or to
+// the end of the last phase once stopped.
+func (t *allocateTiming) total() time.Duration {
+	return t.since.Sub(t.start)
+}
+
+func (t *allocateTiming) String() string {
+	var b strings.Builder
+	for _, phase := range allocatePhases {
+		fmt.Fprintf(&b, "%v=%v ", phase, t.phases[phase])
+	}
+	fmt.Fprintf(&b, "%v=%v", AllocatePhaseTotal, t.total())
+	return b.String()
+}
+
+// reportTiming stops the timing of an Allocate call for pod, nil if there was none, which
+// ended with err, and exports its phases. A call taking longer than config.AllocateSlowThreshold logs them, one
+// taking slowAllocateEventFactor times as long or running out of time records them in an
+// event on the pod, so it tells whether a slow start was Allocate or what came after it.
+func (m *NvidiaDevicePlugin) reportTiming(t *allocateTiming, pod *corev1.Pod, err error) {
+	t.begin("")
+	for _, phase := range allocatePhases {
+		AllocateDuration.WithLabelValues(phase).Observe(t.phases[phase].Seconds())
+	}
+	total := t.total()
+	AllocateDuration.WithLabelValues(AllocatePhaseTotal).Observe(total.Seconds())
+	expired := errors.Is(err, context.DeadlineExceeded)
+	if total <= config.AllocateSlowThreshold && !expired {
+		return
+	}
+	ref := "unknown pod"
+	if pod != nil {
+		ref = util.PodRef(pod.Namespace, pod.Name)
+	}
+	klog.V(2).Infof("Allocate for %v took %v, above %v: %v", ref, total, config.AllocateSlowThreshold, t)
+	if pod == nil || m.recorder == nil || total < slowAllocateEventFactor*config.AllocateSlowThreshold && !expired {
+		return
+	}
+	if expired {
+		m.recorder.Eventf(pod, corev1.EventTypeWarning, "SlowGPUAllocation", "Allocating GPUs didn't finish within %v: %v", config.AllocateTimeout, t)
+		return
+	}
+	m.recorder.Eventf(pod, corev1.EventTypeWarning, "SlowGPUAllocation", "Allocating GPUs took %v: %v", total, t)
+}
+
+// allocation is an Allocate call, which stops once ctx is done.
+type allocation struct {
+	ctx    context.Context
+	timing *allocateTiming
+}
+
+// begin starts phase, it returns the error of ctx instead once the deadline of the
+// allocation passed so the allocation stops and rolls back.
+func (a *allocation) begin(phase string) error {
+	a.timing.begin(phase)
+	return a.ctx.Err()
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nvidiadevice
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestAllocateTimingBreakdown(t *testing.T) {
+	oldNow, oldPrepare, oldThreshold := allocateNow, prepareCacheDir, config.AllocateSlowThreshold
+	t.Cleanup(func() { allocateNow, prepareCacheDir, config.AllocateSlowThreshold = oldNow, oldPrepare, oldThreshold })
+	config.AllocateSlowThreshold = 2 * time.Second
+	// the clock only moves by the delays of the phases
+	now := time.Unix(0, 0)
+	allocateNow = func() time.Time { return now }
+
+	m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+	recorder := record.NewFakeRecorder(1)
+	m.SetEventRecorder(recorder)
+	allocate := func() {
+		_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+		assert.NilError(t, err)
+	}
+	// finding the pending pod, then checking the device shares of the node
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.ListAction).GetListRestrictions().Fields.Empty() {
+			now = now.Add(time.Second)
+		} else {
+			now = now.Add(2 * time.Second)
+		}
+		return false, nil, nil
+	})
+	// reporting the devices allocated
+	client.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if strings.Contains(string(action.(k8stesting.PatchAction).GetPatch()), util.AllocatedIDsAnnotations) {
+			now = now.Add(3 * time.Second)
+		}
+		return false, nil, nil
+	})
+	prepareCacheDir = func(dir string) (int64, error) {
+		now = now.Add(4 * time.Second)
+		return oldPrepare(dir)
+	}
+
+	allocate()
+	assert.Equal(t, <-recorder.Events, "Warning SlowGPUAllocation Allocating GPUs took 10s: lookup=1s select=2s limits=4s response=3s total=10s")
+	assert.Equal(t, testutil.CollectAndCount(AllocateDuration), 5)
+
+	// slow but not egregious, only logged
+	prepareCacheDir = oldPrepare
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	pod.Annotations[util.AssignedIDsToAllocateAnnotations] = "GPU-0,NVIDIA,1000,30:"
+	pod.Annotations[util.DeviceBindPhase] = util.DeviceBindAllocating
+	_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	allocate()
+	assert.Equal(t, len(recorder.Events), 0)
+}
+
+func TestAllocateStopsAtDeadline(t *testing.T) {
+	oldPrepare, oldTimeout := prepareCacheDir, config.AllocateTimeout
+	t.Cleanup(func() { prepareCacheDir, config.AllocateTimeout = oldPrepare, oldTimeout })
+	config.AllocateTimeout = 50 * time.Millisecond
+	prepareCacheDir = func(dir string) (int64, error) {
+		time.Sleep(100 * time.Millisecond)
+		return oldPrepare(dir)
+	}
+	toAllocate := "GPU-0,NVIDIA,1000,30:"
+	m, client := setupAllocate(t, toAllocate)
+	recorder := record.NewFakeRecorder(1)
+	m.SetEventRecorder(recorder)
+
+	_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// rolled back before Allocate returned, without handing out the devices
+	event := <-recorder.Events
+	assert.Assert(t, strings.HasPrefix(event, "Warning SlowGPUAllocation Allocating GPUs didn't finish within 50ms: lookup="), event)
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.AssignedIDsToAllocateAnnotations], toAllocate)
+	assert.Equal(t, pod.Annotations[util.DeviceBindPhase], util.DeviceBindFailed)
+	_, ok := pod.Annotations[util.AllocatedIDsAnnotations]
+	assert.Assert(t, !ok)
+	_, err = os.Stat(filepath.Join(config.ContainerCacheRoot, "uid_c"))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestAllocateRollbackKeepsExistingDirectory(t *testing.T) {
+	oldPrepare, oldTimeout := prepareCacheDir, config.AllocateTimeout
+	t.Cleanup(func() { prepareCacheDir, config.AllocateTimeout = oldPrepare, oldTimeout })
+	config.AllocateTimeout = 50 * time.Millisecond
+	prepareCacheDir = func(dir string) (int64, error) {
+		time.Sleep(100 * time.Millisecond)
+		return oldPrepare(dir)
+	}
+	m, _ := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+	// the container was started before, its generations go on
+	dir := filepath.Join(config.ContainerCacheRoot, "uid_c")
+	assert.NilError(t, os.MkdirAll(dir, 0777))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, generationFile), []byte("3"), 0644))
+
+	_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, readGeneration(dir), int64(4))
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/status"
+)
+
+// kubeletVersionsPattern finds the versions kubelet lists when it rejects the version
+// of a registration: `Supported versions are ["v1beta1"]` since 1.14, and
+// `Supported versions are [v1beta1]` before.
+var kubeletVersionsPattern = regexp.MustCompile(`[Ss]upported versions are \[([^\]]*)\]`)
+
+// kubeletVersions returns the device plugin API versions kubelet supports, as listed
+// in err when it rejected a registration for its version, nil for other errors. The
+// plugin only serves pluginapi.Version, so there is nothing to fall back to, but the
+// versions tell why the registration failed.
+func kubeletVersions(err error) []string {
+	match := kubeletVersionsPattern.FindStringSubmatch(status.Convert(err).Message())
+	if match == nil {
+		return nil
+	}
+	var res []string
+	for _, v := range strings.Fields(match[1]) {
+		if v = strings.Trim(v, `"',`); len(v) > 0 {
+			res = append(res, v)
+		}
+	}
+	return res
+}
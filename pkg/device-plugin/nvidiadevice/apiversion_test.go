@@ -0,0 +1,67 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gotest.tools/v3/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestKubeletVersions(t *testing.T) {
+	for msg, want := range map[string][]string{
+		`requested API version "v1" is not supported by kubelet. Supported versions are ["v1beta1"]`:      {"v1beta1"},
+		`Requested device plugin version v1 is not supported. Supported versions are [v1alpha v1beta1]`:   {"v1alpha", "v1beta1"},
+		`requested API version "v2" is not supported by kubelet. Supported versions are ["v1" "v1beta1"]`: {"v1", "v1beta1"},
+	} {
+		assert.DeepEqual(t, kubeletVersions(status.Error(codes.Unknown, msg)), want)
+	}
+	assert.Assert(t, kubeletVersions(errors.New("kubelet is not ready")) == nil)
+	assert.Assert(t, kubeletVersions(nil) == nil)
+}
+
+func serveRegistration(t *testing.T, registration *fakeRegistrationServer) {
+	ln, err := net.Listen("unix", KubeletSocket())
+	assert.NilError(t, err)
+	server := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(server, registration)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+}
+
+func TestRegisterReportsVersionMismatch(t *testing.T) {
+	setupRegister(t, 0)
+	registration := &fakeRegistrationServer{versions: []string{"v1", "v2"}}
+	serveRegistration(t, registration)
+
+	m := &NvidiaDevicePlugin{resourceName: "test.io/register", socket: "test.sock"}
+	err := m.Register()
+	assert.ErrorContains(t, err, `kubelet supports device plugin API versions [v1 v2], the plugin only v1beta1`)
+	// the plugin serves no other version to register with
+	assert.DeepEqual(t, registration.requested, []string{pluginapi.Version})
+
+	registration.requested = nil
+	registration.versions = []string{pluginapi.Version}
+	assert.NilError(t, m.Register())
+	assert.DeepEqual(t, registration.requested, []string{pluginapi.Version})
+}
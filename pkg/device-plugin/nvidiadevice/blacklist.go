@@ -0,0 +1,114 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"k8s.io/klog/v2"
+)
+
+// BlacklistPath is where the runtime service lists the blacklisted devices. With
+// config.EnableDeviceBlacklist, PUT on BlacklistPath/<uuid> takes a device out of
+// scheduling and DELETE puts it back.
+const BlacklistPath = "/blacklist"
+
+// Checkpoint is what was set at runtime and is kept across restarts in config.CheckpointFile.
+type Checkpoint struct {
+	Blacklist []string `json:"blacklist,omitempty"`
+}
+
+// ReadCheckpoint reads the checkpoint at path, a missing file is an empty checkpoint.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("checkpoint %v: %v", path, err)
+	}
+	return c, nil
+}
+
+// WriteCheckpoint replaces the checkpoint at path, it is written to a temporary file
+// first so a crash doesn't leave half of it.
+func WriteCheckpoint(path string, c *Checkpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// SetBlacklisted takes the device with the given UUID out of scheduling or puts it back,
+// and returns whether that changed anything. A blacklisted device is reported unhealthy
+// to kubelet and the scheduler, so no container is allocated to it anymore, while the
+// containers already running on it keep their share.
+func (d *DeviceCache) SetBlacklisted(id string, blacklisted bool) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	found := false
+	for _, dev := range d.cache {
+		if dev.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("device %v not found on this node", id)
+	}
+	if d.blacklist[id] == blacklisted {
+		return false, nil
+	}
+	if blacklisted {
+		klog.Warningf("device %v blacklisted, it is reported unhealthy until it is taken back", id)
+		d.blacklist[id] = true
+	} else {
+		klog.Infof("device %v taken back from the blacklist", id)
+		delete(d.blacklist, id)
+	}
+	d.publish([]string{id})
+	return true, nil
+}
+
+// Blacklisted returns the UUIDs of the blacklisted devices in order.
+func (d *DeviceCache) Blacklisted() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := []string{}
+	for id := range d.blacklist {
+		res = append(res, id)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// burstActiveWindow is how recently a container must have launched a kernel to count as
+// busy. Containers without a heartbeat always count as busy.
+const burstActiveWindow = 30 * time.Second
+
+// tenant is a container on this node with the shared regions of its processes.
+type tenant struct {
+	// dir is the cache directory, named <pod uid>_<container name>
+	dir     string
+	pod     *corev1.Pod
+	ctr     string
+	devs    util.ContainerDevices
+	regions []string
+}
+
+func (t *tenant) burst() bool {
+	return t.pod.Annotations[util.CoresBurstAnnotation] == "true"
+}
+
+// allowedCores returns the percentage of the cores a container guaranteed the given share
+// may use on a device with the given utilization, where busy are the shares of the other
+// containers on the device that are busy. The container may take what isn't guaranteed
+// to the busy ones, until the device is contended: another container is busy and the
+// utilization reached config.CoreBurstThreshold. It is then held to its share. A share of
+// 0 or 100 isn't limited anyway.
+func allowedCores(guaranteed int32, utilization uint, busy []int32) int32 {
+	if guaranteed <= 0 || guaranteed >= 100 || config.CoreBurstThreshold == 0 || config.DisableCoreLimit {
+		return guaranteed
+	}
+	if len(busy) > 0 && utilization >= config.CoreBurstThreshold {
+		return guaranteed
+	}
+	allowed := int32(100)
+	for _, cores := range busy {
+		allowed -= cores
+	}
+	if allowed < guaranteed {
+		return guaranteed
+	}
+	return allowed
+}
+
+// burstCores are the cores the LimitSyncer last allowed the containers that may burst, by
+// cache directory and device UUID, for the runtime service.
+var burstCores = struct {
+	sync.Mutex
+	allowed map[string]map[string]int32
+}{allowed: make(map[string]map[string]int32)}
+
+// allowedBurstCores returns the cores the container with the cache directory dir may use
+// on the device with uuid, if it may burst.
+func allowedBurstCores(dir, uuid string) (int32, bool) {
+	burstCores.Lock()
+	defer burstCores.Unlock()
+	cores, ok := burstCores.allowed[dir][uuid]
+	return cores, ok
+}
+
+// busy tells whether the container launched a kernel recently, from its heartbeat.
+func (l *LimitSyncer) busy(t *tenant) bool {
+	hb, err := readHeartbeat(filepath.Join(l.root, t.dir, heartbeatFile))
+	if err != nil {
+		return true
+	}
+	return l.now().Sub(time.Unix(hb.LastKernelLaunch, 0)) < burstActiveWindow
+}
+
+// syncBursts sets the core limits of the tenants that may burst to those allowedCores
+// gives them with the utilization NVML measures on their devices. With
+// config.IdleCoreReclaim, it also adds the cores they borrow from idle tenants, see
+// loanCores, to the limits of all tenants.
+func (l *LimitSyncer) syncBursts(tenants []*tenant) {
+	byDevice := make(map[string][]*tenant)
+	bursting := false
+	for _, t := range tenants {
+		for _, dev := range t.devs {
+			byDevice[dev.UUID] = append(byDevice[dev.UUID], t)
+		}
+		bursting = bursting || t.burst()
+	}
+	allowed := make(map[string]map[string]int32)
+	loans := make(map[string]map[string]coreLoan)
+	defer func() {
+		burstCores.Lock()
+		burstCores.allowed = allowed
+		burstCores.Unlock()
+		coreLoans.Lock()
+		coreLoans.loans = loans
+		coreLoans.Unlock()
+	}()
+	reclaim := config.IdleCoreReclaim && !config.DisableCoreLimit
+	if !bursting && !reclaim {
+		return
+	}
+	busy := make(map[*tenant]bool)
+	idle := make(map[*tenant]bool)
+	for _, t := range tenants {
+		busy[t] = l.busy(t)
+		if reclaim {
+			idle[t] = l.idle(t)
+		}
+	}
+	if reclaim {
+		loans = loanCores(tenants, idle)
+	}
+	utilization := make(map[string]uint)
+	for _, t := range tenants {
+		if !t.burst() && !reclaim {
+			continue
+		}
+		cores := make(map[string]int32)
+		borrowing := false
+		for _, dev := range t.devs {
+			if !t.burst() {
+				// the limit Allocate set, plus what the tenant borrows
+				enforced, err := enforcedCores(dev.Usedcores)
+				if err != nil {
+					continue
+				}
+				cores[dev.UUID] = enforced
+				if borrowed := loans[t.dir][dev.UUID].Borrowed; borrowed > 0 {
+					cores[dev.UUID] = withBorrowed(dev.Usedcores, borrowed)
+					borrowing = true
+				}
+				continue
+			}
+			u, ok := utilization[dev.UUID]
+			if !ok {
+				var err error
+				if u, err = l.utilization(dev.UUID); err != nil {
+					klog.V(4).Infof("utilization of device %v: %v", dev.UUID, err)
+					// hold the container to its share while the contention is unknown
+					u = 100
+				}
+				utilization[dev.UUID] = u
+			}
+			var shares []int32
+			for _, other := range byDevice[dev.UUID] {
+				if other == t || !busy[other] {
+					continue
+				}
+				for _, d := range other.devs {
+					if d.UUID == dev.UUID {
+						shares = append(shares, d.Usedcores)
+					}
+				}
+			}
+			cores[dev.UUID] = allowedCores(dev.Usedcores, u, shares)
+			if c := withBorrowed(dev.Usedcores, loans[t.dir][dev.UUID].Borrowed); c > cores[dev.UUID] {
+				cores[dev.UUID] = c
+			}
+		}
+		if t.burst() || borrowing {
+			allowed[t.dir] = cores
+		}
+		for _, path := range t.regions {
+			changed, err := setRegionCoreLimits(path, cores)
+			if err != nil {
+				klog.Errorf("set core limits of %v/%v %v: %v", t.pod.Namespace, t.pod.Name, t.ctr, err)
+				continue
+			}
+			for _, uuid := range changed {
+				klog.V(4).Infof("core limit of %v/%v %v on device %v set to %v%%", t.pod.Namespace, t.pod.Name, t.ctr, uuid, cores[uuid])
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func regionCoreLimit(t *testing.T, path string) uint64 {
+	buf, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	return binary.LittleEndian.Uint64(buf[regionSMLimitOffset:])
+}
+
+func TestLimitSyncerBurst(t *testing.T) {
+	pod := func(name, uid string, cores int32, burst bool) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: k8stypes.UID(uid), Annotations: map[string]string{
+				util.AssignedIDsAnnotations: annotations.EncodePodDevices(util.PodDevices{{
+					{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: cores},
+				}}),
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+		}
+		if burst {
+			p.Annotations[util.CoresBurstAnnotation] = "true"
+		}
+		return p
+	}
+	client := fake.NewSimpleClientset(pod("a", "uid1", 30, true), pod("b", "uid2", 50, false))
+	root := t.TempDir()
+	regionA := filepath.Join(root, "uid1_c", "a.cache")
+	regionB := filepath.Join(root, "uid2_c", "a.cache")
+	writeRegion(t, regionA, map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+	writeRegion(t, regionB, map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+
+	now := time.Unix(10000, 0)
+	utilization := uint(90)
+	l := &LimitSyncer{root: root, nodeName: "node1", client: client, now: func() time.Time { return now },
+		utilization: func(string) (uint, error) { return utilization, nil }}
+	sync := func(busyB bool) uint64 {
+		launch := now.Add(-time.Hour)
+		if busyB {
+			launch = now.Add(-time.Second)
+		}
+		writeHeartbeat(t, root, "uid2_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: launch.Unix()})
+		writeHeartbeat(t, root, "uid1_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: now.Unix()})
+		assert.NilError(t, l.sync(context.Background()))
+		return regionCoreLimit(t, regionA)
+	}
+
+	// alone on the device, a busy GPU is a's own doing
+	assert.Equal(t, sync(false), uint64(100))
+	cores, ok := allowedBurstCores("uid1_c", "GPU-0")
+	assert.Assert(t, ok)
+	assert.Equal(t, cores, int32(100))
+	// b is busy but the device isn't contended yet, a keeps clear of b's share
+	utilization = 40
+	assert.Equal(t, sync(true), uint64(50))
+	// both are busy, a is held to its share
+	utilization = 90
+	assert.Equal(t, sync(true), uint64(30))
+	cores, _ = allowedBurstCores("uid1_c", "GPU-0")
+	assert.Equal(t, cores, int32(30))
+	// b that may not burst keeps its limit
+	assert.Equal(t, regionCoreLimit(t, regionB), uint64(0))
+	_, ok = allowedBurstCores("uid2_c", "GPU-0")
+	assert.Assert(t, !ok)
+
+	assert.Equal(t, sync(false), uint64(100))
+}
@@ -17,19 +17,148 @@
 package nvidiadevice
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// nvmlSampleInterval is how often the sampler queries NVML about the devices.
+const nvmlSampleInterval = 10 * time.Second
+
+// DeviceSample is what NVML reported about a device, memory is in MiB.
+type DeviceSample struct {
+	Model  string
+	Memory int32
+	Free   uint64
+	// ComputeMode of the device, only DEFAULT lets it be split
+	ComputeMode ComputeMode
+	// Contexts is the number of processes using the device, each holds a CUDA context
+	Contexts int
+	// Temperature of the device in °C, 0 if NVML doesn't know it
+	Temperature uint
+}
+
+// DeviceSnapshot is the state of the devices published by the sampler. It is never
+// modified once published, so readers need no lock and never wait for NVML.
+type DeviceSnapshot struct {
+	// Devices are copies of the cached devices with their health at the time
+	Devices []*Device
+	// Samples holds the last NVML sample of each device by UUID, devices NVML never
+	// answered for have none
+	Samples map[string]DeviceSample
+	// Blacklisted holds the UUIDs of the devices an operator took out of scheduling
+	Blacklisted map[string]bool
+	// Drained holds the UUIDs of the devices drained with util.DrainDeviceAnnotation
+	Drained map[string]bool
+	// Legacy holds the UUIDs of the devices kept out of the pool for pods of the stock
+	// device plugin, see LegacyMigration
+	Legacy map[string]bool
+}
+
+// Device returns the device with the given ID, nil if there is none.
+func (s *DeviceSnapshot) Device(id string) *Device {
+	for _, dev := range s.Devices {
+		if dev.ID == id {
+			return dev
+		}
+	}
+	return nil
+}
+
+type sampleResult struct {
+	sample DeviceSample
+	err    error
+}
+
+// queryDevice asks NVML about the device with the given UUID.
+var queryDevice = func(uuid string) (DeviceSample, error) {
+	sample, err := nvmlLib.Query(uuid)
+	if err != nil {
+		return sample, err
+	}
+	sample.ComputeMode = queryComputeMode(uuid)
+	sample.Contexts = queryContexts(uuid)
+	return sample, nil
+}
+
+// queryContexts counts the processes using the GPU, GPUs whose driver doesn't tell are
+// taken for idle.
+func queryContexts(uuid string) int {
+	procs, err := nvmlLib.Processes(uuid)
+	if err != nil {
+		klog.V(4).Infof("list processes of %v: %v", uuid, err)
+		return 0
+	}
+	return len(procs)
+}
+
+// DeviceCache enumerates the devices once and then samples them with NVML on a goroutine
+// of its own, publishing a DeviceSnapshot after every change. The gRPC paths only read
+// the snapshot, so a slow or hung driver can't stall kubelet.
+//
+// mutex guards the health of the devices and is only held by the sampler and the health
+// check. Watches have locks of their own and Allocate only signals the goroutine sending
+// to them, so neither waits for the other or for a snapshot being built.
 type DeviceCache struct {
 	GpuDeviceManager
 
 	cache     []*Device
 	stopCh    chan interface{}
 	unhealthy chan *Device
-	notifyCh  map[string]chan *Device
 	mutex     sync.Mutex
+	// startOnce and stopOnce make Start and Stop safe to call more than once
+	startOnce sync.Once
+	stopOnce  sync.Once
+
+	// watchers holds the map[chan DeviceEvent]struct{} of the watches, which receive
+	// every snapshot published. It is replaced under watchMu rather than modified, so
+	// senders read it without a lock.
+	watchers atomic.Value
+	watchMu  sync.Mutex
+	// sendMu orders storing and sending snapshots, so the last one a watcher gets is the latest
+	sendMu sync.Mutex
+	// republish asks the sender to send the latest snapshot again
+	republish chan struct{}
+	// refresh asks the sampler to enumerate the devices again, see Refresh
+	refresh chan chan refreshReply
+	// stopHealth stops the health check of the devices enumerated last, only the
+	// sampler uses it after Start
+	stopHealth func()
+
+	// snapshot holds the *DeviceSnapshot last published
+	snapshot atomic.Value
+	// xid and hung are the devices found unhealthy by the XID check and by NVML queries
+	// timing out, blacklist those taken out of scheduling, drained those drained for
+	// maintenance, legacy those held by pods of the stock device plugin, samples the last
+	// sample of each device, all guarded by mutex
+	xid       map[string]bool
+	hung      map[string]bool
+	blacklist map[string]bool
+	drained   map[string]bool
+	legacy    map[string]bool
+	samples   map[string]DeviceSample
+	// failed are the devices reported unhealthy for xid or hung, disagreed since when
+	// xid and hung disagree with failed, see settleHealth, both guarded by mutex
+	failed    map[string]bool
+	disagreed map[string]time.Time
+	now       func() time.Time
+	// pending are the queries still running, enumerating the enumeration still running
+	// after it timed out, only the sampler uses them
+	pending     map[string]chan sampleResult
+	enumerating chan enumerateResult
+	// nvmlLog coalesces the NVML errors repeated every sample
+	nvmlLog *logThrottle
+
+	// profiles are set before the plugins start and again when the node config is
+	// reloaded, owners maps a device to the profile selecting it, both guarded by profileMu
+	profileMu sync.RWMutex
+	profiles  []*Profile
+	owners    map[string]*Profile
 }
 
 func NewDeviceCache() *DeviceCache {
@@ -37,48 +166,402 @@ func NewDeviceCache() *DeviceCache {
 		GpuDeviceManager: GpuDeviceManager{true},
 		stopCh:           make(chan interface{}),
 		unhealthy:        make(chan *Device),
-		notifyCh:         make(map[string]chan *Device),
+		republish:        make(chan struct{}, 1),
+		refresh:          make(chan chan refreshReply),
+		xid:              make(map[string]bool),
+		hung:             make(map[string]bool),
+		failed:           make(map[string]bool),
+		disagreed:        make(map[string]time.Time),
+		now:              time.Now,
+		blacklist:        make(map[string]bool),
+		drained:          make(map[string]bool),
+		legacy:           make(map[string]bool),
+		samples:          make(map[string]DeviceSample),
+		pending:          make(map[string]chan sampleResult),
+		nvmlLog:          newLogThrottle(nvmlErrorLogInterval),
 	}
 }
 
-func (d *DeviceCache) AddNotifyChannel(name string, ch chan *Device) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	d.notifyCh[name] = ch
+// DeviceEvent is a snapshot published by the cache. Changed are the IDs of the devices
+// whose health changed since the watcher's last event, removed devices included; it is
+// empty when only the samples changed or the snapshot was republished.
+type DeviceEvent struct {
+	Snapshot *DeviceSnapshot
+	Changed  []string
 }
 
-func (d *DeviceCache) RemoveNotifyChannel(name string) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	delete(d.notifyCh, name)
+// Watch returns a channel receiving the snapshots published from now on, a reader too
+// slow for every snapshot gets the latest with the changes of those it missed. cancel
+// ends the watch and may be called more than once.
+func (d *DeviceCache) Watch() (<-chan DeviceEvent, func()) {
+	ch := make(chan DeviceEvent, 1)
+	d.updateWatchers(func(watchers map[chan DeviceEvent]struct{}) {
+		watchers[ch] = struct{}{}
+	})
+	return ch, func() {
+		d.updateWatchers(func(watchers map[chan DeviceEvent]struct{}) {
+			delete(watchers, ch)
+		})
+	}
+}
+
+// updateWatchers replaces the watchers by a copy changed by update.
+func (d *DeviceCache) updateWatchers(update func(map[chan DeviceEvent]struct{})) {
+	d.watchMu.Lock()
+	defer d.watchMu.Unlock()
+	old, _ := d.watchers.Load().(map[chan DeviceEvent]struct{})
+	watchers := make(map[chan DeviceEvent]struct{}, len(old)+1)
+	for ch := range old {
+		watchers[ch] = struct{}{}
+	}
+	update(watchers)
+	d.watchers.Store(watchers)
 }
 
+// Republish sends the devices to the watchers again unchanged, telling them about a change
+// outside the cache, like an allocation. It doesn't wait for them.
+func (d *DeviceCache) Republish() {
+	select {
+	case d.republish <- struct{}{}:
+	default:
+	}
+}
+
+// Start enumerates the devices and starts sampling them, only the first call does.
 func (d *DeviceCache) Start() {
-	d.cache = d.Devices()
-	go d.CheckHealth(d.stopCh, d.cache, d.unhealthy)
-	go d.notify()
+	d.startOnce.Do(func() {
+		d.cache = d.Devices()
+		d.sample()
+		d.stopHealth = d.watchHealth()
+		go d.notify()
+		go d.sampleLoop()
+		go d.republishLoop()
+	})
 }
 
+func (d *DeviceCache) republishLoop() {
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-d.republish:
+			d.send(nil, nil)
+		}
+	}
+}
+
+// Stop stops sampling the devices, calls after the first do nothing.
 func (d *DeviceCache) Stop() {
-	close(d.stopCh)
+	d.stopOnce.Do(func() { close(d.stopCh) })
+}
+
+// Done returns a channel closed by Stop.
+func (d *DeviceCache) Done() <-chan interface{} {
+	return d.stopCh
 }
 
+// GetCache returns the devices with their health as last published.
 func (d *DeviceCache) GetCache() []*Device {
+	if s := d.Snapshot(); s != nil {
+		return s.Devices
+	}
 	return d.cache
 }
 
+// Snapshot returns the state of the devices last published, nil before Start.
+func (d *DeviceCache) Snapshot() *DeviceSnapshot {
+	s, _ := d.snapshot.Load().(*DeviceSnapshot)
+	return s
+}
+
+// Sample returns the last NVML sample of the device with the given UUID.
+func (d *DeviceCache) Sample(uuid string) (DeviceSample, bool) {
+	s := d.Snapshot()
+	if s == nil {
+		return DeviceSample{}, false
+	}
+	sample, ok := s.Samples[uuid]
+	return sample, ok
+}
+
+// SetProfiles splits the cached devices into profiles, a device belongs to one
+// profile at most and the devices no profile selects to def, the default profile.
+func (d *DeviceCache) SetProfiles(def *Profile, profiles []*Profile) error {
+	if err := ValidateProfiles(def, profiles); err != nil {
+		return err
+	}
+	owners := make(map[string]*Profile)
+	for _, p := range profiles {
+		for _, id := range p.Devices {
+			owners[id] = p
+		}
+	}
+	for id, p := range owners {
+		found := false
+		for _, dev := range d.cache {
+			if dev.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			klog.Warningf("device %v of profile %q not found on this node", id, p.Name)
+		}
+	}
+	d.profileMu.Lock()
+	defer d.profileMu.Unlock()
+	d.profiles = append([]*Profile{def}, profiles...)
+	d.owners = owners
+	return nil
+}
+
+// Profiles returns the default profile followed by the configured ones.
+func (d *DeviceCache) Profiles() []*Profile {
+	d.profileMu.RLock()
+	defer d.profileMu.RUnlock()
+	if d.profiles == nil {
+		return []*Profile{DefaultProfile()}
+	}
+	return d.profiles
+}
+
+// DeviceProfile returns the profile device id belongs to.
+func (d *DeviceCache) DeviceProfile(id string) *Profile {
+	d.profileMu.RLock()
+	p, ok := d.owners[id]
+	d.profileMu.RUnlock()
+	if ok {
+		return p
+	}
+	return d.Profiles()[0]
+}
+
+// SplitCount returns the number of slices device id is split into, as config.DeviceSplitCountMap
+// sets it or else its profile.
+func (d *DeviceCache) SplitCount(id string) uint {
+	return splitCount(d.DeviceProfile(id), id)
+}
+
+func splitCount(profile *Profile, id string) uint {
+	if count, ok := config.DeviceSplitCountMap[id]; ok {
+		return uint(count)
+	}
+	return profile.DeviceSplitCount
+}
+
+// ProfileDevices returns the cached devices of the profile named name.
+func (d *DeviceCache) ProfileDevices(name string) []*Device {
+	var res []*Device
+	for _, dev := range d.GetCache() {
+		if d.DeviceProfile(dev.ID).Name == name {
+			res = append(res, dev)
+		}
+	}
+	return res
+}
+
 func (d *DeviceCache) notify() {
 	for {
 		select {
 		case <-d.stopCh:
 			return
 		case dev := <-d.unhealthy:
-			dev.Health = pluginapi.Unhealthy
+			// FIXME: there is no way to recover from an XID error.
 			d.mutex.Lock()
-			for _, ch := range d.notifyCh {
-				ch <- dev
-			}
+			d.xid[dev.ID] = true
+			d.publish(d.settleHealth())
 			d.mutex.Unlock()
 		}
 	}
 }
+
+func (d *DeviceCache) sampleLoop() {
+	ticker := time.NewTicker(nvmlSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+			d.sample()
+		case reply := <-d.refresh:
+			res, err := d.reenumerate()
+			reply <- refreshReply{res, err}
+		}
+	}
+}
+
+// sample queries NVML about all devices in parallel and publishes the answers. A device
+// whose query takes longer than config.NVMLQueryTimeout is unhealthy until a query
+// answers in time again, the late query is left running and no new one starts for the
+// device until it returns. Samples with less memory than config.MinPlausibleMemory are
+// dropped, so the device keeps its last good sample.
+func (d *DeviceCache) sample() {
+	query := queryDevice
+	for _, dev := range d.cache {
+		if _, ok := d.pending[dev.ID]; ok {
+			continue
+		}
+		ch := make(chan sampleResult, 1)
+		d.pending[dev.ID] = ch
+		go func(uuid string) {
+			sample, err := query(uuid)
+			ch <- sampleResult{sample, err}
+		}(dev.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.NVMLQueryTimeout)
+	defer cancel()
+	hung := make(map[string]bool)
+	samples := make(map[string]DeviceSample)
+	for _, dev := range d.cache {
+		select {
+		case res := <-d.pending[dev.ID]:
+			delete(d.pending, dev.ID)
+			if res.err != nil {
+				d.nvmlLog.Errorf("query device %v: %v", dev.ID, res.err)
+				continue
+			}
+			if res.sample.Memory <= 0 || res.sample.Memory < config.MinPlausibleMemory {
+				// transient driver glitches report no memory, keep the last good sample
+				d.nvmlLog.Warningf("NVML reported implausible memory %vMiB for device %v, keeping the last sample", res.sample.Memory, dev.ID)
+				continue
+			}
+			samples[dev.ID] = res.sample
+		case <-ctx.Done():
+			hung[dev.ID] = true
+		}
+	}
+	d.nvmlLog.flush()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, dev := range d.cache {
+		if hung[dev.ID] == d.hung[dev.ID] {
+			continue
+		}
+		if hung[dev.ID] {
+			klog.Warningf("NVML didn't answer for device %v within %v, marking it unhealthy", dev.ID, config.NVMLQueryTimeout)
+			NVMLQueryTimeouts.WithLabelValues(dev.ID).Inc()
+		} else {
+			klog.Infof("NVML answers for device %v again", dev.ID)
+		}
+	}
+	d.hung = hung
+	for id, s := range samples {
+		if former, ok := d.samples[id]; ok && former.ComputeMode != s.ComputeMode || !ok && s.ComputeMode != ComputeModeDefault {
+			warnComputeMode(id, s.ComputeMode)
+		}
+		d.samples[id] = s
+	}
+	d.publish(d.settleHealth())
+}
+
+// settleHealth updates failed from the health checks and returns the devices whose
+// reported health changed. A device changes once the checks kept disagreeing with its
+// reported health for config.UnhealthyGracePeriod, so NVML errors during a driver hiccup
+// don't flip it. The sampler calls it every nvmlSampleInterval, the caller holds mutex.
+func (d *DeviceCache) settleHealth() []string {
+	now := d.now()
+	var changed []string
+	for _, dev := range d.cache {
+		failing := d.xid[dev.ID] || d.hung[dev.ID]
+		if failing == d.failed[dev.ID] {
+			delete(d.disagreed, dev.ID)
+			continue
+		}
+		since, ok := d.disagreed[dev.ID]
+		if !ok {
+			since = now
+			d.disagreed[dev.ID] = now
+		}
+		if now.Sub(since) < config.UnhealthyGracePeriod {
+			klog.V(3).Infof("device %v failing: %v for %v, within the grace period", dev.ID, failing, now.Sub(since))
+			continue
+		}
+		delete(d.disagreed, dev.ID)
+		d.failed[dev.ID] = failing
+		changed = append(changed, dev.ID)
+		if failing {
+			klog.Warningf("device %v failed health checks for %v, marking it unhealthy", dev.ID, now.Sub(since))
+		} else if config.UnhealthyGracePeriod > 0 {
+			klog.Infof("device %v passed health checks for %v, marking it healthy", dev.ID, now.Sub(since))
+		}
+	}
+	return changed
+}
+
+// publish stores a new snapshot and sends it to the watchers with the devices whose
+// health changed, the caller holds mutex.
+func (d *DeviceCache) publish(changed []string) {
+	s := &DeviceSnapshot{
+		Samples:     make(map[string]DeviceSample, len(d.samples)),
+		Blacklisted: make(map[string]bool),
+		Drained:     make(map[string]bool),
+		Legacy:      make(map[string]bool),
+	}
+	for _, dev := range d.cache {
+		c := *dev
+		if d.failed[dev.ID] || d.blacklist[dev.ID] || d.drained[dev.ID] {
+			c.Health = pluginapi.Unhealthy
+		}
+		if d.blacklist[dev.ID] {
+			s.Blacklisted[dev.ID] = true
+		}
+		if d.drained[dev.ID] {
+			s.Drained[dev.ID] = true
+		}
+		if d.legacy[dev.ID] {
+			s.Legacy[dev.ID] = true
+		}
+		s.Devices = append(s.Devices, &c)
+	}
+	for id, sample := range d.samples {
+		s.Samples[id] = sample
+	}
+	d.send(s, changed)
+}
+
+// send stores s as the snapshot unless it is nil and sends the snapshot to the watchers
+// with the devices changed.
+func (d *DeviceCache) send(s *DeviceSnapshot, changed []string) {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	if s != nil {
+		d.snapshot.Store(s)
+	} else if s = d.Snapshot(); s == nil {
+		return
+	}
+	watchers, _ := d.watchers.Load().(map[chan DeviceEvent]struct{})
+	for ch := range watchers {
+		ev := DeviceEvent{Snapshot: s, Changed: changed}
+		// only send sends, so the channel has room once the stale event is dropped, whose
+		// changes the watcher must still hear about
+		select {
+		case stale := <-ch:
+			ev.Changed = mergeChanged(stale.Changed, changed)
+		default:
+		}
+		ch <- ev
+	}
+}
+
+// mergeChanged returns the IDs in a or b, each once.
+func mergeChanged(a, b []string) []string {
+	if len(a) == 0 {
+		return b
+	}
+	res := append([]string(nil), a...)
+	for _, id := range b {
+		found := false
+		for _, seen := range a {
+			if seen == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, id)
+		}
+	}
+	return res
+}
@@ -0,0 +1,605 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newTestCache(t testing.TB, n int, query func(uuid string) (DeviceSample, error)) *DeviceCache {
+	oldQuery, oldTimeout := queryDevice, config.NVMLQueryTimeout
+	t.Cleanup(func() { queryDevice, config.NVMLQueryTimeout = oldQuery, oldTimeout })
+	queryDevice = query
+	config.NVMLQueryTimeout = 50 * time.Millisecond
+	d := NewDeviceCache()
+	for i := 0; i < n; i++ {
+		d.cache = append(d.cache, &Device{Device: pluginapi.Device{ID: fmt.Sprintf("GPU-%d", i), Health: pluginapi.Healthy}})
+	}
+	return d
+}
+
+// changed returns the devices changed by the event pending on events, nil if none is.
+func changed(events <-chan DeviceEvent) []string {
+	select {
+	case ev := <-events:
+		return ev.Changed
+	default:
+		return nil
+	}
+}
+
+func TestSampleMarksHungDeviceUnhealthy(t *testing.T) {
+	release := make(chan struct{})
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		if uuid == "GPU-1" {
+			<-release
+		}
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 12000}, nil
+	})
+	events, cancel := d.Watch()
+	defer cancel()
+
+	d.sample()
+	devs := d.GetCache()
+	assert.Equal(t, devs[0].Health, pluginapi.Healthy)
+	assert.Equal(t, devs[1].Health, pluginapi.Unhealthy)
+	assert.DeepEqual(t, changed(events), []string{"GPU-1"})
+	sample, ok := d.Sample("GPU-0")
+	assert.Assert(t, ok)
+	assert.Equal(t, sample.Memory, int32(16000))
+	_, ok = d.Sample("GPU-1")
+	assert.Assert(t, !ok)
+	assert.Equal(t, testutil.ToFloat64(NVMLQueryTimeouts.WithLabelValues("GPU-1")), float64(1))
+
+	// the hung query isn't started again, nor counted twice
+	d.sample()
+	assert.Equal(t, testutil.ToFloat64(NVMLQueryTimeouts.WithLabelValues("GPU-1")), float64(1))
+	assert.Equal(t, len(changed(events)), 0)
+
+	close(release)
+	d.sample()
+	assert.Equal(t, d.GetCache()[1].Health, pluginapi.Healthy)
+	assert.DeepEqual(t, changed(events), []string{"GPU-1"})
+	_, ok = d.Sample("GPU-1")
+	assert.Assert(t, ok)
+}
+
+func TestUnhealthyGracePeriod(t *testing.T) {
+	oldGrace := config.UnhealthyGracePeriod
+	t.Cleanup(func() { config.UnhealthyGracePeriod = oldGrace })
+	config.UnhealthyGracePeriod = 30 * time.Second
+	d := newTestCache(t, 1, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000}, nil
+	})
+	now := time.Unix(1690000000, 0)
+	d.now = func() time.Time { return now }
+	events, cancel := d.Watch()
+	defer cancel()
+	// check runs the health checks after step, the hung device failing them
+	check := func(step time.Duration, hung bool) string {
+		now = now.Add(step)
+		d.mutex.Lock()
+		d.hung["GPU-0"] = hung
+		d.publish(d.settleHealth())
+		d.mutex.Unlock()
+		return d.GetCache()[0].Health
+	}
+
+	// a device flapping within the grace period stays healthy
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, check(10*time.Second, true), pluginapi.Healthy)
+		assert.Equal(t, check(10*time.Second, false), pluginapi.Healthy)
+	}
+	assert.Equal(t, len(changed(events)), 0)
+
+	// it turns unhealthy once it kept failing for the grace period
+	assert.Equal(t, check(10*time.Second, true), pluginapi.Healthy)
+	assert.Equal(t, check(20*time.Second, true), pluginapi.Healthy)
+	assert.Equal(t, check(10*time.Second, true), pluginapi.Unhealthy)
+	assert.DeepEqual(t, changed(events), []string{"GPU-0"})
+
+	// and recovers once it kept passing for it
+	assert.Equal(t, check(10*time.Second, false), pluginapi.Unhealthy)
+	assert.Equal(t, check(10*time.Second, true), pluginapi.Unhealthy)
+	assert.Equal(t, check(10*time.Second, false), pluginapi.Unhealthy)
+	assert.Equal(t, check(30*time.Second, false), pluginapi.Healthy)
+	assert.DeepEqual(t, changed(events), []string{"GPU-0"})
+
+	// without a grace period changes are reported at once
+	config.UnhealthyGracePeriod = 0
+	assert.Equal(t, check(time.Second, true), pluginapi.Unhealthy)
+	assert.Equal(t, check(time.Second, false), pluginapi.Healthy)
+}
+
+// BenchmarkListAndWatchUpdate measures how long a health change takes to reach kubelet
+// while every NVML query takes 10ms. It stays in microseconds however many devices there
+// are, only building the device list grows with them, where querying NVML on the way
+// would add 10ms for each device.
+func BenchmarkListAndWatchUpdate(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, n := range []int{1, 8, 16, 64} {
+		b.Run(fmt.Sprintf("devices=%d", n), func(b *testing.B) {
+			d := newTestCache(b, n, func(string) (DeviceSample, error) {
+				time.Sleep(10 * time.Millisecond)
+				return DeviceSample{Model: "A100", Memory: 16000}, nil
+			})
+			// no device turns unhealthy on a busy machine
+			config.NVMLQueryTimeout = time.Second
+			d.sample()
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			defer func() {
+				close(stop)
+				<-stopped
+			}()
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						d.sample()
+					}
+				}
+			}()
+
+			m := &NvidiaDevicePlugin{
+				deviceCache: d,
+				migStrategy: "none",
+				profile:     &Profile{DeviceSplitCount: 10},
+				stop:        make(chan interface{}),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sent := make(chan struct{})
+			go m.ListAndWatch(&pluginapi.Empty{}, &fakeListAndWatchServer{ctx: ctx, sent: sent})
+			<-sent
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.mutex.Lock()
+				d.publish([]string{d.cache[i%n].ID})
+				d.mutex.Unlock()
+				<-sent
+			}
+			b.StopTimer()
+			close(m.stop)
+		})
+	}
+}
+
+func TestSampleKeepsLastPlausibleMemory(t *testing.T) {
+	memory := int32(16000)
+	d := newTestCache(t, 1, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: memory, Free: 12000}, nil
+	})
+	d.sample()
+	memory = 0
+	d.sample()
+	sample, ok := d.Sample("GPU-0")
+	assert.Assert(t, ok)
+	assert.Equal(t, sample.Memory, int32(16000))
+
+	memory = 512
+	d.sample()
+	sample, _ = d.Sample("GPU-0")
+	assert.Equal(t, sample.Memory, int32(16000))
+
+	memory = 15000
+	d.sample()
+	sample, _ = d.Sample("GPU-0")
+	assert.Equal(t, sample.Memory, int32(15000))
+}
+
+// BenchmarkAllocateUnderStatsLoad measures Allocate while agents follow the devices on the
+// runtime socket, some reading every snapshot and some opening and closing watches, and
+// the sampler publishes a snapshot every millisecond.
+func BenchmarkAllocateUnderStatsLoad(b *testing.B) {
+	klog.LogToStderr(false)
+	klog.SetOutput(io.Discard)
+	defer klog.LogToStderr(true)
+	for _, n := range []int{0, 64, 512} {
+		b.Run(fmt.Sprintf("watchers=%d", n), func(b *testing.B) {
+			toAllocate := "GPU-0,NVIDIA,1000,30:"
+			m, client := setupAllocate(b, toAllocate)
+			d := newTestCache(b, 2, func(string) (DeviceSample, error) {
+				return DeviceSample{Model: "A100", Memory: 16000}, nil
+			})
+			d.sample()
+			go d.republishLoop()
+			defer d.Stop()
+			m.deviceCache = d
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			defer func() {
+				close(stop)
+				wg.Wait()
+			}()
+			load := func(f func()) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							f()
+						}
+					}
+				}()
+			}
+			for i := 0; i < n; i++ {
+				snapshots, cancel := d.Watch()
+				load(func() {
+					select {
+					case ev := <-snapshots:
+						_ = len(ev.Snapshot.Devices)
+					case <-stop:
+					}
+				})
+				defer cancel()
+			}
+			for i := 0; i < 4; i++ {
+				load(func() {
+					_, cancel := d.Watch()
+					d.Snapshot()
+					cancel()
+				})
+			}
+			load(func() {
+				d.sample()
+				time.Sleep(time.Millisecond)
+			})
+
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				pod, err := client.CoreV1().Pods("default").Get(ctx, "p", metav1.GetOptions{})
+				assert.NilError(b, err)
+				pod.Annotations[util.DeviceBindPhase] = util.DeviceBindAllocating
+				pod.Annotations[util.AssignedIDsToAllocateAnnotations] = toAllocate
+				_, err = client.CoreV1().Pods("default").Update(ctx, pod, metav1.UpdateOptions{})
+				assert.NilError(b, err)
+				node, err := client.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+				assert.NilError(b, err)
+				node.Annotations[util.NodeLockTime] = "locked"
+				_, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+				assert.NilError(b, err)
+				b.StartTimer()
+
+				_, err = m.Allocate(ctx, allocateRequest("GPU-0-0"))
+				assert.NilError(b, err)
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+func TestSplitCountMap(t *testing.T) {
+	oldSplit, oldScaling, oldMap := config.DeviceSplitCount, config.DeviceMemoryScaling, config.DeviceSplitCountMap
+	t.Cleanup(func() {
+		config.DeviceSplitCount, config.DeviceMemoryScaling, config.DeviceSplitCountMap = oldSplit, oldScaling, oldMap
+	})
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 10, 1
+	config.DeviceSplitCountMap = map[string]int{"GPU-1": 8, "GPU-2": 2, "GPU-9": 3}
+	memory := map[string]int32{"GPU-0": 16000, "GPU-1": 48000, "GPU-2": 12000, "GPU-3": 24000}
+	d := newTestCache(t, 4, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: memory[uuid], Free: uint64(memory[uuid])}, nil
+	})
+	d.sample()
+	// the map overrides the split count of a profile, its memory scaling still applies
+	training := &Profile{Name: "training", Devices: []string{"GPU-1", "GPU-3"}, DeviceSplitCount: 4, DeviceMemoryScaling: 2}
+	assert.NilError(t, d.SetProfiles(DefaultProfile(), []*Profile{training}))
+
+	for _, tc := range []struct {
+		uuid        string
+		split       uint
+		advertised  int32
+		sliceMemory int32
+	}{
+		{uuid: "GPU-0", split: 10, advertised: 16000, sliceMemory: 1600},
+		{uuid: "GPU-1", split: 8, advertised: 96000, sliceMemory: 12000},
+		{uuid: "GPU-2", split: 2, advertised: 12000, sliceMemory: 6000},
+		{uuid: "GPU-3", split: 4, advertised: 48000, sliceMemory: 12000},
+	} {
+		assert.Equal(t, d.SplitCount(tc.uuid), tc.split, tc.uuid)
+		sample, _ := d.Sample(tc.uuid)
+		dev := &Device{Device: pluginapi.Device{ID: tc.uuid, Health: pluginapi.Healthy}}
+		info := advertisedDevice(dev, sample, d.DeviceProfile(tc.uuid), d.SplitCount(tc.uuid), &corev1.Node{}, 0)
+		assert.Equal(t, info.Count, int32(tc.split), tc.uuid)
+		assert.Equal(t, info.Devmem, tc.advertised, tc.uuid)
+		mem, split, ok := d.sliceMemory(tc.uuid)
+		assert.Assert(t, ok, tc.uuid)
+		assert.Equal(t, mem/split, tc.sliceMemory, tc.uuid)
+	}
+	check := d.CheckCapacity()
+	assert.Equal(t, check.Checked, 4)
+	assert.Equal(t, len(check.Mismatches), 0)
+
+	m := &NvidiaDevicePlugin{deviceCache: d, migStrategy: "none", profile: training}
+	assert.Equal(t, len(m.apiDevices()), 12)
+	m = &NvidiaDevicePlugin{deviceCache: d, migStrategy: "none", profile: d.Profiles()[0]}
+	assert.Equal(t, len(m.apiDevices()), 12)
+}
+
+// enumerationNVML only enumerates devs.
+type enumerationNVML struct {
+	NVML
+	devs []*NVMLDevice
+}
+
+func (n *enumerationNVML) DeviceCount() (uint, error) {
+	return uint(len(n.devs)), nil
+}
+
+func (n *enumerationNVML) Device(index uint) (*NVMLDevice, error) {
+	return n.devs[index], nil
+}
+
+func TestDuplicateUUIDsTrackedSeparately(t *testing.T) {
+	oldLib := nvmlLib
+	t.Cleanup(func() {
+		nvmlLib = oldLib
+		compositeDevices.index = make(map[string]uint)
+	})
+	nvmlLib = &enumerationNVML{devs: []*NVMLDevice{
+		{UUID: "GPU-a", BusID: "00000000:3B:00.0", Memory: 16000},
+		{UUID: "GPU-a", BusID: "00000000:5E:00.0", Memory: 24000},
+		{UUID: "", BusID: "00000000:86:00.0", Memory: 32000},
+		{UUID: "GPU-b", BusID: "00000000:AF:00.0", Memory: 40000},
+		{UUID: "", Memory: 48000},
+	}}
+	var d *DeviceCache
+	d = newTestCache(t, 0, func(uuid string) (DeviceSample, error) {
+		for _, dev := range d.cache {
+			if dev.ID == uuid {
+				return DeviceSample{Model: "A100", Memory: int32(dev.Memory), Free: dev.Memory}, nil
+			}
+		}
+		return DeviceSample{}, fmt.Errorf("no device %v", uuid)
+	})
+	d.cache = d.Devices()
+
+	var ids []string
+	for _, dev := range d.cache {
+		ids = append(ids, dev.ID)
+	}
+	assert.DeepEqual(t, ids, []string{
+		"GPU-a_pci-00000000-3b-00-0",
+		"GPU-a_pci-00000000-5e-00-0",
+		"GPU-nouuid_pci-00000000-86-00-0",
+		"GPU-b",
+		"GPU-nouuid_pci-index4",
+	})
+	d.sample()
+	for i, id := range ids {
+		sample, ok := d.Sample(id)
+		assert.Assert(t, ok, id)
+		assert.Equal(t, sample.Memory, int32(16000+8000*i), id)
+	}
+
+	for i, want := range []string{"GPU-a", "GPU-a", "", "GPU-b", ""} {
+		gpu, _, _ := parseDeviceID(ids[i])
+		assert.Equal(t, gpu, want, ids[i])
+	}
+	response := &pluginapi.ContainerAllocateResponse{Envs: make(map[string]string)}
+	setVisibleDevices(response, ids)
+	assert.Equal(t, response.Envs["NVIDIA_VISIBLE_DEVICES"], "0,1,2,GPU-b,4")
+}
+
+func TestDevicesReportLinks(t *testing.T) {
+	oldLib := nvmlLib
+	t.Cleanup(func() {
+		nvmlLib = oldLib
+		compositeDevices.index = make(map[string]uint)
+	})
+	// GPU-a and GPU-b are NVLinked, GPU-c only shares a PCIe switch with them, and the GPU
+	// at 00000000:D8:00.0 is left out
+	nvmlLib = &enumerationNVML{devs: []*NVMLDevice{
+		{UUID: "GPU-a", BusID: "00000000:3B:00.0", Links: map[string]int32{"00000000:5E:00.0": 10, "00000000:86:00.0": 5, "00000000:D8:00.0": 5}},
+		{UUID: "GPU-b", BusID: "00000000:5E:00.0", Links: map[string]int32{"00000000:3B:00.0": 10, "00000000:86:00.0": 5}},
+		{UUID: "GPU-c", BusID: "00000000:86:00.0", Links: map[string]int32{"00000000:3B:00.0": 5, "00000000:5E:00.0": 5}},
+	}}
+	d := newTestCache(t, 0, nil)
+	assert.DeepEqual(t, deviceLinks(d.Devices()), []annotations.DeviceLink{
+		{A: "GPU-a", B: "GPU-b", Level: 10},
+		{A: "GPU-a", B: "GPU-c", Level: 5},
+		{A: "GPU-b", B: "GPU-c", Level: 5},
+	})
+}
+
+func TestCacheStartsAndStopsOnce(t *testing.T) {
+	oldLib := nvmlLib
+	t.Cleanup(func() {
+		nvmlLib = oldLib
+		compositeDevices.index = make(map[string]uint)
+	})
+	t.Setenv(envDisableHealthChecks, "all")
+	lib := &countingNVML{enumerationNVML: enumerationNVML{devs: []*NVMLDevice{{UUID: "GPU-a", BusID: "00000000:3B:00.0", Memory: 16000}}}}
+	nvmlLib = lib
+	d := newTestCache(t, 0, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	// each call runs on goroutines of its own, so -race sees them overlap
+	concurrently := func(f func()) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f()
+			}()
+		}
+		wg.Wait()
+	}
+
+	concurrently(d.Start)
+	assert.Equal(t, atomic.LoadInt32(&lib.enumerations), int32(1))
+	assert.Equal(t, len(d.GetCache()), 1)
+	select {
+	case <-d.Done():
+		t.Fatal("cache done before Stop")
+	default:
+	}
+
+	concurrently(d.Stop)
+	<-d.Done()
+	d.Stop()
+	d.Start()
+	assert.Equal(t, atomic.LoadInt32(&lib.enumerations), int32(1))
+}
+
+// countingNVML counts the enumerations of devs.
+type countingNVML struct {
+	enumerationNVML
+	enumerations int32
+}
+
+func (n *countingNVML) DeviceCount() (uint, error) {
+	atomic.AddInt32(&n.enumerations, 1)
+	return n.enumerationNVML.DeviceCount()
+}
+
+func TestWatchMergesMissedChanges(t *testing.T) {
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000}, nil
+	})
+	events, cancel := d.Watch()
+	publish := func(changed ...string) {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.publish(changed)
+	}
+
+	publish("GPU-0")
+	publish()
+	publish("GPU-1", "GPU-0")
+	ev := <-events
+	assert.DeepEqual(t, ev.Changed, []string{"GPU-0", "GPU-1"})
+	assert.Equal(t, ev.Snapshot, d.Snapshot())
+	assert.Equal(t, len(events), 0)
+
+	publish()
+	assert.Equal(t, len((<-events).Changed), 0)
+
+	cancel()
+	cancel()
+	publish("GPU-0")
+	assert.Equal(t, len(events), 0)
+}
+
+// TestWatchConcurrently has watches start, end and read while snapshots are published,
+// run it with -race.
+func TestWatchConcurrently(t *testing.T) {
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000}, nil
+	})
+	d.sample()
+	var watchers, churn sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		events, cancel := d.Watch()
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			defer cancel()
+			// every watcher hears about the last change, however many it missed
+			for ev := range events {
+				assert.Check(t, ev.Snapshot != nil)
+				for _, id := range ev.Changed {
+					if id == "GPU-1" {
+						return
+					}
+				}
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		churn.Add(1)
+		go func() {
+			defer churn.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				events, cancel := d.Watch()
+				select {
+				case ev := <-events:
+					assert.Check(t, ev.Snapshot != nil)
+				default:
+				}
+				d.Snapshot()
+				cancel()
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		d.mutex.Lock()
+		d.publish([]string{"GPU-0"})
+		d.mutex.Unlock()
+		if i%100 == 0 {
+			d.sample()
+		}
+	}
+	d.mutex.Lock()
+	d.publish([]string{"GPU-1"})
+	d.mutex.Unlock()
+	watchers.Wait()
+	close(stop)
+	churn.Wait()
+}
+
+func TestExportDeviceMetrics(t *testing.T) {
+	d := newTestCache(t, 1, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Contexts: 3, Temperature: 65}, nil
+	})
+	d.sample()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ExportDeviceMetrics(d)
+	}()
+	d.Stop()
+	<-done
+	assert.Equal(t, testutil.ToFloat64(DeviceContexts.WithLabelValues("GPU-0")), float64(3))
+	assert.Equal(t, testutil.ToFloat64(DeviceTemperature.WithLabelValues("GPU-0")), float64(65))
+}
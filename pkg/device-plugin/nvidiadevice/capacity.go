@@ -0,0 +1,166 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// CapacityCheckPath is where the runtime service runs CheckCapacity.
+const CapacityCheckPath = "/capacity-check"
+
+// CapacityMismatch is a device whose advertised capacity and the limits its slices are
+// enforced with disagree, with the parameters both were computed from.
+type CapacityMismatch struct {
+	UUID    string `json:"uuid"`
+	Profile string `json:"profile"`
+	// Memory is the memory NVML reports in MiB, Scaling the memory scaling of the profile.
+	Memory     int32   `json:"memory"`
+	Scaling    float64 `json:"memoryScaling"`
+	SplitCount uint    `json:"splitCount"`
+	// Advertised is the memory registered with the scheduler in MiB, Count its slices.
+	Advertised int32 `json:"advertisedMemory"`
+	Count      int32 `json:"count"`
+	// SliceLimit is the memory limit a slice is enforced with in MiB.
+	SliceLimit int32  `json:"sliceLimit"`
+	Problem    string `json:"problem"`
+}
+
+// CapacityCheck is the result of CheckCapacity.
+type CapacityCheck struct {
+	// Checked is the number of devices NVML sampled, the others can't be checked yet.
+	Checked    int                `json:"checked"`
+	Mismatches []CapacityMismatch `json:"mismatches"`
+}
+
+// CheckCapacity recomputes the capacity advertised for each device, without memory kept
+// for processes outside vGPU accounting, and the memory limit a slice of it would be
+// injected with, and checks that they agree: the scaled memory fits its type, every
+// slice is enforced with the slice memory the scheduler accounts, in the environment
+// and in the shared region alike, the slices fit the physical memory unless it is
+// oversubscribed, and a slice allocated without the API server is as large. Mismatches
+// are logged, they are regressions of the scaling math rather than misconfigurations.
+func (d *DeviceCache) CheckCapacity() CapacityCheck {
+	res := CapacityCheck{Mismatches: []CapacityMismatch{}}
+	for _, dev := range d.GetCache() {
+		sample, ok := d.Sample(dev.ID)
+		if !ok {
+			continue
+		}
+		res.Checked++
+		profile := d.DeviceProfile(dev.ID)
+		split := d.SplitCount(dev.ID)
+		info := advertisedDevice(dev, sample, profile, split, &corev1.Node{}, 0)
+		m := CapacityMismatch{
+			UUID:       dev.ID,
+			Profile:    profile.Name,
+			Memory:     sample.Memory,
+			Scaling:    profile.MemoryScaling(),
+			SplitCount: split,
+			Advertised: info.Devmem,
+			Count:      info.Count,
+		}
+		if info.Count > 0 {
+			// the scheduler accounts slices this large
+			m.SliceLimit = info.Devmem / info.Count
+		}
+		m.Problem = capacityProblem(d, m)
+		if m.Problem == "" {
+			continue
+		}
+		klog.Errorf("Capacity of device %v inconsistent: %v (profile %q, memory %vm, scaling %v, split %v, advertised %vm in %v slices, slice limit %vm)",
+			m.UUID, m.Problem, m.Profile, m.Memory, m.Scaling, m.SplitCount, m.Advertised, m.Count, m.SliceLimit)
+		res.Mismatches = append(res.Mismatches, m)
+	}
+	return res
+}
+
+func capacityProblem(d *DeviceCache, m CapacityMismatch) string {
+	if m.Count < 1 {
+		return fmt.Sprintf("advertised in %v slices", m.Count)
+	}
+	want := float64(m.Memory)
+	if m.Scaling > 1 {
+		want *= m.Scaling
+	}
+	if want > math.MaxInt32 {
+		return fmt.Sprintf("scaled memory %.0fm overflows", want)
+	}
+	if m.Advertised != int32(want) {
+		return fmt.Sprintf("advertised %vm, scaling gives %vm", m.Advertised, int32(want))
+	}
+	if m.SliceLimit < 1 {
+		return "slices get no memory"
+	}
+	env := memoryLimitEnv(m.SliceLimit)
+	if mem, err := strconv.ParseInt(strings.TrimSuffix(env, "m"), 10, 32); err != nil || !strings.HasSuffix(env, "m") || int32(mem) != m.SliceLimit {
+		return fmt.Sprintf("a slice is injected with limit %q", env)
+	}
+	if limit := regionLimit(m.SliceLimit); limit != uint64(m.SliceLimit)*1024*1024 {
+		return fmt.Sprintf("a slice gets %v bytes in the shared region", limit)
+	}
+	if m.Scaling <= 1 && int64(m.SliceLimit)*int64(m.Count) > int64(m.Memory) {
+		return fmt.Sprintf("slices add up to %vm without oversubscription", int64(m.SliceLimit)*int64(m.Count))
+	}
+	if mem, split, ok := d.sliceMemory(m.UUID); ok {
+		if offline := offlineMemory(mem, split, 1); offline != m.SliceLimit {
+			return fmt.Sprintf("a slice allocated without the API server gets %vm", offline)
+		}
+	}
+	return ""
+}
+
+// LogCapacityCheck runs CheckCapacity once NVML sampled every device, or gave up on some
+// for a minute, unless stop is closed first.
+func LogCapacityCheck(d *DeviceCache, stop <-chan struct{}) {
+	deadline := time.Now().Add(time.Minute)
+	err := wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+		for _, dev := range d.GetCache() {
+			if _, ok := d.Sample(dev.ID); !ok && time.Now().Before(deadline) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, stop)
+	if err != nil {
+		return
+	}
+	check := d.CheckCapacity()
+	if len(check.Mismatches) == 0 {
+		klog.Infof("Capacity of %v devices consistent with their enforced limits", check.Checked)
+	}
+}
+
+// serveCapacityCheck runs CheckCapacity.
+func (s *RuntimeService) serveCapacityCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cache.CheckCapacity())
+}
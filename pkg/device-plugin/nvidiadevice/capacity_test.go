@@ -0,0 +1,86 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"gotest.tools/v3/assert"
+)
+
+func TestCheckCapacity(t *testing.T) {
+	oldSplit, oldScaling := config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() { config.DeviceSplitCount, config.DeviceMemoryScaling = oldSplit, oldScaling })
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 10, 1
+	d := newTestCache(t, 3, func(uuid string) (DeviceSample, error) {
+		if uuid == "GPU-2" {
+			return DeviceSample{Model: "A100", Memory: 16000, Free: 16000, ComputeMode: ComputeModeExclusiveProcess}, nil
+		}
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	training := &Profile{Name: "training", Devices: []string{"GPU-1"}, DeviceSplitCount: 4, DeviceMemoryScaling: 2}
+	assert.NilError(t, d.SetProfiles(DefaultProfile(), []*Profile{training}))
+
+	check := d.CheckCapacity()
+	assert.Equal(t, check.Checked, 3)
+	assert.Equal(t, len(check.Mismatches), 0)
+
+	// a split count of 0 advertises no slice
+	config.DeviceSplitCount = 0
+	assert.NilError(t, d.SetProfiles(DefaultProfile(), []*Profile{training}))
+	check = d.CheckCapacity()
+	assert.Equal(t, len(check.Mismatches), 1)
+	assert.Equal(t, check.Mismatches[0].UUID, "GPU-0")
+	assert.Equal(t, check.Mismatches[0].Problem, "advertised in 0 slices")
+
+	// scaled memory overflowing int32 can't be advertised
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 10, 1e6
+	assert.NilError(t, d.SetProfiles(DefaultProfile(), []*Profile{training}))
+	check = d.CheckCapacity()
+	assert.Equal(t, len(check.Mismatches), 2)
+	assert.Equal(t, check.Mismatches[0].UUID, "GPU-0")
+	assert.Equal(t, check.Mismatches[0].Problem, "scaled memory 16000000000m overflows")
+	assert.Equal(t, check.Mismatches[1].UUID, "GPU-2")
+}
+
+func TestServeCapacityCheck(t *testing.T) {
+	oldSplit, oldScaling := config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() { config.DeviceSplitCount, config.DeviceMemoryScaling = oldSplit, oldScaling })
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 10, 1
+	d := newTestCache(t, 1, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	s := &RuntimeService{cache: d}
+
+	w := httptest.NewRecorder()
+	s.serveCapacityCheck(w, httptest.NewRequest(http.MethodPost, CapacityCheckPath, nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+
+	w = httptest.NewRecorder()
+	s.serveCapacityCheck(w, httptest.NewRequest(http.MethodGet, CapacityCheckPath, nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	var check CapacityCheck
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&check))
+	assert.Equal(t, check.Checked, 1)
+	assert.Equal(t, len(check.Mismatches), 0)
+}
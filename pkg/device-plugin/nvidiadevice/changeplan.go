@@ -0,0 +1,136 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/plan"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PlanPath is where the runtime service plans a change of the node settings, given as the
+// deviceSplitCount and deviceMemoryScaling parameters, see PlanProfiles.
+const PlanPath = "/plan"
+
+func profileSettings(p *Profile, split uint) plan.Settings {
+	return plan.Settings{SplitCount: split, MemoryScaling: p.MemoryScaling()}
+}
+
+// PlanProfiles plans replacing the profiles of the cache with def, the default profile,
+// and profiles, checking that allocations, the containers by device UUID, fit the
+// capacity every cached device would be advertised with.
+func (d *DeviceCache) PlanProfiles(def *Profile, profiles []*Profile, allocations map[string][]DeviceAllocation) plan.Plan {
+	owners := make(map[string]*Profile)
+	for _, p := range profiles {
+		for _, id := range p.Devices {
+			owners[id] = p
+		}
+	}
+	var devs []plan.Device
+	for _, dev := range d.GetCache() {
+		planned, ok := owners[dev.ID]
+		if !ok {
+			planned = def
+		}
+		pd := plan.Device{
+			ID:      dev.ID,
+			Current: profileSettings(d.DeviceProfile(dev.ID), d.SplitCount(dev.ID)),
+			Planned: profileSettings(planned, splitCount(planned, dev.ID)),
+		}
+		if sample, ok := d.Sample(dev.ID); ok {
+			pd.Memory = sample.Memory
+		}
+		for _, a := range allocations[dev.ID] {
+			pd.Allocations = append(pd.Allocations, plan.Allocation{
+				Namespace: a.Namespace,
+				Pod:       a.Pod,
+				Container: a.Container,
+				Memory:    a.Memory,
+			})
+		}
+		devs = append(devs, pd)
+	}
+	return plan.Compute(devs)
+}
+
+func parseSplitCount(val string) (uint, error) {
+	count, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device split count %q", val)
+	}
+	return uint(count), config.ValidateSplitCount(uint(count))
+}
+
+func parseMemoryScaling(val string) (float64, error) {
+	scaling, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device memory scaling %q", val)
+	}
+	return scaling, config.ValidateScaling("memory", scaling)
+}
+
+// ApplyNodeOverrides sets the split count and memory scaling of def, the default profile,
+// to the values of the util.DeviceSplitCountAnnotation and util.DeviceMemoryScalingAnnotation
+// annotations of node, leaving both as they are if either is invalid.
+func ApplyNodeOverrides(def *Profile, node *corev1.Node) error {
+	split, scaling := def.DeviceSplitCount, def.DeviceMemoryScaling
+	var err error
+	if val, ok := node.Annotations[util.DeviceSplitCountAnnotation]; ok {
+		if split, err = parseSplitCount(val); err != nil {
+			return fmt.Errorf("annotation %v: %v", util.DeviceSplitCountAnnotation, err)
+		}
+	}
+	if val, ok := node.Annotations[util.DeviceMemoryScalingAnnotation]; ok {
+		if scaling, err = parseMemoryScaling(val); err != nil {
+			return fmt.Errorf("annotation %v: %v", util.DeviceMemoryScalingAnnotation, err)
+		}
+	}
+	def.DeviceSplitCount, def.DeviceMemoryScaling = split, scaling
+	return nil
+}
+
+// servePlan plans the change of the default profile to the settings of the query, the
+// settings it lacks are kept.
+func (s *RuntimeService) servePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	profiles := s.cache.Profiles()
+	def := *profiles[0]
+	var err error
+	if val := r.URL.Query().Get("deviceSplitCount"); val != "" {
+		if def.DeviceSplitCount, err = parseSplitCount(val); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if val := r.URL.Query().Get("deviceMemoryScaling"); val != "" {
+		if def.DeviceMemoryScaling, err = parseMemoryScaling(val); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	res := s.cache.PlanProfiles(&def, profiles[1:], NodeAllocations(r.Context(), s.client, s.nodeName))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/plan"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServePlan(t *testing.T) {
+	oldSplit, oldScaling := config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() { config.DeviceSplitCount, config.DeviceMemoryScaling = oldSplit, oldScaling })
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 4, 2
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	pod := func(name, devices string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{
+				util.AssignedIDsAnnotations: devices,
+			}},
+			Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c"}}},
+		}
+	}
+	s := NewRuntimeService(d, "node1", fake.NewSimpleClientset(
+		pod("a", "GPU-0,NVIDIA,3000,30:;"),
+		pod("b", "GPU-1,NVIDIA,10000,30:;"),
+		pod("c", "GPU-1,NVIDIA,10000,30:;"),
+	))
+	get := func(query string) plan.Plan {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.servePlan(w, httptest.NewRequest(http.MethodGet, PlanPath+query, nil))
+		assert.Equal(t, w.Code, http.StatusOK, w.Body.String())
+		var res plan.Plan
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&res))
+		return res
+	}
+
+	res := get("?deviceSplitCount=1")
+	assert.Assert(t, !res.Safe)
+	assert.Equal(t, len(res.Devices), 2)
+	assert.DeepEqual(t, res.Devices[0], plan.DevicePlan{
+		ID:      "GPU-0",
+		Current: plan.Capacity{Count: 4, Memory: 32000},
+		Planned: plan.Capacity{Count: 1, Memory: 32000},
+		Used:    plan.Capacity{Count: 1, Memory: 3000},
+	})
+	assert.Equal(t, res.Devices[1].Problem, "2 containers share it, split into 1")
+	assert.DeepEqual(t, res.Devices[1].Exceeding, []plan.Allocation{
+		{Namespace: "default", Pod: "b", Container: "c", Memory: 10000},
+		{Namespace: "default", Pod: "c", Container: "c", Memory: 10000},
+	})
+	// the change is planned, not applied
+	assert.Equal(t, d.SplitCount("GPU-0"), uint(4))
+
+	res = get("?deviceMemoryScaling=1")
+	assert.Assert(t, !res.Safe)
+	assert.Equal(t, res.Devices[1].Problem, "20000m are allocated, 16000m advertised")
+
+	// a profile keeps its own settings
+	training := &Profile{Name: "training", Devices: []string{"GPU-1"}, DeviceSplitCount: 2}
+	assert.NilError(t, d.SetProfiles(DefaultProfile(), []*Profile{training}))
+	res = get("?deviceSplitCount=1&deviceMemoryScaling=1.5")
+	assert.Assert(t, res.Safe)
+	assert.Equal(t, res.Devices[0].Planned, plan.Capacity{Count: 1, Memory: 24000})
+	assert.Equal(t, res.Devices[1].Planned, plan.Capacity{Count: 2, Memory: 32000})
+
+	w := httptest.NewRecorder()
+	s.servePlan(w, httptest.NewRequest(http.MethodGet, PlanPath+"?deviceSplitCount=0", nil))
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	w = httptest.NewRecorder()
+	s.servePlan(w, httptest.NewRequest(http.MethodPost, PlanPath, nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+func TestApplyNodeOverrides(t *testing.T) {
+	oldSplit, oldScaling := config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() { config.DeviceSplitCount, config.DeviceMemoryScaling = oldSplit, oldScaling })
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 10, 1
+	node := func(annotations map[string]string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: annotations}}
+	}
+
+	def := DefaultProfile()
+	assert.NilError(t, ApplyNodeOverrides(def, node(nil)))
+	assert.Equal(t, def.DeviceSplitCount, uint(10))
+	assert.Equal(t, def.DeviceMemoryScaling, 1.0)
+
+	// neither applies if one is invalid
+	err := ApplyNodeOverrides(def, node(map[string]string{
+		util.DeviceSplitCountAnnotation:    "4",
+		util.DeviceMemoryScalingAnnotation: "0",
+	}))
+	assert.ErrorContains(t, err, util.DeviceMemoryScalingAnnotation)
+	assert.Equal(t, def.DeviceSplitCount, uint(10))
+	assert.ErrorContains(t, ApplyNodeOverrides(def, node(map[string]string{util.DeviceSplitCountAnnotation: "four"})), "invalid device split count")
+
+	assert.NilError(t, ApplyNodeOverrides(def, node(map[string]string{
+		util.DeviceSplitCountAnnotation:    "4",
+		util.DeviceMemoryScalingAnnotation: "1.5",
+	})))
+	assert.Equal(t, def.DeviceSplitCount, uint(4))
+	assert.Equal(t, def.DeviceMemoryScaling, 1.5)
+	// the flags stay as they were parsed, the override is published with the profiles
+	assert.Equal(t, config.DeviceSplitCount, uint(10))
+	assert.Equal(t, config.DeviceMemoryScaling, 1.0)
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// CleanupOptions select what Cleanup removes besides the node annotations and taints.
+type CleanupOptions struct {
+	// Files removes the sockets and container directories on the host, only possible on
+	// the node being cleaned up.
+	Files bool
+	// ZeroResources sets the capacity of the GPU resources the plugin registered to 0,
+	// until kubelet or another device plugin reports them again.
+	ZeroResources bool
+	// DryRun reports what would be removed without removing it.
+	DryRun bool
+}
+
+// CleanupReport lists what Cleanup removed, or would remove in a dry run.
+type CleanupReport struct {
+	Node        string   `json:"node"`
+	Files       []string `json:"files,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+	Taints      []string `json:"taints,omitempty"`
+	Resources   []string `json:"resources,omitempty"`
+}
+
+// Print writes one line for each item removed.
+func (r *CleanupReport) Print(w io.Writer, dryRun bool) {
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	for _, f := range r.Files {
+		fmt.Fprintf(w, "%v: %v file %v\n", r.Node, verb, f)
+	}
+	for _, a := range r.Annotations {
+		fmt.Fprintf(w, "%v: %v annotation %v\n", r.Node, verb, a)
+	}
+	for _, t := range r.Taints {
+		fmt.Fprintf(w, "%v: %v taint %v\n", r.Node, verb, t)
+	}
+	for _, res := range r.Resources {
+		fmt.Fprintf(w, "%v: %v resource %v\n", r.Node, verb, res)
+	}
+}
+
+// Cleanup removes what the device plugin left on a node so the stock NVIDIA device plugin
+// can take over. Only what the plugin owns is removed: the annotations it writes, not the
+// ones administrators set, the taint carrying its owner value, the resources named after
+// util.ResourceName, stale sockets nobody listens on and the container directories named
+// after a pod UID.
+func Cleanup(ctx context.Context, client kubernetes.Interface, nodeName string, opts CleanupOptions) (*CleanupReport, error) {
+	report := &CleanupReport{Node: nodeName}
+	if opts.Files {
+		files, err := cleanupFiles(opts.DryRun)
+		report.Files = files
+		if err != nil {
+			return report, err
+		}
+	}
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return report, err
+	}
+	report.Annotations, err = util.RemoveNodeAnnotations(ctx, client, node, util.OwnedNodeAnnotations(), opts.DryRun)
+	if err != nil {
+		return report, err
+	}
+	report.Taints, err = cleanupTaints(ctx, client, nodeName, opts.DryRun)
+	if err != nil {
+		return report, err
+	}
+	if opts.ZeroResources {
+		report.Resources, err = zeroResources(ctx, client, node, opts.DryRun)
+	}
+	return report, err
+}
+
+// cleanupFiles removes the runtime socket, the device plugin sockets and the container
+// cache directories. Sockets still accepting connections belong to a running plugin,
+// possibly the stock one which uses the same names, and are kept.
+func cleanupFiles(dryRun bool) ([]string, error) {
+	var removed []string
+	remove := func(path string) error {
+		if !dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		removed = append(removed, path)
+		return nil
+	}
+	sockets := []string{config.RuntimeSocketFlag}
+	plugins, err := filepath.Glob(filepath.Join(config.DevicePluginPath, "nvidia-*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	sockets = append(sockets, plugins...)
+	for _, path := range sockets {
+		if !staleSocket(path) {
+			continue
+		}
+		if err := remove(path); err != nil {
+			return removed, err
+		}
+	}
+	entries, err := os.ReadDir(config.ContainerCacheRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !containerCacheDir(e.Name()) {
+			continue
+		}
+		if err := remove(filepath.Join(config.ContainerCacheRoot, e.Name())); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// staleSocket reports whether path is a unix socket nobody listens on.
+func staleSocket(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+// podUID matches the UIDs the API server assigns.
+var podUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// containerCacheDir reports whether name is a container directory created by Allocate,
+// named <pod UID>_<container name>.
+func containerCacheDir(name string) bool {
+	uid, ctr, ok := strings.Cut(name, "_")
+	return ok && podUID.MatchString(uid) && len(validation.IsDNS1123Label(ctr)) == 0
+}
+
+// cleanupTaints removes util.GPUUnhealthyTaint if the plugin added it.
+func cleanupTaints(ctx context.Context, client kubernetes.Interface, nodeName string, dryRun bool) ([]string, error) {
+	var removed []string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		removed = nil
+		node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var taints []corev1.Taint
+		for _, t := range node.Spec.Taints {
+			if t.Key == util.GPUUnhealthyTaint && t.Value == taintOwner {
+				removed = append(removed, t.ToString())
+				continue
+			}
+			taints = append(taints, t)
+		}
+		if len(removed) == 0 || dryRun {
+			return nil
+		}
+		node.Spec.Taints = taints
+		_, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+	return removed, err
+}
+
+// zeroResources sets the capacity and allocatable of the GPU resources named after
+// util.ResourceName to 0.
+func zeroResources(ctx context.Context, client kubernetes.Interface, node *corev1.Node, dryRun bool) ([]string, error) {
+	var removed []string
+	zero := make(corev1.ResourceList)
+	for name, q := range node.Status.Capacity {
+		if _, ok := util.ResourceProfile(string(name)); !ok || q.IsZero() {
+			continue
+		}
+		removed = append(removed, string(name))
+		zero[name] = resource.MustParse("0")
+	}
+	sort.Strings(removed)
+	if len(removed) == 0 || dryRun {
+		return removed, nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{
+		"capacity":    zero,
+		"allocatable": zero,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.CoreV1().Nodes().PatchStatus(ctx, node.Name, patch); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const cleanupPodUID = "0b7c9b5e-3d1f-4c2a-9e8f-1a2b3c4d5e6f"
+
+// cleanupNode has annotations, taints and resources of vGPU components mixed with
+// those of administrators and other components.
+func cleanupNode() *corev1.Node {
+	ours := corev1.Taint{Key: util.GPUUnhealthyTaint, Value: taintOwner, Effect: corev1.TaintEffectNoSchedule}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{
+			util.NodeHandshake:                  "Reported 2022.01.01 00:00:00",
+			util.NodeNvidiaDeviceRegistered:     "GPU-0,10,16000,100,NVIDIA-A100,true:",
+			util.NodeLockTime:                   "2022-01-01T00:00:00Z",
+			util.DeviceMemoryExternalAnnotation: "GPU-0:1000",
+			"example.com/owner":                 "team-a",
+		}},
+		Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+			ours,
+			{Key: util.GPUUnhealthyTaint, Value: "maintenance", Effect: corev1.TaintEffectNoExecute},
+			{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule},
+		}},
+		Status: corev1.NodeStatus{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceName(util.ResourceName):               resource.MustParse("20"),
+				corev1.ResourceName(util.ResourceName + "-training"): resource.MustParse("10"),
+				corev1.ResourceCPU: resource.MustParse("8"),
+				"example.com/fpga": resource.MustParse("2"),
+			},
+		},
+	}
+}
+
+// listenUnix returns a socket at path, live until the test ends unless closed.
+func listenUnix(t *testing.T, path string) *net.UnixListener {
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.NilError(t, err)
+	ln.SetUnlinkOnClose(false)
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// setupCleanupFiles creates the runtime socket, plugin sockets and container directories
+// next to files the plugin doesn't own, and returns the paths that must be removed.
+func setupCleanupFiles(t *testing.T) []string {
+	dir := t.TempDir()
+	oldSocket, oldPluginDir, oldRoot := config.RuntimeSocketFlag, config.DevicePluginPath, config.ContainerCacheRoot
+	t.Cleanup(func() {
+		config.RuntimeSocketFlag, config.DevicePluginPath, config.ContainerCacheRoot = oldSocket, oldPluginDir, oldRoot
+	})
+	config.RuntimeSocketFlag = filepath.Join(dir, "vgpu.sock")
+	config.DevicePluginPath = filepath.Join(dir, "device-plugins")
+	config.ContainerCacheRoot = filepath.Join(dir, "containers")
+	for _, d := range []string{config.DevicePluginPath, config.ContainerCacheRoot} {
+		assert.NilError(t, os.Mkdir(d, 0755))
+	}
+
+	listenUnix(t, config.RuntimeSocketFlag).Close()
+	stalePlugin := filepath.Join(config.DevicePluginPath, "nvidia-gpu.sock")
+	listenUnix(t, stalePlugin).Close()
+	// a running plugin, possibly the stock NVIDIA one, and sockets of other plugins
+	listenUnix(t, filepath.Join(config.DevicePluginPath, "nvidia-gpu-training.sock"))
+	listenUnix(t, filepath.Join(config.DevicePluginPath, "kubelet.sock")).Close()
+	assert.NilError(t, os.WriteFile(filepath.Join(config.DevicePluginPath, "nvidia-notes.sock"), nil, 0644))
+
+	ctrDir := filepath.Join(config.ContainerCacheRoot, cleanupPodUID+"_main")
+	assert.NilError(t, os.MkdirAll(filepath.Join(ctrDir, "cache"), 0755))
+	for _, name := range []string{"lost+found", "notes_main", cleanupPodUID + "_Main"} {
+		assert.NilError(t, os.Mkdir(filepath.Join(config.ContainerCacheRoot, name), 0755))
+	}
+	assert.NilError(t, os.WriteFile(filepath.Join(config.ContainerCacheRoot, cleanupPodUID+"_file"), nil, 0644))
+	return []string{config.RuntimeSocketFlag, stalePlugin, ctrDir}
+}
+
+func TestCleanupRemovesOnlyOwned(t *testing.T) {
+	removedFiles := setupCleanupFiles(t)
+	client := fake.NewSimpleClientset(cleanupNode())
+	report, err := Cleanup(context.Background(), client, "node1", CleanupOptions{Files: true, ZeroResources: true})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, report.Files, removedFiles)
+	for _, f := range removedFiles {
+		_, err := os.Lstat(f)
+		assert.Assert(t, os.IsNotExist(err), f)
+	}
+	entries, err := os.ReadDir(config.ContainerCacheRoot)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 4)
+	plugins, err := os.ReadDir(config.DevicePluginPath)
+	assert.NilError(t, err)
+	assert.Equal(t, len(plugins), 3)
+
+	assert.DeepEqual(t, report.Annotations, []string{util.NodeHandshake, util.NodeNvidiaDeviceRegistered, util.NodeLockTime})
+	assert.Equal(t, len(report.Taints), 1)
+	assert.DeepEqual(t, report.Resources, []string{util.ResourceName, util.ResourceName + "-training"})
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, node.Annotations, map[string]string{
+		util.DeviceMemoryExternalAnnotation: "GPU-0:1000",
+		"example.com/owner":                 "team-a",
+	})
+	assert.DeepEqual(t, node.Spec.Taints, cleanupNode().Spec.Taints[1:])
+	gpus := node.Status.Capacity[corev1.ResourceName(util.ResourceName)]
+	assert.Assert(t, gpus.IsZero())
+	gpus = node.Status.Allocatable[corev1.ResourceName(util.ResourceName+"-training")]
+	assert.Assert(t, gpus.IsZero())
+	cpus := node.Status.Capacity[corev1.ResourceCPU]
+	assert.Equal(t, cpus.Value(), int64(8))
+	fpgas := node.Status.Capacity["example.com/fpga"]
+	assert.Equal(t, fpgas.Value(), int64(2))
+}
+
+func TestCleanupDryRun(t *testing.T) {
+	files := setupCleanupFiles(t)
+	client := fake.NewSimpleClientset(cleanupNode())
+	report, err := Cleanup(context.Background(), client, "node1", CleanupOptions{Files: true, ZeroResources: true, DryRun: true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, report.Files, files)
+	assert.Equal(t, len(report.Annotations), 3)
+	assert.Equal(t, len(report.Taints), 1)
+	assert.Equal(t, len(report.Resources), 2)
+
+	for _, f := range files {
+		_, err := os.Lstat(f)
+		assert.NilError(t, err)
+	}
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, node, cleanupNode())
+}
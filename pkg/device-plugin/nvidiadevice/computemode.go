@@ -0,0 +1,53 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"k8s.io/klog/v2"
+)
+
+// queryComputeMode returns the compute mode of the GPU, resetting it to DEFAULT first with
+// config.ForceComputeModeDefault. GPUs whose driver doesn't tell are taken for DEFAULT.
+func queryComputeMode(uuid string) ComputeMode {
+	mode, err := nvmlLib.ComputeMode(uuid)
+	if err != nil {
+		klog.V(4).Infof("get compute mode of %v: %v", uuid, err)
+		return ComputeModeDefault
+	}
+	if mode == ComputeModeDefault || !config.ForceComputeModeDefault {
+		return mode
+	}
+	if err := nvmlLib.SetComputeMode(uuid, ComputeModeDefault); err != nil {
+		klog.Errorf("reset compute mode of %v from %v to DEFAULT: %v", uuid, mode, err)
+		return mode
+	}
+	klog.Infof("Reset compute mode of %v from %v to DEFAULT", uuid, mode)
+	return ComputeModeDefault
+}
+
+// warnComputeMode logs why a GPU outside the DEFAULT compute mode isn't split.
+func warnComputeMode(uuid string, mode ComputeMode) {
+	switch mode {
+	case ComputeModeDefault:
+		klog.Infof("GPU %v is back in DEFAULT compute mode and split again", uuid)
+	case ComputeModeProhibited:
+		klog.Warningf("GPU %v is in PROHIBITED compute mode, no container can use it, it is registered unhealthy. Run nvidia-smi -c DEFAULT or pass --force-compute-mode-default", uuid)
+	default:
+		klog.Warningf("GPU %v is in %v compute mode, only one container can use it at a time, it is registered unsplit. Run nvidia-smi -c DEFAULT or pass --force-compute-mode-default", uuid, mode)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"gotest.tools/v3/assert"
+)
+
+// computeModeNVML only answers compute mode calls.
+type computeModeNVML struct {
+	NVML
+	mode ComputeMode
+}
+
+func (n *computeModeNVML) ComputeMode(uuid string) (ComputeMode, error) {
+	return n.mode, nil
+}
+
+func (n *computeModeNVML) SetComputeMode(uuid string, mode ComputeMode) error {
+	n.mode = mode
+	return nil
+}
+
+func TestQueryComputeMode(t *testing.T) {
+	oldLib, oldForce := nvmlLib, config.ForceComputeModeDefault
+	t.Cleanup(func() { nvmlLib, config.ForceComputeModeDefault = oldLib, oldForce })
+	lib := &computeModeNVML{mode: ComputeModeExclusiveProcess}
+	nvmlLib = lib
+
+	config.ForceComputeModeDefault = false
+	assert.Equal(t, queryComputeMode("GPU-0"), ComputeModeExclusiveProcess)
+	assert.Equal(t, lib.mode, ComputeModeExclusiveProcess)
+
+	config.ForceComputeModeDefault = true
+	assert.Equal(t, queryComputeMode("GPU-0"), ComputeModeDefault)
+	assert.Equal(t, lib.mode, ComputeModeDefault)
+}
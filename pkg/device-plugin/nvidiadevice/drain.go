@@ -0,0 +1,75 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// DrainPath is where the runtime service lists the drained devices with the containers
+// still holding a share of them, those to evict before the card is replaced.
+const DrainPath = "/drain"
+
+// SetDrained drains the devices with the given UUIDs for maintenance and undrains all
+// others. Like a blacklisted device, a drained one is reported unhealthy to kubelet and
+// the scheduler, so no new container gets it while the running ones keep their share.
+// The list comes from the node's util.DrainDeviceAnnotation, which is read again after
+// a restart; UUIDs of devices on other nodes are ignored.
+func (d *DeviceCache) SetDrained(ids []string) {
+	drain := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drain[id] = true
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var changed []string
+	for _, dev := range d.cache {
+		if drain[dev.ID] == d.drained[dev.ID] {
+			continue
+		}
+		changed = append(changed, dev.ID)
+		if drain[dev.ID] {
+			klog.Warningf("device %v drained, it is reported unhealthy until it is undrained", dev.ID)
+			d.drained[dev.ID] = true
+		} else {
+			klog.Infof("device %v undrained", dev.ID)
+			delete(d.drained, dev.ID)
+		}
+	}
+	if len(changed) > 0 {
+		d.publish(changed)
+	}
+}
+
+// serveDrain lists the states of the drained devices.
+func (s *RuntimeService) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	res := []DeviceState{}
+	for _, state := range s.states(r.Context(), s.cache.Snapshot()) {
+		if state.Drained {
+			res = append(res, state)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
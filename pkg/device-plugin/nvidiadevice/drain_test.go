@@ -0,0 +1,105 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDrainDeviceWithActivePods(t *testing.T) {
+	oldClient, oldNode := util.GetClient(), config.NodeName
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		config.NodeName = oldNode
+	})
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{
+		util.DrainDeviceAnnotation: "GPU-1, GPU-other-node",
+	}}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+			util.AssignedIDsAnnotations: "GPU-1,NVIDIA,3000,30:;",
+		}},
+		Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c"}}},
+	}
+	client := fake.NewSimpleClientset(node, pod)
+	util.SetClient(client)
+	config.NodeName = "node1"
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	r := NewDeviceRegister(d)
+	s := NewRuntimeService(d, "node1", client)
+	drained := func() []DeviceState {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DrainPath, nil))
+		assert.Equal(t, rec.Code, http.StatusOK)
+		var states []DeviceState
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&states))
+		return states
+	}
+	registered := func() map[string]bool {
+		n, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+		assert.NilError(t, err)
+		devs, err := annotations.DecodeNodeDevices(n.Annotations[util.NodeNvidiaDeviceRegistered])
+		assert.NilError(t, err)
+		res := make(map[string]bool)
+		for _, dev := range devs {
+			res[dev.Id] = dev.Health
+		}
+		return res
+	}
+
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.Equal(t, d.GetCache()[0].Health, pluginapi.Healthy)
+	assert.Equal(t, d.GetCache()[1].Health, pluginapi.Unhealthy)
+	assert.DeepEqual(t, registered(), map[string]bool{"GPU-0": true, "GPU-1": false})
+	states := drained()
+	assert.Equal(t, len(states), 1)
+	assert.Equal(t, states[0].ID, "GPU-1")
+	assert.DeepEqual(t, states[0].Allocations, []DeviceAllocation{
+		{Namespace: "default", Pod: "p", Container: "c", Memory: 3000, Cores: 30, EnforcedCores: 30},
+	})
+
+	// sampling doesn't bring the device back
+	d.sample()
+	assert.Equal(t, d.GetCache()[1].Health, pluginapi.Unhealthy)
+
+	// undrain
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	delete(node.Annotations, util.DrainDeviceAnnotation)
+	_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.Equal(t, d.GetCache()[1].Health, pluginapi.Healthy)
+	assert.DeepEqual(t, registered(), map[string]bool{"GPU-0": true, "GPU-1": true})
+	assert.Equal(t, len(drained()), 0)
+}
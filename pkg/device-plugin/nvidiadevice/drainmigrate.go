@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// drainMigrateInterval is how often a cordoned node is checked for vGPU pods to evict.
+var drainMigrateInterval = 30 * time.Second
+
+// DrainMigrator moves the vGPU pods off the node while it is cordoned, evicting them one
+// at a time so the scheduler extender places them on other nodes before maintenance.
+// Evictions go through the eviction API, which refuses those a PodDisruptionBudget
+// doesn't allow; they are retried on the next check.
+type DrainMigrator struct {
+	nodeName string
+	client   kubernetes.Interface
+	// draining is set while the node is cordoned, done once no vGPU pod is left on it,
+	// until the node is uncordoned.
+	draining, done bool
+}
+
+func NewDrainMigrator(nodeName string, client kubernetes.Interface) *DrainMigrator {
+	return &DrainMigrator{nodeName: nodeName, client: client}
+}
+
+// Run checks the node every drainMigrateInterval until stop is closed.
+func (m *DrainMigrator) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(drainMigrateInterval)
+	defer ticker.Stop()
+	for {
+		if err := m.migrate(context.Background()); err != nil {
+			klog.Errorf("migrate vGPU pods off node %v: %v", m.nodeName, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// migrate evicts the next vGPU pod of the cordoned node once the one evicted before is gone.
+func (m *DrainMigrator) migrate(ctx context.Context) error {
+	node, err := m.client.CoreV1().Nodes().Get(ctx, m.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !node.Spec.Unschedulable {
+		if m.draining {
+			klog.Infof("Node %v uncordoned, no longer migrating its vGPU pods", m.nodeName)
+		}
+		m.draining, m.done = false, false
+		DrainMigrationPods.Set(0)
+		return nil
+	}
+	if !m.draining {
+		klog.Infof("Node %v cordoned, evicting its vGPU pods one at a time", m.nodeName)
+		m.draining = true
+	}
+	if m.done {
+		return nil
+	}
+	pods, err := m.vgpuPods(ctx)
+	if err != nil {
+		return err
+	}
+	DrainMigrationPods.Set(float64(len(pods)))
+	if len(pods) == 0 {
+		klog.Infof("All vGPU pods left cordoned node %v", m.nodeName)
+		m.done = true
+		return nil
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			klog.Infof("Waiting for pod %v to leave node %v, %d vGPU pods remaining", util.PodRef(pod.Namespace, pod.Name), m.nodeName, len(pods))
+			return nil
+		}
+	}
+	pod := pods[0]
+	err = m.client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+	})
+	switch {
+	case apierrors.IsTooManyRequests(err):
+		klog.Infof("Eviction of pod %v refused by its disruption budget, retrying in %v: %v", util.PodRef(pod.Namespace, pod.Name), drainMigrateInterval, err)
+		return nil
+	case apierrors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	klog.Infof("Evicted pod %v from cordoned node %v, %d vGPU pods remaining", util.PodRef(pod.Namespace, pod.Name), m.nodeName, len(pods))
+	return nil
+}
+
+// vgpuPods lists the running pods of the node asking for vGPUs, by namespace and name.
+// DaemonSet pods, which would come back, and mirror pods, which can't be evicted, are
+// left alone.
+func (m *DrainMigrator) vgpuPods(ctx context.Context) ([]corev1.Pod, error) {
+	list, err := m.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + m.nodeName})
+	if err != nil {
+		return nil, err
+	}
+	var pods []corev1.Pod
+	for _, pod := range list.Items {
+		if pod.Spec.NodeName != m.nodeName || k8sutil.IsPodInTerminatedState(&pod) || !requestsVGPUs(&pod) {
+			continue
+		}
+		if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&pod); owner != nil && owner.Kind == "DaemonSet" {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods, nil
+}
+
+func requestsVGPUs(pod *corev1.Pod) bool {
+	for _, reqs := range k8sutil.Resourcereqs(pod) {
+		if len(reqs) > 0 {
+			return true
+		}
+	}
+	return false
+}
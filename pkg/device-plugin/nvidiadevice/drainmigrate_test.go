@@ -0,0 +1,111 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDrainMigrator(t *testing.T) {
+	old := util.ResourceName
+	t.Cleanup(func() { util.ResourceName = old })
+	util.ResourceName = "nvidia.com/gpu"
+	gpu := corev1.ResourceRequirements{Limits: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")}}
+	pod := func(name string, resources corev1.ResourceRequirements) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c", Resources: resources}}},
+		}
+	}
+	controller := true
+	daemon := pod("daemon", gpu)
+	daemon.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "exporter", Controller: &controller}}
+	done := pod("done", gpu)
+	done.Status.Phase = corev1.PodSucceeded
+	other := pod("other", gpu)
+	other.Spec.NodeName = "node2"
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	client := fake.NewSimpleClientset(node, pod("a", gpu), pod("b", gpu), pod("cpu", corev1.ResourceRequirements{}), daemon, done, other)
+
+	var evicted []string
+	budget := true
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		name := action.(k8stesting.CreateAction).GetObject().(metav1.Object).GetName()
+		if budget {
+			budget = false
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 10)
+		}
+		evicted = append(evicted, name)
+		// the pod is terminating until the next check
+		p, err := client.Tracker().Get(schema.GroupVersionResource{Version: "v1", Resource: "pods"}, "default", name)
+		assert.NilError(t, err)
+		now := metav1.Now()
+		p.(*corev1.Pod).DeletionTimestamp = &now
+		return true, nil, client.Tracker().Update(schema.GroupVersionResource{Version: "v1", Resource: "pods"}, p, "default")
+	})
+	remove := func(name string) {
+		assert.NilError(t, client.Tracker().Delete(schema.GroupVersionResource{Version: "v1", Resource: "pods"}, "default", name))
+	}
+	m := NewDrainMigrator("node1", client)
+	ctx := context.Background()
+
+	// nothing happens while the node is schedulable
+	assert.NilError(t, m.migrate(ctx))
+	assert.Assert(t, evicted == nil)
+
+	node.Spec.Unschedulable = true
+	_, err := client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	// the disruption budget refuses the first eviction
+	assert.NilError(t, m.migrate(ctx))
+	assert.Assert(t, evicted == nil)
+	assert.Equal(t, testutil.ToFloat64(DrainMigrationPods), 2.0)
+	assert.NilError(t, m.migrate(ctx))
+	assert.DeepEqual(t, evicted, []string{"a"})
+	// one at a time
+	assert.NilError(t, m.migrate(ctx))
+	assert.DeepEqual(t, evicted, []string{"a"})
+	remove("a")
+	assert.NilError(t, m.migrate(ctx))
+	assert.DeepEqual(t, evicted, []string{"a", "b"})
+	remove("b")
+	assert.NilError(t, m.migrate(ctx))
+	assert.Equal(t, testutil.ToFloat64(DrainMigrationPods), 0.0)
+	assert.Assert(t, m.done)
+
+	node.Spec.Unschedulable = false
+	_, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, m.migrate(ctx))
+	assert.Assert(t, !m.draining && !m.done)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+)
+
+// ProfileConfig is the effective configuration of one profile.
+type ProfileConfig struct {
+	Name                string   `json:"name"`
+	ResourceName        string   `json:"resourceName"`
+	Socket              string   `json:"socket"`
+	DeviceSplitCount    uint     `json:"deviceSplitCount"`
+	DeviceMemoryScaling float64  `json:"deviceMemoryScaling"`
+	Devices             []string `json:"devices"`
+}
+
+// EffectiveConfig is the configuration the device plugin runs with, after the
+// command line flags and the node config file were applied.
+type EffectiveConfig struct {
+	NodeName                  string          `json:"nodeName"`
+	ResourcePrefix            string          `json:"resourcePrefix"`
+	ResourceName              string          `json:"resourceName"`
+	DeviceSplitCount          uint            `json:"deviceSplitCount"`
+	DeviceSplitCountMap       map[string]int  `json:"deviceSplitCountMap,omitempty"`
+	MaxSharesPerDevice        uint            `json:"maxSharesPerDevice"`
+	ModelMaxShares            map[string]uint `json:"modelMaxShares,omitempty"`
+	DeviceMemoryScaling       float64         `json:"deviceMemoryScaling"`
+	DeviceCoresScaling        float64         `json:"deviceCoresScaling"`
+	ScalingDimensions         string          `json:"scalingDimensions"`
+	MaxScaling                float64         `json:"maxScaling"`
+	DisableCoreLimit          bool            `json:"disableCoreLimit"`
+	ManagedMemoryRatio        float64         `json:"managedMemoryRatio"`
+	MigStrategy               string          `json:"migStrategy"`
+	Enforcement               string          `json:"enforcement"`
+	MemoryBandwidthLimit      bool            `json:"memoryBandwidthLimit"`
+	MemoryTiers               bool            `json:"memoryTiers"`
+	RequireSchedulerApproval  bool            `json:"requireSchedulerApproval"`
+	StrictBindTimeMemoryCheck bool            `json:"strictBindTimeMemoryCheck"`
+	VerifyDeviceFreeMemory    bool            `json:"verifyDeviceFreeMemory"`
+	OnLeak                    string          `json:"onLeak"`
+	ReapLeakedProcesses       bool            `json:"reapLeakedProcesses"`
+	StrictDeviceVisibility    bool            `json:"strictDeviceVisibility"`
+	DeviceListStrategy        string          `json:"deviceListStrategy"`
+	RuntimeFlavor             string          `json:"runtimeFlavor"`
+	SkipPreflight             []string        `json:"skipPreflight,omitempty"`
+	ManageNodeTaints          bool            `json:"manageNodeTaints"`
+	InjectAssignmentEnv       bool            `json:"injectAssignmentEnv"`
+	LimitDelivery             string          `json:"limitDelivery"`
+	MeasureExternalMemory     bool            `json:"measureExternalMemory"`
+	RegisterTimeout           string          `json:"registerTimeout"`
+	RegisterRetries           int             `json:"registerRetries"`
+	APITimeout                string          `json:"apiTimeout"`
+	APIKeepalive              string          `json:"apiKeepalive"`
+	NodeUpdateInterval        string          `json:"nodeUpdateInterval"`
+	NodeUpdateQPS             float64         `json:"nodeUpdateQPS"`
+	HeartbeatInterval         string          `json:"heartbeatInterval"`
+	LimitSyncInterval         string          `json:"limitSyncInterval"`
+	MemoryWatchdogInterval    string          `json:"memoryWatchdogInterval"`
+	NVMLQueryTimeout          string          `json:"nvmlQueryTimeout"`
+	AllocateSlowThreshold     string          `json:"allocateSlowThreshold"`
+	AllocateTimeout           string          `json:"allocateTimeout"`
+	UnhealthyGracePeriod      string          `json:"unhealthyGracePeriod"`
+	CoreBurstThreshold        uint            `json:"coreBurstThreshold"`
+	IdleCoreReclaim           bool            `json:"idleCoreReclaim"`
+	IdleCorePeriod            string          `json:"idleCorePeriod"`
+	Offline                   bool            `json:"offline"`
+	CoexistWithLegacy         bool            `json:"coexistWithLegacyAllocations"`
+	LegacyResourceName        string          `json:"legacyResourceName"`
+	DrainMigrate              bool            `json:"drainMigrate"`
+	CheckCapacity             bool            `json:"checkCapacity"`
+	AllowUnsafeReload         bool            `json:"allowUnsafeReload"`
+	CoreLimitGranularity      uint            `json:"coreLimitGranularity"`
+	MinPlausibleMemory        int32           `json:"minPlausibleMemory"`
+	EnablePersistenceMode     bool            `json:"enablePersistenceMode"`
+	EnableNVMLAccounting      bool            `json:"enableNVMLAccounting"`
+	ForceComputeModeDefault   bool            `json:"forceComputeModeDefault"`
+	KubeletSocket             string          `json:"kubeletSocket"`
+	RuntimeSocket             string          `json:"runtimeSocket"`
+	EnableDeviceBlacklist     bool            `json:"enableDeviceBlacklist"`
+	CheckpointFile            string          `json:"checkpointFile"`
+	NodeLockFile              string          `json:"nodeLockFile"`
+	OnLockConflict            string          `json:"onLockConflict"`
+	Blacklisted               []string        `json:"blacklisted,omitempty"`
+	Profiles                  []ProfileConfig `json:"profiles"`
+}
+
+// NewEffectiveConfig collects the configuration in effect, profiles are taken from cache.
+func NewEffectiveConfig(cache *DeviceCache, migStrategy string) *EffectiveConfig {
+	c := &EffectiveConfig{
+		NodeName:                  config.NodeName,
+		ResourcePrefix:            util.ResourcePrefix,
+		ResourceName:              util.ResourceName,
+		DeviceSplitCount:          cache.Profiles()[0].DeviceSplitCount,
+		DeviceSplitCountMap:       config.DeviceSplitCountMap,
+		MaxSharesPerDevice:        config.MaxSharesPerDevice,
+		ModelMaxShares:            config.ModelMaxShares,
+		DeviceMemoryScaling:       cache.Profiles()[0].MemoryScaling(),
+		DeviceCoresScaling:        CoresScaling(),
+		ScalingDimensions:         config.ScalingDimensions,
+		MaxScaling:                config.MaxScaling,
+		DisableCoreLimit:          config.DisableCoreLimit,
+		ManagedMemoryRatio:        config.ManagedMemoryRatio,
+		MigStrategy:               migStrategy,
+		Enforcement:               config.Enforcement,
+		MemoryBandwidthLimit:      config.MemoryBandwidthLimit,
+		MemoryTiers:               config.MemoryTiers,
+		RequireSchedulerApproval:  config.RequireSchedulerApproval,
+		StrictBindTimeMemoryCheck: config.StrictBindTimeMemoryCheck,
+		VerifyDeviceFreeMemory:    config.VerifyDeviceFreeMemory,
+		OnLeak:                    config.OnLeak,
+		ReapLeakedProcesses:       config.ReapLeakedProcesses,
+		StrictDeviceVisibility:    config.StrictDeviceVisibility,
+		DeviceListStrategy:        config.DeviceListStrategy,
+		RuntimeFlavor:             config.RuntimeFlavor,
+		SkipPreflight:             config.SkipPreflight,
+		ManageNodeTaints:          config.ManageNodeTaints,
+		InjectAssignmentEnv:       config.InjectAssignmentEnv,
+		LimitDelivery:             config.LimitDelivery,
+		MeasureExternalMemory:     config.MeasureExternalMemory,
+		RegisterTimeout:           config.RegisterTimeout.String(),
+		RegisterRetries:           config.RegisterRetries,
+		APITimeout:                config.APITimeout.String(),
+		APIKeepalive:              config.APIKeepalive.String(),
+		NodeUpdateInterval:        config.NodeUpdateInterval.String(),
+		NodeUpdateQPS:             config.NodeUpdateQPS,
+		HeartbeatInterval:         config.HeartbeatInterval.String(),
+		LimitSyncInterval:         config.LimitSyncInterval.String(),
+		MemoryWatchdogInterval:    config.MemoryWatchdogInterval.String(),
+		NVMLQueryTimeout:          config.NVMLQueryTimeout.String(),
+		AllocateSlowThreshold:     config.AllocateSlowThreshold.String(),
+		AllocateTimeout:           config.AllocateTimeout.String(),
+		UnhealthyGracePeriod:      config.UnhealthyGracePeriod.String(),
+		CoreBurstThreshold:        config.CoreBurstThreshold,
+		IdleCoreReclaim:           config.IdleCoreReclaim,
+		IdleCorePeriod:            config.IdleCorePeriod.String(),
+		Offline:                   config.Offline,
+		CoexistWithLegacy:         config.CoexistWithLegacyAllocations,
+		LegacyResourceName:        config.LegacyResourceName,
+		DrainMigrate:              config.DrainMigrate,
+		CheckCapacity:             config.CheckCapacity,
+		AllowUnsafeReload:         config.AllowUnsafeReload,
+		CoreLimitGranularity:      config.CoreLimitGranularity,
+		MinPlausibleMemory:        config.MinPlausibleMemory,
+		EnablePersistenceMode:     config.EnablePersistenceMode,
+		EnableNVMLAccounting:      config.EnableNVMLAccounting,
+		ForceComputeModeDefault:   config.ForceComputeModeDefault,
+		KubeletSocket:             KubeletSocket(),
+		RuntimeSocket:             config.RuntimeSocketFlag,
+		EnableDeviceBlacklist:     config.EnableDeviceBlacklist,
+		CheckpointFile:            config.CheckpointFile,
+		NodeLockFile:              config.NodeLockFile,
+		OnLockConflict:            config.OnLockConflict,
+	}
+	if bl := cache.Blacklisted(); len(bl) > 0 {
+		c.Blacklisted = bl
+	}
+	for _, p := range cache.Profiles() {
+		pc := ProfileConfig{
+			Name:                p.Name,
+			ResourceName:        p.ResourceName(),
+			Socket:              p.socket(),
+			DeviceSplitCount:    p.DeviceSplitCount,
+			DeviceMemoryScaling: p.MemoryScaling(),
+		}
+		for _, d := range cache.ProfileDevices(p.Name) {
+			pc.Devices = append(pc.Devices, d.ID)
+		}
+		c.Profiles = append(c.Profiles, pc)
+	}
+	return c
+}
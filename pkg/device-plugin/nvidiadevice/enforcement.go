@@ -0,0 +1,218 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Constants to represent the various enforcement mechanisms
+const (
+	EnforcementAuto = "auto"
+	// EnforcementHook injects libvgpu.so, which enforces both memory and core limits.
+	EnforcementHook = "hook"
+	// EnforcementCgroup only passes the allocated device nodes to the container, so the
+	// device cgroup keeps other GPUs out, and the MemoryWatchdog kills the processes of
+	// containers exceeding their memory limit. Core limits aren't enforced in this mode.
+	EnforcementCgroup = "cgroup"
+	// EnforcementNone means no isolation is available besides NVIDIA_VISIBLE_DEVICES.
+	// Nothing enforces limits, so containers only get whole GPUs, see checkWholeDevices.
+	EnforcementNone = "none"
+	// EnforcementPassthrough is reported to containers of pods that got whole GPUs in
+	// util.GPUModeExclusive, nothing intercepts their CUDA calls.
+	EnforcementPassthrough = "passthrough"
+
+	// EnforcementEnv tells the container which mechanism is active.
+	EnforcementEnv = "VGPU_ENFORCEMENT"
+	// MemoryBandwidthEnv passes the memory bandwidth limit of util.MemoryBandwidthAnnotation
+	// in percent to hook libraries that throttle the kernels of the container to it.
+	MemoryBandwidthEnv = "CUDA_DEVICE_MEMBW_LIMIT"
+	// MemoryTierEnv passes the memory tier of util.MemoryTierAnnotation to hook libraries,
+	// which page or evict the memory of best-effort containers first when a GPU whose
+	// memory is scaled runs out of physical memory.
+	MemoryTierEnv = "CUDA_DEVICE_MEMORY_TIER"
+
+	// HookMemoryBandwidth and HookMemoryTiers are the capabilities of a hook library
+	// beyond memory and core limits, as listed in config.HookCapabilities.
+	HookMemoryBandwidth = "memory-bandwidth"
+	HookMemoryTiers     = "memory-tiers"
+)
+
+const (
+	hookLibraryPath   = "/usr/local/vgpu/libvgpu.so"
+	cgroupDevicesPath = "/sys/fs/cgroup/devices"
+	cgroupV2Path      = "/sys/fs/cgroup/cgroup.controllers"
+)
+
+// nvidiaControlDevices are needed by every CUDA application besides the GPU nodes themselves.
+var nvidiaControlDevices = []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools"}
+
+// DetectEnforcement resolves the enforcement mechanism to use, honouring an explicit choice
+// and otherwise preferring the hook library and falling back to the device cgroup.
+func DetectEnforcement(mode string) (string, error) {
+	switch mode {
+	case EnforcementHook, EnforcementCgroup, EnforcementNone:
+		return mode, nil
+	case EnforcementAuto, "":
+	default:
+		return "", fmt.Errorf("unknown enforcement mode: %v", mode)
+	}
+	if _, err := os.Stat(hookLibraryPath); err == nil {
+		return EnforcementHook, nil
+	}
+	klog.Warningf("%s not found, memory and core limits can't be enforced by the hook library", hookLibraryPath)
+	for _, p := range []string{cgroupDevicesPath, cgroupV2Path} {
+		if _, err := os.Stat(p); err == nil {
+			klog.Warningf("Falling back to device cgroup isolation, memory limits are enforced by killing the processes exceeding them, core limits aren't enforced")
+			return EnforcementCgroup, nil
+		}
+	}
+	klog.Warningf("No device cgroup found, GPU isolation relies on NVIDIA_VISIBLE_DEVICES only and shared GPUs are refused")
+	return EnforcementNone, nil
+}
+
+// CheckHookCapabilities rejects capabilities of the hook library the device plugin
+// doesn't know.
+func CheckHookCapabilities(capabilities []string) error {
+	for _, c := range capabilities {
+		if c != HookMemoryBandwidth && c != HookMemoryTiers {
+			return fmt.Errorf("unknown hook library capability: %v", c)
+		}
+	}
+	return nil
+}
+
+// DetectMemoryBandwidthLimit tells whether memory bandwidth limits can be enforced, which
+// takes the hook library enforcement and a hook library said to read MemoryBandwidthEnv
+// with HookMemoryBandwidth in capabilities. The library can't be asked itself.
+func DetectMemoryBandwidthLimit(enforcement string, capabilities []string) bool {
+	return enforcement == EnforcementHook && hasCapability(capabilities, HookMemoryBandwidth)
+}
+
+// DetectMemoryTiers tells whether memory tiers are enforced, which takes the hook library
+// enforcement and a hook library said to read MemoryTierEnv with HookMemoryTiers in
+// capabilities.
+func DetectMemoryTiers(enforcement string, capabilities []string) bool {
+	return enforcement == EnforcementHook && hasCapability(capabilities, HookMemoryTiers)
+}
+
+func hasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// enforcedCores rounds a core limit in percent to the nearest config.CoreLimitGranularity
+// step, which is what the hook library enforces. 0 and 100 leave the cores unlimited and
+// are kept, limits below one step can't be enforced.
+func enforcedCores(cores int32) (int32, error) {
+	step := int32(config.CoreLimitGranularity)
+	if step <= 1 || cores <= 0 || cores >= 100 {
+		return cores, nil
+	}
+	if cores < step {
+		return 0, fmt.Errorf("a core limit of %v%% can't be enforced, the hook library limits cores in steps of %v%%, request 0 or at least %v%% of the cores", cores, step, step)
+	}
+	rounded := (cores + step/2) / step * step
+	if rounded > 100 {
+		rounded = 100
+	}
+	return rounded, nil
+}
+
+// setVisibleDevices passes the GPUs with the given UUIDs to the NVIDIA container runtime.
+// UUIDs are used rather than indices, which differ between the host and the container,
+// except for GPUs with composite IDs, which the runtime can't find by UUID.
+// With the volume-mounts strategy the list is mounted into the container, where only the
+// runtime configured with accept-nvidia-visible-devices-as-volume-mounts reads it, so a
+// container can't widen its GPUs by setting NVIDIA_VISIBLE_DEVICES itself. With the
+// cdi-annotations strategy the runtime injects the GPUs from their CDI specification, and
+// NVIDIA_VISIBLE_DEVICES is voided so an NVIDIA runtime, if any, doesn't add the GPUs the
+// image asks for.
+func setVisibleDevices(response *pluginapi.ContainerAllocateResponse, ids []string) {
+	uuids := make([]string, 0, len(ids))
+	for _, id := range ids {
+		uuids = append(uuids, runtimeDeviceID(id))
+	}
+	switch config.DeviceListStrategy {
+	case DeviceListStrategyVolumeMounts:
+		response.Envs["NVIDIA_VISIBLE_DEVICES"] = deviceListAsVolumeMountsContainerPathRoot
+		for _, id := range uuids {
+			response.Mounts = append(response.Mounts, &pluginapi.Mount{
+				ContainerPath: filepath.Join(deviceListAsVolumeMountsContainerPathRoot, id),
+				HostPath:      deviceListAsVolumeMountsHostPath,
+			})
+		}
+	case DeviceListStrategyCDIAnnotations:
+		response.Envs["NVIDIA_VISIBLE_DEVICES"] = "void"
+		var devices []string
+		for _, id := range uuids {
+			devices = append(devices, cdiDeviceKind+"="+id)
+		}
+		if response.Annotations == nil {
+			response.Annotations = make(map[string]string)
+		}
+		response.Annotations[cdiAnnotationKey] = strings.Join(devices, ",")
+	default:
+		response.Envs["NVIDIA_VISIBLE_DEVICES"] = strings.Join(uuids, ",")
+	}
+}
+
+// ValidateDeviceListStrategy checks the strategy chosen on the command line.
+func ValidateDeviceListStrategy(strategy string) error {
+	switch strategy {
+	case DeviceListStrategyEnvvar, DeviceListStrategyVolumeMounts, DeviceListStrategyCDIAnnotations:
+		return nil
+	}
+	return fmt.Errorf("unknown device list strategy: %v", strategy)
+}
+
+// apiDeviceSpecs returns the device nodes the container may access in cgroup mode or
+// with strict device visibility.
+func apiDeviceSpecs(devs []*Device) []*pluginapi.DeviceSpec {
+	var specs []*pluginapi.DeviceSpec
+	for _, p := range nvidiaControlDevices {
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		specs = append(specs, &pluginapi.DeviceSpec{
+			ContainerPath: p,
+			HostPath:      p,
+			Permissions:   "rw",
+		})
+	}
+	for _, d := range devs {
+		for _, p := range d.Paths {
+			specs = append(specs, &pluginapi.DeviceSpec{
+				ContainerPath: filepath.Clean(p),
+				HostPath:      filepath.Clean(p),
+				Permissions:   "rw",
+			})
+		}
+	}
+	return specs
+}
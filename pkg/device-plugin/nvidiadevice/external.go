@@ -0,0 +1,187 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"time"
+
+	"google.golang.org/grpc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	podResourcesSocket  = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	podResourcesTimeout = 10 * time.Second
+
+	// externalMemoryDecay is the share of the gap to a lower measurement closed each round.
+	// Usage growth is taken at once so shared pods don't run out of memory, but capacity
+	// comes back over several minutes so short-lived external processes don't make it flap.
+	externalMemoryDecay = 0.1
+	// externalMemoryStep is the granularity of the reported external usage in MiB,
+	// so the registered memory doesn't change with every small fluctuation.
+	externalMemoryStep = 256
+)
+
+// podUIDPattern finds the pod UID in a cgroup path, with the cgroupfs or systemd driver.
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// ExternalMemory measures the device memory used by processes that didn't get the device
+// from this plugin, like node daemons or DaemonSet pods, so it can be taken out of the
+// schedulable memory.
+type ExternalMemory struct {
+	cache    *DeviceCache
+	client   kubernetes.Interface
+	nodeName string
+	procRoot string
+	// processes lists the processes using the device with the given UUID
+	processes func(uuid string) ([]ProcessInfo, error)
+	// allocatedPods returns the namespace/name of the pods kubelet assigned devices of this plugin to
+	allocatedPods func() (map[string]bool, error)
+	// smoothed is the damped external usage of each device in MiB
+	smoothed map[string]float64
+}
+
+func NewExternalMemory(cache *DeviceCache, nodeName string, client kubernetes.Interface) *ExternalMemory {
+	e := &ExternalMemory{
+		cache:     cache,
+		client:    client,
+		nodeName:  nodeName,
+		procRoot:  "/proc",
+		processes: nvmlLib.Processes,
+		smoothed:  make(map[string]float64),
+	}
+	e.allocatedPods = func() (map[string]bool, error) {
+		return podResourcesAllocatedPods(podResourcesSocket, e.resourceNames())
+	}
+	return e
+}
+
+func (e *ExternalMemory) resourceNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, p := range e.cache.Profiles() {
+		names[p.ResourceName()] = true
+	}
+	return names
+}
+
+// listPodResources asks kubelet for the devices it assigned to the containers of pods.
+func listPodResources(socket string) ([]*podresourcesapi.PodResources, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connect to pod resources socket %v: %v", socket, err)
+	}
+	defer conn.Close()
+	resp, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list pod resources: %v", err)
+	}
+	return resp.GetPodResources(), nil
+}
+
+// podResourcesAllocatedPods asks kubelet which pods hold any of the given resources.
+func podResourcesAllocatedPods(socket string, resourceNames map[string]bool) (map[string]bool, error) {
+	podResources, err := listPodResources(socket)
+	if err != nil {
+		return nil, err
+	}
+	pods := make(map[string]bool)
+	for _, pod := range podResources {
+		for _, ctr := range pod.GetContainers() {
+			for _, dev := range ctr.GetDevices() {
+				if resourceNames[dev.GetResourceName()] {
+					pods[pod.GetNamespace()+"/"+pod.GetName()] = true
+				}
+			}
+		}
+	}
+	return pods, nil
+}
+
+// podUID returns the UID of the pod the process runs in, or "" for processes outside pods.
+func (e *ExternalMemory) podUID(pid uint) string {
+	uid, _ := processCgroup(e.procRoot, pid)
+	return uid
+}
+
+// allocatedPodUIDs returns the UIDs of the pods on the node that hold devices of this plugin.
+func (e *ExternalMemory) allocatedPodUIDs() (map[string]bool, error) {
+	allocated, err := e.allocatedPods()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := e.client.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{FieldSelector: "spec.nodeName=" + e.nodeName})
+	if err != nil {
+		return nil, err
+	}
+	uids := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if allocated[pod.Namespace+"/"+pod.Name] {
+			uids[string(pod.UID)] = true
+		}
+	}
+	return uids, nil
+}
+
+// Measure returns the damped device memory in MiB used by processes outside the pods that
+// got the devices from this plugin, for each of the given devices. Devices whose processes
+// can't be listed keep their previous value.
+func (e *ExternalMemory) Measure(uuids []string) (map[string]int32, error) {
+	allocated, err := e.allocatedPodUIDs()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]int32, len(uuids))
+	for _, uuid := range uuids {
+		procs, err := e.processes(uuid)
+		if err != nil {
+			klog.Warningf("list processes of device %v: %v", uuid, err)
+		} else {
+			var used uint64
+			for _, p := range procs {
+				if uid := e.podUID(p.PID); uid == "" || !allocated[uid] {
+					used += p.MemoryUsed
+				}
+			}
+			e.smooth(uuid, float64(used))
+		}
+		res[uuid] = int32(math.Ceil(e.smoothed[uuid]/externalMemoryStep) * externalMemoryStep)
+	}
+	return res, nil
+}
+
+func (e *ExternalMemory) smooth(uuid string, sample float64) {
+	former, ok := e.smoothed[uuid]
+	if !ok || sample >= former || former-sample < 1 {
+		e.smoothed[uuid] = sample
+		return
+	}
+	e.smoothed[uuid] = former + (sample-former)*externalMemoryDecay
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	vgpuPodUID   = "2b8c7a1e-3f41-4c55-9d0e-1a2b3c4d5e6f"
+	daemonPodUID = "7f6e5d4c-3b2a-4190-8f7e-6d5c4b3a2910"
+)
+
+func writeCgroup(t *testing.T, root string, pid int, cgroup string) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	assert.NilError(t, os.MkdirAll(dir, 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0644))
+}
+
+func newTestExternalMemory(t *testing.T, procs []ProcessInfo) *ExternalMemory {
+	root := t.TempDir()
+	// 1 got the GPU from the plugin (systemd driver), 2 is a DaemonSet pod, 3 runs on the host
+	writeCgroup(t, root, 1, "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod2b8c7a1e_3f41_4c55_9d0e_1a2b3c4d5e6f.slice/cri-containerd-abc.scope\n")
+	writeCgroup(t, root, 2, "12:devices:/kubepods/burstable/pod"+daemonPodUID+"/0123456789ab\n")
+	writeCgroup(t, root, 3, "0::/system.slice/thumbnailer.service\n")
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "train", UID: types.UID(vgpuPodUID)}, Spec: corev1.PodSpec{NodeName: "node1"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "dcgm-exporter", UID: types.UID(daemonPodUID)}, Spec: corev1.PodSpec{NodeName: "node1"}},
+	)
+	e := NewExternalMemory(&DeviceCache{}, "node1", client)
+	e.procRoot = root
+	e.processes = func(uuid string) ([]ProcessInfo, error) { return procs, nil }
+	e.allocatedPods = func() (map[string]bool, error) { return map[string]bool{"default/train": true}, nil }
+	return e
+}
+
+func TestExternalMemoryMeasure(t *testing.T) {
+	procs := []ProcessInfo{{PID: 1, MemoryUsed: 8000}, {PID: 2, MemoryUsed: 300}, {PID: 3, MemoryUsed: 1000}}
+	e := newTestExternalMemory(t, procs)
+	res, err := e.Measure([]string{"GPU-0"})
+	assert.NilError(t, err)
+	// 1300m outside the vgpu pod, rounded up to 256m
+	assert.Equal(t, res["GPU-0"], int32(1536))
+}
+
+func TestExternalMemoryDamping(t *testing.T) {
+	procs := []ProcessInfo{{PID: 3, MemoryUsed: 4000}}
+	e := newTestExternalMemory(t, nil)
+	e.processes = func(uuid string) ([]ProcessInfo, error) { return procs, nil }
+
+	res, err := e.Measure([]string{"GPU-0"})
+	assert.NilError(t, err)
+	assert.Equal(t, res["GPU-0"], int32(4096))
+
+	// the host process exits, capacity comes back slowly
+	procs = nil
+	res, err = e.Measure([]string{"GPU-0"})
+	assert.NilError(t, err)
+	assert.Equal(t, res["GPU-0"], int32(3840))
+	for i := 0; i < 100; i++ {
+		res, err = e.Measure([]string{"GPU-0"})
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, res["GPU-0"], int32(0))
+
+	// a rise is taken at once
+	procs = []ProcessInfo{{PID: 3, MemoryUsed: 2000}}
+	res, err = e.Measure([]string{"GPU-0"})
+	assert.NilError(t, err)
+	assert.Equal(t, res["GPU-0"], int32(2048))
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kubelet calls Allocate again for a container it restarts in place, which gets the
+// same cache directory, <pod uid>_<container name>. Each Allocate starts a new
+// generation of the directory: what the previous instances left is removed, the shared
+// region is named after the generation, and the limit syncer and the heartbeat monitor
+// ignore what an instance of a superseded generation still writes.
+const (
+	// GenerationEnv tells the hook library the generation of its container, which it
+	// writes to its heartbeat.
+	GenerationEnv  = "VGPU_ALLOCATION_GENERATION"
+	generationFile = "generation"
+)
+
+// readGeneration returns the generation of the cache directory dir, 0 if it has none,
+// e.g. when it was created by a plugin that didn't count generations.
+func readGeneration(dir string) int64 {
+	data, err := os.ReadFile(filepath.Join(dir, generationFile))
+	if err != nil {
+		return 0
+	}
+	gen, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || gen < 0 {
+		return 0
+	}
+	return gen
+}
+
+// nextGeneration starts a new generation of the cache directory dir and returns it,
+// after removing the shared regions, heartbeat and anything else of the previous ones.
+func nextGeneration(dir string) (int64, error) {
+	gen := readGeneration(dir) + 1
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.Name() == generationFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return 0, err
+		}
+	}
+	tmp := filepath.Join(dir, generationFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(gen, 10)), 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, generationFile)); err != nil {
+		return 0, err
+	}
+	return gen, nil
+}
+
+// regionFile is the name of the shared region of generation gen.
+func regionFile(gen int64) string {
+	return fmt.Sprintf("%d.cache", gen)
+}
+
+// currentRegions returns the shared regions in the cache directory dir that belong to
+// its current generation, all of them if it has none.
+func currentRegions(dir string) ([]string, error) {
+	gen := readGeneration(dir)
+	if gen == 0 {
+		return filepath.Glob(filepath.Join(dir, "*.cache"))
+	}
+	path := filepath.Join(dir, regionFile(gen))
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+// superseded is whether hb was written by an instance of a generation older than gen.
+// Hook libraries that don't report their generation are taken at their word.
+func superseded(hb *Heartbeat, gen int64) bool {
+	return hb.Generation != 0 && hb.Generation < gen
+}
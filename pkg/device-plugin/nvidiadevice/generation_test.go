@@ -0,0 +1,134 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// TestAllocateCrashLoop restarts a container in place over and over, its memory limit
+// changing every time, and checks that no instance is ever served the state of another.
+func TestAllocateCrashLoop(t *testing.T) {
+	m, client := setupAllocate(t, "")
+	dir := filepath.Join(config.ContainerCacheRoot, "uid_c")
+	syncer := &LimitSyncer{root: config.ContainerCacheRoot, nodeName: "node1", client: client}
+	monitor := &HeartbeatMonitor{
+		root:     config.ContainerCacheRoot,
+		nodeName: "node1",
+		client:   client,
+		recorder: record.NewFakeRecorder(10),
+		stalled:  make(map[string]bool),
+		exported: make(map[string][]string),
+		usage:    NewUsageTracker(),
+		now:      time.Now,
+	}
+	t.Cleanup(func() {
+		for _, m := range []interface{ DeleteLabelValues(...string) bool }{LastActivity, AllocatedBytes, SMSeconds, SMUtilization, PeakMemoryBytes} {
+			m.DeleteLabelValues("default", "p", "c")
+		}
+	})
+
+	var previous string
+	for gen := int64(1); gen <= 5; gen++ {
+		mem := int32(1000 * gen)
+		devs := util.ContainerDevices{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: mem, Usedcores: 30}}
+		pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+		assert.NilError(t, err)
+		pod.Annotations[util.AssignedIDsAnnotations] = annotations.EncodePodDevices(util.PodDevices{devs})
+		pod.Annotations[util.AssignedIDsToAllocateAnnotations] = pod.Annotations[util.AssignedIDsAnnotations]
+		pod.Annotations[util.DeviceBindPhase] = util.DeviceBindAllocating
+		_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+		node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+		assert.NilError(t, err)
+		node.Annotations[util.NodeLockTime] = "locked"
+		_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+
+		res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+		assert.NilError(t, err)
+		envs := res.ContainerResponses[0].Envs
+		assert.Equal(t, envs[GenerationEnv], fmt.Sprint(gen))
+		region := filepath.Join(dir, filepath.Base(envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"]))
+		assert.Assert(t, region != previous)
+		// nothing of the previous instance is left for the new one to read
+		entries, err := os.ReadDir(dir)
+		assert.NilError(t, err)
+		assert.Equal(t, len(entries), 1)
+		assert.Equal(t, entries[0].Name(), generationFile)
+
+		// the new instance starts with the limit it was given, while the previous one,
+		// not quite dead, writes its region and heartbeat once more
+		writeRegion(t, region, map[string]uint64{"GPU-0": uint64(mem) << 20}, "GPU-0")
+		writeHeartbeat(t, config.ContainerCacheRoot, "uid_c", Heartbeat{Timestamp: time.Now().Unix(), AllocatedBytes: uint64(gen), Generation: gen})
+		if previous != "" {
+			writeRegion(t, previous, map[string]uint64{"GPU-0": 1 << 20}, "GPU-0")
+			writeHeartbeat(t, config.ContainerCacheRoot, "uid_c", Heartbeat{Timestamp: time.Now().Unix(), AllocatedBytes: uint64(gen - 1), Generation: gen - 1})
+		}
+		assert.NilError(t, syncer.sync(context.Background()))
+		assert.DeepEqual(t, regionLimits(t, region), []uint64{uint64(mem) << 20})
+		if previous != "" {
+			// the syncer keeps the limits of the current generation out of stale regions
+			assert.DeepEqual(t, regionLimits(t, previous), []uint64{1 << 20})
+			assert.NilError(t, monitor.check(context.Background()))
+			assert.Assert(t, !AllocatedBytes.DeleteLabelValues("default", "p", "c"))
+		}
+		writeHeartbeat(t, config.ContainerCacheRoot, "uid_c", Heartbeat{Timestamp: time.Now().Unix(), AllocatedBytes: uint64(gen), Generation: gen})
+		assert.NilError(t, monitor.check(context.Background()))
+		assert.Equal(t, testutil.ToFloat64(AllocatedBytes.WithLabelValues("default", "p", "c")), float64(gen))
+		previous = region
+	}
+}
+
+func TestCurrentRegions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.cache", "b.cache"} {
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, name), nil, 0666))
+	}
+	// directories of plugins that didn't count generations
+	regions, err := currentRegions(dir)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, regions, []string{filepath.Join(dir, "a.cache"), filepath.Join(dir, "b.cache")})
+
+	gen, err := nextGeneration(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, gen, int64(1))
+	regions, err = currentRegions(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(regions), 0)
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, regionFile(gen)), nil, 0666))
+	regions, err = currentRegions(dir)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, regions, []string{filepath.Join(dir, "1.cache")})
+
+	assert.Assert(t, superseded(&Heartbeat{Generation: 1}, 2))
+	assert.Assert(t, !superseded(&Heartbeat{Generation: 2}, 2))
+	assert.Assert(t, !superseded(&Heartbeat{}, 2))
+}
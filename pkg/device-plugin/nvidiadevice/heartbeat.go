@@ -0,0 +1,230 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// HeartbeatEnv tells the hook library where to write its heartbeat, inside the
+	// cache directory mounted at /tmp/vgpu.
+	HeartbeatEnv  = "CUDA_DEVICE_HEARTBEAT_FILE"
+	heartbeatFile = "heartbeat"
+)
+
+// Heartbeat is written by the hook library as JSON, replacing the file atomically.
+// Times are unix seconds. KernelTimeNs sums up the time the kernels of the container ran
+// since it started, hook versions that don't measure it leave it out.
+type Heartbeat struct {
+	Timestamp        int64  `json:"timestamp"`
+	LastKernelLaunch int64  `json:"last_kernel_launch"`
+	AllocatedBytes   uint64 `json:"allocated_bytes"`
+	KernelTimeNs     uint64 `json:"kernel_time_ns,omitempty"`
+	// Generation is the GenerationEnv of the container that wrote the heartbeat.
+	Generation int64 `json:"generation,omitempty"`
+}
+
+// HeartbeatMonitor reads the heartbeats of the containers on this node, exports
+// them as metrics and reports containers that stopped launching kernels for longer
+// than their pod allows. Hook versions that don't write heartbeats are ignored.
+// The heartbeats are also the check-ins of the usage tracker, which takes the kernel
+// time from NVML accounting where the hook doesn't measure it.
+type HeartbeatMonitor struct {
+	root     string
+	nodeName string
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	// stalled remembers the containers already reported until they are active again
+	stalled map[string]bool
+	// exported are the label values of the metrics set in the previous round
+	exported map[string][]string
+	usage    *UsageTracker
+	// accounting returns the NVML accounting of the processes of the given pods by
+	// container, nil without config.EnableNVMLAccounting
+	accounting func(pods map[string]*corev1.Pod) map[string][]ProcessUsage
+	now        func() time.Time
+}
+
+// NewEventRecorder returns a recorder for the events the device plugin on nodeName reports.
+func NewEventRecorder(nodeName string, client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "vgpu-device-plugin", Host: nodeName})
+}
+
+func NewHeartbeatMonitor(nodeName string, client kubernetes.Interface) *HeartbeatMonitor {
+	h := &HeartbeatMonitor{
+		root:     config.ContainerCacheRoot,
+		nodeName: nodeName,
+		client:   client,
+		recorder: NewEventRecorder(nodeName, client),
+		stalled:  make(map[string]bool),
+		exported: make(map[string][]string),
+		usage:    NewUsageTracker(),
+		now:      time.Now,
+	}
+	if config.EnableNVMLAccounting {
+		h.accounting = func(pods map[string]*corev1.Pod) map[string][]ProcessUsage {
+			return accountProcesses(nvmlLib, "/proc", pods)
+		}
+	}
+	return h
+}
+
+// Usage returns the tracker the heartbeats are checked in to.
+func (h *HeartbeatMonitor) Usage() *UsageTracker {
+	return h.usage
+}
+
+// Run checks the heartbeats every interval until stop is closed.
+func (h *HeartbeatMonitor) Run(interval time.Duration, stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := h.check(context.Background()); err != nil {
+			klog.Errorf("check container heartbeats: %v", err)
+		}
+	}, interval, stop)
+}
+
+func readHeartbeat(path string) (*Heartbeat, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hb := &Heartbeat{}
+	if err := json.Unmarshal(data, hb); err != nil {
+		return nil, err
+	}
+	return hb, nil
+}
+
+func (h *HeartbeatMonitor) check(ctx context.Context) error {
+	entries, err := os.ReadDir(h.root)
+	if err != nil {
+		return err
+	}
+	pods, err := h.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + h.nodeName})
+	if err != nil {
+		return err
+	}
+	byUID := make(map[string]*corev1.Pod)
+	for i := range pods.Items {
+		byUID[string(pods.Items[i].UID)] = &pods.Items[i]
+	}
+
+	var accounted map[string][]ProcessUsage
+	if h.accounting != nil {
+		accounted = h.accounting(byUID)
+	}
+
+	now := h.now()
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		// directories are named <pod uid>_<container name> by Allocate
+		uid, ctr, ok := strings.Cut(e.Name(), "_")
+		if !e.IsDir() || !ok {
+			continue
+		}
+		pod, ok := byUID[uid]
+		if !ok {
+			continue
+		}
+		hb, err := readHeartbeat(filepath.Join(h.root, e.Name(), heartbeatFile))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				klog.V(4).Infof("read heartbeat of %v/%v %v: %v", pod.Namespace, pod.Name, ctr, err)
+			}
+			continue
+		}
+		if gen := readGeneration(filepath.Join(h.root, e.Name())); superseded(hb, gen) {
+			klog.V(4).Infof("ignoring heartbeat of %v/%v %v from generation %v, the container is at %v", pod.Namespace, pod.Name, ctr, hb.Generation, gen)
+			continue
+		}
+		labels := []string{pod.Namespace, pod.Name, ctr}
+		seen[e.Name()] = true
+		h.exported[e.Name()] = labels
+		idle := now.Sub(time.Unix(hb.LastKernelLaunch, 0))
+		LastActivity.WithLabelValues(labels...).Set(idle.Seconds())
+		AllocatedBytes.WithLabelValues(labels...).Set(float64(hb.AllocatedBytes))
+		h.checkIn(e.Name(), labels, CheckIn{
+			At:             now,
+			KernelTime:     time.Duration(hb.KernelTimeNs),
+			AllocatedBytes: hb.AllocatedBytes,
+			Processes:      accounted[e.Name()],
+		})
+		h.checkStalled(e.Name(), pod, ctr, idle)
+	}
+	for key, labels := range h.exported {
+		if !seen[key] {
+			LastActivity.DeleteLabelValues(labels...)
+			AllocatedBytes.DeleteLabelValues(labels...)
+			SMSeconds.DeleteLabelValues(labels...)
+			SMUtilization.DeleteLabelValues(labels...)
+			PeakMemoryBytes.DeleteLabelValues(labels...)
+			h.usage.Forget(key)
+			delete(h.exported, key)
+			delete(h.stalled, key)
+		}
+	}
+	return nil
+}
+
+func (h *HeartbeatMonitor) checkIn(key string, labels []string, c CheckIn) {
+	SMSeconds.WithLabelValues(labels...).Add(h.usage.Observe(key, labels[0], labels[1], labels[2], c))
+	u, _ := h.usage.Usage(key)
+	SMUtilization.WithLabelValues(labels...).Set(u.Utilization)
+	PeakMemoryBytes.WithLabelValues(labels...).Set(float64(u.PeakMemory))
+}
+
+func (h *HeartbeatMonitor) checkStalled(key string, pod *corev1.Pod, ctr string, idle time.Duration) {
+	value, ok := pod.Annotations[util.StallThresholdAnnotation]
+	if !ok {
+		return
+	}
+	threshold, err := time.ParseDuration(value)
+	if err != nil || threshold <= 0 {
+		klog.V(4).Infof("pod %v/%v has invalid %v %q", pod.Namespace, pod.Name, util.StallThresholdAnnotation, value)
+		return
+	}
+	if idle < threshold {
+		delete(h.stalled, key)
+		return
+	}
+	if h.stalled[key] {
+		return
+	}
+	h.stalled[key] = true
+	h.recorder.Eventf(pod, corev1.EventTypeWarning, "VGPUContainerStalled",
+		"container %v launched no GPU kernel for %v, longer than %v", ctr, idle.Round(time.Second), threshold)
+}
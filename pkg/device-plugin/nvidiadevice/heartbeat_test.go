@@ -0,0 +1,87 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func writeHeartbeat(t *testing.T, root, dir string, hb Heartbeat) {
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, dir), 0777))
+	data, err := json.Marshal(hb)
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(filepath.Join(root, dir, heartbeatFile), data, 0666))
+}
+
+func TestHeartbeatMonitor(t *testing.T) {
+	now := time.Unix(10000, 0)
+	pod := func(name, uid string, annos map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: k8stypes.UID(uid), Annotations: annos}}
+	}
+	client := fake.NewSimpleClientset(
+		pod("stalled", "uid1", map[string]string{util.StallThresholdAnnotation: "5m"}),
+		pod("busy", "uid2", map[string]string{util.StallThresholdAnnotation: "5m"}),
+		pod("legacy", "uid3", nil),
+	)
+	root := t.TempDir()
+	writeHeartbeat(t, root, "uid1_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: now.Add(-10 * time.Minute).Unix(), AllocatedBytes: 1 << 30})
+	writeHeartbeat(t, root, "uid2_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: now.Add(-time.Second).Unix(), KernelTimeNs: uint64(90 * time.Second)})
+	// an old hook only writes its cache file
+	assert.NilError(t, os.MkdirAll(filepath.Join(root, "uid3_c"), 0777))
+
+	recorder := record.NewFakeRecorder(10)
+	h := &HeartbeatMonitor{
+		root:     root,
+		nodeName: "node1",
+		client:   client,
+		recorder: recorder,
+		stalled:  make(map[string]bool),
+		exported: make(map[string][]string),
+		usage:    NewUsageTracker(),
+		now:      func() time.Time { return now },
+	}
+	assert.NilError(t, h.check(context.Background()))
+	assert.Equal(t, testutil.ToFloat64(LastActivity.WithLabelValues("default", "stalled", "c")), float64(600))
+	assert.Equal(t, testutil.ToFloat64(AllocatedBytes.WithLabelValues("default", "stalled", "c")), float64(1<<30))
+	assert.Equal(t, testutil.ToFloat64(LastActivity.WithLabelValues("default", "busy", "c")), float64(1))
+	assert.Equal(t, testutil.ToFloat64(SMSeconds.WithLabelValues("default", "busy", "c")), float64(90))
+	assert.Equal(t, testutil.ToFloat64(PeakMemoryBytes.WithLabelValues("default", "stalled", "c")), float64(1<<30))
+	assert.Equal(t, <-recorder.Events, "Warning VGPUContainerStalled container c launched no GPU kernel for 10m0s, longer than 5m0s")
+
+	// reported once until the container is active again
+	assert.NilError(t, h.check(context.Background()))
+	assert.Equal(t, len(recorder.Events), 0)
+
+	// containers that are gone are no longer exported
+	assert.NilError(t, os.RemoveAll(filepath.Join(root, "uid1_c")))
+	assert.NilError(t, h.check(context.Background()))
+	assert.Equal(t, testutil.CollectAndCount(LastActivity), 1)
+}
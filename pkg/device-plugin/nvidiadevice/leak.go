@@ -0,0 +1,199 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// What Allocate does when a GPU lacks the memory of a container because processes of
+// terminated pods hold it, see config.OnLeak.
+const (
+	OnLeakFail = "fail"
+	OnLeakWarn = "warn"
+)
+
+// ValidateOnLeak checks the action on leaks chosen on the command line.
+func ValidateOnLeak(action string) error {
+	switch action {
+	case OnLeakFail, OnLeakWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown action on leaks %q, must be %v or %v", action, OnLeakFail, OnLeakWarn)
+}
+
+// leakedProcess is a process on a GPU whose pod terminated or is gone.
+type leakedProcess struct {
+	PID uint
+	// MemoryUsed is the device memory the process holds, in MiB
+	MemoryUsed uint64
+	PodUID     string
+	// Pod is nil for pods deleted already
+	Pod *corev1.Pod
+}
+
+func (p leakedProcess) String() string {
+	if p.Pod == nil {
+		return fmt.Sprintf("pid %v (%vm) of deleted pod %v", p.PID, p.MemoryUsed, p.PodUID)
+	}
+	return fmt.Sprintf("pid %v (%vm) of %v pod %v/%v", p.PID, p.MemoryUsed, strings.ToLower(string(p.Pod.Status.Phase)), p.Pod.Namespace, p.Pod.Name)
+}
+
+// LeakCheck verifies with config.VerifyDeviceFreeMemory that the GPUs of a container have
+// its memory free when it is allocated. Accounting can't see processes that outlived their
+// pods, like zombies of a crashed container, whose memory the next tenant of the GPU would
+// run out of.
+type LeakCheck struct {
+	nodeName string
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	lib      NVML
+	procRoot string
+	kill     func(pid int) error
+}
+
+func NewLeakCheck(nodeName string, client kubernetes.Interface) *LeakCheck {
+	return &LeakCheck{
+		nodeName: nodeName,
+		client:   client,
+		recorder: NewEventRecorder(nodeName, client),
+		lib:      nvmlLib,
+		procRoot: "/proc",
+		kill: func(pid int) error {
+			return syscall.Kill(pid, syscall.SIGKILL)
+		},
+	}
+}
+
+// Check queries NVML for the free memory of each GPU of devreq, the devices pod is about
+// to get. A GPU with less free memory than the container's limit, the accounted
+// co-tenants using theirs, is checked for processes of pods that terminated or are gone.
+// These are reported in a DeviceMemoryLeakDetected event on pod, killed with
+// config.ReapLeakedProcesses, and fail the allocation with config.OnLeak "fail". A lack of
+// memory without such processes is left to config.StrictBindTimeMemoryCheck.
+func (c *LeakCheck) Check(pod *corev1.Pod, devreq util.ContainerDevices) error {
+	var pods map[string]*corev1.Pod
+	for _, dev := range devreq {
+		sample, err := c.lib.Query(dev.UUID)
+		if err != nil {
+			klog.Warningf("check device %v for leaked memory: %v", dev.UUID, err)
+			continue
+		}
+		if sample.Free >= uint64(dev.Usedmem) {
+			continue
+		}
+		if pods == nil {
+			if pods, err = nodePods(c.client, c.nodeName); err != nil {
+				klog.Warningf("check device %v for leaked memory: %v", dev.UUID, err)
+				return nil
+			}
+		}
+		leaked := c.leaked(dev.UUID, pods)
+		if len(leaked) == 0 {
+			continue
+		}
+		var held uint64
+		var owners []string
+		for _, p := range leaked {
+			held += p.MemoryUsed
+			owners = append(owners, p.String())
+		}
+		msg := fmt.Sprintf("device %v has %vm free, less than the %vm requested, %vm are held by %v",
+			dev.UUID, sample.Free, dev.Usedmem, held, strings.Join(owners, ", "))
+		if config.ReapLeakedProcesses {
+			msg += ", " + c.reap(leaked)
+		}
+		klog.Warningf("pod %v/%v: %v", pod.Namespace, pod.Name, msg)
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, "DeviceMemoryLeakDetected", msg)
+		if config.OnLeak == OnLeakFail {
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// nodePods returns the pods of the node by UID.
+func nodePods(client kubernetes.Interface, nodeName string) (map[string]*corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.APITimeout)
+	defer cancel()
+	list, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*corev1.Pod, len(list.Items))
+	for i := range list.Items {
+		res[string(list.Items[i].UID)] = &list.Items[i]
+	}
+	return res, nil
+}
+
+// leaked returns the processes on the device with uuid run by pods that terminated or are
+// not on the node anymore. Processes outside pods aren't tenants, they aren't returned.
+func (c *LeakCheck) leaked(uuid string, pods map[string]*corev1.Pod) []leakedProcess {
+	procs, err := c.lib.Processes(uuid)
+	if err != nil {
+		klog.Warningf("list processes of %v: %v", uuid, err)
+		return nil
+	}
+	var res []leakedProcess
+	for _, p := range procs {
+		uid, _ := processCgroup(c.procRoot, p.PID)
+		if uid == "" {
+			continue
+		}
+		pod, ok := pods[uid]
+		if ok && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			continue
+		}
+		res = append(res, leakedProcess{PID: p.PID, MemoryUsed: p.MemoryUsed, PodUID: uid, Pod: pod})
+	}
+	return res
+}
+
+// reap kills the leaked processes and tells which it did.
+func (c *LeakCheck) reap(leaked []leakedProcess) string {
+	var killed, failed []string
+	for _, p := range leaked {
+		if err := c.kill(int(p.PID)); err != nil {
+			klog.Errorf("kill leaked process %v: %v", p.PID, err)
+			failed = append(failed, fmt.Sprint(p.PID))
+			continue
+		}
+		klog.Infof("Killed leaked process %v", p)
+		killed = append(killed, fmt.Sprint(p.PID))
+	}
+	res := fmt.Sprintf("killed %v", strings.Join(killed, " "))
+	if len(killed) == 0 {
+		res = "killed none"
+	}
+	if len(failed) > 0 {
+		res += fmt.Sprintf(", failed to kill %v", strings.Join(failed, " "))
+	}
+	return res
+}
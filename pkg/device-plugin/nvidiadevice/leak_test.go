@@ -0,0 +1,100 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+type leakNVML struct {
+	NVML
+	free  uint64
+	procs []ProcessInfo
+}
+
+func (n *leakNVML) Query(uuid string) (DeviceSample, error) {
+	return DeviceSample{Model: "A100", Memory: 16000, Free: n.free}, nil
+}
+
+func (n *leakNVML) Processes(uuid string) ([]ProcessInfo, error) {
+	return n.procs, nil
+}
+
+func TestLeakCheck(t *testing.T) {
+	oldOnLeak, oldReap := config.OnLeak, config.ReapLeakedProcesses
+	t.Cleanup(func() { config.OnLeak, config.ReapLeakedProcesses = oldOnLeak, oldReap })
+	const failedPodUID = "5a4b3c2d-1e0f-4a9b-8c7d-6e5f4a3b2c1d"
+	const deletedPodUID = "9e8d7c6b-5a49-4382-a716-5f4e3d2c1b0a"
+	root := t.TempDir()
+	// 1 is a co-tenant, 2 and 3 outlived their pods, 4 runs on the host
+	writeCgroup(t, root, 1, "0::/kubepods.slice/kubepods-pod"+strings.ReplaceAll(vgpuPodUID, "-", "_")+".slice/cri-containerd-abc.scope\n")
+	writeCgroup(t, root, 2, "12:devices:/kubepods/pod"+failedPodUID+"/0123456789ab\n")
+	writeCgroup(t, root, 3, "12:devices:/kubepods/pod"+deletedPodUID+"/0123456789ab\n")
+	writeCgroup(t, root, 4, "0::/system.slice/thumbnailer.service\n")
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "train", UID: types.UID(vgpuPodUID)}, Spec: corev1.PodSpec{NodeName: "node1"},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "crashed", UID: types.UID(failedPodUID)}, Spec: corev1.PodSpec{NodeName: "node1"},
+			Status: corev1.PodStatus{Phase: corev1.PodFailed}},
+	)
+	lib := &leakNVML{free: 2000, procs: []ProcessInfo{{PID: 1, MemoryUsed: 4000}, {PID: 2, MemoryUsed: 6000}, {PID: 3, MemoryUsed: 2000}, {PID: 4, MemoryUsed: 1000}}}
+	var killed []int
+	recorder := record.NewFakeRecorder(8)
+	c := &LeakCheck{nodeName: "node1", client: client, recorder: recorder, lib: lib, procRoot: root, kill: func(pid int) error {
+		killed = append(killed, pid)
+		return nil
+	}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "next"}}
+	devreq := util.ContainerDevices{{UUID: "GPU-0", Usedmem: 8000}}
+
+	config.OnLeak, config.ReapLeakedProcesses = OnLeakFail, false
+	err := c.Check(pod, devreq)
+	assert.ErrorContains(t, err, "device GPU-0 has 2000m free, less than the 8000m requested, 8000m are held by "+
+		"pid 2 (6000m) of failed pod default/crashed, pid 3 (2000m) of deleted pod "+deletedPodUID)
+	event := <-recorder.Events
+	assert.Assert(t, strings.HasPrefix(event, "Warning DeviceMemoryLeakDetected device GPU-0"), event)
+	assert.Assert(t, killed == nil)
+
+	config.OnLeak, config.ReapLeakedProcesses = OnLeakWarn, true
+	assert.NilError(t, c.Check(pod, devreq))
+	assert.Assert(t, strings.HasSuffix(<-recorder.Events, "killed 2 3"))
+	assert.DeepEqual(t, killed, []int{2, 3})
+
+	// enough memory, or too little without leaked processes, isn't a leak
+	config.OnLeak = OnLeakFail
+	lib.free = 8000
+	assert.NilError(t, c.Check(pod, devreq))
+	lib.free, lib.procs = 2000, lib.procs[:1]
+	assert.NilError(t, c.Check(pod, devreq))
+	assert.Equal(t, len(recorder.Events), 0)
+}
+
+func TestValidateOnLeak(t *testing.T) {
+	assert.NilError(t, ValidateOnLeak(OnLeakFail))
+	assert.NilError(t, ValidateOnLeak(OnLeakWarn))
+	assert.ErrorContains(t, ValidateOnLeak("kill"), `unknown action on leaks "kill"`)
+}
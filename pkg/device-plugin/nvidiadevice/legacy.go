@@ -0,0 +1,233 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"k8s.io/klog/v2"
+)
+
+// MigrationPath is where the runtime service reports the progress of the migration from
+// the stock device plugin, with --coexist-with-legacy-allocations.
+const MigrationPath = "/migration"
+
+// legacySyncInterval is how often kubelet is asked for the GPUs of legacy pods, at most
+// one freed GPU is brought into the pool each time.
+var legacySyncInterval = 30 * time.Second
+
+// SetLegacyHeld keeps the devices with the given UUIDs out of the pool and brings all
+// others in. Unlike a drained device, a held one is healthy but not advertised at all,
+// neither to kubelet nor to the scheduler.
+func (d *DeviceCache) SetLegacyHeld(ids map[string]bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var changed []string
+	for _, dev := range d.cache {
+		if ids[dev.ID] == d.legacy[dev.ID] {
+			continue
+		}
+		changed = append(changed, dev.ID)
+		if ids[dev.ID] {
+			d.legacy[dev.ID] = true
+		} else {
+			delete(d.legacy, dev.ID)
+		}
+	}
+	if len(changed) > 0 {
+		d.publish(changed)
+	}
+}
+
+// LegacyHeld tells whether the device with the given UUID is kept out of the pool for
+// pods of the stock device plugin.
+func (d *DeviceCache) LegacyHeld(id string) bool {
+	s := d.Snapshot()
+	return s != nil && s.Legacy[id]
+}
+
+// MigrationStatus lists the GPUs pods of the stock device plugin held since the plugin
+// started. GPUs they never held aren't listed, they are in the pool from the first sync.
+type MigrationStatus struct {
+	// Synced is set once kubelet answered, until then every GPU is held
+	Synced bool `json:"synced"`
+	// Held are the GPUs kubelet still assigns to legacy pods
+	Held []string `json:"held"`
+	// Releasing are the GPUs whose legacy pods are gone, waiting for NVML to list no
+	// process on them and for their turn
+	Releasing []string `json:"releasing"`
+	// Released are the GPUs brought into the pool after their legacy pods ended
+	Released []string `json:"released"`
+	Complete bool     `json:"complete"`
+}
+
+// LegacyMigration keeps the GPUs that pods of the stock NVIDIA device plugin were
+// assigned out of the pool, so no slice of them is given to another container while
+// the legacy pod uses the whole GPU. kubelet keeps the assignments of the replaced plugin
+// in its checkpoint and reports them on the pod resources socket, by GPU UUID or index.
+// A GPU whose legacy pods ended comes back once NVML lists no process on it, one GPU
+// per sync so the pool grows steadily rather than with the end of a whole Job.
+type LegacyMigration struct {
+	cache *DeviceCache
+	// legacyDevices returns the device IDs kubelet assigned under config.LegacyResourceName
+	legacyDevices func() (map[string]bool, error)
+
+	mu sync.Mutex
+	// seen are the GPUs ever held by legacy pods, released those brought back since
+	seen     map[string]bool
+	released map[string]bool
+	status   MigrationStatus
+}
+
+// NewLegacyMigration holds every GPU of cache until the first Sync.
+func NewLegacyMigration(cache *DeviceCache) *LegacyMigration {
+	l := &LegacyMigration{
+		cache:    cache,
+		seen:     make(map[string]bool),
+		released: make(map[string]bool),
+		status:   MigrationStatus{Held: []string{}, Releasing: []string{}, Released: []string{}},
+	}
+	l.legacyDevices = func() (map[string]bool, error) {
+		return podResourcesDeviceIDs(podResourcesSocket, config.LegacyResourceName)
+	}
+	all := make(map[string]bool)
+	for _, dev := range cache.GetCache() {
+		all[dev.ID] = true
+	}
+	cache.SetLegacyHeld(all)
+	return l
+}
+
+// podResourcesDeviceIDs asks kubelet for the IDs of the devices assigned under resourceName.
+func podResourcesDeviceIDs(socket, resourceName string) (map[string]bool, error) {
+	podResources, err := listPodResources(socket)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, pod := range podResources {
+		for _, ctr := range pod.GetContainers() {
+			for _, dev := range ctr.GetDevices() {
+				if dev.GetResourceName() != resourceName {
+					continue
+				}
+				for _, id := range dev.GetDeviceIds() {
+					ids[id] = true
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+// Sync asks kubelet for the GPUs of legacy pods and updates the GPUs held. On an error
+// the GPUs held are left as they are.
+func (l *LegacyMigration) Sync() error {
+	assigned, err := l.legacyDevices()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held := make(map[string]bool)
+	status := MigrationStatus{Synced: true, Held: []string{}, Releasing: []string{}, Released: []string{}}
+	var freed []string
+	for _, dev := range sortDevices(l.cache.GetCache()) {
+		// our split devices are named <uuid>-<n>, the stock plugin's by UUID or index
+		if assigned[dev.ID] || dev.Index != "" && assigned[dev.Index] {
+			if !l.seen[dev.ID] {
+				klog.Infof("device %v is held by pods of %v, it is kept out of the pool until they end", dev.ID, config.LegacyResourceName)
+			}
+			l.seen[dev.ID] = true
+			delete(l.released, dev.ID)
+			held[dev.ID] = true
+			status.Held = append(status.Held, dev.ID)
+			continue
+		}
+		if l.released[dev.ID] {
+			status.Released = append(status.Released, dev.ID)
+		} else if l.seen[dev.ID] {
+			freed = append(freed, dev.ID)
+		}
+	}
+	releasing := false
+	for _, id := range freed {
+		// the processes of an ended container may still hold memory
+		if sample, ok := l.cache.Sample(id); ok && sample.Contexts == 0 && !releasing {
+			klog.Infof("legacy pods of device %v ended, bringing it into the pool", id)
+			l.released[id] = true
+			status.Released = append(status.Released, id)
+			releasing = true
+			continue
+		}
+		held[id] = true
+		status.Releasing = append(status.Releasing, id)
+	}
+	sort.Strings(status.Released)
+	status.Complete = len(status.Held) == 0 && len(status.Releasing) == 0
+	if status.Complete && !l.status.Complete && len(l.seen) > 0 {
+		klog.Infof("all %d devices held by pods of %v are in the pool, the migration is complete", len(l.seen), config.LegacyResourceName)
+	}
+	l.status = status
+	l.cache.SetLegacyHeld(held)
+	LegacyDevices.WithLabelValues("held").Set(float64(len(status.Held)))
+	LegacyDevices.WithLabelValues("releasing").Set(float64(len(status.Releasing)))
+	LegacyDevices.WithLabelValues("released").Set(float64(len(status.Released)))
+	return nil
+}
+
+// Status returns the progress of the migration as of the last Sync.
+func (l *LegacyMigration) Status() MigrationStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+// Run syncs every legacySyncInterval until stop is closed.
+func (l *LegacyMigration) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(legacySyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := l.Sync(); err != nil {
+			klog.Errorf("sync devices held by pods of %v: %v", config.LegacyResourceName, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveMigration reports the MigrationStatus, 404 without --coexist-with-legacy-allocations.
+func (s *RuntimeService) serveMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.migration == nil {
+		http.Error(w, "not migrating from the stock device plugin, see --coexist-with-legacy-allocations", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.migration.Status())
+}
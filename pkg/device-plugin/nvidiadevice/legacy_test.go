@@ -0,0 +1,117 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestLegacyMigration runs a node with two GPUs held by pods of the stock device plugin,
+// one assigned by UUID and one by index, and two free GPUs.
+func TestLegacyMigration(t *testing.T) {
+	contexts := map[string]int{"GPU-0": 1, "GPU-1": 1}
+	d := newTestCache(t, 4, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000, Contexts: contexts[uuid]}, nil
+	})
+	d.cache[1].Index = "1"
+	d.sample()
+	assigned := map[string]bool{"GPU-0": true, "1": true}
+	listErr := errors.New("kubelet down")
+	var kubeletErr error
+	l := NewLegacyMigration(d)
+	l.legacyDevices = func() (map[string]bool, error) { return assigned, kubeletErr }
+	m := &NvidiaDevicePlugin{deviceCache: d, migStrategy: "none", profile: &Profile{DeviceSplitCount: 2}}
+	advertised := func() []string {
+		var ids []string
+		for _, dev := range m.apiDevices() {
+			ids = append(ids, dev.ID)
+		}
+		return ids
+	}
+	sync := func() MigrationStatus {
+		assert.NilError(t, l.Sync())
+		return l.Status()
+	}
+
+	// nothing is advertised until kubelet answered
+	assert.Equal(t, len(advertised()), 0)
+	kubeletErr = listErr
+	assert.ErrorContains(t, l.Sync(), "kubelet down")
+	assert.Equal(t, len(advertised()), 0)
+	kubeletErr = nil
+
+	status := sync()
+	assert.DeepEqual(t, status, MigrationStatus{Synced: true, Held: []string{"GPU-0", "GPU-1"}, Releasing: []string{}, Released: []string{}})
+	assert.DeepEqual(t, advertised(), []string{"GPU-2-0", "GPU-2-1", "GPU-3-0", "GPU-3-1"})
+	assert.Equal(t, len(*NewDeviceRegister(d).apiDevices(&corev1.Node{}, nil, nil)), 2)
+	assert.Equal(t, testutil.ToFloat64(LegacyDevices.WithLabelValues("held")), float64(2))
+
+	// the legacy pod of GPU-0 ended, but its process is still exiting
+	delete(assigned, "GPU-0")
+	status = sync()
+	assert.DeepEqual(t, status.Held, []string{"GPU-1"})
+	assert.DeepEqual(t, status.Releasing, []string{"GPU-0"})
+	assert.Equal(t, len(advertised()), 4)
+
+	// both GPUs are free, they come back one by one
+	delete(assigned, "1")
+	contexts["GPU-0"], contexts["GPU-1"] = 0, 0
+	d.sample()
+	status = sync()
+	assert.DeepEqual(t, status, MigrationStatus{Synced: true, Held: []string{}, Releasing: []string{"GPU-1"}, Released: []string{"GPU-0"}})
+	assert.Equal(t, len(advertised()), 6)
+	assert.Assert(t, d.LegacyHeld("GPU-1"))
+
+	status = sync()
+	assert.DeepEqual(t, status, MigrationStatus{Synced: true, Held: []string{}, Releasing: []string{}, Released: []string{"GPU-0", "GPU-1"}, Complete: true})
+	assert.Equal(t, len(advertised()), 8)
+	assert.Equal(t, testutil.ToFloat64(LegacyDevices.WithLabelValues("released")), float64(2))
+	assert.Equal(t, testutil.ToFloat64(LegacyDevices.WithLabelValues("held")), float64(0))
+}
+
+func TestServeMigration(t *testing.T) {
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	s := NewRuntimeService(d, "node1", nil)
+	rec := httptest.NewRecorder()
+	s.serveMigration(rec, httptest.NewRequest("GET", MigrationPath, nil))
+	assert.Equal(t, rec.Code, 404)
+
+	l := NewLegacyMigration(d)
+	l.legacyDevices = func() (map[string]bool, error) { return map[string]bool{"GPU-1": true}, nil }
+	assert.NilError(t, l.Sync())
+	s.SetLegacyMigration(l)
+	rec = httptest.NewRecorder()
+	s.serveMigration(rec, httptest.NewRequest("GET", MigrationPath, nil))
+	var status MigrationStatus
+	assert.NilError(t, json.NewDecoder(rec.Body).Decode(&status))
+	assert.DeepEqual(t, status.Held, []string{"GPU-1"})
+
+	states := s.states(context.Background(), d.Snapshot())
+	assert.Assert(t, !states[0].Legacy)
+	assert.Assert(t, states[1].Legacy)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// How the limits of a container are passed to it, see config.LimitDelivery.
+const (
+	// LimitDeliveryEnv sets the limits in environment variables of the container.
+	LimitDeliveryEnv = "env"
+	// LimitDeliveryFile writes them to a limit config file mounted at LimitConfigPath,
+	// for shims that read their limits from a file.
+	LimitDeliveryFile = "file"
+
+	// LimitConfigPath is where containers find their limit config file, one KEY=VALUE line
+	// for each of the variables LimitDeliveryEnv would set.
+	LimitConfigPath = "/etc/vgpu/limits.conf"
+	// limitConfigFile is the name of the limit config file in the cache directory of a
+	// container on the host.
+	limitConfigFile = "limits.conf"
+)
+
+// ValidateLimitDelivery checks the limit delivery chosen on the command line.
+func ValidateLimitDelivery(delivery string) error {
+	switch delivery {
+	case LimitDeliveryEnv, LimitDeliveryFile:
+		return nil
+	}
+	return fmt.Errorf("unknown limit delivery %q, must be %v or %v", delivery, LimitDeliveryEnv, LimitDeliveryFile)
+}
+
+// isLimitEnv is whether the variable key of an Allocate response carries a limit.
+func isLimitEnv(key string) bool {
+	switch key {
+	case "CUDA_DEVICE_SM_LIMIT", "CUDA_OVERSUBSCRIBE", api.CoreLimitSwitch, MemoryBandwidthEnv, MemoryTierEnv:
+		return true
+	}
+	return strings.HasPrefix(key, "CUDA_DEVICE_MEMORY_LIMIT_") || strings.HasPrefix(key, "CUDA_MANAGED_MEMORY_LIMIT_")
+}
+
+// deliverLimits moves the limits in the variables of response to the limit config file in
+// the cache directory dir of the container and mounts it, unless config.LimitDelivery
+// leaves them in the variables.
+func deliverLimits(response *pluginapi.ContainerAllocateResponse, dir string) error {
+	if config.LimitDelivery != LimitDeliveryFile {
+		return nil
+	}
+	limits := make(map[string]string)
+	for key, value := range response.Envs {
+		if isLimitEnv(key) {
+			limits[key] = value
+			delete(response.Envs, key)
+		}
+	}
+	path := filepath.Join(dir, limitConfigFile)
+	if err := os.WriteFile(path, encodeLimitConfig(limits), 0644); err != nil {
+		return fmt.Errorf("write limit config: %v", err)
+	}
+	response.Mounts = append(response.Mounts, &pluginapi.Mount{ContainerPath: LimitConfigPath, HostPath: path, ReadOnly: true})
+	return nil
+}
+
+func encodeLimitConfig(limits map[string]string) []byte {
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%v=%v\n", key, limits[key])
+	}
+	return b.Bytes()
+}
+
+func decodeLimitConfig(data []byte) map[string]string {
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			res[key] = value
+		}
+	}
+	return res
+}
+
+// updateLimitConfig sets the memory limits of the limit config file in the cache directory
+// dir to those of devs, with managedMemory also the device plus host memory budgets, and
+// tells whether they changed. Containers without the file are left alone. The file is bind
+// mounted, so it is rewritten in place.
+func updateLimitConfig(dir string, devs util.ContainerDevices, managedMemory bool) (bool, error) {
+	path := filepath.Join(dir, limitConfigFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	limits := decodeLimitConfig(data)
+	// Allocate numbers the devices in the order of their UUIDs
+	sorted := append(util.ContainerDevices(nil), devs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].UUID < sorted[j].UUID })
+	for i, dev := range sorted {
+		limits[fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)] = memoryLimitEnv(dev.Usedmem)
+		if managedMemory {
+			limits[fmt.Sprintf("CUDA_MANAGED_MEMORY_LIMIT_%v", i)] = memoryLimitEnv(managedMemoryBudget(dev.Usedmem))
+		}
+	}
+	updated := encodeLimitConfig(limits)
+	if bytes.Equal(updated, data) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, updated, 0644)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAllocateDeliversLimitsInFile(t *testing.T) {
+	old := config.LimitDelivery
+	t.Cleanup(func() { config.LimitDelivery = old })
+	config.LimitDelivery = LimitDeliveryFile
+	m, _ := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+	envs := res.ContainerResponses[0].Envs
+	for _, key := range []string{"CUDA_DEVICE_MEMORY_LIMIT_0", "CUDA_DEVICE_SM_LIMIT"} {
+		_, ok := envs[key]
+		assert.Assert(t, !ok, key)
+	}
+	assert.Equal(t, envs["NVIDIA_VISIBLE_DEVICES"], "GPU-0")
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"], "/tmp/vgpu/1.cache")
+	var hostPath string
+	for _, mount := range res.ContainerResponses[0].Mounts {
+		if mount.ContainerPath == LimitConfigPath {
+			assert.Assert(t, mount.ReadOnly)
+			hostPath = mount.HostPath
+		}
+	}
+	assert.Equal(t, hostPath, filepath.Join(config.ContainerCacheRoot, "uid_c", limitConfigFile))
+	data, err := os.ReadFile(hostPath)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "CUDA_DEVICE_MEMORY_LIMIT_0=1000m\nCUDA_DEVICE_SM_LIMIT=30\n")
+}
+
+func TestLimitSyncerUpdatesLimitConfig(t *testing.T) {
+	// resized in place, the annotation lists the devices in another order than Allocate
+	devs := util.PodDevices{{
+		{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 6000},
+		{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 2000},
+	}}
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: k8stypes.UID("uid1"), Annotations: map[string]string{
+			util.AssignedIDsAnnotations: annotations.EncodePodDevices(devs),
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	})
+	root := t.TempDir()
+	path := filepath.Join(root, "uid1_c", limitConfigFile)
+	assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	assert.NilError(t, os.WriteFile(path, []byte("CUDA_DEVICE_MEMORY_LIMIT_0=1000m\nCUDA_DEVICE_MEMORY_LIMIT_1=4000m\nCUDA_DEVICE_SM_LIMIT=30\n"), 0644))
+	before, err := os.Stat(path)
+	assert.NilError(t, err)
+
+	l := &LimitSyncer{root: root, nodeName: "node1", client: client}
+	assert.NilError(t, l.sync(context.Background()))
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "CUDA_DEVICE_MEMORY_LIMIT_0=2000m\nCUDA_DEVICE_MEMORY_LIMIT_1=6000m\nCUDA_DEVICE_SM_LIMIT=30\n")
+	// the container has the file bind mounted
+	after, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Assert(t, os.SameFile(before, after))
+
+	changed, err := updateLimitConfig(filepath.Dir(path), devs[0], false)
+	assert.NilError(t, err)
+	assert.Assert(t, !changed)
+}
+
+func TestValidateLimitDelivery(t *testing.T) {
+	assert.NilError(t, ValidateLimitDelivery(LimitDeliveryEnv))
+	assert.NilError(t, ValidateLimitDelivery(LimitDeliveryFile))
+	assert.ErrorContains(t, ValidateLimitDelivery("volume"), "unknown limit delivery")
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const maxRegionDevices = 16
+
+// regionMagic is what the hook library sets initializedFlag of a shared region to once it
+// initialized it. The region has no version field, the magic stands for the layout of
+// sharedRegionHeader: regions with another non-zero flag were written by a hook library
+// with another layout and are never written to.
+const regionMagic = 19920718
+
+// sharedRegionHeader is the start of the shared region the hook library keeps in the
+// cache file of each container, the same layout vGPUmonitor maps. The hook library reads
+// the memory limits from it on every allocation and the core limits on every kernel
+// launch, so changing them takes effect at once.
+type sharedRegionHeader struct {
+	initializedFlag int32
+	smInitFlag      int32
+	ownerPid        uint32
+	// sem is a sem_t, aligned to 8 bytes by the C compiler
+	_     uint32
+	sem   [32]byte
+	num   uint64
+	uuids [maxRegionDevices][96]byte
+	limit [maxRegionDevices]uint64
+	// smLimit is the core limit in percent
+	smLimit [maxRegionDevices]uint64
+}
+
+var (
+	regionHeaderSize        = int64(unsafe.Sizeof(sharedRegionHeader{}))
+	regionInitializedOffset = int64(unsafe.Offsetof(sharedRegionHeader{}.initializedFlag))
+	regionOwnerPidOffset    = int64(unsafe.Offsetof(sharedRegionHeader{}.ownerPid))
+	regionSemOffset         = int64(unsafe.Offsetof(sharedRegionHeader{}.sem))
+	regionNumOffset         = int64(unsafe.Offsetof(sharedRegionHeader{}.num))
+	regionUUIDsOffset       = int64(unsafe.Offsetof(sharedRegionHeader{}.uuids))
+	regionLimitOffset       = int64(unsafe.Offsetof(sharedRegionHeader{}.limit))
+	regionSMLimitOffset     = int64(unsafe.Offsetof(sharedRegionHeader{}.smLimit))
+)
+
+// The sem_t of glibc on 64-bit platforms is a 64-bit word holding the value of the
+// semaphore in its low and the number of waiters in its high 32 bits, waiters sleep on a
+// futex on the value.
+const (
+	semValueMask     = 1<<32 - 1
+	semNwaitersShift = 32
+	futexWake        = 1
+)
+
+// regionLockTimeout bounds waiting for the semaphore of a shared region. The hook library
+// holds it only while it reads or updates the region, a region locked longer is retried
+// the next time.
+var regionLockTimeout = time.Second
+
+// sharedRegion is the header of a shared region mapped from its cache file, the writes of
+// the device plugin and those of the hook library go to the same memory.
+type sharedRegion struct {
+	path string
+	data []byte
+}
+
+// openRegion maps the header of the shared region at path. Regions the hook library
+// didn't initialize yet are nil, regions of an unknown layout fail.
+func openRegion(path string) (*sharedRegion, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < regionHeaderSize {
+		return nil, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(regionHeaderSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("map shared region %v: %v", path, err)
+	}
+	r := &sharedRegion{path: path, data: data}
+	switch flag := atomic.LoadInt32((*int32)(r.at(regionInitializedOffset))); flag {
+	case regionMagic:
+		return r, nil
+	case 0:
+		r.close()
+		return nil, nil
+	default:
+		r.close()
+		return nil, fmt.Errorf("shared region %v has the unknown layout %v, it isn't written to", path, flag)
+	}
+}
+
+func (r *sharedRegion) close() {
+	if err := syscall.Munmap(r.data); err != nil {
+		klog.Errorf("unmap shared region %v: %v", r.path, err)
+	}
+}
+
+func (r *sharedRegion) at(offset int64) unsafe.Pointer {
+	return unsafe.Pointer(&r.data[offset])
+}
+
+// lock takes the semaphore of the region the hook library takes while it reads or updates
+// the region. It polls rather than sleeping as a waiter, the hook library holds it briefly.
+func (r *sharedRegion) lock() error {
+	sem := (*uint64)(r.at(regionSemOffset))
+	deadline := time.Now().Add(regionLockTimeout)
+	for {
+		d := atomic.LoadUint64(sem)
+		if d&semValueMask > 0 {
+			if atomic.CompareAndSwapUint64(sem, d, d-1) {
+				return nil
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			owner := atomic.LoadUint32((*uint32)(r.at(regionOwnerPidOffset)))
+			return fmt.Errorf("shared region %v is locked by pid %v", r.path, owner)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// unlock releases the semaphore of the region and wakes a waiting hook library, if any.
+func (r *sharedRegion) unlock() {
+	sem := (*uint64)(r.at(regionSemOffset))
+	for {
+		d := atomic.LoadUint64(sem)
+		if !atomic.CompareAndSwapUint64(sem, d, d+1) {
+			continue
+		}
+		if d>>semNwaitersShift > 0 {
+			// shared futex, the hook library sleeps in another process
+			if _, _, errno := syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(sem)), futexWake, 1, 0, 0, 0); errno != 0 {
+				klog.Errorf("wake waiters of shared region %v: %v", r.path, errno)
+			}
+		}
+		return
+	}
+}
+
+// devices returns the UUIDs of the devices in the region in the order of its limits.
+func (r *sharedRegion) devices() ([]string, error) {
+	num := atomic.LoadUint64((*uint64)(r.at(regionNumOffset)))
+	if num > maxRegionDevices {
+		return nil, fmt.Errorf("shared region %v has %v devices", r.path, num)
+	}
+	var uuids []string
+	for i := int64(0); i < int64(num); i++ {
+		id := r.data[regionUUIDsOffset+i*96 : regionUUIDsOffset+(i+1)*96]
+		uuids = append(uuids, strings.TrimRight(string(id), "\x00"))
+	}
+	return uuids, nil
+}
+
+// set sets the value at offset to want and tells whether it changed.
+func (r *sharedRegion) set(offset int64, want uint64) bool {
+	return atomic.SwapUint64((*uint64)(r.at(offset)), want) != want
+}
+
+// updateRegion maps the shared region at path and calls update with the region locked
+// and the UUIDs of its devices. A region the hook library didn't initialize yet is left
+// alone.
+func updateRegion(path string, update func(r *sharedRegion, uuids []string)) error {
+	r, err := openRegion(path)
+	if err != nil || r == nil {
+		return err
+	}
+	defer r.close()
+	if err := r.lock(); err != nil {
+		return err
+	}
+	defer r.unlock()
+	uuids, err := r.devices()
+	if err != nil {
+		return err
+	}
+	update(r, uuids)
+	return nil
+}
+
+// regionLimit is the memory limit of usedmem MiB in the shared region, in bytes.
+func regionLimit(usedmem int32) uint64 {
+	return uint64(usedmem) << 20
+}
+
+// setRegionLimits sets the memory limits in the shared region at path to those of devs,
+// matched by UUID, and returns the devices whose limit changed, see updateRegion.
+func setRegionLimits(path string, devs util.ContainerDevices) (util.ContainerDevices, error) {
+	var changed util.ContainerDevices
+	err := updateRegion(path, func(r *sharedRegion, uuids []string) {
+		for i, uuid := range uuids {
+			for _, dev := range devs {
+				if dev.UUID != uuid {
+					continue
+				}
+				if r.set(regionLimitOffset+int64(i)*8, regionLimit(dev.Usedmem)) {
+					changed = append(changed, dev)
+				}
+				break
+			}
+		}
+	})
+	return changed, err
+}
+
+// setRegionCoreLimits sets the core limits in the shared region at path to cores, in
+// percent by device UUID, and returns the UUIDs whose limit changed. Devices missing in
+// cores keep their limit.
+func setRegionCoreLimits(path string, cores map[string]int32) ([]string, error) {
+	var changed []string
+	err := updateRegion(path, func(r *sharedRegion, uuids []string) {
+		for i, uuid := range uuids {
+			want, ok := cores[uuid]
+			if !ok {
+				continue
+			}
+			if r.set(regionSMLimitOffset+int64(i)*8, uint64(want)) {
+				changed = append(changed, uuid)
+			}
+		}
+	})
+	return changed, err
+}
+
+// LimitSyncer keeps the memory limits in the shared regions of the containers on this node
+// in line with the devices the scheduler assigned to their pods, which change when a pod
+// is resized in place. It also sets the core limits of the containers allowed to burst,
+// see allowedCores.
+type LimitSyncer struct {
+	root        string
+	nodeName    string
+	client      kubernetes.Interface
+	utilization func(uuid string) (uint, error)
+	now         func() time.Time
+}
+
+func NewLimitSyncer(nodeName string, client kubernetes.Interface) *LimitSyncer {
+	return &LimitSyncer{
+		root:        config.ContainerCacheRoot,
+		nodeName:    nodeName,
+		client:      client,
+		utilization: nvmlLib.Utilization,
+		now:         time.Now,
+	}
+}
+
+// Run syncs the limits every interval until stop is closed.
+func (l *LimitSyncer) Run(interval time.Duration, stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := l.sync(context.Background()); err != nil {
+			klog.Errorf("sync container memory limits: %v", err)
+		}
+	}, interval, stop)
+}
+
+func (l *LimitSyncer) sync(ctx context.Context) error {
+	entries, err := os.ReadDir(l.root)
+	if err != nil {
+		return err
+	}
+	pods, err := l.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + l.nodeName})
+	if err != nil {
+		return err
+	}
+	byUID := make(map[string]*corev1.Pod)
+	for i := range pods.Items {
+		byUID[string(pods.Items[i].UID)] = &pods.Items[i]
+	}
+	var tenants []*tenant
+	for _, e := range entries {
+		// directories are named <pod uid>_<container name> by Allocate
+		uid, ctr, ok := strings.Cut(e.Name(), "_")
+		if !e.IsDir() || !ok {
+			continue
+		}
+		pod, ok := byUID[uid]
+		if !ok {
+			continue
+		}
+		devs, ok := containerDevices(pod, ctr)
+		if !ok {
+			continue
+		}
+		files, err := currentRegions(filepath.Join(l.root, e.Name()))
+		if err != nil {
+			return err
+		}
+		tenants = append(tenants, &tenant{dir: e.Name(), pod: pod, ctr: ctr, devs: devs, regions: files})
+		for _, path := range files {
+			changed, err := setRegionLimits(path, devs)
+			if err != nil {
+				klog.Errorf("set memory limits of %v/%v %v: %v", pod.Namespace, pod.Name, ctr, err)
+				continue
+			}
+			for _, dev := range changed {
+				klog.Infof("memory limit of %v/%v %v on device %v set to %vm", pod.Namespace, pod.Name, ctr, dev.UUID, dev.Usedmem)
+			}
+		}
+		if changed, err := updateLimitConfig(filepath.Join(l.root, e.Name()), devs, allowsManagedMemory(pod)); err != nil {
+			klog.Errorf("update limit config of %v/%v %v: %v", pod.Namespace, pod.Name, ctr, err)
+		} else if changed {
+			klog.Infof("limit config of %v/%v %v updated", pod.Namespace, pod.Name, ctr)
+		}
+	}
+	l.syncBursts(tenants)
+	return nil
+}
+
+// containerDevices returns the devices assigned to the container named ctr.
+func containerDevices(pod *corev1.Pod, ctr string) (util.ContainerDevices, bool) {
+	pd, err := annotations.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+	if err != nil {
+		klog.V(4).Infof("pod %v/%v annotation %v: %v", pod.Namespace, pod.Name, util.AssignedIDsAnnotations, err)
+		return nil, false
+	}
+	for i, c := range pod.Spec.Containers {
+		if c.Name == ctr && i < len(pd) {
+			return pd[i], true
+		}
+	}
+	return nil, false
+}
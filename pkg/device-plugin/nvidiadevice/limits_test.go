@@ -0,0 +1,168 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// writeRegion writes a shared region as the hook library initializes it, unlocked.
+func writeRegion(t *testing.T, path string, limits map[string]uint64, order ...string) {
+	buf := make([]byte, unsafe.Sizeof(sharedRegionHeader{}))
+	binary.LittleEndian.PutUint32(buf[regionInitializedOffset:], regionMagic)
+	binary.LittleEndian.PutUint64(buf[regionSemOffset:], 1)
+	binary.LittleEndian.PutUint64(buf[regionNumOffset:], uint64(len(order)))
+	for i, uuid := range order {
+		copy(buf[regionUUIDsOffset+int64(i)*96:], uuid)
+		binary.LittleEndian.PutUint64(buf[regionLimitOffset+int64(i)*8:], limits[uuid])
+	}
+	assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	assert.NilError(t, os.WriteFile(path, buf, 0666))
+}
+
+func regionLimits(t *testing.T, path string) []uint64 {
+	buf, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	n := binary.LittleEndian.Uint64(buf[regionNumOffset:])
+	var res []uint64
+	for i := int64(0); i < int64(n); i++ {
+		res = append(res, binary.LittleEndian.Uint64(buf[regionLimitOffset+i*8:]))
+	}
+	return res
+}
+
+func TestLimitSyncer(t *testing.T) {
+	devs := util.PodDevices{{
+		{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 6000},
+		{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 2000},
+	}}
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: k8stypes.UID("uid1"), Annotations: map[string]string{
+			util.AssignedIDsAnnotations: annotations.EncodePodDevices(devs),
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	})
+	root := t.TempDir()
+	// the hook library orders devices its own way
+	region := filepath.Join(root, "uid1_c", "a.cache")
+	writeRegion(t, region, map[string]uint64{"GPU-0": 4000 << 20, "GPU-1": 2000 << 20}, "GPU-1", "GPU-0")
+	// regions of unknown pods and regions not initialized yet are left alone
+	unknown := filepath.Join(root, "uid2_c", "a.cache")
+	writeRegion(t, unknown, map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+	pending := filepath.Join(root, "uid1_c", "b.cache")
+	assert.NilError(t, os.WriteFile(pending, make([]byte, unsafe.Sizeof(sharedRegionHeader{})), 0666))
+
+	l := &LimitSyncer{root: root, nodeName: "node1", client: client}
+	assert.NilError(t, l.sync(context.Background()))
+	assert.DeepEqual(t, regionLimits(t, region), []uint64{2000 << 20, 6000 << 20})
+	assert.DeepEqual(t, regionLimits(t, unknown), []uint64{4000 << 20})
+	assert.DeepEqual(t, regionLimits(t, pending), []uint64(nil))
+
+	changed, err := setRegionLimits(region, devs[0])
+	assert.NilError(t, err)
+	assert.Equal(t, len(changed), 0)
+}
+
+func TestSetRegionLimitsLocksRegion(t *testing.T) {
+	oldTimeout := regionLockTimeout
+	t.Cleanup(func() { regionLockTimeout = oldTimeout })
+	regionLockTimeout = 10 * time.Millisecond
+	devs := util.ContainerDevices{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 6000}}
+	region := filepath.Join(t.TempDir(), "a.cache")
+	writeRegion(t, region, map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+	semaphore := func() uint64 {
+		buf, err := os.ReadFile(region)
+		assert.NilError(t, err)
+		return binary.LittleEndian.Uint64(buf[regionSemOffset:])
+	}
+	setSemaphore := func(value uint64) {
+		f, err := os.OpenFile(region, os.O_RDWR, 0)
+		assert.NilError(t, err)
+		defer f.Close()
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, value)
+		_, err = f.WriteAt(buf, regionSemOffset)
+		assert.NilError(t, err)
+	}
+
+	// the hook library holds the semaphore
+	setSemaphore(0)
+	_, err := setRegionLimits(region, devs)
+	assert.ErrorContains(t, err, "is locked")
+	assert.DeepEqual(t, regionLimits(t, region), []uint64{4000 << 20})
+
+	// released, the semaphore is given back after the update
+	setSemaphore(1)
+	changed, err := setRegionLimits(region, devs)
+	assert.NilError(t, err)
+	assert.Equal(t, len(changed), 1)
+	assert.DeepEqual(t, regionLimits(t, region), []uint64{6000 << 20})
+	assert.Equal(t, semaphore(), uint64(1))
+
+	// a region of another layout isn't written to
+	writeRegion(t, region, map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+	f, err := os.OpenFile(region, os.O_RDWR, 0)
+	assert.NilError(t, err)
+	_, err = f.WriteAt([]byte{1, 0, 0, 0}, regionInitializedOffset)
+	assert.NilError(t, err)
+	f.Close()
+	_, err = setRegionLimits(region, devs)
+	assert.ErrorContains(t, err, "unknown layout 1")
+	assert.DeepEqual(t, regionLimits(t, region), []uint64{4000 << 20})
+}
+
+func TestLimitSyncerSeparatesManagedMemoryBudget(t *testing.T) {
+	oldEnforcement, oldRatio := config.Enforcement, config.ManagedMemoryRatio
+	t.Cleanup(func() { config.Enforcement, config.ManagedMemoryRatio = oldEnforcement, oldRatio })
+	config.Enforcement, config.ManagedMemoryRatio = EnforcementHook, 2
+	devs := util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 3000}}}
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: k8stypes.UID("uid1"), Annotations: map[string]string{
+			util.AssignedIDsAnnotations:       annotations.EncodePodDevices(devs),
+			util.AllowManagedMemoryAnnotation: "true",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	})
+	root := t.TempDir()
+	region := filepath.Join(root, "uid1_c", "a.cache")
+	writeRegion(t, region, map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+	conf := filepath.Join(root, "uid1_c", limitConfigFile)
+	assert.NilError(t, os.WriteFile(conf, []byte("CUDA_DEVICE_MEMORY_LIMIT_0=4000m\nCUDA_MANAGED_MEMORY_LIMIT_0=8000m\n"), 0644))
+
+	// the device memory stays at the reservation, the budget for paging to host memory is apart
+	l := &LimitSyncer{root: root, nodeName: "node1", client: client}
+	assert.NilError(t, l.sync(context.Background()))
+	assert.DeepEqual(t, regionLimits(t, region), []uint64{3000 << 20})
+	data, err := os.ReadFile(conf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "CUDA_DEVICE_MEMORY_LIMIT_0=3000m\nCUDA_MANAGED_MEMORY_LIMIT_0=6000m\n")
+}
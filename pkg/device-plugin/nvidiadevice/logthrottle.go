@@ -0,0 +1,99 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// nvmlErrorLogInterval is how long identical NVML errors are coalesced into one line.
+const nvmlErrorLogInterval = 30 * time.Second
+
+// logThrottle logs a message at most once per interval. Repeats within the interval are
+// counted and reported with the next line of the message, or by flush once it passed, so
+// a failing driver doesn't fill the log with the same error every sample.
+type logThrottle struct {
+	interval time.Duration
+	now      func() time.Time
+	errorf   func(format string, args ...interface{})
+	warningf func(format string, args ...interface{})
+
+	mutex   sync.Mutex
+	entries map[string]*throttledEntry
+}
+
+type throttledEntry struct {
+	logf     func(format string, args ...interface{})
+	since    time.Time
+	repeated int
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{
+		interval: interval,
+		now:      time.Now,
+		errorf:   klog.Errorf,
+		warningf: klog.Warningf,
+		entries:  make(map[string]*throttledEntry),
+	}
+}
+
+func (t *logThrottle) Errorf(format string, args ...interface{}) {
+	t.log(t.errorf, fmt.Sprintf(format, args...))
+}
+
+func (t *logThrottle) Warningf(format string, args ...interface{}) {
+	t.log(t.warningf, fmt.Sprintf(format, args...))
+}
+
+func (t *logThrottle) log(logf func(format string, args ...interface{}), msg string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	e, ok := t.entries[msg]
+	if ok && now.Sub(e.since) < t.interval {
+		e.repeated++
+		return
+	}
+	if ok && e.repeated > 0 {
+		logf("%v (last error repeated %v times in %v)", msg, e.repeated, t.interval)
+	} else {
+		logf("%v", msg)
+	}
+	t.entries[msg] = &throttledEntry{logf: logf, since: now}
+}
+
+// flush reports the repeats of messages whose interval passed and forgets them, so the
+// next line of such a message is logged right away.
+func (t *logThrottle) flush() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	for msg, e := range t.entries {
+		if now.Sub(e.since) < t.interval {
+			continue
+		}
+		if e.repeated > 0 {
+			e.logf("%v (last error repeated %v times in %v)", msg, e.repeated, t.interval)
+		}
+		delete(t.entries, msg)
+	}
+}
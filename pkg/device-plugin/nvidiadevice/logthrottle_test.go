@@ -0,0 +1,62 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLogThrottleCoalescesRepeats(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var lines []string
+	l := newLogThrottle(30 * time.Second)
+	l.now = func() time.Time { return now }
+	l.errorf = func(format string, args ...interface{}) { lines = append(lines, "E "+fmt.Sprintf(format, args...)) }
+	l.warningf = func(format string, args ...interface{}) { lines = append(lines, "W "+fmt.Sprintf(format, args...)) }
+
+	for i := 0; i < 5; i++ {
+		l.Errorf("query device %v: %v", "GPU-0", "Unknown Error")
+		l.Warningf("implausible memory of %v", "GPU-1")
+		now = now.Add(time.Second)
+	}
+	l.Errorf("query device %v: %v", "GPU-1", "Unknown Error")
+	l.flush()
+	assert.DeepEqual(t, lines, []string{
+		"E query device GPU-0: Unknown Error",
+		"W implausible memory of GPU-1",
+		"E query device GPU-1: Unknown Error",
+	})
+
+	// the next line after the interval carries the count
+	now = now.Add(25 * time.Second)
+	l.Errorf("query device %v: %v", "GPU-0", "Unknown Error")
+	assert.Equal(t, lines[3], "E query device GPU-0: Unknown Error (last error repeated 4 times in 30s)")
+
+	// without one, flush reports it
+	now = now.Add(time.Second)
+	l.flush()
+	assert.DeepEqual(t, lines[4:], []string{"W implausible memory of GPU-1 (last error repeated 4 times in 30s)"})
+	now = now.Add(30 * time.Second)
+	l.flush()
+	assert.Equal(t, len(lines), 5)
+	l.Warningf("implausible memory of %v", "GPU-1")
+	assert.Equal(t, lines[5], "W implausible memory of GPU-1")
+}
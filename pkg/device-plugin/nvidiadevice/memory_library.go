@@ -0,0 +1,72 @@
+//go:build !nogpu
+
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+// #include <stdlib.h>
+//
+// typedef struct nvmlDevice_st *nvmlDevice_t;
+//
+// typedef struct {
+// 	unsigned int version;
+// 	unsigned long long total;
+// 	unsigned long long reserved;
+// 	unsigned long long free;
+// 	unsigned long long used;
+// } nvmlMemory_v2_t;
+//
+// // The NVML bindings only wrap nvmlDeviceGetMemoryInfo, see symbol_library.go.
+// extern void *nvml_symbol(const char *name);
+//
+// // nvml_memory_v2 reads the memory of the GPU with uuid, or with index if uuid is NULL.
+// // It returns -1 if NVML isn't loaded or the driver predates nvmlDeviceGetMemoryInfo_v2.
+// static int nvml_memory_v2(const char *uuid, unsigned int index, nvmlMemory_v2_t *mem) {
+// 	int (*by_uuid)(const char *, nvmlDevice_t *) = nvml_symbol("nvmlDeviceGetHandleByUUID");
+// 	int (*by_index)(unsigned int, nvmlDevice_t *) = nvml_symbol("nvmlDeviceGetHandleByIndex_v2");
+// 	int (*get)(nvmlDevice_t, nvmlMemory_v2_t *) = nvml_symbol("nvmlDeviceGetMemoryInfo_v2");
+// 	if (by_uuid == NULL || by_index == NULL || get == NULL)
+// 		return -1;
+// 	nvmlDevice_t dev;
+// 	int ret = uuid == NULL ? by_index(index, &dev) : by_uuid(uuid, &dev);
+// 	if (ret != 0)
+// 		return ret;
+// 	mem->version = (unsigned int)(sizeof(nvmlMemory_v2_t) | 2 << 24);
+// 	return get(dev, mem);
+// }
+import "C"
+
+import "unsafe"
+
+// nvmlMemoryInfo returns the total and the reserved memory in bytes NVML measures on the
+// GPU with the device ID. The total leaves out ECC overhead and remapped rows, reserved is
+// what the driver and the firmware keep of it.
+func nvmlMemoryInfo(id string) (total, reserved uint64, err error) {
+	var mem C.nvmlMemory_v2_t
+	var ret C.int
+	if index, ok := compositeIndex(id); ok {
+		ret = C.nvml_memory_v2(nil, C.uint(index), &mem)
+	} else {
+		cuuid := C.CString(id)
+		defer C.free(unsafe.Pointer(cuuid))
+		ret = C.nvml_memory_v2(cuuid, 0, &mem)
+	}
+	if ret != 0 {
+		return 0, 0, nvmlError(ret)
+	}
+	return uint64(mem.total), uint64(mem.reserved), nil
+}
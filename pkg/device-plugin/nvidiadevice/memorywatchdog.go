@@ -0,0 +1,176 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// memoryBudget is the device memory a container was assigned on a GPU.
+type memoryBudget struct {
+	pod *corev1.Pod
+	ctr string
+	// limit is in MiB
+	limit int32
+}
+
+// MemoryWatchdog enforces the memory limits of containers in cgroup mode, where no hook
+// library keeps their allocations within the limit. It sums up the device memory NVML
+// reports for the processes of each container and kills those of a container holding
+// more than it was assigned, so a co-tenant of the GPU doesn't run out of memory.
+// Core limits stay unenforced in this mode.
+type MemoryWatchdog struct {
+	nodeName string
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	lib      NVML
+	procRoot string
+	kill     func(pid int) error
+}
+
+func NewMemoryWatchdog(nodeName string, client kubernetes.Interface) *MemoryWatchdog {
+	return &MemoryWatchdog{
+		nodeName: nodeName,
+		client:   client,
+		recorder: NewEventRecorder(nodeName, client),
+		lib:      nvmlLib,
+		procRoot: "/proc",
+		kill: func(pid int) error {
+			return syscall.Kill(pid, syscall.SIGKILL)
+		},
+	}
+}
+
+// Run checks the containers of the node every interval until stop is closed.
+func (w *MemoryWatchdog) Run(interval time.Duration, stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := w.Check(); err != nil {
+			klog.Errorf("check memory limits: %v", err)
+		}
+	}, interval, stop)
+}
+
+// Check kills the processes of each container using more device memory on a GPU than it
+// was assigned there, and reports it in a GPUMemoryLimitExceeded event on the pod.
+// Containers of pods with whole GPUs in util.GPUModeExclusive have no limit to exceed.
+func (w *MemoryWatchdog) Check() error {
+	pods, err := nodePods(w.client, w.nodeName)
+	if err != nil {
+		return err
+	}
+	budgets := make(map[string]map[string]memoryBudget)
+	for uid, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning || util.PodGPUMode(pod) == util.GPUModeExclusive {
+			continue
+		}
+		pd, err := annotations.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+		if err != nil {
+			klog.V(4).Infof("pod %v/%v annotation %v: %v", pod.Namespace, pod.Name, util.AssignedIDsAnnotations, err)
+			continue
+		}
+		for i, devs := range pd {
+			if i >= len(pod.Spec.Containers) {
+				break
+			}
+			ctr := pod.Spec.Containers[i].Name
+			for _, dev := range devs {
+				if budgets[dev.UUID] == nil {
+					budgets[dev.UUID] = make(map[string]memoryBudget)
+				}
+				budgets[dev.UUID][uid+"_"+ctr] = memoryBudget{pod: pod, ctr: ctr, limit: dev.Usedmem}
+			}
+		}
+	}
+	uuids := make([]string, 0, len(budgets))
+	for uuid := range budgets {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		w.checkDevice(uuid, budgets[uuid], pods)
+	}
+	return nil
+}
+
+// checkDevice holds the containers on the GPU with uuid to their budgets.
+func (w *MemoryWatchdog) checkDevice(uuid string, budgets map[string]memoryBudget, pods map[string]*corev1.Pod) {
+	procs, err := w.lib.Processes(uuid)
+	if err != nil {
+		klog.Warningf("list processes of %v: %v", uuid, err)
+		return
+	}
+	used := make(map[string][]ProcessInfo)
+	var keys []string
+	for _, p := range procs {
+		uid, id := processCgroup(w.procRoot, p.PID)
+		key := uid + "_" + containerName(pods[uid], id)
+		if _, ok := budgets[key]; !ok {
+			continue
+		}
+		if used[key] == nil {
+			keys = append(keys, key)
+		}
+		used[key] = append(used[key], p)
+	}
+	for _, key := range keys {
+		var sum uint64
+		for _, p := range used[key] {
+			sum += p.MemoryUsed
+		}
+		b := budgets[key]
+		if sum <= uint64(b.limit) {
+			continue
+		}
+		msg := fmt.Sprintf("container %v uses %vm of device %v, more than its %vm, %v",
+			b.ctr, sum, uuid, b.limit, w.reap(used[key]))
+		klog.Warningf("pod %v/%v: %v", b.pod.Namespace, b.pod.Name, msg)
+		w.recorder.Eventf(b.pod, corev1.EventTypeWarning, "GPUMemoryLimitExceeded", msg)
+	}
+}
+
+// reap kills the processes and tells which it did.
+func (w *MemoryWatchdog) reap(procs []ProcessInfo) string {
+	var killed, failed []string
+	for _, p := range procs {
+		if err := w.kill(int(p.PID)); err != nil {
+			klog.Errorf("kill process %v: %v", p.PID, err)
+			failed = append(failed, fmt.Sprint(p.PID))
+			continue
+		}
+		killed = append(killed, fmt.Sprint(p.PID))
+	}
+	res := fmt.Sprintf("killed %v", strings.Join(killed, " "))
+	if len(killed) == 0 {
+		res = "killed none"
+	}
+	if len(failed) > 0 {
+		res += fmt.Sprintf(", failed to kill %v", strings.Join(failed, " "))
+	}
+	return res
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestMemoryWatchdog(t *testing.T) {
+	const trainID = "4e5f6a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091"
+	const evalID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	root := t.TempDir()
+	cgroup := "0::/kubepods.slice/kubepods-pod" + strings.ReplaceAll(vgpuPodUID, "-", "_") + ".slice/cri-containerd-"
+	// 1 and 2 run in train, 3 in eval, 4 on the host
+	writeCgroup(t, root, 1, cgroup+trainID+".scope\n")
+	writeCgroup(t, root, 2, cgroup+trainID+".scope\n")
+	writeCgroup(t, root, 3, cgroup+evalID+".scope\n")
+	writeCgroup(t, root, 4, "0::/system.slice/thumbnailer.service\n")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job", UID: types.UID(vgpuPodUID), Annotations: map[string]string{
+			util.AssignedIDsAnnotations: annotations.EncodePodDevices(util.PodDevices{
+				{{UUID: "GPU-0", Type: "NVIDIA", Usedmem: 4000, Usedcores: 30}},
+				{{UUID: "GPU-0", Type: "NVIDIA", Usedmem: 2000, Usedcores: 30}},
+			}),
+		}},
+		Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "train"}, {Name: "eval"}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "train", ContainerID: "containerd://" + trainID},
+			{Name: "eval", ContainerID: "containerd://" + evalID},
+		}},
+	}
+	lib := &leakNVML{procs: []ProcessInfo{{PID: 1, MemoryUsed: 3000}, {PID: 2, MemoryUsed: 1500}, {PID: 3, MemoryUsed: 1000}, {PID: 4, MemoryUsed: 9000}}}
+	var killed []int
+	recorder := record.NewFakeRecorder(8)
+	w := &MemoryWatchdog{nodeName: "node1", client: fake.NewSimpleClientset(pod), recorder: recorder, lib: lib, procRoot: root, kill: func(pid int) error {
+		killed = append(killed, pid)
+		return nil
+	}}
+
+	assert.NilError(t, w.Check())
+	assert.DeepEqual(t, killed, []int{1, 2})
+	assert.Equal(t, <-recorder.Events, "Warning GPUMemoryLimitExceeded container train uses 4500m of device GPU-0, more than its 4000m, killed 1 2")
+	assert.Equal(t, len(recorder.Events), 0)
+
+	// containers within their limits are left alone
+	killed = nil
+	lib.procs = lib.procs[2:]
+	assert.NilError(t, w.Check())
+	assert.Assert(t, killed == nil)
+	assert.Equal(t, len(recorder.Events), 0)
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// ListAndWatchDisconnects counts ListAndWatch streams to kubelet lost without the plugin stopping.
+	ListAndWatchDisconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vgpu_device_plugin_listandwatch_disconnects_total",
+			Help: "Number of ListAndWatch streams to kubelet lost unexpectedly",
+		},
+		[]string{"resource"},
+	)
+	// LastActivity is the time since the last kernel launch reported by the heartbeat of a container.
+	LastActivity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_last_activity_seconds",
+			Help: "Seconds since the last successful kernel launch of a container, from its hook heartbeat",
+		},
+		[]string{"namespace", "pod", "container"},
+	)
+	// AllocatedBytes is the device memory a container allocated, from its hook heartbeat.
+	AllocatedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_container_allocated_bytes",
+			Help: "Device memory allocated by a container, from its hook heartbeat",
+		},
+		[]string{"namespace", "pod", "container"},
+	)
+	// ExternalMemoryBytes is the device memory used outside vGPU accounting, from the node
+	// annotation or measured, that is taken out of the registered memory.
+	ExternalMemoryBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_device_external_memory_bytes",
+			Help: "Device memory used by processes outside vGPU accounting, by source: annotation or measured",
+		},
+		[]string{"deviceuuid", "source"},
+	)
+	// NVMLQueryTimeouts counts NVML queries of the device sampler that took longer than
+	// config.NVMLQueryTimeout.
+	NVMLQueryTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vgpu_nvml_query_timeouts_total",
+			Help: "Number of NVML device queries that timed out",
+		},
+		[]string{"deviceuuid"},
+	)
+	// NVMLEnumerationTimeouts counts enumerations of the devices by Refresh that took longer
+	// than config.NVMLQueryTimeout.
+	NVMLEnumerationTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "vgpu_nvml_enumeration_timeouts_total",
+			Help: "Number of NVML device enumerations that timed out",
+		},
+	)
+	// AllocateDuration is how long the phases of Allocate calls took, see allocateTiming.
+	AllocateDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "vgpu_allocate_duration_seconds",
+			Help:    "Time Allocate calls took by phase: lookup, select, limits, response or total",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		},
+		[]string{"phase"},
+	)
+	// DeviceContexts is the number of processes using a GPU as of its last NVML sample.
+	DeviceContexts = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_device_contexts",
+			Help: "Number of processes, each with a CUDA context, NVML listed on a GPU in its last sample",
+		},
+		[]string{"deviceuuid"},
+	)
+	// DeviceTemperature is the temperature of a GPU as of its last NVML sample.
+	DeviceTemperature = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_device_temperature_celsius",
+			Help: "Temperature of a GPU in its last NVML sample",
+		},
+		[]string{"deviceuuid"},
+	)
+	// SMSeconds is the kernel time of a container on its GPUs, from its heartbeat or NVML accounting.
+	SMSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vgpu_container_sm_seconds_total",
+			Help: "Seconds the kernels of a container ran on its GPUs, from its hook heartbeat or NVML accounting",
+		},
+		[]string{"namespace", "pod", "container"},
+	)
+	// SMUtilization is the share of its GPUs a container kept busy over the recent check-ins.
+	SMUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_container_sm_utilization",
+			Help: "Kernel time of a container over the recent check-ins divided by their span, 1 is one GPU kept busy",
+		},
+		[]string{"namespace", "pod", "container"},
+	)
+	// PeakMemoryBytes is the most device memory a container held over the recent check-ins.
+	PeakMemoryBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_container_peak_memory_bytes",
+			Help: "Most device memory a container held over the recent check-ins",
+		},
+		[]string{"namespace", "pod", "container"},
+	)
+	// LegacyDevices counts the GPUs pods of the stock device plugin held since the plugin
+	// started, by migration state: held, releasing or released.
+	LegacyDevices = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vgpu_legacy_devices",
+			Help: "Number of GPUs held by pods of the stock device plugin, by state: held, releasing once their processes exited, or released into the pool",
+		},
+		[]string{"state"},
+	)
+	// DrainMigrationPods is the number of vGPU pods left on the node while they are
+	// evicted from it for maintenance, see DrainMigrator.
+	DrainMigrationPods = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "vgpu_drain_migration_pods_remaining",
+			Help: "Number of vGPU pods left on the cordoned node to evict with --drain-migrate",
+		},
+	)
+)
+
+// Metrics returns the collectors above so binaries can add them to their registry.
+func Metrics() []prometheus.Collector {
+	return []prometheus.Collector{ListAndWatchDisconnects, LastActivity, AllocatedBytes, ExternalMemoryBytes, NVMLQueryTimeouts, NVMLEnumerationTimeouts, AllocateDuration,
+		DeviceContexts, DeviceTemperature, SMSeconds, SMUtilization, PeakMemoryBytes, LegacyDevices, DrainMigrationPods}
+}
+
+// ExportDeviceMetrics sets the gauges of the GPUs from the snapshots d publishes until d
+// stops, the gauges of GPUs removed by a refresh are deleted.
+func ExportDeviceMetrics(d *DeviceCache) {
+	events, cancel := d.Watch()
+	defer cancel()
+	exported := make(map[string]bool)
+	update := func(s *DeviceSnapshot) {
+		if s == nil {
+			return
+		}
+		for id, sample := range s.Samples {
+			DeviceContexts.WithLabelValues(id).Set(float64(sample.Contexts))
+			DeviceTemperature.WithLabelValues(id).Set(float64(sample.Temperature))
+			exported[id] = true
+		}
+		for id := range exported {
+			if _, ok := s.Samples[id]; !ok {
+				DeviceContexts.DeleteLabelValues(id)
+				DeviceTemperature.DeleteLabelValues(id)
+				delete(exported, id)
+			}
+		}
+	}
+	update(d.Snapshot())
+	for {
+		select {
+		case <-d.Done():
+			return
+		case ev := <-events:
+			update(ev.Snapshot)
+		}
+	}
+}
@@ -1,4 +1,7 @@
 // Copyright (c) 2021, NVIDIA CORPORATION. All rights reserved.
+
+//go:build !nogpu
+
 package nvidiadevice
 
 import (
@@ -223,3 +226,64 @@ func GetMigDeviceNodePaths(parent *nvml.Device, mig *nvml.Device) ([]string, err
 
 	return devicePaths, nil
 }
+
+// MigResourceMatcher tells which resource a MIG device is served as, the MIG strategies
+// other than none implement it.
+type MigResourceMatcher interface {
+	MatchesResource(mig *nvml.Device, resource string) bool
+}
+
+// MigDeviceManager implements the ResourceManager interface for MIG devices
+type MigDeviceManager struct {
+	strategy MigResourceMatcher
+	resource string
+}
+
+// NewMigDeviceManager returns a reference to a new MigDeviceManager
+func NewMigDeviceManager(strategy MigResourceMatcher, resource string) *MigDeviceManager {
+	return &MigDeviceManager{
+		strategy: strategy,
+		resource: resource,
+	}
+}
+
+// Devices returns a list of devices from the MigDeviceManager
+func (m *MigDeviceManager) Devices() []*Device {
+	n, err := nvml.GetDeviceCount()
+	check(err)
+
+	var devs []*Device
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDeviceLite(i)
+		check(err)
+
+		migEnabled, err := d.IsMigEnabled()
+		check(err)
+
+		if !migEnabled {
+			continue
+		}
+
+		migs, err := d.GetMigDevices()
+		check(err)
+
+		for j, mig := range migs {
+			if !m.strategy.MatchesResource(mig, m.resource) {
+				continue
+			}
+
+			paths, err := GetMigDeviceNodePaths(d, mig)
+			check(err)
+
+			dev := &NVMLDevice{UUID: mig.UUID, Memory: *mig.Memory, CPUAffinity: mig.CPUAffinity}
+			devs = append(devs, buildDevice(dev, paths, fmt.Sprintf("%v:%v", i, j)))
+		}
+	}
+
+	return devs
+}
+
+// CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
+func (m *MigDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+	checkHealth(stop, devices, unhealthy)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// What a device plugin does when another one holds the lock of the node, see --on-lock-conflict.
+const (
+	LockConflictExit = "exit"
+	LockConflictWait = "wait"
+)
+
+// ErrNodeLocked is returned by TryNodeLock while another device plugin holds the lock.
+var ErrNodeLocked = errors.New("another device plugin holds the node lock")
+
+// ValidateLockConflict checks the --on-lock-conflict policy.
+func ValidateLockConflict(policy string) error {
+	switch policy {
+	case LockConflictExit, LockConflictWait:
+		return nil
+	}
+	return fmt.Errorf("unknown lock conflict policy %q, want %q or %q", policy, LockConflictExit, LockConflictWait)
+}
+
+// NodeLock is an exclusive flock on a file, held by the one device plugin of a node that
+// serves the runtime socket and registers with kubelet. Two of them, e.g. during a botched
+// update of the DaemonSet, would both write the container cache directories.
+type NodeLock struct {
+	file *os.File
+}
+
+// TryNodeLock takes the lock on path without waiting. It returns an error wrapping
+// ErrNodeLocked with the pid and host of the holder while another process, or another
+// NodeLock of this process, holds it. The lock is released when the process exits.
+func TryNodeLock(path string) (*NodeLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("lock %v: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("lock %v: %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder, _ := os.ReadFile(path)
+			return nil, fmt.Errorf("%w %v: held by %v", ErrNodeLocked, path, strings.TrimSpace(string(holder)))
+		}
+		return nil, fmt.Errorf("lock %v: %v", path, err)
+	}
+	// tell whoever finds the lock held who holds it
+	host, _ := os.Hostname()
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(fmt.Sprintf("pid %v on %v\n", os.Getpid(), host)), 0)
+	}
+	return &NodeLock{file: f}, nil
+}
+
+// Release gives up the lock.
+func (l *NodeLock) Release() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestNodeLockIsExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vgpu", "device-plugin.lock")
+	first, err := TryNodeLock(path)
+	assert.NilError(t, err)
+
+	_, err = TryNodeLock(path)
+	assert.Assert(t, errors.Is(err, ErrNodeLocked), err)
+	assert.ErrorContains(t, err, "held by pid")
+
+	assert.NilError(t, first.Release())
+	second, err := TryNodeLock(path)
+	assert.NilError(t, err)
+	assert.NilError(t, second.Release())
+}
+
+func TestValidateLockConflict(t *testing.T) {
+	assert.NilError(t, ValidateLockConflict(LockConflictExit))
+	assert.NilError(t, ValidateLockConflict(LockConflictWait))
+	assert.ErrorContains(t, ValidateLockConflict("ignore"), "unknown lock conflict policy")
+}
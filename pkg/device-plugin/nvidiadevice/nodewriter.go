@@ -0,0 +1,134 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+)
+
+// NodeWriter makes the writes of the device register to its node. The annotations and
+// labels set between two flushes go out in one patch, leaving out those whose content
+// hash matches what was written last, and the reports are spaced by config.NodeUpdateQPS,
+// so hundreds of nodes don't keep the API server busy with patches that change nothing.
+type NodeWriter struct {
+	node    string
+	limiter flowcontrol.RateLimiter
+
+	mutex       sync.Mutex
+	annotations map[string]string
+	labels      map[string]string
+	// writtenAnnotations and writtenLabels hold the content hash of the values last written
+	writtenAnnotations map[string]uint64
+	writtenLabels      map[string]uint64
+}
+
+func NewNodeWriter(node string) *NodeWriter {
+	return &NodeWriter{
+		node:               node,
+		limiter:            flowcontrol.NewTokenBucketRateLimiter(float32(config.NodeUpdateQPS), 1),
+		annotations:        make(map[string]string),
+		labels:             make(map[string]string),
+		writtenAnnotations: make(map[string]uint64),
+		writtenLabels:      make(map[string]uint64),
+	}
+}
+
+func contentHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+// Wait blocks until the next report is allowed by config.NodeUpdateQPS or ctx is done.
+func (w *NodeWriter) Wait(ctx context.Context) error {
+	return w.limiter.Wait(ctx)
+}
+
+// Set queues annotations and labels for the next flush, replacing the values queued for
+// the same keys before.
+func (w *NodeWriter) Set(annotations, labels map[string]string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for k, v := range annotations {
+		w.annotations[k] = v
+	}
+	for k, v := range labels {
+		w.labels[k] = v
+	}
+}
+
+// Observe forgets the hashes of the values node doesn't have anymore, e.g. an annotation
+// someone else removed or changed, so the next flush writes them again.
+func (w *NodeWriter) Observe(node *corev1.Node) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	forget := func(written map[string]uint64, values map[string]string) {
+		for k, h := range written {
+			if v, ok := values[k]; !ok || contentHash(v) != h {
+				delete(written, k)
+			}
+		}
+	}
+	forget(w.writtenAnnotations, node.Annotations)
+	forget(w.writtenLabels, node.Labels)
+}
+
+// Flush writes the queued values that changed since they were written last in one patch.
+// It returns whether it patched the node, the values stay queued if the patch failed.
+func (w *NodeWriter) Flush(ctx context.Context) (bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	changed := func(values map[string]string, written map[string]uint64) map[string]string {
+		var res map[string]string
+		for k, v := range values {
+			if h, ok := written[k]; ok && h == contentHash(v) {
+				continue
+			}
+			if res == nil {
+				res = make(map[string]string)
+			}
+			res[k] = v
+		}
+		return res
+	}
+	annotations, labels := changed(w.annotations, w.writtenAnnotations), changed(w.labels, w.writtenLabels)
+	if len(annotations) == 0 && len(labels) == 0 {
+		klog.V(4).Infof("node %v unchanged, not patched", w.node)
+		return false, nil
+	}
+	if err := util.PatchNodeMetadataWithContext(ctx, w.node, annotations, labels); err != nil {
+		return false, err
+	}
+	for k, v := range annotations {
+		w.writtenAnnotations[k] = contentHash(v)
+	}
+	for k, v := range labels {
+		w.writtenLabels[k] = contentHash(v)
+	}
+	w.annotations = make(map[string]string)
+	w.labels = make(map[string]string)
+	return true, nil
+}
@@ -24,7 +24,6 @@ import (
 	"strings"
 
 	"4pd.io/k8s-vgpu/pkg/util"
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -40,6 +39,9 @@ type Device struct {
 	Paths  []string
 	Index  string
 	Memory uint64
+	// Links is the level of the link to each other GPU by its device ID, see
+	// annotations.DeviceLink
+	Links map[string]int32
 }
 
 // ResourceManager provides an interface for listing a set of Devices and checking health on them
@@ -53,12 +55,6 @@ type GpuDeviceManager struct {
 	skipMigEnabledGPUs bool
 }
 
-// MigDeviceManager implements the ResourceManager interface for MIG devices
-type MigDeviceManager struct {
-	strategy MigStrategy
-	resource string
-}
-
 func check(err error) {
 	if err != nil {
 		log.Panicln("Fatal:", err)
@@ -72,92 +68,94 @@ func NewGpuDeviceManager(skipMigEnabledGPUs bool) *GpuDeviceManager {
 	}
 }
 
-// NewMigDeviceManager returns a reference to a new MigDeviceManager
-func NewMigDeviceManager(strategy MigStrategy, resource string) *MigDeviceManager {
-	return &MigDeviceManager{
-		strategy: strategy,
-		resource: resource,
-	}
-}
-
 // Devices returns a list of devices from the GpuDeviceManager
 func (g *GpuDeviceManager) Devices() []*Device {
-	n, err := nvml.GetDeviceCount()
+	n, err := nvmlLib.DeviceCount()
 	check(err)
 	if n > util.DeviceLimit {
 		n = util.DeviceLimit
 	}
 
-	var devs []*Device
+	var nvdevs []*NVMLDevice
+	var indices []uint
 	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDevice(i)
-		check(err)
-
-		migEnabled, err := d.IsMigEnabled()
+		d, err := nvmlLib.Device(i)
 		check(err)
 
-		if migEnabled && g.skipMigEnabledGPUs {
+		if d.MigEnabled && g.skipMigEnabledGPUs {
 			continue
 		}
-
-		devs = append(devs, buildDevice(d, []string{d.Path}, fmt.Sprintf("%v", i)))
+		nvdevs = append(nvdevs, d)
+		indices = append(indices, i)
 	}
 
-	return devs
-}
-
-// Devices returns a list of devices from the MigDeviceManager
-func (m *MigDeviceManager) Devices() []*Device {
-	n, err := nvml.GetDeviceCount()
-	check(err)
-
 	var devs []*Device
-	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDeviceLite(i)
-		check(err)
-
-		migEnabled, err := d.IsMigEnabled()
-		check(err)
-
-		if !migEnabled {
-			continue
+	ids := uniqueDeviceIDs(nvdevs, indices)
+	byBusID := make(map[string]string, len(ids))
+	for i, id := range ids {
+		dev := buildDevice(nvdevs[i], []string{nvdevs[i].Path}, fmt.Sprintf("%v", indices[i]))
+		dev.ID = id
+		devs = append(devs, dev)
+		if nvdevs[i].BusID != "" {
+			byBusID[nvdevs[i].BusID] = id
 		}
-
-		migs, err := d.GetMigDevices()
-		check(err)
-
-		for j, mig := range migs {
-			if !m.strategy.MatchesResource(mig, m.resource) {
-				continue
+	}
+	for i, dev := range devs {
+		for busID, level := range nvdevs[i].Links {
+			if peer, ok := byBusID[busID]; ok {
+				if dev.Links == nil {
+					dev.Links = make(map[string]int32)
+				}
+				dev.Links[peer] = level
 			}
-
-			paths, err := GetMigDeviceNodePaths(d, mig)
-			check(err)
-
-			devs = append(devs, buildDevice(mig, paths, fmt.Sprintf("%v:%v", i, j)))
 		}
 	}
-
 	return devs
 }
 
-// CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
-func (g *GpuDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
-	checkHealth(stop, devices, unhealthy)
+// uniqueDeviceIDs returns the IDs the GPUs with the NVML indices are tracked by. These are
+// their UUIDs, unless NVML reports an empty UUID or the same UUID for several GPUs, as on
+// some vGPU and SR-IOV hosts, which would merge their accounting. Such GPUs get composite
+// IDs with their PCI bus id instead, and are looked up by their index.
+func uniqueDeviceIDs(devs []*NVMLDevice, indices []uint) []string {
+	count := make(map[string]int)
+	for _, d := range devs {
+		count[d.UUID]++
+	}
+	ids := make([]string, len(devs))
+	compositeDevices.Lock()
+	defer compositeDevices.Unlock()
+	for i, d := range devs {
+		if d.UUID != "" && count[d.UUID] == 1 {
+			ids[i] = d.UUID
+			continue
+		}
+		ids[i] = compositeDeviceID(d.UUID, d.BusID)
+		if d.BusID == "" {
+			ids[i] = compositeDeviceID(d.UUID, fmt.Sprintf("index%d", indices[i]))
+		}
+		compositeDevices.index[ids[i]] = indices[i]
+		if d.UUID == "" {
+			log.Printf("Warning: NVML reports no UUID for the GPU %d, tracking it as %v", indices[i], ids[i])
+		} else {
+			log.Printf("Warning: NVML reports the UUID %v for %d GPUs, tracking the GPU %d as %v", d.UUID, count[d.UUID], indices[i], ids[i])
+		}
+	}
+	return ids
 }
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
-func (m *MigDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+func (g *GpuDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
 	checkHealth(stop, devices, unhealthy)
 }
 
-func buildDevice(d *nvml.Device, paths []string, index string) *Device {
+func buildDevice(d *NVMLDevice, paths []string, index string) *Device {
 	dev := Device{}
 	dev.ID = d.UUID
 	dev.Health = pluginapi.Healthy
 	dev.Paths = paths
 	dev.Index = index
-	dev.Memory = *d.Memory
+	dev.Memory = d.Memory
 	if d.CPUAffinity != nil {
 		dev.Topology = &pluginapi.TopologyInfo{
 			Nodes: []*pluginapi.NUMANode{
@@ -170,6 +168,20 @@ func buildDevice(d *nvml.Device, paths []string, index string) *Device {
 	return &dev
 }
 
+// parseDeviceID returns the GPU of the device with the given UUID and, for MIG devices,
+// its GPU and compute instance. The GPU of a composite device ID is the UUID NVML reports.
+func parseDeviceID(id string) (string, uint, uint) {
+	// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
+	// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
+	if strings.HasPrefix(id, "MIG-") {
+		if gpu, gi, ci, err := parseMigDeviceUUID(id); err == nil {
+			return gpu, gi, ci
+		}
+	}
+	gpu, _ := splitDeviceID(id)
+	return gpu, 0xFFFFFFFF, 0xFFFFFFFF
+}
+
 func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
 	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
 	if disableHealthChecks == "all" {
@@ -179,46 +191,50 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		return
 	}
 
-	eventSet := nvml.NewEventSet()
-	defer nvml.DeleteEventSet(eventSet)
-
+	// GPUs sharing a UUID are marked unhealthy together, as their Xids can't be told apart
+	gpus := make([]string, 0, len(devices))
+	seen := make(map[string]bool)
 	for _, d := range devices {
-		gpu, _, _, err := nvml.ParseMigDeviceUUID(d.ID)
-		if err != nil {
-			gpu = d.ID
-		}
-
-		err = nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, gpu)
-		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
-			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", d.ID, err)
-			unhealthy <- d
+		gpu, _, _ := parseDeviceID(d.ID)
+		if gpu == "" {
+			log.Printf("Warning: %s has no UUID to watch Xids of, it isn't health checked", d.ID)
 			continue
 		}
-		check(err)
+		if !seen[gpu] {
+			seen[gpu] = true
+			gpus = append(gpus, gpu)
+		}
+	}
+	events := make(chan XidEvent)
+	unsupported, err := nvmlLib.WatchXids(stop, gpus, events)
+	check(err)
+	for _, gpu := range unsupported {
+		for _, d := range devices {
+			if id, _, _ := parseDeviceID(d.ID); id == gpu {
+				log.Printf("Warning: %s is too old to support healthchecking. Marking it unhealthy.", d.ID)
+				unhealthy <- d
+			}
+		}
 	}
 
 	for {
+		var e XidEvent
 		select {
 		case <-stop:
 			return
-		default:
-		}
-
-		e, err := nvml.WaitForEvent(eventSet, 5000)
-		if err != nil && e.Etype != nvml.XidCriticalError {
-			continue
+		case e = <-events:
 		}
 
 		// FIXME: formalize the full list and document it.
 		// http://docs.nvidia.com/deploy/xid-errors/index.html#topic_4
 		// Application errors: the GPU should still be healthy
-		if e.Edata == 31 || e.Edata == 43 || e.Edata == 45 {
+		if e.Xid == 31 || e.Xid == 43 || e.Xid == 45 {
 			continue
 		}
 
-		if e.UUID == nil || len(*e.UUID) == 0 {
+		if len(e.UUID) == 0 {
 			// All devices are unhealthy
-			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Edata)
+			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Xid)
 			for _, d := range devices {
 				unhealthy <- d
 			}
@@ -226,17 +242,9 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		}
 
 		for _, d := range devices {
-			// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
-			// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
-			gpu, gi, ci, err := nvml.ParseMigDeviceUUID(d.ID)
-			if err != nil {
-				gpu = d.ID
-				gi = 0xFFFFFFFF
-				ci = 0xFFFFFFFF
-			}
-
-			if gpu == *e.UUID && gi == *e.GpuInstanceId && ci == *e.ComputeInstanceId {
-				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Edata, d.ID)
+			gpu, gi, ci := parseDeviceID(d.ID)
+			if gpu == e.UUID && gi == e.GpuInstanceId && ci == e.ComputeInstanceId {
+				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Xid, d.ID)
 				unhealthy <- d
 			}
 		}
@@ -0,0 +1,177 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NVMLDevice is a full GPU as enumerated by NVML, memory is in MiB.
+type NVMLDevice struct {
+	UUID string
+	// BusID is the PCI bus id of the GPU, e.g. 00000000:3B:00.0
+	BusID       string
+	Path        string
+	Model       string
+	Memory      uint64
+	CPUAffinity *uint
+	MigEnabled  bool
+	// Links is the level of the link to each other GPU by its PCI bus id, see
+	// annotations.DeviceLink
+	Links map[string]int32
+}
+
+// compositeSeparator joins the UUID and the PCI bus id of a composite device ID.
+const compositeSeparator = "_pci-"
+
+// noUUID stands in for an empty UUID in composite device IDs.
+const noUUID = "GPU-nouuid"
+
+// compositeDeviceID is the ID of a GPU NVML reports an empty UUID or the UUID of another
+// GPU for, as on some vGPU and SR-IOV hosts: the UUID and the PCI bus id, with the colons
+// and dots the annotations use as separators replaced.
+func compositeDeviceID(uuid, busID string) string {
+	if uuid == "" {
+		uuid = noUUID
+	}
+	return uuid + compositeSeparator + strings.NewReplacer(":", "-", ".", "-").Replace(strings.ToLower(busID))
+}
+
+// splitDeviceID returns the UUID NVML reports for the GPU with the device ID, and whether
+// the ID is composite.
+func splitDeviceID(id string) (string, bool) {
+	i := strings.Index(id, compositeSeparator)
+	if i < 0 {
+		return id, false
+	}
+	if uuid := id[:i]; uuid != noUUID {
+		return uuid, true
+	}
+	return "", true
+}
+
+// compositeDevices maps the composite IDs of the enumerated GPUs to their NVML index, as
+// they can't be looked up by UUID.
+var compositeDevices = struct {
+	sync.Mutex
+	index map[string]uint
+}{index: make(map[string]uint)}
+
+// compositeIndex returns the NVML index of the GPU with the composite device ID.
+func compositeIndex(id string) (uint, bool) {
+	compositeDevices.Lock()
+	defer compositeDevices.Unlock()
+	index, ok := compositeDevices.index[id]
+	return index, ok
+}
+
+// runtimeDeviceID is how the GPU with the device ID is named to the container runtime,
+// by its UUID or, for composite IDs, by its index.
+func runtimeDeviceID(id string) string {
+	if index, ok := compositeIndex(id); ok {
+		return fmt.Sprint(index)
+	}
+	return id
+}
+
+// XidEvent is a critical Xid error of the GPU with UUID, of all GPUs if UUID is empty.
+// GpuInstanceId and ComputeInstanceId are 0xFFFFFFFF unless a MIG device failed.
+type XidEvent struct {
+	UUID              string
+	GpuInstanceId     uint
+	ComputeInstanceId uint
+	Xid               uint64
+}
+
+// ProcessInfo is a process using a GPU, memory is in MiB.
+type ProcessInfo struct {
+	PID        uint
+	MemoryUsed uint64
+}
+
+// AccountingStats are what NVML accounted of a process on a GPU since it started using it.
+type AccountingStats struct {
+	// GPUUtilization is the percentage of Time a kernel of the process ran
+	GPUUtilization uint
+	// MaxMemoryUsage is the most device memory the process used, in bytes
+	MaxMemoryUsage uint64
+	Time           time.Duration
+}
+
+// ComputeMode is the nvmlComputeMode_t of a GPU, which limits the contexts it runs.
+type ComputeMode int
+
+const (
+	// ComputeModeDefault lets any number of contexts share the GPU, which splitting needs
+	ComputeModeDefault ComputeMode = iota
+	ComputeModeExclusiveThread
+	// ComputeModeProhibited lets no context run on the GPU
+	ComputeModeProhibited
+	// ComputeModeExclusiveProcess lets a single context use the GPU
+	ComputeModeExclusiveProcess
+)
+
+func (m ComputeMode) String() string {
+	switch m {
+	case ComputeModeDefault:
+		return "DEFAULT"
+	case ComputeModeExclusiveThread:
+		return "EXCLUSIVE_THREAD"
+	case ComputeModeProhibited:
+		return "PROHIBITED"
+	case ComputeModeExclusiveProcess:
+		return "EXCLUSIVE_PROCESS"
+	}
+	return fmt.Sprintf("ComputeMode(%d)", int(m))
+}
+
+// NVML is the part of the NVML library used to enumerate, sample and health check full
+// GPUs. MIG devices are still read from the library itself. The library needs cgo, builds
+// with the nogpu tag get an NVML that finds no GPUs instead.
+type NVML interface {
+	Init() error
+	Shutdown() error
+	DeviceCount() (uint, error)
+	Device(index uint) (*NVMLDevice, error)
+	Query(uuid string) (DeviceSample, error)
+	// Utilization is the percentage of time a kernel ran on the GPU in the last sample period.
+	Utilization(uuid string) (uint, error)
+	// Processes lists the processes using the GPU with uuid
+	Processes(uuid string) ([]ProcessInfo, error)
+	PersistenceMode(uuid string) (bool, error)
+	SetPersistenceMode(uuid string, enabled bool) error
+	// AccountingMode is whether NVML keeps AccountingStats of the processes on the GPU
+	AccountingMode(uuid string) (bool, error)
+	SetAccountingMode(uuid string, enabled bool) error
+	AccountingStats(uuid string, pid uint) (AccountingStats, error)
+	ComputeMode(uuid string) (ComputeMode, error)
+	SetComputeMode(uuid string, mode ComputeMode) error
+	// WatchXids sends the critical Xid errors of the GPUs with the given UUIDs to events
+	// until stop is closed. The GPUs too old to report them are returned.
+	WatchXids(stop <-chan interface{}, uuids []string, events chan<- XidEvent) ([]string, error)
+}
+
+// nvmlLib is the NVML the device plugin talks to.
+var nvmlLib NVML = NewNVML()
+
+// SetNVML replaces the NVML the device plugin talks to, before the device cache starts.
+func SetNVML(lib NVML) {
+	nvmlLib = lib
+}
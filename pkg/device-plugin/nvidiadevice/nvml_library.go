@@ -0,0 +1,226 @@
+//go:build !nogpu
+
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"k8s.io/klog/v2"
+)
+
+type nvmlLibrary struct{}
+
+// NewNVML returns the NVML backed by the driver's library.
+func NewNVML() NVML {
+	return nvmlLibrary{}
+}
+
+func (nvmlLibrary) Init() error {
+	return nvml.Init()
+}
+
+func (nvmlLibrary) Shutdown() error {
+	return nvml.Shutdown()
+}
+
+func (nvmlLibrary) DeviceCount() (uint, error) {
+	return nvml.GetDeviceCount()
+}
+
+func (nvmlLibrary) Device(index uint) (*NVMLDevice, error) {
+	d, err := nvml.NewDevice(index)
+	if err != nil {
+		return nil, err
+	}
+	migEnabled, err := d.IsMigEnabled()
+	if err != nil {
+		return nil, err
+	}
+	dev := &NVMLDevice{UUID: d.UUID, BusID: d.PCI.BusID, Path: d.Path, CPUAffinity: d.CPUAffinity, MigEnabled: migEnabled}
+	if d.Model != nil {
+		dev.Model = *d.Model
+	}
+	if d.Memory != nil {
+		dev.Memory = *d.Memory
+	}
+	dev.Links = links(d, index)
+	return dev, nil
+}
+
+// links returns the level of the link of d, the GPU with the index, to each other GPU by
+// its PCI bus id, the NVLinks between them if any, otherwise their common PCIe ancestor.
+// GPUs NVML can't tell the link to are left out.
+func links(d *nvml.Device, index uint) map[string]int32 {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		klog.Warningf("GPU %v: no topology, %v", d.UUID, err)
+		return nil
+	}
+	res := make(map[string]int32)
+	for i := uint(0); i < n; i++ {
+		if i == index {
+			continue
+		}
+		peer, err := nvml.NewDeviceLite(i)
+		if err != nil {
+			klog.Warningf("GPU %v: no link to GPU %d, %v", d.UUID, i, err)
+			continue
+		}
+		link, err := nvml.GetNVLink(d, peer)
+		if err == nil && link == nvml.P2PLinkUnknown {
+			link, err = nvml.GetP2PLink(d, peer)
+		}
+		if err != nil || link == nvml.P2PLinkUnknown {
+			klog.V(4).Infof("GPU %v: link to %v unknown, %v", d.UUID, peer.PCI.BusID, err)
+			continue
+		}
+		res[peer.PCI.BusID] = int32(link)
+	}
+	return res
+}
+
+// deviceByID returns the GPU with the device ID, by its index for composite IDs, only
+// with the properties NewDeviceLite reads if lite.
+func deviceByID(id string, lite bool) (*nvml.Device, error) {
+	index, ok := compositeIndex(id)
+	switch {
+	case ok && lite:
+		return nvml.NewDeviceLite(index)
+	case ok:
+		return nvml.NewDevice(index)
+	case lite:
+		return nvml.NewDeviceLiteByUUID(id)
+	}
+	return nvml.NewDeviceByUUID(id)
+}
+
+func (nvmlLibrary) Query(uuid string) (DeviceSample, error) {
+	dev, err := deviceByID(uuid, false)
+	if err != nil {
+		return DeviceSample{}, err
+	}
+	if dev.Model == nil || dev.Memory == nil {
+		return DeviceSample{}, fmt.Errorf("model or memory of device %v is unknown", uuid)
+	}
+	status, err := dev.Status()
+	if err != nil {
+		return DeviceSample{}, err
+	}
+	if status.Memory.Global.Free == nil {
+		return DeviceSample{}, fmt.Errorf("free memory of device %v is unknown", uuid)
+	}
+	sample := DeviceSample{Model: *dev.Model, Memory: int32(*dev.Memory), Free: *status.Memory.Global.Free}
+	// the memory the driver reserves can't be allocated, drivers predating
+	// nvmlDeviceGetMemoryInfo_v2 count it as used and leave it in the total
+	if total, reserved, err := nvmlMemoryInfo(uuid); err == nil {
+		sample.Memory = int32((total - reserved) >> 20)
+	} else {
+		klog.V(4).Infof("memory info v2 of device %v: %v, taking the total of v1", uuid, err)
+	}
+	if status.Temperature != nil {
+		sample.Temperature = *status.Temperature
+	}
+	return sample, nil
+}
+
+func (nvmlLibrary) Utilization(uuid string) (uint, error) {
+	dev, err := deviceByID(uuid, true)
+	if err != nil {
+		return 0, err
+	}
+	status, err := dev.Status()
+	if err != nil {
+		return 0, err
+	}
+	if status.Utilization.GPU == nil {
+		return 0, fmt.Errorf("utilization of device %v is unknown", uuid)
+	}
+	return *status.Utilization.GPU, nil
+}
+
+func (nvmlLibrary) Processes(uuid string) ([]ProcessInfo, error) {
+	dev, err := deviceByID(uuid, true)
+	if err != nil {
+		return nil, err
+	}
+	procs, err := dev.GetAllRunningProcesses()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ProcessInfo, 0, len(procs))
+	for _, p := range procs {
+		res = append(res, ProcessInfo{PID: p.PID, MemoryUsed: p.MemoryUsed})
+	}
+	return res, nil
+}
+
+// parseMigDeviceUUID returns the GPU and the GPU and compute instance of a MIG device.
+func parseMigDeviceUUID(uuid string) (string, uint, uint, error) {
+	return nvml.ParseMigDeviceUUID(uuid)
+}
+
+func (nvmlLibrary) WatchXids(stop <-chan interface{}, uuids []string, events chan<- XidEvent) ([]string, error) {
+	eventSet := nvml.NewEventSet()
+	var unsupported []string
+	for _, uuid := range uuids {
+		err := nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, uuid)
+		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
+			unsupported = append(unsupported, uuid)
+			continue
+		}
+		if err != nil {
+			nvml.DeleteEventSet(eventSet)
+			return nil, err
+		}
+	}
+
+	go func() {
+		defer nvml.DeleteEventSet(eventSet)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			e, err := nvml.WaitForEvent(eventSet, 5000)
+			if err != nil && e.Etype != nvml.XidCriticalError {
+				continue
+			}
+			xid := XidEvent{GpuInstanceId: 0xFFFFFFFF, ComputeInstanceId: 0xFFFFFFFF, Xid: e.Edata}
+			if e.UUID != nil {
+				xid.UUID = *e.UUID
+			}
+			if e.GpuInstanceId != nil {
+				xid.GpuInstanceId = *e.GpuInstanceId
+			}
+			if e.ComputeInstanceId != nil {
+				xid.ComputeInstanceId = *e.ComputeInstanceId
+			}
+			select {
+			case events <- xid:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return unsupported, nil
+}
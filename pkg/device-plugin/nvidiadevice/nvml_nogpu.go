@@ -0,0 +1,103 @@
+//go:build nogpu
+
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errNoNVML is returned by the NVML of builds with the nogpu tag, which leave out the
+// NVML library so the device plugin and its tests build without cgo or a driver.
+var errNoNVML = errors.New("built without NVML support (nogpu)")
+
+type noNVML struct{}
+
+// NewNVML returns an NVML failing to initialize, the build has no NVML library.
+func NewNVML() NVML {
+	return noNVML{}
+}
+
+func (noNVML) Init() error {
+	return errNoNVML
+}
+
+func (noNVML) Shutdown() error {
+	return errNoNVML
+}
+
+func (noNVML) DeviceCount() (uint, error) {
+	return 0, errNoNVML
+}
+
+func (noNVML) Device(index uint) (*NVMLDevice, error) {
+	return nil, errNoNVML
+}
+
+func (noNVML) Query(uuid string) (DeviceSample, error) {
+	return DeviceSample{}, errNoNVML
+}
+
+func (noNVML) Utilization(uuid string) (uint, error) {
+	return 0, errNoNVML
+}
+
+func (noNVML) Processes(uuid string) ([]ProcessInfo, error) {
+	return nil, errNoNVML
+}
+
+func (noNVML) PersistenceMode(uuid string) (bool, error) {
+	return false, errNoNVML
+}
+
+func (noNVML) SetPersistenceMode(uuid string, enabled bool) error {
+	return errNoNVML
+}
+
+func (noNVML) AccountingMode(uuid string) (bool, error) {
+	return false, errNoNVML
+}
+
+func (noNVML) SetAccountingMode(uuid string, enabled bool) error {
+	return errNoNVML
+}
+
+func (noNVML) AccountingStats(uuid string, pid uint) (AccountingStats, error) {
+	return AccountingStats{}, errNoNVML
+}
+
+func (noNVML) ComputeMode(uuid string) (ComputeMode, error) {
+	return 0, errNoNVML
+}
+
+func (noNVML) SetComputeMode(uuid string, mode ComputeMode) error {
+	return errNoNVML
+}
+
+func (noNVML) WatchXids(stop <-chan interface{}, uuids []string, events chan<- XidEvent) ([]string, error) {
+	return nil, errNoNVML
+}
+
+func parseMigDeviceUUID(uuid string) (string, uint, uint, error) {
+	return "", 0, 0, errNoNVML
+}
+
+func newMigStrategy(strategy string) (MigStrategy, error) {
+	return nil, fmt.Errorf("mig strategy %v: %w", strategy, errNoNVML)
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// offlineDirPrefix starts the names of the shared region cache directories of containers
+// allocated without the API server, which are named after their devices instead of
+// their pod.
+const offlineDirPrefix = "offline_"
+
+// deviceUUID returns the UUID of the GPU of a split device, advertised as <uuid>-<n>.
+func deviceUUID(id string) string {
+	if i := strings.LastIndex(id, "-"); i > 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// allocateOffline hands containers the devices kubelet picked while the plugin runs
+// without the API server, where no scheduler assignment can be read: each split device
+// is a slice of its GPU, the GPU's memory divided by its split count, and the limits
+// are enforced as for the pods the scheduler assigned. The containers sharing a GPU are
+// capped by the contexts NVML lists on it.
+func (m *NvidiaDevicePlugin) allocateOffline(reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		ids := append([]string(nil), req.DevicesIDs...)
+		sort.Strings(ids)
+		devreq, err := m.offlineDevices(ids)
+		if err != nil {
+			return &pluginapi.AllocateResponse{}, err
+		}
+		if err := checkContexts(m.deviceCache, devreq); err != nil {
+			return &pluginapi.AllocateResponse{}, err
+		}
+		dir := filepath.Join(config.ContainerCacheRoot, offlineDirPrefix+strings.Join(ids, "_"))
+		gen, err := prepareCacheDir(dir)
+		if err != nil {
+			return &pluginapi.AllocateResponse{}, err
+		}
+		response, err := m.limitedResponse(devreq, dir, gen, false, 0, "")
+		if err != nil {
+			return &pluginapi.AllocateResponse{}, err
+		}
+		klog.Infof("Allocated %v without the API server", annotations.EncodeContainerDevices(devreq))
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	return &responses, nil
+}
+
+// offlineDevices returns the GPUs of the sorted split devices ids with the memory of
+// their slices.
+func (m *NvidiaDevicePlugin) offlineDevices(ids []string) (util.ContainerDevices, error) {
+	slices := make(map[string]int32)
+	var uuids []string
+	for _, id := range ids {
+		uuid := deviceUUID(id)
+		if slices[uuid] == 0 {
+			uuids = append(uuids, uuid)
+		}
+		slices[uuid]++
+	}
+	var devreq util.ContainerDevices
+	for _, uuid := range uuids {
+		mem, split, ok := m.deviceCache.sliceMemory(uuid)
+		if !ok {
+			return nil, fmt.Errorf("device %v not sampled by NVML yet", uuid)
+		}
+		usedmem := offlineMemory(mem, split, slices[uuid])
+		devreq = append(devreq, util.ContainerDevice{UUID: uuid, Type: util.NvidiaGPUDevice, Usedmem: usedmem})
+	}
+	return devreq, nil
+}
+
+// offlineMemory is the memory of n of the split slices of a GPU with mem MiB.
+func offlineMemory(mem, split, n int32) int32 {
+	usedmem := mem / split * n
+	if usedmem > mem {
+		usedmem = mem
+	}
+	return usedmem
+}
+
+// sliceMemory returns the memory of the GPU with the UUID, after memory scaling, and the
+// number of slices it is split into.
+func (d *DeviceCache) sliceMemory(uuid string) (mem, split int32, ok bool) {
+	sample, ok := d.Sample(uuid)
+	if !ok {
+		return 0, 0, false
+	}
+	profile := d.DeviceProfile(uuid)
+	mem = sample.Memory
+	if scaling := profile.MemoryScaling(); scaling > 1 {
+		mem = int32(float64(mem) * scaling)
+	}
+	split = int32(d.SplitCount(uuid))
+	if sample.ComputeMode != ComputeModeDefault || split < 1 {
+		split = 1
+	}
+	return mem, split, true
+}
+
+// prefersAllocation is whether kubelet asks the plugin which devices to allocate, which
+// kubelets since 1.19 do. Without the API server the devices kubelet picks are the
+// allocation, otherwise they are those of the GPUs the scheduler assigned, see
+// preferredAssigned. Older kubelets pick the devices themselves, Allocate hands out the
+// GPUs the scheduler assigned either way.
+func (m *NvidiaDevicePlugin) prefersAllocation() bool {
+	return m.migStrategy != "mixed"
+}
+
+// preferredOffline picks size of the available split devices for a container, the ones
+// kubelet must include first. The GPUs are ranked like the scheduler ranks them, with
+// util.CandidateBefore, the free memory being that of their free slices, and each gets
+// one slice before any gets a second, as the scheduler gives a container distinct GPUs.
+func (m *NvidiaDevicePlugin) preferredOffline(available, mustInclude []string, size int) []string {
+	res := append([]string(nil), mustInclude...)
+	taken := make(map[string]bool, len(mustInclude))
+	for _, id := range mustInclude {
+		taken[id] = true
+	}
+	free := make(map[string][]string)
+	for _, id := range available {
+		if !taken[id] {
+			free[deviceUUID(id)] = append(free[deviceUUID(id)], id)
+		}
+	}
+	for _, ids := range free {
+		sort.Strings(ids)
+	}
+	for len(res) < size {
+		candidates := make([]util.DeviceCandidate, 0, len(free))
+		for uuid, ids := range free {
+			if len(ids) == 0 {
+				continue
+			}
+			c := util.DeviceCandidate{UUID: uuid, SharesLeft: int32(len(ids))}
+			if mem, split, ok := m.deviceCache.sliceMemory(uuid); ok {
+				c.FreeMemory = mem / split * int32(len(ids))
+			}
+			candidates = append(candidates, c)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.Slice(candidates, func(i, j int) bool { return util.CandidateBefore(candidates[i], candidates[j]) })
+		for _, c := range candidates {
+			if len(res) == size {
+				break
+			}
+			res = append(res, free[c.UUID][0])
+			free[c.UUID] = free[c.UUID][1:]
+		}
+	}
+	return res
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"4pd.io/k8s-vgpu/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// EnablePersistenceMode turns persistence mode on for the GPUs having it off, so the
+// driver stays loaded while no job runs, and returns a function turning it off again
+// on those GPUs. Setting it needs root, a GPU that fails is logged and left as it was.
+func EnablePersistenceMode() (restore func()) {
+	n, err := nvmlLib.DeviceCount()
+	if err != nil {
+		klog.Errorf("enable persistence mode: %v", err)
+		return func() {}
+	}
+	if n > util.DeviceLimit {
+		n = util.DeviceLimit
+	}
+	var enabled []string
+	for i := uint(0); i < n; i++ {
+		d, err := nvmlLib.Device(i)
+		if err != nil {
+			klog.Errorf("enable persistence mode of GPU %d: %v", i, err)
+			continue
+		}
+		on, err := nvmlLib.PersistenceMode(d.UUID)
+		if err != nil {
+			klog.Errorf("get persistence mode of %v: %v", d.UUID, err)
+			continue
+		}
+		if on {
+			klog.Infof("Persistence mode of %v is enabled already", d.UUID)
+			continue
+		}
+		if err := nvmlLib.SetPersistenceMode(d.UUID, true); err != nil {
+			klog.Errorf("enable persistence mode of %v: %v", d.UUID, err)
+			continue
+		}
+		klog.Infof("Enabled persistence mode of %v", d.UUID)
+		enabled = append(enabled, d.UUID)
+	}
+	return func() {
+		for _, uuid := range enabled {
+			if err := nvmlLib.SetPersistenceMode(uuid, false); err != nil {
+				klog.Errorf("disable persistence mode of %v: %v", uuid, err)
+				continue
+			}
+			klog.Infof("Disabled persistence mode of %v again", uuid)
+		}
+	}
+}
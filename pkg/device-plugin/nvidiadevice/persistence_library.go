@@ -0,0 +1,69 @@
+//go:build !nogpu
+
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+// #include <stdlib.h>
+//
+// typedef struct nvmlDevice_st *nvmlDevice_t;
+//
+// // The NVML bindings don't wrap nvmlDeviceSetPersistenceMode, see symbol_library.go.
+// extern void *nvml_symbol(const char *name);
+//
+// // nvml_persistence_mode reads the mode of the GPU into mode if set is negative,
+// // and sets it to set otherwise. It returns -1 if NVML isn't loaded.
+// static int nvml_persistence_mode(const char *uuid, int set, int *mode) {
+// 	int (*by_uuid)(const char *, nvmlDevice_t *) = nvml_symbol("nvmlDeviceGetHandleByUUID");
+// 	int (*get)(nvmlDevice_t, int *) = nvml_symbol("nvmlDeviceGetPersistenceMode");
+// 	int (*put)(nvmlDevice_t, int) = nvml_symbol("nvmlDeviceSetPersistenceMode");
+// 	if (by_uuid == NULL || get == NULL || put == NULL)
+// 		return -1;
+// 	nvmlDevice_t dev;
+// 	int ret = by_uuid(uuid, &dev);
+// 	if (ret != 0)
+// 		return ret;
+// 	if (set < 0)
+// 		return get(dev, mode);
+// 	return put(dev, set);
+// }
+import "C"
+
+import "unsafe"
+
+func nvmlPersistenceMode(uuid string, set C.int) (bool, error) {
+	cuuid := C.CString(uuid)
+	defer C.free(unsafe.Pointer(cuuid))
+	var mode C.int
+	if ret := C.nvml_persistence_mode(cuuid, set, &mode); ret != 0 {
+		return false, nvmlError(ret)
+	}
+	return mode != 0, nil
+}
+
+func (nvmlLibrary) PersistenceMode(uuid string) (bool, error) {
+	return nvmlPersistenceMode(uuid, -1)
+}
+
+func (nvmlLibrary) SetPersistenceMode(uuid string, enabled bool) error {
+	var set C.int
+	if enabled {
+		set = 1
+	}
+	_, err := nvmlPersistenceMode(uuid, set)
+	return err
+}
@@ -20,28 +20,36 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"4pd.io/k8s-vgpu/pkg/api"
 	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
 	"4pd.io/k8s-vgpu/pkg/util"
-	"k8s.io/apimachinery/pkg/util/uuid"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"4pd.io/k8s-vgpu/pkg/util/tracing"
 	"k8s.io/klog/v2"
 
-	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
-// Constants to represent the various device list strategies
+// Constants to represent the various device list strategies, see runtimeStrategies
 const (
-	DeviceListStrategyEnvvar       = "envvar"
-	DeviceListStrategyVolumeMounts = "volume-mounts"
+	DeviceListStrategyAuto           = "auto"
+	DeviceListStrategyEnvvar         = "envvar"
+	DeviceListStrategyVolumeMounts   = "volume-mounts"
+	DeviceListStrategyCDIAnnotations = "cdi-annotations"
 )
 
 // Constants to represent the various device id strategies
@@ -56,6 +64,27 @@ const (
 	deviceListAsVolumeMountsContainerPathRoot = "/var/run/nvidia-container-devices"
 )
 
+// Constants for use by the 'cdi-annotations' device list strategy
+const (
+	cdiAnnotationKey = "cdi.k8s.io/vgpu-device-plugin_devices"
+	cdiDeviceKind    = "nvidia.com/gpu"
+)
+
+// Environment variables telling a container its assignment, set with config.InjectAssignmentEnv
+const (
+	AssignedUUIDEnv = "VGPU_ASSIGNED_UUID"
+	MemoryLimitEnv  = "VGPU_MEMORY_LIMIT_MIB"
+	CoreLimitEnv    = "VGPU_CORE_LIMIT"
+)
+
+// KubeletSocket is where kubelet serves the registration service.
+func KubeletSocket() string {
+	return filepath.Join(config.DevicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// registerBackoff is the pause between registration attempts.
+var registerBackoff = time.Second
+
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
 	ResourceManager
@@ -63,7 +92,6 @@ type NvidiaDevicePlugin struct {
 	deviceCache      *DeviceCache
 	resourceName     string
 	deviceListEnvvar string
-	allocatePolicy   gpuallocator.Policy
 	socket           string
 
 	server        *grpc.Server
@@ -72,18 +100,26 @@ type NvidiaDevicePlugin struct {
 	stop          chan interface{}
 	changed       chan struct{}
 	migStrategy   string
+	// profile sets the devices and split count of the plugin in the "none" MIG strategy.
+	profile *Profile
+	// disconnected receives the resource name when the ListAndWatch stream is lost.
+	disconnected chan<- string
+	// leaks checks the devices of each container for leaked memory, nil if disabled.
+	leaks *LeakCheck
+	// recorder records the events of slow Allocate calls on their pods, nil if disabled.
+	recorder record.EventRecorder
 	//devRegister   *DeviceRegister
 	//podManager    *PodManager
 }
 
-// NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
-func NewNvidiaDevicePlugin(resourceName string, deviceCache *DeviceCache, allocatePolicy gpuallocator.Policy, socket string) *NvidiaDevicePlugin {
+// NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin serving the devices of profile
+func NewNvidiaDevicePlugin(profile *Profile, deviceCache *DeviceCache) *NvidiaDevicePlugin {
 	return &NvidiaDevicePlugin{
-		deviceCache:    deviceCache,
-		resourceName:   resourceName,
-		allocatePolicy: allocatePolicy,
-		socket:         socket,
-		migStrategy:    "none",
+		deviceCache:  deviceCache,
+		resourceName: profile.ResourceName(),
+		socket:       profile.socket(),
+		migStrategy:  "none",
+		profile:      profile,
 
 		// These will be reinitialized every
 		// time the plugin server is restarted.
@@ -94,13 +130,13 @@ func NewNvidiaDevicePlugin(resourceName string, deviceCache *DeviceCache, alloca
 }
 
 // NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
-func NewMIGNvidiaDevicePlugin(resourceName string, resourceManager ResourceManager, deviceListEnvvar string, allocatePolicy gpuallocator.Policy, socket string) *NvidiaDevicePlugin {
+func NewMIGNvidiaDevicePlugin(resourceName string, resourceManager ResourceManager, deviceListEnvvar string, socket string) *NvidiaDevicePlugin {
 	return &NvidiaDevicePlugin{
 		ResourceManager:  resourceManager,
 		resourceName:     resourceName,
 		deviceListEnvvar: deviceListEnvvar,
-		allocatePolicy:   allocatePolicy,
 		socket:           socket,
+		profile:          DefaultProfile(),
 
 		// These will be reinitialized every
 		// time the plugin server is restarted.
@@ -118,13 +154,33 @@ func (m *NvidiaDevicePlugin) initialize() {
 		m.cachedDevices = m.ResourceManager.Devices()
 	}
 	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	m.health = make(chan *Device)
+	m.health = make(chan *Device, 1)
 	m.stop = make(chan interface{})
 	check(err)
 }
 
+// SetDisconnectChannel makes the plugin report its resource name on ch when the
+// ListAndWatch stream to kubelet is lost, so the caller can register again.
+func (m *NvidiaDevicePlugin) SetDisconnectChannel(ch chan<- string) {
+	m.disconnected = ch
+}
+
+// SetLeakCheck makes Allocate check the devices of each container for memory leaked by
+// terminated pods with leaks, nil disables the check.
+func (m *NvidiaDevicePlugin) SetLeakCheck(leaks *LeakCheck) {
+	m.leaks = leaks
+}
+
+// SetEventRecorder makes Allocate record an event on the pods whose allocation is slow
+// with recorder, nil disables the events.
+func (m *NvidiaDevicePlugin) SetEventRecorder(recorder record.EventRecorder) {
+	m.recorder = recorder
+}
+
 func (m *NvidiaDevicePlugin) cleanup() {
-	close(m.stop)
+	if m.stop != nil {
+		close(m.stop)
+	}
 	m.server = nil
 	m.health = nil
 	m.stop = nil
@@ -152,11 +208,10 @@ func (m *NvidiaDevicePlugin) Start() error {
 	}
 	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
 
-	if strings.Compare(m.migStrategy, "none") == 0 {
-		m.deviceCache.AddNotifyChannel("plugin", m.health)
-	} else if strings.Compare(m.migStrategy, "mixed") == 0 {
+	// with the none strategy ListAndWatch watches the device cache
+	if strings.Compare(m.migStrategy, "mixed") == 0 {
 		go m.CheckHealth(m.stop, m.cachedDevices, m.health)
-	} else {
+	} else if strings.Compare(m.migStrategy, "none") != 0 {
 		log.Panicln("migstrategy not recognized", m.migStrategy)
 	}
 	return nil
@@ -168,7 +223,10 @@ func (m *NvidiaDevicePlugin) Stop() error {
 		return nil
 	}
 	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
-	m.deviceCache.RemoveNotifyChannel("plugin")
+	// close stop before the server cancels the streams, so ListAndWatch can tell
+	// our own shutdown from a lost stream
+	close(m.stop)
+	m.stop = nil
 	m.server.Stop()
 	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
 		return err
@@ -229,7 +287,24 @@ func (m *NvidiaDevicePlugin) Serve() error {
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (m *NvidiaDevicePlugin) Register() error {
-	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
+	start := time.Now()
+	var err error
+	for attempt := 0; attempt <= config.RegisterRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(registerBackoff)
+		}
+		err = m.register(config.RegisterTimeout)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Registration attempt %d/%d for '%s' failed after %v: %v",
+			attempt+1, config.RegisterRetries+1, m.resourceName, time.Since(start).Round(time.Millisecond), err)
+	}
+	return err
+}
+
+func (m *NvidiaDevicePlugin) register(timeout time.Duration) error {
+	conn, err := m.dial(KubeletSocket(), timeout)
 	if err != nil {
 		return err
 	}
@@ -241,45 +316,116 @@ func (m *NvidiaDevicePlugin) Register() error {
 		Endpoint:     path.Base(m.socket),
 		ResourceName: m.resourceName,
 		Options: &pluginapi.DevicePluginOptions{
-			GetPreferredAllocationAvailable: false,
+			GetPreferredAllocationAvailable: m.prefersAllocation(),
 		},
 	}
 
-	_, err = client.Register(context.Background(), reqt)
-	if err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err = client.Register(ctx, reqt)
+	if supported := kubeletVersions(err); supported != nil {
+		return fmt.Errorf("kubelet supports device plugin API versions %v, the plugin only %v: %w", supported, pluginapi.Version, err)
 	}
-	return nil
+	return err
 }
 
 // GetDevicePluginOptions returns the values of the optional settings for this plugin
 func (m *NvidiaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
 	options := &pluginapi.DevicePluginOptions{
-		GetPreferredAllocationAvailable: false,
+		GetPreferredAllocationAvailable: m.prefersAllocation(),
 	}
 	return options, nil
 }
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	_ = s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
+	stop, health := m.stop, m.health
+	// watch before the first send, so no change after it is missed
+	var events <-chan DeviceEvent
+	if strings.Compare(m.migStrategy, "none") == 0 {
+		ch, cancel := m.deviceCache.Watch()
+		defer cancel()
+		events = ch
+	}
+	send := func() error {
+		devs := m.apiDevices()
+		if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+			return m.streamLost(devs, err)
+		}
+		return nil
+	}
+	if err := send(); err != nil {
+		return err
+	}
 	for {
 		select {
-		case <-m.stop:
+		case <-stop:
 			return nil
-		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			//d.Health = pluginapi.Unhealthy
-			log.Printf("'%s' device marked unhealthy: %s", m.resourceName, d.ID)
-			_ = s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
+		case <-s.Context().Done():
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return m.streamLost(m.apiDevices(), s.Context().Err())
+		case d := <-health:
+			log.Printf("'%s' device marked %s: %s", m.resourceName, d.Health, d.ID)
+			if err := send(); err != nil {
+				return err
+			}
+		case ev := <-events:
+			if len(ev.Changed) == 0 {
+				continue
+			}
+			for _, id := range ev.Changed {
+				state := "removed"
+				if d := ev.Snapshot.Device(id); d != nil {
+					state = d.Health
+				}
+				log.Printf("'%s' device marked %s: %s", m.resourceName, state, id)
+			}
+			if err := send(); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// streamLost reports a ListAndWatch stream that ended while the plugin is still
+// running, e.g. kubelet restarted without recreating its socket.
+func (m *NvidiaDevicePlugin) streamLost(devs []*pluginapi.Device, err error) error {
+	var ids []string
+	for _, d := range devs {
+		ids = append(ids, d.ID)
+	}
+	klog.Errorf("ListAndWatch stream of '%s' lost, devices %v are no longer advertised: %v", m.resourceName, ids, err)
+	ListAndWatchDisconnects.WithLabelValues(m.resourceName).Inc()
+	if m.disconnected != nil {
+		select {
+		case m.disconnected <- m.resourceName:
+		default:
+		}
+	}
+	return err
+}
+
 // GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
 func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-
-	return &pluginapi.PreferredAllocationResponse{}, nil
+	res := &pluginapi.PreferredAllocationResponse{}
+	if !m.prefersAllocation() {
+		return res, nil
+	}
+	for _, req := range r.ContainerRequests {
+		ids, ok := []string(nil), false
+		if util.GetClient() != nil {
+			ids, ok = m.preferredAssigned(ctx, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		}
+		if !ok {
+			ids = m.preferredOffline(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		}
+		res.ContainerResponses = append(res.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{DeviceIDs: ids})
+	}
+	return res, nil
 }
 
 func (m *NvidiaDevicePlugin) MIGAllocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
@@ -314,7 +460,9 @@ func (m *NvidiaDevicePlugin) MIGAllocate(ctx context.Context, reqs *pluginapi.Al
 	return &responses, nil
 }
 
-// Allocate which return list of devices.
+// Allocate which return list of devices. The devices of the pods the scheduler assigned
+// are allocated under a deadline, kubelet's or config.AllocateTimeout, which cancels the
+// API requests of the allocation and stops it, so kubelet gets its answer in time.
 func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
 	klog.Infoln("Allocate", reqs.ContainerRequests)
 	if len(reqs.ContainerRequests) > 1 {
@@ -323,59 +471,256 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 	if strings.Compare(m.migStrategy, "mixed") == 0 {
 		return m.MIGAllocate(ctx, reqs)
 	}
-	responses := pluginapi.AllocateResponse{}
+	if util.GetClient() == nil {
+		return m.allocateOffline(reqs)
+	}
+	// kubelet calls Allocate without a deadline
+	ctx, cancel := context.WithTimeout(ctx, config.AllocateTimeout)
+	defer cancel()
+	res, err := m.allocate(&allocation{ctx: ctx, timing: newAllocateTiming()}, reqs)
+	if err != nil && ctx.Err() != nil {
+		klog.Warningf("Allocate %v: %v, rolled back", reqs.ContainerRequests[0].DevicesIDs, ctx.Err())
+		return &pluginapi.AllocateResponse{}, fmt.Errorf("allocate %v: %w", reqs.ContainerRequests[0].DevicesIDs, ctx.Err())
+	}
+	return res, err
+}
+
+// allocate allocates the devices of the pod the scheduler assigned to the node, see
+// Allocate, and reports the time it took.
+func (m *NvidiaDevicePlugin) allocate(a *allocation, reqs *pluginapi.AllocateRequest) (res *pluginapi.AllocateResponse, err error) {
+	var current *corev1.Pod
+	defer func() { m.reportTiming(a.timing, current, err) }()
 	nodename := os.Getenv("NODE_NAME")
 
-	current, err := util.GetPendingPod(nodename)
+	current, err = util.GetPendingPodWithContext(a.ctx, nodename)
 	if err != nil {
 		util.ReleaseNodeLock(nodename)
 		return &pluginapi.AllocateResponse{}, err
 	}
+	if current == nil {
+		// the node lock, if any, belongs to a pod the scheduler did approve
+		if config.RequireSchedulerApproval {
+			return &pluginapi.AllocateResponse{}, fmt.Errorf("no pod assigned to node %v by the vGPU scheduler is waiting for %v, "+
+				"pods requesting %v must be scheduled by the vGPU scheduler", nodename, m.resourceName, m.resourceName)
+		}
+		klog.Warningf("Allocating %v without scheduler approval, memory and core limits are not applied", reqs.ContainerRequests[0].DevicesIDs)
+		return m.allocateUnapproved(reqs), nil
+	}
+	span := tracing.Start("vgpu.allocate", current.Annotations[util.TraceParentAnnotation])
+	span.SetAttribute("k8s.namespace.name", current.Namespace)
+	span.SetAttribute("k8s.pod.name", current.Name)
+	span.SetAttribute("k8s.node.name", nodename)
+	if sec, err := strconv.ParseInt(current.Annotations[util.BindTimeAnnotations], 10, 64); err == nil {
+		span.SetAttribute("vgpu.since_bind_seconds", time.Since(time.Unix(sec, 0)).Seconds())
+	}
+	defer span.End()
+	res, err = m.allocateForPod(a, span, nodename, current, reqs)
+	if err != nil {
+		span.SetError(err)
+		return &pluginapi.AllocateResponse{}, err
+	}
+	klog.Infoln("Allocate Response", res.ContainerResponses)
+	util.PodAllocationTrySuccess(nodename, current)
+	m.deviceCache.Republish()
+	return res, nil
+}
 
+// allocateForPod builds the responses for the devices the scheduler assigned to current.
+// It is all-or-nothing: on any failure, or once the deadline of a passed, the devices
+// already taken from the pod's to-allocate annotation are put back and the container
+// directories it created are removed before it returns.
+func (m *NvidiaDevicePlugin) allocateForPod(a *allocation, span *tracing.Span, nodename string, current *corev1.Pod, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	toAllocate := current.Annotations[util.AssignedIDsToAllocateAnnotations]
+	erased := false
+	// the directories of containers started before are kept
+	var created []string
+	fail := func(err error) (*pluginapi.AllocateResponse, error) {
+		for _, dir := range created {
+			if rerr := os.RemoveAll(dir); rerr != nil {
+				klog.Errorf("remove %v failed: %v", dir, rerr)
+			}
+		}
+		if erased {
+			// the deadline of a may have passed, the rollback gets a request of its own
+			ctx, cancel := context.WithTimeout(context.Background(), config.APITimeout)
+			defer cancel()
+			rollback := map[string]string{util.AssignedIDsToAllocateAnnotations: toAllocate}
+			if rerr := util.PatchPodAnnotationsWithContext(ctx, current, rollback); rerr != nil {
+				klog.Errorf("restore devices of pod %v/%v failed: %v", current.Namespace, current.Name, rerr)
+			}
+		}
+		util.PodAllocationFailed(nodename, current)
+		return nil, err
+	}
+
+	if err := checkDistinct(current); err != nil {
+		return fail(err)
+	}
+	var bandwidth int32
+	if val, ok := current.Annotations[util.MemoryBandwidthAnnotation]; ok {
+		var err error
+		if bandwidth, err = annotations.DecodeMemoryPercent(val); err != nil {
+			return fail(fmt.Errorf("annotation %v: %v", util.MemoryBandwidthAnnotation, err))
+		}
+	}
+	allocated := make(map[string]util.ContainerDevices)
 	for idx := range reqs.ContainerRequests {
+		if err := a.begin(AllocatePhaseLookup); err != nil {
+			return fail(err)
+		}
 		currentCtr, devreq, err := util.GetNextDeviceRequest(util.NvidiaGPUDevice, *current)
 		klog.Infoln("deviceAllocateFromAnnotation=", devreq)
 		if err != nil {
-			util.PodAllocationFailed(nodename, current)
-			return &pluginapi.AllocateResponse{}, err
+			return fail(err)
 		}
 		if len(devreq) != len(reqs.ContainerRequests[idx].DevicesIDs) {
-			util.PodAllocationFailed(nodename, current)
-			return &pluginapi.AllocateResponse{}, errors.New("device number not matched")
+			return fail(errors.New("device number not matched"))
+		}
+		if err := a.begin(AllocatePhaseSelect); err != nil {
+			return fail(err)
+		}
+		sort.SliceStable(devreq, func(i, j int) bool { return devreq[i].UUID < devreq[j].UUID })
+		if m.leaks != nil {
+			if err := m.leaks.Check(current, devreq); err != nil {
+				return fail(err)
+			}
+		}
+		if config.StrictBindTimeMemoryCheck {
+			if err := checkFreeMemory(m.deviceCache, devreq); err != nil {
+				return fail(err)
+			}
+		}
+		if err := checkMaxShares(a.ctx, m.deviceCache, nodename, current, devreq); err != nil {
+			return fail(err)
+		}
+		if config.Enforcement == EnforcementNone && util.PodGPUMode(current) != util.GPUModeExclusive {
+			if err := m.checkWholeDevices(devreq); err != nil {
+				return fail(fmt.Errorf("container %v: %v", currentCtr.Name, err))
+			}
+		}
+		if !config.DisableCoreLimit {
+			for i := range devreq {
+				cores, err := enforcedCores(devreq[i].Usedcores)
+				if err != nil {
+					return fail(fmt.Errorf("container %v: %v", currentCtr.Name, err))
+				}
+				devreq[i].Usedcores = cores
+			}
 		}
 
-		err = util.EraseNextDeviceTypeFromAnnotation(util.NvidiaGPUDevice, *current)
+		err = util.EraseNextDeviceTypeFromAnnotationWithContext(a.ctx, util.NvidiaGPUDevice, *current)
 		if err != nil {
-			util.PodAllocationFailed(nodename, current)
-			return &pluginapi.AllocateResponse{}, err
+			return fail(err)
 		}
-
-		response := pluginapi.ContainerAllocateResponse{}
-		response.Envs = make(map[string]string)
-		for i, dev := range devreq {
-			limitKey := fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)
-			response.Envs[limitKey] = fmt.Sprintf("%vm", dev.Usedmem)
-			tmp := response.Envs["NVIDIA_VISIBLE_DEVICES"]
-			if i > 0 {
-				response.Envs["NVIDIA_VISIBLE_DEVICES"] = fmt.Sprintf("%v,%v", tmp, dev.UUID)
-			} else {
-				response.Envs["NVIDIA_VISIBLE_DEVICES"] = dev.UUID
+		erased = true
+		allocated[currentCtr.Name] = devreq
+		span.SetAttribute("k8s.container.name", currentCtr.Name)
+		span.SetAttribute("vgpu.devices", annotations.EncodeContainerDevices(devreq))
+
+		if util.PodGPUMode(current) == util.GPUModeExclusive {
+			if err := a.begin(AllocatePhaseResponse); err != nil {
+				return fail(err)
 			}
+			response, err := m.passthroughResponse(devreq)
+			if err != nil {
+				return fail(err)
+			}
+			responses.ContainerResponses = append(responses.ContainerResponses, response)
+			continue
 		}
-		response.Envs["CUDA_DEVICE_SM_LIMIT"] = fmt.Sprint(devreq[0].Usedcores)
-		response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = fmt.Sprintf("/tmp/vgpu/%v.cache", uuid.NewUUID())
-		if config.DeviceMemoryScaling > 1 {
-			response.Envs["CUDA_OVERSUBSCRIBE"] = "true"
+
+		cacheFileHostDirectory := filepath.Join(config.ContainerCacheRoot, string(current.UID)+"_"+currentCtr.Name)
+		if err := a.begin(AllocatePhaseLimits); err != nil {
+			return fail(err)
 		}
-		if config.DisableCoreLimit {
-			response.Envs[api.CoreLimitSwitch] = "disable"
+		if _, err := os.Stat(cacheFileHostDirectory); os.IsNotExist(err) {
+			created = append(created, cacheFileHostDirectory)
 		}
-		cacheFileHostDirectory := "/usr/local/vgpu/containers/" + string(current.UID) + "_" + currentCtr.Name
-		os.MkdirAll(cacheFileHostDirectory, 0777)
-		os.Chmod(cacheFileHostDirectory, 0777)
-		os.MkdirAll("/tmp/vgpulock", 0777)
-		os.Chmod("/tmp/vgpulock", 0777)
-		hostHookPath := os.Getenv("HOOK_PATH")
+		gen, err := prepareCacheDir(cacheFileHostDirectory)
+		if err != nil {
+			return fail(err)
+		}
+		if err := a.begin(AllocatePhaseResponse); err != nil {
+			return fail(err)
+		}
+		response, err := m.limitedResponse(devreq, cacheFileHostDirectory, gen, allowsManagedMemory(current), bandwidth, memoryTier(current))
+		if err != nil {
+			return fail(err)
+		}
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	// the devices are handed out from here on
+	if err := a.ctx.Err(); err != nil {
+		return fail(err)
+	}
+	reportAllocated(current, allocated)
+	return &responses, nil
+}
+
+// prepareCacheDir creates the cache directory dir of a container and returns its next
+// generation, see nextGeneration.
+var prepareCacheDir = func(dir string) (int64, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, err
+	}
+	os.Chmod(dir, 0777)
+	return nextGeneration(dir)
+}
+
+// limitedResponse hands the devices of devreq to a container with their memory and core
+// limits enforced, the container's shared region cache being generation gen in dir on the
+// host, see prepareCacheDir. With managedMemory the container also gets the device plus
+// host memory budgets of managedMemoryBudget, on top of its device memory limits, which stay
+// at the memory the scheduler reserved. A memory bandwidth limit other than 0 is passed on where
+// config.MemoryBandwidthLimit is set, a memory tier other than "" where config.MemoryTiers is.
+// The limits are passed as config.LimitDelivery says, see deliverLimits.
+func (m *NvidiaDevicePlugin) limitedResponse(devreq util.ContainerDevices, dir string, gen int64, managedMemory bool, bandwidth int32, tier string) (*pluginapi.ContainerAllocateResponse, error) {
+	response := pluginapi.ContainerAllocateResponse{}
+	response.Envs = make(map[string]string)
+	var uuids []string
+	for i, dev := range devreq {
+		limitKey := fmt.Sprintf("CUDA_DEVICE_MEMORY_LIMIT_%v", i)
+		response.Envs[limitKey] = memoryLimitEnv(dev.Usedmem)
+		if managedMemory {
+			response.Envs[fmt.Sprintf("CUDA_MANAGED_MEMORY_LIMIT_%v", i)] = memoryLimitEnv(managedMemoryBudget(dev.Usedmem))
+		}
+		uuids = append(uuids, dev.UUID)
+	}
+	setVisibleDevices(&response, uuids)
+	response.Envs["CUDA_DEVICE_SM_LIMIT"] = fmt.Sprint(devreq[0].Usedcores)
+	response.Envs["CUDA_DEVICE_MEMORY_SHARED_CACHE"] = "/tmp/vgpu/" + regionFile(gen)
+	response.Envs[HeartbeatEnv] = "/tmp/vgpu/" + heartbeatFile
+	response.Envs[GenerationEnv] = fmt.Sprint(gen)
+	if m.profile != nil && m.profile.MemoryScaling() > 1 {
+		response.Envs["CUDA_OVERSUBSCRIBE"] = "true"
+	}
+	if managedMemory {
+		// the hook library pages what exceeds the free device memory to host memory
+		response.Envs["CUDA_OVERSUBSCRIBE"] = "true"
+	}
+	if config.DisableCoreLimit {
+		response.Envs[api.CoreLimitSwitch] = "disable"
+	}
+	if bandwidth > 0 && bandwidth < 100 {
+		if config.MemoryBandwidthLimit {
+			response.Envs[MemoryBandwidthEnv] = fmt.Sprint(bandwidth)
+		} else {
+			klog.Warningf("Ignoring the memory bandwidth limit of %v%% for %v, the hook library can't enforce it", bandwidth, annotations.EncodeContainerDevices(devreq))
+		}
+	}
+	if tier != "" && config.MemoryTiers {
+		response.Envs[MemoryTierEnv] = tier
+	}
+	response.Envs[EnforcementEnv] = config.Enforcement
+	if config.InjectAssignmentEnv {
+		setAssignmentEnvs(&response, devreq)
+	}
+	os.MkdirAll("/tmp/vgpulock", 0777)
+	os.Chmod("/tmp/vgpulock", 0777)
+	hostHookPath := os.Getenv("HOOK_PATH")
+	switch config.Enforcement {
+	case EnforcementHook:
 		response.Mounts = append(response.Mounts,
 			&pluginapi.Mount{ContainerPath: "/usr/local/vgpu/libvgpu.so",
 				HostPath: hostHookPath + "/libvgpu.so",
@@ -383,18 +728,175 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 			&pluginapi.Mount{ContainerPath: "/etc/ld.so.preload",
 				HostPath: hostHookPath + "/ld.so.preload",
 				ReadOnly: true},
-			&pluginapi.Mount{ContainerPath: "/tmp/vgpu",
-				HostPath: cacheFileHostDirectory,
-				ReadOnly: false},
-			&pluginapi.Mount{ContainerPath: "/tmp/vgpulock",
-				HostPath: "/tmp/vgpulock",
-				ReadOnly: false},
 		)
-		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
-	klog.Infoln("Allocate Response", responses.ContainerResponses)
-	util.PodAllocationTrySuccess(nodename, current)
-	return &responses, nil
+	if config.Enforcement == EnforcementCgroup || config.StrictDeviceVisibility {
+		devs, err := m.devicesByUUID(devreq)
+		if err != nil {
+			return nil, err
+		}
+		response.Devices = apiDeviceSpecs(devs)
+	}
+	response.Mounts = append(response.Mounts,
+		&pluginapi.Mount{ContainerPath: "/tmp/vgpu",
+			HostPath: dir,
+			ReadOnly: false},
+		&pluginapi.Mount{ContainerPath: "/tmp/vgpulock",
+			HostPath: "/tmp/vgpulock",
+			ReadOnly: false},
+	)
+	if err := deliverLimits(&response, dir); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// reportAllocated records the devices handed to the containers of pod, by name, in its
+// util.AllocatedIDsAnnotations, from which the scheduler learns what was really allocated.
+// The report is best effort, the scheduler falls back to the pod's status without it.
+func reportAllocated(pod *corev1.Pod, allocated map[string]util.ContainerDevices) {
+	devices, err := annotations.DecodePodDevices(pod.Annotations[util.AllocatedIDsAnnotations])
+	if err != nil {
+		klog.Warningf("pod %v/%v annotation %v: %v, replacing it", pod.Namespace, pod.Name, util.AllocatedIDsAnnotations, err)
+		devices = nil
+	}
+	for len(devices) < len(pod.Spec.Containers) {
+		devices = append(devices, util.ContainerDevices{})
+	}
+	for idx, ctr := range pod.Spec.Containers {
+		if devs, ok := allocated[ctr.Name]; ok {
+			devices[idx] = devs
+		}
+	}
+	newannos := map[string]string{util.AllocatedIDsAnnotations: annotations.EncodePodDevices(devices)}
+	if err := util.PatchPodAnnotations(pod, newannos); err != nil {
+		klog.Errorf("report devices allocated to pod %v/%v: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// passthroughResponse hands whole GPUs to a container of a pod in util.GPUModeExclusive,
+// see util.PodGPUMode: no hook library, limits or shared cache are
+// injected, the scheduler reserved the GPUs entirely and keeps other pods off them.
+func (m *NvidiaDevicePlugin) passthroughResponse(devreq util.ContainerDevices) (*pluginapi.ContainerAllocateResponse, error) {
+	response := &pluginapi.ContainerAllocateResponse{Envs: make(map[string]string)}
+	var uuids []string
+	for _, dev := range devreq {
+		uuids = append(uuids, dev.UUID)
+	}
+	setVisibleDevices(response, uuids)
+	response.Envs[EnforcementEnv] = EnforcementPassthrough
+	if config.InjectAssignmentEnv {
+		setAssignmentEnvs(response, devreq)
+		response.Envs[CoreLimitEnv] = "0"
+	}
+	if config.Enforcement == EnforcementCgroup || config.StrictDeviceVisibility {
+		devs, err := m.devicesByUUID(devreq)
+		if err != nil {
+			return nil, err
+		}
+		response.Devices = apiDeviceSpecs(devs)
+	}
+	return response, nil
+}
+
+// checkFreeMemory fails when a GPU has less free memory than the limit of the container,
+// which can happen when memory is oversubscribed, so kubelet fails the pod instead of
+// starting a container bound to run out of memory. The free memory is the one of the
+// last NVML sample, Allocate doesn't wait for NVML.
+func checkFreeMemory(cache *DeviceCache, devreq util.ContainerDevices) error {
+	for _, dev := range devreq {
+		sample, ok := cache.Sample(dev.UUID)
+		if !ok {
+			return fmt.Errorf("check free memory of device %v: NVML didn't answer for it yet", dev.UUID)
+		}
+		if free := sample.Free; free < uint64(dev.Usedmem) {
+			return fmt.Errorf("device %v has %vm free memory, less than the %vm requested", dev.UUID, free, dev.Usedmem)
+		}
+	}
+	return nil
+}
+
+// memoryTier returns the memory tier the scheduler placed pod in, "" if none or unknown.
+func memoryTier(pod *corev1.Pod) string {
+	switch tier := pod.Annotations[util.MemoryTierAnnotation]; tier {
+	case util.MemoryTierGuaranteed, util.MemoryTierBestEffort:
+		return tier
+	case "":
+	default:
+		klog.Warningf("pod %v annotation %v: unknown memory tier %q", util.PodRef(pod.Namespace, pod.Name), util.MemoryTierAnnotation, tier)
+	}
+	return ""
+}
+
+// allowsManagedMemory tells whether the containers of pod get the device plus host memory
+// budget of util.AllowManagedMemoryAnnotation, which only the hook library enforces.
+func allowsManagedMemory(pod *corev1.Pod) bool {
+	if pod.Annotations[util.AllowManagedMemoryAnnotation] != "true" {
+		return false
+	}
+	if config.Enforcement != EnforcementHook {
+		klog.Warningf("Ignoring %v of pod %v, %s enforcement can't page memory to the host", util.AllowManagedMemoryAnnotation, util.PodRef(pod.Namespace, pod.Name), config.Enforcement)
+		return false
+	}
+	return true
+}
+
+// managedMemoryBudget is the device plus host memory budget in MiB of a container allowed
+// to use managed memory with usedmem MiB of device memory, config.ManagedMemoryRatio times
+// usedmem. The hook library keeps the device part within usedmem and pages the rest to
+// host memory.
+func managedMemoryBudget(usedmem int32) int32 {
+	limit := float64(usedmem) * config.ManagedMemoryRatio
+	if limit > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(limit)
+}
+
+// memoryLimitEnv is the value of CUDA_DEVICE_MEMORY_LIMIT_x for usedmem MiB.
+func memoryLimitEnv(usedmem int32) string {
+	return fmt.Sprintf("%vm", usedmem)
+}
+
+// setAssignmentEnvs tells the container which GPUs it got and its limits, derived from the
+// same values as the limits passed to the hook library. Lists follow the device order of
+// NVIDIA_VISIBLE_DEVICES, a core limit of 0 means the cores aren't limited.
+func setAssignmentEnvs(response *pluginapi.ContainerAllocateResponse, devreq util.ContainerDevices) {
+	var uuids, mems []string
+	for _, dev := range devreq {
+		uuids = append(uuids, dev.UUID)
+		mems = append(mems, fmt.Sprint(dev.Usedmem))
+	}
+	response.Envs[AssignedUUIDEnv] = strings.Join(uuids, ",")
+	response.Envs[MemoryLimitEnv] = strings.Join(mems, ",")
+	cores := devreq[0].Usedcores
+	if config.DisableCoreLimit {
+		cores = 0
+	}
+	response.Envs[CoreLimitEnv] = fmt.Sprint(cores)
+}
+
+// allocateUnapproved exposes the GPUs kubelet picked without any limits, it is only
+// used when scheduler approval is disabled for debugging.
+func (m *NvidiaDevicePlugin) allocateUnapproved(reqs *pluginapi.AllocateRequest) *pluginapi.AllocateResponse {
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		ids := append([]string(nil), req.DevicesIDs...)
+		sort.Strings(ids)
+		var uuids []string
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			uuid := deviceUUID(id)
+			if !seen[uuid] {
+				seen[uuid] = true
+				uuids = append(uuids, uuid)
+			}
+		}
+		response := &pluginapi.ContainerAllocateResponse{Envs: make(map[string]string)}
+		setVisibleDevices(response, uuids)
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	return &responses
 }
 
 // PreStartContainer is unimplemented for this plugin
@@ -420,7 +922,7 @@ func (m *NvidiaDevicePlugin) dial(unixSocketPath string, timeout time.Duration)
 
 func (m *NvidiaDevicePlugin) Devices() []*Device {
 	if strings.Compare(m.migStrategy, "none") == 0 {
-		return m.deviceCache.GetCache()
+		return m.deviceCache.ProfileDevices(m.profile.Name)
 	}
 	if strings.Compare(m.migStrategy, "mixed") == 0 {
 		return m.ResourceManager.Devices()
@@ -439,22 +941,68 @@ func (m *NvidiaDevicePlugin) deviceExists(id string) bool {
 	return false
 }
 
+func (m *NvidiaDevicePlugin) devicesByUUID(devreq util.ContainerDevices) ([]*Device, error) {
+	var res []*Device
+	for _, dev := range devreq {
+		found := false
+		for _, d := range m.Devices() {
+			if d.ID == dev.UUID {
+				res = append(res, d)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("device %v not found on this node", dev.UUID)
+		}
+	}
+	return res, nil
+}
+
+// checkWholeDevices refuses the GPUs of devreq the container gets only part of the memory
+// of. Without enforcement nothing holds a container to its share, it could take the memory
+// of the co-tenants the scheduler placed next to it.
+func (m *NvidiaDevicePlugin) checkWholeDevices(devreq util.ContainerDevices) error {
+	devs, err := m.devicesByUUID(devreq)
+	if err != nil {
+		return err
+	}
+	for i, d := range devs {
+		if uint64(devreq[i].Usedmem) < d.Memory {
+			return fmt.Errorf("%vm of the %vm of device %v can't be enforced with %v enforcement, request whole GPUs or install the hook library on the node",
+				devreq[i].Usedmem, d.Memory, d.ID, EnforcementNone)
+		}
+	}
+	return nil
+}
+
 func (m *NvidiaDevicePlugin) deviceIDsFromUUIDs(uuids []string) []string {
 	return uuids
 }
 
+// sortDevices orders devices by UUID, so kubelet sees the same list whatever
+// order NVML enumerated them in.
+func sortDevices(devs []*Device) []*Device {
+	res := append([]*Device(nil), devs...)
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
 func (m *NvidiaDevicePlugin) apiDevices() []*pluginapi.Device {
 	if strings.Compare(m.migStrategy, "mixed") == 0 {
 		var pdevs []*pluginapi.Device
-		for _, d := range m.cachedDevices {
+		for _, d := range sortDevices(m.cachedDevices) {
 			pdevs = append(pdevs, &d.Device)
 		}
 		return pdevs
 	}
-	devices := m.Devices()
+	devices := sortDevices(m.Devices())
 	var res []*pluginapi.Device
 	for _, dev := range devices {
-		for i := uint(0); i < config.DeviceSplitCount; i++ {
+		if m.deviceCache.LegacyHeld(dev.ID) {
+			continue
+		}
+		for i := uint(0); i < splitCount(m.profile, dev.ID); i++ {
 			id := fmt.Sprintf("%v-%v", dev.ID, i)
 			res = append(res, &pluginapi.Device{
 				ID:       id,
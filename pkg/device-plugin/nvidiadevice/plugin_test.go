@@ -0,0 +1,655 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func setupAllocate(t testing.TB, toAllocate string) (*NvidiaDevicePlugin, *fake.Clientset) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid", Annotations: map[string]string{
+			util.BindTimeAnnotations:              "0",
+			util.DeviceBindPhase:                  util.DeviceBindAllocating,
+			util.AssignedNodeAnnotations:          "node1",
+			util.AssignedIDsToAllocateAnnotations: toAllocate,
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{
+		util.NodeLockTime: "locked",
+	}}}
+	client := fake.NewSimpleClientset(pod, node)
+	oldClient, oldRoot, oldEnforcement := util.GetClient(), config.ContainerCacheRoot, config.Enforcement
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		config.ContainerCacheRoot, config.Enforcement = oldRoot, oldEnforcement
+	})
+	util.SetClient(client)
+	config.ContainerCacheRoot = t.TempDir()
+	config.Enforcement = EnforcementCgroup
+	t.Setenv("NODE_NAME", "node1")
+
+	cache := &DeviceCache{cache: []*Device{
+		{Device: pluginapi.Device{ID: "GPU-0"}, Paths: []string{"/dev/nvidia0"}},
+		{Device: pluginapi.Device{ID: "GPU-1"}, Paths: []string{"/dev/nvidia1"}},
+	}}
+	return &NvidiaDevicePlugin{deviceCache: cache, migStrategy: "none", profile: DefaultProfile()}, client
+}
+
+func allocateRequest(ids ...string) *pluginapi.AllocateRequest {
+	return &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}}}
+}
+
+func TestAllocateRollsBackOnPartialFailure(t *testing.T) {
+	// GPU-9 has left the node since the pod was scheduled.
+	toAllocate := "GPU-0,NVIDIA,1000,30:GPU-9,NVIDIA,1000,30:"
+	m, client := setupAllocate(t, toAllocate)
+
+	_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-9-0"))
+	assert.ErrorContains(t, err, "GPU-9")
+
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.AssignedIDsToAllocateAnnotations], toAllocate)
+	assert.Equal(t, pod.Annotations[util.DeviceBindPhase], util.DeviceBindFailed)
+	_, reported := pod.Annotations[util.AllocatedIDsAnnotations]
+	assert.Assert(t, !reported)
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	_, locked := node.Annotations[util.NodeLockTime]
+	assert.Assert(t, !locked)
+	entries, err := os.ReadDir(config.ContainerCacheRoot)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestAllocateTakesAllDevices(t *testing.T) {
+	m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:GPU-1,NVIDIA,1000,30:")
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-1-0"))
+	assert.NilError(t, err)
+	assert.Equal(t, res.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"], "GPU-0,GPU-1")
+
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.AssignedIDsToAllocateAnnotations], "")
+	assert.Equal(t, pod.Annotations[util.DeviceBindPhase], util.DeviceBindSuccess)
+	assert.Equal(t, pod.Annotations[util.AllocatedIDsAnnotations], "GPU-0,NVIDIA,1000,30:GPU-1,NVIDIA,1000,30:")
+}
+
+func TestAllocateRequiresSchedulerApproval(t *testing.T) {
+	for name, annos := range map[string]map[string]string{
+		"unapproved":   nil,
+		"another node": {util.BindTimeAnnotations: "0", util.DeviceBindPhase: util.DeviceBindAllocating, util.AssignedNodeAnnotations: "node2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+			pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+			assert.NilError(t, err)
+			pod.Annotations = annos
+			_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+			assert.NilError(t, err)
+
+			_, err = m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+			assert.ErrorContains(t, err, "vGPU scheduler")
+		})
+	}
+}
+
+func TestAllocateWithoutSchedulerApproval(t *testing.T) {
+	m, client := setupAllocate(t, "")
+	assert.NilError(t, client.CoreV1().Pods("default").Delete(context.Background(), "p", metav1.DeleteOptions{}))
+	old := config.RequireSchedulerApproval
+	t.Cleanup(func() { config.RequireSchedulerApproval = old })
+	config.RequireSchedulerApproval = false
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-0-1", "GPU-1-0"))
+	assert.NilError(t, err)
+	assert.Equal(t, res.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"], "GPU-0,GPU-1")
+}
+
+func TestAllocateStrictMemoryCheck(t *testing.T) {
+	toAllocate := "GPU-0,NVIDIA,1000,30:GPU-1,NVIDIA,4000,30:"
+	m, client := setupAllocate(t, toAllocate)
+	oldCheck := config.StrictBindTimeMemoryCheck
+	t.Cleanup(func() { config.StrictBindTimeMemoryCheck = oldCheck })
+	config.StrictBindTimeMemoryCheck = true
+	free := map[string]uint64{"GPU-0": 8000, "GPU-1": 3000}
+	setFree := func(cache *DeviceCache) {
+		cache.samples = make(map[string]DeviceSample)
+		for id, f := range free {
+			cache.samples[id] = DeviceSample{Free: f}
+		}
+		cache.publish(nil)
+	}
+	setFree(m.deviceCache)
+
+	_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-1-0"))
+	assert.ErrorContains(t, err, "device GPU-1 has 3000m free memory, less than the 4000m requested")
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.DeviceBindPhase], util.DeviceBindFailed)
+
+	m, _ = setupAllocate(t, toAllocate)
+	free["GPU-1"] = 4000
+	setFree(m.deviceCache)
+	_, err = m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-1-0"))
+	assert.NilError(t, err)
+}
+
+func TestAPIDevicesOrderIsStable(t *testing.T) {
+	devs := []*Device{
+		{Device: pluginapi.Device{ID: "GPU-c", Health: pluginapi.Healthy}},
+		{Device: pluginapi.Device{ID: "GPU-a", Health: pluginapi.Healthy}},
+		{Device: pluginapi.Device{ID: "GPU-b", Health: pluginapi.Unhealthy}},
+	}
+	profile := &Profile{DeviceSplitCount: 2}
+	var want []*pluginapi.Device
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		cache := &DeviceCache{}
+		for _, i := range order {
+			cache.cache = append(cache.cache, devs[i])
+		}
+		m := &NvidiaDevicePlugin{deviceCache: cache, migStrategy: "none", profile: profile}
+		got := m.apiDevices()
+		if want == nil {
+			want = got
+			continue
+		}
+		assert.DeepEqual(t, got, want)
+	}
+	var ids []string
+	for _, d := range want {
+		ids = append(ids, d.ID)
+	}
+	assert.DeepEqual(t, ids, []string{"GPU-a-0", "GPU-a-1", "GPU-b-0", "GPU-b-1", "GPU-c-0", "GPU-c-1"})
+}
+
+func TestAllocateOrdersDevices(t *testing.T) {
+	m, _ := setupAllocate(t, "GPU-1,NVIDIA,2000,30:GPU-0,NVIDIA,1000,30:")
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-1-0", "GPU-0-0"))
+	assert.NilError(t, err)
+	envs := res.ContainerResponses[0].Envs
+	assert.Equal(t, envs["NVIDIA_VISIBLE_DEVICES"], "GPU-0,GPU-1")
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "1000m")
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_1"], "2000m")
+}
+
+func TestAllocateStrictDeviceVisibility(t *testing.T) {
+	m, _ := setupAllocate(t, "GPU-1,NVIDIA,1000,30:")
+	oldStrict := config.StrictDeviceVisibility
+	t.Cleanup(func() { config.StrictDeviceVisibility = oldStrict })
+	config.Enforcement, config.StrictDeviceVisibility = EnforcementHook, true
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-1-0"))
+	assert.NilError(t, err)
+	var paths []string
+	for _, d := range res.ContainerResponses[0].Devices {
+		paths = append(paths, d.HostPath)
+	}
+	// control devices are only passed if they exist on the test host
+	assert.Equal(t, paths[len(paths)-1], "/dev/nvidia1")
+	assert.Assert(t, !contains(paths, "/dev/nvidia0"))
+	assert.Equal(t, res.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"], "GPU-1")
+}
+
+func TestAllocateVolumeMountsDeviceList(t *testing.T) {
+	m, _ := setupAllocate(t, "GPU-0,NVIDIA,1000,30:GPU-1,NVIDIA,1000,30:")
+	oldStrategy := config.DeviceListStrategy
+	t.Cleanup(func() { config.DeviceListStrategy = oldStrategy })
+	config.DeviceListStrategy = DeviceListStrategyVolumeMounts
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-1-0"))
+	assert.NilError(t, err)
+	resp := res.ContainerResponses[0]
+	assert.Equal(t, resp.Envs["NVIDIA_VISIBLE_DEVICES"], "/var/run/nvidia-container-devices")
+	var mounts []string
+	for _, mnt := range resp.Mounts {
+		if mnt.HostPath == "/dev/null" {
+			mounts = append(mounts, mnt.ContainerPath)
+		}
+	}
+	assert.DeepEqual(t, mounts, []string{"/var/run/nvidia-container-devices/GPU-0", "/var/run/nvidia-container-devices/GPU-1"})
+	assert.ErrorContains(t, ValidateDeviceListStrategy("mounts"), "unknown device list strategy")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeListAndWatchServer struct {
+	grpc.ServerStream
+	ctx     context.Context
+	sendErr error
+	// sent, if set, receives a value on every Send
+	sent chan struct{}
+}
+
+func (f *fakeListAndWatchServer) Send(*pluginapi.ListAndWatchResponse) error {
+	if f.sent != nil {
+		f.sent <- struct{}{}
+	}
+	return f.sendErr
+}
+
+func (f *fakeListAndWatchServer) Context() context.Context {
+	return f.ctx
+}
+
+func TestListAndWatchReportsLostStream(t *testing.T) {
+	disconnected := make(chan string, 1)
+	m := &NvidiaDevicePlugin{
+		resourceName: "test.io/lost-stream",
+		deviceCache:  &DeviceCache{cache: []*Device{{Device: pluginapi.Device{ID: "GPU-0"}}}},
+		migStrategy:  "none",
+		profile:      DefaultProfile(),
+		stop:         make(chan interface{}),
+		health:       make(chan *Device),
+	}
+	m.SetDisconnectChannel(disconnected)
+
+	err := m.ListAndWatch(&pluginapi.Empty{}, &fakeListAndWatchServer{ctx: context.Background(), sendErr: errors.New("transport is closing")})
+	assert.ErrorContains(t, err, "transport is closing")
+	assert.Equal(t, <-disconnected, "test.io/lost-stream")
+
+	// kubelet going away without a send error is a lost stream as well
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = m.ListAndWatch(&pluginapi.Empty{}, &fakeListAndWatchServer{ctx: ctx})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, <-disconnected, "test.io/lost-stream")
+	assert.Equal(t, testutil.ToFloat64(ListAndWatchDisconnects.WithLabelValues("test.io/lost-stream")), float64(2))
+
+	// a stream ended by our own Stop is not
+	close(m.stop)
+	assert.NilError(t, m.ListAndWatch(&pluginapi.Empty{}, &fakeListAndWatchServer{ctx: ctx}))
+	assert.Equal(t, len(disconnected), 0)
+}
+
+func TestAllocateAllowsManagedMemory(t *testing.T) {
+	m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+	oldRatio := config.ManagedMemoryRatio
+	t.Cleanup(func() { config.ManagedMemoryRatio = oldRatio })
+	config.ManagedMemoryRatio = 2.5
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	pod.Annotations[util.AllowManagedMemoryAnnotation] = "true"
+	_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+
+	// only the hook library pages memory to the host
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+	envs := res.ContainerResponses[0].Envs
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "1000m")
+	_, ok := envs["CUDA_OVERSUBSCRIBE"]
+	assert.Assert(t, !ok)
+
+	// the device memory limit stays at the reservation, the hook library pages up to the
+	// budget to host memory
+	config.Enforcement = EnforcementHook
+	pod, err = client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	pod.Annotations[util.DeviceBindPhase] = util.DeviceBindAllocating
+	pod.Annotations[util.AssignedIDsToAllocateAnnotations] = "GPU-0,NVIDIA,1000,30:"
+	_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	res, err = m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+	envs = res.ContainerResponses[0].Envs
+	assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "1000m")
+	assert.Equal(t, envs["CUDA_MANAGED_MEMORY_LIMIT_0"], "2500m")
+	assert.Equal(t, envs["CUDA_OVERSUBSCRIBE"], "true")
+}
+
+func TestAllocateMemoryTier(t *testing.T) {
+	oldTiers := config.MemoryTiers
+	t.Cleanup(func() { config.MemoryTiers = oldTiers })
+	allocate := func(tier string) map[string]string {
+		m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+		pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+		assert.NilError(t, err)
+		pod.Annotations[util.MemoryTierAnnotation] = tier
+		_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+		res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+		assert.NilError(t, err)
+		return res.ContainerResponses[0].Envs
+	}
+
+	config.MemoryTiers = true
+	assert.Equal(t, allocate(util.MemoryTierBestEffort)[MemoryTierEnv], util.MemoryTierBestEffort)
+	assert.Equal(t, allocate(util.MemoryTierGuaranteed)[MemoryTierEnv], util.MemoryTierGuaranteed)
+	_, ok := allocate("gold")[MemoryTierEnv]
+	assert.Assert(t, !ok)
+
+	// left out where the hook library doesn't read it
+	config.MemoryTiers = false
+	_, ok = allocate(util.MemoryTierBestEffort)[MemoryTierEnv]
+	assert.Assert(t, !ok)
+	assert.Assert(t, !DetectMemoryTiers(EnforcementCgroup, []string{HookMemoryTiers}))
+	assert.Assert(t, !DetectMemoryTiers(EnforcementHook, []string{HookMemoryBandwidth}))
+	assert.Assert(t, DetectMemoryTiers(EnforcementHook, []string{HookMemoryBandwidth, HookMemoryTiers}))
+}
+
+func TestAllocateMemoryBandwidth(t *testing.T) {
+	oldLimit := config.MemoryBandwidthLimit
+	t.Cleanup(func() { config.MemoryBandwidthLimit = oldLimit })
+	allocate := func(val string) (*pluginapi.AllocateResponse, error) {
+		m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+		pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+		assert.NilError(t, err)
+		pod.Annotations[util.MemoryBandwidthAnnotation] = val
+		_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+		return m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	}
+
+	config.MemoryBandwidthLimit = true
+	res, err := allocate("40")
+	assert.NilError(t, err)
+	assert.Equal(t, res.ContainerResponses[0].Envs[MemoryBandwidthEnv], "40")
+	_, err = allocate("140")
+	assert.ErrorContains(t, err, "annotation "+util.MemoryBandwidthAnnotation)
+
+	// ignored where the hook library can't enforce it
+	config.MemoryBandwidthLimit = false
+	res, err = allocate("40")
+	assert.NilError(t, err)
+	_, ok := res.ContainerResponses[0].Envs[MemoryBandwidthEnv]
+	assert.Assert(t, !ok)
+
+	assert.Assert(t, !DetectMemoryBandwidthLimit(EnforcementHook, nil))
+	assert.Assert(t, !DetectMemoryBandwidthLimit(EnforcementCgroup, []string{HookMemoryBandwidth}))
+	assert.Assert(t, DetectMemoryBandwidthLimit(EnforcementHook, []string{HookMemoryBandwidth}))
+	assert.NilError(t, CheckHookCapabilities([]string{HookMemoryBandwidth, HookMemoryTiers}))
+	assert.ErrorContains(t, CheckHookCapabilities([]string{"membw"}), "unknown hook library capability")
+}
+
+type fakeRegistrationServer struct {
+	calls int
+	fail  int
+	// versions are the device plugin API versions served, like kubelet's when set
+	versions []string
+	// requested are the versions of the registrations received
+	requested []string
+}
+
+func (f *fakeRegistrationServer) Register(_ context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	f.calls++
+	f.requested = append(f.requested, req.Version)
+	if f.calls <= f.fail {
+		return nil, errors.New("kubelet is not ready")
+	}
+	if f.versions != nil {
+		served := false
+		for _, v := range f.versions {
+			served = served || v == req.Version
+		}
+		if !served {
+			return nil, fmt.Errorf("requested API version %q is not supported by kubelet. Supported versions are %q", req.Version, f.versions)
+		}
+	}
+	return &pluginapi.Empty{}, nil
+}
+
+func setupRegister(t *testing.T, retries int) string {
+	oldDir, oldBackoff := config.DevicePluginPath, registerBackoff
+	oldTimeout, oldRetries := config.RegisterTimeout, config.RegisterRetries
+	t.Cleanup(func() {
+		config.DevicePluginPath, registerBackoff = oldDir, oldBackoff
+		config.RegisterTimeout, config.RegisterRetries = oldTimeout, oldRetries
+	})
+	config.DevicePluginPath = t.TempDir()
+	registerBackoff = time.Millisecond
+	config.RegisterTimeout, config.RegisterRetries = time.Second, retries
+	return KubeletSocket()
+}
+
+func TestRegisterRetries(t *testing.T) {
+	socket := setupRegister(t, 2)
+	ln, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	server := grpc.NewServer()
+	registration := &fakeRegistrationServer{fail: 2}
+	pluginapi.RegisterRegistrationServer(server, registration)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	m := &NvidiaDevicePlugin{resourceName: "test.io/register", socket: "test.sock"}
+	assert.NilError(t, m.Register())
+	assert.Equal(t, registration.calls, 3)
+}
+
+func TestRegisterGivesUp(t *testing.T) {
+	setupRegister(t, 1)
+	config.RegisterTimeout = 50 * time.Millisecond
+
+	m := &NvidiaDevicePlugin{resourceName: "test.io/register", socket: "test.sock"}
+	start := time.Now()
+	assert.Assert(t, m.Register() != nil)
+	assert.Assert(t, time.Since(start) >= 2*config.RegisterTimeout)
+}
+
+func TestAllocateInjectsAssignmentEnv(t *testing.T) {
+	m, _ := setupAllocate(t, "GPU-1,NVIDIA,2000,30:GPU-0,NVIDIA,1000,30:")
+	oldInject, oldDisable := config.InjectAssignmentEnv, config.DisableCoreLimit
+	t.Cleanup(func() { config.InjectAssignmentEnv, config.DisableCoreLimit = oldInject, oldDisable })
+	config.InjectAssignmentEnv = true
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-1-0", "GPU-0-0"))
+	assert.NilError(t, err)
+	envs := res.ContainerResponses[0].Envs
+	assert.Equal(t, envs[AssignedUUIDEnv], envs["NVIDIA_VISIBLE_DEVICES"])
+	assert.Equal(t, envs[AssignedUUIDEnv], "GPU-0,GPU-1")
+	assert.Equal(t, envs[MemoryLimitEnv], "1000,2000")
+	assert.Equal(t, envs[CoreLimitEnv], envs["CUDA_DEVICE_SM_LIMIT"])
+
+	m, _ = setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+	config.DisableCoreLimit = true
+	res, err = m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+	assert.Equal(t, res.ContainerResponses[0].Envs[CoreLimitEnv], "0")
+}
+
+func TestAllocateRoundsCoresToGranularity(t *testing.T) {
+	oldStep := config.CoreLimitGranularity
+	t.Cleanup(func() { config.CoreLimitGranularity = oldStep })
+	config.CoreLimitGranularity = 10
+
+	m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,25:GPU-1,NVIDIA,1000,25:")
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-1-0"))
+	assert.NilError(t, err)
+	assert.Equal(t, res.ContainerResponses[0].Envs["CUDA_DEVICE_SM_LIMIT"], "30")
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.AllocatedIDsAnnotations], "GPU-0,NVIDIA,1000,30:GPU-1,NVIDIA,1000,30:")
+
+	for cores, want := range map[int32]int32{0: 0, 14: 10, 96: 100, 100: 100} {
+		got, err := enforcedCores(cores)
+		assert.NilError(t, err)
+		assert.Equal(t, got, want)
+	}
+
+	m, client = setupAllocate(t, "GPU-0,NVIDIA,1000,5:")
+	_, err = m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.ErrorContains(t, err, "steps of 10%")
+	pod, err = client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, pod.Annotations[util.DeviceBindPhase], util.DeviceBindFailed)
+}
+
+func TestAllocateExclusivePassthrough(t *testing.T) {
+	m, client := setupAllocate(t, "GPU-0,NVIDIA,16000,100:")
+	oldInject := config.InjectAssignmentEnv
+	t.Cleanup(func() { config.InjectAssignmentEnv = oldInject })
+	config.InjectAssignmentEnv = true
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	pod.Annotations[util.ExclusivePassthroughAnnotation] = "true"
+	_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+	resp := res.ContainerResponses[0]
+	assert.DeepEqual(t, resp.Envs, map[string]string{
+		"NVIDIA_VISIBLE_DEVICES": "GPU-0",
+		EnforcementEnv:           EnforcementPassthrough,
+		AssignedUUIDEnv:          "GPU-0",
+		MemoryLimitEnv:           "16000",
+		CoreLimitEnv:             "0",
+	})
+	assert.Equal(t, len(resp.Mounts), 0)
+	assert.Equal(t, resp.Devices[len(resp.Devices)-1].HostPath, "/dev/nvidia0")
+	entries, err := os.ReadDir(config.ContainerCacheRoot)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestAllocateGPUMode(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		annos       map[string]string
+		passthrough bool
+	}{
+		{"exclusive", map[string]string{util.GPUModeAnnotation: util.GPUModeExclusive}, true},
+		{"dedicated", map[string]string{util.GPUModeAnnotation: util.GPUModeDedicated}, false},
+		// the gpu mode wins over the exclusive passthrough annotation
+		{"dedicated over passthrough", map[string]string{util.GPUModeAnnotation: util.GPUModeDedicated, util.ExclusivePassthroughAnnotation: "true"}, false},
+		{"exclusive without passthrough", map[string]string{util.GPUModeAnnotation: util.GPUModeExclusive, util.ExclusivePassthroughAnnotation: "false"}, true},
+	} {
+		m, client := setupAllocate(t, "GPU-0,NVIDIA,16000,100:")
+		pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+		assert.NilError(t, err)
+		for k, v := range c.annos {
+			pod.Annotations[k] = v
+		}
+		_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+		assert.NilError(t, err)
+
+		res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+		assert.NilError(t, err)
+		envs := res.ContainerResponses[0].Envs
+		if c.passthrough {
+			assert.Equal(t, envs[EnforcementEnv], EnforcementPassthrough, c.name)
+			assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "", c.name)
+		} else {
+			assert.Equal(t, envs[EnforcementEnv], EnforcementCgroup, c.name)
+			assert.Equal(t, envs["CUDA_DEVICE_MEMORY_LIMIT_0"], "16000m", c.name)
+		}
+	}
+}
+
+func TestAllocateWholeDevicesWithoutEnforcement(t *testing.T) {
+	m, _ := setupAllocate(t, "GPU-0,NVIDIA,8000,30:")
+	config.Enforcement = EnforcementNone
+	m.deviceCache.cache[0].Memory = 16000
+	_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.ErrorContains(t, err, "8000m of the 16000m of device GPU-0 can't be enforced with none enforcement")
+
+	m, _ = setupAllocate(t, "GPU-0,NVIDIA,16000,100:")
+	config.Enforcement = EnforcementNone
+	m.deviceCache.cache[0].Memory = 16000
+	res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+	assert.Equal(t, res.ContainerResponses[0].Envs[EnforcementEnv], EnforcementNone)
+}
+
+func TestGetPreferredAllocationOffline(t *testing.T) {
+	oldClient := util.GetClient()
+	t.Cleanup(func() { util.SetClient(oldClient) })
+	util.SetClient(nil)
+	m := &NvidiaDevicePlugin{deviceCache: &DeviceCache{}, migStrategy: "none", profile: DefaultProfile()}
+	available := []string{
+		"GPU-a-0", "GPU-a-1", "GPU-a-2",
+		"GPU-b-0", "GPU-b-1",
+		"GPU-c-0", "GPU-c-1", "GPU-c-2",
+	}
+	request := func(available, mustInclude []string, size int32) []string {
+		res, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: available, MustIncludeDeviceIDs: mustInclude, AllocationSize: size,
+		}}})
+		assert.NilError(t, err)
+		return res.ContainerResponses[0].DeviceIDs
+	}
+
+	// the GPUs with the most free slices first, ties by UUID, one slice each before a second
+	assert.DeepEqual(t, request(available, nil, 2), []string{"GPU-a-0", "GPU-c-0"})
+	assert.DeepEqual(t, request(available, nil, 4), []string{"GPU-a-0", "GPU-c-0", "GPU-b-0", "GPU-a-1"})
+	assert.DeepEqual(t, request(available, []string{"GPU-b-1"}, 2), []string{"GPU-b-1", "GPU-a-0"})
+	// the order kubelet lists the devices in doesn't matter
+	assert.NilError(t, quick.Check(func(seed int64, size uint8) bool {
+		shuffled := append([]string(nil), available...)
+		rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		n := int32(1 + int(size)%len(available))
+		return reflect.DeepEqual(request(shuffled, nil, n), request(available, nil, n))
+	}, nil))
+
+	// with the api server but no pod waiting for its devices, the same as offline
+	util.SetClient(fake.NewSimpleClientset())
+	options, err := m.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	assert.NilError(t, err)
+	assert.Assert(t, options.GetPreferredAllocationAvailable)
+	assert.DeepEqual(t, request(available, nil, 2), []string{"GPU-a-0", "GPU-c-0"})
+}
+
+func TestGetPreferredAllocationAssigned(t *testing.T) {
+	m, _ := setupAllocate(t, "GPU-1,NVIDIA,1000,30:;GPU-0,NVIDIA,1000,30:")
+	request := func(available, mustInclude []string, size int32) []string {
+		res, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: available, MustIncludeDeviceIDs: mustInclude, AllocationSize: size,
+		}}})
+		assert.NilError(t, err)
+		return res.ContainerResponses[0].DeviceIDs
+	}
+	available := []string{"GPU-0-1", "GPU-0-0", "GPU-1-1", "GPU-1-0"}
+
+	// a split device of the GPU the scheduler assigned the next container
+	assert.DeepEqual(t, request(available, nil, 1), []string{"GPU-1-0"})
+	assert.DeepEqual(t, request(available, []string{"GPU-1-1"}, 1), []string{"GPU-1-1"})
+	// kubelet's picks for other GPUs or counts fall back to the ranking without the API server
+	assert.DeepEqual(t, request(available, []string{"GPU-0-1"}, 1), []string{"GPU-0-1"})
+	assert.DeepEqual(t, request(available, nil, 2), []string{"GPU-0-0", "GPU-1-0"})
+	assert.DeepEqual(t, request([]string{"GPU-0-0", "GPU-0-1"}, nil, 1), []string{"GPU-0-0"})
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// preferredAssigned picks size of the available split devices for the next container of
+// the pod waiting for its devices on the node, on the GPUs the scheduler assigned it, so
+// the split devices kubelet accounts as taken are those of the GPUs the container gets.
+// ok is false when there is no such pod or its GPUs can't be matched with the devices
+// kubelet offers, which then picks as without the API server.
+func (m *NvidiaDevicePlugin) preferredAssigned(ctx context.Context, available, mustInclude []string, size int) ([]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, config.APITimeout)
+	defer cancel()
+	pod, err := util.GetPendingPodWithContext(ctx, os.Getenv("NODE_NAME"))
+	if err != nil || pod == nil {
+		klog.V(4).Infof("no pod waiting for its devices, preferring devices as offline: %v", err)
+		return nil, false
+	}
+	_, devreq, err := util.GetNextDeviceRequest(util.NvidiaGPUDevice, *pod)
+	if err != nil || len(devreq) != size {
+		klog.V(4).Infof("pod %v: %v devices assigned to the next container, kubelet asks for %v: %v",
+			util.PodRef(pod.Namespace, pod.Name), len(devreq), size, err)
+		return nil, false
+	}
+	wanted := make(map[string]int, len(devreq))
+	for _, dev := range devreq {
+		wanted[dev.UUID]++
+	}
+	res := make([]string, 0, size)
+	for _, id := range mustInclude {
+		uuid := deviceUUID(id)
+		if wanted[uuid] == 0 {
+			return nil, false
+		}
+		wanted[uuid]--
+		res = append(res, id)
+	}
+	free := append([]string(nil), available...)
+	sort.Strings(free)
+	taken := make(map[string]bool, len(mustInclude))
+	for _, id := range mustInclude {
+		taken[id] = true
+	}
+	for _, id := range free {
+		if uuid := deviceUUID(id); !taken[id] && wanted[uuid] > 0 {
+			wanted[uuid]--
+			res = append(res, id)
+		}
+	}
+	if len(res) != size {
+		klog.V(4).Infof("pod %v: kubelet offers no free split device of an assigned GPU", util.PodRef(pod.Namespace, pod.Name))
+		return nil, false
+	}
+	return res, true
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// PreflightCondition is the node condition reporting whether the node's NVIDIA
+// container toolkit works with the device plugin.
+const PreflightCondition corev1.NodeConditionType = "VGPUToolkitCompatible"
+
+// minToolkitVersion is the oldest libnvidia-container release supported.
+var minToolkitVersion = [3]int{1, 7, 0}
+
+// PreflightEnv locates what the checks inspect on the host, tests point it at fixtures.
+type PreflightEnv struct {
+	// EtcDir and BinDir are the host /etc and /usr/bin as mounted into the plugin.
+	EtcDir string
+	BinDir string
+	// Run executes a command of the host and returns its output.
+	Run func(name string, args ...string) (string, error)
+}
+
+// DefaultPreflightEnv inspects the host directories mounted by the chart and runs
+// commands in the host mount namespace, which needs hostPID.
+func DefaultPreflightEnv() *PreflightEnv {
+	return &PreflightEnv{
+		EtcDir: "/hostetc",
+		BinDir: "/usrbin",
+		Run: func(name string, args ...string) (string, error) {
+			out, err := exec.Command("nsenter", append([]string{"--target", "1", "--mount", "--", name}, args...)...).CombinedOutput()
+			return string(out), err
+		},
+	}
+}
+
+// PreflightCheck returns an error describing why the node is incompatible.
+type PreflightCheck struct {
+	Name  string
+	Check func(env *PreflightEnv) error
+}
+
+// preflightChecks run in order, append new incompatibilities here.
+var preflightChecks = []PreflightCheck{
+	{Name: "nvidia-runtime", Check: checkNvidiaRuntime},
+	{Name: "runtime-hook", Check: checkRuntimeHook},
+	{Name: "toolkit-version", Check: checkToolkitVersion},
+}
+
+type PreflightResult struct {
+	Name    string
+	Skipped bool
+	Err     error
+}
+
+// RunPreflight runs every check not named in skip.
+func RunPreflight(env *PreflightEnv, skip []string) ([]PreflightResult, error) {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	var results []PreflightResult
+	for _, c := range preflightChecks {
+		if skipped[c.Name] {
+			delete(skipped, c.Name)
+			results = append(results, PreflightResult{Name: c.Name, Skipped: true})
+			continue
+		}
+		results = append(results, PreflightResult{Name: c.Name, Err: c.Check(env)})
+	}
+	for name := range skipped {
+		return nil, fmt.Errorf("unknown preflight check %q", name)
+	}
+	return results, nil
+}
+
+// PreflightError summarizes the failed checks, it is nil if all passed.
+func PreflightError(results []PreflightResult) error {
+	var msgs []string
+	for _, r := range results {
+		if r.Err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", r.Name, r.Err))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// ReportPreflight sets the preflight condition of the node and records a warning
+// event on it when a check failed.
+func ReportPreflight(ctx context.Context, client kubernetes.Interface, recorder record.EventRecorder, nodeName string, results []PreflightResult) error {
+	cond := corev1.NodeCondition{
+		Type:    PreflightCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  "PreflightPassed",
+		Message: "all preflight checks passed",
+	}
+	var skipped []string
+	for _, r := range results {
+		if r.Skipped {
+			skipped = append(skipped, r.Name)
+		}
+	}
+	if len(skipped) > 0 {
+		cond.Message += ", skipped " + strings.Join(skipped, ", ")
+	}
+	if err := PreflightError(results); err != nil {
+		cond.Status, cond.Reason, cond.Message = corev1.ConditionFalse, "PreflightFailed", err.Error()
+		ref := &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: types.UID(nodeName)}
+		recorder.Eventf(ref, corev1.EventTypeWarning, "VGPUToolkitIncompatible", "NVIDIA container toolkit is incompatible: %v", err)
+	}
+	now := metav1.NewTime(time.Now())
+	cond.LastHeartbeatTime, cond.LastTransitionTime = now, now
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"conditions": []corev1.NodeCondition{cond}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Nodes().PatchStatus(ctx, nodeName, patch)
+	return err
+}
+
+// checkNvidiaRuntime looks for the nvidia runtime in the containerd and docker configurations.
+func checkNvidiaRuntime(env *PreflightEnv) error {
+	found := false
+	b, err := os.ReadFile(filepath.Join(env.EtcDir, "containerd", "config.toml"))
+	if err == nil {
+		found = true
+		if strings.Contains(string(b), "runtimes.nvidia]") || strings.Contains(string(b), "nvidia-container-runtime") {
+			return nil
+		}
+	}
+	b, err = os.ReadFile(filepath.Join(env.EtcDir, "docker", "daemon.json"))
+	if err == nil {
+		found = true
+		var daemon struct {
+			Runtimes map[string]interface{} `json:"runtimes"`
+		}
+		if err := json.Unmarshal(b, &daemon); err != nil {
+			return fmt.Errorf("parse docker daemon.json: %v", err)
+		}
+		if _, ok := daemon.Runtimes["nvidia"]; ok {
+			return nil
+		}
+	}
+	if !found {
+		return errors.New("no containerd or docker configuration found")
+	}
+	return errors.New("the nvidia runtime is not configured in containerd or docker")
+}
+
+// checkRuntimeHook looks for the OCI hook the nvidia runtime calls.
+func checkRuntimeHook(env *PreflightEnv) error {
+	for _, name := range []string{"nvidia-container-runtime-hook", "nvidia-container-toolkit"} {
+		if _, err := os.Stat(filepath.Join(env.BinDir, name)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("nvidia-container-runtime-hook not found in %v", env.BinDir)
+}
+
+var toolkitVersionPattern = regexp.MustCompile(`(?m)^(?:lib-)?version: (\d+)\.(\d+)\.(\d+)`)
+
+// checkToolkitVersion compares the libnvidia-container version to minToolkitVersion.
+func checkToolkitVersion(env *PreflightEnv) error {
+	out, err := env.Run("nvidia-container-cli", "--version")
+	if err != nil {
+		return fmt.Errorf("run nvidia-container-cli: %v", err)
+	}
+	m := toolkitVersionPattern.FindStringSubmatch(out)
+	if m == nil {
+		return fmt.Errorf("no version in nvidia-container-cli output %q", strings.TrimSpace(out))
+	}
+	var version [3]int
+	for i := range version {
+		version[i], _ = strconv.Atoi(m[i+1])
+	}
+	for i := range version {
+		if version[i] != minToolkitVersion[i] {
+			if version[i] < minToolkitVersion[i] {
+				return fmt.Errorf("libnvidia-container %d.%d.%d is older than %d.%d.%d", version[0], version[1], version[2],
+					minToolkitVersion[0], minToolkitVersion[1], minToolkitVersion[2])
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const containerdNvidiaConfig = `version = 2
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.nvidia]
+  runtime_type = "io.containerd.runc.v2"
+  [plugins."io.containerd.grpc.v1.cri".containerd.runtimes.nvidia.options]
+    BinaryName = "/usr/bin/nvidia-container-runtime"
+`
+
+// toolkitFixture lays out a host with the given files, paths are relative to the host root.
+func toolkitFixture(t *testing.T, files map[string]string, cliVersion string) *PreflightEnv {
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NilError(t, os.WriteFile(p, []byte(content), 0755))
+	}
+	return &PreflightEnv{
+		EtcDir: filepath.Join(root, "etc"),
+		BinDir: filepath.Join(root, "usr/bin"),
+		Run: func(name string, args ...string) (string, error) {
+			if cliVersion == "" {
+				return "nsenter: failed to execute nvidia-container-cli: No such file or directory\n", errors.New("exit status 127")
+			}
+			return cliVersion, nil
+		},
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	hook := map[string]string{"usr/bin/nvidia-container-runtime-hook": ""}
+	withHook := func(files map[string]string) map[string]string {
+		for k, v := range hook {
+			files[k] = v
+		}
+		return files
+	}
+	for name, tc := range map[string]struct {
+		env  *PreflightEnv
+		skip []string
+		want map[string]string
+	}{
+		"compatible containerd": {
+			env: toolkitFixture(t, withHook(map[string]string{"etc/containerd/config.toml": containerdNvidiaConfig}),
+				"cli-version: 1.13.1\nlib-version: 1.13.1\nbuild date: 2023-04-19T14:38+00:00\n"),
+			want: map[string]string{},
+		},
+		"compatible docker": {
+			env: toolkitFixture(t, withHook(map[string]string{
+				"etc/docker/daemon.json": `{"runtimes": {"nvidia": {"path": "nvidia-container-runtime", "runtimeArgs": []}}}`,
+			}), "version: 1.7.0\n"),
+			want: map[string]string{},
+		},
+		"missing toolkit": {
+			env: toolkitFixture(t, map[string]string{"etc/containerd/config.toml": "version = 2\n"}, ""),
+			want: map[string]string{
+				"nvidia-runtime":  "the nvidia runtime is not configured",
+				"runtime-hook":    "nvidia-container-runtime-hook not found",
+				"toolkit-version": "run nvidia-container-cli: exit status 127",
+			},
+		},
+		"old toolkit": {
+			env: toolkitFixture(t, withHook(map[string]string{"etc/containerd/config.toml": containerdNvidiaConfig}),
+				"version: 1.0.0\nbuild date: 2019-06-27T10:03+0000\n"),
+			want: map[string]string{"toolkit-version": "libnvidia-container 1.0.0 is older than 1.7.0"},
+		},
+		"skipped": {
+			env:  toolkitFixture(t, withHook(map[string]string{"etc/containerd/config.toml": containerdNvidiaConfig}), "version: 1.0.0\n"),
+			skip: []string{"toolkit-version"},
+			want: map[string]string{},
+		},
+		"no runtime config": {
+			env:  toolkitFixture(t, hook, "version: 1.7.0\n"),
+			want: map[string]string{"nvidia-runtime": "no containerd or docker configuration found"},
+		},
+	} {
+		results, err := RunPreflight(tc.env, tc.skip)
+		assert.NilError(t, err, name)
+		assert.Equal(t, len(results), len(preflightChecks), name)
+		for _, r := range results {
+			msg, fail := tc.want[r.Name]
+			if !fail {
+				assert.NilError(t, r.Err, name)
+				continue
+			}
+			assert.ErrorContains(t, r.Err, msg, name)
+		}
+		assert.Equal(t, PreflightError(results) == nil, len(tc.want) == 0, name)
+	}
+
+	_, err := RunPreflight(toolkitFixture(t, nil, ""), []string{"toolkit"})
+	assert.ErrorContains(t, err, `unknown preflight check "toolkit"`)
+}
+
+func TestReportPreflight(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	recorder := record.NewFakeRecorder(10)
+	results, err := RunPreflight(toolkitFixture(t, nil, "version: 1.0.0\n"), []string{"nvidia-runtime", "runtime-hook"})
+	assert.NilError(t, err)
+
+	assert.NilError(t, ReportPreflight(context.Background(), client, recorder, "node1", results))
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(node.Status.Conditions), 1)
+	cond := node.Status.Conditions[0]
+	assert.Equal(t, cond.Type, PreflightCondition)
+	assert.Equal(t, cond.Status, corev1.ConditionFalse)
+	assert.Equal(t, cond.Message, "toolkit-version: libnvidia-container 1.0.0 is older than 1.7.0")
+	event := <-recorder.Events
+	assert.Assert(t, strings.HasPrefix(event, "Warning VGPUToolkitIncompatible"), event)
+}
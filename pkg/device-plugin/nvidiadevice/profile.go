@@ -0,0 +1,163 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// Constants to represent the capacities scaling may apply to
+const (
+	ScalingMemory = "memory"
+	ScalingCores  = "cores"
+	ScalingBoth   = "both"
+)
+
+// Profile is a pool of GPUs on a node exposed as a resource of its own, so cards
+// can be split differently on the same node. GPUs not selected by any profile
+// belong to the default profile, which is configured by the command line flags.
+type Profile struct {
+	// Name is appended to the resource name, e.g. nvidia.com/gpu-training.
+	Name string `json:"name"`
+	// Devices are the UUIDs of the GPUs in the profile.
+	Devices             []string `json:"devices"`
+	DeviceSplitCount    uint     `json:"devicesplitcount"`
+	DeviceMemoryScaling float64  `json:"devicememoryscaling"`
+}
+
+// DefaultProfile returns the profile of GPUs not selected by any configured profile, as
+// the command line flags set it. The config file and the node annotations override it
+// on a copy, which DeviceCache.SetProfiles publishes.
+func DefaultProfile() *Profile {
+	return &Profile{
+		DeviceSplitCount:    config.DeviceSplitCount,
+		DeviceMemoryScaling: config.DeviceMemoryScaling,
+	}
+}
+
+// MemoryScaling is the memory scaling of the GPUs in the profile, 1 unless
+// config.ScalingDimensions lets scaling oversubscribe memory.
+func (p *Profile) MemoryScaling() float64 {
+	if !scales(ScalingMemory) {
+		return 1
+	}
+	return p.DeviceMemoryScaling
+}
+
+// CoresScaling is config.DeviceCoresScaling, 1 unless config.ScalingDimensions lets
+// scaling oversubscribe cores.
+func CoresScaling() float64 {
+	if !scales(ScalingCores) {
+		return 1
+	}
+	return config.DeviceCoresScaling
+}
+
+func scales(dimension string) bool {
+	switch config.ScalingDimensions {
+	case "", ScalingBoth:
+		return true
+	}
+	return config.ScalingDimensions == dimension
+}
+
+// ValidateScalingDimensions checks the scaling dimensions chosen on the command line.
+func ValidateScalingDimensions(dimensions string) error {
+	switch dimensions {
+	case ScalingMemory, ScalingCores, ScalingBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown scaling dimensions %q, must be %v, %v or %v", dimensions, ScalingMemory, ScalingCores, ScalingBoth)
+}
+
+// LogScalingPolicy logs the scaling that applies to the profiles, and warns about
+// scaling factors that are set but don't change the advertised capacity.
+func LogScalingPolicy(profiles []*Profile) {
+	klog.Infof("Scaling ratios apply to %v: memory scaling %v, cores scaling %v", config.ScalingDimensions, profiles[0].MemoryScaling(), CoresScaling())
+	for _, p := range profiles {
+		if !scales(ScalingMemory) && p.DeviceMemoryScaling != 1 {
+			klog.Warningf("Ignoring memory scaling %v of profile %q, --scaling-dimensions=%v", p.DeviceMemoryScaling, p.Name, config.ScalingDimensions)
+		}
+	}
+	if config.DeviceCoresScaling == 1 {
+		return
+	}
+	if !scales(ScalingCores) {
+		klog.Warningf("Ignoring cores scaling %v, --scaling-dimensions=%v", config.DeviceCoresScaling, config.ScalingDimensions)
+	} else {
+		klog.Warningf("Cores scaling %v doesn't change the advertised cores, the scheduler accounts 100%% of the cores of each GPU", config.DeviceCoresScaling)
+	}
+}
+
+func (p *Profile) ResourceName() string {
+	return util.ProfileResourceName(p.Name)
+}
+
+func (p *Profile) socket() string {
+	if p.Name == "" {
+		return filepath.Join(config.DevicePluginPath, "nvidia-gpu.sock")
+	}
+	return filepath.Join(config.DevicePluginPath, "nvidia-gpu-"+p.Name+".sock")
+}
+
+// ValidateProfiles checks that profile names are unique DNS labels and that every
+// GPU belongs to one profile at most. Unset split counts and scaling factors are
+// taken from def, the default profile, and all must be within the bounds of config.Validate.
+func ValidateProfiles(def *Profile, profiles []*Profile) error {
+	names := make(map[string]bool)
+	owners := make(map[string]string)
+	for _, p := range profiles {
+		if errs := validation.IsDNS1123Label(p.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid profile name %q: %s", p.Name, strings.Join(errs, ", "))
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Devices) == 0 {
+			return fmt.Errorf("profile %q selects no devices", p.Name)
+		}
+		for _, id := range p.Devices {
+			if owner, ok := owners[id]; ok {
+				return fmt.Errorf("device %v is selected by profiles %q and %q", id, owner, p.Name)
+			}
+			owners[id] = p.Name
+		}
+		if p.DeviceSplitCount == 0 {
+			p.DeviceSplitCount = def.DeviceSplitCount
+		}
+		if p.DeviceMemoryScaling == 0 {
+			p.DeviceMemoryScaling = def.DeviceMemoryScaling
+		}
+	}
+	for _, p := range profiles {
+		if err := config.ValidateSplitCount(p.DeviceSplitCount); err != nil {
+			return fmt.Errorf("profile %q: %v", p.Name, err)
+		}
+		if err := config.ValidateScaling("memory", p.DeviceMemoryScaling); err != nil {
+			return fmt.Errorf("profile %q: %v", p.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestValidateProfiles(t *testing.T) {
+	for name, tc := range map[string]struct {
+		profiles []*Profile
+		err      string
+	}{
+		"overlap": {
+			profiles: []*Profile{{Name: "inference", Devices: []string{"GPU-0", "GPU-1"}}, {Name: "training", Devices: []string{"GPU-1"}}},
+			err:      `device GPU-1 is selected by profiles "inference" and "training"`,
+		},
+		"duplicate": {
+			profiles: []*Profile{{Name: "training", Devices: []string{"GPU-0"}}, {Name: "training", Devices: []string{"GPU-1"}}},
+			err:      `duplicate profile "training"`,
+		},
+		"invalid name": {
+			profiles: []*Profile{{Name: "Training", Devices: []string{"GPU-0"}}},
+			err:      `invalid profile name "Training"`,
+		},
+		"no devices": {
+			profiles: []*Profile{{Name: "training"}},
+			err:      `profile "training" selects no devices`,
+		},
+		"split count": {
+			profiles: []*Profile{{Name: "training", Devices: []string{"GPU-0"}, DeviceSplitCount: 100, DeviceMemoryScaling: 1}},
+			err:      `profile "training": the device split count must be between 1 and 64, got 100`,
+		},
+		"memory scaling": {
+			profiles: []*Profile{{Name: "training", Devices: []string{"GPU-0"}, DeviceSplitCount: 4, DeviceMemoryScaling: 20}},
+			err:      `profile "training": the memory scaling 20 is above the maximum scaling 10`,
+		},
+	} {
+		assert.ErrorContains(t, ValidateProfiles(DefaultProfile(), tc.profiles), tc.err, name)
+	}
+}
+
+func TestDeviceCacheProfiles(t *testing.T) {
+	oldName, oldSplit, oldScaling := util.ResourceName, config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() {
+		util.ResourceName, config.DeviceSplitCount, config.DeviceMemoryScaling = oldName, oldSplit, oldScaling
+	})
+	util.ResourceName, config.DeviceSplitCount, config.DeviceMemoryScaling = "nvidia.com/gpu", 4, 1
+
+	cache := &DeviceCache{cache: []*Device{
+		{Device: pluginapi.Device{ID: "GPU-0"}},
+		{Device: pluginapi.Device{ID: "GPU-1"}},
+		{Device: pluginapi.Device{ID: "GPU-2"}},
+	}}
+	training := &Profile{Name: "training", Devices: []string{"GPU-1", "GPU-2"}, DeviceSplitCount: 2, DeviceMemoryScaling: 1.5}
+	assert.NilError(t, cache.SetProfiles(DefaultProfile(), []*Profile{training}))
+	assert.Equal(t, cache.DeviceProfile("GPU-0").Name, "")
+	assert.Equal(t, cache.DeviceProfile("GPU-2"), training)
+
+	plugins, err := NewMigStrategy(MigStrategyNone)
+	assert.NilError(t, err)
+	var got []string
+	for _, p := range plugins.GetPlugins(cache) {
+		var ids []string
+		for _, d := range p.apiDevices() {
+			ids = append(ids, d.ID)
+		}
+		got = append(got, p.resourceName+" "+p.socket)
+		switch p.profile.Name {
+		case "":
+			assert.DeepEqual(t, ids, []string{"GPU-0-0", "GPU-0-1", "GPU-0-2", "GPU-0-3"})
+		case "training":
+			assert.DeepEqual(t, ids, []string{"GPU-1-0", "GPU-1-1", "GPU-2-0", "GPU-2-1"})
+		}
+	}
+	assert.DeepEqual(t, got, []string{
+		"nvidia.com/gpu " + pluginapi.DevicePluginPath + "nvidia-gpu.sock",
+		"nvidia.com/gpu-training " + pluginapi.DevicePluginPath + "nvidia-gpu-training.sock",
+	})
+}
+
+func TestEffectiveConfigProfiles(t *testing.T) {
+	oldName, oldSplit, oldScaling := util.ResourceName, config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() {
+		util.ResourceName, config.DeviceSplitCount, config.DeviceMemoryScaling = oldName, oldSplit, oldScaling
+	})
+	util.ResourceName, config.DeviceSplitCount, config.DeviceMemoryScaling = "nvidia.com/gpu", 4, 1
+
+	cache := &DeviceCache{cache: []*Device{
+		{Device: pluginapi.Device{ID: "GPU-0"}},
+		{Device: pluginapi.Device{ID: "GPU-1"}},
+	}}
+	assert.NilError(t, cache.SetProfiles(DefaultProfile(), []*Profile{{Name: "training", Devices: []string{"GPU-1"}, DeviceMemoryScaling: 2}}))
+
+	c := NewEffectiveConfig(cache, MigStrategyNone)
+	assert.Equal(t, c.DeviceSplitCount, uint(4))
+	assert.Equal(t, c.MigStrategy, MigStrategyNone)
+	assert.DeepEqual(t, c.Profiles, []ProfileConfig{
+		{ResourceName: "nvidia.com/gpu", Socket: pluginapi.DevicePluginPath + "nvidia-gpu.sock", DeviceSplitCount: 4, DeviceMemoryScaling: 1, Devices: []string{"GPU-0"}},
+		{Name: "training", ResourceName: "nvidia.com/gpu-training", Socket: pluginapi.DevicePluginPath + "nvidia-gpu-training.sock", DeviceSplitCount: 4, DeviceMemoryScaling: 2, Devices: []string{"GPU-1"}},
+	})
+}
+
+func TestScalingDimensions(t *testing.T) {
+	oldDimensions, oldMem, oldCores := config.ScalingDimensions, config.DeviceMemoryScaling, config.DeviceCoresScaling
+	t.Cleanup(func() {
+		config.ScalingDimensions, config.DeviceMemoryScaling, config.DeviceCoresScaling = oldDimensions, oldMem, oldCores
+	})
+	config.DeviceMemoryScaling, config.DeviceCoresScaling = 1.5, 2
+	training := &Profile{Name: "training", DeviceMemoryScaling: 3}
+
+	for _, c := range []struct {
+		dimensions string
+		memory     float64
+		training   float64
+		cores      float64
+	}{
+		{ScalingBoth, 1.5, 3, 2},
+		{ScalingMemory, 1.5, 3, 1},
+		{ScalingCores, 1, 1, 2},
+	} {
+		assert.NilError(t, ValidateScalingDimensions(c.dimensions))
+		config.ScalingDimensions = c.dimensions
+		assert.Equal(t, DefaultProfile().MemoryScaling(), c.memory, c.dimensions)
+		assert.Equal(t, training.MemoryScaling(), c.training, c.dimensions)
+		assert.Equal(t, CoresScaling(), c.cores, c.dimensions)
+	}
+	assert.ErrorContains(t, ValidateScalingDimensions("memory,cores"), "unknown scaling dimensions")
+	assert.ErrorContains(t, ValidateScalingDimensions(""), "unknown scaling dimensions")
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+)
+
+// coreLoan is what a container lends of its cores on a device while it is idle, or
+// borrows from idle containers on the device, with config.IdleCoreReclaim.
+type coreLoan struct {
+	Lent     int32
+	Borrowed int32
+}
+
+// coreLoans are the loans the LimitSyncer last made, by cache directory and device UUID,
+// for the runtime service.
+var coreLoans = struct {
+	sync.Mutex
+	loans map[string]map[string]coreLoan
+}{loans: make(map[string]map[string]coreLoan)}
+
+// coreLoanOf returns the loan of the container with the cache directory dir on the device
+// with uuid, if it lends or borrows cores.
+func coreLoanOf(dir, uuid string) (coreLoan, bool) {
+	coreLoans.Lock()
+	defer coreLoans.Unlock()
+	loan, ok := coreLoans.loans[dir][uuid]
+	return loan, ok
+}
+
+// idle tells whether the container launched no kernel for config.IdleCorePeriod, from its
+// heartbeat. Containers without a heartbeat are never idle.
+func (l *LimitSyncer) idle(t *tenant) bool {
+	hb, err := readHeartbeat(filepath.Join(l.root, t.dir, heartbeatFile))
+	if err != nil {
+		return false
+	}
+	return l.now().Sub(time.Unix(hb.LastKernelLaunch, 0)) >= config.IdleCorePeriod
+}
+
+// withBorrowed returns the cores of a share plus those borrowed, at most all of them.
+func withBorrowed(cores, borrowed int32) int32 {
+	if cores+borrowed > 100 {
+		return 100
+	}
+	return cores + borrowed
+}
+
+// loanCores lends the cores of the idle tenants to the others on the same device, which
+// split them evenly, so together the busy tenants never exceed what is reserved on the
+// device. Only limited shares, above 0 and below 100, lend or borrow. A tenant resuming
+// work takes its cores back with the next sync, the hook library holds it to its share
+// meanwhile.
+func loanCores(tenants []*tenant, idle map[*tenant]bool) map[string]map[string]coreLoan {
+	lent := make(map[string]int32)
+	borrowers := make(map[string]int32)
+	for _, t := range tenants {
+		for _, dev := range t.devs {
+			if dev.Usedcores <= 0 || dev.Usedcores >= 100 {
+				continue
+			}
+			if idle[t] {
+				lent[dev.UUID] += dev.Usedcores
+			} else {
+				borrowers[dev.UUID]++
+			}
+		}
+	}
+	res := make(map[string]map[string]coreLoan)
+	for _, t := range tenants {
+		for _, dev := range t.devs {
+			if dev.Usedcores <= 0 || dev.Usedcores >= 100 || borrowers[dev.UUID] == 0 || lent[dev.UUID] == 0 {
+				continue
+			}
+			loan := coreLoan{Lent: dev.Usedcores}
+			if !idle[t] {
+				loan = coreLoan{Borrowed: lent[dev.UUID] / borrowers[dev.UUID]}
+			}
+			if res[t.dir] == nil {
+				res[t.dir] = make(map[string]coreLoan)
+			}
+			res[t.dir][dev.UUID] = loan
+		}
+	}
+	return res
+}
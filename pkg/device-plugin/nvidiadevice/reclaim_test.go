@@ -0,0 +1,102 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLimitSyncerLendsIdleCores(t *testing.T) {
+	oldReclaim, oldPeriod := config.IdleCoreReclaim, config.IdleCorePeriod
+	t.Cleanup(func() { config.IdleCoreReclaim, config.IdleCorePeriod = oldReclaim, oldPeriod })
+	config.IdleCoreReclaim, config.IdleCorePeriod = true, 5*time.Minute
+
+	pod := func(uid string, cores int32) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: uid, Namespace: "default", UID: k8stypes.UID(uid), Annotations: map[string]string{
+				util.AssignedIDsAnnotations: annotations.EncodePodDevices(util.PodDevices{{
+					{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: cores},
+				}}),
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+		}
+	}
+	client := fake.NewSimpleClientset(pod("a", 20), pod("b", 30), pod("idle", 40))
+	root := t.TempDir()
+	regions := map[string]string{}
+	for _, uid := range []string{"a", "b", "idle"} {
+		regions[uid] = filepath.Join(root, uid+"_c", "a.cache")
+		writeRegion(t, regions[uid], map[string]uint64{"GPU-0": 4000 << 20}, "GPU-0")
+	}
+	now := time.Unix(10000, 0)
+	l := &LimitSyncer{root: root, nodeName: "node1", client: client, now: func() time.Time { return now },
+		utilization: func(string) (uint, error) { return 90, nil }}
+	sync := func(idleSince time.Duration) {
+		writeHeartbeat(t, root, "a_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: now.Unix()})
+		writeHeartbeat(t, root, "b_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: now.Unix()})
+		writeHeartbeat(t, root, "idle_c", Heartbeat{Timestamp: now.Unix(), LastKernelLaunch: now.Add(-idleSince).Unix()})
+		assert.NilError(t, l.sync(context.Background()))
+	}
+
+	// not idle long enough yet
+	sync(time.Minute)
+	assert.Equal(t, regionCoreLimit(t, regions["a"]), uint64(20))
+	assert.Equal(t, regionCoreLimit(t, regions["b"]), uint64(30))
+	_, ok := coreLoanOf("a_c", "GPU-0")
+	assert.Assert(t, !ok)
+
+	// the busy ones split the idle cores
+	sync(10 * time.Minute)
+	assert.Equal(t, regionCoreLimit(t, regions["a"]), uint64(40))
+	assert.Equal(t, regionCoreLimit(t, regions["b"]), uint64(50))
+	assert.Equal(t, regionCoreLimit(t, regions["idle"]), uint64(40))
+	loan, ok := coreLoanOf("a_c", "GPU-0")
+	assert.Assert(t, ok)
+	assert.Equal(t, loan, coreLoan{Borrowed: 20})
+	loan, _ = coreLoanOf("idle_c", "GPU-0")
+	assert.Equal(t, loan, coreLoan{Lent: 40})
+	cores, ok := allowedBurstCores("b_c", "GPU-0")
+	assert.Assert(t, ok)
+	assert.Equal(t, cores, int32(50))
+
+	// reclaimed once it launches a kernel
+	sync(0)
+	assert.Equal(t, regionCoreLimit(t, regions["a"]), uint64(20))
+	assert.Equal(t, regionCoreLimit(t, regions["b"]), uint64(30))
+	_, ok = coreLoanOf("idle_c", "GPU-0")
+	assert.Assert(t, !ok)
+}
+
+func TestLoanCoresSkipsUnlimitedShares(t *testing.T) {
+	whole := &tenant{dir: "whole", devs: util.ContainerDevices{{UUID: "GPU-0", Usedcores: 100}}}
+	unlimited := &tenant{dir: "unlimited", devs: util.ContainerDevices{{UUID: "GPU-0"}}}
+	idle := &tenant{dir: "idle", devs: util.ContainerDevices{{UUID: "GPU-0", Usedcores: 50}}}
+	loans := loanCores([]*tenant{whole, unlimited, idle}, map[*tenant]bool{idle: true})
+	assert.Equal(t, len(loans), 0)
+}
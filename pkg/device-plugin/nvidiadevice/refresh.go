@@ -0,0 +1,216 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"k8s.io/klog/v2"
+)
+
+// RefreshPath is where the runtime service enumerates the devices again on POST, see
+// DeviceCache.Refresh.
+const RefreshPath = "/refresh"
+
+// RefreshResult is what enumerating the devices again changed, by device ID.
+type RefreshResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Resized are the devices NVML reports another memory size for
+	Resized []string `json:"resized"`
+}
+
+// Changed tells whether the devices changed.
+func (r RefreshResult) Changed() bool {
+	return len(r.Added)+len(r.Removed)+len(r.Resized) > 0
+}
+
+type refreshReply struct {
+	res RefreshResult
+	err error
+}
+
+type enumerateResult struct {
+	devs []*Device
+	err  error
+}
+
+var (
+	// errCacheStopped is returned by Refresh once the cache stopped.
+	errCacheStopped = errors.New("device cache stopped")
+	// errEnumerating is returned by Refresh while an enumeration that timed out still runs.
+	errEnumerating = errors.New("NVML is still enumerating the devices of a refresh that timed out")
+)
+
+// Refresh enumerates the devices again at once, e.g. after a GPU was hot-plugged or the
+// driver reloaded, instead of at the next restart of the plugin. It runs on the sampler,
+// which is the only one to change the devices, and publishes them, so ListAndWatch sends
+// the new devices to kubelet and the register reports them to the scheduler.
+func (d *DeviceCache) Refresh(ctx context.Context) (RefreshResult, error) {
+	reply := make(chan refreshReply, 1)
+	select {
+	case d.refresh <- reply:
+	case <-d.stopCh:
+		return RefreshResult{}, errCacheStopped
+	case <-ctx.Done():
+		return RefreshResult{}, ctx.Err()
+	}
+	select {
+	case r := <-reply:
+		return r.res, r.err
+	case <-ctx.Done():
+		return RefreshResult{}, ctx.Err()
+	}
+}
+
+// serveRefresh enumerates the devices again on POST and answers with the RefreshResult.
+func (s *RuntimeService) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := s.cache.Refresh(r.Context())
+	if err != nil {
+		klog.Errorf("refresh devices: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// enumerate lists the devices with NVML, whose failures panic in Devices.
+func (d *DeviceCache) enumerate() (devs []*Device, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("enumerate devices: %v", r)
+		}
+	}()
+	return d.Devices(), nil
+}
+
+// enumerateInTime enumerates the devices on a goroutine of its own and gives up after
+// config.NVMLQueryTimeout, so a driver hanging during a GPU fault doesn't stall the
+// sampler. The late enumeration is left running and no new one starts until it returns,
+// its devices are dropped then as they may be stale. The devices sampled meanwhile hang as
+// well and are reported unhealthy by sample.
+func (d *DeviceCache) enumerateInTime() ([]*Device, error) {
+	if d.enumerating != nil {
+		select {
+		case <-d.enumerating:
+			d.enumerating = nil
+		default:
+			return nil, errEnumerating
+		}
+	}
+	ch := make(chan enumerateResult, 1)
+	go func() {
+		devs, err := d.enumerate()
+		ch <- enumerateResult{devs, err}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), config.NVMLQueryTimeout)
+	defer cancel()
+	select {
+	case res := <-ch:
+		return res.devs, res.err
+	case <-ctx.Done():
+		d.enumerating = ch
+		NVMLEnumerationTimeouts.Inc()
+		klog.Warningf("NVML didn't enumerate the devices within %v, keeping the devices enumerated before", config.NVMLQueryTimeout)
+		return nil, fmt.Errorf("enumerate devices: NVML didn't answer within %v", config.NVMLQueryTimeout)
+	}
+}
+
+// reenumerate replaces the devices with those NVML lists now and logs the changes. The
+// state kept of removed devices is forgotten, their Xids aren't watched anymore and those
+// of added devices are. It runs on the sampler.
+func (d *DeviceCache) reenumerate() (RefreshResult, error) {
+	devs, err := d.enumerateInTime()
+	if err != nil {
+		return RefreshResult{}, err
+	}
+	var res RefreshResult
+	former := make(map[string]*Device, len(d.cache))
+	for _, dev := range d.cache {
+		former[dev.ID] = dev
+	}
+	for _, dev := range devs {
+		old, ok := former[dev.ID]
+		delete(former, dev.ID)
+		switch {
+		case !ok:
+			klog.Infof("Refresh: device %v added, %vMiB", dev.ID, dev.Memory)
+			res.Added = append(res.Added, dev.ID)
+		case old.Memory != dev.Memory:
+			klog.Infof("Refresh: device %v memory changed from %vMiB to %vMiB", dev.ID, old.Memory, dev.Memory)
+			res.Resized = append(res.Resized, dev.ID)
+		}
+	}
+	for id := range former {
+		klog.Infof("Refresh: device %v removed", id)
+		res.Removed = append(res.Removed, id)
+	}
+	sort.Strings(res.Removed)
+	if !res.Changed() {
+		klog.Infof("Refresh: %d devices, none changed", len(devs))
+		return res, nil
+	}
+
+	d.mutex.Lock()
+	d.cache = devs
+	for _, id := range res.Removed {
+		delete(d.xid, id)
+		delete(d.hung, id)
+		delete(d.failed, id)
+		delete(d.disagreed, id)
+		delete(d.samples, id)
+	}
+	d.mutex.Unlock()
+	if d.stopHealth != nil {
+		d.stopHealth()
+		d.stopHealth = d.watchHealth()
+	}
+	d.sample()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	changed := append(append([]string(nil), res.Added...), res.Resized...)
+	d.publish(append(changed, res.Removed...))
+	return res, nil
+}
+
+// watchHealth checks the health of the cached devices until the cache stops or the
+// returned function is called.
+func (d *DeviceCache) watchHealth() (stop func()) {
+	done := make(chan struct{})
+	stopCh := make(chan interface{})
+	go func() {
+		select {
+		case <-d.stopCh:
+		case <-done:
+		}
+		close(stopCh)
+	}()
+	go d.CheckHealth(stopCh, d.cache, d.unhealthy)
+	return func() { close(done) }
+}
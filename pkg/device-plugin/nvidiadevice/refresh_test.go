@@ -0,0 +1,146 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestRefreshReenumeratesDevices(t *testing.T) {
+	oldLib := nvmlLib
+	t.Cleanup(func() {
+		nvmlLib = oldLib
+		compositeDevices.index = make(map[string]uint)
+	})
+	lib := &enumerationNVML{devs: []*NVMLDevice{
+		{UUID: "GPU-a", BusID: "00000000:3B:00.0", Memory: 16000},
+		{UUID: "GPU-b", BusID: "00000000:5E:00.0", Memory: 16000},
+	}}
+	nvmlLib = lib
+	var d *DeviceCache
+	d = newTestCache(t, 0, func(uuid string) (DeviceSample, error) {
+		for _, dev := range d.cache {
+			if dev.ID == uuid {
+				return DeviceSample{Model: "A100", Memory: int32(dev.Memory), Free: dev.Memory}, nil
+			}
+		}
+		return DeviceSample{}, errCacheStopped
+	})
+	d.cache = d.Devices()
+	d.sample()
+	go d.sampleLoop()
+	defer d.Stop()
+	events, cancel := d.Watch()
+	defer cancel()
+	s := NewRuntimeService(d, "node1", fake.NewSimpleClientset())
+	refresh := func() RefreshResult {
+		w := httptest.NewRecorder()
+		s.serveRefresh(w, httptest.NewRequest(http.MethodPost, RefreshPath, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		var res RefreshResult
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	assert.Assert(t, !refresh().Changed())
+	assert.Equal(t, len(changed(events)), 0)
+
+	// GPU-b is taken out, GPU-c plugged in and the memory of GPU-a changes
+	lib.devs = []*NVMLDevice{
+		{UUID: "GPU-a", BusID: "00000000:3B:00.0", Memory: 24000},
+		{UUID: "GPU-c", BusID: "00000000:86:00.0", Memory: 16000},
+	}
+	assert.DeepEqual(t, refresh(), RefreshResult{Added: []string{"GPU-c"}, Removed: []string{"GPU-b"}, Resized: []string{"GPU-a"}})
+	var ids []string
+	for _, dev := range d.GetCache() {
+		ids = append(ids, dev.ID)
+	}
+	assert.DeepEqual(t, ids, []string{"GPU-a", "GPU-c"})
+	sample, ok := d.Sample("GPU-a")
+	assert.Assert(t, ok)
+	assert.Equal(t, sample.Memory, int32(24000))
+	_, ok = d.Sample("GPU-b")
+	assert.Assert(t, !ok)
+	ev := <-events
+	assert.DeepEqual(t, ev.Changed, []string{"GPU-c", "GPU-a", "GPU-b"})
+	assert.Equal(t, ev.Snapshot.Device("GPU-a").Health, pluginapi.Healthy)
+	assert.Assert(t, ev.Snapshot.Device("GPU-b") == nil)
+
+	w := httptest.NewRecorder()
+	s.serveRefresh(w, httptest.NewRequest(http.MethodGet, RefreshPath, nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+// hangingNVML enumerates the devices of enumerationNVML once release is closed.
+type hangingNVML struct {
+	enumerationNVML
+	release chan struct{}
+}
+
+func (n *hangingNVML) DeviceCount() (uint, error) {
+	<-n.release
+	return n.enumerationNVML.DeviceCount()
+}
+
+func TestRefreshTimesOutHungEnumeration(t *testing.T) {
+	oldLib := nvmlLib
+	t.Cleanup(func() {
+		nvmlLib = oldLib
+		compositeDevices.index = make(map[string]uint)
+	})
+	lib := &hangingNVML{enumerationNVML: enumerationNVML{devs: []*NVMLDevice{
+		{UUID: "GPU-a", BusID: "00000000:3B:00.0", Memory: 16000},
+	}}, release: make(chan struct{})}
+	nvmlLib = lib
+	d := newTestCache(t, 0, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	go d.sampleLoop()
+	defer d.Stop()
+	timeouts := testutil.ToFloat64(NVMLEnumerationTimeouts)
+
+	_, err := d.Refresh(context.Background())
+	assert.ErrorContains(t, err, "NVML didn't answer within 50ms")
+	assert.Equal(t, testutil.ToFloat64(NVMLEnumerationTimeouts), timeouts+1)
+	// the sampler goes on, and doesn't pile up enumerations while the late one hangs
+	_, err = d.Refresh(context.Background())
+	assert.ErrorIs(t, err, errEnumerating)
+	assert.Equal(t, testutil.ToFloat64(NVMLEnumerationTimeouts), timeouts+1)
+	assert.Equal(t, len(d.GetCache()), 0)
+
+	// the late enumeration is dropped once it returned, the next one is used
+	close(lib.release)
+	res, err := d.Refresh(context.Background())
+	for errors.Is(err, errEnumerating) {
+		time.Sleep(time.Millisecond)
+		res, err = d.Refresh(context.Background())
+	}
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res.Added, []string{"GPU-a"})
+	assert.Equal(t, d.GetCache()[0].ID, "GPU-a")
+}
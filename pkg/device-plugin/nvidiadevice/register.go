@@ -17,99 +17,344 @@
 package nvidiadevice
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 
 	"4pd.io/k8s-vgpu/pkg/api"
 	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
 	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 )
 
 type DevListFunc func() []*Device
 
 type DeviceRegister struct {
 	deviceCache *DeviceCache
-	unhealthy   chan *Device
 	stopCh      chan struct{}
+	// running is done once WatchAndRegister returned after Stop
+	running sync.WaitGroup
+	// lastmem remembers the memory reported for each device in the previous round
+	lastmem map[string]int32
+	// overcommitted holds the devices reported over-committed in the previous round
+	overcommitted map[string]bool
+	// external measures the memory used outside vGPU accounting, nil if disabled
+	external *ExternalMemory
+	// ready is set to 1 once every device was reported, it isn't reset afterwards
+	ready int32
+	// usage is reported for the efficiency report of the scheduler, nil while the
+	// heartbeats aren't checked
+	usage *UsageTracker
+	// writer makes all writes to the node
+	writer *NodeWriter
 }
 
 func NewDeviceRegister(deviceCache *DeviceCache) *DeviceRegister {
 	return &DeviceRegister{
-		deviceCache: deviceCache,
-		unhealthy:   make(chan *Device),
-		stopCh:      make(chan struct{}),
+		deviceCache:   deviceCache,
+		stopCh:        make(chan struct{}),
+		lastmem:       make(map[string]int32),
+		overcommitted: make(map[string]bool),
+		writer:        NewNodeWriter(config.NodeName),
 	}
 }
 
+// SetExternalMemory subtracts the memory measured by e from the registered memory.
+func (r *DeviceRegister) SetExternalMemory(e *ExternalMemory) {
+	r.external = e
+}
+
+// SetUsageTracker reports the usage of the containers tracked by usage with the devices.
+func (r *DeviceRegister) SetUsageTracker(usage *UsageTracker) {
+	r.usage = usage
+}
+
 func (r *DeviceRegister) Start() {
-	r.deviceCache.AddNotifyChannel("register", r.unhealthy)
-	go r.WatchAndRegister()
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		r.WatchAndRegister()
+	}()
 }
 
+// Stop stops reporting the devices and waits for a report under way.
 func (r *DeviceRegister) Stop() {
 	close(r.stopCh)
+	r.running.Wait()
+}
+
+// externalMemory returns the memory in MiB to keep free on each device for processes outside
+// vGPU accounting, the larger of the node annotation and the measured usage.
+func (r *DeviceRegister) externalMemory(node *corev1.Node, devs []*Device) map[string]int32 {
+	res := make(map[string]int32)
+	if val, ok := node.Annotations[util.DeviceMemoryExternalAnnotation]; ok {
+		reserved, err := annotations.DecodeDeviceMemoryExternal(val)
+		if err != nil {
+			klog.Errorf("ignoring annotation %v: %v", util.DeviceMemoryExternalAnnotation, err)
+		}
+		for id, mem := range reserved {
+			res[id] = mem
+		}
+	}
+	var measured map[string]int32
+	if r.external != nil {
+		uuids := make([]string, 0, len(devs))
+		for _, dev := range devs {
+			uuids = append(uuids, dev.ID)
+		}
+		var err error
+		measured, err = r.external.Measure(uuids)
+		if err != nil {
+			klog.Errorf("measure external device memory: %v", err)
+		}
+	}
+	for _, dev := range devs {
+		ExternalMemoryBytes.WithLabelValues(dev.ID, "annotation").Set(float64(res[dev.ID]) * 1024 * 1024)
+		if measured == nil {
+			continue
+		}
+		ExternalMemoryBytes.WithLabelValues(dev.ID, "measured").Set(float64(measured[dev.ID]) * 1024 * 1024)
+		if measured[dev.ID] > res[dev.ID] {
+			res[dev.ID] = measured[dev.ID]
+		}
+	}
+	return res
+}
+
+// allocatedMemory returns the memory allocated to the running pods on the node by device
+// UUID, none if the pods couldn't be listed.
+func (r *DeviceRegister) allocatedMemory() map[string]int32 {
+	ctx, cancel := context.WithTimeout(context.Background(), config.APITimeout)
+	defer cancel()
+	res := make(map[string]int32)
+	for uuid, allocations := range NodeAllocations(ctx, util.GetClient(), config.NodeName) {
+		for _, a := range allocations {
+			res[uuid] += a.Memory
+		}
+	}
+	return res
 }
 
-func (r *DeviceRegister) apiDevices() *[]*api.DeviceInfo {
+// apiDevices lists the devices to report, flagging those with less memory than allocated
+// holds on them over-committed.
+func (r *DeviceRegister) apiDevices(node *corev1.Node, external, allocated map[string]int32) *[]*api.DeviceInfo {
 	devs := r.deviceCache.GetCache()
 	res := make([]*api.DeviceInfo, 0, len(devs))
 	for _, dev := range devs {
-		ndev, err := nvml.NewDeviceByUUID(dev.ID)
-		//klog.V(3).Infoln("ndev type=", ndev.Model)
-		if err != nil {
-			fmt.Println("nvml new device by uuid error id=", dev.ID)
-			panic(0)
-		} else {
-			klog.V(3).Infoln("nvml registered device id=", dev.ID, "memory=", *ndev.Memory, "type=", *ndev.Model)
-		}
-		registeredmem := int32(*ndev.Memory)
-		if config.DeviceMemoryScaling > 1 {
-			fmt.Println("Memory Scaling to", config.DeviceMemoryScaling)
-			registeredmem = int32(float64(registeredmem) * config.DeviceMemoryScaling)
-		}
-		res = append(res, &api.DeviceInfo{
-			Id:     dev.ID,
-			Count:  int32(config.DeviceSplitCount),
-			Devmem: registeredmem,
-			Type:   fmt.Sprintf("%v-%v", "NVIDIA", *ndev.Model),
-			Health: dev.Health == "healthy",
-		})
+		if r.deviceCache.LegacyHeld(dev.ID) {
+			continue
+		}
+		sample, ok := r.deviceCache.Sample(dev.ID)
+		if !ok {
+			klog.Warningf("device %v not registered, NVML didn't answer for it yet", dev.ID)
+			continue
+		}
+		klog.V(3).Infoln("nvml registered device id=", dev.ID, "memory=", sample.Memory, "type=", sample.Model)
+		// The memory NVML measures excludes ECC overhead and the memory the driver reserves,
+		// and shrinks when rows are remapped after a reset, so take it from every sample.
+		registeredmem := sample.Memory
+		if former, ok := r.lastmem[dev.ID]; ok && former != registeredmem {
+			klog.Warningf("device %v memory changed from %vm to %vm", dev.ID, former, registeredmem)
+		}
+		r.lastmem[dev.ID] = registeredmem
+		if ext := external[dev.ID]; ext > 0 {
+			klog.V(3).Infof("device %v keeps %vm for processes outside vGPU accounting", dev.ID, ext)
+		}
+		profile := r.deviceCache.DeviceProfile(dev.ID)
+		if scaling := profile.MemoryScaling(); scaling > 1 {
+			fmt.Println("Memory Scaling to", scaling)
+		}
+		info := advertisedDevice(dev, sample, profile, r.deviceCache.SplitCount(dev.ID), node, external[dev.ID])
+		// pods already on the device keep running, the scheduler just places no new ones
+		info.Overcommitted = allocated[dev.ID] > info.Devmem
+		if info.Overcommitted && !r.overcommitted[dev.ID] {
+			klog.Warningf("device %v over-committed, %vm allocated on %vm", dev.ID, allocated[dev.ID], info.Devmem)
+		} else if !info.Overcommitted && r.overcommitted[dev.ID] {
+			klog.Infof("device %v no longer over-committed, %vm allocated on %vm", dev.ID, allocated[dev.ID], info.Devmem)
+		}
+		r.overcommitted[dev.ID] = info.Overcommitted
+		res = append(res, info)
 	}
 	return &res
 }
 
+// advertisedDevice is what the scheduler is told about dev, split into split slices, with
+// ext MiB kept for processes outside vGPU accounting.
+func advertisedDevice(dev *Device, sample DeviceSample, profile *Profile, split uint, node *corev1.Node, ext int32) *api.DeviceInfo {
+	registeredmem := sample.Memory
+	if ext > 0 {
+		registeredmem -= ext
+		if registeredmem < 0 {
+			registeredmem = 0
+		}
+	}
+	// the scheduler caps oversubscription against the physical memory
+	var physmem int32
+	if profile.MemoryScaling() > 1 {
+		physmem = registeredmem
+	}
+	registeredmem = profileSettings(profile, split).Capacity(registeredmem).Memory
+	// the scheduler takes the split count as the limit unless a lower one is registered
+	var maxshares int32
+	if shares := maxShares(node, sample.Model, split); shares > 0 && shares < int32(split) {
+		maxshares = shares
+	}
+	// a single context can use a GPU outside the DEFAULT compute mode, so it isn't split
+	count := int32(split)
+	if sample.ComputeMode != ComputeModeDefault {
+		count, maxshares = 1, 0
+	}
+	return &api.DeviceInfo{
+		Id:        dev.ID,
+		Count:     count,
+		Devmem:    registeredmem,
+		Type:      util.ProfileDeviceType(fmt.Sprintf("%v-%v", "NVIDIA", sample.Model), profile.Name),
+		Health:    dev.Health == pluginapi.Healthy && sample.ComputeMode != ComputeModeProhibited,
+		Physmem:   physmem,
+		Maxshares: maxshares,
+	}
+}
+
+// deviceLinks lists the links between devs once each, sorted so the annotation only
+// changes with the topology.
+func deviceLinks(devs []*Device) []annotations.DeviceLink {
+	var res []annotations.DeviceLink
+	for _, dev := range devs {
+		for peer, level := range dev.Links {
+			if dev.ID < peer {
+				res = append(res, annotations.DeviceLink{A: dev.ID, B: peer, Level: level})
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].A != res[j].A {
+			return res[i].A < res[j].A
+		}
+		return res[i].B < res[j].B
+	})
+	return res
+}
+
+// RegistrInAnnotation reports the devices in the node annotation, each API server request
+// taking at most config.APITimeout. The annotations and the label are patched in one
+// request, and not at all while they are unchanged and the scheduler didn't ask for a
+// report by resetting the handshake.
 func (r *DeviceRegister) RegistrInAnnotation() error {
-	devices := r.apiDevices()
 	annos := make(map[string]string)
-	node, err := util.GetNode(config.NodeName)
+	labels := make(map[string]string)
+	ctx, cancel := context.WithTimeout(context.Background(), config.APITimeout)
+	node, err := util.GetClient().CoreV1().Nodes().Get(ctx, config.NodeName, metav1.GetOptions{})
+	cancel()
 	if err != nil {
 		klog.Errorln("get node error", err.Error())
 		return err
 	}
-	encodeddevices := util.EncodeNodeDevices(*devices)
-	annos[util.NodeHandshake] = "Reported " + time.Now().String()
+	r.writer.Observe(node)
+	r.deviceCache.SetDrained(annotations.DecodeDrainDevices(node.Annotations[util.DrainDeviceAnnotation]))
+	devices := r.apiDevices(node, r.externalMemory(node, r.deviceCache.GetCache()), r.allocatedMemory())
+	encodeddevices := annotations.EncodeNodeDevices(*devices)
+	if !strings.HasPrefix(node.Annotations[util.NodeHandshake], "Reported") {
+		annos[util.NodeHandshake] = "Reported " + time.Now().String()
+	}
 	annos[util.NodeNvidiaDeviceRegistered] = encodeddevices
-	klog.Infoln("Reporting devices", encodeddevices, "in", time.Now().String())
-	err = util.PatchNodeAnnotations(node, annos)
-
+	annos[util.NodeNvidiaTopologyAnnotation] = annotations.EncodeDeviceLinks(deviceLinks(r.deviceCache.GetCache()))
+	if r.usage != nil {
+		annos[util.ContainerUsageAnnotation] = annotations.EncodeContainerUsage(r.usage.Reported())
+	}
+	label := len(*devices) > 0 && node.Labels[util.GPUNodeLabel] != util.GPUNodeLabelValue
+	if label {
+		// the webhook requires the label of vGPU pods, so kube-scheduler filters out
+		// nodes without GPUs before calling the extender
+		labels[util.GPUNodeLabel] = util.GPUNodeLabelValue
+	}
+	r.writer.Set(annos, labels)
+	ctx, cancel = context.WithTimeout(context.Background(), config.APITimeout)
+	defer cancel()
+	patched, err := r.writer.Flush(ctx)
 	if err != nil {
 		klog.Errorln("patch node error", err.Error())
+		return err
+	}
+	if patched {
+		klog.Infoln("Reported devices", encodeddevices, "in", time.Now().String())
 	}
-	return err
+	if label {
+		klog.Infof("Labeled node %v with %v=%v", node.Name, util.GPUNodeLabel, util.GPUNodeLabelValue)
+	}
+	if _, ok := node.Labels[util.GPUNodeLabel]; ok && len(*devices) == 0 {
+		// pods requiring the label would be sent here without a GPU to get
+		if _, err := util.RemoveNodeLabels(ctx, util.GetClient(), node, []string{util.GPUNodeLabel}); err != nil {
+			klog.Errorln("remove node label error", err.Error())
+			return err
+		}
+		klog.Infof("Removed the label %v of node %v, it has no GPUs registered", util.GPUNodeLabel, node.Name)
+	}
+	// the GPUs of legacy pods aren't reported until the pods end
+	want := 0
+	for _, dev := range r.deviceCache.GetCache() {
+		if !r.deviceCache.LegacyHeld(dev.ID) {
+			want++
+		}
+	}
+	if n := len(*devices); n == want && atomic.CompareAndSwapInt32(&r.ready, 0, 1) {
+		klog.Infof("All %d devices reported to the scheduler, node is ready", n)
+	}
+	return nil
 }
 
+// Ready returns nil once the node annotation listed every device, which takes NVML to have
+// answered for all of them. Until then the scheduler would see no or only some of the GPUs
+// of the node, so the readiness probe keeps failing.
+func (r *DeviceRegister) Ready() error {
+	if atomic.LoadInt32(&r.ready) == 0 {
+		return fmt.Errorf("devices not all reported to the scheduler yet")
+	}
+	return nil
+}
+
+// WatchAndRegister reports the devices every config.NodeUpdateInterval, jittered, and
+// when the health of a device changed, at most config.NodeUpdateQPS times a second.
 func (r *DeviceRegister) WatchAndRegister() {
 	klog.Infof("into WatchAndRegister")
+	ctx, cancel := wait.ContextForChannel(r.stopCh)
+	defer cancel()
+	events, cancelWatch := r.deviceCache.Watch()
+	defer cancelWatch()
 	for {
+		if err := r.writer.Wait(ctx); err != nil {
+			return
+		}
+		interval := wait.Jitter(config.NodeUpdateInterval, config.NodeUpdateJitter)
 		err := r.RegistrInAnnotation()
 		if err != nil {
 			klog.Errorf("register error, %v", err)
-			time.Sleep(time.Second * 5)
-		} else {
-			time.Sleep(time.Second * 30)
+			interval = time.Second * 5
+		}
+		timeout := time.After(interval)
+	wait:
+		for {
+			select {
+			case <-r.stopCh:
+				return
+			case ev := <-events:
+				// report a device whose health changed as soon as the rate allows, with
+				// the changes made meanwhile
+				if len(ev.Changed) > 0 {
+					break wait
+				}
+			case <-timeout:
+				break wait
+			}
 		}
 	}
 }
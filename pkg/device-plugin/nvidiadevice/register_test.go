@@ -0,0 +1,251 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRegisterReadyOnceEveryDeviceIsReported(t *testing.T) {
+	oldClient, oldNode := util.GetClient(), config.NodeName
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		config.NodeName = oldNode
+	})
+	util.SetClient(fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}))
+	config.NodeName = "node1"
+	answered := map[string]bool{"GPU-0": true}
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		if !answered[uuid] {
+			return DeviceSample{}, fmt.Errorf("no answer")
+		}
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	r := NewDeviceRegister(d)
+
+	// GPU-1 isn't reported until NVML answered for it
+	d.sample()
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.ErrorContains(t, r.Ready(), "not all reported")
+	node, err := util.GetClient().CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, node.Labels[util.GPUNodeLabel], util.GPUNodeLabelValue)
+
+	answered["GPU-1"] = true
+	d.sample()
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.NilError(t, r.Ready())
+
+	// the node stays ready when a device stops answering later
+	answered["GPU-1"] = false
+	d.sample()
+	assert.NilError(t, r.Ready())
+}
+
+func TestRegisterRemovesLabelWithoutDevices(t *testing.T) {
+	oldClient, oldNode := util.GetClient(), config.NodeName
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		config.NodeName = oldNode
+	})
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{
+		util.GPUNodeLabel: util.GPUNodeLabelValue,
+	}}})
+	util.SetClient(client)
+	config.NodeName = "node1"
+	answered := false
+	d := newTestCache(t, 1, func(uuid string) (DeviceSample, error) {
+		if !answered {
+			return DeviceSample{}, fmt.Errorf("no answer")
+		}
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	r := NewDeviceRegister(d)
+
+	// no GPU is reported while NVML doesn't answer
+	d.sample()
+	assert.NilError(t, r.RegistrInAnnotation())
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	_, labeled := node.Labels[util.GPUNodeLabel]
+	assert.Assert(t, !labeled)
+
+	answered = true
+	d.sample()
+	assert.NilError(t, r.RegistrInAnnotation())
+	node, err = client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, node.Labels[util.GPUNodeLabel], util.GPUNodeLabelValue)
+}
+
+// patches counts the patches of nodes client got.
+func patches(client *fake.Clientset) int {
+	n := 0
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "patch" && a.GetResource().Resource == "nodes" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegisterCoalescesNodePatches(t *testing.T) {
+	oldClient, oldNode := util.GetClient(), config.NodeName
+	oldInterval, oldQPS := config.NodeUpdateInterval, config.NodeUpdateQPS
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		config.NodeName = oldNode
+		config.NodeUpdateInterval, config.NodeUpdateQPS = oldInterval, oldQPS
+	})
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	util.SetClient(client)
+	config.NodeName = "node1"
+	config.NodeUpdateInterval, config.NodeUpdateQPS = time.Hour, 10
+	d := newTestCache(t, 4, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	r := NewDeviceRegister(d)
+
+	// the annotations and the label go out in one patch, and not again while unchanged
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.Equal(t, patches(client), 1)
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, node.Labels[util.GPUNodeLabel], util.GPUNodeLabelValue)
+	assert.Assert(t, strings.HasPrefix(node.Annotations[util.NodeHandshake], "Reported"))
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.Equal(t, patches(client), 1)
+
+	// the scheduler asking for a report is answered
+	node.Annotations[util.NodeHandshake] = "Requesting_2023.07.22 10:00:00"
+	_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, r.RegistrInAnnotation())
+	assert.Equal(t, patches(client), 2)
+
+	// a burst of health changes is reported at the rate allowed
+	r.Start()
+	defer r.Stop()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		d.mutex.Lock()
+		d.failed[fmt.Sprintf("GPU-%d", i%4)] = i%8 < 4
+		d.publish([]string{fmt.Sprintf("GPU-%d", i%4)})
+		d.mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	elapsed := time.Since(start)
+	n := patches(client) - 2
+	assert.Assert(t, n >= 1, n)
+	assert.Assert(t, float64(n) <= elapsed.Seconds()*config.NodeUpdateQPS+2, "%d patches in %v", n, elapsed)
+}
+
+func TestRegisterUnsplitsExclusiveDevices(t *testing.T) {
+	oldSplit := config.DeviceSplitCount
+	t.Cleanup(func() { config.DeviceSplitCount = oldSplit })
+	config.DeviceSplitCount = 10
+	modes := map[string]ComputeMode{"GPU-1": ComputeModeExclusiveProcess, "GPU-2": ComputeModeProhibited}
+	d := newTestCache(t, 3, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000, ComputeMode: modes[uuid]}, nil
+	})
+	d.sample()
+	devs := *NewDeviceRegister(d).apiDevices(&corev1.Node{}, nil, nil)
+	assert.Equal(t, len(devs), 3)
+	assert.Equal(t, devs[0].Count, int32(10))
+	assert.Assert(t, devs[0].Health)
+	assert.Equal(t, devs[1].Count, int32(1))
+	assert.Assert(t, devs[1].Health)
+	assert.Assert(t, !devs[2].Health)
+}
+
+func TestRegisterFlagsDeviceShrunkBelowAllocations(t *testing.T) {
+	oldClient, oldNode := util.GetClient(), config.NodeName
+	oldSplit, oldScaling := config.DeviceSplitCount, config.DeviceMemoryScaling
+	t.Cleanup(func() {
+		util.SetClient(oldClient)
+		config.NodeName = oldNode
+		config.DeviceSplitCount, config.DeviceMemoryScaling = oldSplit, oldScaling
+	})
+	config.DeviceSplitCount, config.DeviceMemoryScaling = 10, 1
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{
+				util.AssignedIDsAnnotations: "GPU-0,NVIDIA,6000,0:",
+			}},
+			Spec:   corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "ctr"}}},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, pod("a"), pod("b"))
+	util.SetClient(client)
+	config.NodeName = "node1"
+	memory := int32(16000)
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		if uuid == "GPU-0" {
+			return DeviceSample{Model: "A100", Memory: memory, Free: uint64(memory)}, nil
+		}
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	r := NewDeviceRegister(d)
+	registered := func() []*api.DeviceInfo {
+		assert.NilError(t, r.RegistrInAnnotation())
+		node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+		assert.NilError(t, err)
+		devs, err := annotations.DecodeNodeDevices(node.Annotations[util.NodeNvidiaDeviceRegistered])
+		assert.NilError(t, err)
+		assert.Equal(t, len(devs), 2)
+		return devs
+	}
+
+	d.sample()
+	devs := registered()
+	assert.Equal(t, devs[0].Devmem, int32(16000))
+	assert.Assert(t, !devs[0].Overcommitted)
+
+	// rows were remapped after a reset, 12000m stay allocated on 10000m
+	memory = 10000
+	d.sample()
+	devs = registered()
+	assert.Equal(t, devs[0].Devmem, int32(10000))
+	assert.Assert(t, devs[0].Overcommitted)
+	assert.Assert(t, devs[0].Health)
+	assert.Assert(t, !devs[1].Overcommitted)
+	pods, err := client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(pods.Items), 2)
+
+	// the flag is cleared once a pod ended
+	assert.NilError(t, client.CoreV1().Pods("default").Delete(context.Background(), "b", metav1.DeleteOptions{}))
+	devs = registered()
+	assert.Assert(t, !devs[0].Overcommitted)
+}
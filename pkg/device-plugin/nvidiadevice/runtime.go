@@ -0,0 +1,163 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Constants to represent the container runtimes kubelet may use.
+const (
+	RuntimeFlavorAuto       = "auto"
+	RuntimeFlavorDocker     = "docker"
+	RuntimeFlavorContainerd = "containerd"
+	RuntimeFlavorCRIO       = "crio"
+)
+
+// RuntimeEnv locates what runtime detection inspects on the host, tests point it at fixtures.
+type RuntimeEnv struct {
+	// ProcDir is the host /proc, the plugin runs with hostPID.
+	ProcDir string
+	// RunDir is the host /run as mounted into the plugin.
+	RunDir string
+}
+
+// DefaultRuntimeEnv inspects the host directories mounted by the chart.
+func DefaultRuntimeEnv() *RuntimeEnv {
+	return &RuntimeEnv{ProcDir: "/proc", RunDir: "/hostrun"}
+}
+
+// runtimeSockets are looked for in RunDir when kubelet doesn't name its runtime endpoint.
+// Docker runs on containerd, so docker is looked for first.
+var runtimeSockets = []struct {
+	flavor string
+	paths  []string
+}{
+	{RuntimeFlavorCRIO, []string{"crio/crio.sock"}},
+	{RuntimeFlavorDocker, []string{"cri-dockerd.sock", "docker.sock", "dockershim.sock"}},
+	{RuntimeFlavorContainerd, []string{"containerd/containerd.sock"}},
+}
+
+// runtimeStrategies is the device list strategy each runtime flavor gets unless one is
+// chosen explicitly, and which combinations work:
+//
+//	              envvar                volume-mounts         cdi-annotations
+//	docker        default               with volume mounts    unsupported
+//	containerd    default               with volume mounts    containerd 1.7+, enable_cdi
+//	crio          with the OCI hook     with the OCI hook     default, CRI-O 1.23+
+//
+// envvar and volume-mounts rely on the NVIDIA container runtime being the default runtime,
+// or, for CRI-O, on the nvidia-container-runtime-hook being installed as an OCI hook.
+// "with volume mounts" needs accept-nvidia-visible-devices-as-volume-mounts in the runtime's
+// config.toml. cdi-annotations needs a CDI specification of the GPUs named by UUID, e.g.
+// nvidia-ctk cdi generate --device-name-strategy=uuid, and no NVIDIA runtime at all.
+var runtimeStrategies = map[string]string{
+	RuntimeFlavorDocker:     DeviceListStrategyEnvvar,
+	RuntimeFlavorContainerd: DeviceListStrategyEnvvar,
+	RuntimeFlavorCRIO:       DeviceListStrategyCDIAnnotations,
+}
+
+// DetectRuntimeFlavor resolves the runtime flavor to use, honouring an explicit choice and
+// otherwise preferring the runtime endpoint kubelet was started with over the sockets found
+// on the host. It returns "" if the runtime can't be told.
+func DetectRuntimeFlavor(flavor string, env *RuntimeEnv) (string, error) {
+	switch flavor {
+	case RuntimeFlavorDocker, RuntimeFlavorContainerd, RuntimeFlavorCRIO:
+		return flavor, nil
+	case RuntimeFlavorAuto, "":
+	default:
+		return "", fmt.Errorf("unknown runtime flavor: %v", flavor)
+	}
+	if endpoint := kubeletRuntimeEndpoint(env.ProcDir); endpoint != "" {
+		if f := endpointFlavor(endpoint); f != "" {
+			klog.Infof("kubelet uses runtime endpoint %v", endpoint)
+			return f, nil
+		}
+		klog.Warningf("unknown kubelet runtime endpoint %v", endpoint)
+	}
+	for _, s := range runtimeSockets {
+		for _, p := range s.paths {
+			if _, err := os.Stat(filepath.Join(env.RunDir, p)); err == nil {
+				klog.Infof("found runtime socket /run/%v", p)
+				return s.flavor, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func endpointFlavor(endpoint string) string {
+	switch {
+	case strings.Contains(endpoint, "crio"):
+		return RuntimeFlavorCRIO
+	case strings.Contains(endpoint, "docker"):
+		return RuntimeFlavorDocker
+	case strings.Contains(endpoint, "containerd"):
+		return RuntimeFlavorContainerd
+	}
+	return ""
+}
+
+// kubeletRuntimeEndpoint returns the --container-runtime-endpoint of the kubelet process,
+// or "" if kubelet isn't found or uses its default.
+func kubeletRuntimeEndpoint(procDir string) string {
+	cmdlines, _ := filepath.Glob(filepath.Join(procDir, "[0-9]*", "cmdline"))
+	for _, path := range cmdlines {
+		data, err := os.ReadFile(path)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(data, "\x00")), "\x00")
+		if filepath.Base(args[0]) != "kubelet" {
+			continue
+		}
+		for i, arg := range args {
+			if strings.HasPrefix(arg, "--container-runtime-endpoint=") {
+				return strings.TrimPrefix(arg, "--container-runtime-endpoint=")
+			}
+			if arg == "--container-runtime-endpoint" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// RuntimeDeviceListStrategy returns the device list strategy to use with the runtime flavor,
+// strategy if it was chosen explicitly, and fails on combinations that can't work.
+func RuntimeDeviceListStrategy(strategy, flavor string) (string, error) {
+	if strategy == DeviceListStrategyAuto || strategy == "" {
+		strategy = DeviceListStrategyEnvvar
+		if s, ok := runtimeStrategies[flavor]; ok {
+			strategy = s
+		}
+	}
+	if err := ValidateDeviceListStrategy(strategy); err != nil {
+		return "", err
+	}
+	if flavor == RuntimeFlavorDocker && strategy == DeviceListStrategyCDIAnnotations {
+		return "", fmt.Errorf("device list strategy %v is not supported with docker", strategy)
+	}
+	return strategy, nil
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/golden"
+)
+
+// runtimeEnvFixture fakes a host with the given files under /run and a kubelet command line.
+func runtimeEnvFixture(t *testing.T, sockets []string, kubelet ...string) *RuntimeEnv {
+	env := &RuntimeEnv{ProcDir: t.TempDir(), RunDir: t.TempDir()}
+	for _, s := range sockets {
+		path := filepath.Join(env.RunDir, s)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NilError(t, os.WriteFile(path, nil, 0644))
+	}
+	assert.NilError(t, os.MkdirAll(filepath.Join(env.ProcDir, "1"), 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(env.ProcDir, "1", "cmdline"), []byte("/sbin/init\x00"), 0644))
+	if len(kubelet) > 0 {
+		assert.NilError(t, os.MkdirAll(filepath.Join(env.ProcDir, "812"), 0755))
+		cmdline := strings.Join(append([]string{"/usr/bin/kubelet"}, kubelet...), "\x00") + "\x00"
+		assert.NilError(t, os.WriteFile(filepath.Join(env.ProcDir, "812", "cmdline"), []byte(cmdline), 0644))
+	}
+	return env
+}
+
+func TestDetectRuntimeFlavor(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		env     *RuntimeEnv
+		flavor  string
+		want    string
+		wantErr string
+	}{
+		{name: "explicit", env: runtimeEnvFixture(t, nil), flavor: RuntimeFlavorCRIO, want: RuntimeFlavorCRIO},
+		{name: "unknown", env: runtimeEnvFixture(t, nil), flavor: "podman", wantErr: "unknown runtime flavor"},
+		{name: "nothing found", env: runtimeEnvFixture(t, nil), flavor: RuntimeFlavorAuto, want: ""},
+		{name: "crio socket", env: runtimeEnvFixture(t, []string{"crio/crio.sock"}), want: RuntimeFlavorCRIO},
+		// docker hosts run containerd too
+		{name: "docker socket", env: runtimeEnvFixture(t, []string{"docker.sock", "containerd/containerd.sock"}), want: RuntimeFlavorDocker},
+		{name: "containerd socket", env: runtimeEnvFixture(t, []string{"containerd/containerd.sock"}), want: RuntimeFlavorContainerd},
+		{
+			name: "kubelet endpoint wins over sockets",
+			env:  runtimeEnvFixture(t, []string{"docker.sock", "containerd/containerd.sock"}, "--config=/var/lib/kubelet/config.yaml", "--container-runtime-endpoint=unix:///run/containerd/containerd.sock"),
+			want: RuntimeFlavorContainerd,
+		},
+		{
+			name: "kubelet endpoint as separate argument",
+			env:  runtimeEnvFixture(t, nil, "--container-runtime-endpoint", "unix:///var/run/crio/crio.sock"),
+			want: RuntimeFlavorCRIO,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DetectRuntimeFlavor(tc.flavor, tc.env)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
+
+func TestRuntimeDeviceListStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy, flavor, want, wantErr string
+	}{
+		{strategy: DeviceListStrategyAuto, flavor: RuntimeFlavorDocker, want: DeviceListStrategyEnvvar},
+		{strategy: DeviceListStrategyAuto, flavor: RuntimeFlavorContainerd, want: DeviceListStrategyEnvvar},
+		{strategy: DeviceListStrategyAuto, flavor: RuntimeFlavorCRIO, want: DeviceListStrategyCDIAnnotations},
+		{strategy: DeviceListStrategyAuto, flavor: "", want: DeviceListStrategyEnvvar},
+		{strategy: DeviceListStrategyVolumeMounts, flavor: RuntimeFlavorCRIO, want: DeviceListStrategyVolumeMounts},
+		{strategy: DeviceListStrategyCDIAnnotations, flavor: RuntimeFlavorContainerd, want: DeviceListStrategyCDIAnnotations},
+		{strategy: DeviceListStrategyCDIAnnotations, flavor: RuntimeFlavorDocker, wantErr: "not supported with docker"},
+		{strategy: "cdi", flavor: RuntimeFlavorCRIO, wantErr: "unknown device list strategy"},
+	} {
+		got, err := RuntimeDeviceListStrategy(tc.strategy, tc.flavor)
+		if tc.wantErr != "" {
+			assert.ErrorContains(t, err, tc.wantErr)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, got, tc.want, "%v on %v", tc.strategy, tc.flavor)
+	}
+}
+
+// TestAllocatePerRuntimeFlavor compares the Allocate response on a node of each runtime flavor
+// with the one recorded in testdata, run with -update to record them again.
+func TestAllocatePerRuntimeFlavor(t *testing.T) {
+	for flavor, sockets := range map[string][]string{
+		RuntimeFlavorDocker:     {"docker.sock", "containerd/containerd.sock"},
+		RuntimeFlavorContainerd: {"containerd/containerd.sock"},
+		RuntimeFlavorCRIO:       {"crio/crio.sock"},
+	} {
+		t.Run(flavor, func(t *testing.T) {
+			m, _ := setupAllocate(t, "GPU-0,NVIDIA,1000,30:GPU-1,NVIDIA,2000,30:")
+			oldStrategy := config.DeviceListStrategy
+			t.Cleanup(func() { config.DeviceListStrategy = oldStrategy })
+			config.Enforcement = EnforcementHook
+			t.Setenv("HOOK_PATH", "/usr/local/vgpu")
+
+			detected, err := DetectRuntimeFlavor(RuntimeFlavorAuto, runtimeEnvFixture(t, sockets))
+			assert.NilError(t, err)
+			assert.Equal(t, detected, flavor)
+			config.DeviceListStrategy, err = RuntimeDeviceListStrategy(DeviceListStrategyAuto, detected)
+			assert.NilError(t, err)
+
+			res, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0", "GPU-1-0"))
+			assert.NilError(t, err)
+			resp := res.ContainerResponses[0]
+			// the container directory differs on every run
+			for _, mnt := range resp.Mounts {
+				mnt.HostPath = strings.Replace(mnt.HostPath, config.ContainerCacheRoot, "$CONTAINERS", 1)
+			}
+			got, err := json.MarshalIndent(resp, "", "  ")
+			assert.NilError(t, err)
+
+			golden.Assert(t, string(got)+"\n", "allocate-"+flavor+".json")
+		})
+	}
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// DevicesPath is where the runtime service serves the device states, with ?watch=true
+// it streams them as one JSON array per line whenever they change.
+const DevicesPath = "/devices"
+
+// DeviceAllocation is a container's share of a device, memory is in MiB. EnforcedCores
+// are the requested cores rounded to the steps the hook library enforces. AllowedCores is
+// set for containers that may burst or borrow cores, to the cores they may use at the
+// moment. With --idle-core-reclaim, LentCores are the cores an idle container lends to
+// the others on the device, BorrowedCores what a container borrows of them.
+type DeviceAllocation struct {
+	Namespace     string `json:"namespace"`
+	Pod           string `json:"pod"`
+	Container     string `json:"container"`
+	Memory        int32  `json:"memory"`
+	Cores         int32  `json:"cores"`
+	EnforcedCores int32  `json:"enforcedCores"`
+	AllowedCores  int32  `json:"allowedCores,omitempty"`
+	LentCores     int32  `json:"lentCores,omitempty"`
+	BorrowedCores int32  `json:"borrowedCores,omitempty"`
+	// MemoryBandwidth is the memory bandwidth limit of the pod in percent, only set where
+	// the hook library enforces it, see config.MemoryBandwidthLimit
+	MemoryBandwidth int32 `json:"memoryBandwidth,omitempty"`
+	// MemoryTier is the memory tier the scheduler placed the pod in, see util.MemoryTierAnnotation,
+	// only set where the hook library enforces it, see config.MemoryTiers
+	MemoryTier string `json:"memoryTier,omitempty"`
+}
+
+// DeviceState is what the runtime service tells about a device, memory is in MiB and
+// missing until NVML answered for the device. Contexts are the processes using it, the
+// temperature is in °C, FreeCores is the percent of the SMs not given to the allocations,
+// Legacy is set while it is held by pods of the stock device plugin.
+type DeviceState struct {
+	ID          string             `json:"id"`
+	Health      string             `json:"health"`
+	Model       string             `json:"model,omitempty"`
+	Memory      int32              `json:"memory,omitempty"`
+	Free        uint64             `json:"free,omitempty"`
+	Contexts    int                `json:"contexts"`
+	Temperature uint               `json:"temperature,omitempty"`
+	FreeCores   int32              `json:"freeCores"`
+	Blacklisted bool               `json:"blacklisted,omitempty"`
+	Drained     bool               `json:"drained,omitempty"`
+	Legacy      bool               `json:"legacy,omitempty"`
+	Allocations []DeviceAllocation `json:"allocations,omitempty"`
+}
+
+// RuntimeService serves a read-only copy of the device cache on the runtime socket, so
+// agents on the node can follow the devices without polling or the API server. The
+// states are sent on every change of the cache, which samples the devices periodically.
+// The blacklist is the only thing it changes, if config.EnableDeviceBlacklist is set, and
+// it can have the devices enumerated again on RefreshPath.
+type RuntimeService struct {
+	cache    *DeviceCache
+	nodeName string
+	client   kubernetes.Interface
+	server   *http.Server
+	// usage is served on UsagePath, nil while the heartbeats aren't checked
+	usage *UsageTracker
+	// migration is served on MigrationPath, nil unless migrating from the stock plugin
+	migration *LegacyMigration
+	// blacklistMu orders the blacklist changes with writing them to the checkpoint
+	blacklistMu sync.Mutex
+}
+
+func NewRuntimeService(cache *DeviceCache, nodeName string, client kubernetes.Interface) *RuntimeService {
+	s := &RuntimeService{cache: cache, nodeName: nodeName, client: client}
+	mux := http.NewServeMux()
+	mux.HandleFunc(DevicesPath, s.serveDevices)
+	mux.HandleFunc(BlacklistPath, s.serveBlacklist)
+	mux.HandleFunc(BlacklistPath+"/", s.serveBlacklist)
+	mux.HandleFunc(DrainPath, s.serveDrain)
+	mux.HandleFunc(UsagePath, s.serveUsage)
+	mux.HandleFunc(MigrationPath, s.serveMigration)
+	mux.HandleFunc(CapacityCheckPath, s.serveCapacityCheck)
+	mux.HandleFunc(RefreshPath, s.serveRefresh)
+	mux.HandleFunc(PlanPath, s.servePlan)
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// SetUsageTracker sets the tracker whose container usage is served on UsagePath.
+func (s *RuntimeService) SetUsageTracker(usage *UsageTracker) {
+	s.usage = usage
+}
+
+// SetLegacyMigration sets the migration whose progress is served on MigrationPath.
+func (s *RuntimeService) SetLegacyMigration(migration *LegacyMigration) {
+	s.migration = migration
+}
+
+// Serve listens on the unix socket at path until Stop. A stale socket is replaced, one
+// still answering belongs to another process and is left alone.
+func (s *RuntimeService) Serve(path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		if !staleSocket(path) {
+			return fmt.Errorf("%v is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Serving device states on %v", path)
+	if err := s.server.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop closes the socket and the open watches.
+func (s *RuntimeService) Stop() {
+	s.server.Close()
+}
+
+func (s *RuntimeService) serveDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("watch") != "true" {
+		json.NewEncoder(w).Encode(s.states(r.Context(), s.cache.Snapshot()))
+		return
+	}
+
+	events, cancel := s.cache.Watch()
+	defer cancel()
+	flusher, _ := w.(http.Flusher)
+	var last []byte
+	snapshot := s.cache.Snapshot()
+	for {
+		data, err := json.Marshal(s.states(r.Context(), snapshot))
+		if err != nil {
+			klog.Errorf("encode device states: %v", err)
+			return
+		}
+		if !bytes.Equal(data, last) {
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			last = data
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			snapshot = ev.Snapshot
+		}
+	}
+}
+
+// serveBlacklist lists the blacklisted devices, and blacklists the device named in the
+// path on PUT or takes it back on DELETE. Changes are kept in config.CheckpointFile.
+func (s *RuntimeService) serveBlacklist(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, BlacklistPath), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.cache.Blacklisted())
+		return
+	case r.Method != http.MethodPut && r.Method != http.MethodDelete || id == "":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	case !config.EnableDeviceBlacklist:
+		http.Error(w, "device blacklisting is disabled, see --enable-device-blacklist", http.StatusForbidden)
+		return
+	}
+	blacklisted := r.Method == http.MethodPut
+	s.blacklistMu.Lock()
+	defer s.blacklistMu.Unlock()
+	changed, err := s.cache.SetBlacklisted(id, blacklisted)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if changed && len(config.CheckpointFile) > 0 {
+		if err := WriteCheckpoint(config.CheckpointFile, &Checkpoint{Blacklist: s.cache.Blacklisted()}); err != nil {
+			// a change that would be lost on restart is undone
+			s.cache.SetBlacklisted(id, !blacklisted)
+			klog.Errorf("write checkpoint %v: %v", config.CheckpointFile, err)
+			http.Error(w, fmt.Sprintf("write checkpoint: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// states returns the devices of snapshot with the containers they are allocated to.
+func (s *RuntimeService) states(ctx context.Context, snapshot *DeviceSnapshot) []DeviceState {
+	res := []DeviceState{}
+	if snapshot == nil {
+		return res
+	}
+	allocations := NodeAllocations(ctx, s.client, s.nodeName)
+	for _, dev := range snapshot.Devices {
+		state := DeviceState{
+			ID:          dev.ID,
+			Health:      dev.Health,
+			Blacklisted: snapshot.Blacklisted[dev.ID],
+			Drained:     snapshot.Drained[dev.ID],
+			Legacy:      snapshot.Legacy[dev.ID],
+			Allocations: allocations[dev.ID],
+			FreeCores:   100,
+		}
+		for _, a := range state.Allocations {
+			state.FreeCores -= a.Cores
+		}
+		if state.FreeCores < 0 {
+			state.FreeCores = 0
+		}
+		if sample, ok := snapshot.Samples[dev.ID]; ok {
+			state.Model, state.Memory, state.Free, state.Contexts = sample.Model, sample.Memory, sample.Free, sample.Contexts
+			state.Temperature = sample.Temperature
+		}
+		res = append(res, state)
+	}
+	return res
+}
+
+// NodeAllocations returns the containers of running pods on node nodeName by device
+// UUID, none without a client.
+func NodeAllocations(ctx context.Context, client kubernetes.Interface, nodeName string) map[string][]DeviceAllocation {
+	res := make(map[string][]DeviceAllocation)
+	if client == nil {
+		return res
+	}
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodeName})
+	if err != nil {
+		klog.Errorf("list pods of node %v: %v", nodeName, err)
+		return res
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		a, b := pods.Items[i], pods.Items[j]
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Name < b.Name
+	})
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		pd, err := annotations.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+		if err != nil {
+			klog.V(4).Infof("pod %v/%v annotation %v: %v", pod.Namespace, pod.Name, util.AssignedIDsAnnotations, err)
+			continue
+		}
+		var bandwidth int32
+		if config.MemoryBandwidthLimit {
+			// 0 if the annotation is missing or invalid
+			bandwidth, _ = annotations.DecodeMemoryPercent(pod.Annotations[util.MemoryBandwidthAnnotation])
+		}
+		var tier string
+		if config.MemoryTiers {
+			tier = memoryTier(&pod)
+		}
+		for i, devs := range pd {
+			if i >= len(pod.Spec.Containers) {
+				break
+			}
+			ctr := pod.Spec.Containers[i].Name
+			for _, dev := range devs {
+				allocation := DeviceAllocation{
+					Namespace:       pod.Namespace,
+					Pod:             pod.Name,
+					Container:       ctr,
+					Memory:          dev.Usedmem,
+					Cores:           dev.Usedcores,
+					MemoryBandwidth: bandwidth,
+					MemoryTier:      tier,
+				}
+				if !config.DisableCoreLimit {
+					allocation.EnforcedCores, _ = enforcedCores(dev.Usedcores)
+				}
+				allocation.AllowedCores, _ = allowedBurstCores(string(pod.UID)+"_"+ctr, dev.UUID)
+				loan, _ := coreLoanOf(string(pod.UID)+"_"+ctr, dev.UUID)
+				allocation.LentCores, allocation.BorrowedCores = loan.Lent, loan.Borrowed
+				res[dev.UUID] = append(res[dev.UUID], allocation)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestRuntimeServiceWatchDevices(t *testing.T) {
+	var free uint64 = 16000
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: atomic.LoadUint64(&free)}, nil
+	})
+	d.sample()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+			util.AssignedIDsAnnotations: "GPU-1,NVIDIA,3000,30:;",
+		}},
+		Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c"}}},
+	}
+	s := NewRuntimeService(d, "node1", fake.NewSimpleClientset(pod))
+	socket := filepath.Join(t.TempDir(), "vgpu.sock")
+	go s.Serve(socket)
+	defer s.Stop()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var res *http.Response
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if res, err = client.Get("http://vgpu" + DevicesPath); err == nil {
+			break
+		}
+	}
+	assert.NilError(t, err)
+	var states []DeviceState
+	assert.NilError(t, json.NewDecoder(res.Body).Decode(&states))
+	res.Body.Close()
+	assert.DeepEqual(t, states, []DeviceState{
+		{ID: "GPU-0", Health: pluginapi.Healthy, Model: "A100", Memory: 16000, Free: 16000, FreeCores: 100},
+		{ID: "GPU-1", Health: pluginapi.Healthy, Model: "A100", Memory: 16000, Free: 16000, FreeCores: 70, Allocations: []DeviceAllocation{
+			{Namespace: "default", Pod: "p", Container: "c", Memory: 3000, Cores: 30, EnforcedCores: 30},
+		}},
+	})
+
+	res, err = client.Get("http://vgpu" + DevicesPath + "?watch=true")
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	lines := bufio.NewScanner(res.Body)
+	assert.Assert(t, lines.Scan())
+	assert.NilError(t, json.Unmarshal(lines.Bytes(), &states))
+	assert.Equal(t, states[0].Free, uint64(16000))
+
+	// an unchanged sample sends nothing, a changed one the new states
+	d.sample()
+	atomic.StoreUint64(&free, 13000)
+	d.sample()
+	assert.Assert(t, lines.Scan())
+	assert.NilError(t, json.Unmarshal(lines.Bytes(), &states))
+	assert.Equal(t, states[0].Free, uint64(13000))
+
+	d.unhealthy = make(chan *Device)
+	go d.notify()
+	defer close(d.stopCh)
+	d.unhealthy <- d.cache[1]
+	assert.Assert(t, lines.Scan())
+	assert.NilError(t, json.Unmarshal(lines.Bytes(), &states))
+	assert.Equal(t, states[1].Health, pluginapi.Unhealthy)
+}
+
+func TestRuntimeServiceBlacklist(t *testing.T) {
+	oldEnable, oldCheckpoint := config.EnableDeviceBlacklist, config.CheckpointFile
+	t.Cleanup(func() { config.EnableDeviceBlacklist, config.CheckpointFile = oldEnable, oldCheckpoint })
+	config.EnableDeviceBlacklist, config.CheckpointFile = false, filepath.Join(t.TempDir(), "checkpoint.json")
+	d := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	d.sample()
+	events, cancel := d.Watch()
+	defer cancel()
+	s := NewRuntimeService(d, "node1", nil)
+	do := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, do(http.MethodPut, BlacklistPath+"/GPU-1"), http.StatusForbidden)
+	config.EnableDeviceBlacklist = true
+	assert.Equal(t, do(http.MethodPut, BlacklistPath+"/GPU-9"), http.StatusNotFound)
+	assert.Equal(t, do(http.MethodPost, BlacklistPath+"/GPU-1"), http.StatusMethodNotAllowed)
+
+	assert.Equal(t, do(http.MethodPut, BlacklistPath+"/GPU-1"), http.StatusNoContent)
+	assert.DeepEqual(t, changed(events), []string{"GPU-1"})
+	states := s.states(context.Background(), d.Snapshot())
+	assert.Equal(t, states[0].Health, pluginapi.Healthy)
+	assert.Equal(t, states[1].Health, pluginapi.Unhealthy)
+	assert.Assert(t, states[1].Blacklisted)
+	checkpoint, err := ReadCheckpoint(config.CheckpointFile)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, checkpoint.Blacklist, []string{"GPU-1"})
+
+	// sampling doesn't bring the device back
+	d.sample()
+	assert.Equal(t, d.GetCache()[1].Health, pluginapi.Unhealthy)
+
+	// a restarted plugin blacklists the device again
+	restarted := newTestCache(t, 2, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 16000}, nil
+	})
+	for _, id := range checkpoint.Blacklist {
+		_, err := restarted.SetBlacklisted(id, true)
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, restarted.GetCache()[1].Health, pluginapi.Unhealthy)
+
+	assert.Equal(t, do(http.MethodDelete, BlacklistPath+"/GPU-1"), http.StatusNoContent)
+	assert.Equal(t, d.GetCache()[1].Health, pluginapi.Healthy)
+	checkpoint, err = ReadCheckpoint(config.CheckpointFile)
+	assert.NilError(t, err)
+	assert.Equal(t, len(checkpoint.Blacklist), 0)
+}
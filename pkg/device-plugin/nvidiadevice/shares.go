@@ -0,0 +1,150 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// maxShares returns how many containers may share a GPU of the given model on node: the
+// node's util.MaxSharesAnnotation, else the model's entry in config.ModelMaxShares, else
+// config.MaxSharesPerDevice. The split count, which bounds the slices advertised to
+// kubelet, caps all of them and is the limit when none is set. 0 means no limit.
+func maxShares(node *corev1.Node, model string, splitCount uint) int32 {
+	limit := config.MaxSharesPerDevice
+	if v := config.ModelMaxShares[model]; v > 0 {
+		limit = v
+	}
+	if val, ok := node.Annotations[util.MaxSharesAnnotation]; ok {
+		v, err := strconv.ParseUint(val, 10, 31)
+		if err != nil || v == 0 {
+			klog.Errorf("ignoring annotation %v=%q of node %v: not a positive integer", util.MaxSharesAnnotation, val, node.Name)
+		} else {
+			limit = uint(v)
+		}
+	}
+	if splitCount > 0 && (limit == 0 || limit > splitCount) {
+		limit = splitCount
+	}
+	return int32(limit)
+}
+
+// checkContexts fails when a GPU of devreq already runs as many CUDA contexts as the
+// containers config.MaxSharesPerDevice or the model's config.ModelMaxShares let share it.
+// It stands in for checkMaxShares without the API server, where the containers of pods
+// can't be counted, and is only applied when a limit is set.
+func checkContexts(cache *DeviceCache, devreq util.ContainerDevices) error {
+	for _, dev := range devreq {
+		sample, ok := cache.Sample(dev.UUID)
+		if !ok {
+			continue
+		}
+		if config.MaxSharesPerDevice == 0 && config.ModelMaxShares[sample.Model] == 0 {
+			continue
+		}
+		limit := maxShares(&corev1.Node{}, sample.Model, cache.SplitCount(dev.UUID))
+		if limit > 0 && int32(sample.Contexts) >= limit {
+			return fmt.Errorf("device %v runs %d CUDA contexts, at its limit of %d containers", dev.UUID, sample.Contexts, limit)
+		}
+	}
+	return nil
+}
+
+// deviceShares counts the containers sharing each device among pods, by device UUID.
+// Pods that ended and the pod skip don't count.
+func deviceShares(pods []corev1.Pod, skip types.UID) map[string]int32 {
+	res := make(map[string]int32)
+	for _, pod := range pods {
+		if pod.UID == skip || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		pd, err := annotations.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+		if err != nil {
+			klog.V(4).Infof("pod %v/%v annotation %v: %v", pod.Namespace, pod.Name, util.AssignedIDsAnnotations, err)
+			continue
+		}
+		for _, devs := range pd {
+			for _, dev := range devs {
+				res[dev.UUID]++
+			}
+		}
+	}
+	return res
+}
+
+// checkMaxShares fails when a GPU of devreq would be shared by more containers than
+// maxShares allows. The scheduler enforces the limit already, this catches pods it placed
+// before the node registered a lower one.
+func checkMaxShares(ctx context.Context, cache *DeviceCache, nodename string, current *corev1.Pod, devreq util.ContainerDevices) error {
+	client := util.GetClient()
+	node, err := client.CoreV1().Nodes().Get(ctx, nodename, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("check device shares: %w", err)
+	}
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + nodename})
+	if err != nil {
+		return fmt.Errorf("check device shares: %w", err)
+	}
+	shares := deviceShares(pods.Items, current.UID)
+	for _, dev := range devreq {
+		var model string
+		if sample, ok := cache.Sample(dev.UUID); ok {
+			model = sample.Model
+		}
+		limit := maxShares(node, model, cache.SplitCount(dev.UUID))
+		if used := shares[dev.UUID] + 1; limit > 0 && used > limit {
+			return fmt.Errorf("device %v would be shared by %d containers, more than its limit of %d", dev.UUID, used, limit)
+		}
+	}
+	return nil
+}
+
+// checkDistinct fails when pod asks for distinct GPUs with util.DistinctGPUsAnnotation but
+// the scheduler assigned a GPU to more than one of its devices. This catches assignments
+// of schedulers not aware of the annotation.
+func checkDistinct(pod *corev1.Pod) error {
+	if pod.Annotations[util.DistinctGPUsAnnotation] != "true" {
+		return nil
+	}
+	pd, err := annotations.DecodePodDevices(pod.Annotations[util.AssignedIDsAnnotations])
+	if err != nil {
+		return fmt.Errorf("check distinct devices: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, devs := range pd {
+		for _, dev := range devs {
+			if dev.Type != util.NvidiaGPUDevice {
+				continue
+			}
+			if seen[dev.UUID] {
+				return fmt.Errorf("pod %v/%v asks for distinct GPUs but got device %v more than once", pod.Namespace, pod.Name, dev.UUID)
+			}
+			seen[dev.UUID] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMaxSharesPrecedence(t *testing.T) {
+	oldFlag, oldModels := config.MaxSharesPerDevice, config.ModelMaxShares
+	t.Cleanup(func() { config.MaxSharesPerDevice, config.ModelMaxShares = oldFlag, oldModels })
+	config.ModelMaxShares = map[string]uint{"Tesla T4": 6}
+
+	node := func(annotation string) *corev1.Node {
+		n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+		if annotation != "" {
+			n.Annotations = map[string]string{util.MaxSharesAnnotation: annotation}
+		}
+		return n
+	}
+	for name, tc := range map[string]struct {
+		flag       uint
+		model      string
+		annotation string
+		split      uint
+		want       int32
+	}{
+		"split count only":        {split: 10, want: 10},
+		"no limit":                {want: 0},
+		"no split count":          {flag: 3, want: 3},
+		"flag":                    {flag: 8, model: "A100", split: 10, want: 8},
+		"model over flag":         {flag: 8, model: "Tesla T4", split: 10, want: 6},
+		"annotation over model":   {flag: 8, model: "Tesla T4", annotation: "4", split: 10, want: 4},
+		"annotation over flag":    {flag: 8, model: "A100", annotation: "9", split: 10, want: 9},
+		"split count caps model":  {model: "Tesla T4", split: 4, want: 4},
+		"split count caps node":   {annotation: "20", split: 10, want: 10},
+		"invalid annotation":      {flag: 8, model: "Tesla T4", annotation: "six", split: 10, want: 6},
+		"zero annotation ignored": {flag: 8, annotation: "0", split: 10, want: 8},
+	} {
+		config.MaxSharesPerDevice = tc.flag
+		assert.Equal(t, maxShares(node(tc.annotation), tc.model, tc.split), tc.want, name)
+	}
+}
+
+func TestAllocateEnforcesMaxShares(t *testing.T) {
+	m, client := setupAllocate(t, "GPU-0,NVIDIA,1000,30:")
+	old := config.MaxSharesPerDevice
+	t.Cleanup(func() { config.MaxSharesPerDevice = old })
+	config.MaxSharesPerDevice = 2
+
+	for _, name := range []string{"q", "r"} {
+		other := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name), Annotations: map[string]string{
+				util.AssignedIDsAnnotations: "GPU-0,NVIDIA,1000,30:",
+			}},
+			Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c"}}},
+		}
+		_, err := client.CoreV1().Pods("default").Create(context.Background(), other, metav1.CreateOptions{})
+		assert.NilError(t, err)
+	}
+	_, err := m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.ErrorContains(t, err, "device GPU-0 would be shared by 3 containers, more than its limit of 2")
+
+	// the annotation raises the limit of the node
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	node.Annotations[util.MaxSharesAnnotation] = "3"
+	node.Annotations[util.NodeLockTime] = "locked"
+	_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	pod.Annotations[util.DeviceBindPhase] = util.DeviceBindAllocating
+	_, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	_, err = m.Allocate(context.Background(), allocateRequest("GPU-0-0"))
+	assert.NilError(t, err)
+}
+
+func TestCheckDistinct(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", Annotations: map[string]string{
+		util.AssignedIDsAnnotations: annotations.EncodePodDevices(annotations.PodDevices{
+			{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 1000}},
+			{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 1000}},
+		}),
+	}}}
+	assert.NilError(t, checkDistinct(pod))
+
+	pod.Annotations[util.DistinctGPUsAnnotation] = "true"
+	assert.ErrorContains(t, checkDistinct(pod), "GPU-0 more than once")
+
+	pod.Annotations[util.AssignedIDsAnnotations] = annotations.EncodePodDevices(annotations.PodDevices{
+		{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 1000}},
+		{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 1000}},
+	})
+	assert.NilError(t, checkDistinct(pod))
+}
+
+func TestCheckContexts(t *testing.T) {
+	old := config.MaxSharesPerDevice
+	t.Cleanup(func() { config.MaxSharesPerDevice = old })
+	contexts := 2
+	d := newTestCache(t, 1, func(uuid string) (DeviceSample, error) {
+		return DeviceSample{Model: "A100", Memory: 16000, Free: 12000, Contexts: contexts}, nil
+	})
+	d.sample()
+	devreq := util.ContainerDevices{{UUID: "GPU-0", Type: "NVIDIA", Usedmem: 1000}}
+
+	config.MaxSharesPerDevice = 0
+	assert.NilError(t, checkContexts(d, devreq))
+
+	config.MaxSharesPerDevice = 2
+	assert.ErrorContains(t, checkContexts(d, devreq), "device GPU-0 runs 2 CUDA contexts, at its limit of 2 containers")
+
+	contexts = 1
+	d.sample()
+	assert.NilError(t, checkContexts(d, devreq))
+}
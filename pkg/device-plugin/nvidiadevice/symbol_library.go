@@ -0,0 +1,50 @@
+//go:build !nogpu
+
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+// #cgo LDFLAGS: -ldl
+// #include <dlfcn.h>
+//
+// // The NVML bindings don't wrap every NVML function, the *_library.go files look
+// // the others up in the library they loaded with nvml_symbol.
+// void *nvml_symbol(const char *name) {
+// 	void *lib = dlopen("libnvidia-ml.so.1", RTLD_LAZY | RTLD_NOLOAD);
+// 	if (lib == NULL)
+// 		return NULL;
+// 	void *sym = dlsym(lib, name);
+// 	dlclose(lib);
+// 	return sym;
+// }
+//
+// static const char *nvml_error(int ret) {
+// 	const char *(*str)(int) = nvml_symbol("nvmlErrorString");
+// 	return str == NULL ? "unknown error" : str(ret);
+// }
+import "C"
+
+import "errors"
+
+// nvmlError is the error of ret returned by a function looked up with nvml_symbol, -1
+// when NVML isn't loaded.
+func nvmlError(ret C.int) error {
+	if ret == -1 {
+		return errors.New("NVML is not loaded")
+	}
+	return errors.New(C.GoString(C.nvml_error(ret)))
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// taintOwner is the value of the taints the device plugin manages, a taint with the
+// same key and another value was set by someone else and is left alone.
+const taintOwner = "vgpu-device-plugin"
+
+// taintResync is how often the taint is reconciled without a health change, so it is
+// restored if removed by hand and removed once the node recovers.
+var taintResync = time.Minute
+
+// NodeTaintManager taints the node with util.GPUUnhealthyTaint while none of its GPUs
+// is healthy and removes the taint when one recovers.
+type NodeTaintManager struct {
+	deviceCache *DeviceCache
+	nodeName    string
+	client      kubernetes.Interface
+}
+
+func NewNodeTaintManager(deviceCache *DeviceCache, nodeName string, client kubernetes.Interface) *NodeTaintManager {
+	return &NodeTaintManager{
+		deviceCache: deviceCache,
+		nodeName:    nodeName,
+		client:      client,
+	}
+}
+
+// Run reconciles the taint on every health change until stop is closed.
+func (m *NodeTaintManager) Run(stop <-chan struct{}) {
+	events, cancel := m.deviceCache.Watch()
+	defer cancel()
+	ticker := time.NewTicker(taintResync)
+	defer ticker.Stop()
+	reconcile := true
+	for {
+		if reconcile {
+			if err := m.reconcile(context.Background()); err != nil {
+				klog.Errorf("reconcile taint %v: %v", util.GPUUnhealthyTaint, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case ev := <-events:
+			reconcile = len(ev.Changed) > 0
+		case <-ticker.C:
+			reconcile = true
+		}
+	}
+}
+
+func (m *NodeTaintManager) healthy() int {
+	n := 0
+	for _, d := range m.deviceCache.GetCache() {
+		if d.Health == pluginapi.Healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// reconcile adds or removes the taint, nodes without GPUs are never tainted.
+func (m *NodeTaintManager) reconcile(ctx context.Context) error {
+	want := len(m.deviceCache.GetCache()) > 0 && m.healthy() == 0
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := m.client.CoreV1().Nodes().Get(ctx, m.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var taints []corev1.Taint
+		found := false
+		for _, t := range node.Spec.Taints {
+			if t.Key != util.GPUUnhealthyTaint {
+				taints = append(taints, t)
+				continue
+			}
+			if t.Value != taintOwner {
+				klog.V(4).Infof("taint %v of node %v is managed externally", t.Key, m.nodeName)
+				return nil
+			}
+			found = true
+			if want {
+				taints = append(taints, t)
+			}
+		}
+		if want == found {
+			return nil
+		}
+		if want {
+			now := metav1.Now()
+			taints = append(taints, corev1.Taint{
+				Key:       util.GPUUnhealthyTaint,
+				Value:     taintOwner,
+				Effect:    corev1.TaintEffectNoSchedule,
+				TimeAdded: &now,
+			})
+			klog.Warningf("No healthy GPU left, tainting node %v with %v", m.nodeName, util.GPUUnhealthyTaint)
+		} else {
+			klog.Infof("GPUs of node %v are healthy again, removing taint %v", m.nodeName, util.GPUUnhealthyTaint)
+		}
+		node.Spec.Taints = taints
+		_, err = m.client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func nodeTaints(t *testing.T, m *NodeTaintManager) []corev1.Taint {
+	node, err := m.client.CoreV1().Nodes().Get(context.Background(), m.nodeName, metav1.GetOptions{})
+	assert.NilError(t, err)
+	return node.Spec.Taints
+}
+
+func TestNodeTaintManager(t *testing.T) {
+	other := corev1.Taint{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule}
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{Taints: []corev1.Taint{other}},
+	})
+	cache := &DeviceCache{cache: []*Device{
+		{Device: pluginapi.Device{ID: "GPU-0", Health: pluginapi.Unhealthy}},
+		{Device: pluginapi.Device{ID: "GPU-1", Health: pluginapi.Healthy}},
+	}}
+	m := NewNodeTaintManager(cache, "node1", client)
+
+	assert.NilError(t, m.reconcile(context.Background()))
+	assert.DeepEqual(t, nodeTaints(t, m), []corev1.Taint{other})
+
+	cache.cache[1].Health = pluginapi.Unhealthy
+	assert.NilError(t, m.reconcile(context.Background()))
+	taints := nodeTaints(t, m)
+	assert.Equal(t, len(taints), 2)
+	assert.Equal(t, taints[1].Key, util.GPUUnhealthyTaint)
+	assert.Equal(t, taints[1].Effect, corev1.TaintEffectNoSchedule)
+
+	cache.cache[0].Health = pluginapi.Healthy
+	assert.NilError(t, m.reconcile(context.Background()))
+	assert.DeepEqual(t, nodeTaints(t, m), []corev1.Taint{other})
+}
+
+func TestNodeTaintManagerKeepsExternalTaint(t *testing.T) {
+	external := corev1.Taint{Key: util.GPUUnhealthyTaint, Value: "maintenance", Effect: corev1.TaintEffectNoExecute}
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{Taints: []corev1.Taint{external}},
+	})
+	cache := &DeviceCache{cache: []*Device{{Device: pluginapi.Device{ID: "GPU-0", Health: pluginapi.Healthy}}}}
+	m := NewNodeTaintManager(cache, "node1", client)
+
+	assert.NilError(t, m.reconcile(context.Background()))
+	assert.DeepEqual(t, nodeTaints(t, m), []corev1.Taint{external})
+
+	cache.cache[0].Health = pluginapi.Unhealthy
+	assert.NilError(t, m.reconcile(context.Background()))
+	assert.DeepEqual(t, nodeTaints(t, m), []corev1.Taint{external})
+}
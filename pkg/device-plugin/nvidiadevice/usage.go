@@ -0,0 +1,246 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+)
+
+// usageSamples is how many check-ins of each container are kept, with the default
+// heartbeat interval the last half hour, so a scrape after a burst still sees its peak.
+const usageSamples = 60
+
+// CheckIn is what a container used up to one check of its heartbeat.
+type CheckIn struct {
+	At time.Time
+	// KernelTime is the GPU time the kernels of the container ran, summed up by the hook
+	// library since the container started, 0 if the hook doesn't measure it.
+	KernelTime time.Duration
+	// AllocatedBytes is the device memory the container holds, from its heartbeat.
+	AllocatedBytes uint64
+	// Processes are the NVML accounting statistics of the processes of the container,
+	// with accounting mode enabled.
+	Processes []ProcessUsage
+}
+
+// ProcessUsage is the accounting of a process of a container on a GPU.
+type ProcessUsage struct {
+	UUID  string
+	PID   uint
+	Stats AccountingStats
+}
+
+// smSeconds is the kernel time NVML accounted of the process.
+func (p ProcessUsage) smSeconds() float64 {
+	return float64(p.Stats.GPUUtilization) / 100 * p.Stats.Time.Seconds()
+}
+
+// ContainerUsage aggregates the check-ins of a container.
+type ContainerUsage struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	PodUID    string `json:"podUID"`
+	Container string `json:"container"`
+	// SMSeconds is the kernel time of the container on all its GPUs since it started.
+	SMSeconds float64 `json:"smSeconds"`
+	// Utilization is SMSeconds over Window divided by its length, above 1 when the
+	// container keeps more than one GPU busy.
+	Utilization float64 `json:"utilization"`
+	// PeakMemory is the most device memory the container held in Window.
+	PeakMemory uint64 `json:"peakMemoryBytes"`
+	Window     string `json:"window"`
+}
+
+type usageSample struct {
+	at        time.Time
+	smSeconds float64
+	memory    uint64
+}
+
+type containerUsage struct {
+	namespace, pod, uid, container string
+	// samples is a ring buffer, next is where the next sample goes
+	samples []usageSample
+	next    int
+	// smSeconds sums up the kernel time from the hook or, if it doesn't measure it,
+	// from the accounting of the container's processes
+	smSeconds      float64
+	lastKernelTime time.Duration
+	// accounted is the last kernel time accounted of each process, by GPU and PID
+	accounted      map[ProcessUsage]float64
+	accountedTotal float64
+}
+
+// UsageTracker keeps the recent check-ins of the containers on the node.
+type UsageTracker struct {
+	mu         sync.Mutex
+	containers map[string]*containerUsage
+}
+
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{containers: make(map[string]*containerUsage)}
+}
+
+// Observe adds a check-in of the container with key, and returns the kernel time it
+// adds to the container's SM-seconds. Keys are the directories of the containers,
+// <pod uid>_<container name>.
+func (u *UsageTracker) Observe(key, namespace, pod, container string, c CheckIn) float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cu, ok := u.containers[key]
+	if !ok {
+		uid, _, _ := strings.Cut(key, "_")
+		cu = &containerUsage{namespace: namespace, pod: pod, uid: uid, container: container, accounted: make(map[ProcessUsage]float64)}
+		u.containers[key] = cu
+	}
+	var delta float64
+	if c.KernelTime > 0 {
+		// a smaller sum means the hook restarted counting, e.g. with a new process
+		if c.KernelTime >= cu.lastKernelTime {
+			delta = (c.KernelTime - cu.lastKernelTime).Seconds()
+		} else {
+			delta = c.KernelTime.Seconds()
+		}
+		cu.lastKernelTime = c.KernelTime
+	}
+	// processes that exited keep what was accounted of them
+	var memory uint64
+	for _, p := range c.Processes {
+		id := ProcessUsage{UUID: p.UUID, PID: p.PID}
+		if sm := p.smSeconds(); sm > cu.accounted[id] {
+			cu.accountedTotal += sm - cu.accounted[id]
+			cu.accounted[id] = sm
+		}
+		memory += p.Stats.MaxMemoryUsage
+	}
+	if c.KernelTime == 0 && cu.lastKernelTime == 0 && cu.accountedTotal > cu.smSeconds {
+		delta = cu.accountedTotal - cu.smSeconds
+	}
+	cu.smSeconds += delta
+	if c.AllocatedBytes > memory {
+		memory = c.AllocatedBytes
+	}
+	s := usageSample{at: c.At, smSeconds: cu.smSeconds, memory: memory}
+	if len(cu.samples) < usageSamples {
+		cu.samples = append(cu.samples, s)
+	} else {
+		cu.samples[cu.next] = s
+	}
+	cu.next = (cu.next + 1) % usageSamples
+	return delta
+}
+
+// Forget drops the check-ins of the container with key, once it is gone.
+func (u *UsageTracker) Forget(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.containers, key)
+}
+
+// Usage aggregates the check-ins of the container with key.
+func (u *UsageTracker) Usage(key string) (ContainerUsage, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cu, ok := u.containers[key]
+	if !ok {
+		return ContainerUsage{}, false
+	}
+	return cu.usage(), true
+}
+
+// List aggregates the check-ins of every container, ordered by namespace, pod and container.
+func (u *UsageTracker) List() []ContainerUsage {
+	u.mu.Lock()
+	res := make([]ContainerUsage, 0, len(u.containers))
+	for _, cu := range u.containers {
+		res = append(res, cu.usage())
+	}
+	u.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		if res[i].Pod != res[j].Pod {
+			return res[i].Pod < res[j].Pod
+		}
+		return res[i].Container < res[j].Container
+	})
+	return res
+}
+
+// Reported is the usage of every container as the node annotation reports it to the
+// scheduler, memory in MiB and the utilization in percent of a GPU.
+func (u *UsageTracker) Reported() []annotations.ContainerUsage {
+	var res []annotations.ContainerUsage
+	for _, cu := range u.List() {
+		res = append(res, annotations.ContainerUsage{
+			PodUID:     cu.PodUID,
+			Container:  cu.Container,
+			PeakMemory: int32(cu.PeakMemory >> 20),
+			Cores:      int32(math.Round(cu.Utilization * 100)),
+		})
+	}
+	return res
+}
+
+func (cu *containerUsage) usage() ContainerUsage {
+	res := ContainerUsage{Namespace: cu.namespace, Pod: cu.pod, PodUID: cu.uid, Container: cu.container, SMSeconds: cu.smSeconds}
+	if len(cu.samples) == 0 {
+		return res
+	}
+	// the oldest sample is where the next one goes once the buffer is full
+	oldest := cu.samples[0]
+	if len(cu.samples) == usageSamples {
+		oldest = cu.samples[cu.next]
+	}
+	newest := cu.samples[(cu.next+usageSamples-1)%usageSamples]
+	for _, s := range cu.samples {
+		if s.memory > res.PeakMemory {
+			res.PeakMemory = s.memory
+		}
+	}
+	window := newest.at.Sub(oldest.at)
+	res.Window = window.String()
+	if window > 0 {
+		res.Utilization = (newest.smSeconds - oldest.smSeconds) / window.Seconds()
+	}
+	return res
+}
+
+// UsagePath is where the runtime service lists the usage of the containers on the node.
+const UsagePath = "/usage"
+
+func (s *RuntimeService) serveUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.usage == nil {
+		http.Error(w, "container usage isn't tracked, see --heartbeat-interval", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.List())
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nvidiadevice
+
+import (
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestUsageFromHeartbeats(t *testing.T) {
+	u := NewUsageTracker()
+	start := time.Unix(10000, 0)
+	checkIn := func(i int, kernel time.Duration, memory uint64) float64 {
+		return u.Observe("uid_c", "default", "train", "c", CheckIn{At: start.Add(time.Duration(i) * 30 * time.Second), KernelTime: kernel, AllocatedBytes: memory})
+	}
+	assert.Equal(t, checkIn(0, 10*time.Second, 1<<30), float64(10))
+	assert.Equal(t, checkIn(1, 25*time.Second, 4<<30), float64(15))
+	assert.Equal(t, checkIn(2, 40*time.Second, 2<<30), float64(15))
+	// the hook counts from 0 again
+	assert.Equal(t, checkIn(3, 5*time.Second, 2<<30), float64(5))
+
+	res, ok := u.Usage("uid_c")
+	assert.Assert(t, ok)
+	assert.Equal(t, res.SMSeconds, float64(45))
+	assert.Equal(t, res.PeakMemory, uint64(4<<30))
+	// 35 SM-seconds from the first to the last check-in, 90 seconds apart
+	assert.Equal(t, res.Utilization, float64(35)/90)
+	assert.Equal(t, res.Window, "1m30s")
+	assert.DeepEqual(t, u.Reported(), []annotations.ContainerUsage{{PodUID: "uid", Container: "c", PeakMemory: 4096, Cores: 39}})
+}
+
+func TestUsageWindow(t *testing.T) {
+	u := NewUsageTracker()
+	start := time.Unix(10000, 0)
+	for i := 0; i < usageSamples+10; i++ {
+		memory := uint64(1 << 30)
+		if i == 5 {
+			// the burst fell out of the window
+			memory = 8 << 30
+		}
+		u.Observe("uid_c", "default", "train", "c", CheckIn{At: start.Add(time.Duration(i) * time.Second), KernelTime: time.Duration(i+1) * time.Second / 2, AllocatedBytes: memory})
+	}
+	res, _ := u.Usage("uid_c")
+	assert.Equal(t, res.PeakMemory, uint64(1<<30))
+	assert.Equal(t, res.Utilization, 0.5)
+	assert.Equal(t, res.Window, (time.Duration(usageSamples-1) * time.Second).String())
+
+	u.Forget("uid_c")
+	_, ok := u.Usage("uid_c")
+	assert.Assert(t, !ok)
+}
+
+func TestUsageFromAccounting(t *testing.T) {
+	u := NewUsageTracker()
+	start := time.Unix(10000, 0)
+	proc := func(pid uint, util uint, d time.Duration, memory uint64) ProcessUsage {
+		return ProcessUsage{UUID: "GPU-0", PID: pid, Stats: AccountingStats{GPUUtilization: util, Time: d, MaxMemoryUsage: memory}}
+	}
+	// 50% of 20s and 100% of 10s
+	delta := u.Observe("uid_c", "default", "train", "c", CheckIn{At: start, Processes: []ProcessUsage{proc(1, 50, 20*time.Second, 1<<30), proc(2, 100, 10*time.Second, 1<<30)}})
+	assert.Equal(t, delta, float64(20))
+	// process 2 exited and keeps what was accounted
+	delta = u.Observe("uid_c", "default", "train", "c", CheckIn{At: start.Add(30 * time.Second), Processes: []ProcessUsage{proc(1, 50, 50*time.Second, 3<<30)}})
+	assert.Equal(t, delta, float64(15))
+
+	res, _ := u.Usage("uid_c")
+	assert.Equal(t, res.SMSeconds, float64(35))
+	assert.Equal(t, res.PeakMemory, uint64(3<<30))
+	assert.Equal(t, res.Utilization, 0.5)
+	assert.DeepEqual(t, u.List(), []ContainerUsage{res})
+}
+
+func TestProcessContainer(t *testing.T) {
+	root := t.TempDir()
+	id := "4e5f6a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091"
+	writeCgroup(t, root, 1, "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod2b8c7a1e_3f41_4c55_9d0e_1a2b3c4d5e6f.slice/cri-containerd-"+id+".scope\n")
+	writeCgroup(t, root, 2, "12:devices:/kubepods/burstable/pod"+daemonPodUID+"/"+id+"\n")
+	writeCgroup(t, root, 3, "0::/system.slice/thumbnailer.service\n")
+
+	uid, ctr := processCgroup(root, 1)
+	assert.Equal(t, uid, vgpuPodUID)
+	assert.Equal(t, ctr, id)
+	uid, ctr = processCgroup(root, 2)
+	assert.Equal(t, uid, daemonPodUID)
+	assert.Equal(t, ctr, id)
+	uid, ctr = processCgroup(root, 3)
+	assert.Equal(t, uid+ctr, "")
+
+	pod := &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+		{Name: "sidecar", ContainerID: "containerd://0123"},
+		{Name: "train", ContainerID: "containerd://" + id},
+	}}}
+	assert.Equal(t, containerName(pod, id), "train")
+	assert.Equal(t, containerName(pod, "4567"), "")
+	assert.Equal(t, containerName(nil, id), "")
+}
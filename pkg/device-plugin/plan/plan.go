@@ -0,0 +1,147 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package plan previews how changing the split count or memory scaling of the GPUs of a
+// node affects the containers already using them, before the change is applied. The
+// device plugin plans with it when it reloads its config, and vgpuctl plan prints it.
+package plan
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"text/tabwriter"
+)
+
+// Settings are how a device is split and its memory scaled.
+type Settings struct {
+	SplitCount    uint    `json:"splitCount"`
+	MemoryScaling float64 `json:"memoryScaling"`
+}
+
+// Capacity is what a device is advertised with: its slices and memory in MiB.
+type Capacity struct {
+	Count  int32 `json:"count"`
+	Memory int32 `json:"memory"`
+}
+
+// Capacity returns the capacity of a device with memory MiB under s. A memory scaling up
+// to 1 advertises the memory as it is, a scaled memory is capped at math.MaxInt32.
+func (s Settings) Capacity(memory int32) Capacity {
+	res := Capacity{Count: int32(s.SplitCount), Memory: memory}
+	if s.MemoryScaling > 1 {
+		res.Memory = int32(math.Min(float64(memory)*s.MemoryScaling, math.MaxInt32))
+	}
+	return res
+}
+
+// Allocation is the memory in MiB a container was given on a device.
+type Allocation struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Memory    int32  `json:"memory"`
+}
+
+func (a Allocation) String() string {
+	return fmt.Sprintf("%v/%v/%v", a.Namespace, a.Pod, a.Container)
+}
+
+// Device is a GPU to plan the change for: its memory in MiB, 0 while unknown, the
+// settings it has and would have after the change, and the containers using it.
+type Device struct {
+	ID          string
+	Memory      int32
+	Current     Settings
+	Planned     Settings
+	Allocations []Allocation
+}
+
+// DevicePlan is the effect of the change on a device. Used counts its allocations and
+// adds up their memory. Exceeding lists the allocations when they don't fit its planned
+// capacity, Problem tells why.
+type DevicePlan struct {
+	ID        string       `json:"id"`
+	Current   Capacity     `json:"current"`
+	Planned   Capacity     `json:"planned"`
+	Used      Capacity     `json:"used"`
+	Exceeding []Allocation `json:"exceeding,omitempty"`
+	Problem   string       `json:"problem,omitempty"`
+}
+
+// Plan is the effect of a change on the devices of a node. It is safe when the
+// allocations of every device fit its planned capacity.
+type Plan struct {
+	Devices []DevicePlan `json:"devices"`
+	Safe    bool         `json:"safe"`
+}
+
+// Compute plans the change of devs. A device whose memory is unknown can't be checked and
+// makes the plan unsafe while it has allocations.
+func Compute(devs []Device) Plan {
+	res := Plan{Devices: []DevicePlan{}, Safe: true}
+	for _, dev := range devs {
+		p := DevicePlan{
+			ID:      dev.ID,
+			Current: dev.Current.Capacity(dev.Memory),
+			Planned: dev.Planned.Capacity(dev.Memory),
+		}
+		for _, a := range dev.Allocations {
+			p.Used.Count++
+			p.Used.Memory += a.Memory
+		}
+		var problems []string
+		if p.Used.Count > p.Planned.Count {
+			problems = append(problems, fmt.Sprintf("%v containers share it, split into %v", p.Used.Count, p.Planned.Count))
+		}
+		if dev.Memory == 0 && p.Used.Count > 0 {
+			problems = append(problems, "its memory is unknown until NVML answers")
+		} else if p.Used.Memory > p.Planned.Memory {
+			problems = append(problems, fmt.Sprintf("%vm are allocated, %vm advertised", p.Used.Memory, p.Planned.Memory))
+		}
+		if len(problems) > 0 {
+			p.Problem = strings.Join(problems, ", ")
+			p.Exceeding = dev.Allocations
+			res.Safe = false
+		}
+		res.Devices = append(res.Devices, p)
+	}
+	return res
+}
+
+// Write prints the plan as a table, followed by the allocations that wouldn't fit.
+func (p Plan) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tSLICES\tMEMORY\tCONTAINERS\tALLOCATED\tPROBLEM")
+	for _, d := range p.Devices {
+		fmt.Fprintf(tw, "%v\t%v -> %v\t%vm -> %vm\t%v\t%vm\t%v\n", d.ID, d.Current.Count, d.Planned.Count,
+			d.Current.Memory, d.Planned.Memory, d.Used.Count, d.Used.Memory, d.Problem)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, d := range p.Devices {
+		for _, a := range d.Exceeding {
+			fmt.Fprintf(w, "%v on %v: %vm\n", a, d.ID, a.Memory)
+		}
+	}
+	if p.Safe {
+		_, err := fmt.Fprintln(w, "Safe to apply: the containers running fit the planned capacity.")
+		return err
+	}
+	_, err := fmt.Fprintln(w, "Unsafe to apply: the containers above don't fit the planned capacity of their devices.")
+	return err
+}
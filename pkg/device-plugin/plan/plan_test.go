@@ -0,0 +1,81 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package plan
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSettingsCapacity(t *testing.T) {
+	assert.Equal(t, Settings{SplitCount: 4, MemoryScaling: 1}.Capacity(16000), Capacity{Count: 4, Memory: 16000})
+	// a memory scaling below 1 doesn't shrink the advertised memory
+	assert.Equal(t, Settings{SplitCount: 4, MemoryScaling: 0.5}.Capacity(16000), Capacity{Count: 4, Memory: 16000})
+	assert.Equal(t, Settings{SplitCount: 4, MemoryScaling: 1.5}.Capacity(16000), Capacity{Count: 4, Memory: 24000})
+	assert.Equal(t, Settings{SplitCount: 4, MemoryScaling: 1e6}.Capacity(16000), Capacity{Count: 4, Memory: math.MaxInt32})
+}
+
+func TestCompute(t *testing.T) {
+	current := Settings{SplitCount: 10, MemoryScaling: 1}
+	planned := Settings{SplitCount: 2, MemoryScaling: 1}
+	a := Allocation{Namespace: "default", Pod: "a", Container: "c", Memory: 6000}
+	b := Allocation{Namespace: "default", Pod: "b", Container: "c", Memory: 6000}
+	c := Allocation{Namespace: "default", Pod: "c", Container: "c", Memory: 6000}
+
+	res := Compute(nil)
+	assert.Assert(t, res.Safe)
+	assert.Equal(t, len(res.Devices), 0)
+
+	res = Compute([]Device{
+		{ID: "GPU-0", Memory: 16000, Current: current, Planned: planned, Allocations: []Allocation{a, b}},
+		{ID: "GPU-1", Memory: 16000, Current: current, Planned: planned},
+	})
+	assert.Assert(t, res.Safe)
+	assert.Equal(t, res.Devices[0].Used, Capacity{Count: 2, Memory: 12000})
+
+	res = Compute([]Device{
+		{ID: "GPU-0", Memory: 16000, Current: current, Planned: planned, Allocations: []Allocation{a, b, c}},
+		{ID: "GPU-1", Memory: 0, Current: current, Planned: planned, Allocations: []Allocation{a}},
+		{ID: "GPU-2", Memory: 0, Current: current, Planned: planned},
+	})
+	assert.Assert(t, !res.Safe)
+	assert.Equal(t, res.Devices[0].Problem, "3 containers share it, split into 2, 18000m are allocated, 16000m advertised")
+	assert.DeepEqual(t, res.Devices[0].Exceeding, []Allocation{a, b, c})
+	assert.Equal(t, res.Devices[1].Problem, "its memory is unknown until NVML answers")
+	assert.Equal(t, res.Devices[2].Problem, "")
+}
+
+func TestWrite(t *testing.T) {
+	current := Settings{SplitCount: 10, MemoryScaling: 1}
+	a := Allocation{Namespace: "default", Pod: "a", Container: "c", Memory: 10000}
+	b := Allocation{Namespace: "default", Pod: "b", Container: "c", Memory: 10000}
+	res := Compute([]Device{
+		{ID: "GPU-0", Memory: 16000, Current: current, Planned: Settings{SplitCount: 4, MemoryScaling: 1.5}, Allocations: []Allocation{a}},
+		{ID: "GPU-1", Memory: 16000, Current: Settings{SplitCount: 10, MemoryScaling: 2}, Planned: current, Allocations: []Allocation{a, b}},
+	})
+	var out strings.Builder
+	assert.NilError(t, res.Write(&out))
+	assert.Equal(t, out.String(), `DEVICE  SLICES    MEMORY            CONTAINERS  ALLOCATED  PROBLEM
+GPU-0   10 -> 4   16000m -> 24000m  1           10000m     
+GPU-1   10 -> 10  32000m -> 16000m  2           20000m     20000m are allocated, 16000m advertised
+default/a/c on GPU-1: 10000m
+default/b/c on GPU-1: 10000m
+Unsafe to apply: the containers above don't fit the planned capacity of their devices.
+`)
+}
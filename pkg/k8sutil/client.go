@@ -24,8 +24,8 @@ import (
     "path/filepath"
 )
 
-// NewClient connects to an API server
-func NewClient() (kubernetes.Interface, error) {
+// NewConfig returns the in-cluster config, falling back to KUBECONFIG
+func NewConfig() (*rest.Config, error) {
     kubeConfig := os.Getenv("KUBECONFIG")
     if kubeConfig == "" {
         kubeConfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
@@ -37,6 +37,15 @@ func NewClient() (kubernetes.Interface, error) {
             return nil, err
         }
     }
+    return config, nil
+}
+
+// NewClient connects to an API server
+func NewClient() (kubernetes.Interface, error) {
+    config, err := NewConfig()
+    if err != nil {
+        return nil, err
+    }
     client, err := kubernetes.NewForConfig(config)
     return client, err
 }
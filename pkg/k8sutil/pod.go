@@ -17,80 +17,229 @@
 package k8sutil
 
 import (
+	"fmt"
+	"sort"
+
 	"4pd.io/k8s-vgpu/pkg/scheduler/config"
 	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 )
 
+// gpuProfiles returns the device plugin profiles of the NVIDIA GPU resources a
+// container asks for, "" being the default profile.
+func gpuProfiles(ctr corev1.Container) []string {
+	found := make(map[string]bool)
+	for _, list := range []corev1.ResourceList{ctr.Resources.Limits, ctr.Resources.Requests} {
+		for name := range list {
+			if profile, ok := util.ResourceProfile(string(name)); ok {
+				found[profile] = true
+			}
+		}
+	}
+	res := make([]string, 0, len(found))
+	for profile := range found {
+		res = append(res, profile)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// RequestsDevices is whether a container of pod asks for vGPUs or MLUs, by the names of
+// its resources alone, so other pods are told apart without counting their requests.
+func RequestsDevices(pod *corev1.Pod) bool {
+	for _, ctr := range pod.Spec.Containers {
+		for _, list := range []corev1.ResourceList{ctr.Resources.Limits, ctr.Resources.Requests} {
+			for name := range list {
+				if _, gpu := util.ResourceProfile(string(name)); gpu || string(name) == util.MLUResourceCount {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// containerQuantity returns the limit of ctr on the resource name, or its request.
+func containerQuantity(ctr corev1.Container, name string) (int64, bool) {
+	q, ok := ctr.Resources.Limits[corev1.ResourceName(name)]
+	if !ok {
+		q, ok = ctr.Resources.Requests[corev1.ResourceName(name)]
+	}
+	if !ok {
+		return 0, false
+	}
+	return q.AsInt64()
+}
+
+// zeroMemory is whether ctr asks for no device memory, setting the memory or the memory
+// percentage resource to 0 without asking for memory with the other.
+func zeroMemory(ctr corev1.Container) bool {
+	mem, memSet := containerQuantity(ctr, util.ResourceMem)
+	pct, pctSet := containerQuantity(ctr, util.ResourceMemPercentage)
+	if !memSet && !pctSet {
+		return false
+	}
+	return (!memSet || mem == 0) && (!pctSet || pct == 0)
+}
+
+// MemoryTier returns the memory tier of pod by its priority class, util.MemoryTierGuaranteed
+// or util.MemoryTierBestEffort, empty if the class is in neither.
+func MemoryTier(pod *corev1.Pod) string {
+	for _, class := range config.GuaranteedPriorityClasses {
+		if class == pod.Spec.PriorityClassName {
+			return util.MemoryTierGuaranteed
+		}
+	}
+	for _, class := range config.BestEffortPriorityClasses {
+		if class == pod.Spec.PriorityClassName {
+			return util.MemoryTierBestEffort
+		}
+	}
+	return ""
+}
+
+// memoryScaling returns the memory scaling pod is scheduled against, see
+// util.ContainerDeviceRequest.MemoryScaling.
+func memoryScaling(pod *corev1.Pod) float64 {
+	switch MemoryTier(pod) {
+	case util.MemoryTierGuaranteed:
+		return 1
+	case util.MemoryTierBestEffort:
+		return 0
+	}
+	return config.PriorityMemoryScaling[pod.Spec.PriorityClassName]
+}
+
+// CheckRequests returns why the vGPU requests of pod can't be served: a container asks
+// for no device memory, unless config.AllowZeroMemory grants it config.ZeroMemoryFloor,
+// or for cores outside [0, 100]. Zero cores are fine, the container reserves memory
+// without a compute guarantee.
+func CheckRequests(pod *corev1.Pod) error {
+	if util.WholeGPUs(pod) {
+		return nil
+	}
+	for _, ctr := range pod.Spec.Containers {
+		if len(gpuProfiles(ctr)) == 0 {
+			continue
+		}
+		if !config.AllowZeroMemory && zeroMemory(ctr) {
+			return fmt.Errorf("container %v asks for no device memory, %v or %v is 0", ctr.Name, util.ResourceMem, util.ResourceMemPercentage)
+		}
+		if cores, ok := containerQuantity(ctr, util.ResourceCores); ok && (cores < 0 || cores > 100) {
+			return fmt.Errorf("container %v asks for %v%% of the cores with %v, not within [0, 100]", ctr.Name, cores, util.ResourceCores)
+		}
+	}
+	return nil
+}
+
 func Resourcereqs(pod *corev1.Pod) (counts [][]util.ContainerDeviceRequest) {
-	resourceName := corev1.ResourceName(util.ResourceName)
 	resourceMem := corev1.ResourceName(util.ResourceMem)
 	resourceMemPercentage := corev1.ResourceName(util.ResourceMemPercentage)
 	resourceCores := corev1.ResourceName(util.ResourceCores)
 	counts = make([][]util.ContainerDeviceRequest, len(pod.Spec.Containers))
+	var typeReqs []util.TypeRequest
+	var bandwidth int32
+	if val, ok := pod.Annotations[util.MemoryBandwidthAnnotation]; ok {
+		var err error
+		if bandwidth, err = annotations.DecodeMemoryPercent(val); err != nil {
+			klog.Errorf("pod %v annotation %v: %v", util.PodRef(pod.Namespace, pod.Name), util.MemoryBandwidthAnnotation, err)
+		}
+	}
+	if val, ok := pod.Annotations[util.VGPUProfileTypesAnnotation]; ok && !util.WholeGPUs(pod) {
+		var err error
+		if typeReqs, err = annotations.DecodeTypeRequests(val); err != nil {
+			klog.Errorf("pod %v annotation %v: %v", util.PodRef(pod.Namespace, pod.Name), util.VGPUProfileTypesAnnotation, err)
+		}
+	}
 	//Count Nvidia GPU
 	for i := 0; i < len(pod.Spec.Containers); i++ {
-		v, ok := pod.Spec.Containers[i].Resources.Limits[resourceName]
-		if !ok {
-			v, ok = pod.Spec.Containers[i].Resources.Requests[resourceName]
-		}
-		if ok {
-			if n, ok := v.AsInt64(); ok {
-				memnum := 0
-				mem, ok := pod.Spec.Containers[i].Resources.Limits[resourceMem]
-				if !ok {
-					mem, ok = pod.Spec.Containers[i].Resources.Requests[resourceMem]
-				}
-				if ok {
-					memnums, ok := mem.AsInt64()
+		for _, profile := range gpuProfiles(pod.Spec.Containers[i]) {
+			resourceName := corev1.ResourceName(util.ProfileResourceName(profile))
+			v, ok := pod.Spec.Containers[i].Resources.Limits[resourceName]
+			if !ok {
+				v, ok = pod.Spec.Containers[i].Resources.Requests[resourceName]
+			}
+			if ok {
+				if n, ok := v.AsInt64(); ok {
+					memnum := 0
+					mem, ok := pod.Spec.Containers[i].Resources.Limits[resourceMem]
+					if !ok {
+						mem, ok = pod.Spec.Containers[i].Resources.Requests[resourceMem]
+					}
 					if ok {
-						memnum = int(memnums)
+						memnums, ok := mem.AsInt64()
+						if ok {
+							memnum = int(memnums)
+						}
+					}
+					mempnum := int32(101)
+					mem, ok = pod.Spec.Containers[i].Resources.Limits[resourceMemPercentage]
+					if !ok {
+						mem, ok = pod.Spec.Containers[i].Resources.Requests[resourceMemPercentage]
 					}
-				}
-				mempnum := int32(101)
-				mem, ok = pod.Spec.Containers[i].Resources.Limits[resourceMemPercentage]
-				if !ok {
-					mem, ok = pod.Spec.Containers[i].Resources.Requests[resourceMemPercentage]
-				}
-				if ok {
-					mempnums, ok := mem.AsInt64()
 					if ok {
-						mempnum = int32(mempnums)
+						mempnums, ok := mem.AsInt64()
+						if ok {
+							mempnum = int32(mempnums)
+						}
 					}
-				}
-				if mempnum == 101 && memnum == 0 {
-					if config.DefaultMem != 0 {
-						memnum = int(config.DefaultMem)
-					} else {
-						mempnum = 100
+					if config.AllowZeroMemory && zeroMemory(pod.Spec.Containers[i]) {
+						memnum, mempnum = int(config.ZeroMemoryFloor), 101
+					}
+					if val, ok := pod.Annotations[util.MemoryPercentAnnotation]; ok && mempnum == 101 && memnum == 0 {
+						if p, err := annotations.DecodeMemoryPercent(val); err == nil {
+							mempnum = p
+						} else {
+							klog.Errorf("pod %v annotation %v: %v", util.PodRef(pod.Namespace, pod.Name), util.MemoryPercentAnnotation, err)
+						}
+					}
+					slice := false
+					if mempnum == 101 && memnum == 0 {
+						if config.SliceRequests {
+							slice = true
+						} else if config.DefaultMem != 0 {
+							memnum = int(config.DefaultMem)
+						} else {
+							mempnum = 100
+						}
+					}
+					corenum := config.DefaultCores
+					core, ok := pod.Spec.Containers[i].Resources.Limits[resourceCores]
+					if !ok {
+						core, ok = pod.Spec.Containers[i].Resources.Requests[resourceCores]
 					}
-				}
-				corenum := config.DefaultCores
-				core, ok := pod.Spec.Containers[i].Resources.Limits[resourceCores]
-				if !ok {
-					core, ok = pod.Spec.Containers[i].Resources.Requests[resourceCores]
-				}
-				if ok {
-					corenums, ok := core.AsInt64()
 					if ok {
-						corenum = int32(corenums)
+						corenums, ok := core.AsInt64()
+						if ok {
+							corenum = int32(corenums)
+						}
+					}
+					if util.WholeGPUs(pod) {
+						// whole GPUs, whatever memory and cores the container asks for
+						memnum, mempnum, slice, corenum = 0, 100, false, 100
 					}
+					counts[i] = append(counts[i], util.ContainerDeviceRequest{
+						Nums:             int32(n),
+						Type:             util.NvidiaGPUDevice,
+						Memreq:           int32(memnum),
+						MemPercentagereq: int32(mempnum),
+						Slice:            slice,
+						Coresreq:         int32(corenum),
+						MemBandwidthreq:  bandwidth,
+						Profile:          profile,
+						TypeRequests:     typeReqs,
+						MemoryScaling:    memoryScaling(pod),
+					})
 				}
-				counts[i] = append(counts[i], util.ContainerDeviceRequest{
-					Nums:             int32(n),
-					Type:             util.NvidiaGPUDevice,
-					Memreq:           int32(memnum),
-					MemPercentagereq: int32(mempnum),
-					Coresreq:         int32(corenum),
-				})
 			}
 		}
 		//Count Cambricon MLU
 		klog.Infof("Counting mlu devices")
 		mluResourceCount := corev1.ResourceName(util.MLUResourceCount)
 		mluResourceMem := corev1.ResourceName(util.MLUResourceMemory)
-		v, ok = pod.Spec.Containers[i].Resources.Limits[mluResourceCount]
+		v, ok := pod.Spec.Containers[i].Resources.Limits[mluResourceCount]
 		if !ok {
 			v, ok = pod.Spec.Containers[i].Resources.Requests[mluResourceCount]
 		}
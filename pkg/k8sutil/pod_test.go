@@ -0,0 +1,189 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sutil
+
+import (
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResourcereqsSliceRequests(t *testing.T) {
+	oldName, oldMem, oldSlice, oldDefault := util.ResourceName, util.ResourceMem, config.SliceRequests, config.DefaultMem
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem, config.SliceRequests, config.DefaultMem = oldName, oldMem, oldSlice, oldDefault
+	})
+	util.ResourceName, util.ResourceMem, config.SliceRequests, config.DefaultMem = "4pd.io/vgpu", "4pd.io/vgpu-memory", true, 5000
+
+	limits := func(l corev1.ResourceList) corev1.Container {
+		return corev1.Container{Resources: corev1.ResourceRequirements{Limits: l}}
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+		limits(corev1.ResourceList{"4pd.io/vgpu": resource.MustParse("1")}),
+		limits(corev1.ResourceList{"4pd.io/vgpu": resource.MustParse("1"), "4pd.io/vgpu-memory": resource.MustParse("3000")}),
+	}}}
+	reqs := Resourcereqs(pod)
+	assert.Equal(t, reqs[0][0].Slice, true)
+	assert.Equal(t, reqs[0][0].Memreq, int32(0))
+	assert.Equal(t, reqs[1][0].Slice, false)
+	assert.Equal(t, reqs[1][0].Memreq, int32(3000))
+
+	config.SliceRequests = false
+	reqs = Resourcereqs(pod)
+	assert.Equal(t, reqs[0][0].Slice, false)
+	assert.Equal(t, reqs[0][0].Memreq, int32(5000))
+}
+
+func TestResourcereqsExclusivePassthrough(t *testing.T) {
+	oldName, oldMem, oldCores := util.ResourceName, util.ResourceMem, util.ResourceCores
+	t.Cleanup(func() { util.ResourceName, util.ResourceMem, util.ResourceCores = oldName, oldMem, oldCores })
+	util.ResourceName, util.ResourceMem, util.ResourceCores = "4pd.io/vgpu", "4pd.io/vgpu-memory", "4pd.io/vgpu-cores"
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+		"4pd.io/vgpu":        resource.MustParse("2"),
+		"4pd.io/vgpu-memory": resource.MustParse("3000"),
+		"4pd.io/vgpu-cores":  resource.MustParse("30"),
+	}}}}}}
+	pod.Annotations = map[string]string{util.ExclusivePassthroughAnnotation: "true"}
+	req := Resourcereqs(pod)[0][0]
+	assert.Equal(t, req.Nums, int32(2))
+	assert.Equal(t, req.Memreq, int32(0))
+	assert.Equal(t, req.MemPercentagereq, int32(100))
+	assert.Equal(t, req.Coresreq, int32(100))
+
+	pod.Annotations = map[string]string{util.GPUModeAnnotation: util.GPUModeDedicated}
+	req = Resourcereqs(pod)[0][0]
+	assert.Equal(t, req.Memreq, int32(0))
+	assert.Equal(t, req.MemPercentagereq, int32(100))
+	assert.Equal(t, req.Coresreq, int32(100))
+
+	// the gpu mode wins over the exclusive passthrough annotation
+	pod.Annotations = map[string]string{util.GPUModeAnnotation: util.GPUModeShared, util.ExclusivePassthroughAnnotation: "true"}
+	req = Resourcereqs(pod)[0][0]
+	assert.Equal(t, req.Memreq, int32(3000))
+	assert.Equal(t, req.Coresreq, int32(30))
+}
+
+func TestResourcereqsMemoryPercentAnnotation(t *testing.T) {
+	oldName, oldMem, oldDefault := util.ResourceName, util.ResourceMem, config.DefaultMem
+	t.Cleanup(func() { util.ResourceName, util.ResourceMem, config.DefaultMem = oldName, oldMem, oldDefault })
+	util.ResourceName, util.ResourceMem, config.DefaultMem = "4pd.io/vgpu", "4pd.io/vgpu-memory", 5000
+
+	limits := func(l corev1.ResourceList) corev1.Container {
+		return corev1.Container{Resources: corev1.ResourceRequirements{Limits: l}}
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{util.MemoryPercentAnnotation: "25"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			limits(corev1.ResourceList{"4pd.io/vgpu": resource.MustParse("1")}),
+			limits(corev1.ResourceList{"4pd.io/vgpu": resource.MustParse("1"), "4pd.io/vgpu-memory": resource.MustParse("3000")}),
+		}},
+	}
+	reqs := Resourcereqs(pod)
+	assert.Equal(t, reqs[0][0].MemPercentagereq, int32(25))
+	assert.Equal(t, reqs[0][0].Memreq, int32(0))
+	// memory asked for by the container wins
+	assert.Equal(t, reqs[1][0].MemPercentagereq, int32(101))
+	assert.Equal(t, reqs[1][0].Memreq, int32(3000))
+
+	pod.Annotations[util.MemoryPercentAnnotation] = "150"
+	reqs = Resourcereqs(pod)
+	assert.Equal(t, reqs[0][0].MemPercentagereq, int32(101))
+	assert.Equal(t, reqs[0][0].Memreq, int32(5000))
+}
+
+func TestZeroRequests(t *testing.T) {
+	oldName, oldMem, oldPct, oldCores := util.ResourceName, util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores
+	oldAllow, oldFloor, oldDefault := config.AllowZeroMemory, config.ZeroMemoryFloor, config.DefaultMem
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores = oldName, oldMem, oldPct, oldCores
+		config.AllowZeroMemory, config.ZeroMemoryFloor, config.DefaultMem = oldAllow, oldFloor, oldDefault
+	})
+	util.ResourceName, util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores = "4pd.io/vgpu", "4pd.io/vgpu-memory", "4pd.io/vgpu-memory-percentage", "4pd.io/vgpu-cores"
+	config.AllowZeroMemory, config.ZeroMemoryFloor, config.DefaultMem = false, 256, 5000
+
+	pod := func(l corev1.ResourceList) *corev1.Pod {
+		l["4pd.io/vgpu"] = resource.MustParse("1")
+		return &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{Limits: l}}}}}
+	}
+	zeroMem := pod(corev1.ResourceList{"4pd.io/vgpu-memory": resource.MustParse("0")})
+	zeroPct := pod(corev1.ResourceList{"4pd.io/vgpu-memory-percentage": resource.MustParse("0")})
+	zeroCores := pod(corev1.ResourceList{"4pd.io/vgpu-memory": resource.MustParse("3000"), "4pd.io/vgpu-cores": resource.MustParse("0")})
+	for _, p := range []*corev1.Pod{zeroMem, zeroPct} {
+		assert.Error(t, CheckRequests(p), "container c asks for no device memory, 4pd.io/vgpu-memory or 4pd.io/vgpu-memory-percentage is 0")
+	}
+	// memory asked for with the other resource
+	assert.NilError(t, CheckRequests(pod(corev1.ResourceList{"4pd.io/vgpu-memory": resource.MustParse("0"), "4pd.io/vgpu-memory-percentage": resource.MustParse("50")})))
+	assert.NilError(t, CheckRequests(pod(corev1.ResourceList{})))
+	// a memory reservation without a compute guarantee
+	assert.NilError(t, CheckRequests(zeroCores))
+	req := Resourcereqs(zeroCores)[0][0]
+	assert.Equal(t, req.Memreq, int32(3000))
+	assert.Equal(t, req.Coresreq, int32(0))
+	assert.Error(t, CheckRequests(pod(corev1.ResourceList{"4pd.io/vgpu-cores": resource.MustParse("150")})), "container c asks for 150% of the cores with 4pd.io/vgpu-cores, not within [0, 100]")
+	passthrough := pod(corev1.ResourceList{"4pd.io/vgpu-memory": resource.MustParse("0")})
+	passthrough.Annotations = map[string]string{util.ExclusivePassthroughAnnotation: "true"}
+	assert.NilError(t, CheckRequests(passthrough))
+
+	config.AllowZeroMemory = true
+	for _, p := range []*corev1.Pod{zeroMem, zeroPct} {
+		assert.NilError(t, CheckRequests(p))
+		req := Resourcereqs(p)[0][0]
+		assert.Equal(t, req.Memreq, int32(256))
+		assert.Equal(t, req.MemPercentagereq, int32(101))
+	}
+}
+
+func TestResourcereqsPriorityMemoryScaling(t *testing.T) {
+	oldName, oldScaling := util.ResourceName, config.PriorityMemoryScaling
+	t.Cleanup(func() { util.ResourceName, config.PriorityMemoryScaling = oldName, oldScaling })
+	util.ResourceName, config.PriorityMemoryScaling = "4pd.io/vgpu", map[string]float64{"high": 1}
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{"4pd.io/vgpu": resource.MustParse("1")},
+	}}}}}
+	assert.Equal(t, Resourcereqs(pod)[0][0].MemoryScaling, float64(0))
+	pod.Spec.PriorityClassName = "high"
+	assert.Equal(t, Resourcereqs(pod)[0][0].MemoryScaling, float64(1))
+}
+
+func TestMemoryTier(t *testing.T) {
+	oldName, oldGuaranteed, oldBestEffort := util.ResourceName, config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses
+	t.Cleanup(func() {
+		util.ResourceName, config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses = oldName, oldGuaranteed, oldBestEffort
+	})
+	util.ResourceName = "4pd.io/vgpu"
+	config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses = []string{"critical"}, []string{"batch"}
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{"4pd.io/vgpu": resource.MustParse("1")},
+	}}}}}
+	for class, tier := range map[string]string{"": "", "other": "", "critical": util.MemoryTierGuaranteed, "batch": util.MemoryTierBestEffort} {
+		pod.Spec.PriorityClassName = class
+		assert.Equal(t, MemoryTier(pod), tier, class)
+	}
+	// guaranteed pods are held to the physical memory, best-effort ones use all of it
+	pod.Spec.PriorityClassName = "critical"
+	assert.Equal(t, Resourcereqs(pod)[0][0].MemoryScaling, float64(1))
+	pod.Spec.PriorityClassName = "batch"
+	assert.Equal(t, Resourcereqs(pod)[0][0].MemoryScaling, float64(0))
+}
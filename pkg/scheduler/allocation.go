@@ -0,0 +1,174 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// The device plugin reports the allocation of a pod in its annotations: util.DeviceBindPhase
+// turns to success or failed after Allocate, and util.AllocatedIDsAnnotations lists the
+// devices handed to each container. The scheduler takes a failed pod's devices back at once
+// and corrects the devices of a successful one if they differ from those it accounted.
+// Pods with no report config.AllocationTimeout after their binding are settled from their
+// status by reconcileAllocations.
+
+// allocationReported applies the device plugin's report of the allocation of pod, which
+// was added before. It returns false if the allocation failed and the pod was removed.
+func (s *Scheduler) allocationReported(pod *corev1.Pod) bool {
+	phase := pod.Annotations[util.DeviceBindPhase]
+	switch phase {
+	case util.DeviceBindFailed:
+		if s.delPod(pod) {
+			klog.Warningf("allocation of pod %v failed on node %v, releasing its devices", util.PodRef(pod.Namespace, pod.Name), pod.Annotations[util.AssignedNodeAnnotations])
+			s.podEventf(pod, corev1.EventTypeWarning, "AllocationFailed", "device plugin failed to allocate the devices, released them")
+		}
+		return false
+	case util.DeviceBindSuccess:
+		s.correctAllocated(pod)
+	}
+	var bound time.Time
+	if sec, err := strconv.ParseInt(pod.Annotations[util.BindTimeAnnotations], 10, 64); err == nil {
+		bound = time.Unix(sec, 0)
+	}
+	s.setBindPhase(pod, phase, bound)
+	return true
+}
+
+// correctAllocated replaces the devices accounted for pod with those the device plugin
+// reports to have handed out, when they are other devices.
+func (s *Scheduler) correctAllocated(pod *corev1.Pod) {
+	val, ok := pod.Annotations[util.AllocatedIDsAnnotations]
+	if !ok {
+		return
+	}
+	allocated, err := annotations.DecodePodDevices(val)
+	if err != nil {
+		s.malformedAnnotation(pod, util.AllocatedIDsAnnotations, err)
+		return
+	}
+	s.podManager.mutex.Lock()
+	pi, ok := s.pods[pod.UID]
+	if !ok || sameDevices(pi.Devices, allocated) {
+		s.podManager.mutex.Unlock()
+		return
+	}
+	accounted := pi.Devices
+	pi.Devices = allocated
+	s.podManager.mutex.Unlock()
+	klog.Warningf("pod %v was allocated %v, correcting the accounted %v", util.PodRef(pod.Namespace, pod.Name),
+		annotations.EncodePodDevices(allocated), annotations.EncodePodDevices(accounted))
+}
+
+// sameDevices tells whether each container holds the same devices in a and b, their
+// memory and cores aside, which change when a pod is resized.
+func sameDevices(a, b util.PodDevices) bool {
+	uuids := func(pd util.PodDevices) map[int]string {
+		res := make(map[int]string)
+		for idx, cd := range pd {
+			var ids []string
+			for _, dev := range cd {
+				ids = append(ids, dev.UUID)
+			}
+			if len(ids) > 0 {
+				sort.Strings(ids)
+				res[idx] = strings.Join(ids, ",")
+			}
+		}
+		return res
+	}
+	ua, ub := uuids(a), uuids(b)
+	if len(ua) != len(ub) {
+		return false
+	}
+	for idx, ids := range ua {
+		if ub[idx] != ids {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingAllocations returns the pods still waiting for the report of their allocation
+// that were bound before the given time.
+func (m *podManager) pendingAllocations(before time.Time) []podInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var res []podInfo
+	for _, pi := range m.pods {
+		if pi.BindPhase == util.DeviceBindAllocating && !pi.BindTime.IsZero() && pi.BindTime.Before(before) {
+			res = append(res, *pi)
+		}
+	}
+	return res
+}
+
+func (s *Scheduler) reconcileAllocationsLoop(timeout time.Duration) {
+	wait.Until(func() {
+		s.reconcileAllocations(context.Background(), time.Now().Add(-timeout))
+	}, timeout/2, s.stopCh)
+}
+
+// reconcileAllocations settles the pods bound before the given time whose allocation the
+// device plugin didn't report, from their status: the devices of a pod that is gone or
+// terminated are released, a pod kubelet admitted got its devices.
+func (s *Scheduler) reconcileAllocations(ctx context.Context, before time.Time) {
+	for _, pi := range s.pendingAllocations(before) {
+		pod, err := s.kubeClient.CoreV1().Pods(pi.Namespace).Get(ctx, pi.Name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err) || err == nil && pod.UID != pi.Uid:
+			klog.Warningf("pod %v is gone without an allocation report, releasing its devices", util.PodRef(pi.Namespace, pi.Name))
+			s.delPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: pi.Namespace, Name: pi.Name, UID: pi.Uid}})
+		case err != nil:
+			klog.Errorf("get pod %v to reconcile its allocation: %v", util.PodRef(pi.Namespace, pi.Name), util.RedactIn(err.Error(), pi.Name, pi.Namespace))
+		case k8sutil.IsPodInTerminatedState(pod):
+			klog.Warningf("pod %v terminated without an allocation report, releasing its devices", util.PodRef(pi.Namespace, pi.Name))
+			s.delPod(pod)
+		case pod.Annotations[util.DeviceBindPhase] != util.DeviceBindAllocating:
+			// the report arrived meanwhile
+			s.onUpdatePod(nil, pod)
+		case podAdmitted(pod):
+			klog.Warningf("pod %v was admitted by kubelet without an allocation report, taking it as allocated", util.PodRef(pi.Namespace, pi.Name))
+			if err := util.PatchPodAnnotationsWithContext(ctx, pod, map[string]string{util.DeviceBindPhase: util.DeviceBindSuccess}); err != nil {
+				klog.Errorf("patch pod %v: %v", util.PodRef(pi.Namespace, pi.Name), util.RedactIn(err.Error(), pi.Name, pi.Namespace))
+				continue
+			}
+			s.setBindPhase(pod, util.DeviceBindSuccess, pi.BindTime)
+		default:
+			klog.Warningf("pod %v is waiting for its allocation on node %v since %v", util.PodRef(pi.Namespace, pi.Name), pi.NodeID, pi.BindTime)
+		}
+	}
+}
+
+// podAdmitted tells whether kubelet admitted the pod, which it only does after the device
+// plugins allocated its devices.
+func podAdmitted(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodRunning || len(pod.Status.ContainerStatuses) > 0
+}
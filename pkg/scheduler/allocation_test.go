@@ -0,0 +1,137 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newAllocationScheduler() *Scheduler {
+	s := NewScheduler()
+	s.eventRecorder = record.NewFakeRecorder(10)
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+		{ID: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	return s
+}
+
+// boundPod returns a pod the scheduler bound to node1 at the given time with 4000m of uuid.
+func boundPod(name, uuid string, bound time.Time) *corev1.Pod {
+	assigned := util.PodDevices{{{UUID: uuid, Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: 30}}}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name), Annotations: map[string]string{
+			util.AssignedNodeAnnotations: "node1",
+			util.AssignedIDsAnnotations:  annotations.EncodePodDevices(assigned),
+			util.DeviceBindPhase:         util.DeviceBindAllocating,
+			util.BindTimeAnnotations:     strconv.FormatInt(bound.Unix(), 10),
+		}},
+		Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c"}}},
+	}
+}
+
+func usedmem(s *Scheduler) map[string]int32 {
+	usage, _ := s.nodesUsage(&[]string{"node1"})
+	res := make(map[string]int32)
+	for _, d := range usage["node1"].Devices {
+		res[d.Id] = d.Usedmem
+	}
+	return res
+}
+
+func TestAllocationFailureReleasesDevices(t *testing.T) {
+	s := newAllocationScheduler()
+	pod := boundPod("p", "GPU-0", time.Now())
+	s.onAddPod(pod)
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 4000, "GPU-1": 0})
+
+	failed := pod.DeepCopy()
+	failed.Annotations[util.DeviceBindPhase] = util.DeviceBindFailed
+	s.onUpdatePod(pod, failed)
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 0, "GPU-1": 0})
+	assert.Equal(t, <-s.eventRecorder.(*record.FakeRecorder).Events,
+		"Warning AllocationFailed device plugin failed to allocate the devices, released them")
+
+	// later updates of the rejected pod don't take the devices again
+	s.onUpdatePod(failed, failed)
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 0, "GPU-1": 0})
+}
+
+func TestAllocationSuccessCorrectsDevices(t *testing.T) {
+	s := newAllocationScheduler()
+	pod := boundPod("p", "GPU-0", time.Now())
+	s.onAddPod(pod)
+
+	// the pod was filtered again and got GPU-1, which the device plugin handed out
+	allocated := pod.DeepCopy()
+	allocated.Annotations[util.AssignedIDsAnnotations] = "GPU-1,NVIDIA,4000,30:"
+	allocated.Annotations[util.DeviceBindPhase] = util.DeviceBindSuccess
+	allocated.Annotations[util.AllocatedIDsAnnotations] = "GPU-1,NVIDIA,4000,30:"
+	s.onUpdatePod(pod, allocated)
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 0, "GPU-1": 4000})
+	assert.Equal(t, s.pods[pod.UID].BindPhase, util.DeviceBindSuccess)
+
+	// the memory accounted after a resize is kept
+	s.updatePod(allocated, util.PodDevices{{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 6000, Usedcores: 30}}})
+	s.onUpdatePod(allocated, allocated)
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 0, "GPU-1": 6000})
+}
+
+func TestReconcileAllocationsWithoutReport(t *testing.T) {
+	oldClient := util.GetClient()
+	t.Cleanup(func() { util.SetClient(oldClient) })
+	s := newAllocationScheduler()
+	long := time.Now().Add(-time.Hour)
+	admitted := boundPod("admitted", "GPU-0", long)
+	admitted.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "c"}}
+	pending := boundPod("pending", "GPU-0", long)
+	recent := boundPod("recent", "GPU-1", time.Now())
+	rejected := boundPod("rejected", "GPU-1", long)
+	rejected.Status.Phase = corev1.PodFailed
+	gone := boundPod("gone", "GPU-1", long)
+	client := fake.NewSimpleClientset(admitted, pending, recent, rejected)
+	util.SetClient(client)
+	s.kubeClient = client
+	for _, pod := range []*corev1.Pod{admitted, pending, recent, gone} {
+		s.onAddPod(pod)
+	}
+	// the informer missed that the pod failed
+	s.addPod(rejected, "node1", util.PodDevices{{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 4000}}})
+	s.setBindPhase(rejected, util.DeviceBindAllocating, long)
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 8000, "GPU-1": 12000})
+
+	s.reconcileAllocations(context.Background(), time.Now().Add(-time.Minute))
+	assert.DeepEqual(t, usedmem(s), map[string]int32{"GPU-0": 8000, "GPU-1": 4000})
+	assert.Equal(t, s.pods[admitted.UID].BindPhase, util.DeviceBindSuccess)
+	stored, err := client.CoreV1().Pods("default").Get(context.Background(), "admitted", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, stored.Annotations[util.DeviceBindPhase], util.DeviceBindSuccess)
+	assert.Equal(t, s.pods[pending.UID].BindPhase, util.DeviceBindAllocating)
+	assert.Equal(t, s.pods[recent.UID].BindPhase, util.DeviceBindAllocating)
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestBindFailsWhileNodeLocked(t *testing.T) {
+	oldClient := util.GetClient()
+	t.Cleanup(func() { util.SetClient(oldClient) })
+	locked := time.Now().Format(time.RFC3339)
+	client := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{util.NodeLockTime: locked}}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "p", UID: "uid-p"}},
+	)
+	util.SetClient(client)
+	s := NewScheduler()
+	s.kubeClient = client
+
+	res, err := s.Bind(context.Background(), extenderv1.ExtenderBindingArgs{PodName: "p", PodNamespace: "default", PodUID: "uid-p", Node: "node1"})
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(res.Error, "has been locked"), res.Error)
+	// the pod is neither marked for allocation nor bound, and the bind slot is free again
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	_, ok := pod.Annotations[util.DeviceBindPhase]
+	assert.Assert(t, !ok)
+	for _, a := range client.Actions() {
+		assert.Assert(t, a.GetSubresource() != "binding", "pod bound")
+	}
+	assert.Equal(t, len(s.bindSlots), 0)
+}
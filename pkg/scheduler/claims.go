@@ -0,0 +1,640 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// The DRA API of Kubernetes 1.27 to 1.29. The client libraries this module is built
+// with predate it, so its objects are handled as unstructured.
+var (
+	resourceClaimsResource        = schema.GroupVersionResource{Group: "resource.k8s.io", Version: "v1alpha2", Resource: "resourceclaims"}
+	resourceClassesResource       = schema.GroupVersionResource{Group: "resource.k8s.io", Version: "v1alpha2", Resource: "resourceclasses"}
+	podSchedulingContextsResource = schema.GroupVersionResource{Group: "resource.k8s.io", Version: "v1alpha2", Resource: "podschedulingcontexts"}
+	podsResource                  = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+)
+
+const (
+	// ClaimParamMemory, ClaimParamCores and ClaimParamGPUType are the keys of the ConfigMap
+	// the parametersRef of a ResourceClaim names, the device memory in MiB, the core
+	// percentage and the GPU type of the vGPU claimed.
+	ClaimParamMemory  = "memoryMB"
+	ClaimParamCores   = "cores"
+	ClaimParamGPUType = "gpuType"
+
+	allocationModeImmediate = "Immediate"
+	// claimSyncRetries is how often a failed claim or scheduling context is synced again
+	claimSyncRetries = 5
+)
+
+type claimObjectRef struct {
+	APIGroup string `json:"apiGroup,omitempty"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+}
+
+type resourceHandle struct {
+	DriverName string `json:"driverName,omitempty"`
+	Data       string `json:"data,omitempty"`
+}
+
+type claimAllocation struct {
+	ResourceHandles  []resourceHandle     `json:"resourceHandles,omitempty"`
+	AvailableOnNodes *corev1.NodeSelector `json:"availableOnNodes,omitempty"`
+}
+
+type claimConsumer struct {
+	Name string       `json:"name"`
+	UID  k8stypes.UID `json:"uid"`
+}
+
+// resourceClaim holds the fields of a resource.k8s.io/v1alpha2 ResourceClaim the
+// controller reads.
+type resourceClaim struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ResourceClassName string          `json:"resourceClassName"`
+		ParametersRef     *claimObjectRef `json:"parametersRef,omitempty"`
+		AllocationMode    string          `json:"allocationMode,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		DriverName            string           `json:"driverName,omitempty"`
+		Allocation            *claimAllocation `json:"allocation,omitempty"`
+		ReservedFor           []claimConsumer  `json:"reservedFor,omitempty"`
+		DeallocationRequested bool             `json:"deallocationRequested,omitempty"`
+	} `json:"status"`
+}
+
+// podSchedulingContext holds the spec of a resource.k8s.io/v1alpha2 PodSchedulingContext,
+// which kube-scheduler names after its pod.
+type podSchedulingContext struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		SelectedNode   string   `json:"selectedNode,omitempty"`
+		PotentialNodes []string `json:"potentialNodes,omitempty"`
+	} `json:"spec"`
+}
+
+type podResourceClaim struct {
+	Name   string `json:"name"`
+	Source struct {
+		ResourceClaimName *string `json:"resourceClaimName,omitempty"`
+	} `json:"source"`
+}
+
+// podClaims holds the resource claims of a pod, which the core/v1 types this module is
+// built with don't know about.
+type podClaims struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ResourceClaims []podResourceClaim `json:"resourceClaims,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		ResourceClaimStatuses []struct {
+			Name              string  `json:"name"`
+			ResourceClaimName *string `json:"resourceClaimName,omitempty"`
+		} `json:"resourceClaimStatuses,omitempty"`
+	} `json:"status"`
+}
+
+// claimName returns the name of the ResourceClaim of pc, empty while the claim of a
+// template isn't created.
+func (p *podClaims) claimName(pc podResourceClaim) string {
+	if pc.Source.ResourceClaimName != nil {
+		return *pc.Source.ResourceClaimName
+	}
+	for _, st := range p.Status.ResourceClaimStatuses {
+		if st.Name == pc.Name {
+			if st.ResourceClaimName == nil {
+				return ""
+			}
+			return *st.ResourceClaimName
+		}
+	}
+	// Kubernetes 1.27 names the claims of templates after the pod
+	return p.Name + "-" + pc.Name
+}
+
+// claimParams is the vGPU a ResourceClaim asks for.
+type claimParams struct {
+	memory  int32
+	cores   int32
+	gpuType string
+}
+
+func (p claimParams) requests() [][]util.ContainerDeviceRequest {
+	return [][]util.ContainerDeviceRequest{{{
+		Nums:             1,
+		Type:             util.NvidiaGPUDevice,
+		Memreq:           p.memory,
+		MemPercentagereq: 101,
+		Coresreq:         p.cores,
+	}}}
+}
+
+func (p claimParams) annotations() map[string]string {
+	if p.gpuType == "" {
+		return nil
+	}
+	return map[string]string{util.GPUInUse: p.gpuType}
+}
+
+// fitClaim scores the given nodes for a claim of namespace asking for p, the way Filter
+// scores them for a pod.
+func (s *Scheduler) fitClaim(namespace string, p claimParams, nodes []string) (NodeScoreList, map[string]string) {
+	usage, failedNodes := s.nodesUsage(&nodes)
+	scores, _ := calcScore(&usage, &failedNodes, p.requests(), p.annotations())
+	return s.withinQuota(namespace, *scores, failedNodes), failedNodes
+}
+
+// claimController allocates vGPUs to the ResourceClaims of a DRA driver from the devices
+// the scheduler accounts pods on, so claims and pods share one pool.
+type claimController struct {
+	s      *Scheduler
+	client dynamic.Interface
+	driver string
+	queue  workqueue.RateLimitingInterface
+}
+
+type claimKey struct {
+	resource  string
+	namespace string
+	name      string
+}
+
+func newClaimController(s *Scheduler, client dynamic.Interface, driver string) *claimController {
+	return &claimController{
+		s:      s,
+		client: client,
+		driver: driver,
+		queue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+}
+
+// RunClaimController allocates the ResourceClaims of the DRA driver named driver until
+// ctx is done.
+func (s *Scheduler) RunClaimController(ctx context.Context, driver string) {
+	restConfig, err := k8sutil.NewConfig()
+	check(err)
+	client, err := dynamic.NewForConfig(restConfig)
+	check(err)
+	newClaimController(s, client, driver).run(ctx)
+}
+
+func (c *claimController) run(ctx context.Context) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.client, time.Hour)
+	factory.ForResource(resourceClaimsResource).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue(resourceClaimsResource),
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(resourceClaimsResource)(obj) },
+		DeleteFunc: c.claimDeleted,
+	})
+	factory.ForResource(podSchedulingContextsResource).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue(podSchedulingContextsResource),
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(podSchedulingContextsResource)(obj) },
+	})
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	klog.Infof("allocating the ResourceClaims of driver %v", c.driver)
+	for c.processNext(ctx) {
+	}
+}
+
+func (c *claimController) enqueue(gvr schema.GroupVersionResource) func(obj interface{}) {
+	return func(obj interface{}) {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			c.queue.Add(claimKey{resource: gvr.Resource, namespace: u.GetNamespace(), name: u.GetName()})
+		}
+	}
+}
+
+func (c *claimController) claimDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		c.s.delClaim(u.GetUID())
+	}
+}
+
+func (c *claimController) processNext(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+	key := item.(claimKey)
+	var err error
+	if key.resource == resourceClaimsResource.Resource {
+		err = c.syncClaim(ctx, key.namespace, key.name)
+	} else {
+		err = c.syncSchedulingContext(ctx, key.namespace, key.name)
+	}
+	switch {
+	case err == nil:
+		c.queue.Forget(item)
+	case c.queue.NumRequeues(item) < claimSyncRetries:
+		klog.Warningf("sync %v %v: %v", key.resource, util.PodRef(key.namespace, key.name), util.RedactIn(err.Error(), key.namespace, key.name))
+		c.queue.AddRateLimited(item)
+	default:
+		klog.Errorf("sync %v %v: %v, giving up", key.resource, util.PodRef(key.namespace, key.name), util.RedactIn(err.Error(), key.namespace, key.name))
+		c.queue.Forget(item)
+	}
+	return true
+}
+
+func (c *claimController) finalizer() string {
+	return c.driver + "/deletion-protection"
+}
+
+// syncClaim accounts, allocates or releases a ResourceClaim of the driver. Claims waiting
+// for their first consumer are allocated by syncSchedulingContext.
+func (c *claimController) syncClaim(ctx context.Context, namespace, name string) error {
+	obj, err := c.client.Resource(resourceClaimsResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var claim resourceClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &claim); err != nil {
+		return err
+	}
+	if ours, err := c.ours(ctx, &claim); err != nil || !ours {
+		return err
+	}
+	switch {
+	case claim.Status.DeallocationRequested || claim.DeletionTimestamp != nil && len(claim.Status.ReservedFor) == 0:
+		return c.deallocate(ctx, obj, &claim)
+	case claim.Status.Allocation != nil:
+		return c.account(&claim)
+	case claim.DeletionTimestamp != nil:
+		return nil
+	case claim.Spec.AllocationMode == allocationModeImmediate:
+		return c.allocate(ctx, obj, &claim, c.s.nodeIDs())
+	}
+	return nil
+}
+
+// ours tells whether the driver handles a claim, which is up to the ResourceClass
+// until the claim is allocated.
+func (c *claimController) ours(ctx context.Context, claim *resourceClaim) (bool, error) {
+	if claim.Status.DriverName != "" {
+		return claim.Status.DriverName == c.driver, nil
+	}
+	class, err := c.client.Resource(resourceClassesResource).Get(ctx, claim.Spec.ResourceClassName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	driver, _, _ := unstructured.NestedString(class.Object, "driverName")
+	return driver == c.driver, nil
+}
+
+// account adds the devices of a claim allocated before, by this or an earlier run.
+func (c *claimController) account(claim *resourceClaim) error {
+	nodeID, devices, err := c.allocation(claim)
+	if err != nil {
+		return err
+	}
+	c.s.addClaim(claim.Namespace, claim.Name, claim.UID, nodeID, devices)
+	return nil
+}
+
+// allocation returns the node and devices a claim was allocated.
+func (c *claimController) allocation(claim *resourceClaim) (string, util.PodDevices, error) {
+	a := claim.Status.Allocation
+	nodeID := ""
+	if a.AvailableOnNodes != nil {
+		for _, term := range a.AvailableOnNodes.NodeSelectorTerms {
+			for _, req := range term.MatchFields {
+				if req.Key == "metadata.name" && len(req.Values) == 1 {
+					nodeID = req.Values[0]
+				}
+			}
+		}
+	}
+	if nodeID == "" {
+		return "", nil, fmt.Errorf("allocation isn't on a single node")
+	}
+	for _, h := range a.ResourceHandles {
+		if h.DriverName == "" || h.DriverName == c.driver {
+			devices, err := annotations.DecodePodDevices(h.Data)
+			return nodeID, devices, err
+		}
+	}
+	return "", nil, fmt.Errorf("allocation has no resource handle of driver %v", c.driver)
+}
+
+// params reads the parameters of a claim from the ConfigMap its parametersRef names,
+// the scheduler's default memory and cores are used for those left out.
+func (c *claimController) params(ctx context.Context, claim *resourceClaim) (claimParams, error) {
+	p := claimParams{memory: config.DefaultMem, cores: config.DefaultCores}
+	ref := claim.Spec.ParametersRef
+	if ref == nil {
+		return p, nil
+	}
+	if ref.APIGroup != "" || ref.Kind != "ConfigMap" {
+		return p, fmt.Errorf("parameters %v %v aren't a ConfigMap", ref.Kind, ref.Name)
+	}
+	cm, err := c.s.kubeClient.CoreV1().ConfigMaps(claim.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return p, err
+	}
+	for key, dst := range map[string]*int32{ClaimParamMemory: &p.memory, ClaimParamCores: &p.cores} {
+		val, ok := cm.Data[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(val, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("parameter %v: %v", key, err)
+		}
+		*dst = int32(n)
+	}
+	p.gpuType = cm.Data[ClaimParamGPUType]
+	switch {
+	case p.memory == 0 && config.AllowZeroMemory:
+		p.memory = config.ZeroMemoryFloor
+	case p.memory <= 0:
+		return p, fmt.Errorf("parameter %v %v isn't positive", ClaimParamMemory, p.memory)
+	}
+	if p.cores < 0 || p.cores > 100 {
+		return p, fmt.Errorf("parameter %v %v isn't between 0 and 100", ClaimParamCores, p.cores)
+	}
+	return p, nil
+}
+
+// allocate gives a claim the devices of the best scoring of the given nodes, accounting
+// them before the allocation is written like Filter does for pods.
+func (c *claimController) allocate(ctx context.Context, obj *unstructured.Unstructured, claim *resourceClaim, nodes []string) error {
+	p, err := c.params(ctx, claim)
+	if err != nil {
+		return err
+	}
+	c.s.allocating.Lock()
+	defer c.s.allocating.Unlock()
+	scores, failedNodes := c.s.fitClaim(claim.Namespace, p, nodes)
+	if len(scores) == 0 {
+		return fmt.Errorf("%v", filterError(len(nodes), failedNodes))
+	}
+	c.s.tieBreaker.sort(scores)
+	m := scores[len(scores)-1]
+	c.s.addClaim(claim.Namespace, claim.Name, claim.UID, m.nodeID, m.devices)
+	if err := c.writeAllocation(ctx, obj, m.nodeID, m.devices); err != nil {
+		c.s.delClaim(claim.UID)
+		return err
+	}
+	klog.Infof("claim %v allocated %v on %v", util.PodRef(claim.Namespace, claim.Name), annotations.EncodePodDevices(m.devices), m.nodeID)
+	return nil
+}
+
+func (c *claimController) writeAllocation(ctx context.Context, obj *unstructured.Unstructured, nodeID string, devices util.PodDevices) error {
+	client := c.client.Resource(resourceClaimsResource).Namespace(obj.GetNamespace())
+	obj = obj.DeepCopy()
+	var err error
+	if !containsString(obj.GetFinalizers(), c.finalizer()) {
+		obj.SetFinalizers(append(obj.GetFinalizers(), c.finalizer()))
+		if obj, err = client.Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	allocation := map[string]interface{}{
+		"resourceHandles": []interface{}{map[string]interface{}{
+			"driverName": c.driver,
+			"data":       annotations.EncodePodDevices(devices),
+		}},
+		"availableOnNodes": map[string]interface{}{"nodeSelectorTerms": []interface{}{map[string]interface{}{
+			"matchFields": []interface{}{map[string]interface{}{
+				"key":      "metadata.name",
+				"operator": string(corev1.NodeSelectorOpIn),
+				"values":   []interface{}{nodeID},
+			}},
+		}}},
+		"shareable": false,
+	}
+	if err := unstructured.SetNestedField(obj.Object, c.driver, "status", "driverName"); err != nil {
+		return err
+	}
+	if err := unstructured.SetNestedField(obj.Object, allocation, "status", "allocation"); err != nil {
+		return err
+	}
+	_, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+// deallocate releases the devices of a claim and clears its allocation, then lets the
+// claim go.
+func (c *claimController) deallocate(ctx context.Context, obj *unstructured.Unstructured, claim *resourceClaim) error {
+	c.s.delClaim(claim.UID)
+	client := c.client.Resource(resourceClaimsResource).Namespace(obj.GetNamespace())
+	var err error
+	if claim.Status.Allocation != nil || claim.Status.DeallocationRequested {
+		obj = obj.DeepCopy()
+		unstructured.RemoveNestedField(obj.Object, "status", "allocation")
+		unstructured.RemoveNestedField(obj.Object, "status", "driverName")
+		unstructured.RemoveNestedField(obj.Object, "status", "deallocationRequested")
+		if obj, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		klog.Infof("claim %v deallocated", util.PodRef(claim.Namespace, claim.Name))
+	}
+	finalizers := obj.GetFinalizers()
+	if !containsString(finalizers, c.finalizer()) {
+		return nil
+	}
+	kept := make([]string, 0, len(finalizers))
+	for _, f := range finalizers {
+		if f != c.finalizer() {
+			kept = append(kept, f)
+		}
+	}
+	obj.SetFinalizers(kept)
+	_, err = client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+// syncSchedulingContext tells kube-scheduler which of the potential nodes of a pod can't
+// take the pod's claims of the driver, and allocates the claims on the node it selected.
+func (c *claimController) syncSchedulingContext(ctx context.Context, namespace, name string) error {
+	client := c.client.Resource(podSchedulingContextsResource).Namespace(namespace)
+	obj, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sc podSchedulingContext
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &sc); err != nil {
+		return err
+	}
+	if sc.DeletionTimestamp != nil {
+		return nil
+	}
+	podObj, err := c.client.Resource(podsResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var pod podClaims
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(podObj.Object, &pod); err != nil {
+		return err
+	}
+	type pending struct {
+		obj   *unstructured.Unstructured
+		claim *resourceClaim
+	}
+	var statuses []interface{}
+	var toAllocate []pending
+	selectable := true
+	for _, pc := range pod.Spec.ResourceClaims {
+		claimName := pod.claimName(pc)
+		if claimName == "" {
+			continue
+		}
+		claimObj, err := c.client.Resource(resourceClaimsResource).Namespace(namespace).Get(ctx, claimName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		claim := &resourceClaim{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(claimObj.Object, claim); err != nil {
+			return err
+		}
+		if ours, err := c.ours(ctx, claim); err != nil || !ours {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if claim.Status.Allocation != nil || claim.DeletionTimestamp != nil {
+			continue
+		}
+		p, err := c.params(ctx, claim)
+		if err != nil {
+			return err
+		}
+		unsuitable := c.unsuitableNodes(claim.Namespace, p, sc.Spec.PotentialNodes)
+		status := map[string]interface{}{"name": pc.Name}
+		if len(unsuitable) > 0 {
+			status["unsuitableNodes"] = unsuitable
+		}
+		statuses = append(statuses, status)
+		for _, n := range unsuitable {
+			selectable = selectable && n != sc.Spec.SelectedNode
+		}
+		toAllocate = append(toAllocate, pending{claimObj, claim})
+	}
+	if sc.Spec.SelectedNode != "" && selectable {
+		for _, pa := range toAllocate {
+			if err := c.allocate(ctx, pa.obj, pa.claim, []string{sc.Spec.SelectedNode}); err != nil {
+				return err
+			}
+		}
+	}
+	if !mergeClaimStatuses(obj, statuses) {
+		return nil
+	}
+	_, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+// unsuitableNodes returns the sorted nodes a claim of namespace asking for p doesn't fit.
+func (c *claimController) unsuitableNodes(namespace string, p claimParams, nodes []string) []interface{} {
+	scores, _ := c.s.fitClaim(namespace, p, nodes)
+	fits := make(map[string]bool)
+	for _, ns := range scores {
+		fits[ns.nodeID] = true
+	}
+	var names []string
+	for _, n := range nodes {
+		if !fits[n] {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	res := make([]interface{}, 0, len(names))
+	for _, n := range names {
+		res = append(res, n)
+	}
+	return res
+}
+
+// mergeClaimStatuses replaces the entries of the given claims in the status of a scheduling
+// context, keeping those of other drivers' claims, it returns whether the status changed.
+func mergeClaimStatuses(obj *unstructured.Unstructured, statuses []interface{}) bool {
+	old, _, _ := unstructured.NestedSlice(obj.Object, "status", "resourceClaims")
+	ours := make(map[string]bool)
+	for _, st := range statuses {
+		ours[st.(map[string]interface{})["name"].(string)] = true
+	}
+	var merged []interface{}
+	for _, st := range old {
+		if m, ok := st.(map[string]interface{}); !ok || !ours[fmt.Sprint(m["name"])] {
+			merged = append(merged, st)
+		}
+	}
+	merged = append(merged, statuses...)
+	if reflect.DeepEqual(old, merged) {
+		return false
+	}
+	_ = unstructured.SetNestedSlice(obj.Object, merged, "status", "resourceClaims")
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testDriver = "vgpu.4pd.io"
+
+func unstructuredObj(apiVersion, kind, name string, fields map[string]interface{}) *unstructured.Unstructured {
+	obj := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default", "uid": "uid-" + kind + "-" + name},
+	}
+	for k, v := range fields {
+		obj[k] = v
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func testClaim(name, params string) *unstructured.Unstructured {
+	return unstructuredObj("resource.k8s.io/v1alpha2", "ResourceClaim", name, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"resourceClassName": "vgpu",
+			"parametersRef":     map[string]interface{}{"kind": "ConfigMap", "name": params},
+		},
+	})
+}
+
+func testClaimPod(name string, claims ...string) *unstructured.Unstructured {
+	var rcs []interface{}
+	for _, c := range claims {
+		rcs = append(rcs, map[string]interface{}{"name": c, "source": map[string]interface{}{"resourceClaimName": c}})
+	}
+	return unstructuredObj("v1", "Pod", name, map[string]interface{}{"spec": map[string]interface{}{"resourceClaims": rcs}})
+}
+
+func testSchedulingContext(name, selected string) *unstructured.Unstructured {
+	return unstructuredObj("resource.k8s.io/v1alpha2", "PodSchedulingContext", name, map[string]interface{}{
+		"spec": map[string]interface{}{"selectedNode": selected, "potentialNodes": []interface{}{"node1"}},
+	})
+}
+
+func newClaimTest(t *testing.T, objs ...runtime.Object) (*claimController, *dynamicfake.FakeDynamicClient) {
+	class := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "resource.k8s.io/v1alpha2",
+		"kind":       "ResourceClass",
+		"metadata":   map[string]interface{}{"name": "vgpu"},
+		"driverName": testDriver,
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		resourceClaimsResource:        "ResourceClaimList",
+		resourceClassesResource:       "ResourceClassList",
+		podSchedulingContextsResource: "PodSchedulingContextList",
+		podsResource:                  "PodList",
+	}, append(objs, class)...)
+	s := NewScheduler()
+	s.kubeClient = fake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "big", Namespace: "default"}, Data: map[string]string{ClaimParamMemory: "4000", ClaimParamCores: "20"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "small", Namespace: "default"}, Data: map[string]string{ClaimParamMemory: "2000"}},
+	)
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 8000, Type: "NVIDIA-A100", Health: true},
+	}})
+	return newClaimController(s, client, testDriver), client
+}
+
+func getClaim(t *testing.T, client *dynamicfake.FakeDynamicClient, name string) *resourceClaim {
+	obj, err := client.Resource(resourceClaimsResource).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	claim := &resourceClaim{}
+	assert.NilError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, claim))
+	claim.Finalizers = obj.GetFinalizers()
+	return claim
+}
+
+func TestClaimsSharePoolWithPods(t *testing.T) {
+	ctx := context.Background()
+	c, client := newClaimTest(t,
+		testClaim("big", "big"), testClaim("small", "small"),
+		testClaimPod("p", "big", "small"), testSchedulingContext("p", ""),
+		testClaimPod("q", "small"), testSchedulingContext("q", "node1"),
+	)
+	// a pod holds 6000 of the 8000 MiB
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "r", Namespace: "default", UID: "uid-r"}}
+	c.s.addPod(pod, "node1", util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 6000}}})
+
+	assert.NilError(t, c.syncSchedulingContext(ctx, "default", "p"))
+	sc, err := client.Resource(podSchedulingContextsResource).Namespace("default").Get(ctx, "p", metav1.GetOptions{})
+	assert.NilError(t, err)
+	statuses, _, _ := unstructured.NestedSlice(sc.Object, "status", "resourceClaims")
+	assert.DeepEqual(t, statuses, []interface{}{
+		map[string]interface{}{"name": "big", "unsuitableNodes": []interface{}{"node1"}},
+		map[string]interface{}{"name": "small"},
+	})
+	assert.Assert(t, getClaim(t, client, "small").Status.Allocation == nil)
+
+	assert.NilError(t, c.syncSchedulingContext(ctx, "default", "q"))
+	claim := getClaim(t, client, "small")
+	assert.Equal(t, claim.Status.DriverName, testDriver)
+	assert.DeepEqual(t, claim.Finalizers, []string{testDriver + "/deletion-protection"})
+	nodeID, devices, err := c.allocation(claim)
+	assert.NilError(t, err)
+	assert.Equal(t, nodeID, "node1")
+	assert.DeepEqual(t, devices, util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 2000}}})
+	assert.DeepEqual(t, usedmem(c.s), map[string]int32{"GPU-0": 8000})
+
+	// the GPU is full for pods now
+	scores, failedNodes := c.s.fitClaim("default", claimParams{memory: 1000}, []string{"node1"})
+	assert.Equal(t, len(scores), 0)
+	assert.Equal(t, failedNodes["node1"], string(ReasonInsufficientMemory))
+
+	// a restarted scheduler accounts the claim again
+	restarted, _ := newClaimTest(t)
+	restarted.client = client
+	assert.NilError(t, restarted.syncClaim(ctx, "default", "small"))
+	assert.DeepEqual(t, usedmem(restarted.s), map[string]int32{"GPU-0": 2000})
+
+	obj, err := client.Resource(resourceClaimsResource).Namespace("default").Get(ctx, "small", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, unstructured.SetNestedField(obj.Object, true, "status", "deallocationRequested"))
+	_, err = client.Resource(resourceClaimsResource).Namespace("default").UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, c.syncClaim(ctx, "default", "small"))
+	claim = getClaim(t, client, "small")
+	assert.Assert(t, claim.Status.Allocation == nil)
+	assert.Equal(t, len(claim.Finalizers), 0)
+	assert.DeepEqual(t, usedmem(c.s), map[string]int32{"GPU-0": 6000})
+}
+
+func TestImmediateClaim(t *testing.T) {
+	claim := testClaim("small", "small")
+	assert.NilError(t, unstructured.SetNestedField(claim.Object, allocationModeImmediate, "spec", "allocationMode"))
+	other := testClaim("other", "small")
+	assert.NilError(t, unstructured.SetNestedField(other.Object, "other", "spec", "resourceClassName"))
+	assert.NilError(t, unstructured.SetNestedField(other.Object, allocationModeImmediate, "spec", "allocationMode"))
+	c, client := newClaimTest(t, claim, other)
+	assert.NilError(t, c.syncClaim(context.Background(), "default", "small"))
+	assert.NilError(t, c.syncClaim(context.Background(), "default", "other"))
+	assert.Equal(t, getClaim(t, client, "small").Status.DriverName, testDriver)
+	assert.Assert(t, getClaim(t, client, "other").Status.Allocation == nil)
+	assert.DeepEqual(t, usedmem(c.s), map[string]int32{"GPU-0": 2000})
+}
+
+func TestClaimParams(t *testing.T) {
+	defer func(mem, cores int32, allow bool) {
+		config.DefaultMem, config.DefaultCores, config.AllowZeroMemory = mem, cores, allow
+	}(config.DefaultMem, config.DefaultCores, config.AllowZeroMemory)
+	config.DefaultMem, config.DefaultCores = 5000, 0
+	for _, tc := range []struct {
+		name  string
+		data  map[string]string
+		allow bool
+		want  claimParams
+		err   string
+	}{
+		{name: "defaults", data: map[string]string{}, want: claimParams{memory: 5000}},
+		{name: "all", data: map[string]string{ClaimParamMemory: "1000", ClaimParamCores: "30", ClaimParamGPUType: "A100"}, want: claimParams{memory: 1000, cores: 30, gpuType: "A100"}},
+		{name: "zero memory", data: map[string]string{ClaimParamMemory: "0"}, err: "parameter memoryMB 0 isn't positive"},
+		{name: "zero memory allowed", data: map[string]string{ClaimParamMemory: "0"}, allow: true, want: claimParams{memory: config.ZeroMemoryFloor}},
+		{name: "cores", data: map[string]string{ClaimParamCores: "101"}, err: "parameter cores 101 isn't between 0 and 100"},
+		{name: "malformed", data: map[string]string{ClaimParamMemory: "1G"}, err: `parameter memoryMB: strconv.ParseInt: parsing "1G": invalid syntax`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config.AllowZeroMemory = tc.allow
+			c, _ := newClaimTest(t)
+			c.s.kubeClient = fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "params", Namespace: "default"}, Data: tc.data})
+			claim := &resourceClaim{}
+			claim.Namespace = "default"
+			claim.Spec.ParametersRef = &claimObjectRef{Kind: "ConfigMap", Name: "params"}
+			p, err := c.params(context.Background(), claim)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, p, tc.want)
+		})
+	}
+}
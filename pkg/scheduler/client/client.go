@@ -0,0 +1,283 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package client is a typed client of the HTTP endpoints of the vGPU scheduler, those
+// the OpenAPI document the scheduler serves at /openapi.json lists. The components serve
+// their endpoints on the listeners they are configured with, so a Client is made for the
+// address of each component used: the extender for Filter and Bind, the webhook for
+// Admit, and the metrics component, by default on port 9395, for the rest.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	admissionv1 "k8s.io/api/admission/v1"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+// Defaults of a Client made by New.
+const (
+	DefaultTimeout = 30 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = 200 * time.Millisecond
+)
+
+// maxErrorBody bounds the response body kept in a StatusError.
+const maxErrorBody = 4096
+
+// Client calls the endpoints of a scheduler component. Its fields may be changed until
+// it is first used.
+type Client struct {
+	// Endpoint is the URL of the component, e.g. http://127.0.0.1:9395
+	Endpoint string
+	HTTP     *http.Client
+	// Retries is how many times a request that can be repeated, a GET or DELETE, is
+	// tried again after it failed with an error of the connection or a Temporary
+	// StatusError. Filter, Bind and Admit aren't repeated, kube-scheduler and the API
+	// server retry those themselves.
+	Retries int
+	// Backoff is the wait before the first retry, doubled before each following one and
+	// jittered by up to half of it.
+	Backoff time.Duration
+}
+
+// New returns a Client of the component at endpoint.
+func New(endpoint string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an http or https URL", endpoint)
+	}
+	return &Client{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		HTTP:     &http.Client{Timeout: DefaultTimeout},
+		Retries:  DefaultRetries,
+		Backoff:  DefaultBackoff,
+	}, nil
+}
+
+// ListOptions select the page of a list endpoint.
+type ListOptions struct {
+	// Limit is the most items on the page, the server's default when 0
+	Limit int
+	// Continue is the Continue of the previous page
+	Continue string
+	// Fields are the parts of the items to get, e.g. scheduler.UsageFieldSummary, all
+	// when empty
+	Fields []string
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set(util.PageLimitParam, strconv.Itoa(o.Limit))
+	}
+	if o.Continue != "" {
+		q.Set(util.PageContinueParam, o.Continue)
+	}
+	if len(o.Fields) > 0 {
+		q.Set(util.PageFieldsParam, strings.Join(o.Fields, ","))
+	}
+	return q
+}
+
+// Usage gets a page of the vGPU usage of the nodes.
+func (c *Client) Usage(ctx context.Context, opts ListOptions) (*scheduler.UsagePage, error) {
+	var res scheduler.UsagePage
+	if err := c.do(ctx, http.MethodGet, scheduler.UsagePath, opts.query(), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// PendingDemand gets a page of the vGPU demand of the pods no node was found for.
+func (c *Client) PendingDemand(ctx context.Context, opts ListOptions) (*scheduler.PendingDemandPage, error) {
+	var res scheduler.PendingDemandPage
+	if err := c.do(ctx, http.MethodGet, scheduler.PendingDemandPath, opts.query(), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// EfficiencyReport gets a page of the efficiency report.
+func (c *Client) EfficiencyReport(ctx context.Context, opts ListOptions) (*scheduler.EfficiencyReportPage, error) {
+	var res scheduler.EfficiencyReportPage
+	if err := c.do(ctx, http.MethodGet, scheduler.EfficiencyReportPath, opts.query(), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Config gets the configuration the scheduler runs with.
+func (c *Client) Config(ctx context.Context) (*config.EffectiveConfig, error) {
+	var res config.EffectiveConfig
+	if err := c.do(ctx, http.MethodGet, util.ConfigPath, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// PurgeNode makes the scheduler forget a decommissioned node and returns what was
+// removed. The scheduler only serves it to clients on the loopback interface, others
+// get a StatusError of http.StatusForbidden.
+func (c *Client) PurgeNode(ctx context.Context, node string) ([]string, error) {
+	var res []string
+	if err := c.do(ctx, http.MethodDelete, scheduler.PurgeNodePath+url.PathEscape(node), nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Metrics gets the metrics of the scheduler, by name.
+func (c *Client) Metrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	var res map[string]*dto.MetricFamily
+	err := c.call(ctx, http.MethodGet, scheduler.MetricsPath, nil, nil, func(body io.Reader) error {
+		var parser expfmt.TextParser
+		var err error
+		res, err = parser.TextToMetricFamilies(body)
+		return err
+	})
+	return res, err
+}
+
+// Filter filters the nodes of args for the pod, as kube-scheduler does. The result is
+// returned with an ExtenderError when it has an Error.
+func (c *Client) Filter(ctx context.Context, args extenderv1.ExtenderArgs) (*extenderv1.ExtenderFilterResult, error) {
+	var res extenderv1.ExtenderFilterResult
+	if err := c.do(ctx, http.MethodPost, scheduler.FilterPath, nil, args, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return &res, &ExtenderError{Op: "filter", Message: res.Error}
+	}
+	return &res, nil
+}
+
+// Bind binds the pod of args to its node, as kube-scheduler does. The result is
+// returned with an ExtenderError when it has an Error.
+func (c *Client) Bind(ctx context.Context, args extenderv1.ExtenderBindingArgs) (*extenderv1.ExtenderBindingResult, error) {
+	var res extenderv1.ExtenderBindingResult
+	if err := c.do(ctx, http.MethodPost, scheduler.BindPath, nil, args, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return &res, &ExtenderError{Op: "bind", Message: res.Error}
+	}
+	return &res, nil
+}
+
+// Admit has the webhook review the request of review, as the API server does, and
+// returns the review with its response.
+func (c *Client) Admit(ctx context.Context, review *admissionv1.AdmissionReview) (*admissionv1.AdmissionReview, error) {
+	var res admissionv1.AdmissionReview
+	if err := c.do(ctx, http.MethodPost, scheduler.WebhookPath, nil, review, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// do sends in, if not nil, as the JSON body of a request and decodes the JSON response
+// into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("%v %v: encode request: %w", method, path, err)
+		}
+	}
+	return c.call(ctx, method, path, query, body, func(r io.Reader) error {
+		if err := json.NewDecoder(r).Decode(out); err != nil {
+			return &DecodeError{Method: method, Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// call sends the request, retried when it can be, and hands the body of a 200 OK
+// response to read.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body []byte, read func(io.Reader) error) error {
+	u := c.Endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	retries := 0
+	if method == http.MethodGet || method == http.MethodDelete {
+		retries = c.Retries
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.try(ctx, method, u, path, body, read)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+		wait := backoff
+		if backoff > 0 {
+			wait += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		}
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) try(ctx context.Context, method, u, path string, body []byte, read func(io.Reader) error) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &StatusError{Method: method, Path: path, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return read(resp.Body)
+}
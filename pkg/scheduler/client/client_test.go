@@ -0,0 +1,286 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/openapi"
+	"gotest.tools/v3/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+// fill sets every field reachable from v, a pointer, to a value other than its zero
+// value, so a field the document or the client misses is found.
+func fill(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		fill(v.Elem())
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fill(key)
+		fill(elem)
+		v.SetMapIndex(key, elem)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	}
+}
+
+// serve serves res, validated against the schema of the 200 response of the operation,
+// at path for method.
+func serve(t *testing.T, method, path string, res interface{}) *Client {
+	doc := scheduler.OpenAPI()
+	item := doc.Paths[path]
+	assert.Assert(t, item != nil, path)
+	op := map[string]*openapi.Operation{http.MethodGet: item.Get, http.MethodPost: item.Post, http.MethodDelete: item.Delete}[method]
+	assert.Assert(t, op != nil, method+" "+path)
+	data, err := json.Marshal(res)
+	assert.NilError(t, err)
+	v := &openapi.Validator{Components: doc.Components, DisallowUnknownFields: true}
+	assert.NilError(t, v.Validate(op.Responses["200"].Content[openapi.JSON].Schema, data))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL)
+	assert.NilError(t, err)
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	var usage scheduler.UsagePage
+	fill(reflect.ValueOf(&usage))
+	got, err := serve(t, http.MethodGet, scheduler.UsagePath, usage).Usage(ctx, ListOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *got, usage)
+
+	var demand scheduler.PendingDemandPage
+	fill(reflect.ValueOf(&demand))
+	gotDemand, err := serve(t, http.MethodGet, scheduler.PendingDemandPath, demand).PendingDemand(ctx, ListOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *gotDemand, demand)
+
+	var efficiency scheduler.EfficiencyReportPage
+	fill(reflect.ValueOf(&efficiency))
+	gotEfficiency, err := serve(t, http.MethodGet, scheduler.EfficiencyReportPath, efficiency).EfficiencyReport(ctx, ListOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *gotEfficiency, efficiency)
+
+	var effective config.EffectiveConfig
+	fill(reflect.ValueOf(&effective))
+	gotConfig, err := serve(t, http.MethodGet, util.ConfigPath, effective).Config(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *gotConfig, effective)
+
+	removed, err := serve(t, http.MethodDelete, scheduler.PurgeNodePath+"{node}", []string{"devices", "annotation 4pd.io/node-handshake"}).PurgeNode(ctx, "node1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{"devices", "annotation 4pd.io/node-handshake"})
+
+	nodes := []string{"node1"}
+	filterResult := extenderv1.ExtenderFilterResult{NodeNames: &nodes, FailedNodes: extenderv1.FailedNodesMap{"node2": "no GPU"}}
+	gotFilter, err := serve(t, http.MethodPost, scheduler.FilterPath, filterResult).Filter(ctx, extenderv1.ExtenderArgs{Pod: &corev1.Pod{}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *gotFilter, filterResult)
+
+	_, err = serve(t, http.MethodPost, scheduler.BindPath, extenderv1.ExtenderBindingResult{}).Bind(ctx, extenderv1.ExtenderBindingArgs{PodName: "p", Node: "node1"})
+	assert.NilError(t, err)
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Response: &admissionv1.AdmissionResponse{UID: "1", Allowed: true},
+	}
+	gotReview, err := serve(t, http.MethodPost, scheduler.WebhookPath, review).Admit(ctx, &admissionv1.AdmissionReview{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *gotReview, review)
+}
+
+func TestListOptions(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(`{"nodes": 0, "items": []}`))
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL + "/")
+	assert.NilError(t, err)
+
+	_, err = c.Usage(context.Background(), ListOptions{Limit: 10, Continue: "node0009", Fields: []string{scheduler.UsageFieldSummary, scheduler.UsageFieldPods}})
+	assert.NilError(t, err)
+	assert.Equal(t, query, "continue=node0009&fields=summary%2Cpods&limit=10")
+	_, err = c.Usage(context.Background(), ListOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, query, "")
+}
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE vgpu_pending_pods gauge\nvgpu_pending_pods{device_type=\"NVIDIA\"} 4\n"))
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL)
+	assert.NilError(t, err)
+	metrics, err := c.Metrics(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, metrics["vgpu_pending_pods"].GetMetric()[0].GetGauge().GetValue(), 4.0)
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		case 2:
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(`["devices"]`))
+		}
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL)
+	assert.NilError(t, err)
+	c.Backoff = time.Millisecond
+
+	removed, err := c.PurgeNode(context.Background(), "node1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{"devices"})
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(3))
+
+	// out of retries
+	atomic.StoreInt32(&calls, 0)
+	c.Retries = 1
+	_, err = c.PurgeNode(context.Background(), "node1")
+	assert.Equal(t, StatusCode(err), http.StatusTooManyRequests)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+
+	// not repeated
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Filter(context.Background(), extenderv1.ExtenderArgs{})
+	assert.Equal(t, StatusCode(err), http.StatusServiceUnavailable)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+}
+
+func TestRetriesStopWithContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL)
+	assert.NilError(t, err)
+	c.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.Usage(ctx, ListOptions{})
+	assert.Equal(t, StatusCode(err), http.StatusServiceUnavailable)
+	assert.Assert(t, time.Since(start) < time.Minute)
+}
+
+func TestErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case scheduler.UsagePath:
+			http.Error(w, `unknown field "gpus"`, http.StatusBadRequest)
+		case scheduler.PurgeNodePath + "node1":
+			http.Error(w, "purge is only served on the loopback interface", http.StatusForbidden)
+		case scheduler.FilterPath:
+			w.Write([]byte(`{"Error": "pod has no vGPU request"}`))
+		case scheduler.BindPath:
+			w.Write([]byte(`{"Error": "node1 is gone"}`))
+		default:
+			w.Write([]byte(`<html>`))
+		}
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL)
+	assert.NilError(t, err)
+	ctx := context.Background()
+
+	_, err = c.Usage(ctx, ListOptions{Fields: []string{"gpus"}})
+	var status *StatusError
+	assert.Assert(t, errors.As(err, &status))
+	assert.Equal(t, status.StatusCode, http.StatusBadRequest)
+	assert.Error(t, err, `GET /usage: Bad Request: unknown field "gpus"`)
+	assert.Assert(t, !status.Temporary())
+
+	_, err = c.PurgeNode(ctx, "node1")
+	assert.Equal(t, StatusCode(err), http.StatusForbidden)
+
+	res, err := c.Filter(ctx, extenderv1.ExtenderArgs{})
+	var extender *ExtenderError
+	assert.Assert(t, errors.As(err, &extender))
+	assert.DeepEqual(t, *extender, ExtenderError{Op: "filter", Message: "pod has no vGPU request"})
+	assert.Equal(t, res.Error, "pod has no vGPU request")
+	_, err = c.Bind(ctx, extenderv1.ExtenderBindingArgs{})
+	assert.Error(t, err, "bind: node1 is gone")
+	assert.Equal(t, StatusCode(err), 0)
+
+	_, err = c.Config(ctx)
+	var decode *DecodeError
+	assert.Assert(t, errors.As(err, &decode))
+
+	_, err = New("localhost:9395")
+	assert.ErrorContains(t, err, "is not an http or https URL")
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// StatusError is returned for a response with a status other than 200 OK, e.g.
+// http.StatusBadRequest for an unknown field of ListOptions.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// Message is the start of the response body, the error the server wrote
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v %v: %v", e.Method, e.Path, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%v %v: %v: %v", e.Method, e.Path, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Temporary reports whether the request may succeed when tried again: the server was
+// overloaded, or a proxy in front of it failed.
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// StatusCode returns the status of the response err was returned for, 0 when err isn't a
+// StatusError.
+func StatusCode(err error) int {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.StatusCode
+	}
+	return 0
+}
+
+// DecodeError is returned when a response isn't what the client expects, e.g. from a
+// server of another version.
+type DecodeError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v %v: decode response: %v", e.Method, e.Path, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ExtenderError is the Error of a filter or bind result.
+type ExtenderError struct {
+	// Op is "filter" or "bind"
+	Op      string
+	Message string
+}
+
+func (e *ExtenderError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Op, e.Message)
+}
+
+// retryable reports whether a request failing with err may be tried again.
+func retryable(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Temporary()
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// colocateAnchor is the devices the pods of a co-location group are placed on. The first
+// pod of the group placed anchors it to its devices, the anchor goes away with the last
+// pod of the group.
+type colocateAnchor struct {
+	NodeID  string
+	Devices []string
+	members int
+}
+
+// colocateKey returns the key of the util.ColocateGroupAnnotation of pod, groups being
+// per namespace, or "" if the pod isn't in one. Pods getting whole GPUs share them with
+// nobody, the gpu mode wins over the group.
+func colocateKey(pod *corev1.Pod) string {
+	group := pod.Annotations[util.ColocateGroupAnnotation]
+	if len(group) == 0 || util.WholeGPUs(pod) {
+		return ""
+	}
+	return pod.Namespace + "/" + group
+}
+
+// joinGroup adds pi to the co-location group key, anchoring the group to the devices of
+// pi if it has none. m.mutex is held.
+func (m *podManager) joinGroup(pi *podInfo, key string) {
+	if len(key) == 0 {
+		return
+	}
+	a, ok := m.groups[key]
+	if !ok {
+		a = &colocateAnchor{NodeID: pi.NodeID}
+		seen := make(map[string]bool)
+		for _, cd := range pi.Devices {
+			for _, d := range cd {
+				if !seen[d.UUID] {
+					seen[d.UUID] = true
+					a.Devices = append(a.Devices, d.UUID)
+				}
+			}
+		}
+		m.groups[key] = a
+		klog.Infof("co-location group %v anchored on %v of node %v", util.Redact(key), a.Devices, a.NodeID)
+	}
+	a.members++
+	pi.ColocateGroup = key
+}
+
+// leaveGroup removes pi from its co-location group, forgetting the anchor with the last
+// pod. m.mutex is held.
+func (m *podManager) leaveGroup(pi *podInfo) {
+	a, ok := m.groups[pi.ColocateGroup]
+	if !ok {
+		return
+	}
+	a.members--
+	if a.members <= 0 {
+		delete(m.groups, pi.ColocateGroup)
+		klog.Infof("co-location group %v released %v of node %v", util.Redact(pi.ColocateGroup), a.Devices, a.NodeID)
+	}
+}
+
+// anchorOf returns the anchor of the co-location group key.
+func (m *podManager) anchorOf(key string) (colocateAnchor, bool) {
+	if len(key) == 0 {
+		return colocateAnchor{}, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	a, ok := m.groups[key]
+	if !ok {
+		return colocateAnchor{}, false
+	}
+	return *a, true
+}
+
+// restrictToAnchor leaves only the anchored devices of a in usage, the other nodes failing
+// with ReasonColocateGroup. A pod asking for several GPUs fits as long as the anchor has
+// as many, which the first pod of the group decides.
+func restrictToAnchor(usage map[string]*NodeUsage, failedNodes map[string]string, a colocateAnchor) {
+	anchored := make(map[string]bool, len(a.Devices))
+	for _, uuid := range a.Devices {
+		anchored[uuid] = true
+	}
+	for nodeID, node := range usage {
+		if nodeID != a.NodeID {
+			delete(usage, nodeID)
+			failedNodes[nodeID] = string(ReasonColocateGroup)
+			continue
+		}
+		var devices DeviceUsageList
+		for _, d := range node.Devices {
+			if anchored[d.Id] {
+				devices = append(devices, d)
+			}
+		}
+		node.Devices = devices
+	}
+}
+
+// colocateFailed reports that the pod doesn't fit the device its co-location group is
+// anchored on, rather than placing it elsewhere.
+func (s *Scheduler) colocateFailed(pod *corev1.Pod, a colocateAnchor, failedNodes map[string]string) {
+	reason, ok := failedNodes[a.NodeID]
+	if !ok {
+		reason = "node not a candidate"
+	}
+	klog.Infof("pod %v doesn't fit %v of node %v its co-location group is anchored on: %v", util.PodRef(pod.Namespace, pod.Name), a.Devices, a.NodeID, reason)
+	s.podEventf(pod, corev1.EventTypeWarning, "ColocateGroupFull",
+		"co-location group %v is anchored on GPUs %v of node %v, which the pod doesn't fit: %v",
+		pod.Annotations[util.ColocateGroupAnnotation], strings.Join(a.Devices, ","), a.NodeID, reason)
+}
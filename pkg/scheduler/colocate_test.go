@@ -0,0 +1,187 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestFilterColocatesGroup(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+
+	s := NewScheduler()
+	recorder := record.NewFakeRecorder(4)
+	s.eventRecorder = recorder
+	for _, node := range []string{"node1", "node2"} {
+		var devices []DeviceInfo
+		for i := 0; i < 2; i++ {
+			devices = append(devices, DeviceInfo{ID: fmt.Sprintf("GPU-%v-%d", node, i), Count: 2, Devmem: 16000, Type: "NVIDIA-A100", Health: true})
+		}
+		s.addNode(node, &NodeInfo{ID: node, Devices: devices})
+	}
+	newPod := func(namespace, name, group string) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(namespace + "-" + name), Annotations: map[string]string{
+				util.ColocateGroupAnnotation: group,
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse("4000"),
+				},
+			}}}},
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		return pod
+	}
+	schedule := func(pod *corev1.Pod) (*extenderv1.ExtenderFilterResult, string) {
+		res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1", "node2"}})
+		assert.NilError(t, err)
+		if pi, ok := s.pods[pod.UID]; ok {
+			return res, pi.Devices[0][0].UUID
+		}
+		return res, ""
+	}
+
+	// the first pod anchors the group
+	producer := newPod("default", "producer", "ipc")
+	_, anchored := schedule(producer)
+	anchor, ok := s.anchorOf("default/ipc")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, anchor.Devices, []string{anchored})
+
+	// the next one joins it
+	consumer := newPod("default", "consumer", "ipc")
+	res, uuid := schedule(consumer)
+	assert.Equal(t, uuid, anchored)
+	assert.DeepEqual(t, *res.NodeNames, []string{anchor.NodeID})
+
+	// groups are per namespace
+	_, uuid = schedule(newPod("other", "producer", "ipc"))
+	assert.Assert(t, uuid != anchored)
+
+	// the anchored GPU is full, the pod isn't placed elsewhere
+	overflow := newPod("default", "overflow", "ipc")
+	res, uuid = schedule(overflow)
+	assert.Equal(t, uuid, "")
+	assert.Assert(t, res.NodeNames == nil)
+	for nodeID, reason := range res.FailedNodes {
+		if nodeID == anchor.NodeID {
+			assert.Equal(t, reason, string(ReasonDevicesFull))
+		} else {
+			assert.Equal(t, reason, string(ReasonColocateGroup))
+		}
+	}
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	assert.Assert(t, strings.Contains(strings.Join(events, "\n"), "ColocateGroupFull"), events)
+
+	// the anchor goes away with the last pod of the group
+	s.delPod(producer)
+	_, ok = s.anchorOf("default/ipc")
+	assert.Assert(t, ok)
+	s.delPod(consumer)
+	_, ok = s.anchorOf("default/ipc")
+	assert.Assert(t, !ok)
+	_, uuid = schedule(overflow)
+	assert.Assert(t, uuid != "")
+	anchor, ok = s.anchorOf("default/ipc")
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, anchor.Devices, []string{uuid})
+}
+
+func TestFilterColocatesMultiGPUMembers(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+
+	s := NewScheduler()
+	s.eventRecorder = record.NewFakeRecorder(4)
+	var devices []DeviceInfo
+	for i := 0; i < 4; i++ {
+		devices = append(devices, DeviceInfo{ID: fmt.Sprintf("GPU-%d", i), Count: 4, Devmem: 16000, Type: "NVIDIA-A100", Health: true})
+	}
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: devices})
+	schedule := func(name string, gpus int) []string {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name), Annotations: map[string]string{
+				util.ColocateGroupAnnotation: "ipc",
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): *resource.NewQuantity(int64(gpus), resource.DecimalSI),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse("1000"),
+				},
+			}}}},
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		_, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+		assert.NilError(t, err)
+		var res []string
+		if pi, ok := s.pods[pod.UID]; ok {
+			for _, d := range pi.Devices[0] {
+				res = append(res, d.UUID)
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	anchored := schedule("trainer", 2)
+	assert.Equal(t, len(anchored), 2)
+	anchor, ok := s.anchorOf("default/ipc")
+	assert.Assert(t, ok)
+	sort.Strings(anchor.Devices)
+	assert.DeepEqual(t, anchor.Devices, anchored)
+
+	// a member asking for as many GPUs gets the anchored ones, one asking for fewer some of them
+	assert.DeepEqual(t, schedule("evaluator", 2), anchored)
+	uuids := schedule("logger", 1)
+	assert.Equal(t, len(uuids), 1)
+	assert.Assert(t, uuids[0] == anchored[0] || uuids[0] == anchored[1])
+	// more than the anchor has doesn't fit
+	assert.Equal(t, len(schedule("sweeper", 3)), 0)
+}
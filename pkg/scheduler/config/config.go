@@ -16,9 +16,95 @@
 
 package config
 
+import "time"
+
 var (
 	HttpBind      string
 	SchedulerName string
 	DefaultMem    int32
 	DefaultCores  int32
+
+	// BindTimeout bounds all API server calls made while handling one bind
+	// request, it is further shortened by the deadline of the request itself.
+	BindTimeout time.Duration
+	// BindWorkers is the number of bind requests handled concurrently.
+	BindWorkers int
+	// NodeStatusInterval is how often changed VGPUNodeStatus objects are written, 0 disables them.
+	NodeStatusInterval time.Duration
+	// SliceRequests charges containers that ask for vGPUs without memory one slice,
+	// the device memory divided by the split count, of each device instead of DefaultMem.
+	SliceRequests bool
+	// FairSharing holds back pods of a namespace while a namespace using less GPU memory
+	// has a pending pod that fits, for at most FairSharingStarvationTimeout.
+	FairSharing                  bool
+	FairSharingStarvationTimeout time.Duration
+	// MaxMemoryScaling caps the memory a device may advertise to this multiple of its
+	// physical memory, 0 leaves the scaling chosen on each node alone.
+	MaxMemoryScaling float64
+	// PriorityMemoryScaling caps the memory of a device pods of a priority class are
+	// assigned, with that of the pods already there, to this multiple of its physical
+	// memory, by the name of the class. Pods of other classes may use all the memory
+	// the device advertises.
+	PriorityMemoryScaling map[string]float64
+	// GuaranteedPriorityClasses and BestEffortPriorityClasses are the priority classes of
+	// the memory tiers: pods of a guaranteed class are placed where the physical memory
+	// covers them, as with a PriorityMemoryScaling of 1, pods of a best-effort class may
+	// use all the memory a device advertises.
+	GuaranteedPriorityClasses []string
+	BestEffortPriorityClasses []string
+	// AllocationTimeout is how long after binding a pod the scheduler waits for the device
+	// plugin's report of its allocation before checking the pod's status, 0 disables it.
+	AllocationTimeout time.Duration
+	// PlacementHistorySize is how many placement keys the scheduler remembers the devices
+	// of on each node, 0 disables placement keys.
+	PlacementHistorySize int
+	// NamespaceQuotaConfigMap is the namespace/name of the ConfigMap with the GPU memory
+	// quota of namespaces on each node, empty disables quotas.
+	NamespaceQuotaConfigMap string
+	// GPUNodeAffinity has the webhook require util.GPUNodeLabel in the node affinity of
+	// pods asking for vGPUs, so kube-scheduler only sends GPU nodes to the extender.
+	GPUNodeAffinity bool
+	// UnmanagedGPUEnv is what the webhook does with containers setting NVIDIA_VISIBLE_DEVICES
+	// or NVIDIA_DRIVER_CAPABILITIES without asking for vGPUs: reject, strip or allow.
+	UnmanagedGPUEnv string
+	// ScoreWeightSpread, ScoreWeightDevices, ScoreWeightPlacement, ScoreWeightModel and
+	// ScoreWeightTopology weigh the factors of the score of a node, see scoreFactors in
+	// package scheduler.
+	ScoreWeightSpread    = 1.0
+	ScoreWeightDevices   = 1.0
+	ScoreWeightPlacement = 1.0
+	ScoreWeightModel     = 0.0
+	ScoreWeightTopology  = 1.0
+	// AllowZeroMemory grants containers asking for no device memory ZeroMemoryFloor MiB
+	// on each of their GPUs, instead of rejecting their pods.
+	AllowZeroMemory bool
+	ZeroMemoryFloor int32 = 256
+	// DRADriverName is the driver of the ResourceClasses whose ResourceClaims the scheduler
+	// allocates vGPUs to, empty disables dynamic resource allocation. It is ignored unless
+	// AlphaDRAClaims is set: there is no kubelet plugin handing the devices of a claim to
+	// containers, so allocated claims only hold capacity no container can use.
+	DRADriverName  string
+	AlphaDRAClaims bool
+	// EfficiencyWindow is how long the usage the device plugins report of containers is
+	// kept for the efficiency report, which recommends requests of the peak usage times
+	// RightSizingSafetyFactor. The report is logged every EfficiencyReportInterval, 0
+	// only serves it.
+	EfficiencyWindow         = 24 * time.Hour
+	RightSizingSafetyFactor  = 1.2
+	EfficiencyReportInterval = time.Hour
+	// SelectionSeed seeds the PRNG drawing the order of the nodes with the best score, 0
+	// picks the first of them by name.
+	SelectionSeed int64
+	// RequestProfileFile is the JSON file of the request profiles pods name with the
+	// vgpu-profile annotation, read again when it changes, empty disables them.
+	RequestProfileFile string
+	// SchedulePolicyFile is the JSON file of the time windows during which pods are
+	// preferred on or get to themselves some GPUs, read again when it changes, empty
+	// disables them.
+	SchedulePolicyFile string
+	// DebugPageLimit is the number of items the list endpoints of the metrics component
+	// serve unless a request sets its own limit, 0 serves all. DebugResponseLimit ends a
+	// page early once its items take that many bytes.
+	DebugPageLimit     = 500
+	DebugResponseLimit = 4 << 20
 )
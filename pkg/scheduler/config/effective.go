@@ -0,0 +1,116 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import "4pd.io/k8s-vgpu/pkg/util"
+
+// EffectiveConfig is the configuration the scheduler runs with, after the command
+// line flags were applied.
+type EffectiveConfig struct {
+	ResourcePrefix               string             `json:"resourcePrefix"`
+	ResourceName                 string             `json:"resourceName"`
+	ResourceMem                  string             `json:"resourceMem"`
+	ResourceMemPercentage        string             `json:"resourceMemPercentage"`
+	ResourceCores                string             `json:"resourceCores"`
+	ResourcePriority             string             `json:"resourcePriority"`
+	HttpBind                     string             `json:"httpBind"`
+	SchedulerName                string             `json:"schedulerName"`
+	DefaultMem                   int32              `json:"defaultMem"`
+	DefaultCores                 int32              `json:"defaultCores"`
+	SliceRequests                bool               `json:"sliceRequests"`
+	MaxMemoryScaling             float64            `json:"maxMemoryScaling"`
+	PriorityMemoryScaling        map[string]float64 `json:"priorityMemoryScaling"`
+	GuaranteedPriorityClasses    []string           `json:"guaranteedPriorityClasses"`
+	BestEffortPriorityClasses    []string           `json:"bestEffortPriorityClasses"`
+	FairSharing                  bool               `json:"fairSharing"`
+	FairSharingStarvationTimeout string             `json:"fairSharingStarvationTimeout"`
+	BindTimeout                  string             `json:"bindTimeout"`
+	BindWorkers                  int                `json:"bindWorkers"`
+	NodeStatusInterval           string             `json:"nodeStatusInterval"`
+	AllocationTimeout            string             `json:"allocationTimeout"`
+	PlacementHistorySize         int                `json:"placementHistorySize"`
+	NamespaceQuotaConfigMap      string             `json:"namespaceQuotaConfigMap"`
+	GPUNodeAffinity              bool               `json:"gpuNodeAffinity"`
+	UnmanagedGPUEnv              string             `json:"unmanagedGPUEnv"`
+	ScoreWeightSpread            float64            `json:"scoreWeightSpread"`
+	ScoreWeightDevices           float64            `json:"scoreWeightDevices"`
+	ScoreWeightPlacement         float64            `json:"scoreWeightPlacement"`
+	ScoreWeightModel             float64            `json:"scoreWeightModel"`
+	ScoreWeightTopology          float64            `json:"scoreWeightTopology"`
+	RedactTenantInfo             bool               `json:"redactTenantInfo"`
+	AllowZeroMemory              bool               `json:"allowZeroMemory"`
+	ZeroMemoryFloor              int32              `json:"zeroMemoryFloor"`
+	DRADriverName                string             `json:"draDriverName"`
+	AlphaDRAClaims               bool               `json:"alphaDRAClaims"`
+	EfficiencyWindow             string             `json:"efficiencyWindow"`
+	RightSizingSafetyFactor      float64            `json:"rightSizingSafetyFactor"`
+	EfficiencyReportInterval     string             `json:"efficiencyReportInterval"`
+	SelectionSeed                int64              `json:"selectionSeed"`
+	RequestProfileFile           string             `json:"requestProfileFile"`
+	SchedulePolicyFile           string             `json:"schedulePolicyFile"`
+	DebugPageLimit               int                `json:"debugPageLimit"`
+	DebugResponseLimit           int                `json:"debugResponseLimit"`
+}
+
+// Effective collects the configuration in effect.
+func Effective() *EffectiveConfig {
+	return &EffectiveConfig{
+		ResourcePrefix:               util.ResourcePrefix,
+		ResourceName:                 util.ResourceName,
+		ResourceMem:                  util.ResourceMem,
+		ResourceMemPercentage:        util.ResourceMemPercentage,
+		ResourceCores:                util.ResourceCores,
+		ResourcePriority:             util.ResourcePriority,
+		HttpBind:                     HttpBind,
+		SchedulerName:                SchedulerName,
+		DefaultMem:                   DefaultMem,
+		DefaultCores:                 DefaultCores,
+		SliceRequests:                SliceRequests,
+		MaxMemoryScaling:             MaxMemoryScaling,
+		PriorityMemoryScaling:        PriorityMemoryScaling,
+		GuaranteedPriorityClasses:    GuaranteedPriorityClasses,
+		BestEffortPriorityClasses:    BestEffortPriorityClasses,
+		FairSharing:                  FairSharing,
+		FairSharingStarvationTimeout: FairSharingStarvationTimeout.String(),
+		BindTimeout:                  BindTimeout.String(),
+		BindWorkers:                  BindWorkers,
+		NodeStatusInterval:           NodeStatusInterval.String(),
+		AllocationTimeout:            AllocationTimeout.String(),
+		PlacementHistorySize:         PlacementHistorySize,
+		NamespaceQuotaConfigMap:      NamespaceQuotaConfigMap,
+		GPUNodeAffinity:              GPUNodeAffinity,
+		UnmanagedGPUEnv:              UnmanagedGPUEnv,
+		ScoreWeightSpread:            ScoreWeightSpread,
+		ScoreWeightDevices:           ScoreWeightDevices,
+		ScoreWeightPlacement:         ScoreWeightPlacement,
+		ScoreWeightModel:             ScoreWeightModel,
+		ScoreWeightTopology:          ScoreWeightTopology,
+		RedactTenantInfo:             util.RedactTenantInfo,
+		AllowZeroMemory:              AllowZeroMemory,
+		ZeroMemoryFloor:              ZeroMemoryFloor,
+		DRADriverName:                DRADriverName,
+		AlphaDRAClaims:               AlphaDRAClaims,
+		EfficiencyWindow:             EfficiencyWindow.String(),
+		RightSizingSafetyFactor:      RightSizingSafetyFactor,
+		EfficiencyReportInterval:     EfficiencyReportInterval.String(),
+		SelectionSeed:                SelectionSeed,
+		RequestProfileFile:           RequestProfileFile,
+		SchedulePolicyFile:           SchedulePolicyFile,
+		DebugPageLimit:               DebugPageLimit,
+		DebugResponseLimit:           DebugResponseLimit,
+	}
+}
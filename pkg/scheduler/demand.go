@@ -0,0 +1,295 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+// PendingDemandPath is served by the metrics component with the PendingDemand.
+const PendingDemandPath = "/pending-demand"
+
+// unschedulablePod is a vGPU pod whose last Filter rejected all nodes.
+type unschedulablePod struct {
+	signature DemandSignature
+	memory    int64
+	cores     int64
+	gpus      int
+	// since is when Filter first rejected all nodes for the pod, lastSeen the last time
+	since    time.Time
+	lastSeen time.Time
+}
+
+// pendingDemand remembers the unschedulable vGPU pods, for autoscalers to pick the
+// nodes to add. Pods are forgotten once placed, deleted, bound by someone else, or after
+// pendingPodTTL without a Filter.
+type pendingDemand struct {
+	demandMutex   sync.Mutex
+	unschedulable map[k8stypes.UID]*unschedulablePod
+	demandNow     func() time.Time
+}
+
+func (d *pendingDemand) init() {
+	d.unschedulable = make(map[k8stypes.UID]*unschedulablePod)
+	d.demandNow = time.Now
+}
+
+// DemandSignature is what the pods of a PendingDemandGroup ask for alike, the
+// constraints a new node must meet.
+type DemandSignature struct {
+	// DeviceTypes are the device types requested, e.g. NVIDIA, separated by ","
+	DeviceTypes string `json:"deviceTypes"`
+	// GPUsPerPod is the number of GPUs all containers of a pod request together
+	GPUsPerPod int `json:"gpusPerPod"`
+	// UseGPUType and NoUseGPUType are the nvidia.com/use-gputype and nouse-gputype annotations
+	UseGPUType   string `json:"useGPUType,omitempty"`
+	NoUseGPUType string `json:"noUseGPUType,omitempty"`
+	// Profiles are the device plugin profiles requested, separated by ","
+	Profiles string `json:"profiles,omitempty"`
+	// MemoryPercent is the share of the memory of each GPU requested instead of MiB
+	MemoryPercent int32 `json:"memoryPercent,omitempty"`
+	// Slice is set when the pods get a slice of each GPU rather than an amount of memory
+	Slice bool `json:"slice,omitempty"`
+	// DistinctGPUs is set when each GPU must be a physical GPU of its own
+	DistinctGPUs bool `json:"distinctGPUs,omitempty"`
+	// RequestProfile is the request profile the pods name, e.g. small
+	RequestProfile string `json:"requestProfile,omitempty"`
+}
+
+// PendingDemandGroup sums up the unschedulable pods of one signature. Memory is in MiB
+// and cores in percent of a GPU, summed over the GPUs of a pod.
+type PendingDemandGroup struct {
+	Signature   DemandSignature `json:"signature"`
+	Pods        int             `json:"pods"`
+	GPUs        int             `json:"gpus"`
+	MemoryMB    int64           `json:"memoryMB"`
+	MaxMemoryMB int64           `json:"maxPodMemoryMB"`
+	Cores       int64           `json:"cores"`
+	MaxCores    int64           `json:"maxPodCores"`
+	// OldestSince is when the pod pending longest was first found unschedulable
+	OldestSince          time.Time `json:"oldestSince"`
+	OldestPendingSeconds int64     `json:"oldestPendingSeconds"`
+}
+
+// PendingDemand is the vGPU demand Filter couldn't place on any node.
+type PendingDemand struct {
+	Pods     int                  `json:"pods"`
+	GPUs     int                  `json:"gpus"`
+	MemoryMB int64                `json:"memoryMB"`
+	Groups   []PendingDemandGroup `json:"groups"`
+}
+
+// PendingDemandPage is what a request to PendingDemandPath gets, the sums only when it
+// selects DemandFieldSummary.
+type PendingDemandPage struct {
+	Pods     int                  `json:"pods" openapi:"optional"`
+	GPUs     int                  `json:"gpus" openapi:"optional"`
+	MemoryMB int64                `json:"memoryMB" openapi:"optional"`
+	Groups   []PendingDemandGroup `json:"groups"`
+	// Continue is the token of the next page, empty on the last
+	Continue string `json:"continue,omitempty"`
+}
+
+// demandOf sums up what pod requests with reqs.
+func demandOf(pod *corev1.Pod, reqs [][]util.ContainerDeviceRequest) unschedulablePod {
+	var p unschedulablePod
+	types := make(map[string]bool)
+	profiles := make(map[string]bool)
+	for _, n := range reqs {
+		for _, k := range n {
+			if k.Nums == 0 {
+				continue
+			}
+			types[k.Type] = true
+			if k.Profile != "" {
+				profiles[k.Profile] = true
+			}
+			p.gpus += int(k.Nums)
+			p.memory += int64(k.Memreq) * int64(k.Nums)
+			p.cores += int64(k.Coresreq) * int64(k.Nums)
+			if k.MemPercentagereq != 101 && k.Memreq == 0 {
+				p.signature.MemoryPercent = k.MemPercentagereq
+			}
+			p.signature.Slice = p.signature.Slice || k.Slice
+		}
+	}
+	p.signature.DeviceTypes = joinKeys(types)
+	p.signature.Profiles = joinKeys(profiles)
+	p.signature.GPUsPerPod = p.gpus
+	p.signature.UseGPUType = pod.Annotations[util.GPUInUse]
+	p.signature.NoUseGPUType = pod.Annotations[util.GPUNoUse]
+	p.signature.DistinctGPUs = pod.Annotations[util.DistinctGPUsAnnotation] == "true"
+	p.signature.RequestProfile = pod.Annotations[util.VGPUProfileAnnotation]
+	return p
+}
+
+func joinKeys(m map[string]bool) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// podUnschedulable records that Filter rejected all nodes for pod.
+func (d *pendingDemand) podUnschedulable(pod *corev1.Pod, reqs [][]util.ContainerDeviceRequest) {
+	d.demandMutex.Lock()
+	defer d.demandMutex.Unlock()
+	now := d.demandNow()
+	p := demandOf(pod, reqs)
+	p.since, p.lastSeen = now, now
+	if former, ok := d.unschedulable[pod.UID]; ok && now.Sub(former.lastSeen) <= pendingPodTTL {
+		p.since = former.since
+	}
+	d.unschedulable[pod.UID] = &p
+}
+
+// podScheduled forgets the pod, it was placed, deleted or bound by someone else.
+func (d *pendingDemand) podScheduled(uid k8stypes.UID) {
+	d.demandMutex.Lock()
+	defer d.demandMutex.Unlock()
+	delete(d.unschedulable, uid)
+}
+
+// PendingDemand sums up the unschedulable pods by signature, the groups with the most
+// GPUs first.
+func (d *pendingDemand) PendingDemand() PendingDemand {
+	d.demandMutex.Lock()
+	defer d.demandMutex.Unlock()
+	now := d.demandNow()
+	res := PendingDemand{Groups: []PendingDemandGroup{}}
+	groups := make(map[DemandSignature]*PendingDemandGroup)
+	for uid, p := range d.unschedulable {
+		if now.Sub(p.lastSeen) > pendingPodTTL {
+			delete(d.unschedulable, uid)
+			continue
+		}
+		g, ok := groups[p.signature]
+		if !ok {
+			g = &PendingDemandGroup{Signature: p.signature, OldestSince: p.since}
+			groups[p.signature] = g
+		}
+		g.Pods++
+		g.GPUs += p.gpus
+		g.MemoryMB += p.memory
+		g.Cores += p.cores
+		if p.memory > g.MaxMemoryMB {
+			g.MaxMemoryMB = p.memory
+		}
+		if p.cores > g.MaxCores {
+			g.MaxCores = p.cores
+		}
+		if p.since.Before(g.OldestSince) {
+			g.OldestSince = p.since
+		}
+		res.Pods++
+		res.GPUs += p.gpus
+		res.MemoryMB += p.memory
+	}
+	for _, g := range groups {
+		g.OldestSince = g.OldestSince.UTC()
+		g.OldestPendingSeconds = int64(now.Sub(g.OldestSince).Seconds())
+		res.Groups = append(res.Groups, *g)
+	}
+	sort.Slice(res.Groups, func(i, j int) bool { return demandGroupKey(res.Groups[i]) < demandGroupKey(res.Groups[j]) })
+	return res
+}
+
+// demandGroupKey orders the groups with the most GPUs first, then by signature.
+func demandGroupKey(g PendingDemandGroup) string {
+	sig, _ := json.Marshal(g.Signature)
+	return fmt.Sprintf("%020d", math.MaxInt64-int64(g.GPUs)) + string(sig)
+}
+
+// Fields of the PendingDemand a request to PendingDemandPath can select.
+const (
+	DemandFieldSummary = "summary"
+	DemandFieldGroups  = "groups"
+)
+
+// PendingDemandHandler serves the PendingDemand of s as JSON, its groups a page at a time.
+func PendingDemandHandler(s *Scheduler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := util.ParsePageRequest(r, config.DebugPageLimit, config.DebugResponseLimit, DemandFieldSummary, DemandFieldGroups)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		demand := s.PendingDemand()
+		var head []util.JSONField
+		if p.Selected(DemandFieldSummary) {
+			head = []util.JSONField{{Name: "pods", Value: demand.Pods}, {Name: "gpus", Value: demand.GPUs}, {Name: "memoryMB", Value: demand.MemoryMB}}
+		}
+		var keys []string
+		if p.Selected(DemandFieldGroups) {
+			for _, g := range demand.Groups {
+				keys = append(keys, demandGroupKey(g))
+			}
+		}
+		util.WriteJSONPage(w, r, p, head, "groups", keys, func(i int) interface{} { return demand.Groups[i] })
+	})
+}
+
+var (
+	pendingPodsDesc = prometheus.NewDesc("vgpu_pending_pods",
+		"Number of vGPU pods the scheduler found no node for, by device type",
+		[]string{"device_type"}, nil)
+	pendingMemoryDesc = prometheus.NewDesc("vgpu_pending_memory_mb",
+		"GPU memory in MiB requested by vGPU pods the scheduler found no node for, by device type",
+		[]string{"device_type"}, nil)
+)
+
+type pendingDemandCollector struct {
+	s *Scheduler
+}
+
+// PendingDemandCollector exports the PendingDemand of s summed by device type.
+func PendingDemandCollector(s *Scheduler) prometheus.Collector {
+	return pendingDemandCollector{s}
+}
+
+func (c pendingDemandCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingPodsDesc
+	ch <- pendingMemoryDesc
+}
+
+func (c pendingDemandCollector) Collect(ch chan<- prometheus.Metric) {
+	pods := make(map[string]int)
+	memory := make(map[string]int64)
+	for _, g := range c.s.PendingDemand().Groups {
+		pods[g.Signature.DeviceTypes] += g.Pods
+		memory[g.Signature.DeviceTypes] += g.MemoryMB
+	}
+	for t, n := range pods {
+		ch <- prometheus.MustNewConstMetric(pendingPodsDesc, prometheus.GaugeValue, float64(n), t)
+		ch <- prometheus.MustNewConstMetric(pendingMemoryDesc, prometheus.GaugeValue, float64(memory[t]), t)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/golden"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func demandPod(name string, annos map[string]string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name), Annotations: annos}}
+}
+
+// TestPendingDemandShape compares the /pending-demand response for a synthetic set of
+// unschedulable pods with the one recorded in testdata, run with -update to record it
+// again. Autoscalers consume it, so changes must stay compatible.
+func TestPendingDemandShape(t *testing.T) {
+	s := NewScheduler()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.demandNow = func() time.Time { return now }
+
+	s.podUnschedulable(demandPod("train-0", map[string]string{util.GPUInUse: "A100", util.DistinctGPUsAnnotation: "true"}),
+		[][]util.ContainerDeviceRequest{{{Nums: 2, Type: util.NvidiaGPUDevice, Memreq: 40000, MemPercentagereq: 101, Coresreq: 100}}})
+	now = now.Add(time.Minute)
+	s.podUnschedulable(demandPod("train-1", map[string]string{util.GPUInUse: "A100", util.DistinctGPUsAnnotation: "true"}),
+		[][]util.ContainerDeviceRequest{{{Nums: 2, Type: util.NvidiaGPUDevice, Memreq: 30000, MemPercentagereq: 101, Coresreq: 100}}})
+	s.podUnschedulable(demandPod("infer", nil), [][]util.ContainerDeviceRequest{
+		{{Nums: 1, Type: util.NvidiaGPUDevice, Memreq: 8000, MemPercentagereq: 101, Coresreq: 30}},
+		{},
+	})
+	s.podUnschedulable(demandPod("notebook", map[string]string{util.GPUNoUse: "T4"}),
+		[][]util.ContainerDeviceRequest{{{Nums: 1, Type: util.NvidiaGPUDevice, MemPercentagereq: 50, Profile: "training"}}})
+	now = now.Add(30 * time.Second)
+	// filtered again, still pending since the first time
+	s.podUnschedulable(demandPod("train-0", map[string]string{util.GPUInUse: "A100", util.DistinctGPUsAnnotation: "true"}),
+		[][]util.ContainerDeviceRequest{{{Nums: 2, Type: util.NvidiaGPUDevice, Memreq: 40000, MemPercentagereq: 101, Coresreq: 100}}})
+
+	rec := httptest.NewRecorder()
+	PendingDemandHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", PendingDemandPath, nil))
+	assert.Equal(t, rec.Header().Get("Content-Type"), "application/json")
+	golden.Assert(t, rec.Body.String(), "pending-demand.json")
+
+	assert.NilError(t, testutil.CollectAndCompare(PendingDemandCollector(s), strings.NewReader(`
+# HELP vgpu_pending_memory_mb GPU memory in MiB requested by vGPU pods the scheduler found no node for, by device type
+# TYPE vgpu_pending_memory_mb gauge
+vgpu_pending_memory_mb{device_type="NVIDIA"} 148000
+# HELP vgpu_pending_pods Number of vGPU pods the scheduler found no node for, by device type
+# TYPE vgpu_pending_pods gauge
+vgpu_pending_pods{device_type="NVIDIA"} 4
+`)))
+
+	// pods not filtered for a while are forgotten
+	now = now.Add(pendingPodTTL + time.Second)
+	s.podUnschedulable(demandPod("infer", nil), [][]util.ContainerDeviceRequest{{{Nums: 1, Type: util.NvidiaGPUDevice, Memreq: 8000, MemPercentagereq: 101}}})
+	d := s.PendingDemand()
+	assert.Equal(t, d.Pods, 1)
+	assert.Equal(t, d.Groups[0].OldestPendingSeconds, int64(0))
+}
+
+func TestFilterTracksPendingDemand(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	t.Cleanup(func() { util.ResourceName, util.ResourceMem = oldName, oldMem })
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	pod := demandPod("big", map[string]string{})
+	pod.Spec.Containers = []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+			corev1.ResourceName(util.ResourceMem):  resource.MustParse("20000"),
+		},
+	}}}
+	res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(res.FailedNodes), 1)
+	d := s.PendingDemand()
+	assert.Equal(t, d.Pods, 1)
+	assert.Equal(t, d.MemoryMB, int64(20000))
+
+	// bound by another scheduler
+	bound := pod.DeepCopy()
+	bound.Spec.NodeName = "node2"
+	s.onAddPod(bound)
+	assert.Equal(t, s.PendingDemand().Pods, 0)
+
+	_, err = s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+	assert.NilError(t, err)
+	s.onDelPod(pod)
+	assert.Equal(t, s.PendingDemand().Pods, 0)
+}
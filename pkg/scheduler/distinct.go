@@ -0,0 +1,164 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"sort"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// distinctUnit is one GPU a container of a pod with distinct GPUs requests.
+type distinctUnit struct {
+	container int
+	req       util.ContainerDeviceRequest
+	// memreq and cores are what the unit takes on each device, fits whether it fits at all
+	memreq []int32
+	cores  []int32
+	fits   []bool
+}
+
+// fitDistinct places the GPUs all containers request on different devices of node, or
+// returns the reason it can't. Placing the units one by one can give a small request the
+// only device a large one fits, so they are matched to the devices as a whole.
+func fitDistinct(nodeID string, node *NodeUsage, nums [][]util.ContainerDeviceRequest, annos map[string]string) (util.PodDevices, scoreFactors, FilterReason) {
+	sort.Sort(node.Devices)
+	order := candidateOrder(node.Devices)
+	var units []*distinctUnit
+	for c, n := range nums {
+		for _, k := range n {
+			for j := int32(0); j < k.Nums; j++ {
+				u := &distinctUnit{
+					container: c,
+					req:       k,
+					memreq:    make([]int32, len(node.Devices)),
+					cores:     make([]int32, len(node.Devices)),
+					fits:      make([]bool, len(node.Devices)),
+				}
+				for i, d := range node.Devices {
+					if d.Profile != k.Profile {
+						continue
+					}
+					dk := k.ForType(d.Type)
+					memreq, skip := deviceFits(d, dk, annos)
+					u.memreq[i], u.cores[i], u.fits[i] = memreq, dk.Coresreq, skip == ""
+				}
+				units = append(units, u)
+			}
+		}
+	}
+	// match[i] is the unit placed on device i, -1 while it is free
+	match := make([]int, len(node.Devices))
+	for i := range match {
+		match[i] = -1
+	}
+	var place func(u int, visited []bool) bool
+	place = func(u int, visited []bool) bool {
+		for _, i := range order {
+			if !units[u].fits[i] || visited[i] {
+				continue
+			}
+			visited[i] = true
+			if match[i] < 0 || place(match[i], visited) {
+				match[i] = u
+				return true
+			}
+		}
+		return false
+	}
+	for u := range units {
+		if !place(u, make([]bool, len(node.Devices))) {
+			return nil, scoreFactors{}, distinctReason(nodeID, node.Devices, units[u], annos)
+		}
+	}
+
+	dn := len(node.Devices)
+	res := make(util.PodDevices, len(nums))
+	total := make([]int32, len(nums))
+	free := make([]int32, len(nums))
+	preferred := make([]int, len(nums))
+	model := make([]int, len(nums))
+	boost := make([]float32, len(nums))
+	for c := range nums {
+		res[c] = util.ContainerDevices{}
+	}
+	for _, i := range order {
+		if match[i] < 0 {
+			continue
+		}
+		u, d := units[match[i]], node.Devices[i]
+		klog.V(4).Infoln("device", d.Id, "fitted distinct")
+		c := u.container
+		total[c] += d.Shares()
+		free[c] += d.Shares() - d.Used
+		if d.Preferred {
+			preferred[c]++
+		}
+		boost[c] += d.Boost
+		if preferredModel(annos, d.Type) {
+			model[c]++
+		}
+		d.Used++
+		d.Usedmem += u.memreq[i]
+		d.Usedcores += u.cores[i]
+		d.Usedmembw += u.req.MemBandwidthreq
+		res[c] = append(res[c], util.ContainerDevice{
+			UUID:      d.Id,
+			Type:      u.req.Type,
+			Usedmem:   u.memreq[i],
+			Usedcores: u.cores[i],
+		})
+	}
+	var factors scoreFactors
+	for c := range nums {
+		if len(res[c]) == 0 {
+			continue
+		}
+		factors = factors.add(containerFactors(dn, res[c], total[c], free[c], preferred[c], model[c], boost[c]))
+	}
+	return res, factors, ""
+}
+
+// distinctReason explains why unit u got no device of its own. When some device fits it
+// but was taken by another unit of the pod, there are just not enough distinct GPUs.
+func distinctReason(nodeID string, devices DeviceUsageList, u *distinctUnit, annos map[string]string) FilterReason {
+	for _, ok := range u.fits {
+		if ok {
+			return ReasonNotDistinct
+		}
+	}
+	skipped := make(map[FilterReason]int)
+	candidates := 0
+	for _, d := range devices {
+		if d.Profile != u.req.Profile {
+			continue
+		}
+		candidates++
+		if _, skip := deviceFits(d, u.req.ForType(d.Type), annos); skip != "" {
+			skipped[skip]++
+		}
+	}
+	if candidates == 0 {
+		return ReasonProfileMismatch
+	}
+	reason := dominantReason(skipped)
+	if reason == ReasonInsufficientMemory && fragmented(nodeID, devices, u.req, annos) {
+		reason = ReasonFragmented
+	}
+	return reason
+}
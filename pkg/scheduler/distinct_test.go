@@ -0,0 +1,105 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+)
+
+func containerRequests(mems ...int32) [][]util.ContainerDeviceRequest {
+	var res [][]util.ContainerDeviceRequest
+	for _, mem := range mems {
+		res = append(res, gpuRequest(1, mem, 0)...)
+	}
+	return res
+}
+
+var distinctAnnos = map[string]string{util.DistinctGPUsAnnotation: "true"}
+
+func TestCalcScoreDistinctLeavesLargeDeviceToLargeRequest(t *testing.T) {
+	newNodes := func() map[string]*NodeUsage {
+		return map[string]*NodeUsage{
+			"node1": {Devices: DeviceUsageList{
+				{Id: "GPU-a", Count: 10, Totalmem: 16000, Type: "NVIDIA-A100"},
+				{Id: "GPU-b", Count: 10, Used: 1, Totalmem: 4000, Type: "NVIDIA-A100"},
+			}},
+		}
+	}
+	nodes := newNodes()
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, containerRequests(2000, 12000), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-a")
+	assert.Equal(t, (*res)[0].devices[1][0].UUID, "GPU-a")
+
+	nodes = newNodes()
+	res, err = calcScore(&nodes, &failed, containerRequests(2000, 12000), distinctAnnos)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-b")
+	assert.Equal(t, (*res)[0].devices[1][0].UUID, "GPU-a")
+	assert.Equal(t, nodes["node1"].Devices[0].Usedmem+nodes["node1"].Devices[1].Usedmem, int32(14000))
+}
+
+func TestCalcScoreDistinctRejectsTooFewDevices(t *testing.T) {
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Totalmem: 16000, Type: "NVIDIA-A100"},
+			{Id: "GPU-b", Count: 10, Totalmem: 16000, Type: "NVIDIA-A100"},
+		}},
+	}
+	req := containerRequests(1000, 1000)
+	req[1][0].Nums = 2
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, req, distinctAnnos)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonNotDistinct))
+	assert.Equal(t, nodes["node1"].Devices[0].Used+nodes["node1"].Devices[1].Used, int32(0))
+}
+
+func TestCalcScoreDistinctReportsFragmentation(t *testing.T) {
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Used: 1, Usedmem: 10000, Totalmem: 16000, Type: "NVIDIA-A100"},
+			{Id: "GPU-b", Count: 10, Used: 1, Usedmem: 10000, Totalmem: 16000, Type: "NVIDIA-A100"},
+		}},
+	}
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, containerRequests(4000, 8000), distinctAnnos)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonFragmented))
+}
+
+func TestCalcScoreDistinctSkipsEmptyContainers(t *testing.T) {
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Totalmem: 16000, Type: "NVIDIA-A100"},
+		}},
+	}
+	req := append(gpuRequest(0, 0, 0), gpuRequest(1, 1000, 0)...)
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, req, distinctAnnos)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, len((*res)[0].devices[0]), 0)
+	assert.Equal(t, (*res)[0].devices[1][0].UUID, "GPU-a")
+}
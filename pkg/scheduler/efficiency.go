@@ -0,0 +1,419 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// EfficiencyReportPath is served by the metrics component with the EfficiencyReport.
+const EfficiencyReportPath = "/reports/efficiency"
+
+// podTemplateHashLabel is set by the Deployment controller on its ReplicaSets and their
+// pods, the ReplicaSets are named <deployment>-<hash>.
+const podTemplateHashLabel = "pod-template-hash"
+
+type usageKey struct {
+	uid       k8stypes.UID
+	container string
+}
+
+type usagePoint struct {
+	at     time.Time
+	memory int64
+	cores  int64
+}
+
+// containerHistory is what a container requested and the usage the device plugin of its
+// node reported of it within config.EfficiencyWindow.
+type containerHistory struct {
+	namespace string
+	owner     WorkloadOwner
+	container string
+	// memory and cores are requested on all gpus of the container together
+	memory int64
+	cores  int64
+	gpus   int
+	points []usagePoint
+}
+
+// usageHistory keeps the usage of containers the device plugins report in their node
+// annotations, for the efficiency report. Containers are kept after their pods ended
+// until their usage fell out of the window, so finished Jobs are reported too.
+type usageHistory struct {
+	usageMutex sync.Mutex
+	containers map[usageKey]*containerHistory
+	usageNow   func() time.Time
+}
+
+func (h *usageHistory) init() {
+	h.containers = make(map[usageKey]*containerHistory)
+	h.usageNow = time.Now
+}
+
+// WorkloadOwner is the controller of a pod's workload, the Deployment of the pods of
+// its ReplicaSets, or the pod itself if it has no controller.
+type WorkloadOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// ownerOf returns the workload the pod belongs to. The Deployment of a ReplicaSet is
+// told by its name, which the Deployment controller derives from the pod template hash.
+func ownerOf(pod *corev1.Pod) WorkloadOwner {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return WorkloadOwner{Kind: "Pod", Name: pod.Name}
+	}
+	if hash := pod.Labels[podTemplateHashLabel]; ref.Kind == "ReplicaSet" && hash != "" && strings.HasSuffix(ref.Name, "-"+hash) {
+		return WorkloadOwner{Kind: "Deployment", Name: strings.TrimSuffix(ref.Name, "-"+hash)}
+	}
+	return WorkloadOwner{Kind: ref.Kind, Name: ref.Name}
+}
+
+// observeUsage records the usage of containers reported in the annotation of a node.
+// Containers of pods the scheduler didn't assign devices are skipped.
+func (s *Scheduler) observeUsage(node, value string) {
+	usage, err := annotations.DecodeContainerUsage(value)
+	if err != nil {
+		klog.Errorf("node %v annotation %v: %v", node, util.ContainerUsageAnnotation, err)
+		return
+	}
+	s.usageMutex.Lock()
+	defer s.usageMutex.Unlock()
+	now := s.usageNow()
+	for _, u := range usage {
+		key := usageKey{uid: k8stypes.UID(u.PodUID), container: u.Container}
+		h, ok := s.containers[key]
+		if !ok {
+			if h = s.containerHistory(key); h == nil {
+				continue
+			}
+			s.containers[key] = h
+		}
+		h.points = append(h.points, usagePoint{at: now, memory: int64(u.PeakMemory), cores: int64(u.Cores)})
+	}
+}
+
+// containerHistory looks up what the container of key requested, nil if the scheduler
+// doesn't know its pod.
+func (s *Scheduler) containerHistory(key usageKey) *containerHistory {
+	s.podManager.mutex.Lock()
+	pi, ok := s.pods[key.uid]
+	var namespace, name string
+	var devices util.PodDevices
+	if ok && !pi.Claim {
+		namespace, name, devices = pi.Namespace, pi.Name, pi.Devices
+	}
+	s.podManager.mutex.Unlock()
+	if name == "" || s.podLister == nil {
+		return nil
+	}
+	pod, err := s.podLister.Pods(namespace).Get(name)
+	if err != nil || pod.UID != key.uid {
+		return nil
+	}
+	h := &containerHistory{namespace: namespace, owner: ownerOf(pod), container: key.container}
+	for i, ctr := range pod.Spec.Containers {
+		if ctr.Name != key.container || i >= len(devices) {
+			continue
+		}
+		for _, d := range devices[i] {
+			h.memory += int64(d.Usedmem)
+			h.cores += int64(d.Usedcores)
+		}
+		h.gpus = len(devices[i])
+	}
+	return h
+}
+
+// ContainerEfficiency compares what the containers of a workload requested with what
+// they used at most within the window, memory in MiB and cores in percent of a GPU,
+// both on all GPUs of a container. The recommendations are per GPU, the peak times
+// the safety factor, and can be above the request of containers that used nearly all of it.
+type ContainerEfficiency struct {
+	Owner     WorkloadOwner `json:"owner"`
+	Container string        `json:"container"`
+	// Pods are the pods of the workload whose usage is in the window
+	Pods                int       `json:"pods"`
+	GPUs                int       `json:"gpus"`
+	RequestedMemoryMB   int64     `json:"requestedMemoryMB"`
+	PeakMemoryMB        int64     `json:"peakMemoryMB"`
+	RequestedCores      int64     `json:"requestedCores"`
+	PeakCores           int64     `json:"peakCores"`
+	RecommendedMemoryMB int64     `json:"recommendedMemoryMB"`
+	RecommendedCores    int64     `json:"recommendedCores"`
+	Since               time.Time `json:"since"`
+}
+
+// NamespaceEfficiency sums up the containers of a namespace, each with its own peak. The
+// sums are left out of a page of EfficiencyReportPath not selecting EfficiencyFieldSummary.
+type NamespaceEfficiency struct {
+	Namespace         string                `json:"namespace"`
+	Containers        int                   `json:"containers" openapi:"optional"`
+	RequestedMemoryMB int64                 `json:"requestedMemoryMB" openapi:"optional"`
+	PeakMemoryMB      int64                 `json:"peakMemoryMB" openapi:"optional"`
+	RequestedCores    int64                 `json:"requestedCores" openapi:"optional"`
+	PeakCores         int64                 `json:"peakCores" openapi:"optional"`
+	Workloads         []ContainerEfficiency `json:"workloads,omitempty"`
+}
+
+// EfficiencyReport compares the requests of the vGPU containers with their peak usage
+// within the window, by namespace and workload. It is data for right-sizing requests,
+// nothing is enforced.
+type EfficiencyReport struct {
+	Window       string                `json:"window"`
+	SafetyFactor float64               `json:"safetyFactor"`
+	Namespaces   []NamespaceEfficiency `json:"namespaces"`
+}
+
+// EfficiencyReportPage is what a request to EfficiencyReportPath gets.
+type EfficiencyReportPage struct {
+	Window       string                `json:"window"`
+	SafetyFactor float64               `json:"safetyFactor"`
+	Namespaces   []NamespaceEfficiency `json:"namespaces"`
+	// Continue is the token of the next page, empty on the last
+	Continue string `json:"continue,omitempty"`
+}
+
+type workloadKey struct {
+	namespace string
+	owner     WorkloadOwner
+	container string
+}
+
+// EfficiencyReport drops the usage older than config.EfficiencyWindow and reports the rest.
+func (h *usageHistory) EfficiencyReport() EfficiencyReport {
+	h.usageMutex.Lock()
+	defer h.usageMutex.Unlock()
+	since := h.usageNow().Add(-config.EfficiencyWindow)
+	res := EfficiencyReport{Window: config.EfficiencyWindow.String(), SafetyFactor: config.RightSizingSafetyFactor, Namespaces: []NamespaceEfficiency{}}
+	namespaces := make(map[string]*NamespaceEfficiency)
+	workloads := make(map[workloadKey]*ContainerEfficiency)
+	for key, c := range h.containers {
+		i := sort.Search(len(c.points), func(i int) bool { return !c.points[i].at.Before(since) })
+		if c.points = c.points[i:]; len(c.points) == 0 {
+			delete(h.containers, key)
+			continue
+		}
+		var memory, cores int64
+		for _, p := range c.points {
+			if p.memory > memory {
+				memory = p.memory
+			}
+			if p.cores > cores {
+				cores = p.cores
+			}
+		}
+		ns, ok := namespaces[c.namespace]
+		if !ok {
+			ns = &NamespaceEfficiency{Namespace: c.namespace}
+			namespaces[c.namespace] = ns
+		}
+		ns.Containers++
+		ns.RequestedMemoryMB += c.memory
+		ns.PeakMemoryMB += memory
+		ns.RequestedCores += c.cores
+		ns.PeakCores += cores
+
+		wk := workloadKey{namespace: c.namespace, owner: c.owner, container: c.container}
+		w, ok := workloads[wk]
+		if !ok {
+			w = &ContainerEfficiency{Owner: c.owner, Container: c.container, Since: c.points[0].at}
+			workloads[wk] = w
+		}
+		w.Pods++
+		if c.gpus > w.GPUs {
+			w.GPUs = c.gpus
+		}
+		if c.memory > w.RequestedMemoryMB {
+			w.RequestedMemoryMB = c.memory
+		}
+		if c.cores > w.RequestedCores {
+			w.RequestedCores = c.cores
+		}
+		if memory > w.PeakMemoryMB {
+			w.PeakMemoryMB = memory
+		}
+		if cores > w.PeakCores {
+			w.PeakCores = cores
+		}
+		if c.points[0].at.Before(w.Since) {
+			w.Since = c.points[0].at
+		}
+	}
+	for wk, w := range workloads {
+		w.RecommendedMemoryMB, w.RecommendedCores = recommend(w.PeakMemoryMB, w.PeakCores, w.GPUs)
+		w.Since = w.Since.UTC()
+		ns := namespaces[wk.namespace]
+		ns.Workloads = append(ns.Workloads, *w)
+	}
+	for _, ns := range namespaces {
+		sort.Slice(ns.Workloads, func(i, j int) bool {
+			a, b := ns.Workloads[i], ns.Workloads[j]
+			if a.Owner != b.Owner {
+				if a.Owner.Kind != b.Owner.Kind {
+					return a.Owner.Kind < b.Owner.Kind
+				}
+				return a.Owner.Name < b.Owner.Name
+			}
+			return a.Container < b.Container
+		})
+		res.Namespaces = append(res.Namespaces, *ns)
+	}
+	sort.Slice(res.Namespaces, func(i, j int) bool { return res.Namespaces[i].Namespace < res.Namespaces[j].Namespace })
+	return res
+}
+
+// recommend returns the memory and cores to request of each of gpus GPUs for the peak
+// usage of a container on all of them. Cores are capped at a whole GPU.
+func recommend(memory, cores int64, gpus int) (int64, int64) {
+	if gpus < 1 {
+		gpus = 1
+	}
+	perGPU := func(v int64) int64 {
+		return int64(math.Ceil(float64(v) * config.RightSizingSafetyFactor / float64(gpus)))
+	}
+	recCores := perGPU(cores)
+	if recCores > 100 {
+		recCores = 100
+	}
+	return perGPU(memory), recCores
+}
+
+// LogEfficiency logs the efficiency report of each namespace every interval until ctx is done.
+func (s *Scheduler) LogEfficiency(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report := s.EfficiencyReport()
+		for _, ns := range report.Namespaces {
+			klog.Infof("efficiency of namespace %v over %v: %d containers requested %dMiB of GPU memory and %d%% GPU cores, used at most %dMiB and %d%%",
+				util.Redact(ns.Namespace), report.Window, ns.Containers, ns.RequestedMemoryMB, ns.RequestedCores, ns.PeakMemoryMB, ns.PeakCores)
+		}
+	}
+}
+
+// Fields of the namespaces of the EfficiencyReport a request to EfficiencyReportPath can
+// select: the sums of a namespace, and its workloads.
+const (
+	EfficiencyFieldSummary   = "summary"
+	EfficiencyFieldWorkloads = "workloads"
+)
+
+// EfficiencyReportHandler serves the EfficiencyReport of s as JSON, its namespaces a page
+// at a time.
+func EfficiencyReportHandler(s *Scheduler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := util.ParsePageRequest(r, config.DebugPageLimit, config.DebugResponseLimit, EfficiencyFieldSummary, EfficiencyFieldWorkloads)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report := s.EfficiencyReport()
+		head := []util.JSONField{{Name: "window", Value: report.Window}, {Name: "safetyFactor", Value: report.SafetyFactor}}
+		keys := make([]string, 0, len(report.Namespaces))
+		for _, ns := range report.Namespaces {
+			keys = append(keys, ns.Namespace)
+		}
+		util.WriteJSONPage(w, r, p, head, "namespaces", keys, func(i int) interface{} {
+			ns := report.Namespaces[i]
+			if !p.Selected(EfficiencyFieldWorkloads) {
+				ns.Workloads = nil
+			}
+			if !p.Selected(EfficiencyFieldSummary) {
+				return struct {
+					Namespace string                `json:"namespace"`
+					Workloads []ContainerEfficiency `json:"workloads"`
+				}{ns.Namespace, ns.Workloads}
+			}
+			return ns
+		})
+	})
+}
+
+var (
+	workloadLabels              = []string{"namespace", "owner_kind", "owner", "container"}
+	workloadRequestedMemoryDesc = prometheus.NewDesc("vgpu_workload_requested_memory_mb",
+		"GPU memory in MiB a container of the workload requested on all its GPUs", workloadLabels, nil)
+	workloadPeakMemoryDesc = prometheus.NewDesc("vgpu_workload_peak_memory_mb",
+		"Most GPU memory in MiB a container of the workload used within the efficiency window", workloadLabels, nil)
+	workloadRecommendedMemoryDesc = prometheus.NewDesc("vgpu_workload_recommended_memory_mb",
+		"GPU memory in MiB recommended to request of each GPU for the containers of the workload", workloadLabels, nil)
+	workloadRequestedCoresDesc = prometheus.NewDesc("vgpu_workload_requested_cores",
+		"GPU cores in percent a container of the workload requested on all its GPUs", workloadLabels, nil)
+	workloadPeakCoresDesc = prometheus.NewDesc("vgpu_workload_peak_cores",
+		"Most GPU cores in percent a container of the workload kept busy within the efficiency window", workloadLabels, nil)
+	workloadRecommendedCoresDesc = prometheus.NewDesc("vgpu_workload_recommended_cores",
+		"GPU cores in percent recommended to request of each GPU for the containers of the workload", workloadLabels, nil)
+)
+
+type efficiencyCollector struct {
+	s *Scheduler
+}
+
+// EfficiencyCollector exports the EfficiencyReport of s by workload.
+func EfficiencyCollector(s *Scheduler) prometheus.Collector {
+	return efficiencyCollector{s}
+}
+
+func (c efficiencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workloadRequestedMemoryDesc
+	ch <- workloadPeakMemoryDesc
+	ch <- workloadRecommendedMemoryDesc
+	ch <- workloadRequestedCoresDesc
+	ch <- workloadPeakCoresDesc
+	ch <- workloadRecommendedCoresDesc
+}
+
+func (c efficiencyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ns := range c.s.EfficiencyReport().Namespaces {
+		for _, w := range ns.Workloads {
+			labels := []string{ns.Namespace, w.Owner.Kind, w.Owner.Name, w.Container}
+			for desc, v := range map[*prometheus.Desc]int64{
+				workloadRequestedMemoryDesc:   w.RequestedMemoryMB,
+				workloadPeakMemoryDesc:        w.PeakMemoryMB,
+				workloadRecommendedMemoryDesc: w.RecommendedMemoryMB,
+				workloadRequestedCoresDesc:    w.RequestedCores,
+				workloadPeakCoresDesc:         w.PeakCores,
+				workloadRecommendedCoresDesc:  w.RecommendedCores,
+			} {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v), labels...)
+			}
+		}
+	}
+}
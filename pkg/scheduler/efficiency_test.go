@@ -0,0 +1,158 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func ownedPod(namespace, name, kind, owner string, labels map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name), Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "sidecar"}, {Name: "main"}}},
+	}
+	if kind != "" {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{Kind: kind, Name: owner, Controller: &controller}}
+	}
+	return pod
+}
+
+func TestOwnerOf(t *testing.T) {
+	for name, tc := range map[string]struct {
+		pod  *corev1.Pod
+		want WorkloadOwner
+	}{
+		"deployment":           {ownedPod("default", "web-7d4b9-x2x", "ReplicaSet", "web-7d4b9", map[string]string{podTemplateHashLabel: "7d4b9"}), WorkloadOwner{"Deployment", "web"}},
+		"bare replicaset":      {ownedPod("default", "rs-abcde", "ReplicaSet", "rs", nil), WorkloadOwner{"ReplicaSet", "rs"}},
+		"foreign hash":         {ownedPod("default", "rs-abcde", "ReplicaSet", "rs", map[string]string{podTemplateHashLabel: "7d4b9"}), WorkloadOwner{"ReplicaSet", "rs"}},
+		"job":                  {ownedPod("default", "train-q8z", "Job", "train", nil), WorkloadOwner{"Job", "train"}},
+		"statefulset":          {ownedPod("default", "db-0", "StatefulSet", "db", nil), WorkloadOwner{"StatefulSet", "db"}},
+		"without a controller": {ownedPod("default", "notebook", "", "", nil), WorkloadOwner{"Pod", "notebook"}},
+	} {
+		assert.Equal(t, ownerOf(tc.pod), tc.want, name)
+	}
+}
+
+// efficiencyScheduler knows the pods, assigned the devices of the "main" container
+func efficiencyScheduler(t *testing.T, pods map[*corev1.Pod]util.ContainerDevices) *Scheduler {
+	oldWindow, oldFactor := config.EfficiencyWindow, config.RightSizingSafetyFactor
+	t.Cleanup(func() { config.EfficiencyWindow, config.RightSizingSafetyFactor = oldWindow, oldFactor })
+	config.EfficiencyWindow = time.Hour
+	config.RightSizingSafetyFactor = 1.5
+
+	s := NewScheduler()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for pod, devices := range pods {
+		assert.NilError(t, indexer.Add(pod))
+		s.addPod(pod, "node1", util.PodDevices{{}, devices})
+	}
+	s.podLister = listerscorev1.NewPodLister(indexer)
+	return s
+}
+
+func TestEfficiencyReport(t *testing.T) {
+	hash := map[string]string{podTemplateHashLabel: "7d4b9"}
+	web0 := ownedPod("web", "web-7d4b9-a", "ReplicaSet", "web-7d4b9", hash)
+	web1 := ownedPod("web", "web-7d4b9-b", "ReplicaSet", "web-7d4b9", hash)
+	train := ownedPod("ml", "train-x", "Job", "train", nil)
+	s := efficiencyScheduler(t, map[*corev1.Pod]util.ContainerDevices{
+		web0:  {{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 8000, Usedcores: 30}},
+		web1:  {{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 8000, Usedcores: 30}},
+		train: {{UUID: "GPU-2", Type: util.NvidiaGPUDevice, Usedmem: 20000, Usedcores: 100}, {UUID: "GPU-3", Type: util.NvidiaGPUDevice, Usedmem: 20000, Usedcores: 100}},
+	})
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	s.usageNow = func() time.Time { return now }
+
+	// the burst of train falls out of the window
+	s.observeUsage("node1", "uid-train-x,main,36000,190:uid-unknown,main,1000,10")
+	now = now.Add(30 * time.Minute)
+	s.observeUsage("node1", "uid-web-7d4b9-a,main,2000,10:uid-train-x,main,10000,120")
+	now = now.Add(20 * time.Minute)
+	s.observeUsage("node1", "uid-web-7d4b9-a,main,3000,5:uid-web-7d4b9-b,main,1000,12:uid-train-x,main,9000,80:uid-web-7d4b9-a,sidecar,100,0")
+	now = now.Add(40 * time.Minute)
+	report := s.EfficiencyReport()
+
+	assert.Equal(t, report.Window, "1h0m0s")
+	assert.Equal(t, report.SafetyFactor, 1.5)
+	assert.DeepEqual(t, report.Namespaces, []NamespaceEfficiency{
+		{Namespace: "ml", Containers: 1, RequestedMemoryMB: 40000, PeakMemoryMB: 10000, RequestedCores: 200, PeakCores: 120, Workloads: []ContainerEfficiency{
+			{Owner: WorkloadOwner{"Job", "train"}, Container: "main", Pods: 1, GPUs: 2, RequestedMemoryMB: 40000, PeakMemoryMB: 10000, RequestedCores: 200, PeakCores: 120,
+				RecommendedMemoryMB: 7500, RecommendedCores: 90, Since: start.Add(30 * time.Minute)},
+		}},
+		{Namespace: "web", Containers: 3, RequestedMemoryMB: 16000, PeakMemoryMB: 4100, RequestedCores: 60, PeakCores: 22, Workloads: []ContainerEfficiency{
+			{Owner: WorkloadOwner{"Deployment", "web"}, Container: "main", Pods: 2, GPUs: 1, RequestedMemoryMB: 8000, PeakMemoryMB: 3000, RequestedCores: 30, PeakCores: 12,
+				RecommendedMemoryMB: 4500, RecommendedCores: 18, Since: start.Add(30 * time.Minute)},
+			{Owner: WorkloadOwner{"Deployment", "web"}, Container: "sidecar", Pods: 1, RequestedMemoryMB: 0, PeakMemoryMB: 100,
+				RecommendedMemoryMB: 150, Since: start.Add(50 * time.Minute)},
+		}},
+	})
+
+	// everything ages out of the window
+	now = now.Add(time.Hour)
+	assert.Equal(t, len(s.EfficiencyReport().Namespaces), 0)
+	assert.Equal(t, len(s.containers), 0)
+}
+
+func TestRecommendCapsCores(t *testing.T) {
+	old := config.RightSizingSafetyFactor
+	t.Cleanup(func() { config.RightSizingSafetyFactor = old })
+	config.RightSizingSafetyFactor = 1.2
+	memory, cores := recommend(1000, 90, 1)
+	assert.Equal(t, memory, int64(1200))
+	assert.Equal(t, cores, int64(100))
+	memory, cores = recommend(1001, 0, 0)
+	assert.Equal(t, memory, int64(1202))
+	assert.Equal(t, cores, int64(0))
+}
+
+func TestEfficiencyReportServedAndExported(t *testing.T) {
+	web := ownedPod("web", "web-7d4b9-a", "ReplicaSet", "web-7d4b9", map[string]string{podTemplateHashLabel: "7d4b9"})
+	s := efficiencyScheduler(t, map[*corev1.Pod]util.ContainerDevices{
+		web: {{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 8000, Usedcores: 30}},
+	})
+	s.observeUsage("node1", "uid-web-7d4b9-a,main,2000,10")
+	// a malformed annotation is logged and skipped
+	s.observeUsage("node1", "uid-web-7d4b9-a,main,lots,10")
+
+	rec := httptest.NewRecorder()
+	EfficiencyReportHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", EfficiencyReportPath, nil))
+	assert.Equal(t, rec.Header().Get("Content-Type"), "application/json")
+	assert.Assert(t, strings.Contains(rec.Body.String(), `"recommendedMemoryMB": 3000`), rec.Body.String())
+
+	assert.Equal(t, testutil.CollectAndCount(EfficiencyCollector(s)), 6)
+	expected := `
+# HELP vgpu_workload_peak_memory_mb Most GPU memory in MiB a container of the workload used within the efficiency window
+# TYPE vgpu_workload_peak_memory_mb gauge
+vgpu_workload_peak_memory_mb{container="main",namespace="web",owner="web",owner_kind="Deployment"} 2000
+`
+	assert.NilError(t, testutil.CollectAndCompare(EfficiencyCollector(s), strings.NewReader(expected), "vgpu_workload_peak_memory_mb"))
+}
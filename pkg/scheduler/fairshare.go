@@ -0,0 +1,158 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// pendingPodTTL forgets pending pods kube-scheduler stopped asking about, e.g. because
+// they were scheduled by another profile.
+const pendingPodTTL = 10 * time.Minute
+
+// pendingPod is a vGPU pod Filter has seen but not placed yet.
+type pendingPod struct {
+	uid       k8stypes.UID
+	namespace string
+	name      string
+	reqs      [][]util.ContainerDeviceRequest
+	annos     map[string]string
+	nodes     []string
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// fairShare remembers the pending vGPU pods so that, when GPUs are scarce, freed
+// capacity goes to the namespace using the least instead of whoever asks first.
+// All namespaces weigh the same, usage is the GPU memory assigned to their pods.
+type fairShare struct {
+	mutex   sync.Mutex
+	pending map[k8stypes.UID]*pendingPod
+	// lastPlaced is when a pod of each namespace was last placed
+	lastPlaced map[string]time.Time
+	now        func() time.Time
+}
+
+func (f *fairShare) init() {
+	f.pending = make(map[k8stypes.UID]*pendingPod)
+	f.lastPlaced = make(map[string]time.Time)
+	f.now = time.Now
+}
+
+// seen records that the pod is waiting for the given nodes and returns since when its
+// namespace waits, that is since the pod or another pod of the namespace was last placed.
+func (f *fairShare) seen(pod *corev1.Pod, nodes []string, reqs [][]util.ContainerDeviceRequest) time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := f.now()
+	for uid, p := range f.pending {
+		if now.Sub(p.lastSeen) > pendingPodTTL {
+			delete(f.pending, uid)
+		}
+	}
+	p, ok := f.pending[pod.UID]
+	if !ok {
+		p = &pendingPod{uid: pod.UID, namespace: pod.Namespace, name: pod.Name, firstSeen: now}
+		f.pending[pod.UID] = p
+	}
+	p.reqs, p.annos, p.nodes, p.lastSeen = reqs, pod.Annotations, nodes, now
+	if placed := f.lastPlaced[pod.Namespace]; placed.After(p.firstSeen) {
+		return placed
+	}
+	return p.firstSeen
+}
+
+// placed forgets the pod once it got its devices.
+func (f *fairShare) placed(pod *corev1.Pod) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.pending, pod.UID)
+	f.lastPlaced[pod.Namespace] = f.now()
+}
+
+func (f *fairShare) done(pod *corev1.Pod) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.pending, pod.UID)
+}
+
+// others returns the pods pending in other namespaces, longest waiting first.
+func (f *fairShare) others(namespace string) []pendingPod {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var res []pendingPod
+	for _, p := range f.pending {
+		if p.namespace != namespace {
+			res = append(res, *p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].firstSeen.Equal(res[j].firstSeen) {
+			return res[i].firstSeen.Before(res[j].firstSeen)
+		}
+		return res[i].uid < res[j].uid
+	})
+	return res
+}
+
+// namespaceUsage returns the GPU memory assigned to the pods of each namespace.
+func (s *Scheduler) namespaceUsage() map[string]int64 {
+	usage := make(map[string]int64)
+	for _, p := range s.pods {
+		for _, ctr := range p.Devices {
+			for _, d := range ctr {
+				usage[p.Namespace] += int64(d.Usedmem)
+			}
+		}
+	}
+	return usage
+}
+
+// fairShareHold returns the pending pod of a namespace using less GPU memory than the
+// namespace of pod, which fits on the nodes it waits for and so should get the capacity
+// first. Pods of a namespace that got nothing for config.FairSharingStarvationTimeout
+// are never held, so fairness degrades to first come first served rather than starving
+// a namespace, e.g. when the pods of less used namespaces don't fit anywhere else.
+func (s *Scheduler) fairShareHold(pod *corev1.Pod, since time.Time) *pendingPod {
+	if s.fairShare.now().Sub(since) >= config.FairSharingStarvationTimeout {
+		return nil
+	}
+	usage := s.namespaceUsage()
+	for _, p := range s.fairShare.others(pod.Namespace) {
+		if usage[p.namespace] >= usage[pod.Namespace] {
+			continue
+		}
+		nodeUsage, _ := s.nodesUsage(&p.nodes)
+		failed := make(map[string]string)
+		scores, err := calcScore(&nodeUsage, &failed, p.reqs, p.annos)
+		if err != nil || len(*scores) == 0 {
+			continue
+		}
+		klog.Infof("holding back pod %v for pod %v, namespace %v uses %vm and %v %vm",
+			util.PodRef(pod.Namespace, pod.Name), util.PodRef(p.namespace, p.name), util.Redact(pod.Namespace), usage[pod.Namespace], util.Redact(p.namespace), usage[p.namespace])
+		return &p
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+// fairShareCluster is a node of 12 GPUs and a queue of pods taking one whole GPU each.
+type fairShareCluster struct {
+	t       *testing.T
+	s       *Scheduler
+	now     time.Time
+	queue   []*corev1.Pod
+	running []*corev1.Pod
+}
+
+func newFairShareCluster(t *testing.T, fair bool, namespaces ...string) *fairShareCluster {
+	oldName, oldMem, oldFair, oldTimeout := util.ResourceName, util.ResourceMem, config.FairSharing, config.FairSharingStarvationTimeout
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem, config.FairSharing, config.FairSharingStarvationTimeout = oldName, oldMem, oldFair, oldTimeout
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	config.FairSharing, config.FairSharingStarvationTimeout = fair, 5*time.Minute
+
+	c := &fairShareCluster{t: t, s: NewScheduler(), now: time.Unix(0, 0)}
+	c.s.fairShare.now = func() time.Time { return c.now }
+	var devices []DeviceInfo
+	for i := 0; i < 12; i++ {
+		devices = append(devices, DeviceInfo{ID: fmt.Sprintf("GPU-%d", i), Count: 1, Devmem: 10000, Type: "NVIDIA-A100", Health: true})
+	}
+	c.s.addNode("node1", &NodeInfo{ID: "node1", Devices: devices})
+
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+	// the first namespace submits its whole backlog first
+	for _, ns := range namespaces {
+		for i := 0; i < 40; i++ {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: fmt.Sprintf("p%d", i), UID: types.UID(fmt.Sprintf("%s-%d", ns, i))},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{
+						corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+						corev1.ResourceName(util.ResourceMem):  resource.MustParse("10000"),
+					},
+				}}}},
+			}
+			assert.NilError(t, client.Tracker().Add(pod))
+			c.queue = append(c.queue, pod)
+		}
+	}
+	return c
+}
+
+// schedule tries the queue in order, like kube-scheduler retrying unschedulable pods.
+func (c *fairShareCluster) schedule() {
+	var waiting []*corev1.Pod
+	for _, pod := range c.queue {
+		res, err := c.s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+		assert.NilError(c.t, err)
+		if res.NodeNames != nil && len(*res.NodeNames) == 1 {
+			c.running = append(c.running, pod)
+		} else {
+			waiting = append(waiting, pod)
+		}
+	}
+	c.queue = waiting
+}
+
+// finish frees the GPU of the pod running longest.
+func (c *fairShareCluster) finish() {
+	c.s.delPod(c.running[0])
+	c.running = c.running[1:]
+}
+
+func (c *fairShareCluster) usage() map[string]int {
+	res := make(map[string]int)
+	for _, pod := range c.running {
+		res[pod.Namespace]++
+	}
+	return res
+}
+
+func (c *fairShareCluster) run(rounds int) {
+	c.schedule()
+	for i := 0; i < rounds; i++ {
+		c.now = c.now.Add(10 * time.Second)
+		c.finish()
+		c.schedule()
+	}
+}
+
+func TestFairShareConverges(t *testing.T) {
+	c := newFairShareCluster(t, true, "a", "b", "c")
+	c.run(0)
+	assert.DeepEqual(t, c.usage(), map[string]int{"a": 12})
+
+	c.run(24)
+	assert.DeepEqual(t, c.usage(), map[string]int{"a": 4, "b": 4, "c": 4})
+	// and stays there as capacity keeps trickling in
+	c.run(12)
+	assert.DeepEqual(t, c.usage(), map[string]int{"a": 4, "b": 4, "c": 4})
+}
+
+func TestFirstComeWithoutFairShare(t *testing.T) {
+	c := newFairShareCluster(t, false, "a", "b", "c")
+	c.run(24)
+	assert.DeepEqual(t, c.usage(), map[string]int{"a": 12})
+}
+
+func TestFairShareStarvationTimeout(t *testing.T) {
+	c := newFairShareCluster(t, true, "a", "b")
+	c.run(0)
+	c.now = c.now.Add(time.Second)
+	c.finish()
+	c.schedule()
+	assert.DeepEqual(t, c.usage(), map[string]int{"a": 11, "b": 1})
+
+	// a waited long enough since it last got a GPU, b's pods aren't preferred any more
+	c.now = c.now.Add(config.FairSharingStarvationTimeout)
+	c.finish()
+	c.schedule()
+	assert.DeepEqual(t, c.usage(), map[string]int{"a": 11, "b": 1})
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// plainPod is a pod like most of a cluster, with several containers and no vGPU.
+func plainPod() *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{"team": "web"}}}
+	for i := 0; i < 3; i++ {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  fmt.Sprintf("c%d", i),
+			Image: "nginx",
+			Env:   []corev1.EnvVar{{Name: "HOME", Value: "/root"}},
+			Resources: corev1.ResourceRequirements{
+				Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("1Gi")},
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+			},
+		})
+	}
+	return pod
+}
+
+// averageLatency is how long f takes on average over n calls.
+func averageLatency(n int, f func()) time.Duration {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		f()
+	}
+	return time.Since(start) / time.Duration(n)
+}
+
+func TestWebhookUntouched(t *testing.T) {
+	setWebhookResources(t)
+	old := config.UnmanagedGPUEnv
+	t.Cleanup(func() { config.UnmanagedGPUEnv = old })
+	config.UnmanagedGPUEnv = UnmanagedGPUEnvReject
+	raw := func(pod *corev1.Pod) []byte {
+		data, err := json.Marshal(pod)
+		assert.NilError(t, err)
+		return data
+	}
+
+	assert.Assert(t, untouched(raw(plainPod())))
+	for name, change := range map[string]func(*corev1.Pod){
+		"gpu limit": func(p *corev1.Pod) {
+			p.Spec.Containers[1].Resources.Limits["nvidia.com/gpu"] = resource.MustParse("1")
+		},
+		"gpu request": func(p *corev1.Pod) {
+			p.Spec.Containers[1].Resources.Requests["nvidia.com/gpu"] = resource.MustParse("1")
+		},
+		"profile gpu": func(p *corev1.Pod) {
+			p.Spec.Containers[1].Resources.Limits["nvidia.com/gpu-training"] = resource.MustParse("1")
+		},
+		"mlu": func(p *corev1.Pod) {
+			p.Spec.Containers[0].Resources.Limits["cambricon.com/mlunum"] = resource.MustParse("1")
+		},
+		"gpu request cr": func(p *corev1.Pod) { p.Annotations[util.GPURequestAnnotation] = "small" },
+		"vgpu profile":   func(p *corev1.Pod) { p.Annotations[util.VGPUProfileAnnotation] = "small" },
+		"unmanaged env": func(p *corev1.Pod) {
+			p.Spec.InitContainers = []corev1.Container{{Name: "init", Env: []corev1.EnvVar{{Name: "NVIDIA_VISIBLE_DEVICES", Value: "all"}}}}
+		},
+		"no containers": func(p *corev1.Pod) { p.Spec.Containers = nil },
+	} {
+		pod := plainPod()
+		change(pod)
+		assert.Assert(t, !untouched(raw(pod)), name)
+	}
+	config.UnmanagedGPUEnv = UnmanagedGPUEnvAllow
+	pod := plainPod()
+	pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "NVIDIA_VISIBLE_DEVICES", Value: "all"})
+	assert.Assert(t, untouched(raw(pod)))
+
+	wh, err := NewWebHook()
+	assert.NilError(t, err)
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw(plainPod())}}}
+	resp := wh.Handler.Handle(context.Background(), req)
+	assert.Assert(t, resp.Allowed)
+	assert.Equal(t, len(resp.Patches), 0)
+	latency := averageLatency(1000, func() { wh.Handler.Handle(context.Background(), req) })
+	assert.Assert(t, latency < time.Millisecond, "handling a pod without vGPUs took %v", latency)
+}
+
+func TestFilterSkipsPodsWithoutDevices(t *testing.T) {
+	setWebhookResources(t)
+	s := NewScheduler()
+	nodes := make([]string, 5000)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("node%d", i)
+	}
+	args := extenderv1.ExtenderArgs{Pod: plainPod(), NodeNames: &nodes}
+	res, err := s.Filter(args)
+	assert.NilError(t, err)
+	assert.Assert(t, res.NodeNames == &nodes)
+	assert.Equal(t, len(res.FailedNodes), 0)
+	latency := averageLatency(1000, func() { s.Filter(args) })
+	assert.Assert(t, latency < time.Millisecond, "filtering a pod without vGPUs took %v", latency)
+}
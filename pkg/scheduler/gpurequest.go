@@ -0,0 +1,173 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// gpuRequestGetter reads the GPURequest with the name in the namespace.
+type gpuRequestGetter func(ctx context.Context, namespace, name string) (*v1alpha1.GPURequest, error)
+
+// newGPURequestGetter reads GPURequests from the API server. It connects on first use, so
+// the webhook doesn't need the API server or the CRD until a pod references a GPURequest.
+func newGPURequestGetter() gpuRequestGetter {
+	var (
+		once sync.Once
+		c    ctrlclient.Client
+		err  error
+	)
+	return func(ctx context.Context, namespace, name string) (*v1alpha1.GPURequest, error) {
+		once.Do(func() {
+			var restConfig *rest.Config
+			if restConfig, err = k8sutil.NewConfig(); err == nil {
+				c, err = newAPIClient(restConfig)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		req := &v1alpha1.GPURequest{}
+		if err := c.Get(ctx, ctrlclient.ObjectKey{Namespace: namespace, Name: name}, req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+}
+
+// validateGPURequest checks what the CRD schema can't, or what an API server without the
+// schema let through.
+func validateGPURequest(spec *v1alpha1.GPURequestSpec) error {
+	switch {
+	case spec.Count < 0:
+		return fmt.Errorf("count %v is negative", spec.Count)
+	case spec.Memory < 0:
+		return fmt.Errorf("memory %v is negative", spec.Memory)
+	case spec.MemoryPercentage < 0 || spec.MemoryPercentage > 100:
+		return fmt.Errorf("memoryPercentage %v is not in [0,100]", spec.MemoryPercentage)
+	case spec.Cores < 0 || spec.Cores > 100:
+		return fmt.Errorf("cores %v is not in [0,100]", spec.Cores)
+	case spec.Memory > 0 && spec.MemoryPercentage > 0:
+		return fmt.Errorf("both memory and memoryPercentage are set")
+	case len(spec.Models) > 0 && len(spec.ExcludedModels) > 0:
+		return fmt.Errorf("both models and excludedModels are set")
+	}
+	return nil
+}
+
+// applyGPURequest turns req, which the pod references with util.GPURequestAnnotation, into
+// the resource limits and annotations the scheduler and device plugin understand, which
+// stay the interface underneath. Annotations the pod sets itself must agree with req. It
+// returns why the pod is denied.
+func applyGPURequest(pod *corev1.Pod, req *v1alpha1.GPURequest) string {
+	spec := &req.Spec
+	if err := validateGPURequest(spec); err != nil {
+		return fmt.Sprintf("GPURequest %v: %v", req.Name, err)
+	}
+	count := spec.Count
+	if count == 0 {
+		count = 1
+	}
+	limits := corev1.ResourceList{corev1.ResourceName(util.ResourceName): *resource.NewQuantity(int64(count), resource.DecimalSI)}
+	if spec.Memory > 0 {
+		limits[corev1.ResourceName(util.ResourceMem)] = *resource.NewQuantity(int64(spec.Memory), resource.DecimalSI)
+	}
+	if spec.MemoryPercentage > 0 {
+		limits[corev1.ResourceName(util.ResourceMemPercentage)] = *resource.NewQuantity(int64(spec.MemoryPercentage), resource.DecimalSI)
+	}
+	if spec.Cores > 0 {
+		limits[corev1.ResourceName(util.ResourceCores)] = *resource.NewQuantity(int64(spec.Cores), resource.DecimalSI)
+	}
+	annos := map[string]string{}
+	if len(spec.Models) > 0 {
+		annos[util.GPUInUse] = strings.Join(spec.Models, ",")
+	}
+	if len(spec.ExcludedModels) > 0 {
+		annos[util.GPUNoUse] = strings.Join(spec.ExcludedModels, ",")
+	}
+	if spec.Distinct {
+		annos[util.DistinctGPUsAnnotation] = "true"
+	}
+	if spec.Exclusive {
+		annos[util.ExclusivePassthroughAnnotation] = "true"
+	}
+	if spec.PlacementKey != "" {
+		annos[util.PlacementKeyAnnotation] = spec.PlacementKey
+	}
+	for key, val := range annos {
+		if old, ok := pod.Annotations[key]; ok && old != val {
+			return fmt.Sprintf("annotation %v is %q, GPURequest %v sets %q", key, old, req.Name, val)
+		}
+	}
+
+	named := map[string]bool{}
+	for _, name := range spec.Containers {
+		named[name] = true
+	}
+	applied := 0
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		if len(spec.Containers) > 0 {
+			if !named[c.Name] {
+				continue
+			}
+			delete(named, c.Name)
+			if requestsDevices(c) {
+				return fmt.Sprintf("container %v asks for devices itself and through GPURequest %v", c.Name, req.Name)
+			}
+		} else if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged || requestsDevices(c) {
+			continue
+		}
+		if c.Resources.Limits == nil {
+			c.Resources.Limits = corev1.ResourceList{}
+		}
+		for name, q := range limits {
+			c.Resources.Limits[name] = q
+		}
+		applied++
+	}
+	if len(named) > 0 {
+		missing := make([]string, 0, len(named))
+		for name := range named {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Sprintf("GPURequest %v names containers the pod doesn't have: %v", req.Name, strings.Join(missing, ", "))
+	}
+	if applied == 0 {
+		return fmt.Sprintf("GPURequest %v applies to no container of the pod", req.Name)
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	for key, val := range annos {
+		pod.Annotations[key] = val
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func setGPURequestResources(t *testing.T) {
+	setWebhookResources(t)
+	oldMem, oldPct, oldCores := util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores
+	t.Cleanup(func() { util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores = oldMem, oldPct, oldCores })
+	util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores = "nvidia.com/gpumem", "nvidia.com/gpumem-percentage", "nvidia.com/gpucores"
+}
+
+func TestApplyGPURequest(t *testing.T) {
+	setGPURequestResources(t)
+	privileged := true
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "train"},
+			{Name: "sidecar"},
+			{Name: "agent", SecurityContext: &corev1.SecurityContext{Privileged: &privileged}},
+			{Name: "own", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("2")}}},
+		}}}
+	}
+	request := func(spec v1alpha1.GPURequestSpec) *v1alpha1.GPURequest {
+		return &v1alpha1.GPURequest{ObjectMeta: metav1.ObjectMeta{Name: "a100"}, Spec: spec}
+	}
+
+	pod := newPod()
+	assert.Equal(t, applyGPURequest(pod, request(v1alpha1.GPURequestSpec{
+		Count: 2, Memory: 8000, Cores: 50, Models: []string{"A100", "H100"}, Distinct: true, PlacementKey: "llama",
+	})), "")
+	want := corev1.ResourceList{
+		"nvidia.com/gpu":      resource.MustParse("2"),
+		"nvidia.com/gpumem":   resource.MustParse("8000"),
+		"nvidia.com/gpucores": resource.MustParse("50"),
+	}
+	assert.DeepEqual(t, pod.Spec.Containers[0].Resources.Limits, want)
+	assert.DeepEqual(t, pod.Spec.Containers[1].Resources.Limits, want)
+	// privileged containers and those asking for devices themselves are left alone
+	assert.Assert(t, pod.Spec.Containers[2].Resources.Limits == nil)
+	assert.DeepEqual(t, pod.Spec.Containers[3].Resources.Limits, corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("2")})
+	assert.DeepEqual(t, pod.Annotations, map[string]string{
+		util.GPUInUse:               "A100,H100",
+		util.DistinctGPUsAnnotation: "true",
+		util.PlacementKeyAnnotation: "llama",
+	})
+
+	// named containers only, count defaults to 1
+	pod = newPod()
+	assert.Equal(t, applyGPURequest(pod, request(v1alpha1.GPURequestSpec{MemoryPercentage: 25, Containers: []string{"train"}})), "")
+	assert.DeepEqual(t, pod.Spec.Containers[0].Resources.Limits, corev1.ResourceList{
+		"nvidia.com/gpu":               resource.MustParse("1"),
+		"nvidia.com/gpumem-percentage": resource.MustParse("25"),
+	})
+	assert.Assert(t, pod.Spec.Containers[1].Resources.Limits == nil)
+
+	for _, tc := range []struct {
+		name   string
+		spec   v1alpha1.GPURequestSpec
+		annos  map[string]string
+		denied string
+	}{
+		{"memory twice", v1alpha1.GPURequestSpec{Memory: 1000, MemoryPercentage: 10}, nil, "GPURequest a100: both memory and memoryPercentage are set"},
+		{"models twice", v1alpha1.GPURequestSpec{Models: []string{"A100"}, ExcludedModels: []string{"T4"}}, nil, "GPURequest a100: both models and excludedModels are set"},
+		{"cores", v1alpha1.GPURequestSpec{Cores: 150}, nil, "GPURequest a100: cores 150 is not in [0,100]"},
+		{"conflicting annotation", v1alpha1.GPURequestSpec{Models: []string{"A100"}}, map[string]string{util.GPUInUse: "T4"}, `annotation nvidia.com/use-gputype is "T4", GPURequest a100 sets "A100"`},
+		{"own devices", v1alpha1.GPURequestSpec{Containers: []string{"own"}}, nil, "container own asks for devices itself and through GPURequest a100"},
+		{"missing containers", v1alpha1.GPURequestSpec{Containers: []string{"train", "eval", "bench"}}, nil, "GPURequest a100 names containers the pod doesn't have: bench, eval"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newPod()
+			pod.Annotations = tc.annos
+			assert.Equal(t, applyGPURequest(pod, request(tc.spec)), tc.denied)
+		})
+	}
+
+	pod = &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "agent", SecurityContext: &corev1.SecurityContext{Privileged: &privileged}}}}}
+	assert.Equal(t, applyGPURequest(pod, request(v1alpha1.GPURequestSpec{})), "GPURequest a100 applies to no container of the pod")
+}
+
+func TestWebhookGPURequest(t *testing.T) {
+	setGPURequestResources(t)
+	wh, err := NewWebHook()
+	assert.NilError(t, err)
+	wh.Handler.(*webhook).gpuRequest = func(_ context.Context, namespace, name string) (*v1alpha1.GPURequest, error) {
+		if namespace != "ml" || name != "a100" {
+			return nil, apierrors.NewNotFound(v1alpha1.GroupVersion.WithResource("gpurequests").GroupResource(), name)
+		}
+		return &v1alpha1.GPURequest{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Spec: v1alpha1.GPURequestSpec{Count: 1, Memory: 4000}}, nil
+	}
+	handle := func(request string) admission.Response {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{util.GPURequestAnnotation: request}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+		}
+		raw, err := json.Marshal(pod)
+		assert.NilError(t, err)
+		return wh.Handler.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Namespace: "ml", Object: runtime.RawExtension{Raw: raw}}})
+	}
+
+	resp := handle("a100")
+	assert.Assert(t, resp.Allowed)
+	var limits bool
+	for _, p := range resp.Patches {
+		if p.Path == "/spec/containers/0/resources/limits" {
+			assert.DeepEqual(t, p.Value, map[string]interface{}{"nvidia.com/gpu": "1", "nvidia.com/gpumem": "4k"})
+			limits = true
+		}
+	}
+	assert.Assert(t, limits)
+
+	resp = handle("t4")
+	assert.Assert(t, !resp.Allowed)
+	assert.Equal(t, string(resp.Result.Reason), "GPURequest t4 not found")
+}
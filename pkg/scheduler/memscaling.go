@@ -0,0 +1,101 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// deviceInfo converts a device registered by the device plugin on nodeID, capping
+// its memory to config.MaxMemoryScaling times the physical memory. Devices whose
+// plugin doesn't report the physical memory aren't scaled and are taken as is.
+func (s *Scheduler) deviceInfo(nodeID string, d *api.DeviceInfo) DeviceInfo {
+	devType, profile := util.SplitProfileDeviceType(d.GetType())
+	info := DeviceInfo{
+		ID:            d.GetId(),
+		Count:         clampRegistered(d.GetCount(), maxDeviceCount),
+		MaxShares:     clampRegistered(d.GetMaxshares(), maxDeviceCount),
+		Devmem:        clampRegistered(d.GetDevmem(), maxDeviceMemory),
+		Advertisedmem: clampRegistered(d.GetDevmem(), maxDeviceMemory),
+		Physmem:       clampRegistered(d.GetPhysmem(), maxDeviceMemory),
+		Type:          devType,
+		Profile:       profile,
+		Health:        d.GetHealth(),
+		Overcommitted: d.GetOvercommitted(),
+	}
+	if config.MaxMemoryScaling <= 0 || info.Physmem <= 0 {
+		return info
+	}
+	limit := int32(float64(info.Physmem) * config.MaxMemoryScaling)
+	if info.Devmem <= limit {
+		return info
+	}
+	info.Devmem = limit
+	klog.Warningf("node %v device %v advertises %vm on %vm physical memory, capped to %vm by the memory scaling limit %v",
+		nodeID, info.ID, info.Advertisedmem, info.Physmem, limit, config.MaxMemoryScaling)
+	if s.eventRecorder != nil {
+		ref := &corev1.ObjectReference{Kind: "Node", Name: nodeID, UID: types.UID(nodeID)}
+		s.eventRecorder.Eventf(ref, corev1.EventTypeWarning, "MemoryScalingCapped",
+			"device %v advertises %vm on %vm physical memory, capped to %vm by the cluster memory scaling limit %v",
+			info.ID, info.Advertisedmem, info.Physmem, limit, config.MaxMemoryScaling)
+	}
+	return info
+}
+
+// ParsePriorityMemoryScaling sets config.PriorityMemoryScaling from the memory scaling of
+// each priority class, e.g. "1" for a class held to the physical memory of the devices.
+func ParsePriorityMemoryScaling(scalings map[string]string) error {
+	res := make(map[string]float64, len(scalings))
+	for class, value := range scalings {
+		scaling, err := strconv.ParseFloat(value, 64)
+		if err != nil || scaling <= 0 {
+			return fmt.Errorf("memory scaling %q of priority class %v isn't a positive number", value, class)
+		}
+		res[class] = scaling
+	}
+	config.PriorityMemoryScaling = res
+	return nil
+}
+
+// ValidateMemoryTiers checks that no priority class is in both memory tiers or has a
+// memory scaling of its own too.
+func ValidateMemoryTiers() error {
+	tiers := make(map[string]string)
+	for tier, classes := range map[string][]string{
+		util.MemoryTierGuaranteed: config.GuaranteedPriorityClasses,
+		util.MemoryTierBestEffort: config.BestEffortPriorityClasses,
+	} {
+		for _, class := range classes {
+			if other, ok := tiers[class]; ok && other != tier {
+				return fmt.Errorf("priority class %v is both %v and %v", class, other, tier)
+			}
+			tiers[class] = tier
+			if _, ok := config.PriorityMemoryScaling[class]; ok {
+				return fmt.Errorf("priority class %v of the %v tier has a memory scaling too", class, tier)
+			}
+		}
+	}
+	return nil
+}
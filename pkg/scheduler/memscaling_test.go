@@ -0,0 +1,213 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestDeviceInfoCapsMemoryScaling(t *testing.T) {
+	defer func(v float64) { config.MaxMemoryScaling = v }(config.MaxMemoryScaling)
+	config.MaxMemoryScaling = 1.5
+	recorder := record.NewFakeRecorder(10)
+	s := NewScheduler()
+	s.eventRecorder = recorder
+
+	// the node scales 16000m of physical memory by 3
+	scaled := &api.DeviceInfo{Id: "GPU-a", Count: 10, Devmem: 48000, Type: "NVIDIA-A100", Health: true, Physmem: 16000}
+	plain := &api.DeviceInfo{Id: "GPU-b", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true}
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		s.deviceInfo("node1", scaled),
+		s.deviceInfo("node1", plain),
+	}})
+
+	select {
+	case e := <-recorder.Events:
+		assert.Assert(t, strings.HasPrefix(e, "Warning MemoryScalingCapped device GPU-a advertises 48000m"), e)
+	default:
+		t.Fatal("expected an event for the capped device")
+	}
+	assert.Equal(t, len(recorder.Events), 0)
+
+	usage, _, err := s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	devs := (*usage)["node1"].Devices
+	assert.Equal(t, devs[0].Totalmem, int32(24000))
+	assert.Equal(t, devs[0].Advertisedmem, int32(48000))
+	assert.Equal(t, devs[1].Totalmem, int32(16000))
+
+	// accounting uses the capped memory
+	failed := map[string]string{}
+	res, err := calcScore(usage, &failed, gpuRequest(1, 41000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonInsufficientMemory))
+
+	status := s.nodeStatuses()["node1"]
+	assert.Equal(t, status.Devices[0].TotalMemory, int32(24000))
+	assert.Equal(t, status.Devices[0].AdvertisedMemory, int32(48000))
+	assert.Equal(t, status.Devices[1].AdvertisedMemory, int32(0))
+}
+
+func TestDeviceInfoWithoutMemoryScalingLimit(t *testing.T) {
+	defer func(v float64) { config.MaxMemoryScaling = v }(config.MaxMemoryScaling)
+	config.MaxMemoryScaling = 0
+	s := NewScheduler()
+	d := s.deviceInfo("node1", &api.DeviceInfo{Id: "GPU-a", Devmem: 48000, Physmem: 16000})
+	assert.Equal(t, d.Devmem, int32(48000))
+	assert.Equal(t, d.Advertisedmem, int32(48000))
+}
+
+func TestPriorityMemoryScaling(t *testing.T) {
+	// 16000m of physical memory scaled by 2, 12000m are assigned to pods already
+	nodes := func() *map[string]*NodeUsage {
+		return &map[string]*NodeUsage{"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Used: 2, Usedmem: 12000, Totalmem: 32000, Physmem: 16000, Type: "NVIDIA-A100"},
+		}}}
+	}
+	fits := func(mem int32, scaling float64) FilterReason {
+		reqs := gpuRequest(1, mem, 0)
+		reqs[0][0].MemoryScaling = scaling
+		failed := map[string]string{}
+		res, err := calcScore(nodes(), &failed, reqs, nil)
+		assert.NilError(t, err)
+		if len(*res) == 0 {
+			return FilterReason(failed["node1"])
+		}
+		return ""
+	}
+
+	// high priority pods are held to the physical memory
+	assert.Equal(t, fits(4000, 1), FilterReason(""))
+	assert.Equal(t, fits(6000, 1), ReasonInsufficientMemory)
+	assert.Equal(t, fits(6000, 1.5), FilterReason(""))
+	assert.Equal(t, fits(14000, 1.5), ReasonInsufficientMemory)
+	// the others use the oversubscribed memory, never more than is advertised
+	assert.Equal(t, fits(20000, 0), FilterReason(""))
+	assert.Equal(t, fits(20000, 3), FilterReason(""))
+	assert.Equal(t, fits(21000, 3), ReasonInsufficientMemory)
+
+	// devices of plugins not reporting their physical memory aren't capped
+	usage := nodes()
+	(*usage)["node1"].Devices[0].Physmem = 0
+	reqs := gpuRequest(1, 20000, 0)
+	reqs[0][0].MemoryScaling = 1
+	res, err := calcScore(usage, &map[string]string{}, reqs, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+}
+
+func TestParsePriorityMemoryScaling(t *testing.T) {
+	defer func(v map[string]float64) { config.PriorityMemoryScaling = v }(config.PriorityMemoryScaling)
+	assert.NilError(t, ParsePriorityMemoryScaling(map[string]string{"high": "1", "batch": "2.5"}))
+	assert.DeepEqual(t, config.PriorityMemoryScaling, map[string]float64{"high": 1, "batch": 2.5})
+	assert.ErrorContains(t, ParsePriorityMemoryScaling(map[string]string{"high": "0"}), "priority class high")
+	assert.ErrorContains(t, ParsePriorityMemoryScaling(map[string]string{"high": "x"}), "isn't a positive number")
+}
+
+func TestMemoryTiersShareOneGPU(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	oldClient := util.GetClient()
+	oldGuaranteed, oldBestEffort := config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+		config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses = oldGuaranteed, oldBestEffort
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses = []string{"critical"}, []string{"batch"}
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+
+	// 16000m of physical memory scaled by 2
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-a", Count: 10, Devmem: 32000, Physmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+
+	filter := func(i int, class string, mem string) *extenderv1.ExtenderFilterResult {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("p%d", i), UID: types.UID(fmt.Sprintf("p%d", i))},
+			Spec: corev1.PodSpec{PriorityClassName: class, Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse(mem),
+				},
+			}}}},
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+		assert.NilError(t, err)
+		return res
+	}
+	tier := func(i int) string {
+		pod, err := client.CoreV1().Pods("default").Get(context.Background(), fmt.Sprintf("p%d", i), metav1.GetOptions{})
+		assert.NilError(t, err)
+		return pod.Annotations[util.MemoryTierAnnotation]
+	}
+
+	// a guaranteed pod is placed on the physical memory
+	res := filter(0, "critical", "10000")
+	assert.Equal(t, len(*res.NodeNames), 1, res.Error)
+	assert.Equal(t, tier(0), util.MemoryTierGuaranteed)
+	// best-effort pods fill the scaled memory around it
+	res = filter(1, "batch", "20000")
+	assert.Equal(t, len(*res.NodeNames), 1, res.Error)
+	assert.Equal(t, tier(1), util.MemoryTierBestEffort)
+	res = filter(2, "batch", "3000")
+	assert.Assert(t, res.NodeNames == nil)
+	assert.DeepEqual(t, res.FailedNodes, extenderv1.FailedNodesMap{"node1": string(ReasonInsufficientMemory)})
+	// the physical memory is oversubscribed now, so another guaranteed pod doesn't fit
+	res = filter(3, "critical", "1000")
+	assert.Assert(t, res.NodeNames == nil)
+	assert.DeepEqual(t, res.FailedNodes, extenderv1.FailedNodesMap{"node1": string(ReasonInsufficientMemory)})
+	// pods without a tier keep the scaled memory and get no annotation
+	res = filter(4, "", "2000")
+	assert.Equal(t, len(*res.NodeNames), 1, res.Error)
+	assert.Equal(t, tier(4), "")
+}
+
+func TestValidateMemoryTiers(t *testing.T) {
+	oldGuaranteed, oldBestEffort, oldScaling := config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses, config.PriorityMemoryScaling
+	t.Cleanup(func() {
+		config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses, config.PriorityMemoryScaling = oldGuaranteed, oldBestEffort, oldScaling
+	})
+	config.GuaranteedPriorityClasses, config.BestEffortPriorityClasses = []string{"critical", "high"}, []string{"batch"}
+	config.PriorityMemoryScaling = map[string]float64{"medium": 1.5}
+	assert.NilError(t, ValidateMemoryTiers())
+
+	config.BestEffortPriorityClasses = []string{"batch", "high"}
+	assert.ErrorContains(t, ValidateMemoryTiers(), "priority class high is both")
+	config.BestEffortPriorityClasses = []string{"batch"}
+	config.PriorityMemoryScaling["batch"] = 2
+	assert.ErrorContains(t, ValidateMemoryTiers(), "priority class batch of the besteffort tier has a memory scaling too")
+}
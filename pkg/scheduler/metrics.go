@@ -0,0 +1,43 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// FilterFailures counts nodes rejected by Filter, labelled by FilterReason.
+var FilterFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "vgpu_scheduler_filter_failures_total",
+		Help: "Number of nodes rejected by the vGPU scheduler filter, by reason",
+	},
+	[]string{"reason"},
+)
+
+// InvalidRegistrations counts the registrations of devices rejected, labelled by the
+// Reason of their InvalidRegistrationError.
+var InvalidRegistrations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "vgpu_invalid_registrations_total",
+		Help: "Number of device registrations rejected by the vGPU scheduler, by reason",
+	},
+	[]string{"reason"},
+)
+
+// Metrics returns the collectors above so binaries can add them to their registry.
+func Metrics() []prometheus.Collector {
+	return []prometheus.Collector{FilterFailures, InvalidRegistrations}
+}
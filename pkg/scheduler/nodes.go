@@ -18,18 +18,31 @@ package scheduler
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
+	"4pd.io/k8s-vgpu/pkg/util"
 	"k8s.io/klog/v2"
 )
 
 type DeviceInfo struct {
-	ID     string
-	Count  int32
-	Devmem int32
-	Type   string
-	Health bool
+	ID    string
+	Count int32
+	// MaxShares caps the tasks sharing the device below Count, 0 if Count is the limit.
+	MaxShares int32
+	// Devmem is the memory the scheduler accounts with, Advertisedmem is what the
+	// device plugin reported before the cluster memory scaling limit was applied.
+	Devmem        int32
+	Advertisedmem int32
+	// Physmem is the physical memory of the device, 0 if its plugin doesn't report it
+	Physmem int32
+	Type    string
+	Profile string
+	Health  bool
+	// Overcommitted is set by the device plugin when it measured less memory on the device
+	// than is allocated on it
+	Overcommitted bool
 }
 
 type NodeInfo struct {
@@ -38,29 +51,90 @@ type NodeInfo struct {
 }
 
 type DeviceUsage struct {
-	Id        string
-	Used      int32
-	Count     int32
-	Usedmem   int32
-	Totalmem  int32
-	Usedcores int32
-	Type      string
-	Health    bool
+	Id            string
+	Used          int32
+	Count         int32
+	MaxShares     int32
+	Usedmem       int32
+	Totalmem      int32
+	Advertisedmem int32
+	Physmem       int32
+	Usedcores     int32
+	Type          string
+	Profile       string
+	Health        bool
+	// Usedmembw is the memory bandwidth in percent the containers on the device are limited to
+	Usedmembw int32
+	// Exclusive is set when a pod got the whole device, dedicated or for exclusive passthrough
+	Exclusive bool
+	// Drained is set while the device is drained for maintenance
+	Drained bool
+	// Overcommitted is set when the device plugin flagged the device, see overcommitted
+	Overcommitted bool
+	// Preferred is set when pods with the placement key of the pod being scheduled were
+	// placed on the device lately
+	Preferred bool
+	// Boost is what the schedule windows open for the pod being scheduled add to the
+	// score for the device, see applySchedulePolicy
+	Boost float32
+	// Reserved is set while exclusive schedule windows leave the device to other pods
+	Reserved bool
 }
 
 type DeviceUsageList []*DeviceUsage
 
+func (d *DeviceUsage) candidate() util.DeviceCandidate {
+	return util.DeviceCandidate{UUID: d.Id, SharesLeft: d.Shares() - d.Used, FreeMemory: d.Totalmem - d.Usedmem}
+}
+
+// Shares returns how many tasks may share the device. Count, the split count of the
+// device plugin, also sizes slices, so a lower MaxShares only caps the tasks.
+func (d *DeviceUsage) Shares() int32 {
+	if d.MaxShares > 0 && d.MaxShares < d.Count {
+		return d.MaxShares
+	}
+	return d.Count
+}
+
+// overcommitted reports whether the device now has less memory than is already allocated
+// on it, e.g. after rows were remapped, as the device plugin flagged it or the pods on it
+// add up to. Existing tasks keep running but no new task is placed.
+func (d *DeviceUsage) overcommitted() bool {
+	return d.Overcommitted || d.Usedmem > d.Totalmem
+}
+
+// capacity returns the memory of the device request k may fill up to, Totalmem unless the
+// memory scaling of k caps it lower. Devices whose physical memory is unknown aren't capped.
+func (d *DeviceUsage) capacity(k util.ContainerDeviceRequest) int32 {
+	if k.MemoryScaling <= 0 || d.Physmem <= 0 {
+		return d.Totalmem
+	}
+	if limit := int32(float64(d.Physmem) * k.MemoryScaling); limit < d.Totalmem {
+		return limit
+	}
+	return d.Totalmem
+}
+
 type NodeUsage struct {
 	Devices DeviceUsageList
+	// Links are how the GPUs of the node are connected, nil if the device plugin didn't
+	// report it
+	Links deviceLinks
 }
 
 type nodeManager struct {
 	nodes map[string]*NodeInfo
+	// drained holds the devices drained on each node, by UUID
+	drained map[string]map[string]bool
+	// links holds how the GPUs of each node are connected
+	links map[string]deviceLinks
 	mutex sync.Mutex
 }
 
 func (m *nodeManager) init() {
 	m.nodes = make(map[string]*NodeInfo)
+	m.drained = make(map[string]map[string]bool)
+	m.links = make(map[string]deviceLinks)
 }
 
 func (m *nodeManager) addNode(nodeID string, nodeInfo *NodeInfo) {
@@ -107,6 +181,50 @@ func (m *nodeManager) rmNodeDevice(nodeID string, nodeInfo *NodeInfo) {
 	}
 }
 
+// rmNode forgets nodeID and all its devices, it reports whether nodeID was registered.
+func (m *nodeManager) rmNode(nodeID string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.nodes[nodeID]
+	delete(m.nodes, nodeID)
+	delete(m.drained, nodeID)
+	delete(m.links, nodeID)
+	return ok
+}
+
+// setDrained records the devices drained on nodeID with util.DrainDeviceAnnotation,
+// devices not in ids are undrained.
+func (m *nodeManager) setDrained(nodeID string, ids []string) {
+	drained := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drained[id] = true
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id := range drained {
+		if !m.drained[nodeID][id] {
+			klog.Infof("node %v device %v drained", nodeID, id)
+		}
+	}
+	for id := range m.drained[nodeID] {
+		if !drained[id] {
+			klog.Infof("node %v device %v undrained", nodeID, id)
+		}
+	}
+	if len(drained) == 0 {
+		delete(m.drained, nodeID)
+		return
+	}
+	m.drained[nodeID] = drained
+}
+
+// isDrained tells whether the device with the given UUID is drained on nodeID.
+func (m *nodeManager) isDrained(nodeID, id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.drained[nodeID][id]
+}
+
 func (m *nodeManager) GetNode(nodeID string) (*NodeInfo, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -116,6 +234,18 @@ func (m *nodeManager) GetNode(nodeID string) (*NodeInfo, error) {
 	return &NodeInfo{}, fmt.Errorf("node %v not found", nodeID)
 }
 
+// nodeIDs returns the names of the nodes with registered devices.
+func (m *nodeManager) nodeIDs() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ids := make([]string, 0, len(m.nodes))
+	for id := range m.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 func (m *nodeManager) ListNodes() (map[string]*NodeInfo, error) {
 	return m.nodes, nil
 }
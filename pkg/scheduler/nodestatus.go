@@ -0,0 +1,170 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newAPIClient is a client of the vgpu.4pd.io objects.
+func newAPIClient(config *rest.Config) (ctrlclient.Client, error) {
+	scheme := runtime.NewScheme()
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	return ctrlclient.New(config, ctrlclient.Options{Scheme: scheme})
+}
+
+// nodeStatusReconciler keeps one VGPUNodeStatus per registered node, writing only
+// the objects whose status changed since they were last published.
+type nodeStatusReconciler struct {
+	client    ctrlclient.Client
+	published map[string]v1alpha1.VGPUNodeStatusStatus
+}
+
+func newNodeStatusReconciler(c ctrlclient.Client) *nodeStatusReconciler {
+	return &nodeStatusReconciler{client: c}
+}
+
+// load starts from what a previous run left behind, so nodes gone meanwhile are cleaned up.
+func (r *nodeStatusReconciler) load(ctx context.Context) error {
+	if r.published != nil {
+		return nil
+	}
+	list := &v1alpha1.VGPUNodeStatusList{}
+	if err := r.client.List(ctx, list); err != nil {
+		return err
+	}
+	r.published = make(map[string]v1alpha1.VGPUNodeStatusStatus, len(list.Items))
+	for _, item := range list.Items {
+		r.published[item.Name] = item.Status
+	}
+	return nil
+}
+
+func (r *nodeStatusReconciler) reconcile(ctx context.Context, desired map[string]v1alpha1.VGPUNodeStatusStatus) error {
+	if err := r.load(ctx); err != nil {
+		return err
+	}
+	var errs []error
+	for name, status := range desired {
+		if last, ok := r.published[name]; ok && equality.Semantic.DeepEqual(last, status) {
+			continue
+		}
+		if err := r.apply(ctx, name, status); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		r.published[name] = status
+	}
+	for name := range r.published {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		obj := &v1alpha1.VGPUNodeStatus{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if err := r.client.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+			continue
+		}
+		delete(r.published, name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (r *nodeStatusReconciler) apply(ctx context.Context, name string, status v1alpha1.VGPUNodeStatusStatus) error {
+	obj := &v1alpha1.VGPUNodeStatus{}
+	err := r.client.Get(ctx, types.NamespacedName{Name: name}, obj)
+	if apierrors.IsNotFound(err) {
+		obj = &v1alpha1.VGPUNodeStatus{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		err = r.client.Create(ctx, obj)
+	}
+	if err != nil {
+		return err
+	}
+	obj.Status = status
+	return r.client.Status().Update(ctx, obj)
+}
+
+// nodeStatuses returns the device usage of every registered node.
+func (s *Scheduler) nodeStatuses() map[string]v1alpha1.VGPUNodeStatusStatus {
+	nodes, _ := s.ListNodes()
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	usage, _, _ := s.getNodesUsage(&ids, nil)
+	res := make(map[string]v1alpha1.VGPUNodeStatusStatus, len(*usage))
+	for id, node := range *usage {
+		res[id] = s.statusOf(id, node)
+	}
+	return res
+}
+
+// statusOf sums up the device usage of the node id.
+func (s *Scheduler) statusOf(id string, node *NodeUsage) v1alpha1.VGPUNodeStatusStatus {
+	status := v1alpha1.VGPUNodeStatusStatus{DeviceCount: int32(len(node.Devices)), PlacementKeys: s.placements(id)}
+	for _, d := range node.Devices {
+		status.TotalMemory += int64(d.Totalmem)
+		status.AllocatedMemory += int64(d.Usedmem)
+		dev := v1alpha1.VGPUDeviceStatus{
+			ID:              d.Id,
+			Type:            d.Type,
+			Health:          d.Health,
+			Capacity:        d.Shares(),
+			Allocated:       d.Used,
+			TotalMemory:     d.Totalmem,
+			AllocatedMemory: d.Usedmem,
+			AllocatedCores:  d.Usedcores,
+			Exclusive:       d.Exclusive,
+			Drained:         d.Drained,
+		}
+		if d.Advertisedmem != d.Totalmem {
+			dev.AdvertisedMemory = d.Advertisedmem
+		}
+		status.Devices = append(status.Devices, dev)
+	}
+	return status
+}
+
+func (s *Scheduler) publishNodeStatus(r *nodeStatusReconciler, interval time.Duration) {
+	wait.Until(func() {
+		if r.published == nil {
+			if err := r.load(context.Background()); err != nil {
+				klog.Errorf("publish VGPUNodeStatus failed: %v", err)
+				return
+			}
+			// the placement keys of a previous run are only kept in what it published
+			s.restorePlacements(r.published)
+		}
+		if err := r.reconcile(context.Background(), s.nodeStatuses()); err != nil {
+			klog.Errorf("publish VGPUNodeStatus failed: %v", err)
+		}
+	}, interval, s.stopCh)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNodeStatusReconcile(t *testing.T) {
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+		{ID: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid"}}
+	s.addPod(pod, "node1", util.PodDevices{{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: 30}}})
+
+	scheme := runtime.NewScheme()
+	assert.NilError(t, v1alpha1.AddToScheme(scheme))
+	gone := &v1alpha1.VGPUNodeStatus{ObjectMeta: metav1.ObjectMeta{Name: "gone"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(gone).Build()
+	r := newNodeStatusReconciler(c)
+	ctx := context.Background()
+
+	assert.NilError(t, r.reconcile(ctx, s.nodeStatuses()))
+	got := &v1alpha1.VGPUNodeStatus{}
+	assert.NilError(t, c.Get(ctx, types.NamespacedName{Name: "node1"}, got))
+	assert.Equal(t, got.Status.DeviceCount, int32(2))
+	assert.Equal(t, got.Status.TotalMemory, int64(32000))
+	assert.Equal(t, got.Status.AllocatedMemory, int64(4000))
+	assert.DeepEqual(t, got.Status.Devices[1], v1alpha1.VGPUDeviceStatus{
+		ID: "GPU-1", Type: "NVIDIA-A100", Health: true, Capacity: 10, Allocated: 1,
+		TotalMemory: 16000, AllocatedMemory: 4000, AllocatedCores: 30,
+	})
+	err := c.Get(ctx, types.NamespacedName{Name: "gone"}, &v1alpha1.VGPUNodeStatus{})
+	assert.Assert(t, apierrors.IsNotFound(err))
+
+	// unchanged usage is not written again
+	got.Status.AllocatedMemory = 0
+	assert.NilError(t, c.Status().Update(ctx, got))
+	assert.NilError(t, r.reconcile(ctx, s.nodeStatuses()))
+	assert.NilError(t, c.Get(ctx, types.NamespacedName{Name: "node1"}, got))
+	assert.Equal(t, got.Status.AllocatedMemory, int64(0))
+
+	s.delPod(pod)
+	assert.NilError(t, r.reconcile(ctx, s.nodeStatuses()))
+	assert.NilError(t, c.Get(ctx, types.NamespacedName{Name: "node1"}, got))
+	assert.Equal(t, got.Status.Devices[1].Allocated, int32(0))
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/openapi"
+	"4pd.io/k8s-vgpu/pkg/version"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/klog/v2"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+// The paths of the extender, webhook and metrics components, besides UsagePath,
+// PendingDemandPath, EfficiencyReportPath, PurgeNodePath and util.ConfigPath.
+const (
+	FilterPath  = "/filter"
+	BindPath    = "/bind"
+	WebhookPath = "/webhook"
+	MetricsPath = "/metrics"
+	// OpenAPIPath is served by every listener with the OpenAPI document of all components.
+	OpenAPIPath = "/openapi.json"
+)
+
+// OpenAPI returns the OpenAPI document of the HTTP endpoints of the scheduler, written
+// from the types they encode. The components serve their endpoints on the listeners
+// they are configured with, the document lists those of all of them.
+func OpenAPI() *openapi.Document {
+	g := openapi.NewGenerator()
+	g.Describe(UsagePage{}, "A page of the vGPU usage of the nodes as the scheduler accounts it, sorted by node name.")
+	g.Describe(PendingDemandPage{}, "A page of the vGPU demand Filter couldn't place on any node, grouped by what the pods ask for alike, the most GPUs first.")
+	g.Describe(EfficiencyReportPage{}, "A page of the requests of the vGPU containers compared with their peak usage within the window, by namespace and workload.")
+	g.Describe(config.EffectiveConfig{}, "The configuration the scheduler runs with, after the command line flags were applied.")
+
+	list := func(fields ...string) []*openapi.Parameter {
+		return []*openapi.Parameter{
+			{Name: util.PageLimitParam, In: "query", Schema: &openapi.Schema{Type: "integer", Format: "int64"},
+				Description: "The most items on the page, that of --debug-page-limit unless set, 0 for all."},
+			{Name: util.PageContinueParam, In: "query", Schema: &openapi.Schema{Type: "string"},
+				Description: "The continue token of the previous page."},
+			{Name: util.PageFieldsParam, In: "query", Schema: &openapi.Schema{Type: "string"},
+				Description: fmt.Sprintf("The parts of the items to serve separated by \",\", of %v, all unless set.", strings.Join(fields, ", "))},
+		}
+	}
+	ok := func(description string, v interface{}) map[string]*openapi.Response {
+		return map[string]*openapi.Response{
+			"200": {Description: description, Content: openapi.Content(g.SchemaOf(v))},
+		}
+	}
+	text := &openapi.Response{Description: "The error.", Content: map[string]*openapi.MediaType{"text/plain": {Schema: &openapi.Schema{Type: "string"}}}}
+	withErrors := func(res map[string]*openapi.Response, codes ...int) map[string]*openapi.Response {
+		for _, code := range codes {
+			res[fmt.Sprint(code)] = text
+		}
+		return res
+	}
+	body := func(v interface{}) *openapi.RequestBody {
+		return &openapi.RequestBody{Required: true, Content: openapi.Content(g.SchemaOf(v))}
+	}
+
+	paths := map[string]*openapi.PathItem{
+		FilterPath: {Post: &openapi.Operation{
+			OperationID: "filter", Tags: []string{"extender"},
+			Summary:     "Filter the nodes for a pod, as a kube-scheduler extender.",
+			Description: "Picks the node and GPUs of the pod among the nodes passed and returns that node alone, or why each node was rejected. Errors are reported in the Error of the result.",
+			RequestBody: body(extenderv1.ExtenderArgs{}),
+			Responses:   ok("The nodes passing the filter.", extenderv1.ExtenderFilterResult{}),
+		}},
+		BindPath: {Post: &openapi.Operation{
+			OperationID: "bind", Tags: []string{"extender"},
+			Summary:     "Bind a pod to the node Filter picked, as a kube-scheduler extender.",
+			Description: "Errors are reported in the Error of the result.",
+			RequestBody: body(extenderv1.ExtenderBindingArgs{}),
+			Responses:   ok("The outcome of the bind.", extenderv1.ExtenderBindingResult{}),
+		}},
+		WebhookPath: {Post: &openapi.Operation{
+			OperationID: "admit", Tags: []string{"webhook"},
+			Summary:     "Review a pod as a mutating admission webhook.",
+			RequestBody: body(admissionv1.AdmissionReview{}),
+			Responses:   ok("The review with its response.", admissionv1.AdmissionReview{}),
+		}},
+		MetricsPath: {Get: &openapi.Operation{
+			OperationID: "getMetrics", Tags: []string{"metrics"},
+			Summary: "Get the metrics in the Prometheus text format.",
+			Responses: map[string]*openapi.Response{"200": {Description: "The metrics.",
+				Content: map[string]*openapi.MediaType{"text/plain": {Schema: &openapi.Schema{Type: "string"}}}}},
+		}},
+		UsagePath: {Get: &openapi.Operation{
+			OperationID: "getUsage", Tags: []string{"metrics"},
+			Summary:    "Get the vGPU usage of the nodes, a page at a time.",
+			Parameters: list(UsageFieldSummary, UsageFieldDevices, UsageFieldPods),
+			Responses:  withErrors(ok("A page of the nodes.", UsagePage{}), http.StatusBadRequest),
+		}},
+		PendingDemandPath: {Get: &openapi.Operation{
+			OperationID: "getPendingDemand", Tags: []string{"metrics"},
+			Summary:    "Get the vGPU demand of the pods no node was found for, its groups a page at a time.",
+			Parameters: list(DemandFieldSummary, DemandFieldGroups),
+			Responses:  withErrors(ok("A page of the groups.", PendingDemandPage{}), http.StatusBadRequest),
+		}},
+		EfficiencyReportPath: {Get: &openapi.Operation{
+			OperationID: "getEfficiencyReport", Tags: []string{"metrics"},
+			Summary:    "Get the efficiency report, its namespaces a page at a time.",
+			Parameters: list(EfficiencyFieldSummary, EfficiencyFieldWorkloads),
+			Responses:  withErrors(ok("A page of the namespaces.", EfficiencyReportPage{}), http.StatusBadRequest),
+		}},
+		util.ConfigPath: {Get: &openapi.Operation{
+			OperationID: "getConfig", Tags: []string{"metrics"},
+			Summary:   "Get the configuration the scheduler runs with.",
+			Responses: withErrors(ok("The configuration.", config.EffectiveConfig{}), http.StatusInternalServerError),
+		}},
+		PurgeNodePath + "{node}": {Delete: &openapi.Operation{
+			OperationID: "purgeNode", Tags: []string{"metrics"},
+			Summary:     "Make the scheduler forget a decommissioned node.",
+			Description: "Removes the devices registered for the node, the annotations vGPU components wrote to it and its VGPUNodeStatus. Only served to clients on the loopback interface.",
+			Parameters:  []*openapi.Parameter{{Name: "node", In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}}},
+			Responses:   withErrors(ok("What was removed.", []string{}), http.StatusForbidden, http.StatusInternalServerError),
+		}},
+		OpenAPIPath: {Get: &openapi.Operation{
+			OperationID: "getOpenAPI",
+			Summary:     "Get this document.",
+			Responses:   map[string]*openapi.Response{"200": {Description: "The OpenAPI document.", Content: openapi.Content(&openapi.Schema{Type: "object"})}},
+		}},
+	}
+	apiVersion := version.Version()
+	if apiVersion == "" {
+		apiVersion = "unknown"
+	}
+	return &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "vGPU scheduler",
+			Description: "The HTTP endpoints of the vGPU scheduler components. The extender serves /filter and /bind, the webhook /webhook, and the metrics component the rest.",
+			Version:     apiVersion,
+		},
+		Paths:      paths,
+		Components: g.Components(),
+	}
+}
+
+var openAPIJSON struct {
+	once sync.Once
+	data []byte
+}
+
+// OpenAPIHandler serves the OpenAPI document.
+func OpenAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openAPIJSON.once.Do(func() {
+			var err error
+			if openAPIJSON.data, err = json.MarshalIndent(OpenAPI(), "", "  "); err != nil {
+				klog.Errorf("encode the OpenAPI document: %v", err)
+			}
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIJSON.data)
+	})
+}
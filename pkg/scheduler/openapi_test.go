@@ -0,0 +1,120 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/openapi"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestHandlersMatchOpenAPI validates the responses of the list endpoints, with every
+// selection of fields, against the schemas of the document, so a field added to a
+// response without a schema, or left out though required, fails.
+func TestHandlersMatchOpenAPI(t *testing.T) {
+	doc := OpenAPI()
+	v := &openapi.Validator{Components: doc.Components, DisallowUnknownFields: true}
+
+	s := usageScheduler(3)
+	s.podUnschedulable(demandPod("infer", nil), [][]util.ContainerDeviceRequest{
+		{{Nums: 1, Type: util.NvidiaGPUDevice, Memreq: 8000, MemPercentagereq: 101, Coresreq: 30}},
+	})
+	web := ownedPod("web", "web-7d4b9-a", "ReplicaSet", "web-7d4b9", map[string]string{podTemplateHashLabel: "7d4b9"})
+	eff := efficiencyScheduler(t, map[*corev1.Pod]util.ContainerDevices{
+		web: {{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 8000, Usedcores: 30}},
+	})
+	eff.observeUsage("node1", "uid-web-7d4b9-a,main,2000,10")
+
+	for _, tc := range []struct {
+		path    string
+		handler http.Handler
+		queries []string
+	}{
+		{UsagePath, UsageHandler(s), []string{"", "?limit=1", "?fields=summary", "?fields=devices", "?fields=pods"}},
+		{PendingDemandPath, PendingDemandHandler(s), []string{"", "?fields=summary", "?fields=groups"}},
+		{EfficiencyReportPath, EfficiencyReportHandler(eff), []string{"", "?fields=summary", "?fields=workloads"}},
+	} {
+		schema := doc.Paths[tc.path].Get.Responses["200"].Content[openapi.JSON].Schema
+		for _, q := range tc.queries {
+			rec := httptest.NewRecorder()
+			tc.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path+q, nil))
+			assert.Equal(t, rec.Code, http.StatusOK, tc.path+q)
+			assert.NilError(t, v.Validate(schema, rec.Body.Bytes()), tc.path+q)
+		}
+	}
+
+	data, err := json.Marshal(config.Effective())
+	assert.NilError(t, err)
+	assert.NilError(t, v.Validate(doc.Paths[util.ConfigPath].Get.Responses["200"].Content[openapi.JSON].Schema, data))
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	OpenAPIHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	assert.Equal(t, rec.Header().Get("Content-Type"), "application/json")
+	var doc openapi.Document
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, doc.OpenAPI, openapi.Version)
+	assert.Assert(t, doc.Paths[PurgeNodePath+"{node}"].Delete != nil)
+	// every reference resolves
+	refs := 0
+	var check func(s *openapi.Schema)
+	check = func(s *openapi.Schema) {
+		if s == nil {
+			return
+		}
+		if s.Ref != "" {
+			refs++
+			_, ok := doc.Components.Schemas[s.Ref[len("#/components/schemas/"):]]
+			assert.Assert(t, ok, s.Ref)
+		}
+		check(s.Items)
+		check(s.AdditionalProperties)
+		for _, sub := range s.AllOf {
+			check(sub)
+		}
+		for _, p := range s.Properties {
+			check(p)
+		}
+	}
+	for _, s := range doc.Components.Schemas {
+		check(s)
+	}
+	for _, item := range doc.Paths {
+		for _, op := range []*openapi.Operation{item.Get, item.Post, item.Delete} {
+			if op == nil {
+				continue
+			}
+			if op.RequestBody != nil {
+				check(op.RequestBody.Content[openapi.JSON].Schema)
+			}
+			for _, res := range op.Responses {
+				for _, mt := range res.Content {
+					check(mt.Schema)
+				}
+			}
+		}
+	}
+	assert.Assert(t, refs > 0)
+}
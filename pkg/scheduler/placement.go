@@ -0,0 +1,149 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"sync"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// maxPlacementDevices bounds the devices remembered for one placement key on a node.
+const maxPlacementDevices = 8
+
+// placementHistory remembers, for the pods annotated with util.PlacementKeyAnnotation, the
+// devices pods of the same key were placed on lately, so a redeployed model is steered back
+// to GPUs where it may still be warm. It keeps the config.PlacementHistorySize keys used last
+// on each node, most recent first. It is only a preference, calcScore falls back to other
+// devices when those of the key don't fit.
+type placementHistory struct {
+	placementMu sync.Mutex
+	history     map[string][]v1alpha1.VGPUPlacementKey
+}
+
+func (h *placementHistory) init() {
+	h.history = make(map[string][]v1alpha1.VGPUPlacementKey)
+}
+
+// recordPlacement moves key to the front of the history of nodeID, with the devices of pd
+// ahead of those it was placed on before.
+func (h *placementHistory) recordPlacement(nodeID, key string, pd util.PodDevices) {
+	if len(key) == 0 || config.PlacementHistorySize <= 0 {
+		return
+	}
+	var devices []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if !seen[id] && len(devices) < maxPlacementDevices {
+			seen[id] = true
+			devices = append(devices, id)
+		}
+	}
+	for _, cd := range pd {
+		for _, dev := range cd {
+			add(dev.UUID)
+		}
+	}
+	h.placementMu.Lock()
+	defer h.placementMu.Unlock()
+	entries := []v1alpha1.VGPUPlacementKey{{}}
+	for _, e := range h.history[nodeID] {
+		if e.Key != key {
+			entries = append(entries, e)
+			continue
+		}
+		for _, id := range e.Devices {
+			add(id)
+		}
+	}
+	entries[0] = v1alpha1.VGPUPlacementKey{Key: key, Devices: devices}
+	if len(entries) > config.PlacementHistorySize {
+		entries = entries[:config.PlacementHistorySize]
+	}
+	h.history[nodeID] = entries
+}
+
+// preferredDevices returns the devices of nodeID pods with key were placed on lately.
+func (h *placementHistory) preferredDevices(nodeID, key string) map[string]bool {
+	if len(key) == 0 {
+		return nil
+	}
+	h.placementMu.Lock()
+	defer h.placementMu.Unlock()
+	for _, e := range h.history[nodeID] {
+		if e.Key != key {
+			continue
+		}
+		res := make(map[string]bool, len(e.Devices))
+		for _, id := range e.Devices {
+			res[id] = true
+		}
+		return res
+	}
+	return nil
+}
+
+// placements returns a copy of the history of nodeID, to publish in its VGPUNodeStatus.
+func (h *placementHistory) placements(nodeID string) []v1alpha1.VGPUPlacementKey {
+	h.placementMu.Lock()
+	defer h.placementMu.Unlock()
+	var res []v1alpha1.VGPUPlacementKey
+	for _, e := range h.history[nodeID] {
+		res = append(res, *e.DeepCopy())
+	}
+	return res
+}
+
+// restorePlacements takes over the history a previous run published for each node, for
+// nodes that have none yet.
+func (h *placementHistory) restorePlacements(statuses map[string]v1alpha1.VGPUNodeStatusStatus) {
+	if config.PlacementHistorySize <= 0 {
+		return
+	}
+	h.placementMu.Lock()
+	defer h.placementMu.Unlock()
+	for nodeID, status := range statuses {
+		if len(status.PlacementKeys) == 0 || len(h.history[nodeID]) > 0 {
+			continue
+		}
+		entries := make([]v1alpha1.VGPUPlacementKey, 0, len(status.PlacementKeys))
+		for _, e := range status.PlacementKeys {
+			if len(entries) == config.PlacementHistorySize {
+				break
+			}
+			entries = append(entries, *e.DeepCopy())
+		}
+		h.history[nodeID] = entries
+		klog.V(3).Infof("restored %d placement keys of node %v", len(entries), nodeID)
+	}
+}
+
+// markPreferred flags the devices pods with key were placed on lately in usage.
+func (h *placementHistory) markPreferred(usage map[string]*NodeUsage, key string) {
+	if len(key) == 0 {
+		return
+	}
+	for nodeID, node := range usage {
+		preferred := h.preferredDevices(nodeID, key)
+		for _, d := range node.Devices {
+			d.Preferred = preferred[d.Id]
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestFilterPrefersDevicesOfPlacementKey(t *testing.T) {
+	oldName, oldMem, oldSize := util.ResourceName, util.ResourceMem, config.PlacementHistorySize
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem, config.PlacementHistorySize = oldName, oldMem, oldSize
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	config.PlacementHistorySize = 4
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+
+	s := NewScheduler()
+	var devices []DeviceInfo
+	for i := 0; i < 4; i++ {
+		devices = append(devices, DeviceInfo{ID: fmt.Sprintf("GPU-%d", i), Count: 2, Devmem: 16000, Type: "NVIDIA-A100", Health: true})
+	}
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: devices})
+	schedule := func(name, key string) string {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name), Annotations: map[string]string{}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse("4000"),
+				},
+			}}}},
+		}
+		if len(key) > 0 {
+			pod.Annotations[util.PlacementKeyAnnotation] = key
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, *res.NodeNames, []string{"node1"})
+		return s.pods[pod.UID].Devices[0][0].UUID
+	}
+	filler := func(name, uuid string) {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)}}
+		s.addPod(pod, "node1", util.PodDevices{{{UUID: uuid, Type: util.NvidiaGPUDevice, Usedmem: 1000}}})
+	}
+
+	first := schedule("model-v1", "llama")
+	s.delPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "model-v1"}})
+	// the device of the first deployment has fewer shares left than the others now
+	filler("other", first)
+	assert.Assert(t, schedule("unrelated", "") != first)
+	assert.Equal(t, schedule("model-v2", "llama"), first)
+
+	// the device is full, the next replica falls back to another one
+	assert.Assert(t, schedule("model-v3", "llama") != first)
+
+	// a restarted scheduler takes the history over from the VGPUNodeStatus
+	restarted := NewScheduler()
+	restarted.restorePlacements(s.nodeStatuses())
+	assert.Assert(t, restarted.preferredDevices("node1", "llama")[first])
+
+	// the key used longest ago is forgotten first
+	for i := 0; i < config.PlacementHistorySize; i++ {
+		s.recordPlacement("node1", fmt.Sprintf("key-%d", i), util.PodDevices{{{UUID: "GPU-0"}}})
+	}
+	assert.Assert(t, s.preferredDevices("node1", "llama") == nil)
+	assert.Equal(t, len(s.placements("node1")), config.PlacementHistorySize)
+}
@@ -18,8 +18,10 @@ package scheduler
 
 import (
 	"sync"
+	"time"
 
 	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 	corev1 "k8s.io/api/core/v1"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
@@ -32,15 +34,31 @@ type podInfo struct {
 	NodeID    string
 	Devices   util.PodDevices
 	CtrIDs    []string
+	// Exclusive is set for pods that get whole GPUs, see util.WholeGPUs
+	Exclusive bool
+	// MemoryBandwidth is the util.MemoryBandwidthAnnotation of the pod, the bandwidth its
+	// containers are limited to on each of their devices
+	MemoryBandwidth int32
+	// BindPhase and BindTime are the util.DeviceBindPhase of the pod and when it was bound
+	BindPhase string
+	BindTime  time.Time
+	// Claim is set for the ResourceClaims allocated through DRA, which hold devices
+	// of the same pool as the pods, see claims.go
+	Claim bool
+	// ColocateGroup is the key of the co-location group of the pod, see colocate.go
+	ColocateGroup string
 }
 
 type podManager struct {
-	pods  map[k8stypes.UID]*podInfo
-	mutex sync.Mutex
+	pods map[k8stypes.UID]*podInfo
+	// groups are the anchors of the co-location groups with pods placed, by colocateKey
+	groups map[string]*colocateAnchor
+	mutex  sync.Mutex
 }
 
 func (m *podManager) init() {
 	m.pods = make(map[k8stypes.UID]*podInfo)
+	m.groups = make(map[string]*colocateAnchor)
 }
 
 func (m *podManager) addPod(pod *corev1.Pod, nodeID string, devices util.PodDevices) {
@@ -55,18 +73,66 @@ func (m *podManager) addPod(pod *corev1.Pod, nodeID string, devices util.PodDevi
 		pi.Uid = pod.UID
 		pi.NodeID = nodeID
 		pi.Devices = devices
-		klog.Info(pod.Name + "Added")
+		pi.Exclusive = util.WholeGPUs(pod)
+		if val, ok := pod.Annotations[util.MemoryBandwidthAnnotation]; ok {
+			pi.MemoryBandwidth, _ = annotations.DecodeMemoryPercent(val)
+		}
+		m.joinGroup(pi, colocateKey(pod))
+		klog.Info(util.Redact(pod.Name) + " added")
 	}
 }
 
-func (m *podManager) delPod(pod *corev1.Pod) {
+// updatePod replaces the devices of a pod added before, after it was resized.
+func (m *podManager) updatePod(pod *corev1.Pod, devices util.PodDevices) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if pi, ok := m.pods[pod.UID]; ok {
+		pi.Devices = devices
+	}
+}
+
+// setBindPhase records the bind phase of a pod added before.
+func (m *podManager) setBindPhase(pod *corev1.Pod, phase string, bound time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if pi, ok := m.pods[pod.UID]; ok {
+		pi.BindPhase, pi.BindTime = phase, bound
+	}
+}
+
+// delPod forgets a pod, it returns whether the pod was known.
+func (m *podManager) delPod(pod *corev1.Pod) bool {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	pi, ok := m.pods[pod.UID]
 	if ok {
-		klog.Infof(pi.Name + " deleted")
+		klog.Info(util.Redact(pi.Name) + " deleted")
 		delete(m.pods, pod.UID)
+		m.leaveGroup(pi)
+	}
+	return ok
+}
+
+// addClaim accounts the devices a ResourceClaim was allocated on a node.
+func (m *podManager) addClaim(namespace, name string, uid k8stypes.UID, nodeID string, devices util.PodDevices) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.pods[uid]; !ok {
+		m.pods[uid] = &podInfo{Namespace: namespace, Name: name, Uid: uid, NodeID: nodeID, Devices: devices, Claim: true}
+		klog.Infof("claim %v added", util.PodRef(namespace, name))
+	}
+}
+
+// delClaim releases the devices of a ResourceClaim, it returns whether the claim was known.
+func (m *podManager) delClaim(uid k8stypes.UID) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pi, ok := m.pods[uid]
+	if ok && pi.Claim {
+		klog.Infof("claim %v deleted", util.PodRef(pi.Namespace, pi.Name))
+		delete(m.pods, uid)
 	}
+	return ok && pi.Claim
 }
 
 func (m *podManager) GetScheduledPods() (map[k8stypes.UID]*podInfo, error) {
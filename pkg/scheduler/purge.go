@@ -0,0 +1,70 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/util"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// PurgeNodePath is served by the metrics component, followed by the node name, to
+// PurgeNode it.
+const PurgeNodePath = "/nodes/"
+
+// PurgeNode forgets a decommissioned node: its registered devices, the annotations vGPU
+// components wrote to the Node, which would register it again, and its VGPUNodeStatus.
+// The device plugin on the node must be stopped first, or it registers the node again.
+// It returns what was removed, a node already gone from the API server is not an error.
+func (s *Scheduler) PurgeNode(ctx context.Context, name string) ([]string, error) {
+	var removed []string
+	if s.rmNode(name) {
+		removed = append(removed, "devices")
+	}
+	if s.kubeClient != nil {
+		node, err := s.kubeClient.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return removed, err
+		}
+		if err == nil {
+			keys, err := util.RemoveNodeAnnotations(ctx, s.kubeClient, node, util.OwnedNodeAnnotations(), false)
+			if err != nil {
+				return removed, err
+			}
+			for _, k := range keys {
+				removed = append(removed, "annotation "+k)
+			}
+		}
+	}
+	if s.nodeStatus != nil {
+		// the publishing loop drops the node from what it published on its next round
+		obj := &v1alpha1.VGPUNodeStatus{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		err := s.nodeStatus.client.Delete(ctx, obj)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return removed, err
+		}
+		if err == nil {
+			removed = append(removed, "VGPUNodeStatus")
+		}
+	}
+	klog.Infof("purged node %v: %v", name, removed)
+	return removed, nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPurgeNode(t *testing.T) {
+	s := NewScheduler()
+	for _, name := range []string{"node1", "node2"} {
+		s.addNode(name, &NodeInfo{ID: name, Devices: []DeviceInfo{
+			{ID: "GPU-" + name, Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+		}})
+	}
+	s.kubeClient = kubefake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: "node1",
+		Annotations: map[string]string{
+			util.NodeHandshake:                  "Reported 2022.01.01 00:00:00",
+			util.NodeNvidiaDeviceRegistered:     "GPU-node1,10,16000,100,NVIDIA-A100,true:",
+			util.DeviceMemoryExternalAnnotation: "GPU-node1:1000",
+			"example.com/owner":                 "team-a",
+		},
+	}})
+	scheme := runtime.NewScheme()
+	assert.NilError(t, v1alpha1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&v1alpha1.VGPUNodeStatus{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		&v1alpha1.VGPUNodeStatus{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+	).Build()
+	s.nodeStatus = newNodeStatusReconciler(c)
+	ctx := context.Background()
+
+	removed, err := s.PurgeNode(ctx, "node1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, removed, []string{
+		"devices",
+		"annotation " + util.NodeHandshake,
+		"annotation " + util.NodeNvidiaDeviceRegistered,
+		"VGPUNodeStatus",
+	})
+	_, err = s.GetNode("node1")
+	assert.ErrorContains(t, err, "not found")
+	_, err = s.GetNode("node2")
+	assert.NilError(t, err)
+	node, err := s.kubeClient.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, node.Annotations, map[string]string{
+		util.DeviceMemoryExternalAnnotation: "GPU-node1:1000",
+		"example.com/owner":                 "team-a",
+	})
+	err = c.Get(ctx, types.NamespacedName{Name: "node1"}, &v1alpha1.VGPUNodeStatus{})
+	assert.Assert(t, apierrors.IsNotFound(err))
+	assert.NilError(t, c.Get(ctx, types.NamespacedName{Name: "node2"}, &v1alpha1.VGPUNodeStatus{}))
+
+	// purging again finds nothing left
+	removed, err = s.PurgeNode(ctx, "node1")
+	assert.NilError(t, err)
+	assert.Equal(t, len(removed), 0)
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// namespaceQuotas caps the GPU memory the pods of a namespace may be assigned on each
+// node, so one team can't take all GPUs of a node, oversubscribed or not. The quotas are
+// read from the data of a ConfigMap, each key a namespace and each value the MiB of
+// GPU memory per node, like nvidia.com/gpumem. Namespaces without a key are unlimited.
+type namespaceQuotas struct {
+	quotaMutex sync.RWMutex
+	quotas     map[string]int64
+}
+
+func (q *namespaceQuotas) init() {
+	q.quotas = make(map[string]int64)
+}
+
+// setQuotas replaces the quotas with those of cm, nil removes all. Invalid entries are
+// logged and skipped, leaving their namespace unlimited.
+func (q *namespaceQuotas) setQuotas(cm *corev1.ConfigMap) {
+	quotas := make(map[string]int64)
+	if cm != nil {
+		for ns, val := range cm.Data {
+			quota, err := parseQuota(ns, val)
+			if err != nil {
+				klog.Errorf("ConfigMap %v/%v: %v", cm.Namespace, cm.Name, err)
+				continue
+			}
+			quotas[ns] = quota
+		}
+	}
+	logged := make(map[string]int64, len(quotas))
+	for ns, quota := range quotas {
+		logged[util.Redact(ns)] = quota
+	}
+	klog.Infof("Namespace GPU memory quotas per node: %v", logged)
+	q.quotaMutex.Lock()
+	defer q.quotaMutex.Unlock()
+	q.quotas = quotas
+}
+
+// watchQuotas keeps the quotas in sync with the ConfigMap named "namespace/name" by ref.
+func (s *Scheduler) watchQuotas(ref string) error {
+	namespace, name, found := strings.Cut(ref, "/")
+	if !found || namespace == "" || name == "" {
+		return fmt.Errorf("namespace quota ConfigMap %q is not namespace/name", ref)
+	}
+	lw := cache.NewListWatchFromClient(s.kubeClient.CoreV1().RESTClient(), "configmaps", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	_, controller := cache.NewInformer(lw, &corev1.ConfigMap{}, time.Hour, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.setQuotas(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			s.setQuotas(obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(interface{}) {
+			s.setQuotas(nil)
+		},
+	})
+	go controller.Run(s.stopCh)
+	if !cache.WaitForCacheSync(s.stopCh, controller.HasSynced) {
+		return fmt.Errorf("namespace quota ConfigMap %v not synced", ref)
+	}
+	return nil
+}
+
+func parseQuota(ns, val string) (int64, error) {
+	if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+		return 0, fmt.Errorf("invalid namespace %q: %s", ns, strings.Join(errs, ", "))
+	}
+	quota, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil || quota < 0 {
+		return 0, fmt.Errorf("quota %q of namespace %v is not a number of MiB", val, ns)
+	}
+	return quota, nil
+}
+
+// quota returns the GPU memory quota of namespace on each node, ok is false if it has none.
+func (q *namespaceQuotas) quota(namespace string) (quota int64, ok bool) {
+	q.quotaMutex.RLock()
+	defer q.quotaMutex.RUnlock()
+	quota, ok = q.quotas[namespace]
+	return quota, ok
+}
+
+// namespaceNodeUsage returns the GPU memory assigned to the pods of namespace on each node.
+func (s *Scheduler) namespaceNodeUsage(namespace string) map[string]int64 {
+	s.podManager.mutex.Lock()
+	defer s.podManager.mutex.Unlock()
+	usage := make(map[string]int64)
+	for _, p := range s.pods {
+		if p.Namespace != namespace {
+			continue
+		}
+		usage[p.NodeID] += podMemory(p.Devices)
+	}
+	return usage
+}
+
+func podMemory(devices util.PodDevices) int64 {
+	var res int64
+	for _, ctr := range devices {
+		for _, d := range ctr {
+			res += int64(d.Usedmem)
+		}
+	}
+	return res
+}
+
+// withinQuota drops the nodes where the devices chosen for a pod of namespace would take
+// it over its quota, they are added to failedNodes.
+func (s *Scheduler) withinQuota(namespace string, scores NodeScoreList, failedNodes map[string]string) NodeScoreList {
+	quota, ok := s.quota(namespace)
+	if !ok {
+		return scores
+	}
+	usage := s.namespaceNodeUsage(namespace)
+	res := scores[:0]
+	for _, n := range scores {
+		if usage[n.nodeID]+podMemory(n.devices) > quota {
+			failedNodes[n.nodeID] = string(ReasonNamespaceQuota)
+			continue
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// checkQuota returns an error if the pods of namespace on node, assigned already, are
+// assigned more GPU memory than its quota, e.g. after the quota was lowered or when
+// pods were filtered concurrently.
+func (s *Scheduler) checkQuota(namespace, node string) error {
+	quota, ok := s.quota(namespace)
+	if !ok {
+		return nil
+	}
+	if used := s.namespaceNodeUsage(namespace)[node]; used > quota {
+		return fmt.Errorf("namespace %v would use %vMiB of GPU memory on node %v, above its quota of %vMiB", util.Redact(namespace), used, node, quota)
+	}
+	return nil
+}
+
+// NamespaceQuota is the GPU memory quota of a namespace on each node, and what it uses
+// of it on the nodes it has pods on.
+type NamespaceQuota struct {
+	Namespace string
+	Quota     int64
+	Used      map[string]int64
+}
+
+// NamespaceQuotas returns the quotas and their usage.
+func (s *Scheduler) NamespaceQuotas() []NamespaceQuota {
+	s.quotaMutex.RLock()
+	quotas := make(map[string]int64, len(s.quotas))
+	for ns, q := range s.quotas {
+		quotas[ns] = q
+	}
+	s.quotaMutex.RUnlock()
+	var res []NamespaceQuota
+	for ns, q := range quotas {
+		res = append(res, NamespaceQuota{Namespace: ns, Quota: q, Used: s.namespaceNodeUsage(ns)})
+	}
+	return res
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestFilterEnforcesNamespaceQuota(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+
+	s := NewScheduler()
+	for _, node := range []string{"node1", "node2"} {
+		var devices []DeviceInfo
+		for i := 0; i < 4; i++ {
+			devices = append(devices, DeviceInfo{ID: fmt.Sprintf("%s-GPU-%d", node, i), Count: 4, Devmem: 10000, Type: "NVIDIA-A100", Health: true})
+		}
+		s.addNode(node, &NodeInfo{ID: node, Devices: devices})
+	}
+	s.setQuotas(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "vgpu-namespace-quotas"},
+		Data:       map[string]string{"team-a": "25000", "Team_B": "1000", "team-c": "lots"},
+	})
+	_, ok := s.quota("team-a")
+	assert.Assert(t, ok)
+	for _, ns := range []string{"Team_B", "team-c", "team-d"} {
+		_, ok := s.quota(ns)
+		assert.Assert(t, !ok, ns)
+	}
+
+	filter := func(ns string, i int) *extenderv1.ExtenderFilterResult {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: fmt.Sprintf("p%d", i), UID: types.UID(fmt.Sprintf("%s-%d", ns, i))},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse("10000"),
+				},
+			}}}},
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1", "node2"}})
+		assert.NilError(t, err)
+		return res
+	}
+	// two pods of team-a fit its quota on each node
+	for i := 0; i < 4; i++ {
+		res := filter("team-a", i)
+		assert.Equal(t, len(*res.NodeNames), 1, res.Error)
+	}
+	res := filter("team-a", 4)
+	assert.Assert(t, res.NodeNames == nil)
+	assert.DeepEqual(t, res.FailedNodes, extenderv1.FailedNodesMap{
+		"node1": string(ReasonNamespaceQuota),
+		"node2": string(ReasonNamespaceQuota),
+	})
+	// other namespaces still get the GPUs team-a may not use
+	for i := 0; i < 2; i++ {
+		res := filter("team-d", i)
+		assert.Equal(t, len(*res.NodeNames), 1, res.Error)
+	}
+
+	quotas := s.NamespaceQuotas()
+	assert.DeepEqual(t, quotas, []NamespaceQuota{{Namespace: "team-a", Quota: 25000, Used: map[string]int64{"node1": 20000, "node2": 20000}}})
+
+	// binds recheck the quota, which may have been lowered since the pod was filtered
+	assert.NilError(t, s.checkQuota("team-a", "node1"))
+	s.setQuotas(&corev1.ConfigMap{Data: map[string]string{"team-a": "15000"}})
+	assert.ErrorContains(t, s.checkQuota("team-a", "node1"), "namespace team-a would use 20000MiB of GPU memory on node node1, above its quota of 15000MiB")
+	assert.NilError(t, s.checkQuota("team-d", "node1"))
+	s.setQuotas(nil)
+	assert.NilError(t, s.checkQuota("team-a", "node1"))
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FilterReason explains why Filter rejected a node. The values end up in
+// FailedScheduling events and metric labels, so changing them breaks runbooks
+// and dashboards.
+type FilterReason string
+
+const (
+	ReasonNodeUnregistered    FilterReason = "node not registered"
+	ReasonInsufficientDevices FilterReason = "insufficient GPU count"
+	ReasonDevicesFull         FilterReason = "GPU sharing limit reached"
+	ReasonOvercommitted       FilterReason = "GPU memory over-committed"
+	ReasonDrained             FilterReason = "GPU drained for maintenance"
+	// ReasonReserved means an exclusive schedule window leaves the GPU to other pods.
+	ReasonReserved           FilterReason = "GPU reserved by a schedule window"
+	ReasonInsufficientMemory FilterReason = "insufficient GPU memory"
+	// ReasonFragmented means the GPUs have enough free memory together, but not each.
+	ReasonFragmented        FilterReason = "GPU memory fragmented"
+	ReasonInsufficientCores FilterReason = "insufficient GPU cores"
+	// ReasonInsufficientBandwidth means the memory bandwidth limits on the GPU leave too little.
+	ReasonInsufficientBandwidth FilterReason = "insufficient GPU memory bandwidth"
+	ReasonTypeMismatch          FilterReason = "GPU type mismatch"
+	ReasonProfileMismatch       FilterReason = "no GPU of the requested profile"
+	// ReasonNotDistinct means each GPU the pod requests fits some GPU, but not each a GPU of its own.
+	ReasonNotDistinct FilterReason = "not enough distinct GPUs"
+	// ReasonFairShare holds a pod back while a namespace using fewer GPUs waits for them.
+	ReasonFairShare FilterReason = "held back for namespace fair share"
+	// ReasonNamespaceQuota means the pod would take its namespace over its GPU memory quota on the node.
+	ReasonNamespaceQuota FilterReason = "namespace GPU memory quota exceeded"
+	// ReasonColocateGroup means the co-location group of the pod is anchored on another node.
+	ReasonColocateGroup FilterReason = "co-location group anchored on another node"
+)
+
+// filterReasons orders the reasons for ties, most specific last.
+var filterReasons = []FilterReason{
+	ReasonNodeUnregistered,
+	ReasonInsufficientDevices,
+	ReasonDevicesFull,
+	ReasonOvercommitted,
+	ReasonDrained,
+	ReasonReserved,
+	ReasonInsufficientMemory,
+	ReasonFragmented,
+	ReasonInsufficientCores,
+	ReasonInsufficientBandwidth,
+	ReasonTypeMismatch,
+	ReasonProfileMismatch,
+	ReasonNotDistinct,
+}
+
+// maxFilterEventLength keeps per-node details in events readable.
+const maxFilterEventLength = 1024
+
+// dominantReason returns the reason most devices of a node were skipped for.
+func dominantReason(skipped map[FilterReason]int) FilterReason {
+	res := ReasonInsufficientDevices
+	for _, r := range filterReasons {
+		if skipped[r] > 0 && skipped[r] >= skipped[res] {
+			res = r
+		}
+	}
+	return res
+}
+
+type reasonCount struct {
+	reason string
+	count  int
+}
+
+func countReasons(failedNodes map[string]string) []reasonCount {
+	counts := make(map[string]int)
+	for _, r := range failedNodes {
+		counts[r]++
+	}
+	res := make([]reasonCount, 0, len(counts))
+	for r, c := range counts {
+		res = append(res, reasonCount{reason: r, count: c})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].count != res[j].count {
+			return res[i].count > res[j].count
+		}
+		return res[i].reason < res[j].reason
+	})
+	return res
+}
+
+// filterError summarizes why no node fit, e.g.
+// "0/12 nodes are available: 8 insufficient GPU memory, 4 GPU type mismatch".
+func filterError(nodes int, failedNodes map[string]string) string {
+	var parts []string
+	for _, c := range countReasons(failedNodes) {
+		parts = append(parts, fmt.Sprintf("%d %v", c.count, c.reason))
+	}
+	return fmt.Sprintf("0/%d nodes are available: %v", nodes, strings.Join(parts, ", "))
+}
+
+// filterDetails lists the reason of every node, sorted by node name and
+// truncated to maxFilterEventLength.
+func filterDetails(failedNodes map[string]string) string {
+	names := make([]string, 0, len(failedNodes))
+	for n := range failedNodes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, n := range names {
+		entry := fmt.Sprintf("%v: %v", n, failedNodes[n])
+		if i > 0 {
+			entry = "; " + entry
+		}
+		if b.Len()+len(entry) > maxFilterEventLength {
+			fmt.Fprintf(&b, "; and %d more", len(names)-i)
+			break
+		}
+		b.WriteString(entry)
+	}
+	return b.String()
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+// The strings below are shown to users and matched by runbooks, don't change
+// them without a release note.
+func TestFilterReasonStrings(t *testing.T) {
+	var got []string
+	for _, r := range filterReasons {
+		got = append(got, string(r))
+	}
+	assert.DeepEqual(t, got, []string{
+		"node not registered",
+		"insufficient GPU count",
+		"GPU sharing limit reached",
+		"GPU memory over-committed",
+		"GPU drained for maintenance",
+		"GPU reserved by a schedule window",
+		"insufficient GPU memory",
+		"GPU memory fragmented",
+		"insufficient GPU cores",
+		"insufficient GPU memory bandwidth",
+		"GPU type mismatch",
+		"no GPU of the requested profile",
+		"not enough distinct GPUs",
+	})
+}
+
+func TestFilterError(t *testing.T) {
+	failed := map[string]string{
+		"node1": string(ReasonInsufficientMemory),
+		"node2": string(ReasonInsufficientMemory),
+		"node3": string(ReasonTypeMismatch),
+		"node4": string(ReasonNodeUnregistered),
+		"node5": string(ReasonInsufficientMemory),
+	}
+	assert.Equal(t, filterError(6, failed),
+		"0/6 nodes are available: 3 insufficient GPU memory, 1 GPU type mismatch, 1 node not registered")
+	assert.Equal(t, filterDetails(failed),
+		"node1: insufficient GPU memory; node2: insufficient GPU memory; node3: GPU type mismatch; "+
+			"node4: node not registered; node5: insufficient GPU memory")
+}
+
+func TestFilterDetailsTruncated(t *testing.T) {
+	failed := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		failed[fmt.Sprintf("node%03d", i)] = string(ReasonInsufficientCores)
+	}
+	details := filterDetails(failed)
+	assert.Assert(t, len(details) <= maxFilterEventLength+len("; and 100 more"))
+	assert.Assert(t, strings.HasPrefix(details, "node000: insufficient GPU cores; node001: "))
+	assert.Assert(t, strings.HasSuffix(details, "; and 69 more"), details)
+}
+
+func TestFilterReportsReasons(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	t.Cleanup(func() { util.ResourceName, util.ResourceMem = oldName, oldMem })
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	s := NewScheduler()
+	recorder := record.NewFakeRecorder(1)
+	s.eventRecorder = recorder
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 1000, Type: "NVIDIA-V100", Health: true},
+	}})
+	s.addNode("node2", &NodeInfo{ID: "node2", Devices: []DeviceInfo{
+		{ID: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid", Annotations: map[string]string{
+			util.GPUInUse: "V100",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+				corev1.ResourceName(util.ResourceMem):  resource.MustParse("4000"),
+			},
+		}}}},
+	}
+	before := testutil.ToFloat64(FilterFailures.WithLabelValues(string(ReasonTypeMismatch)))
+
+	res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1", "node2", "node3"}})
+	assert.NilError(t, err)
+	assert.Equal(t, res.Error, "0/3 nodes are available: 1 GPU type mismatch, 1 insufficient GPU memory, 1 node not registered")
+	assert.DeepEqual(t, res.FailedNodes, extenderv1.FailedNodesMap{
+		"node1": "insufficient GPU memory",
+		"node2": "GPU type mismatch",
+		"node3": "node not registered",
+	})
+	assert.Equal(t, <-recorder.Events, "Warning FilteringFailed "+
+		"node1: insufficient GPU memory; node2: GPU type mismatch; node3: node not registered")
+	assert.Equal(t, testutil.ToFloat64(FilterFailures.WithLabelValues(string(ReasonTypeMismatch))), before+1)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestRedactTenantInfo(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+		util.RedactTenantInfo = false
+		klog.SetOutput(nil)
+		klog.LogToStderr(true)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	util.RedactTenantInfo = true
+	var logs bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&logs)
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{}}})
+	util.SetClient(client)
+
+	s := NewScheduler()
+	s.kubeClient = client
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{{ID: "GPU-0", Count: 1, Devmem: 10000, Type: "NVIDIA-A100", Health: true}}})
+	newPod := func(name string, uid types.UID) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "acme-research", Name: name, UID: uid},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse("8000"),
+				},
+			}}}},
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		return pod
+	}
+
+	placed := newPod("llm-finetune-7", "uid-1")
+	res, err := s.Filter(extenderv1.ExtenderArgs{Pod: placed, NodeNames: &[]string{"node1"}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *res.NodeNames, []string{"node1"})
+	// the GPU is taken
+	res, err = s.Filter(extenderv1.ExtenderArgs{Pod: newPod("llm-eval-3", "uid-2"), NodeNames: &[]string{"node1"}})
+	assert.NilError(t, err)
+	assert.Assert(t, res.NodeNames == nil)
+	_, err = s.Bind(context.Background(), extenderv1.ExtenderBindingArgs{PodName: placed.Name, PodNamespace: placed.Namespace, PodUID: placed.UID, Node: "node1"})
+	assert.NilError(t, err)
+	// the API server error quotes the name of a pod that is gone
+	bound, err := s.Bind(context.Background(), extenderv1.ExtenderBindingArgs{PodName: "llm-gone-1", PodNamespace: placed.Namespace, Node: "node1"})
+	assert.NilError(t, err)
+	assert.Assert(t, bound.Error != "")
+	assert.Assert(t, !strings.Contains(bound.Error, "llm-gone-1"), bound.Error)
+	klog.Flush()
+
+	out := logs.String()
+	for _, raw := range []string{"acme-research", "llm-finetune-7", "llm-eval-3", "llm-gone-1"} {
+		assert.Assert(t, !strings.Contains(out, raw), "%v logged in:\n%v", raw, out)
+	}
+	ref := util.PodRef("acme-research", "llm-finetune-7")
+	assert.Assert(t, strings.Contains(out, fmt.Sprintf("schedule %v to node1", ref)), out)
+	assert.Assert(t, strings.Contains(out, util.Redact("llm-gone-1")), out)
+}
+
+func TestRedact(t *testing.T) {
+	t.Cleanup(func() { util.RedactTenantInfo = false })
+	assert.Equal(t, util.PodRef("team-a", "job-1"), "team-a/job-1")
+	assert.Equal(t, util.RedactIn(`pods "job-1" not found`, "job-1"), `pods "job-1" not found`)
+
+	util.RedactTenantInfo = true
+	assert.Equal(t, util.Redact("team-a"), util.Redact("team-a"))
+	assert.Assert(t, util.Redact("team-a") != util.Redact("team-b"))
+	assert.Equal(t, len(util.Redact("team-a")), len("h-")+10)
+	assert.Equal(t, util.Redact(""), "")
+	assert.Equal(t, util.RedactIn(`pods "team-a-job" not found in team-a`, "team-a", "team-a-job"),
+		fmt.Sprintf(`pods "%v" not found in %v`, util.Redact("team-a-job"), util.Redact("team-a")))
+}
+
+func TestRedactEvents(t *testing.T) {
+	t.Cleanup(func() { util.RedactTenantInfo = false })
+	util.RedactTenantInfo = true
+	s := NewScheduler()
+	recorder := record.NewFakeRecorder(2)
+	s.eventRecorder = recorder
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "acme-research", Name: "llm-finetune-7", Annotations: map[string]string{
+		util.ColocateGroupAnnotation: "acme-train",
+	}}}
+
+	s.colocateFailed(pod, colocateAnchor{NodeID: "node1", Devices: []string{"GPU-0"}}, map[string]string{"node1": string(ReasonDevicesFull)})
+	s.malformedAnnotation(pod, util.AssignedIDsAnnotations, fmt.Errorf("pod acme-research/llm-finetune-7: bad value"))
+	for _, want := range []string{
+		fmt.Sprintf("co-location group %v is anchored on GPUs GPU-0 of node node1", util.Redact("acme-train")),
+		fmt.Sprintf("pod %v: bad value", util.PodRef("acme-research", "llm-finetune-7")),
+	} {
+		event := <-recorder.Events
+		assert.Assert(t, strings.Contains(event, want), event)
+		for _, raw := range []string{"acme-research", "llm-finetune-7", "acme-train"} {
+			assert.Assert(t, !strings.Contains(event, raw), event)
+		}
+	}
+}
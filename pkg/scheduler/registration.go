@@ -0,0 +1,153 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// The bounds of a registration. They are far beyond any real node, a device plugin
+// exceeding them is broken, and its devices are better left out than accounted with.
+const (
+	maxRegisteredDevices = 64
+	// maxDeviceMemory is in MiB, 1TiB
+	maxDeviceMemory = 1 << 20
+	maxDeviceCount  = 1024
+	maxDeviceID     = 128
+	maxDeviceType   = 128
+)
+
+// The reasons a registration is rejected for, they label InvalidRegistrations.
+const (
+	RegistrationMalformed      = "malformed"
+	RegistrationMissingNode    = "missing_node"
+	RegistrationNodeChanged    = "node_changed"
+	RegistrationTooManyDevices = "too_many_devices"
+	RegistrationInvalidID      = "invalid_id"
+	RegistrationDuplicateID    = "duplicate_id"
+	RegistrationInvalidType    = "invalid_type"
+	RegistrationMemoryRange    = "memory_out_of_range"
+	RegistrationCountRange     = "count_out_of_range"
+)
+
+// InvalidRegistrationError rejects the devices a node registered, none of them are
+// added. Register returns it to the device plugin as codes.InvalidArgument.
+type InvalidRegistrationError struct {
+	Node string
+	// Device is the ID of the offending device, "" when the registration as a whole is
+	Device string
+	Reason string
+	Detail string
+}
+
+func (e *InvalidRegistrationError) Error() string {
+	if len(e.Device) > 0 {
+		return fmt.Sprintf("invalid registration of node %q: device %q: %v", e.Node, e.Device, e.Detail)
+	}
+	return fmt.Sprintf("invalid registration of node %q: %v", e.Node, e.Detail)
+}
+
+// GRPCStatus lets the gRPC server send the error with its code.
+func (e *InvalidRegistrationError) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, e.Error())
+}
+
+// validateRegisterRequest checks a request received on a Register stream that
+// registered node so far, "" before its first request.
+func validateRegisterRequest(node string, req *api.RegisterRequest) error {
+	if len(req.GetNode()) == 0 {
+		return &InvalidRegistrationError{Node: node, Reason: RegistrationMissingNode, Detail: "no node name"}
+	}
+	if len(node) > 0 && req.GetNode() != node {
+		return &InvalidRegistrationError{Node: node, Reason: RegistrationNodeChanged,
+			Detail: fmt.Sprintf("the stream registers node %q now", req.GetNode())}
+	}
+	return validateDevices(req.GetNode(), req.GetDevices())
+}
+
+// validateDevices checks the devices registered on node are within the bounds above.
+func validateDevices(node string, devs []*api.DeviceInfo) error {
+	if len(devs) > maxRegisteredDevices {
+		return &InvalidRegistrationError{Node: node, Reason: RegistrationTooManyDevices,
+			Detail: fmt.Sprintf("%d devices, at most %d are accepted", len(devs), maxRegisteredDevices)}
+	}
+	seen := make(map[string]bool, len(devs))
+	for _, d := range devs {
+		id := d.GetId()
+		invalid := func(reason, format string, args ...interface{}) error {
+			return &InvalidRegistrationError{Node: node, Device: id, Reason: reason, Detail: fmt.Sprintf(format, args...)}
+		}
+		switch {
+		case len(id) == 0:
+			return invalid(RegistrationInvalidID, "empty UUID")
+		case len(id) > maxDeviceID || !utf8.ValidString(id):
+			return invalid(RegistrationInvalidID, "UUID longer than %d bytes or not UTF-8", maxDeviceID)
+		case seen[id]:
+			return invalid(RegistrationDuplicateID, "registered twice")
+		case len(d.GetType()) > maxDeviceType || !utf8.ValidString(d.GetType()):
+			return invalid(RegistrationInvalidType, "type longer than %d bytes or not UTF-8", maxDeviceType)
+		case d.GetDevmem() < 0 || d.GetDevmem() > maxDeviceMemory:
+			return invalid(RegistrationMemoryRange, "memory %vm not within [0, %vm]", d.GetDevmem(), maxDeviceMemory)
+		case d.GetPhysmem() < 0 || d.GetPhysmem() > maxDeviceMemory:
+			return invalid(RegistrationMemoryRange, "physical memory %vm not within [0, %vm]", d.GetPhysmem(), maxDeviceMemory)
+		case d.GetCount() < 0 || d.GetCount() > maxDeviceCount:
+			return invalid(RegistrationCountRange, "split count %v not within [0, %v]", d.GetCount(), maxDeviceCount)
+		case d.GetMaxshares() < 0 || d.GetMaxshares() > maxDeviceCount:
+			return invalid(RegistrationCountRange, "max shares %v not within [0, %v]", d.GetMaxshares(), maxDeviceCount)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// rejectRegistration counts and logs a registration rejected with err, and records it
+// on the node, where whoever looks after the device plugin sees it.
+func (s *Scheduler) rejectRegistration(node string, err error) {
+	reason := RegistrationMalformed
+	var invalid *InvalidRegistrationError
+	if errors.As(err, &invalid) {
+		reason = invalid.Reason
+	}
+	InvalidRegistrations.WithLabelValues(reason).Inc()
+	klog.Errorf("rejected the devices registered by node %v, keeping them out of scheduling: %v", node, err)
+	if s.eventRecorder != nil && len(node) > 0 {
+		ref := &corev1.ObjectReference{Kind: "Node", Name: node, UID: types.UID(node)}
+		s.eventRecorder.Eventf(ref, corev1.EventTypeWarning, "InvalidRegistration", "rejected the registered devices: %v", err)
+	}
+}
+
+// clampRegistered keeps the figures of a registered device within the bounds above, for
+// registrations that got past validation some other way; accounting with a negative
+// capacity makes the node look infinitely free.
+func clampRegistered(v int32, max int32) int32 {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
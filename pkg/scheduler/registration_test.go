@@ -0,0 +1,183 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateDevices(t *testing.T) {
+	valid := func() *api.DeviceInfo {
+		return &api.DeviceInfo{Id: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true, Physmem: 16000}
+	}
+	assert.NilError(t, validateDevices("node1", []*api.DeviceInfo{valid()}))
+	assert.NilError(t, validateDevices("node1", nil))
+
+	tooMany := make([]*api.DeviceInfo, maxRegisteredDevices+1)
+	for i := range tooMany {
+		tooMany[i] = valid()
+		tooMany[i].Id = "GPU-" + string(rune('a'+i%26)) + strings.Repeat("x", i/26)
+	}
+	for reason, devs := range map[string][]*api.DeviceInfo{
+		RegistrationTooManyDevices: tooMany,
+		RegistrationDuplicateID:    {valid(), valid()},
+	} {
+		var invalid *InvalidRegistrationError
+		assert.Assert(t, errors.As(validateDevices("node1", devs), &invalid), reason)
+		assert.Equal(t, invalid.Reason, reason)
+	}
+	for reason, change := range map[string]func(d *api.DeviceInfo){
+		RegistrationInvalidID:   func(d *api.DeviceInfo) { d.Id = "" },
+		RegistrationInvalidType: func(d *api.DeviceInfo) { d.Type = "NVIDIA-\xff" },
+		RegistrationMemoryRange: func(d *api.DeviceInfo) { d.Devmem = -1 },
+		RegistrationCountRange:  func(d *api.DeviceInfo) { d.Maxshares = maxDeviceCount + 1 },
+	} {
+		d := valid()
+		change(d)
+		var invalid *InvalidRegistrationError
+		assert.Assert(t, errors.As(validateDevices("node1", []*api.DeviceInfo{d}), &invalid), reason)
+		assert.Equal(t, invalid.Reason, reason)
+	}
+	d := valid()
+	d.Type = strings.Repeat("x", maxDeviceType+1)
+	assert.Error(t, validateDevices("node1", []*api.DeviceInfo{d}),
+		`invalid registration of node "node1": device "GPU-0": type longer than 128 bytes or not UTF-8`)
+	assert.Equal(t, status.Code(validateDevices("node1", []*api.DeviceInfo{d})), codes.InvalidArgument)
+}
+
+func FuzzRegistration(f *testing.F) {
+	f.Add("GPU-0,10,16000,NVIDIA-Tesla V100,true:GPU-1,10,16000,NVIDIA-Tesla V100,false:")
+	f.Add("GPU-0,10,-1,NVIDIA,true:")
+	f.Add("GPU-0,-10,16000,NVIDIA,true,-16000,-1:")
+	f.Add("GPU-0,10,2147483647,NVIDIA,true:GPU-0,10,16000,NVIDIA,true:")
+	f.Add(",10,16000,\xff,true:")
+	s := NewScheduler()
+	f.Fuzz(func(t *testing.T, str string) {
+		devs, err := annotations.DecodeNodeDevices(str)
+		if err != nil {
+			return
+		}
+		valid := validateDevices("node1", devs) == nil
+		for _, d := range devs {
+			info := s.deviceInfo("node1", d)
+			// whatever got through, accounting never sees a negative capacity
+			assert.Assert(t, info.Count >= 0 && info.MaxShares >= 0 && info.Devmem >= 0 && info.Physmem >= 0, str)
+			assert.Assert(t, info.Devmem <= maxDeviceMemory && info.Count <= maxDeviceCount, str)
+			if valid {
+				assert.Assert(t, len(info.ID) > 0, str)
+				assert.Equal(t, info.Count, d.Count, str)
+				assert.Equal(t, info.Advertisedmem, d.Devmem, str)
+			}
+		}
+	})
+}
+
+// registeredDevices returns the number of devices registered on nodeID.
+func registeredDevices(s *Scheduler, nodeID string) int {
+	node, err := s.GetNode(nodeID)
+	if err != nil {
+		return 0
+	}
+	return len(node.Devices)
+}
+
+func waitRegistered(t *testing.T, s *Scheduler, nodeID string, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for registeredDevices(s, nodeID) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %v has %d devices registered, want %d", nodeID, registeredDevices(s, nodeID), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterRejectsPoisonedRegistration(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "scheduler.sock")
+	ln, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	s := NewScheduler()
+	server := grpc.NewServer()
+	api.RegisterDeviceServiceServer(server, s)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NilError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	register := func(node string, devs ...*api.DeviceInfo) api.DeviceService_RegisterClient {
+		stream, err := api.NewDeviceServiceClient(conn).Register(ctx)
+		assert.NilError(t, err)
+		assert.NilError(t, stream.Send(&api.RegisterRequest{Node: node, Devices: devs}))
+		return stream
+	}
+	gpu := func(id string, mem int32) *api.DeviceInfo {
+		return &api.DeviceInfo{Id: id, Count: 10, Devmem: mem, Type: "NVIDIA-A100", Health: true}
+	}
+
+	a := register("node-a", gpu("GPU-a0", 16000), gpu("GPU-a1", 16000))
+	defer a.CloseSend()
+	b := register("node-b", gpu("GPU-b0", 16000))
+	waitRegistered(t, s, "node-a", 2)
+	waitRegistered(t, s, "node-b", 1)
+
+	before := testutil.ToFloat64(InvalidRegistrations.WithLabelValues(RegistrationMemoryRange))
+	// the buggy node reports an underflowed memory size
+	assert.NilError(t, b.Send(&api.RegisterRequest{Node: "node-b", Devices: []*api.DeviceInfo{gpu("GPU-b0", -2147483648)}}))
+	_, err = b.CloseAndRecv()
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	assert.ErrorContains(t, err, `device "GPU-b0": memory -2147483648m not within`)
+	assert.Equal(t, testutil.ToFloat64(InvalidRegistrations.WithLabelValues(RegistrationMemoryRange)), before+1)
+	waitRegistered(t, s, "node-b", 0)
+
+	c := register("node-c", gpu("GPU-c0", 16000))
+	waitRegistered(t, s, "node-c", 1)
+	// and another one claims the devices of a healthy node
+	assert.NilError(t, c.Send(&api.RegisterRequest{Node: "node-a", Devices: []*api.DeviceInfo{gpu("GPU-a0", 1<<30)}}))
+	_, err = c.CloseAndRecv()
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	assert.ErrorContains(t, err, `the stream registers node "node-a" now`)
+	waitRegistered(t, s, "node-c", 0)
+
+	// the accounting of the healthy node is untouched, and only it takes pods
+	assert.Equal(t, registeredDevices(s, "node-a"), 2)
+	usage, failed, err := s.getNodesUsage(&[]string{"node-a", "node-b", "node-c"}, nil)
+	assert.NilError(t, err)
+	for _, d := range (*usage)["node-a"].Devices {
+		assert.Equal(t, d.Totalmem, int32(16000))
+	}
+	res, err := calcScore(usage, &failed, gpuRequest(1, 8000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].nodeID, "node-a")
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// requestProfileReloadInterval is how often the request profile file is read again, a
+// ConfigMap volume is updated in place.
+const requestProfileReloadInterval = 10 * time.Second
+
+// RequestProfile is a named amount of GPU, e.g. "small", pods ask for with
+// util.VGPUProfileAnnotation instead of resource limits. Memory is in MiB and cores in
+// percent of a GPU, on GPUs of the types listed they are replaced by the first type whose
+// name the GPU type contains.
+type RequestProfile struct {
+	Name   string               `json:"name"`
+	Memory int32                `json:"memory,omitempty"`
+	Cores  int32                `json:"cores,omitempty"`
+	Types  []RequestProfileType `json:"types,omitempty"`
+}
+
+// RequestProfileType is the memory and cores of a RequestProfile on GPUs of a type, the
+// cores of the profile unless Cores is set.
+type RequestProfileType struct {
+	Type   string `json:"type"`
+	Memory int32  `json:"memory"`
+	Cores  *int32 `json:"cores,omitempty"`
+}
+
+type requestProfileFile struct {
+	Profiles []*RequestProfile `json:"profiles"`
+}
+
+// parseRequestProfiles reads the profiles of a request profile file, keyed by name.
+func parseRequestProfiles(data []byte) (map[string]*RequestProfile, error) {
+	var file requestProfileFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	res := make(map[string]*RequestProfile, len(file.Profiles))
+	for _, p := range file.Profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("profile without a name")
+		}
+		if _, ok := res[p.Name]; ok {
+			return nil, fmt.Errorf("profile %v is defined twice", p.Name)
+		}
+		if err := validateRequestProfile(p); err != nil {
+			return nil, fmt.Errorf("profile %v: %v", p.Name, err)
+		}
+		res[p.Name] = p
+	}
+	return res, nil
+}
+
+func validateRequestProfile(p *RequestProfile) error {
+	switch {
+	case p.Memory < 0:
+		return fmt.Errorf("memory %v is negative", p.Memory)
+	case p.Cores < 0 || p.Cores > 100:
+		return fmt.Errorf("cores %v is not in [0,100]", p.Cores)
+	case p.Memory == 0 && len(p.Types) == 0:
+		return fmt.Errorf("no memory on any GPU type")
+	}
+	for _, t := range p.Types {
+		switch {
+		case strings.TrimSpace(t.Type) == "" || strings.ContainsAny(t.Type, ",:"):
+			return fmt.Errorf("type %q is empty or has a \",\" or \":\"", t.Type)
+		case t.Memory <= 0:
+			return fmt.Errorf("type %v: memory %v is not positive", t.Type, t.Memory)
+		case t.Cores != nil && (*t.Cores < 0 || *t.Cores > 100):
+			return fmt.Errorf("type %v: cores %v is not in [0,100]", t.Type, *t.Cores)
+		}
+	}
+	return nil
+}
+
+// typeRequests returns the memory and cores of p on each of its GPU types.
+func (p *RequestProfile) typeRequests() []util.TypeRequest {
+	res := make([]util.TypeRequest, 0, len(p.Types))
+	for _, t := range p.Types {
+		cores := p.Cores
+		if t.Cores != nil {
+			cores = *t.Cores
+		}
+		res = append(res, util.TypeRequest{Type: strings.TrimSpace(t.Type), Memreq: t.Memory, Coresreq: cores})
+	}
+	return res
+}
+
+// requestProfiles are the profiles of a request profile file, read again whenever it
+// changes. A file that stops parsing leaves the profiles read last in place.
+type requestProfiles struct {
+	path     string
+	mu       sync.RWMutex
+	data     []byte
+	profiles map[string]*RequestProfile
+}
+
+// loadRequestProfiles reads the profiles of the file at path.
+func loadRequestProfiles(path string) (*requestProfiles, error) {
+	p := &requestProfiles{path: path}
+	if _, err := p.reload(); err != nil {
+		return nil, fmt.Errorf("request profiles %v: %v", path, err)
+	}
+	return p, nil
+}
+
+// reload reads the file again and returns whether the profiles changed.
+func (p *requestProfiles) reload() (bool, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return false, err
+	}
+	p.mu.RLock()
+	same := p.profiles != nil && bytes.Equal(data, p.data)
+	p.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	profiles, err := parseRequestProfiles(data)
+	if err != nil {
+		return false, err
+	}
+	p.mu.Lock()
+	p.data, p.profiles = data, profiles
+	p.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the file every requestProfileReloadInterval, it never returns.
+func (p *requestProfiles) watch() {
+	for range time.Tick(requestProfileReloadInterval) {
+		changed, err := p.reload()
+		if err != nil {
+			klog.Errorf("Keeping the request profiles read last from %v: %v", p.path, err)
+			continue
+		}
+		if changed {
+			klog.Infof("Reloaded request profiles %v from %v", strings.Join(p.names(), ", "), p.path)
+		}
+	}
+}
+
+// get returns the profile named name, nil when there is none.
+func (p *requestProfiles) get(name string) *RequestProfile {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.profiles[name]
+}
+
+// names returns the names of the profiles, sorted.
+func (p *requestProfiles) names() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]string, 0, len(p.profiles))
+	for name := range p.profiles {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// applyRequestProfile turns the profile the pod names with util.VGPUProfileAnnotation into
+// resource limits: the containers asking for vGPUs get the memory and cores of the
+// profile, or, when none does, every container one vGPU with them, like a GPURequest.
+// The memory and cores on each GPU type go into util.VGPUProfileTypesAnnotation, and a
+// profile with memory on the GPU types listed only restricts the pod to them with
+// util.GPUInUse. It returns why the pod is denied.
+func applyRequestProfile(pod *corev1.Pod, profiles *requestProfiles) string {
+	name := pod.Annotations[util.VGPUProfileAnnotation]
+	p := profiles.get(name)
+	if p == nil {
+		valid := profiles.names()
+		if len(valid) == 0 {
+			return fmt.Sprintf("unknown vGPU profile %q, no profiles are configured", name)
+		}
+		return fmt.Sprintf("unknown vGPU profile %q, valid profiles: %v", name, strings.Join(valid, ", "))
+	}
+	limits := corev1.ResourceList{}
+	if p.Memory > 0 {
+		limits[corev1.ResourceName(util.ResourceMem)] = *resource.NewQuantity(int64(p.Memory), resource.DecimalSI)
+	}
+	if p.Cores > 0 {
+		limits[corev1.ResourceName(util.ResourceCores)] = *resource.NewQuantity(int64(p.Cores), resource.DecimalSI)
+	}
+	annos := map[string]string{}
+	if len(p.Types) > 0 {
+		typeReqs := p.typeRequests()
+		annos[util.VGPUProfileTypesAnnotation] = annotations.EncodeTypeRequests(typeReqs)
+		if p.Memory == 0 {
+			types := make([]string, 0, len(typeReqs))
+			for _, t := range typeReqs {
+				types = append(types, t.Type)
+			}
+			if old, ok := pod.Annotations[util.GPUInUse]; ok && old != strings.Join(types, ",") {
+				return fmt.Sprintf("annotation %v is %q, vGPU profile %v has memory on %v only", util.GPUInUse, old, name, strings.Join(types, ","))
+			}
+			annos[util.GPUInUse] = strings.Join(types, ",")
+		}
+	}
+
+	var gpus []*corev1.Container
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		for res := range c.Resources.Limits {
+			if _, gpu := util.ResourceProfile(string(res)); gpu {
+				gpus = append(gpus, c)
+				break
+			}
+		}
+	}
+	for _, c := range gpus {
+		for _, res := range []string{util.ResourceMem, util.ResourceMemPercentage, util.ResourceCores} {
+			_, limit := c.Resources.Limits[corev1.ResourceName(res)]
+			_, request := c.Resources.Requests[corev1.ResourceName(res)]
+			if limit || request {
+				return fmt.Sprintf("container %v sets %v itself and through vGPU profile %v", c.Name, res, name)
+			}
+		}
+	}
+	if len(gpus) == 0 {
+		limits[corev1.ResourceName(util.ResourceName)] = *resource.NewQuantity(1, resource.DecimalSI)
+		for i := range pod.Spec.Containers {
+			c := &pod.Spec.Containers[i]
+			if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged || requestsDevices(c) {
+				continue
+			}
+			gpus = append(gpus, c)
+		}
+		if len(gpus) == 0 {
+			return fmt.Sprintf("vGPU profile %v applies to no container of the pod", name)
+		}
+	}
+	for _, c := range gpus {
+		if c.Resources.Limits == nil {
+			c.Resources.Limits = corev1.ResourceList{}
+		}
+		for res, q := range limits {
+			c.Resources.Limits[res] = q
+		}
+	}
+	// the types of the profile replace any the pod brought along
+	delete(pod.Annotations, util.VGPUProfileTypesAnnotation)
+	for key, val := range annos {
+		pod.Annotations[key] = val
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testRequestProfiles = `{"profiles": [
+	{"name": "small", "memory": 3000, "cores": 20, "types": [
+		{"type": "T4", "memory": 4000},
+		{"type": "A10", "memory": 6000, "cores": 30}
+	]},
+	{"name": "large", "types": [{"type": "A100", "memory": 40000, "cores": 100}]},
+	{"name": "tiny", "memory": 1000}
+]}`
+
+func testProfiles(t *testing.T, data string) *requestProfiles {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	assert.NilError(t, os.WriteFile(path, []byte(data), 0644))
+	p, err := loadRequestProfiles(path)
+	assert.NilError(t, err)
+	return p
+}
+
+func TestParseRequestProfiles(t *testing.T) {
+	profiles, err := parseRequestProfiles([]byte(testRequestProfiles))
+	assert.NilError(t, err)
+	assert.Equal(t, len(profiles), 3)
+	assert.DeepEqual(t, profiles["small"].typeRequests(), []util.TypeRequest{
+		{Type: "T4", Memreq: 4000, Coresreq: 20},
+		{Type: "A10", Memreq: 6000, Coresreq: 30},
+	})
+
+	for data, want := range map[string]string{
+		`{"profiles": [{"memory": 1000}]}`:                                          "profile without a name",
+		`{"profiles": [{"name": "a", "memory": 1000}, {"name": "a", "memory": 1}]}`: "profile a is defined twice",
+		`{"profiles": [{"name": "a", "cores": 20}]}`:                                "profile a: no memory on any GPU type",
+		`{"profiles": [{"name": "a", "memory": 1000, "cores": 101}]}`:               "profile a: cores 101 is not in [0,100]",
+		`{"profiles": [{"name": "a", "types": [{"type": "T4"}]}]}`:                  "profile a: type T4: memory 0 is not positive",
+		`{"profiles": [{"name": "a", "types": [{"type": "T4,A10", "memory": 1}]}]}`: `profile a: type "T4,A10" is empty`,
+	} {
+		_, err := parseRequestProfiles([]byte(data))
+		assert.ErrorContains(t, err, want, data)
+	}
+}
+
+func TestApplyRequestProfile(t *testing.T) {
+	setGPURequestResources(t)
+	profiles := testProfiles(t, testRequestProfiles)
+	newPod := func(profile string, containers ...corev1.Container) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{util.VGPUProfileAnnotation: profile}},
+			Spec:       corev1.PodSpec{Containers: containers},
+		}
+	}
+	gpus := func(n string) corev1.ResourceRequirements {
+		return corev1.ResourceRequirements{Limits: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse(n)}}
+	}
+
+	// the containers asking for vGPUs get the profile
+	pod := newPod("small", corev1.Container{Name: "train", Resources: gpus("2")}, corev1.Container{Name: "sidecar"})
+	assert.Equal(t, applyRequestProfile(pod, profiles), "")
+	assert.DeepEqual(t, pod.Spec.Containers[0].Resources.Limits, corev1.ResourceList{
+		"nvidia.com/gpu":      resource.MustParse("2"),
+		"nvidia.com/gpumem":   resource.MustParse("3000"),
+		"nvidia.com/gpucores": resource.MustParse("20"),
+	})
+	assert.Assert(t, pod.Spec.Containers[1].Resources.Limits == nil)
+	assert.DeepEqual(t, pod.Annotations, map[string]string{
+		util.VGPUProfileAnnotation:      "small",
+		util.VGPUProfileTypesAnnotation: "T4,4000,20:A10,6000,30",
+	})
+
+	// without any, every container gets one vGPU, a profile with memory on some types
+	// only restricts the pod to them
+	pod = newPod("large", corev1.Container{Name: "train"})
+	assert.Equal(t, applyRequestProfile(pod, profiles), "")
+	assert.DeepEqual(t, pod.Spec.Containers[0].Resources.Limits, corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")})
+	assert.Equal(t, pod.Annotations[util.GPUInUse], "A100")
+	assert.Equal(t, pod.Annotations[util.VGPUProfileTypesAnnotation], "A100,40000,100")
+
+	pod = newPod("tiny", corev1.Container{Name: "train"})
+	pod.Annotations[util.VGPUProfileTypesAnnotation] = "T4,100,0"
+	assert.Equal(t, applyRequestProfile(pod, profiles), "")
+	_, ok := pod.Annotations[util.VGPUProfileTypesAnnotation]
+	assert.Assert(t, !ok)
+
+	assert.Equal(t, applyRequestProfile(newPod("medium", corev1.Container{Name: "train"}), profiles),
+		`unknown vGPU profile "medium", valid profiles: large, small, tiny`)
+	assert.Equal(t, applyRequestProfile(newPod("small", corev1.Container{Name: "train"}), nil),
+		`unknown vGPU profile "small", no profiles are configured`)
+	own := gpus("1")
+	own.Limits["nvidia.com/gpumem"] = resource.MustParse("1000")
+	assert.Equal(t, applyRequestProfile(newPod("small", corev1.Container{Name: "train", Resources: own}), profiles),
+		"container train sets nvidia.com/gpumem itself and through vGPU profile small")
+	pod = newPod("large", corev1.Container{Name: "train"})
+	pod.Annotations[util.GPUInUse] = "H100"
+	assert.Equal(t, applyRequestProfile(pod, profiles), `annotation nvidia.com/use-gputype is "H100", vGPU profile large has memory on A100 only`)
+}
+
+func TestRequestProfilesReload(t *testing.T) {
+	profiles := testProfiles(t, testRequestProfiles)
+	changed, err := profiles.reload()
+	assert.NilError(t, err)
+	assert.Assert(t, !changed)
+
+	assert.NilError(t, os.WriteFile(profiles.path, []byte(`{"profiles": [{"name": "medium", "memory": 8000}]}`), 0644))
+	changed, err = profiles.reload()
+	assert.NilError(t, err)
+	assert.Assert(t, changed)
+	assert.DeepEqual(t, profiles.names(), []string{"medium"})
+
+	// a broken file leaves the profiles read last
+	assert.NilError(t, os.WriteFile(profiles.path, []byte(`{"profiles": [{"name": "medium"}]}`), 0644))
+	_, err = profiles.reload()
+	assert.ErrorContains(t, err, "no memory on any GPU type")
+	assert.Equal(t, profiles.get("medium").Memory, int32(8000))
+}
+
+func TestCalcScoreRequestProfileTypes(t *testing.T) {
+	setGPURequestResources(t)
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "train", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")}}}}}}
+	pod.Annotations = map[string]string{util.VGPUProfileAnnotation: "small"}
+	assert.Equal(t, applyRequestProfile(pod, testProfiles(t, testRequestProfiles)), "")
+	reqs := k8sutil.Resourcereqs(pod)
+
+	for _, tc := range []struct {
+		typ        string
+		mem, cores int32
+	}{
+		{"NVIDIA-Tesla T4", 4000, 20},
+		{"NVIDIA-NVIDIA A10", 6000, 30},
+		{"NVIDIA-Tesla V100", 3000, 20},
+	} {
+		nodes := map[string]*NodeUsage{"node1": {Devices: DeviceUsageList{{Id: "GPU-a", Count: 10, Totalmem: 16000, Type: tc.typ}}}}
+		failed := map[string]string{}
+		res, err := calcScore(&nodes, &failed, reqs, pod.Annotations)
+		assert.NilError(t, err)
+		assert.Equal(t, len(*res), 1, tc.typ)
+		assert.DeepEqual(t, (*res)[0].devices[0][0], util.ContainerDevice{UUID: "GPU-a", Type: util.NvidiaGPUDevice, Usedmem: tc.mem, Usedcores: tc.cores})
+
+		nodes = map[string]*NodeUsage{"node1": {Devices: DeviceUsageList{{Id: "GPU-a", Count: 10, Totalmem: 16000, Type: tc.typ}}}}
+		res, err = calcScore(&nodes, &failed, reqs, map[string]string{util.DistinctGPUsAnnotation: "true"})
+		assert.NilError(t, err)
+		assert.Equal(t, (*res)[0].devices[0][0].Usedmem, tc.mem, tc.typ)
+	}
+}
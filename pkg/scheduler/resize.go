@@ -0,0 +1,141 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// containerMemory returns the GPU memory a container asks for with util.ResourceMem.
+func containerMemory(ctr *corev1.Container) (int32, bool) {
+	name := corev1.ResourceName(util.ResourceMem)
+	v, ok := ctr.Resources.Limits[name]
+	if !ok {
+		v, ok = ctr.Resources.Requests[name]
+	}
+	if !ok {
+		return 0, false
+	}
+	mem, ok := v.AsInt64()
+	return int32(mem), ok
+}
+
+// resizedDevices returns the devices of a pod assigned to the node with usage, with the GPU
+// memory its containers ask for now, or nil if no container changed its util.ResourceMem.
+// Containers keep their GPUs, so a resize that changes their number or grows beyond the
+// free memory of a GPU is rejected, moving to other GPUs needs a restart.
+func resizedDevices(pod *corev1.Pod, assigned util.PodDevices, usage *NodeUsage) (util.PodDevices, error) {
+	type change struct {
+		ctr int
+		mem int32
+	}
+	var changes []change
+	for i := range pod.Spec.Containers {
+		if i >= len(assigned) {
+			break
+		}
+		mem, ok := containerMemory(&pod.Spec.Containers[i])
+		if !ok {
+			continue
+		}
+		for _, dev := range assigned[i] {
+			if strings.Contains(dev.Type, util.NvidiaGPUDevice) && dev.Usedmem != mem {
+				changes = append(changes, change{i, mem})
+				break
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	free := make(map[string]int32)
+	for _, d := range usage.Devices {
+		free[d.Id] = d.Totalmem - d.Usedmem
+	}
+	reqs := k8sutil.Resourcereqs(pod)
+	res := make(util.PodDevices, len(assigned))
+	for i, cd := range assigned {
+		res[i] = append(util.ContainerDevices{}, cd...)
+	}
+	for _, c := range changes {
+		name := pod.Spec.Containers[c.ctr].Name
+		nums := int32(0)
+		for _, r := range reqs[c.ctr] {
+			if r.Type == util.NvidiaGPUDevice {
+				nums += r.Nums
+			}
+		}
+		var gpus []*util.ContainerDevice
+		for j := range res[c.ctr] {
+			if strings.Contains(res[c.ctr][j].Type, util.NvidiaGPUDevice) {
+				gpus = append(gpus, &res[c.ctr][j])
+			}
+		}
+		if int(nums) != len(gpus) {
+			return nil, fmt.Errorf("container %v asks for %v GPUs but holds %v, changing the number of GPUs needs a restart", name, nums, len(gpus))
+		}
+		for _, dev := range gpus {
+			grow := c.mem - dev.Usedmem
+			if grow > free[dev.UUID] {
+				return nil, fmt.Errorf("container %v needs %vm more on device %v, which has %vm free, moving to another device needs a restart",
+					name, grow, dev.UUID, free[dev.UUID])
+			}
+			free[dev.UUID] -= grow
+			dev.Usedmem = c.mem
+		}
+	}
+	return res, nil
+}
+
+// resize applies a change of the GPU memory the containers of a pod running on nodeID ask
+// for, as made by in-place pod resize. The new devices are written to the pod, where the
+// device plugin picks them up and raises or lowers the limits of the running containers.
+func (s *Scheduler) resize(pod *corev1.Pod, nodeID string, assigned util.PodDevices) {
+	if pod.Spec.NodeName == "" || util.WholeGPUs(pod) {
+		return
+	}
+	usage, _ := s.nodesUsage(&[]string{nodeID})
+	node, ok := usage[nodeID]
+	if !ok {
+		return
+	}
+	devices, err := resizedDevices(pod, assigned, node)
+	if err != nil {
+		klog.Warningf("pod %v resize rejected: %v", util.PodRef(pod.Namespace, pod.Name), err)
+		s.podEventf(pod, corev1.EventTypeWarning, "ResizeRejected", "%v", err)
+		return
+	}
+	if devices == nil {
+		return
+	}
+	newannos := map[string]string{util.AssignedIDsAnnotations: annotations.EncodePodDevices(devices)}
+	if err := util.PatchPodAnnotations(pod, newannos); err != nil {
+		klog.Errorf("pod %v resize: %v", util.PodRef(pod.Namespace, pod.Name), util.RedactIn(err.Error(), pod.Name, pod.Namespace))
+		return
+	}
+	s.updatePod(pod, devices)
+	klog.Infof("pod %v resized to %v", util.PodRef(pod.Namespace, pod.Name), devices)
+	s.podEventf(pod, corev1.EventTypeNormal, "Resized", "GPU memory resized to %v", newannos[util.AssignedIDsAnnotations])
+}
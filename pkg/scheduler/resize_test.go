@@ -0,0 +1,117 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// setupResize returns a scheduler with a pod holding 4000m of GPU-0, which another pod
+// shares with 8000m, and the pod asking for mem now.
+func setupResize(t *testing.T, mem string) (*Scheduler, *corev1.Pod, *record.FakeRecorder) {
+	oldName, oldMem, oldClient := util.ResourceName, util.ResourceMem, util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+
+	s := NewScheduler()
+	recorder := record.NewFakeRecorder(10)
+	s.eventRecorder = recorder
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+		{ID: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", UID: "uid-other"}}
+	s.addPod(other, "node1", util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 8000}}})
+
+	assigned := util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: 30}}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: types.UID("uid"), Annotations: map[string]string{
+			util.AssignedNodeAnnotations: "node1",
+			util.AssignedIDsAnnotations:  annotations.EncodePodDevices(assigned),
+		}},
+		Spec: corev1.PodSpec{NodeName: "node1", Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				"nvidia.com/gpu":    resource.MustParse("1"),
+				"nvidia.com/gpumem": resource.MustParse(mem),
+			},
+		}}}},
+	}
+	util.SetClient(fake.NewSimpleClientset(pod))
+	s.addPod(pod, "node1", assigned)
+	return s, pod, recorder
+}
+
+func podUsedmem(t *testing.T, s *Scheduler, pod *corev1.Pod) int32 {
+	stored, err := util.GetClient().CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	pd, err := annotations.DecodePodDevices(stored.Annotations[util.AssignedIDsAnnotations])
+	assert.NilError(t, err)
+	assert.Equal(t, s.pods[pod.UID].Devices[0][0].Usedmem, pd[0][0].Usedmem)
+	return pd[0][0].Usedmem
+}
+
+func TestResizeGrowFits(t *testing.T) {
+	s, pod, recorder := setupResize(t, "8000")
+	s.onUpdatePod(nil, pod)
+	assert.Equal(t, podUsedmem(t, s, pod), int32(8000))
+	assert.Equal(t, <-recorder.Events, "Normal Resized GPU memory resized to GPU-0,NVIDIA,8000,30:")
+
+	usage, _ := s.nodesUsage(&[]string{"node1"})
+	assert.Equal(t, usage["node1"].Devices[0].Usedmem, int32(16000))
+}
+
+func TestResizeGrowDoesNotFit(t *testing.T) {
+	s, pod, recorder := setupResize(t, "8001")
+	s.onUpdatePod(nil, pod)
+	assert.Equal(t, podUsedmem(t, s, pod), int32(4000))
+	assert.Equal(t, <-recorder.Events, "Warning ResizeRejected container c needs 4001m more on device GPU-0, which has 4000m free, moving to another device needs a restart")
+}
+
+func TestResizeShrink(t *testing.T) {
+	s, pod, recorder := setupResize(t, "1000")
+	s.onUpdatePod(nil, pod)
+	assert.Equal(t, podUsedmem(t, s, pod), int32(1000))
+	assert.Equal(t, len(recorder.Events), 1)
+
+	// the update carrying the new assignment changes nothing
+	stored, err := util.GetClient().CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	s.onUpdatePod(pod, stored)
+	assert.Equal(t, len(recorder.Events), 1)
+}
+
+func TestResizeRejectsMoreGPUs(t *testing.T) {
+	s, pod, recorder := setupResize(t, "2000")
+	pod.Spec.Containers[0].Resources.Limits["nvidia.com/gpu"] = resource.MustParse("2")
+	s.onUpdatePod(nil, pod)
+	assert.Equal(t, podUsedmem(t, s, pod), int32(4000))
+	assert.Equal(t, <-recorder.Events, "Warning ResizeRejected container c asks for 2 GPUs but holds 1, changing the number of GPUs needs a restart")
+}
@@ -19,11 +19,14 @@ package routes
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 
 	"4pd.io/k8s-vgpu/pkg/scheduler"
+	"4pd.io/k8s-vgpu/pkg/util"
 
 	"github.com/julienschmidt/httprouter"
 	"k8s.io/apimachinery/pkg/types"
@@ -58,7 +61,7 @@ func PredicateRoute(s *scheduler.Scheduler) httprouter.Handle {
 		} else {
 			extenderFilterResult, err = s.Filter(extenderArgs)
 			if err != nil {
-				klog.Errorf("pod %v filter error, %v", extenderArgs.Pod.Name, err)
+				klog.Errorf("pod %v filter error, %v", util.Redact(extenderArgs.Pod.Name), util.RedactIn(err.Error(), extenderArgs.Pod.Name, extenderArgs.Pod.Namespace))
 				extenderFilterResult = &extenderv1.ExtenderFilterResult{
 					Error: err.Error(),
 				}
@@ -92,7 +95,7 @@ func Bind(s *scheduler.Scheduler) httprouter.Handle {
 				Error: err.Error(),
 			}
 		} else {
-			extenderBindingResult, err = s.Bind(extenderBindingArgs)
+			extenderBindingResult, err = s.Bind(r.Context(), extenderBindingArgs)
 		}
 
 		if response, err := json.Marshal(extenderBindingResult); err != nil {
@@ -114,7 +117,7 @@ func bind(args extenderv1.ExtenderBindingArgs, bindFunc func(string, string, typ
 	err := bindFunc(args.PodName, args.PodNamespace, args.PodUID, args.Node)
 	errMsg := ""
 	if err != nil {
-		klog.ErrorS(err, "Bind", "pod", args.PodName, "namespace", args.PodNamespace, "node", args.Node, "uid", args.PodUID)
+		klog.ErrorS(errors.New(util.RedactIn(err.Error(), args.PodName, args.PodNamespace)), "Bind", "pod", util.Redact(args.PodName), "namespace", util.Redact(args.PodNamespace), "node", args.Node, "uid", args.PodUID)
 		errMsg = err.Error()
 	}
 	return &extenderv1.ExtenderBindingResult{
@@ -132,3 +135,24 @@ func WebHookRoute() httprouter.Handle {
 		h.ServeHTTP(w, r)
 	}
 }
+
+// PurgeNode makes the scheduler forget the node in the path, see Scheduler.PurgeNode.
+// It changes cluster state without authentication, so only local clients, e.g. through
+// kubectl exec, are served.
+func PurgeNode(s *scheduler.Scheduler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "only served to local clients", http.StatusForbidden)
+			return
+		}
+		removed, err := s.PurgeNode(r.Context(), ps.ByName("node"))
+		if err != nil {
+			klog.ErrorS(err, "Purge node", "node", ps.ByName("node"))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(removed)
+	}
+}
@@ -0,0 +1,416 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// schedulePolicyReloadInterval is how often the schedule policy file is read again, a
+// ConfigMap volume is updated in place.
+const schedulePolicyReloadInterval = 10 * time.Second
+
+// SchedulePolicy is the content of the schedule policy file: windows of time during
+// which some pods are preferred on, or get to themselves, some GPUs, e.g. the notebooks
+// of the data science team on the A100 nodes during office hours.
+type SchedulePolicy struct {
+	// Timezone is the IANA name of the time zone the schedules are in, e.g.
+	// Asia/Shanghai, UTC when empty.
+	Timezone string            `json:"timezone,omitempty"`
+	Windows  []*ScheduleWindow `json:"windows"`
+	location *time.Location
+}
+
+// ScheduleWindow applies to the pods selected by Pods on the GPUs selected by Devices
+// while Schedule matches the time. Boost is added to the score of a node for each pod
+// container's share of such GPUs, and an Exclusive window leaves the GPUs to its pods,
+// other pods are not placed on them. Pods already placed keep their GPUs.
+type ScheduleWindow struct {
+	Name string `json:"name"`
+	// Schedule is a cron expression of the minutes the window is open, e.g.
+	// "* 9-17 * * 1-5" from 9:00 to 17:59 on weekdays.
+	Schedule  string           `json:"schedule"`
+	Pods      ScheduledPods    `json:"pods,omitempty"`
+	Devices   ScheduledDevices `json:"devices,omitempty"`
+	Boost     float64          `json:"boost,omitempty"`
+	Exclusive bool             `json:"exclusive,omitempty"`
+	cron      *cronSchedule
+	selector  labels.Selector
+}
+
+// ScheduledPods selects the pods of a ScheduleWindow, all pods when empty.
+type ScheduledPods struct {
+	Namespaces []string              `json:"namespaces,omitempty"`
+	Selector   *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// ScheduledDevices selects the GPUs of a ScheduleWindow: those on the nodes with the
+// labels of NodeSelector whose type contains one of Types, ignoring case as with
+// nvidia.com/use-gputype. All GPUs when empty.
+type ScheduledDevices struct {
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	Types        []string          `json:"types,omitempty"`
+}
+
+// parseSchedulePolicy reads a schedule policy file.
+func parseSchedulePolicy(data []byte) (*SchedulePolicy, error) {
+	var p SchedulePolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone %q: %v", p.Timezone, err)
+	}
+	p.location = loc
+	names := make(map[string]bool, len(p.Windows))
+	for _, w := range p.Windows {
+		if w.Name == "" {
+			return nil, fmt.Errorf("window without a name")
+		}
+		if names[w.Name] {
+			return nil, fmt.Errorf("window %v is defined twice", w.Name)
+		}
+		names[w.Name] = true
+		if err := w.compile(); err != nil {
+			return nil, fmt.Errorf("window %v: %v", w.Name, err)
+		}
+	}
+	return &p, nil
+}
+
+func (w *ScheduleWindow) compile() error {
+	switch {
+	case w.Boost < 0:
+		return fmt.Errorf("boost %v is negative", w.Boost)
+	case w.Boost == 0 && !w.Exclusive:
+		return fmt.Errorf("neither a boost nor exclusive")
+	}
+	cron, err := parseCron(w.Schedule)
+	if err != nil {
+		return fmt.Errorf("schedule: %v", err)
+	}
+	w.cron = cron
+	w.selector = labels.Everything()
+	if w.Pods.Selector != nil {
+		if w.selector, err = metav1.LabelSelectorAsSelector(w.Pods.Selector); err != nil {
+			return fmt.Errorf("pod selector: %v", err)
+		}
+	}
+	return nil
+}
+
+// activeWindows returns the windows open at now, in the time zone of the policy.
+func (p *SchedulePolicy) activeWindows(now time.Time) []*ScheduleWindow {
+	if p == nil {
+		return nil
+	}
+	now = now.In(p.location)
+	var res []*ScheduleWindow
+	for _, w := range p.Windows {
+		if w.cron.matches(now) {
+			res = append(res, w)
+		}
+	}
+	return res
+}
+
+// selectsPod reports whether the window applies to pod.
+func (w *ScheduleWindow) selectsPod(pod *corev1.Pod) bool {
+	if len(w.Pods.Namespaces) == 0 {
+		return w.selector.Matches(labels.Set(pod.Labels))
+	}
+	for _, ns := range w.Pods.Namespaces {
+		if ns == pod.Namespace {
+			return w.selector.Matches(labels.Set(pod.Labels))
+		}
+	}
+	return false
+}
+
+// selectsDevice reports whether the window applies to a GPU of type cardtype on a node
+// labeled nodeLabels.
+func (w *ScheduleWindow) selectsDevice(nodeLabels map[string]string, cardtype string) bool {
+	for key, val := range w.Devices.NodeSelector {
+		if v, ok := nodeLabels[key]; !ok || v != val {
+			return false
+		}
+	}
+	if len(w.Devices.Types) == 0 {
+		return true
+	}
+	for _, t := range w.Devices.Types {
+		if strings.Contains(strings.ToUpper(cardtype), strings.ToUpper(strings.TrimSpace(t))) {
+			return true
+		}
+	}
+	return false
+}
+
+// cronField is the range of values of a field of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 0 and 7 are both Sunday
+	{"day of week", 0, 7},
+}
+
+// cronSchedule is a parsed cron expression, each field a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are set when the day of month or of week is "*": as in cron, a
+	// day matches when either of them matches, unless one of them is "*".
+	domStar, dowStar bool
+}
+
+// parseCron parses a cron expression of five fields, minute, hour, day of month, month
+// and day of week. Each field is "*" or a list of numbers and ranges, e.g. "1-5,0", each
+// optionally with a step, e.g. "*/15".
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%q has %d fields, expected minute, hour, day of month, month and day of week", expr, len(fields))
+	}
+	var bits [len(cronFields)]uint64
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", cronFields[i].name, err)
+		}
+		bits[i] = b
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var res uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("step %q is not a positive number", item[i+1:])
+			}
+			rng, step = item[:i], n
+		}
+		lo, hi := f.min, f.max
+		var err error
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err == nil {
+				hi, err = strconv.Atoi(bounds[1])
+			}
+		default:
+			lo, err = strconv.Atoi(rng)
+			// a single value with a step runs to the end of the range, as in cron
+			if step == 1 {
+				hi = lo
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number or range", item)
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%q is not within %d-%d", item, f.min, f.max)
+		}
+		for v := lo; v <= hi; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+	return res, nil
+}
+
+// matches reports whether the minute of t is in the schedule, in the location of t.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// schedulePolicyFile is the policy of a schedule policy file, read again whenever it
+// changes. A file that stops parsing leaves the policy read last in place.
+type schedulePolicyFile struct {
+	path   string
+	mu     sync.RWMutex
+	data   []byte
+	policy *SchedulePolicy
+}
+
+// loadSchedulePolicyFile reads the policy of the file at path.
+func loadSchedulePolicyFile(path string) (*schedulePolicyFile, error) {
+	f := &schedulePolicyFile{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, fmt.Errorf("schedule policy %v: %v", path, err)
+	}
+	return f, nil
+}
+
+// reload reads the file again and returns whether the policy changed.
+func (f *schedulePolicyFile) reload() (bool, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.mu.RLock()
+	same := f.policy != nil && bytes.Equal(data, f.data)
+	f.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	policy, err := parseSchedulePolicy(data)
+	if err != nil {
+		return false, err
+	}
+	f.mu.Lock()
+	f.data, f.policy = data, policy
+	f.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the file every schedulePolicyReloadInterval, it never returns.
+func (f *schedulePolicyFile) watch() {
+	for range time.Tick(schedulePolicyReloadInterval) {
+		changed, err := f.reload()
+		if err != nil {
+			klog.Errorf("Keeping the schedule policy read last from %v: %v", f.path, err)
+			continue
+		}
+		if changed {
+			klog.Infof("Reloaded the schedule policy from %v, %d windows", f.path, len(f.get().Windows))
+		}
+	}
+}
+
+// get returns the policy, nil when there is none.
+func (f *schedulePolicyFile) get() *SchedulePolicy {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.policy
+}
+
+// schedulePolicy applies the windows of the schedule policy file when pods are filtered,
+// at the time of policyNow.
+type schedulePolicy struct {
+	policyFile *schedulePolicyFile
+	policyNow  func() time.Time
+}
+
+func (p *schedulePolicy) init() {
+	p.policyNow = time.Now
+}
+
+// LoadSchedulePolicy reads the schedule policy from the file at path, and again every
+// 10s after. It is called before the scheduler serves requests.
+func (s *Scheduler) LoadSchedulePolicy(path string) error {
+	f, err := loadSchedulePolicyFile(path)
+	if err != nil {
+		return err
+	}
+	s.policyFile = f
+	klog.Infof("Read the schedule policy from %v, %d windows in time zone %v", path, len(f.get().Windows), f.get().location)
+	go f.watch()
+	return nil
+}
+
+// applySchedulePolicy flags the devices in usage with the windows open now for pod: each
+// gets the Boost of those selecting it and the pod, and is Reserved when exclusive windows
+// select it but none of them the pod. Only the usage Filter scores is changed, pods
+// already placed keep their devices.
+func (s *Scheduler) applySchedulePolicy(pod *corev1.Pod, usage map[string]*NodeUsage) {
+	active := s.policyFile.get().activeWindows(s.policyNow())
+	if len(active) == 0 {
+		return
+	}
+	if klog.V(4).Enabled() {
+		names := make([]string, 0, len(active))
+		for _, w := range active {
+			names = append(names, w.Name)
+		}
+		klog.Infof("pod %v: schedule windows %v open", util.PodRef(pod.Namespace, pod.Name), strings.Join(names, ", "))
+	}
+	for nodeID, node := range usage {
+		nodeLabels := s.nodeLabels(nodeID)
+		for _, d := range node.Devices {
+			reserved, admitted := false, false
+			for _, w := range active {
+				if !w.selectsDevice(nodeLabels, d.Type) {
+					continue
+				}
+				selected := w.selectsPod(pod)
+				if selected {
+					d.Boost += float32(w.Boost)
+				}
+				if w.Exclusive {
+					reserved = true
+					admitted = admitted || selected
+				}
+			}
+			d.Reserved = reserved && !admitted
+		}
+	}
+}
+
+// nodeLabels returns the labels of the node, nil when it isn't known.
+func (s *Scheduler) nodeLabels(nodeID string) map[string]string {
+	if s.nodeLister == nil {
+		return nil
+	}
+	node, err := s.nodeLister.Get(nodeID)
+	if err != nil {
+		klog.V(4).Infof("node %v: no labels for the schedule policy: %v", nodeID, err)
+		return nil
+	}
+	return node.Labels
+}
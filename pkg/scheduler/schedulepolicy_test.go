@@ -0,0 +1,265 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		res, err := time.Parse("2006-01-02 15:04 Mon", s)
+		assert.NilError(t, err)
+		return res
+	}
+	for _, tc := range []struct {
+		expr    string
+		matches []string
+		misses  []string
+	}{
+		{"* * * * *", []string{"2026-10-16 00:00 Fri", "2026-12-31 23:59 Thu"}, nil},
+		{"* 9-17 * * 1-5", []string{"2026-10-16 09:00 Fri", "2026-10-12 17:59 Mon"}, []string{"2026-10-16 08:59 Fri", "2026-10-16 18:00 Fri", "2026-10-17 10:00 Sat"}},
+		{"*/15 0 * * *", []string{"2026-10-16 00:00 Fri", "2026-10-16 00:45 Fri"}, []string{"2026-10-16 00:10 Fri", "2026-10-16 01:00 Fri"}},
+		{"30/10 * * * *", []string{"2026-10-16 05:30 Fri", "2026-10-16 05:50 Fri"}, []string{"2026-10-16 05:20 Fri", "2026-10-16 05:35 Fri"}},
+		{"0,30 22-23,0-5 * * *", []string{"2026-10-16 23:30 Fri", "2026-10-17 03:00 Sat"}, []string{"2026-10-16 12:00 Fri", "2026-10-16 23:15 Fri"}},
+		// Sunday is 0 and 7
+		{"* * * * 7", []string{"2026-10-18 12:00 Sun"}, []string{"2026-10-17 12:00 Sat"}},
+		// either the day of month or the day of week, as in cron
+		{"* * 1 * 1", []string{"2026-10-01 12:00 Thu", "2026-10-05 12:00 Mon"}, []string{"2026-10-06 12:00 Tue"}},
+		{"* * 1 * *", []string{"2026-10-01 12:00 Thu"}, []string{"2026-10-05 12:00 Mon"}},
+		{"* * * 12 *", []string{"2026-12-24 12:00 Thu"}, []string{"2026-11-24 12:00 Tue"}},
+	} {
+		c, err := parseCron(tc.expr)
+		assert.NilError(t, err, tc.expr)
+		for _, s := range tc.matches {
+			assert.Assert(t, c.matches(at(s)), "%v at %v", tc.expr, s)
+		}
+		for _, s := range tc.misses {
+			assert.Assert(t, !c.matches(at(s)), "%v at %v", tc.expr, s)
+		}
+	}
+	for expr, want := range map[string]string{
+		"* 9-17 * *":     "has 4 fields",
+		"60 * * * *":     `minute: "60" is not within 0-59`,
+		"* 17-9 * * *":   `hour: "17-9" is not within 0-23`,
+		"* * 0 * *":      `day of month: "0" is not within 1-31`,
+		"* * * jan *":    `month: "jan" is not a number or range`,
+		"* * * * 1-8":    `day of week: "1-8" is not within 0-7`,
+		"*/0 * * * *":    `minute: step "0" is not a positive number`,
+		"* * * * 1-":     `day of week: "1-" is not a number or range`,
+		"* 9,,17 * * *":  `hour: "" is not a number or range`,
+		"* * * * mon-fr": `day of week: "mon-fr" is not a number or range`,
+	} {
+		_, err := parseCron(expr)
+		assert.ErrorContains(t, err, want, expr)
+	}
+}
+
+func TestParseSchedulePolicy(t *testing.T) {
+	p, err := parseSchedulePolicy([]byte(`{"timezone": "Asia/Shanghai", "windows": [
+		{"name": "a", "schedule": "* 9-17 * * 1-5", "boost": 1},
+		{"name": "b", "schedule": "* * * * *", "exclusive": true, "pods": {"selector": {"matchLabels": {"app": "notebook"}}}}]}`))
+	assert.NilError(t, err)
+	assert.Equal(t, p.location.String(), "Asia/Shanghai")
+	assert.Equal(t, len(p.Windows), 2)
+	p, err = parseSchedulePolicy([]byte(`{"windows": []}`))
+	assert.NilError(t, err)
+	assert.Equal(t, p.location, time.UTC)
+
+	for _, tc := range []struct{ data, want string }{
+		{`{"timezone": "Mars/Olympus_Mons", "windows": []}`, `timezone "Mars/Olympus_Mons"`},
+		{`{"windows": [{"schedule": "* * * * *", "boost": 1}]}`, "window without a name"},
+		{`{"windows": [{"name": "a", "schedule": "* * * * *", "boost": 1}, {"name": "a", "schedule": "* * * * *", "boost": 1}]}`, "window a is defined twice"},
+		{`{"windows": [{"name": "a", "schedule": "* * * * *"}]}`, "window a: neither a boost nor exclusive"},
+		{`{"windows": [{"name": "a", "schedule": "* * * * *", "boost": -1}]}`, "window a: boost -1 is negative"},
+		{`{"windows": [{"name": "a", "schedule": "* 25 * * *", "boost": 1}]}`, `window a: schedule: hour: "25" is not within 0-23`},
+		{`{"windows": [{"name": "a", "schedule": "* * * * *", "boost": 1, "pods": {"selector": {"matchExpressions": [{"key": "app", "operator": "Near"}]}}}]}`, "window a: pod selector:"},
+	} {
+		_, err := parseSchedulePolicy([]byte(tc.data))
+		assert.ErrorContains(t, err, tc.want, tc.data)
+	}
+}
+
+func TestSchedulePolicyTimezone(t *testing.T) {
+	policy := func(tz string) *SchedulePolicy {
+		p, err := parseSchedulePolicy([]byte(fmt.Sprintf(`{"timezone": %q, "windows": [{"name": "office", "schedule": "* 9 * * 1-5", "boost": 1}]}`, tz)))
+		assert.NilError(t, err)
+		return p
+	}
+	// Friday 9:30 in Shanghai, 1:30 in UTC and 21:30 on Thursday in New York
+	now := time.Date(2026, 10, 16, 1, 30, 0, 0, time.UTC)
+	assert.Equal(t, len(policy("Asia/Shanghai").activeWindows(now)), 1)
+	assert.Equal(t, len(policy("").activeWindows(now)), 0)
+	assert.Equal(t, len(policy("UTC").activeWindows(now.Add(8*time.Hour))), 1)
+	assert.Equal(t, len(policy("America/New_York").activeWindows(now)), 0)
+
+	// 9:30 in New York is 14:30 UTC in winter and 13:30 UTC in summer, the window
+	// follows the clocks on the days around the switch
+	ny := policy("America/New_York")
+	assert.Equal(t, len(ny.activeWindows(time.Date(2026, 3, 6, 14, 30, 0, 0, time.UTC))), 1)
+	assert.Equal(t, len(ny.activeWindows(time.Date(2026, 3, 9, 14, 30, 0, 0, time.UTC))), 0)
+	assert.Equal(t, len(ny.activeWindows(time.Date(2026, 3, 9, 13, 30, 0, 0, time.UTC))), 1)
+}
+
+func TestSchedulePolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	assert.NilError(t, os.WriteFile(path, []byte(`{"windows": [{"name": "a", "schedule": "* * * * *", "boost": 1}]}`), 0644))
+	f, err := loadSchedulePolicyFile(path)
+	assert.NilError(t, err)
+	changed, err := f.reload()
+	assert.NilError(t, err)
+	assert.Assert(t, !changed)
+
+	assert.NilError(t, os.WriteFile(path, []byte(`{"timezone": "Asia/Shanghai", "windows": []}`), 0644))
+	changed, err = f.reload()
+	assert.NilError(t, err)
+	assert.Assert(t, changed)
+	assert.Equal(t, len(f.get().Windows), 0)
+
+	// a time zone that doesn't exist keeps the policy read last
+	assert.NilError(t, os.WriteFile(path, []byte(`{"timezone": "Asia/Atlantis", "windows": []}`), 0644))
+	_, err = f.reload()
+	assert.ErrorContains(t, err, `timezone "Asia/Atlantis"`)
+	assert.Equal(t, f.get().location.String(), "Asia/Shanghai")
+
+	_, err = loadSchedulePolicyFile(path)
+	assert.ErrorContains(t, err, "schedule policy "+path)
+}
+
+// policyScheduler has the nodes "batch" and "interactive" with two GPUs each, labeled
+// with their gpu-pool, and the schedule policy of data.
+func policyScheduler(t *testing.T, data string) *Scheduler {
+	p, err := parseSchedulePolicy([]byte(data))
+	assert.NilError(t, err)
+	s := NewScheduler()
+	s.policyFile = &schedulePolicyFile{policy: p}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range []string{"batch", "interactive"} {
+		assert.NilError(t, indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: node, Labels: map[string]string{"gpu-pool": node}}}))
+		var devices []DeviceInfo
+		for i := 0; i < 2; i++ {
+			devices = append(devices, DeviceInfo{ID: fmt.Sprintf("%s-GPU-%d", node, i), Count: 4, Devmem: 40000, Type: "NVIDIA-A100", Health: true})
+		}
+		s.addNode(node, &NodeInfo{ID: node, Devices: devices})
+	}
+	s.nodeLister = listerscorev1.NewNodeLister(indexer)
+	return s
+}
+
+func TestFilterSchedulePolicy(t *testing.T) {
+	oldName, oldMem := util.ResourceName, util.ResourceMem
+	oldClient := util.GetClient()
+	t.Cleanup(func() {
+		util.ResourceName, util.ResourceMem = oldName, oldMem
+		util.SetClient(oldClient)
+	})
+	util.ResourceName, util.ResourceMem = "nvidia.com/gpu", "nvidia.com/gpumem"
+	client := fake.NewSimpleClientset()
+	util.SetClient(client)
+
+	const policy = `{"timezone": "Asia/Shanghai", "windows": [
+		{"name": "notebooks", "schedule": "* 9-17 * * 1-5", "exclusive": true, "boost": 5,
+		 "pods": {"namespaces": ["data-science"], "selector": {"matchLabels": {"app": "notebook"}}},
+		 "devices": {"nodeSelector": {"gpu-pool": "interactive"}}},
+		{"name": "training-nights", "schedule": "* 0-6,22-23 * * *", "boost": 10,
+		 "pods": {"namespaces": ["ml"]}, "devices": {"nodeSelector": {"gpu-pool": "interactive"}, "types": ["A100"]}}]}`
+	// Friday 10:00 and 23:00 in Shanghai
+	office := time.Date(2026, 10, 16, 2, 0, 0, 0, time.UTC)
+	night := time.Date(2026, 10, 16, 15, 0, 0, 0, time.UTC)
+	uid := 0
+	filter := func(s *Scheduler, ns, app string, nodes ...string) *extenderv1.ExtenderFilterResult {
+		uid++
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: fmt.Sprintf("p%d", uid), UID: types.UID(fmt.Sprint(uid)), Labels: map[string]string{"app": app}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+					corev1.ResourceName(util.ResourceMem):  resource.MustParse("10000"),
+				},
+			}}}},
+		}
+		assert.NilError(t, client.Tracker().Add(pod))
+		res, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &nodes})
+		assert.NilError(t, err)
+		return res
+	}
+	placed := func(res *extenderv1.ExtenderFilterResult) string {
+		assert.Assert(t, res.NodeNames != nil && len(*res.NodeNames) == 1, "%v %v", res.FailedNodes, res.Error)
+		return (*res.NodeNames)[0]
+	}
+
+	s := policyScheduler(t, policy)
+	s.policyNow = func() time.Time { return office }
+	// a pod placed on the interactive GPUs before the window opened keeps them
+	s.addPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "early", UID: "early"}}, "interactive",
+		util.PodDevices{{{UUID: "interactive-GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 10000}}})
+	// the batch node scores better with a pod less, the notebook is boosted where it is reserved
+	assert.Equal(t, placed(filter(s, "data-science", "notebook", "batch", "interactive")), "interactive")
+	res := filter(s, "data-science", "dashboard", "interactive")
+	assert.Assert(t, res.NodeNames == nil)
+	assert.DeepEqual(t, res.FailedNodes, extenderv1.FailedNodesMap{"interactive": string(ReasonReserved)})
+	res = filter(s, "ml", "train", "interactive")
+	assert.DeepEqual(t, res.FailedNodes, extenderv1.FailedNodesMap{"interactive": string(ReasonReserved)})
+	assert.Equal(t, placed(filter(s, "ml", "train", "batch", "interactive")), "batch")
+	pi, ok := s.pods["early"]
+	assert.Assert(t, ok)
+	assert.Equal(t, pi.NodeID, "interactive")
+
+	// at night the interactive GPUs take anyone, and training pods are boosted onto them
+	// although the batch node has fewer pods
+	s = policyScheduler(t, policy)
+	s.policyNow = func() time.Time { return night }
+	assert.Equal(t, placed(filter(s, "ml", "train", "interactive")), "interactive")
+	assert.Equal(t, placed(filter(s, "ml", "train", "batch", "interactive")), "interactive")
+	assert.Equal(t, placed(filter(s, "data-science", "notebook", "batch", "interactive")), "batch")
+
+	// in office hours the batch node with the fewest pods wins for training, the boost is off
+	s = policyScheduler(t, policy)
+	s.policyNow = func() time.Time { return office }
+	assert.Equal(t, placed(filter(s, "ml", "train", "batch", "interactive")), "batch")
+
+	// without a policy both nodes take any pod
+	s = policyScheduler(t, `{"windows": []}`)
+	s.policyNow = func() time.Time { return office }
+	assert.Equal(t, placed(filter(s, "data-science", "dashboard", "interactive")), "interactive")
+}
+
+func TestCandidateOrderBoost(t *testing.T) {
+	devices := DeviceUsageList{
+		{Id: "a"}, {Id: "b", Boost: 1}, {Id: "c", Preferred: true}, {Id: "d", Boost: 2},
+	}
+	var order []string
+	for _, i := range candidateOrder(devices) {
+		order = append(order, devices[i].Id)
+	}
+	assert.DeepEqual(t, order, []string{"c", "d", "b", "a"})
+}
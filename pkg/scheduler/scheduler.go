@@ -18,27 +18,34 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"4pd.io/k8s-vgpu/pkg/api"
 	"4pd.io/k8s-vgpu/pkg/k8sutil"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
 	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 	"4pd.io/k8s-vgpu/pkg/util/k8s"
+	"4pd.io/k8s-vgpu/pkg/util/tracing"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	listerscorev1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	extenderv1 "k8s.io/kube-scheduler/extender/v1"
-	"k8s.io/kubernetes/pkg/scheduler/apis/config"
+	schedulerconfig "k8s.io/kubernetes/pkg/scheduler/apis/config"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
 	"k8s.io/kubernetes/pkg/scheduler/framework/plugins/nodeaffinity"
 	"k8s.io/kubernetes/pkg/scheduler/framework/plugins/nodeunschedulable"
@@ -47,22 +54,51 @@ import (
 type Scheduler struct {
 	nodeManager
 	podManager
+	fairShare
+	placementHistory
+	namespaceQuotas
+	pendingDemand
+	usageHistory
+	schedulePolicy
 
 	stopCh       chan struct{}
 	kubeClient   kubernetes.Interface
 	podLister    listerscorev1.PodLister
 	nodeLister   listerscorev1.NodeLister
 	cachedstatus map[string]*NodeUsage
+	// eventRecorder reports problems with a single pod, it is nil until Start.
+	eventRecorder record.EventRecorder
+	// nodeStatus publishes VGPUNodeStatus objects, it is nil unless enabled.
+	nodeStatus *nodeStatusReconciler
+	// bindSlots bounds the number of binds in flight so a slow API server
+	// call can only hold up its own slot.
+	bindSlots chan struct{}
+	// allocating serializes picking devices for pods and ResourceClaims, so both can't
+	// be given the same free share.
+	allocating sync.Mutex
+	tieBreaker *tieBreaker
 }
 
 func NewScheduler() *Scheduler {
 	klog.Infof("New Scheduler")
+	workers := config.BindWorkers
+	if workers <= 0 {
+		workers = 1
+	}
 	s := &Scheduler{
 		stopCh:       make(chan struct{}),
 		cachedstatus: make(map[string]*NodeUsage),
+		bindSlots:    make(chan struct{}, workers),
+		tieBreaker:   newTieBreaker(config.SelectionSeed),
 	}
 	s.nodeManager.init()
 	s.podManager.init()
+	s.fairShare.init()
+	s.placementHistory.init()
+	s.namespaceQuotas.init()
+	s.pendingDemand.init()
+	s.usageHistory.init()
+	s.schedulePolicy.init()
 	return s
 }
 
@@ -78,6 +114,9 @@ func (s *Scheduler) onAddPod(obj interface{}) {
 		klog.Errorf("unknown add object type")
 		return
 	}
+	if pod.Spec.NodeName != "" {
+		s.podScheduled(pod.UID)
+	}
 	nodeID, ok := pod.Annotations[util.AssignedNodeAnnotations]
 	if !ok {
 		return
@@ -90,8 +129,35 @@ func (s *Scheduler) onAddPod(obj interface{}) {
 		s.delPod(pod)
 		return
 	}
-	podDev := util.DecodePodDevices(ids)
-	s.addPod(pod, nodeID, podDev)
+	podDev, err := annotations.DecodePodDevices(ids)
+	if err != nil {
+		// keep the pod out of the device usage rather than guessing what it holds
+		s.malformedAnnotation(pod, util.AssignedIDsAnnotations, err)
+		return
+	}
+	if pod.Annotations[util.DeviceBindPhase] != util.DeviceBindFailed {
+		s.addPod(pod, nodeID, podDev)
+	}
+	if !s.allocationReported(pod) {
+		return
+	}
+	s.resize(pod, nodeID, podDev)
+}
+
+func (s *Scheduler) malformedAnnotation(pod *corev1.Pod, key string, err error) {
+	klog.Errorf("pod %v annotation %v: %v", util.PodRef(pod.Namespace, pod.Name), key, err)
+	s.podEventf(pod, corev1.EventTypeWarning, "MalformedAnnotation", "annotation %v: %v", key, err)
+}
+
+// podEventf records an event on pod. With util.RedactTenantInfo the names of the pod,
+// its namespace and its co-location group are hashed in the message too, as an error it
+// quotes may carry them, and events are read by more than the pod's owners.
+func (s *Scheduler) podEventf(pod *corev1.Pod, eventtype, reason, format string, args ...interface{}) {
+	if s.eventRecorder == nil {
+		return
+	}
+	msg := util.RedactIn(fmt.Sprintf(format, args...), pod.Namespace, pod.Name, pod.Annotations[util.ColocateGroupAnnotation])
+	s.eventRecorder.Event(pod, eventtype, reason, msg)
 }
 
 func (s *Scheduler) onUpdatePod(_, newObj interface{}) {
@@ -104,6 +170,8 @@ func (s *Scheduler) onDelPod(obj interface{}) {
 		klog.Errorf("unknown add object type")
 		return
 	}
+	s.fairShare.done(pod)
+	s.podScheduled(pod.UID)
 	_, ok = pod.Annotations[util.AssignedNodeAnnotations]
 	if !ok {
 		return
@@ -126,8 +194,27 @@ func (s *Scheduler) Start() {
 		DeleteFunc: s.onDelPod,
 	})
 
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: s.kubeClient.CoreV1().Events("")})
+	s.eventRecorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "vgpu-scheduler"})
+
 	informerFactory.Start(s.stopCh)
 	informerFactory.WaitForCacheSync(s.stopCh)
+
+	if config.NodeStatusInterval > 0 {
+		restConfig, err := k8sutil.NewConfig()
+		check(err)
+		c, err := newAPIClient(restConfig)
+		check(err)
+		s.nodeStatus = newNodeStatusReconciler(c)
+		go s.publishNodeStatus(s.nodeStatus, config.NodeStatusInterval)
+	}
+	if config.AllocationTimeout > 0 {
+		go s.reconcileAllocationsLoop(config.AllocationTimeout)
+	}
+	if config.NamespaceQuotaConfigMap != "" {
+		check(s.watchQuotas(config.NamespaceQuotaConfigMap))
+	}
 }
 
 func (s *Scheduler) Stop() {
@@ -152,20 +239,40 @@ func (s *Scheduler) RegisterFromNodeAnnotatons() error {
 			return err
 		}
 		for _, val := range nodes.Items {
+			s.setDrained(val.Name, annotations.DecodeDrainDevices(val.Annotations[util.DrainDeviceAnnotation]))
+			links, err := annotations.DecodeDeviceLinks(val.Annotations[util.NodeNvidiaTopologyAnnotation])
+			if err != nil {
+				klog.Errorf("node %v annotation %v: %v", val.Name, util.NodeNvidiaTopologyAnnotation, err)
+			}
+			s.setLinks(val.Name, links)
+			if usage, ok := val.Annotations[util.ContainerUsageAnnotation]; ok {
+				s.observeUsage(val.Name, usage)
+			}
 			for devhandsk, devreg := range util.KnownDevice {
 				_, ok := val.Annotations[devreg]
 				if !ok {
 					continue
 				}
-				nodedevices := util.DecodeNodeDevices(val.Annotations[devreg])
+				nodedevices, err := annotations.DecodeNodeDevices(val.Annotations[devreg])
+				if err == nil {
+					err = validateDevices(val.Name, nodedevices)
+				}
+				if err != nil {
+					s.rejectRegistration(val.Name, fmt.Errorf("annotation %v: %w", devreg, err))
+					continue
+				}
 				if len(nodedevices) == 0 {
 					continue
 				}
 				klog.V(5).Infoln("nodedevices=", nodedevices)
 				handshake := val.Annotations[devhandsk]
 				if strings.Contains(handshake, "Requesting") {
-					formertime, _ := time.Parse("2006.01.02 15:04:05", strings.Split(handshake, "_")[1])
-					if time.Now().After(formertime.Add(time.Second * 60)) {
+					// an unreadable handshake is treated as expired
+					formertime, err := annotations.ParseHandshakeTime(handshake)
+					if err != nil {
+						klog.Warningf("node %v annotation %v: %v", val.Name, devhandsk, err)
+					}
+					if time.Now().After(formertime.Add(util.HandshakeTimeout)) {
 						_, ok := s.nodes[val.Name]
 						if ok {
 							s.rmNodeDevice(val.Name, nodeInfoCopy[devhandsk])
@@ -208,13 +315,7 @@ func (s *Scheduler) RegisterFromNodeAnnotatons() error {
 						}
 					}
 					if !found {
-						nodeInfo.Devices = append(nodeInfo.Devices, DeviceInfo{
-							ID:     deviceinfo.Id,
-							Count:  deviceinfo.Count,
-							Devmem: deviceinfo.Devmem,
-							Type:   deviceinfo.Type,
-							Health: deviceinfo.Health,
-						})
+						nodeInfo.Devices = append(nodeInfo.Devices, s.deviceInfo(val.Name, deviceinfo))
 					}
 				}
 				s.addNode(val.Name, nodeInfo)
@@ -224,7 +325,7 @@ func (s *Scheduler) RegisterFromNodeAnnotatons() error {
 				}
 			}
 		}
-		time.Sleep(time.Second * 15)
+		time.Sleep(util.HandshakePollInterval)
 	}
 }
 
@@ -244,17 +345,21 @@ func (s *Scheduler) Register(stream api.DeviceService_RegisterServer) error {
 			return err
 		}
 		klog.V(3).Infof("device register %v", req.String())
+		if err := validateRegisterRequest(nodeID, req); err != nil {
+			// the devices of other nodes are left alone, whatever node the request names
+			node := nodeID
+			if len(node) == 0 {
+				node = req.GetNode()
+			}
+			s.rejectRegistration(node, err)
+			s.rmNodeDevice(nodeID, &nodeInfoCopy)
+			return err
+		}
 		nodeID = req.GetNode()
 		nodeInfo.ID = nodeID
 		nodeInfo.Devices = make([]DeviceInfo, len(req.Devices))
 		for i := 0; i < len(req.Devices); i++ {
-			nodeInfo.Devices[i] = DeviceInfo{
-				ID:     req.Devices[i].GetId(),
-				Count:  req.Devices[i].GetCount(),
-				Devmem: req.Devices[i].GetDevmem(),
-				Type:   req.Devices[i].GetType(),
-				Health: req.Devices[i].GetHealth(),
-			}
+			nodeInfo.Devices[i] = s.deviceInfo(nodeID, req.Devices[i])
 		}
 		if s.nodes[nodeID] != nil {
 			klog.Infoln("before=", s.nodes[nodeID].Devices)
@@ -286,9 +391,9 @@ func GenerateNodeMapAndSlice(nodes []*corev1.Node) map[string]*framework.NodeInf
 func (s *Scheduler) checkNodeValidity(ni *corev1.Node, pod *corev1.Pod) bool {
 	if len(pod.Spec.NodeName) > 0 {
 		if strings.Compare(ni.Name, pod.Spec.NodeName) == 0 {
-			fmt.Println("nodename matched", ni.Name)
+			klog.V(4).Infoln("nodename matched", ni.Name)
 		} else {
-			klog.Infoln("nodeName not matched", ni.Name, pod.Spec.NodeName)
+			klog.V(4).Infoln("nodeName not matched", ni.Name, pod.Spec.NodeName)
 			return false
 		}
 	}
@@ -296,15 +401,15 @@ func (s *Scheduler) checkNodeValidity(ni *corev1.Node, pod *corev1.Pod) bool {
 		for idx, val := range pod.Spec.NodeSelector {
 			str1, ok := ni.Labels[idx]
 			if !ok {
-				klog.Infoln("nodeselector check failed")
+				klog.V(4).Infoln("nodeselector check failed")
 				return false
 			}
 			if strings.Compare(str1, val) != 0 {
-				klog.Infoln("nodeselector check failed")
+				klog.V(4).Infoln("nodeselector check failed")
 				return false
 			}
 		}
-		klog.Infoln("nodeselector check passed")
+		klog.V(4).Infoln("nodeselector check passed")
 	}
 
 	nodes, err := s.nodeLister.List(labels.Everything())
@@ -319,7 +424,7 @@ func (s *Scheduler) checkNodeValidity(ni *corev1.Node, pod *corev1.Pod) bool {
 	plugin, _ := nodeunschedulable.New(nil, handle)
 	nodeUnscheduleFilter := plugin.(*nodeunschedulable.NodeUnschedulable)
 	// 2. NodeAffinity
-	nodeAffinityArgs := config.NodeAffinityArgs{
+	nodeAffinityArgs := schedulerconfig.NodeAffinityArgs{
 		AddedAffinity: &v1.NodeAffinity{},
 	}
 	plugin, _ = nodeaffinity.New(&nodeAffinityArgs, handle)
@@ -346,13 +451,20 @@ func (s *Scheduler) checkNodeValidity(ni *corev1.Node, pod *corev1.Pod) bool {
 // returns all nodes and its device memory usage, and we filter it with nodeSelector, taints, nodeAffinity
 // unschedulerable and nodeName
 func (s *Scheduler) getNodesUsage(nodes *[]string, task *corev1.Pod) (*map[string]*NodeUsage, map[string]string, error) {
+	nodeMap, failedNodes := s.nodesUsage(nodes)
+	s.cachedstatus = nodeMap
+	return &nodeMap, failedNodes, nil
+}
+
+// nodesUsage returns the device usage of the given nodes, and why the others are left out.
+func (s *Scheduler) nodesUsage(nodes *[]string) (map[string]*NodeUsage, map[string]string) {
 	nodeMap := make(map[string]*NodeUsage)
 	failedNodes := make(map[string]string)
 	for _, nodeID := range *nodes {
 		node, err := s.GetNode(nodeID)
 		if err != nil {
 			klog.Errorf("get node %v device error, %v", nodeID, err)
-			failedNodes[nodeID] = "node unregisterd"
+			failedNodes[nodeID] = string(ReasonNodeUnregistered)
 			continue
 		}
 		/*
@@ -362,17 +474,23 @@ func (s *Scheduler) getNodesUsage(nodes *[]string, task *corev1.Pod) (*map[strin
 				failedNodes[nodeID] = "node validity check failed"
 				continue
 			}*/
-		nodeInfo := &NodeUsage{}
+		nodeInfo := &NodeUsage{Links: s.linksOf(nodeID)}
 		for _, d := range node.Devices {
 			nodeInfo.Devices = append(nodeInfo.Devices, &DeviceUsage{
-				Id:        d.ID,
-				Used:      0,
-				Count:     d.Count,
-				Usedmem:   0,
-				Totalmem:  d.Devmem,
-				Usedcores: 0,
-				Type:      d.Type,
-				Health:    d.Health,
+				Id:            d.ID,
+				Used:          0,
+				Count:         d.Count,
+				MaxShares:     d.MaxShares,
+				Usedmem:       0,
+				Totalmem:      d.Devmem,
+				Advertisedmem: d.Advertisedmem,
+				Physmem:       d.Physmem,
+				Usedcores:     0,
+				Type:          d.Type,
+				Profile:       d.Profile,
+				Health:        d.Health,
+				Drained:       s.isDrained(nodeID, d.ID),
+				Overcommitted: d.Overcommitted,
 			})
 		}
 		nodeMap[nodeID] = nodeInfo
@@ -389,31 +507,65 @@ func (s *Scheduler) getNodesUsage(nodes *[]string, task *corev1.Pod) (*map[strin
 						d.Used++
 						d.Usedmem += udevice.Usedmem
 						d.Usedcores += udevice.Usedcores
+						d.Usedmembw += p.MemoryBandwidth
+						d.Exclusive = d.Exclusive || p.Exclusive
 					}
 				}
 			}
 		}
-		klog.V(5).Infof("usage: pod %v assigned %v %v", p.Name, p.NodeID, p.Devices)
+		klog.V(5).Infof("usage: pod %v assigned %v %v", util.Redact(p.Name), p.NodeID, p.Devices)
 	}
-	s.cachedstatus = nodeMap
-	return &nodeMap, failedNodes, nil
+	return nodeMap, failedNodes
 }
 
-func (s *Scheduler) Bind(args extenderv1.ExtenderBindingArgs) (*extenderv1.ExtenderBindingResult, error) {
-	klog.InfoS("Bind", "pod", args.PodName, "namespace", args.PodNamespace, "podUID", args.PodUID, "node", args.Node)
+func (s *Scheduler) Bind(ctx context.Context, args extenderv1.ExtenderBindingArgs) (*extenderv1.ExtenderBindingResult, error) {
+	req := util.NewRequestID()
+	pod, namespace := util.Redact(args.PodName), util.Redact(args.PodNamespace)
+	redactErr := func(err error) error { return errors.New(util.RedactIn(err.Error(), args.PodName, args.PodNamespace)) }
+	klog.InfoS("Bind", "request", req, "pod", pod, "namespace", namespace, "podUID", args.PodUID, "node", args.Node)
 	var err error
 	var res *extenderv1.ExtenderBindingResult
+	if config.BindTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.BindTimeout)
+		defer cancel()
+	}
+	select {
+	case s.bindSlots <- struct{}{}:
+		defer func() { <-s.bindSlots }()
+	case <-ctx.Done():
+		klog.ErrorS(ctx.Err(), "No bind worker available", "request", req, "pod", pod, "namespace", namespace)
+		return &extenderv1.ExtenderBindingResult{Error: ctx.Err().Error()}, nil
+	}
 	binding := &corev1.Binding{
 		ObjectMeta: metav1.ObjectMeta{Name: args.PodName, UID: args.PodUID},
 		Target:     corev1.ObjectReference{Kind: "Node", Name: args.Node},
 	}
-	current, err := s.kubeClient.CoreV1().Pods(args.PodNamespace).Get(context.Background(), args.PodName, metav1.GetOptions{})
+	start := time.Now()
+	current, err := s.kubeClient.CoreV1().Pods(args.PodNamespace).Get(ctx, args.PodName, metav1.GetOptions{})
+	util.APIRequestDuration.WithLabelValues("get-pod").Observe(time.Since(start).Seconds())
 	if err != nil {
-		klog.ErrorS(err, "Get pod failed")
+		err = redactErr(err)
+		klog.ErrorS(err, "Get pod failed", "request", req)
+		return &extenderv1.ExtenderBindingResult{Error: err.Error()}, nil
+	}
+	span := tracing.Start("vgpu.bind", current.Annotations[util.TraceParentAnnotation])
+	span.SetAttribute("k8s.namespace.name", util.Redact(namespace))
+	span.SetAttribute("k8s.pod.name", util.Redact(pod))
+	span.SetAttribute("k8s.node.name", args.Node)
+	defer span.End()
+	if err := s.checkQuota(args.PodNamespace, args.Node); err != nil {
+		klog.ErrorS(err, "Rejecting bind", "request", req, "pod", pod, "namespace", namespace, "node", args.Node)
+		span.SetError(err)
+		return &extenderv1.ExtenderBindingResult{Error: err.Error()}, nil
 	}
-	err = util.LockNode(args.Node)
+	// the device plugin takes the devices of the pod holding the lock, without it the
+	// pod could get those of another pod being bound to the node
+	err = util.LockNode(ctx, args.Node)
 	if err != nil {
-		klog.ErrorS(err, "Failed to lock node", "node", args.Node)
+		klog.ErrorS(err, "Failed to lock node", "request", req, "node", args.Node)
+		span.SetError(err)
+		return &extenderv1.ExtenderBindingResult{Error: err.Error()}, nil
 	}
 	//defer util.ReleaseNodeLock(args.Node)
 
@@ -421,12 +573,16 @@ func (s *Scheduler) Bind(args extenderv1.ExtenderBindingArgs) (*extenderv1.Exten
 	tmppatch[util.DeviceBindPhase] = "allocating"
 	tmppatch[util.BindTimeAnnotations] = strconv.FormatInt(time.Now().Unix(), 10)
 
-	err = util.PatchPodAnnotations(current, tmppatch)
+	err = util.PatchPodAnnotationsWithContext(ctx, current, tmppatch)
 	if err != nil {
-		klog.ErrorS(err, "patch pod annotation failed")
+		klog.ErrorS(redactErr(err), "patch pod annotation failed", "request", req)
 	}
-	if err = s.kubeClient.CoreV1().Pods(args.PodNamespace).Bind(context.Background(), binding, metav1.CreateOptions{}); err != nil {
-		klog.ErrorS(err, "Failed to bind pod", "pod", args.PodName, "namespace", args.PodNamespace, "podUID", args.PodUID, "node", args.Node)
+	start = time.Now()
+	err = s.kubeClient.CoreV1().Pods(args.PodNamespace).Bind(ctx, binding, metav1.CreateOptions{})
+	util.APIRequestDuration.WithLabelValues("bind-pod").Observe(time.Since(start).Seconds())
+	if err != nil {
+		klog.ErrorS(redactErr(err), "Failed to bind pod", "request", req, "pod", pod, "namespace", namespace, "podUID", args.PodUID, "node", args.Node)
+		span.SetError(err)
 	}
 	if err == nil {
 		res = &extenderv1.ExtenderBindingResult{
@@ -437,12 +593,38 @@ func (s *Scheduler) Bind(args extenderv1.ExtenderBindingArgs) (*extenderv1.Exten
 			Error: err.Error(),
 		}
 	}
-	klog.Infoln("After Binding Process")
+	klog.InfoS("After Binding Process", "request", req)
 	return res, nil
 }
 
-func (s *Scheduler) Filter(args extenderv1.ExtenderArgs) (*extenderv1.ExtenderFilterResult, error) {
-	klog.Infof("schedule pod %v/%v[%v]", args.Pod.Namespace, args.Pod.Name, args.Pod.UID)
+// filterFailed reports why no node fit the pod. The summary is returned as the
+// extender error, so kube-scheduler shows it in the FailedScheduling event, and
+// the per-node details go to an event of our own.
+func (s *Scheduler) filterFailed(req string, args extenderv1.ExtenderArgs, failedNodes map[string]string) *extenderv1.ExtenderFilterResult {
+	for _, r := range failedNodes {
+		FilterFailures.WithLabelValues(r).Inc()
+	}
+	nodes := len(failedNodes)
+	if args.NodeNames != nil {
+		nodes = len(*args.NodeNames)
+	}
+	msg := filterError(nodes, failedNodes)
+	klog.Infof("[%v] pod %v doesn't fit: %v", req, util.PodRef(args.Pod.Namespace, args.Pod.Name), msg)
+	s.podEventf(args.Pod, corev1.EventTypeWarning, "FilteringFailed", "%v", filterDetails(failedNodes))
+	return &extenderv1.ExtenderFilterResult{
+		FailedNodes: failedNodes,
+		Error:       msg,
+	}
+}
+
+func (s *Scheduler) Filter(args extenderv1.ExtenderArgs) (_ *extenderv1.ExtenderFilterResult, err error) {
+	if !k8sutil.RequestsDevices(args.Pod) {
+		// kube-scheduler calls the extender for every pod unless its managedResources are set,
+		// see print-extender-config
+		return &extenderv1.ExtenderFilterResult{NodeNames: args.NodeNames}, nil
+	}
+	req := util.NewRequestID()
+	klog.Infof("[%v] schedule pod %v[%v]", req, util.PodRef(args.Pod.Namespace, args.Pod.Name), args.Pod.UID)
 	nums := k8sutil.Resourcereqs(args.Pod)
 	total := 0
 	for _, n := range nums {
@@ -451,7 +633,7 @@ func (s *Scheduler) Filter(args extenderv1.ExtenderArgs) (*extenderv1.ExtenderFi
 		}
 	}
 	if total == 0 {
-		klog.V(1).Infof("pod %v not find resource %v or %v", args.Pod.Name, util.ResourceName, util.MLUResourceCount)
+		klog.V(1).Infof("[%v] pod %v not find resource %v or %v", req, util.Redact(args.Pod.Name), util.ResourceName, util.MLUResourceCount)
 		return &extenderv1.ExtenderFilterResult{
 			NodeNames:   args.NodeNames,
 			FailedNodes: nil,
@@ -459,34 +641,100 @@ func (s *Scheduler) Filter(args extenderv1.ExtenderArgs) (*extenderv1.ExtenderFi
 		}, nil
 	}
 	annos := args.Pod.Annotations
+	span := tracing.Start("vgpu.filter", annos[util.TraceParentAnnotation])
+	span.SetAttribute("k8s.namespace.name", util.Redact(args.Pod.Namespace))
+	span.SetAttribute("k8s.pod.name", util.Redact(args.Pod.Name))
+	span.SetAttribute("k8s.pod.uid", string(args.Pod.UID))
+	span.SetAttribute("vgpu.requested_devices", total)
+	profile := ""
+	if name, ok := annos[util.VGPUProfileAnnotation]; ok {
+		span.SetAttribute("vgpu.profile", name)
+		profile = fmt.Sprintf(" as vGPU profile %v", name)
+	}
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	// pods created while the webhook was off
+	if val, ok := annos[util.GPUModeAnnotation]; ok {
+		if _, err := util.ParseGPUMode(val); err != nil {
+			return nil, fmt.Errorf("pod %v annotation %v: %v", util.PodRef(args.Pod.Namespace, args.Pod.Name), util.GPUModeAnnotation, err)
+		}
+	}
+	if val, ok := annos[util.MemoryPercentAnnotation]; ok {
+		if _, err := annotations.DecodeMemoryPercent(val); err != nil {
+			return nil, fmt.Errorf("pod %v annotation %v: %v", util.PodRef(args.Pod.Namespace, args.Pod.Name), util.MemoryPercentAnnotation, err)
+		}
+	}
+	if val, ok := annos[util.MemoryBandwidthAnnotation]; ok {
+		if _, err := annotations.DecodeMemoryPercent(val); err != nil {
+			return nil, fmt.Errorf("pod %v annotation %v: %v", util.PodRef(args.Pod.Namespace, args.Pod.Name), util.MemoryBandwidthAnnotation, err)
+		}
+	}
+	if err := k8sutil.CheckRequests(args.Pod); err != nil {
+		return nil, fmt.Errorf("pod %v: %v", util.PodRef(args.Pod.Namespace, args.Pod.Name), err)
+	}
 	s.delPod(args.Pod)
+	if config.FairSharing && args.NodeNames != nil {
+		since := s.fairShare.seen(args.Pod, *args.NodeNames, nums)
+		if p := s.fairShareHold(args.Pod, since); p != nil {
+			failedNodes := make(map[string]string)
+			for _, n := range *args.NodeNames {
+				failedNodes[n] = string(ReasonFairShare)
+			}
+			return s.filterFailed(req, args, failedNodes), nil
+		}
+	}
+	s.allocating.Lock()
+	defer s.allocating.Unlock()
 	nodeUsage, failedNodes, err := s.getNodesUsage(args.NodeNames, args.Pod)
 	if err != nil {
 		return nil, err
 	}
+	s.markPreferred(*nodeUsage, annos[util.PlacementKeyAnnotation])
+	s.applySchedulePolicy(args.Pod, *nodeUsage)
+	anchor, anchored := s.anchorOf(colocateKey(args.Pod))
+	if anchored {
+		restrictToAnchor(*nodeUsage, failedNodes, anchor)
+	}
 	nodeScores, err := calcScore(nodeUsage, &failedNodes, nums, annos)
 	if err != nil {
 		return nil, err
 	}
+	*nodeScores = s.withinQuota(args.Pod.Namespace, *nodeScores, failedNodes)
 	if len(*nodeScores) == 0 {
-		return &extenderv1.ExtenderFilterResult{
-			FailedNodes: failedNodes,
-		}, nil
+		span.SetAttribute("vgpu.failed_nodes", len(failedNodes))
+		s.podUnschedulable(args.Pod, nums)
+		if anchored {
+			s.colocateFailed(args.Pod, anchor, failedNodes)
+		}
+		return s.filterFailed(req, args, failedNodes), nil
 	}
-	sort.Sort(nodeScores)
+	s.tieBreaker.sort(*nodeScores)
 	m := (*nodeScores)[len(*nodeScores)-1]
-	klog.Infof("schedule %v/%v to %v %v", args.Pod.Namespace, args.Pod.Name, m.nodeID, m.devices)
-	annotations := make(map[string]string)
-	annotations[util.AssignedNodeAnnotations] = m.nodeID
-	annotations[util.AssignedTimeAnnotations] = strconv.FormatInt(time.Now().Unix(), 10)
-	annotations[util.AssignedIDsAnnotations] = util.EncodePodDevices(m.devices)
-	annotations[util.AssignedIDsToAllocateAnnotations] = annotations[util.AssignedIDsAnnotations]
+	klog.Infof("[%v] schedule %v%v to %v %v, score %.3f: %v", req, util.PodRef(args.Pod.Namespace, args.Pod.Name), profile, m.nodeID, m.devices, m.score, m.factors)
+	newannos := make(map[string]string)
+	newannos[util.AssignedNodeAnnotations] = m.nodeID
+	newannos[util.AssignedTimeAnnotations] = strconv.FormatInt(time.Now().Unix(), 10)
+	newannos[util.AssignedIDsAnnotations] = annotations.EncodePodDevices(m.devices)
+	newannos[util.AssignedIDsToAllocateAnnotations] = newannos[util.AssignedIDsAnnotations]
+	if tier := k8sutil.MemoryTier(args.Pod); tier != "" {
+		newannos[util.MemoryTierAnnotation] = tier
+	}
+	if tp := span.TraceParent(); tp != "" {
+		newannos[util.TraceParentAnnotation] = tp
+	}
+	span.SetAttribute("k8s.node.name", m.nodeID)
+	span.SetAttribute("vgpu.devices", newannos[util.AssignedIDsAnnotations])
 	s.addPod(args.Pod, m.nodeID, m.devices)
-	err = util.PatchPodAnnotations(args.Pod, annotations)
+	err = util.PatchPodAnnotations(args.Pod, newannos)
 	if err != nil {
 		s.delPod(args.Pod)
 		return nil, err
 	}
+	s.fairShare.placed(args.Pod)
+	s.podScheduled(args.Pod.UID)
+	s.recordPlacement(m.nodeID, annos[util.PlacementKeyAnnotation], m.devices)
 	res := extenderv1.ExtenderFilterResult{NodeNames: &[]string{m.nodeID}}
 	return &res, nil
 }
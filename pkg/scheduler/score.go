@@ -18,9 +18,12 @@ package scheduler
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
 	"strings"
+	"sync"
 
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
 	"4pd.io/k8s-vgpu/pkg/util"
 	"k8s.io/klog/v2"
 )
@@ -28,7 +31,82 @@ import (
 type NodeScore struct {
 	nodeID  string
 	devices util.PodDevices
+	// score is the sum of factors weighted by the --score-weight-* flags
 	score   float32
+	factors scoreFactors
+	// tie orders nodes with the same score, see tieBreaker
+	tie uint64
+}
+
+// scoreFactors are what a node scores for, summed over the containers of the pod.
+type scoreFactors struct {
+	// spread is the share of slices still free on the GPUs chosen for each container,
+	// from 0 to 1; a negative weight prefers the fullest GPUs, i.e. binpacking.
+	spread float32
+	// devices is how many GPUs of the node each container leaves to others.
+	devices float32
+	// placement is the share of the GPUs chosen for each container that pods with its
+	// placement key got lately, from 0 to 1.
+	placement float32
+	// model is the share of the GPUs chosen for each container of the model listed first
+	// in its nvidia.com/use-gputype annotation, from 0 to 1.
+	model float32
+	// topology is how well the GPUs chosen for each container asking for several are
+	// connected, from 0 to 1, see deviceLinks.factor.
+	topology float32
+	// policy is the mean Boost of the GPUs chosen for each container, added to the score
+	// as it is, see applySchedulePolicy.
+	policy float32
+}
+
+func (f scoreFactors) add(o scoreFactors) scoreFactors {
+	return scoreFactors{
+		spread:    f.spread + o.spread,
+		devices:   f.devices + o.devices,
+		placement: f.placement + o.placement,
+		model:     f.model + o.model,
+		topology:  f.topology + o.topology,
+		policy:    f.policy + o.policy,
+	}
+}
+
+// weighted is the score of the factors, their sum weighted by the --score-weight-* flags.
+func (f scoreFactors) weighted() float32 {
+	return float32(config.ScoreWeightSpread)*f.spread +
+		float32(config.ScoreWeightDevices)*f.devices +
+		float32(config.ScoreWeightPlacement)*f.placement +
+		float32(config.ScoreWeightModel)*f.model +
+		float32(config.ScoreWeightTopology)*f.topology +
+		f.policy
+}
+
+// String lists the weighted contribution of each factor, for the decision log.
+func (f scoreFactors) String() string {
+	return fmt.Sprintf("spread %.3f*%v, devices %.3f*%v, placement %.3f*%v, model %.3f*%v, topology %.3f*%v, policy %.3f",
+		f.spread, config.ScoreWeightSpread, f.devices, config.ScoreWeightDevices,
+		f.placement, config.ScoreWeightPlacement, f.model, config.ScoreWeightModel,
+		f.topology, config.ScoreWeightTopology, f.policy)
+}
+
+// containerFactors scores the devices chosen for a container out of the dn of the node,
+// free of total slices were left on them before, and boost the sum of their Boost.
+func containerFactors(dn int, devs util.ContainerDevices, total, free int32, preferred, model int, boost float32) scoreFactors {
+	sums := float32(len(devs))
+	return scoreFactors{
+		spread:  float32(free) / float32(total),
+		devices: float32(dn - len(devs)),
+		// up to one device more for placing all of them where the placement key was
+		placement: float32(preferred) / sums,
+		model:     float32(model) / sums,
+		policy:    boost / sums,
+	}
+}
+
+// preferredModel reports whether cardtype is the model listed first in the
+// nvidia.com/use-gputype annotation.
+func preferredModel(annos map[string]string, cardtype string) bool {
+	first := strings.TrimSpace(strings.Split(annos[util.GPUInUse], ",")[0])
+	return first != "" && strings.Contains(strings.ToUpper(cardtype), strings.ToUpper(first))
 }
 
 type NodeScoreList []*NodeScore
@@ -41,8 +119,10 @@ func (l DeviceUsageList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
+// Less sorts the devices the other way round than util.CandidateBefore, calcScore tries
+// them from the end.
 func (l DeviceUsageList) Less(i, j int) bool {
-	return l[i].Count-l[i].Used < l[j].Count-l[j].Used
+	return util.CandidateBefore(l[j].candidate(), l[i].candidate())
 }
 
 func (l NodeScoreList) Len() int {
@@ -53,14 +133,54 @@ func (l NodeScoreList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
+// Less sorts the best node last: the highest score, then the lowest tie, then the first
+// name.
 func (l NodeScoreList) Less(i, j int) bool {
-	return l[i].score < l[j].score
+	if l[i].score != l[j].score {
+		return l[i].score < l[j].score
+	}
+	if l[i].tie != l[j].tie {
+		return l[i].tie > l[j].tie
+	}
+	return l[i].nodeID > l[j].nodeID
+}
+
+// tieBreaker picks among the nodes with the best score. Without a seed the node with the
+// first name wins, with config.SelectionSeed a PRNG seeded with it draws the order of the
+// tied nodes, so the same seed and the same sequence of pods replay the same choices.
+type tieBreaker struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newTieBreaker(seed int64) *tieBreaker {
+	if seed == 0 {
+		return &tieBreaker{}
+	}
+	return &tieBreaker{rand: rand.New(rand.NewSource(seed))}
+}
+
+// sort sorts scores, the best node last. calcScore lists the nodes in map order, so the
+// draws are made in the order of their names.
+func (t *tieBreaker) sort(scores NodeScoreList) {
+	if t != nil && t.rand != nil {
+		sort.Slice(scores, func(i, j int) bool { return scores[i].nodeID < scores[j].nodeID })
+		t.mu.Lock()
+		for _, s := range scores {
+			s.tie = t.rand.Uint64()
+		}
+		t.mu.Unlock()
+	}
+	sort.Sort(scores)
 }
 
 func viewStatus(usage NodeUsage) {
-	fmt.Println("viewing status")
+	if !klog.V(4).Enabled() {
+		return
+	}
+	klog.Infoln("viewing status")
 	for _, val := range usage.Devices {
-		fmt.Println(val)
+		klog.Infoln(val)
 	}
 }
 
@@ -153,12 +273,120 @@ func checkType(annos map[string]string, d DeviceUsage, n util.ContainerDeviceReq
 	return false
 }
 
+// fragmented reports whether the GPUs of the node that could take the rest of request k
+// have enough free memory together but not on enough single GPUs, which tells apart
+// fragmentation from a lack of memory, and logs the free memory of each GPU.
+func fragmented(nodeID string, devices DeviceUsageList, k util.ContainerDeviceRequest, annos map[string]string) bool {
+	if k.Slice || k.MemPercentagereq != 101 && k.Memreq == 0 {
+		return false
+	}
+	var sum int64
+	var breakdown []string
+	for _, d := range devices {
+		if d.Profile != k.Profile || d.Shares() <= d.Used || d.Drained || d.Reserved || d.overcommitted() || !checkType(annos, *d, k) {
+			continue
+		}
+		free := d.capacity(k) - d.Usedmem
+		if free < 0 {
+			free = 0
+		}
+		sum += int64(free)
+		breakdown = append(breakdown, fmt.Sprintf("%v %vm", d.Id, free))
+	}
+	if sum < int64(k.Memreq)*int64(k.Nums) {
+		return false
+	}
+	klog.Infof("node %v GPU memory fragmented: %v GPUs of %vm requested, %vm free in total on %v",
+		nodeID, k.Nums, k.Memreq, sum, strings.Join(breakdown, ", "))
+	return true
+}
+
+// candidateOrder returns the indices of the devices sorted by DeviceUsageList.Less in the
+// order calcScore tries them: in the order of util.CandidateBefore, preferred ones ahead
+// of all others, and among those the ones with the highest Boost first.
+func candidateOrder(devices DeviceUsageList) []int {
+	res := make([]int, 0, len(devices))
+	for i := len(devices) - 1; i >= 0; i-- {
+		res = append(res, i)
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		da, db := devices[res[a]], devices[res[b]]
+		if da.Preferred != db.Preferred {
+			return da.Preferred
+		}
+		return da.Boost > db.Boost
+	})
+	return res
+}
+
+// deviceFits returns the memory one device of request k takes on d, or the reason d can't
+// take it. The profile of d isn't checked, devices of other profiles are no candidates, and
+// k is the request for the type of d, see util.ContainerDeviceRequest.ForType.
+func deviceFits(d *DeviceUsage, k util.ContainerDeviceRequest, annos map[string]string) (int32, FilterReason) {
+	if d.Shares() <= d.Used {
+		return 0, ReasonDevicesFull
+	}
+	if d.Exclusive {
+		return 0, ReasonDevicesFull
+	}
+	if d.Drained {
+		return 0, ReasonDrained
+	}
+	if d.Reserved {
+		return 0, ReasonReserved
+	}
+	if d.overcommitted() {
+		klog.Warningf("device %v is over-committed, used %v total %v", d.Id, d.Usedmem, d.Totalmem)
+		return 0, ReasonOvercommitted
+	}
+	memreq := k.Memreq
+	// a percentage is of the memory of each GPU, which differs between models
+	if k.MemPercentagereq != 101 && k.Memreq == 0 {
+		memreq = d.Totalmem * k.MemPercentagereq / 100
+	}
+	if k.Slice && d.Count > 0 {
+		memreq = d.Totalmem / d.Count
+	}
+	if d.capacity(k)-d.Usedmem < memreq {
+		return 0, ReasonInsufficientMemory
+	}
+	if 100-d.Usedcores < k.Coresreq {
+		return 0, ReasonInsufficientCores
+	}
+	// Coresreq=100 indicates it want this card exclusively
+	if k.Coresreq == 100 && d.Used > 0 {
+		return 0, ReasonInsufficientCores
+	}
+	// You can't allocate core=0 job to an already full GPU
+	if d.Usedcores == 100 && k.Coresreq == 0 {
+		return 0, ReasonInsufficientCores
+	}
+	if d.Usedmembw+k.MemBandwidthreq > 100 {
+		return 0, ReasonInsufficientBandwidth
+	}
+	if !checkType(annos, *d, k) {
+		return 0, ReasonTypeMismatch
+	}
+	return memreq, ""
+}
+
 func calcScore(nodes *map[string]*NodeUsage, errMap *map[string]string, nums [][]util.ContainerDeviceRequest, annos map[string]string) (*NodeScoreList, error) {
 	res := make(NodeScoreList, 0, len(*nodes))
 	for nodeID, node := range *nodes {
 		viewStatus(*node)
 		dn := len(node.Devices)
 		score := NodeScore{nodeID: nodeID, score: 0}
+		if annos[util.DistinctGPUsAnnotation] == "true" {
+			devices, factors, reason := fitDistinct(nodeID, node, nums, annos)
+			if reason != "" {
+				(*errMap)[nodeID] = string(reason)
+				continue
+			}
+			score.devices, score.factors, score.score = devices, factors, factors.weighted()
+			klog.V(4).Infof("node %v scores %.3f: %v", nodeID, score.score, score.factors)
+			res = append(res, &score)
+			continue
+		}
 		for _, n := range nums {
 			sums := 0
 			for _, k := range n {
@@ -170,8 +398,12 @@ func calcScore(nodes *map[string]*NodeUsage, errMap *map[string]string, nums [][
 			}
 			devs := make([]util.ContainerDevice, 0, sums)
 			fit := true
+			reason := ReasonInsufficientDevices
 			total := int32(0)
 			free := int32(0)
+			preferred := 0
+			model := 0
+			boost := float32(0)
 			for _, k := range n {
 				if int(k.Nums) > dn {
 					fit = false
@@ -179,50 +411,49 @@ func calcScore(nodes *map[string]*NodeUsage, errMap *map[string]string, nums [][
 				}
 				sort.Sort(node.Devices)
 				//If this node has no devices available
-				if node.Devices[dn-int(k.Nums)].Count <= node.Devices[dn-int(k.Nums)].Used {
+				if node.Devices[dn-int(k.Nums)].Shares() <= node.Devices[dn-int(k.Nums)].Used {
 					fit = false
+					reason = ReasonDevicesFull
 					break
 				}
+				skipped := make(map[FilterReason]int)
+				// devices of other profiles are a separate pool, not candidates
+				candidates := 0
 				//devs := make([]string, 0, n)
-				klog.Infoln("Allocating device for container request", k)
-				for i := len(node.Devices) - 1; i >= 0; i-- {
-					klog.Info("Scoring pod ", k.Memreq, ":", k.MemPercentagereq, ":", k.Coresreq, ":", k.Nums, "i", i, "device:", node.Devices[i].Id)
-					if node.Devices[i].Count <= node.Devices[i].Used {
-						continue
-					}
-					if k.MemPercentagereq != 101 && k.Memreq == 0 {
-						k.Memreq = node.Devices[i].Totalmem * k.MemPercentagereq / 100
-					}
-					if node.Devices[i].Totalmem-node.Devices[i].Usedmem < k.Memreq {
+				klog.V(4).Infoln("Allocating device for container request", k)
+				for _, i := range connectedOrder(node, candidateOrder(node.Devices), k, annos) {
+					klog.V(4).Info("Scoring pod ", k.Memreq, ":", k.MemPercentagereq, ":", k.Coresreq, ":", k.Nums, "i", i, "device:", node.Devices[i].Id)
+					if node.Devices[i].Profile != k.Profile {
 						continue
 					}
-					if 100-node.Devices[i].Usedcores < k.Coresreq {
+					candidates++
+					dk := k.ForType(node.Devices[i].Type)
+					memreq, skip := deviceFits(node.Devices[i], dk, annos)
+					if skip != "" {
+						skipped[skip]++
 						continue
 					}
-					// Coresreq=100 indicates it want this card exclusively
-					if k.Coresreq == 100 && node.Devices[i].Used > 0 {
-						continue
-					}
-					// You can't allocate core=0 job to an already full GPU
-					if node.Devices[i].Usedcores == 100 && k.Coresreq == 0 {
-						continue
-					}
-					if !checkType(annos, *node.Devices[i], k) {
-						continue
-					}
-					total += node.Devices[i].Count
-					free += node.Devices[i].Count - node.Devices[i].Used
+					total += node.Devices[i].Shares()
+					free += node.Devices[i].Shares() - node.Devices[i].Used
 					if k.Nums > 0 {
-						klog.Infoln("device", node.Devices[i].Id, "fitted")
+						klog.V(4).Infoln("device", node.Devices[i].Id, "fitted")
 						k.Nums--
+						if node.Devices[i].Preferred {
+							preferred++
+						}
+						boost += node.Devices[i].Boost
+						if preferredModel(annos, node.Devices[i].Type) {
+							model++
+						}
 						node.Devices[i].Used++
-						node.Devices[i].Usedmem += k.Memreq
-						node.Devices[i].Usedcores += k.Coresreq
+						node.Devices[i].Usedmem += memreq
+						node.Devices[i].Usedcores += dk.Coresreq
+						node.Devices[i].Usedmembw += dk.MemBandwidthreq
 						devs = append(devs, util.ContainerDevice{
 							UUID:      node.Devices[i].Id,
 							Type:      k.Type,
-							Usedmem:   k.Memreq,
-							Usedcores: k.Coresreq,
+							Usedmem:   memreq,
+							Usedcores: dk.Coresreq,
 						})
 					}
 					if k.Nums == 0 {
@@ -231,18 +462,29 @@ func calcScore(nodes *map[string]*NodeUsage, errMap *map[string]string, nums [][
 				}
 				if k.Nums > 0 {
 					fit = false
+					reason = dominantReason(skipped)
+					if candidates == 0 {
+						reason = ReasonProfileMismatch
+					}
+					if reason == ReasonInsufficientMemory && fragmented(nodeID, node.Devices, k, annos) {
+						reason = ReasonFragmented
+					}
 					break
 				}
 			}
 			if fit {
 				score.devices = append(score.devices, devs)
-				score.score += float32(free) / float32(total)
-				score.score += float32(dn - int(sums))
+				factors := containerFactors(dn, devs, total, free, preferred, model, boost)
+				factors.topology = node.Links.factor(devs)
+				score.factors = score.factors.add(factors)
 			} else {
+				(*errMap)[nodeID] = string(reason)
 				break
 			}
 		}
 		if len(score.devices) == len(nums) {
+			score.score = score.factors.weighted()
+			klog.V(4).Infof("node %v scores %.3f: %v", nodeID, score.score, score.factors)
 			res = append(res, &score)
 		}
 	}
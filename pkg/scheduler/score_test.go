@@ -0,0 +1,511 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"github.com/google/go-cmp/cmp"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func gpuRequest(nums, mem, cores int32) [][]util.ContainerDeviceRequest {
+	return [][]util.ContainerDeviceRequest{{{
+		Nums:             nums,
+		Type:             util.NvidiaGPUDevice,
+		Memreq:           mem,
+		MemPercentagereq: 101,
+		Coresreq:         cores,
+	}}}
+}
+
+func TestCalcScoreSkipsOvercommittedDevice(t *testing.T) {
+	// GPU-a shrank from 16000m to 8000m while 12000m were allocated on it.
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Used: 2, Usedmem: 12000, Totalmem: 8000, Type: "NVIDIA-A100"},
+			{Id: "GPU-b", Count: 10, Used: 0, Usedmem: 0, Totalmem: 16000, Type: "NVIDIA-A100"},
+		}},
+	}
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-b")
+}
+
+func TestCalcScoreRejectsNodeWithOnlyOvercommittedDevices(t *testing.T) {
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Used: 2, Usedmem: 12000, Totalmem: 8000, Type: "NVIDIA-A100"},
+		}},
+	}
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, gpuRequest(1, 0, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonOvercommitted))
+}
+
+func TestCalcScoreSkipsDeviceFlaggedOvercommitted(t *testing.T) {
+	// the scheduler missed some pods on GPU-a, the device plugin counted them
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Used: 1, Usedmem: 4000, Totalmem: 8000, Type: "NVIDIA-A100", Overcommitted: true},
+			{Id: "GPU-b", Count: 10, Totalmem: 16000, Type: "NVIDIA-A100"},
+		}},
+	}
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-b")
+}
+
+func TestCalcScoreKeepsProfilesApart(t *testing.T) {
+	newNodes := func() map[string]*NodeUsage {
+		return map[string]*NodeUsage{
+			"node1": {Devices: DeviceUsageList{
+				{Id: "GPU-a", Count: 4, Totalmem: 16000, Type: "NVIDIA-A100"},
+				{Id: "GPU-b", Count: 2, Totalmem: 24000, Type: "NVIDIA-A100", Profile: "training"},
+			}},
+		}
+	}
+	req := gpuRequest(1, 1000, 0)
+	req[0][0].Profile = "training"
+	nodes := newNodes()
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, req, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-b")
+
+	nodes = newNodes()
+	res, err = calcScore(&nodes, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-a")
+
+	req[0][0].Profile = "inference"
+	nodes = newNodes()
+	res, err = calcScore(&nodes, &failed, req, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonProfileMismatch))
+}
+
+func TestCalcScoreMixesSliceAndMemoryRequests(t *testing.T) {
+	// a pod asking for 6000m and one asking for a slice already share GPU-a
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 4, Used: 2, Usedmem: 10000, Totalmem: 16000, Type: "NVIDIA-A100"},
+		}},
+	}
+	slice := gpuRequest(1, 0, 0)
+	slice[0][0].Slice = true
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, slice, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].Usedmem, int32(4000))
+	assert.Equal(t, nodes["node1"].Devices[0].Usedmem, int32(14000))
+
+	res, err = calcScore(&nodes, &failed, gpuRequest(1, 3000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonInsufficientMemory))
+
+	res, err = calcScore(&nodes, &failed, gpuRequest(1, 2000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+}
+
+func TestCalcScoreReportsFragmentation(t *testing.T) {
+	newNodes := func() map[string]*NodeUsage {
+		return map[string]*NodeUsage{
+			"node1": {Devices: DeviceUsageList{
+				{Id: "GPU-a", Count: 4, Used: 1, Usedmem: 5000, Totalmem: 8000, Type: "NVIDIA-A100"},
+				{Id: "GPU-b", Count: 4, Used: 1, Usedmem: 5000, Totalmem: 8000, Type: "NVIDIA-A100"},
+			}},
+		}
+	}
+	nodes := newNodes()
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, gpuRequest(1, 5000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonFragmented))
+
+	nodes = newNodes()
+	res, err = calcScore(&nodes, &failed, gpuRequest(1, 7000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonInsufficientMemory))
+}
+
+func TestCalcScoreSkipsExclusiveDevice(t *testing.T) {
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+		{ID: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid",
+		Annotations: map[string]string{util.ExclusivePassthroughAnnotation: "true"}}}
+	s.addPod(pod, "node1", util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 16000, Usedcores: 100}}})
+
+	usage, _, err := s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	failed := map[string]string{}
+	res, err := calcScore(usage, &failed, gpuRequest(1, 0, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-1")
+
+	usage, _, err = s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	res, err = calcScore(usage, &failed, gpuRequest(2, 0, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonDevicesFull))
+
+	devs := s.nodeStatuses()["node1"].Devices
+	assert.Equal(t, devs[0].Exclusive, true)
+	assert.Equal(t, devs[1].Exclusive, false)
+
+	// dedicated pods keep others off their GPUs the same way
+	dedicated := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "d", Namespace: "default", UID: "uid-d",
+		Annotations: map[string]string{util.GPUModeAnnotation: util.GPUModeDedicated, util.ColocateGroupAnnotation: "g"}}}
+	s.addPod(dedicated, "node1", util.PodDevices{{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 16000, Usedcores: 100}}})
+	usage, _, err = s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	res, err = calcScore(usage, &failed, gpuRequest(1, 0, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	devs = s.nodeStatuses()["node1"].Devices
+	assert.Equal(t, devs[1].Exclusive, true)
+	// and don't anchor their co-location group
+	assert.Equal(t, len(s.groups), 0)
+}
+
+func TestCalcScoreSkipsDrainedDevice(t *testing.T) {
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+		{ID: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid"}}
+	s.addPod(pod, "node1", util.PodDevices{{{UUID: "GPU-1", Type: util.NvidiaGPUDevice, Usedmem: 1000}}})
+	s.setDrained("node1", []string{"GPU-1"})
+
+	usage, _, err := s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	failed := map[string]string{}
+	res, err := calcScore(usage, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, (*res)[0].devices[0][0].UUID, "GPU-0")
+
+	usage, _, err = s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	res, err = calcScore(usage, &failed, gpuRequest(2, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonDrained))
+	devs := s.nodeStatuses()["node1"].Devices
+	assert.Equal(t, devs[1].Drained, true)
+	assert.Equal(t, devs[1].Allocated, int32(1))
+
+	s.setDrained("node1", nil)
+	usage, _, err = s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	res, err = calcScore(usage, &failed, gpuRequest(2, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, s.nodeStatuses()["node1"].Devices[1].Drained, false)
+}
+
+func TestCalcScoreHonorsMaxShares(t *testing.T) {
+	newNodes := func() map[string]*NodeUsage {
+		return map[string]*NodeUsage{
+			"node1": {Devices: DeviceUsageList{
+				{Id: "GPU-a", Count: 10, MaxShares: 2, Used: 2, Usedmem: 2000, Totalmem: 16000, Type: "NVIDIA-Tesla T4"},
+			}},
+		}
+	}
+	nodes := newNodes()
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonDevicesFull))
+
+	// the split count still sizes slices when max shares is lower
+	nodes = newNodes()
+	nodes["node1"].Devices[0].MaxShares = 3
+	slice := gpuRequest(1, 0, 0)
+	slice[0][0].Slice = true
+	res, err = calcScore(&nodes, &failed, slice, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	assert.Equal(t, (*res)[0].devices[0][0].Usedmem, int32(1600))
+
+	// a max shares above the split count doesn't raise it
+	nodes = newNodes()
+	nodes["node1"].Devices[0].Count, nodes["node1"].Devices[0].MaxShares = 2, 4
+	failed = map[string]string{}
+	_, err = calcScore(&nodes, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, failed["node1"], string(ReasonDevicesFull))
+}
+
+func TestCalcScoreResolvesMemoryPercentPerDevice(t *testing.T) {
+	nodes := map[string]*NodeUsage{
+		"node1": {Devices: DeviceUsageList{
+			{Id: "GPU-a", Count: 10, Totalmem: 40000, Type: "NVIDIA-A100"},
+			{Id: "GPU-b", Count: 10, Totalmem: 24000, Type: "NVIDIA-A10"},
+		}},
+	}
+	req := gpuRequest(2, 0, 0)
+	req[0][0].MemPercentagereq = 25
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, req, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	got := map[string]int32{}
+	for _, d := range (*res)[0].devices[0] {
+		got[d.UUID] = d.Usedmem
+	}
+	assert.DeepEqual(t, got, map[string]int32{"GPU-a": 10000, "GPU-b": 6000})
+}
+
+func TestFilterRejectsInvalidMemoryPercent(t *testing.T) {
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	for _, val := range []string{"0", "101", "-5", "25%", "quarter"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid", Annotations: map[string]string{
+				util.MemoryPercentAnnotation: val,
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceName(util.ResourceName): resource.MustParse("1")},
+			}}}},
+		}
+		_, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+		assert.ErrorContains(t, err, "annotation "+util.MemoryPercentAnnotation, val)
+	}
+}
+
+func TestCalcScoreLimitsMemoryBandwidth(t *testing.T) {
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{
+		{ID: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true},
+	}})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "uid", Annotations: map[string]string{
+		util.MemoryBandwidthAnnotation: "70",
+	}}}
+	s.addPod(pod, "node1", util.PodDevices{{{UUID: "GPU-0", Type: util.NvidiaGPUDevice, Usedmem: 1000}}})
+
+	usage, _, err := s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, (*usage)["node1"].Devices[0].Usedmembw, int32(70))
+	req := gpuRequest(1, 1000, 0)
+	req[0][0].MemBandwidthreq = 40
+	failed := map[string]string{}
+	res, err := calcScore(usage, &failed, req, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 0)
+	assert.Equal(t, failed["node1"], string(ReasonInsufficientBandwidth))
+
+	// pods without a limit aren't held back
+	usage, _, err = s.getNodesUsage(&[]string{"node1"}, nil)
+	assert.NilError(t, err)
+	req[0][0].MemBandwidthreq = 30
+	res, err = calcScore(usage, &failed, req, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+	res, err = calcScore(usage, &failed, gpuRequest(1, 1000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 1)
+
+	for _, val := range []string{"0", "101", "fast"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "q", Namespace: "default", UID: "uid2", Annotations: map[string]string{
+				util.MemoryBandwidthAnnotation: val,
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceName(util.ResourceName): resource.MustParse("1")},
+			}}}},
+		}
+		_, err := s.Filter(extenderv1.ExtenderArgs{Pod: pod, NodeNames: &[]string{"node1"}})
+		assert.ErrorContains(t, err, "annotation "+util.MemoryBandwidthAnnotation, val)
+	}
+}
+
+func TestCalcScoreWeighsFactors(t *testing.T) {
+	oldSpread, oldModel := config.ScoreWeightSpread, config.ScoreWeightModel
+	defer func() { config.ScoreWeightSpread, config.ScoreWeightModel = oldSpread, oldModel }()
+	best := func(annos map[string]string) (string, scoreFactors) {
+		nodes := map[string]*NodeUsage{
+			"busy": {Devices: DeviceUsageList{
+				{Id: "GPU-a", Count: 10, Used: 5, Usedmem: 5000, Totalmem: 16000, Type: "NVIDIA-H100"},
+			}},
+			"idle": {Devices: DeviceUsageList{
+				{Id: "GPU-b", Count: 10, Totalmem: 16000, Type: "NVIDIA-A100"},
+			}},
+		}
+		failed := map[string]string{}
+		res, err := calcScore(&nodes, &failed, gpuRequest(1, 1000, 0), annos)
+		assert.NilError(t, err)
+		assert.Equal(t, len(*res), 2)
+		sort.Sort(res)
+		m := (*res)[len(*res)-1]
+		assert.Equal(t, m.score, m.factors.weighted())
+		return m.nodeID, m.factors
+	}
+
+	node, factors := best(nil)
+	assert.Equal(t, node, "idle")
+	assert.DeepEqual(t, factors, scoreFactors{spread: 1}, cmp.AllowUnexported(scoreFactors{}))
+
+	config.ScoreWeightSpread = -1
+	node, factors = best(nil)
+	assert.Equal(t, node, "busy")
+	assert.DeepEqual(t, factors, scoreFactors{spread: 0.5}, cmp.AllowUnexported(scoreFactors{}))
+
+	config.ScoreWeightSpread, config.ScoreWeightModel = 1, 1
+	node, factors = best(map[string]string{util.GPUInUse: "H100,A100"})
+	assert.Equal(t, node, "busy")
+	assert.DeepEqual(t, factors, scoreFactors{spread: 0.5, model: 1}, cmp.AllowUnexported(scoreFactors{}))
+	assert.Equal(t, factors.String(), "spread 0.500*1, devices 0.000*1, placement 0.000*1, model 1.000*1, topology 0.000*1, policy 0.000")
+}
+
+// TestSelectionIsDeterministic checks that the node and devices chosen for a pod don't
+// depend on the order nodes and devices are listed in, also with many ties.
+func TestSelectionIsDeterministic(t *testing.T) {
+	pick := func(r *rand.Rand, seed int64, spec map[string][]DeviceUsage, nums [][]util.ContainerDeviceRequest) string {
+		nodes := make(map[string]*NodeUsage, len(spec))
+		for id, devices := range spec {
+			node := &NodeUsage{}
+			for _, i := range r.Perm(len(devices)) {
+				d := devices[i]
+				node.Devices = append(node.Devices, &d)
+			}
+			nodes[id] = node
+		}
+		failed := make(map[string]string)
+		scores, err := calcScore(&nodes, &failed, nums, nil)
+		assert.NilError(t, err)
+		if len(*scores) == 0 {
+			return ""
+		}
+		r.Shuffle(len(*scores), func(i, j int) { (*scores)[i], (*scores)[j] = (*scores)[j], (*scores)[i] })
+		newTieBreaker(seed).sort(*scores)
+		m := (*scores)[len(*scores)-1]
+		return m.nodeID + " " + annotations.EncodePodDevices(m.devices)
+	}
+	property := func(seed int64, selectionSeed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		spec := make(map[string][]DeviceUsage)
+		for n := 0; n < 1+r.Intn(4); n++ {
+			var devices []DeviceUsage
+			for d := 0; d < 1+r.Intn(6); d++ {
+				// few distinct values, so devices and nodes tie often
+				count := int32(1 + r.Intn(3))
+				used := int32(r.Intn(int(count) + 1))
+				devices = append(devices, DeviceUsage{
+					Id:       fmt.Sprintf("GPU-%v-%v", n, d),
+					Count:    count,
+					Used:     used,
+					Totalmem: 16000,
+					Usedmem:  used * 4000,
+					Type:     "NVIDIA-A10",
+					Health:   true,
+				})
+			}
+			spec[fmt.Sprintf("node%v", n)] = devices
+		}
+		nums := gpuRequest(int32(1+r.Intn(2)), 4000, 0)
+		first := pick(r, selectionSeed, spec, nums)
+		for i := 0; i < 5; i++ {
+			if got := pick(r, selectionSeed, spec, nums); got != first {
+				t.Logf("seed %v: picked %q, then %q", seed, first, got)
+				return false
+			}
+		}
+		return true
+	}
+	assert.NilError(t, quick.Check(func(seed int64) bool { return property(seed, 0) }, nil))
+	assert.NilError(t, quick.Check(func(seed int64) bool { return property(seed, 42) }, nil))
+}
+
+func TestTieBreaker(t *testing.T) {
+	scores := func() NodeScoreList {
+		return NodeScoreList{{nodeID: "node3", score: 1}, {nodeID: "node1", score: 1}, {nodeID: "node2", score: 1}, {nodeID: "node0", score: 0.5}}
+	}
+	// without a seed the first name wins
+	s := scores()
+	newTieBreaker(0).sort(s)
+	assert.Equal(t, s[len(s)-1].nodeID, "node1")
+	assert.Equal(t, s[0].nodeID, "node0")
+
+	// a seed replays the same sequence of choices, which spreads over the tied nodes
+	replay := func(seed int64) []string {
+		tb := newTieBreaker(seed)
+		var res []string
+		for i := 0; i < 20; i++ {
+			s := scores()
+			tb.sort(s)
+			res = append(res, s[len(s)-1].nodeID)
+		}
+		return res
+	}
+	picks := replay(7)
+	assert.DeepEqual(t, replay(7), picks)
+	seen := make(map[string]bool)
+	for _, p := range picks {
+		seen[p] = true
+	}
+	assert.Assert(t, !seen["node0"])
+	assert.Assert(t, len(seen) > 1, "picks %v", picks)
+}
+
+func TestDeviceUsageListOrder(t *testing.T) {
+	devices := DeviceUsageList{
+		{Id: "GPU-b", Count: 4, Used: 1, Totalmem: 16000, Usedmem: 4000},
+		{Id: "GPU-a", Count: 4, Used: 1, Totalmem: 16000, Usedmem: 4000},
+		{Id: "GPU-c", Count: 4, Used: 1, Totalmem: 16000, Usedmem: 2000},
+		{Id: "GPU-d", Count: 4, Used: 0, Totalmem: 16000},
+	}
+	sort.Sort(devices)
+	var order []string
+	for _, i := range candidateOrder(devices) {
+		order = append(order, devices[i].Id)
+	}
+	// most shares left, then most free memory, then the lower UUID
+	assert.DeepEqual(t, order, []string{"GPU-d", "GPU-c", "GPU-a", "GPU-b"})
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+)
+
+// deviceLinks is the level of the link between two GPUs of a node by their UUIDs, see
+// annotations.DeviceLink. It is replaced, never changed, so node usages can share it.
+type deviceLinks map[string]map[string]int32
+
+func newDeviceLinks(links []annotations.DeviceLink) deviceLinks {
+	if len(links) == 0 {
+		return nil
+	}
+	res := make(deviceLinks)
+	for _, l := range links {
+		for _, ab := range [][2]string{{l.A, l.B}, {l.B, l.A}} {
+			if res[ab[0]] == nil {
+				res[ab[0]] = make(map[string]int32)
+			}
+			res[ab[0]][ab[1]] = l.Level
+		}
+	}
+	return res
+}
+
+// level is the level of the link between the GPUs a and b, 0 if unknown.
+func (l deviceLinks) level(a, b string) int32 {
+	return l[a][b]
+}
+
+// factor is how well devs are connected, the mean level of the links between each two of
+// them over annotations.MaxLinkLevel, from 0 to 1. It is 0 for fewer than two GPUs.
+func (l deviceLinks) factor(devs util.ContainerDevices) float32 {
+	if len(devs) < 2 {
+		return 0
+	}
+	var sum, pairs int32
+	for i := range devs {
+		for j := i + 1; j < len(devs); j++ {
+			sum += l.level(devs[i].UUID, devs[j].UUID)
+			pairs++
+		}
+	}
+	return float32(sum) / float32(pairs*annotations.MaxLinkLevel)
+}
+
+// setLinks records the links between the GPUs of nodeID the device plugin reported in
+// util.NodeNvidiaTopologyAnnotation.
+func (m *nodeManager) setLinks(nodeID string, links []annotations.DeviceLink) {
+	l := newDeviceLinks(links)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if l == nil {
+		delete(m.links, nodeID)
+		return
+	}
+	m.links[nodeID] = l
+}
+
+// linksOf returns the links between the GPUs of nodeID, nil if they weren't reported.
+func (m *nodeManager) linksOf(nodeID string) deviceLinks {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.links[nodeID]
+}
+
+// connectedOrder moves the set of k.Nums devices in order that fit request k and are
+// connected best to the front of order, for the NVIDIA GPUs of a node whose links are
+// known. Otherwise, or if fewer devices fit, order is returned as it is.
+func connectedOrder(node *NodeUsage, order []int, k util.ContainerDeviceRequest, annos map[string]string) []int {
+	if k.Type != util.NvidiaGPUDevice || k.Nums < 2 || len(node.Links) == 0 {
+		return order
+	}
+	var fitting []int
+	for _, i := range order {
+		d := node.Devices[i]
+		if d.Profile != k.Profile {
+			continue
+		}
+		if _, skip := deviceFits(d, k.ForType(d.Type), annos); skip == "" {
+			fitting = append(fitting, i)
+		}
+	}
+	best := bestConnected(fitting, int(k.Nums), func(i, j int) int32 {
+		return node.Links.level(node.Devices[i].Id, node.Devices[j].Id)
+	})
+	if best == nil {
+		return order
+	}
+	res := make([]int, 0, len(order))
+	taken := make(map[int]bool, len(best))
+	for _, i := range best {
+		res = append(res, i)
+		taken[i] = true
+	}
+	for _, i := range order {
+		if !taken[i] {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// bestConnected picks size of the candidates with the highest sum of the levels of the
+// links between each two of them. Starting from each candidate in turn it adds the one
+// with the best links to those picked so far, which finds the best set of the NVLink
+// meshes and islands of common GPU servers without trying every combination. Ties go to
+// the candidates listed first, nil is returned for fewer than size candidates.
+func bestConnected(candidates []int, size int, level func(i, j int) int32) []int {
+	if size <= 0 || len(candidates) < size {
+		return nil
+	}
+	var best []int
+	bestSum := int32(-1)
+	for _, seed := range candidates {
+		set := []int{seed}
+		in := map[int]bool{seed: true}
+		sum := int32(0)
+		for len(set) < size {
+			next, nextSum := -1, int32(-1)
+			for _, c := range candidates {
+				if in[c] {
+					continue
+				}
+				s := int32(0)
+				for _, p := range set {
+					s += level(p, c)
+				}
+				if s > nextSum {
+					next, nextSum = c, s
+				}
+			}
+			set = append(set, next)
+			in[next] = true
+			sum += nextSum
+		}
+		if sum > bestSum {
+			best, bestSum = set, sum
+		}
+	}
+	return best
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"gotest.tools/v3/assert"
+)
+
+// islands is a synthetic node of two NVLink islands of four GPUs, GPU-0 to GPU-3 with two
+// NVLinks between each two of them and GPU-4 to GPU-7 with twelve, the islands connected
+// across the CPU sockets.
+func islands() []annotations.DeviceLink {
+	var links []annotations.DeviceLink
+	for a := 0; a < 8; a++ {
+		for b := a + 1; b < 8; b++ {
+			level := int32(1)
+			switch {
+			case a < 4 && b < 4:
+				level = 8
+			case a >= 4:
+				level = annotations.MaxLinkLevel
+			}
+			links = append(links, annotations.DeviceLink{A: fmt.Sprintf("GPU-%d", a), B: fmt.Sprintf("GPU-%d", b), Level: level})
+		}
+	}
+	return links
+}
+
+func islandNode(busy ...int) *NodeUsage {
+	node := &NodeUsage{Links: newDeviceLinks(islands())}
+	for i := 0; i < 8; i++ {
+		node.Devices = append(node.Devices, &DeviceUsage{Id: fmt.Sprintf("GPU-%d", i), Count: 4, Totalmem: 16000, Type: "NVIDIA-A100"})
+	}
+	for _, i := range busy {
+		node.Devices[i].Used, node.Devices[i].Usedmem = 1, 12000
+	}
+	return node
+}
+
+func chosen(score *NodeScore) []string {
+	var ids []string
+	for _, d := range score.devices[0] {
+		ids = append(ids, d.UUID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestCalcScorePicksConnectedSet(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		busy []int
+		nums int32
+		want []string
+	}{
+		// the GPUs with the lowest UUIDs would be picked without the topology
+		{"best island", nil, 2, []string{"GPU-4", "GPU-5"}},
+		{"whole island", nil, 4, []string{"GPU-4", "GPU-5", "GPU-6", "GPU-7"}},
+		{"rest of the best island", []int{5}, 3, []string{"GPU-4", "GPU-6", "GPU-7"}},
+		// three free GPUs of the best island are better than four of the other one
+		{"island too full", []int{5, 6}, 4, []string{"GPU-0", "GPU-1", "GPU-2", "GPU-3"}},
+		{"across islands", []int{0, 1, 2, 5, 6, 7}, 2, []string{"GPU-3", "GPU-4"}},
+	} {
+		nodes := map[string]*NodeUsage{"node1": islandNode(tc.busy...)}
+		failed := map[string]string{}
+		res, err := calcScore(&nodes, &failed, gpuRequest(tc.nums, 8000, 0), nil)
+		assert.NilError(t, err)
+		assert.Equal(t, len(*res), 1, tc.name)
+		assert.DeepEqual(t, chosen((*res)[0]), tc.want)
+	}
+}
+
+func TestCalcScorePrefersConnectedNode(t *testing.T) {
+	// node1 has the same GPUs without NVLinks
+	pcie := islandNode()
+	for _, l := range pcie.Links {
+		for b := range l {
+			l[b] = 2
+		}
+	}
+	nodes := map[string]*NodeUsage{"node1": pcie, "node2": islandNode()}
+	failed := map[string]string{}
+	res, err := calcScore(&nodes, &failed, gpuRequest(2, 8000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(*res), 2)
+	scores := map[string]*NodeScore{}
+	for _, s := range *res {
+		scores[s.nodeID] = s
+	}
+	assert.Equal(t, scores["node1"].factors.topology, float32(2)/annotations.MaxLinkLevel)
+	assert.Equal(t, scores["node2"].factors.topology, float32(1))
+	assert.Assert(t, scores["node2"].score > scores["node1"].score)
+
+	// single GPU containers and nodes without reported links score no topology
+	nodes = map[string]*NodeUsage{"node1": islandNode()}
+	nodes["node1"].Links = nil
+	res, err = calcScore(&nodes, &failed, gpuRequest(2, 8000, 0), nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, chosen((*res)[0]), []string{"GPU-0", "GPU-1"})
+	assert.Equal(t, (*res)[0].factors.topology, float32(0))
+	nodes = map[string]*NodeUsage{"node1": islandNode()}
+	res, err = calcScore(&nodes, &failed, gpuRequest(1, 8000, 0), nil)
+	assert.NilError(t, err)
+	assert.Equal(t, (*res)[0].factors.topology, float32(0))
+}
+
+func TestNodesUsageCarriesLinks(t *testing.T) {
+	s := NewScheduler()
+	s.addNode("node1", &NodeInfo{ID: "node1", Devices: []DeviceInfo{{ID: "GPU-0", Count: 4, Devmem: 16000, Type: "NVIDIA-A100", Health: true}}})
+	s.setLinks("node1", islands())
+	usage, _ := s.nodesUsage(&[]string{"node1"})
+	assert.Equal(t, usage["node1"].Links.level("GPU-7", "GPU-4"), int32(annotations.MaxLinkLevel))
+
+	s.setLinks("node1", nil)
+	usage, _ = s.nodesUsage(&[]string{"node1"})
+	assert.Assert(t, usage["node1"].Links == nil)
+}
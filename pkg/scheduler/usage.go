@@ -0,0 +1,140 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"net/http"
+	"sort"
+
+	"4pd.io/k8s-vgpu/pkg/apis/vgpu/v1alpha1"
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+// UsagePath is served by the metrics component with the NodeUsageReport of each node.
+const UsagePath = "/usage"
+
+// Fields of the NodeUsageReports a request to UsagePath can select.
+const (
+	UsageFieldSummary = "summary"
+	UsageFieldDevices = "devices"
+	UsageFieldPods    = "pods"
+)
+
+// UsagePage is what a request to UsagePath gets.
+type UsagePage struct {
+	// Nodes is the number of nodes on all pages
+	Nodes int               `json:"nodes"`
+	Items []NodeUsageReport `json:"items"`
+	// Continue is the token of the next page, empty on the last
+	Continue string `json:"continue,omitempty"`
+}
+
+// NodeUsageReport is the vGPU usage of a node as the scheduler accounts it, with the
+// parts a request selects only.
+type NodeUsageReport struct {
+	Node    string                      `json:"node"`
+	Summary *NodeUsageSummary           `json:"summary,omitempty"`
+	Devices []v1alpha1.VGPUDeviceStatus `json:"devices,omitempty"`
+	Pods    []PodUsage                  `json:"pods,omitempty"`
+}
+
+// NodeUsageSummary sums up the devices of a node, memory in MiB.
+type NodeUsageSummary struct {
+	DeviceCount     int32 `json:"deviceCount"`
+	TotalMemory     int64 `json:"totalMemory"`
+	AllocatedMemory int64 `json:"allocatedMemory"`
+}
+
+// PodUsage is a pod or ResourceClaim and the devices it was assigned on the node.
+type PodUsage struct {
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	UID       k8stypes.UID    `json:"uid"`
+	Claim     bool            `json:"claim,omitempty"`
+	Devices   util.PodDevices `json:"devices"`
+}
+
+// nodePods returns the pods assigned devices on the nodes, sorted by namespace and name.
+func (m *podManager) nodePods(nodes map[string]bool) map[string][]PodUsage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	res := make(map[string][]PodUsage)
+	for _, p := range m.pods {
+		if nodes[p.NodeID] {
+			res[p.NodeID] = append(res[p.NodeID], PodUsage{Namespace: p.Namespace, Name: p.Name, UID: p.Uid, Claim: p.Claim, Devices: p.Devices})
+		}
+	}
+	for _, pods := range res {
+		sort.Slice(pods, func(i, j int) bool {
+			if pods[i].Namespace != pods[j].Namespace {
+				return pods[i].Namespace < pods[j].Namespace
+			}
+			return pods[i].Name < pods[j].Name
+		})
+	}
+	return res
+}
+
+// UsageHandler serves the NodeUsageReports of the nodes of s, sorted by name, a page at
+// a time. Only the nodes of the page are accounted, not all nodes of the cluster.
+func UsageHandler(s *Scheduler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := util.ParsePageRequest(r, config.DebugPageLimit, config.DebugResponseLimit, UsageFieldSummary, UsageFieldDevices, UsageFieldPods)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids := s.nodeIDs()
+		start := p.Start(ids)
+		end := len(ids)
+		if p.Limit > 0 && start+p.Limit < end {
+			end = start + p.Limit
+		}
+		page := ids[start:end]
+		usage, _ := s.nodesUsage(&page)
+		var pods map[string][]PodUsage
+		if p.Selected(UsageFieldPods) {
+			onPage := make(map[string]bool, len(page))
+			for _, id := range page {
+				onPage[id] = true
+			}
+			pods = s.nodePods(onPage)
+		}
+		head := []util.JSONField{{Name: "nodes", Value: len(ids)}}
+		util.WriteJSONPage(w, r, p, head, "items", ids, func(i int) interface{} {
+			// the page ends at end at the latest
+			id := ids[i]
+			report := NodeUsageReport{Node: id}
+			node, ok := usage[id]
+			if !ok {
+				// removed since it was listed
+				return report
+			}
+			status := s.statusOf(id, node)
+			if p.Selected(UsageFieldSummary) {
+				report.Summary = &NodeUsageSummary{DeviceCount: status.DeviceCount, TotalMemory: status.TotalMemory, AllocatedMemory: status.AllocatedMemory}
+			}
+			if p.Selected(UsageFieldDevices) {
+				report.Devices = status.Devices
+			}
+			report.Pods = pods[id]
+			return report
+		})
+	})
+}
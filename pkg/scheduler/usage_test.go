@@ -0,0 +1,113 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+// usageScheduler has nodes with 8 GPUs each and 4 pods on every node.
+func usageScheduler(nodes int) *Scheduler {
+	s := NewScheduler()
+	for n := 0; n < nodes; n++ {
+		id := fmt.Sprintf("node%04d", n)
+		info := &NodeInfo{ID: id}
+		for d := 0; d < 8; d++ {
+			info.Devices = append(info.Devices, DeviceInfo{ID: fmt.Sprintf("GPU-%v-%d", id, d), Count: 10, Devmem: 16000, Type: "NVIDIA-A100", Health: true})
+		}
+		s.addNode(id, info)
+		for p := 0; p < 4; p++ {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("p%d", p), Namespace: "default", UID: k8stypes.UID(fmt.Sprintf("%v-%d", id, p))}}
+			s.addPod(pod, id, util.PodDevices{{{UUID: info.Devices[p].ID, Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: 25}}})
+		}
+	}
+	return s
+}
+
+type usagePage struct {
+	Nodes    int               `json:"nodes"`
+	Items    []NodeUsageReport `json:"items"`
+	Continue string            `json:"continue"`
+}
+
+func getUsage(t *testing.T, s *Scheduler, url string) usagePage {
+	w := httptest.NewRecorder()
+	UsageHandler(s).ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	assert.Equal(t, w.Code, http.StatusOK, w.Body.String())
+	var page usagePage
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	return page
+}
+
+func TestUsageHandler(t *testing.T) {
+	s := usageScheduler(3)
+	page := getUsage(t, s, UsagePath+"?limit=2")
+	assert.Equal(t, page.Nodes, 3)
+	assert.Equal(t, len(page.Items), 2)
+	assert.Equal(t, page.Items[0].Node, "node0000")
+	assert.DeepEqual(t, page.Items[0].Summary, &NodeUsageSummary{DeviceCount: 8, TotalMemory: 128000, AllocatedMemory: 16000})
+	assert.Equal(t, len(page.Items[0].Devices), 8)
+	assert.Equal(t, page.Items[0].Devices[0].AllocatedMemory, int32(4000))
+	assert.Equal(t, len(page.Items[0].Pods), 4)
+	assert.DeepEqual(t, page.Items[0].Pods[1], PodUsage{
+		Namespace: "default", Name: "p1", UID: "node0000-1",
+		Devices: util.PodDevices{{{UUID: "GPU-node0000-1", Type: util.NvidiaGPUDevice, Usedmem: 4000, Usedcores: 25}}},
+	})
+
+	page = getUsage(t, s, UsagePath+"?limit=2&fields=summary&continue="+page.Continue)
+	assert.Equal(t, len(page.Items), 1)
+	assert.Equal(t, page.Items[0].Node, "node0002")
+	assert.Equal(t, page.Items[0].Summary.AllocatedMemory, int64(16000))
+	assert.Assert(t, page.Items[0].Devices == nil && page.Items[0].Pods == nil)
+	assert.Equal(t, page.Continue, "")
+
+	w := httptest.NewRecorder()
+	UsageHandler(s).ServeHTTP(w, httptest.NewRequest(http.MethodGet, UsagePath+"?fields=gpus", nil))
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+// BenchmarkUsage compares encoding the usage of 1000 nodes as a whole, as the node status
+// is built, with a page of the default size streamed by UsageHandler.
+func BenchmarkUsage(b *testing.B) {
+	s := usageScheduler(1000)
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc := json.NewEncoder(io.Discard)
+			enc.SetIndent("", "  ")
+			enc.Encode(s.nodeStatuses())
+		}
+	})
+	b.Run("page", func(b *testing.B) {
+		b.ReportAllocs()
+		h := UsageHandler(s)
+		for i := 0; i < b.N; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, UsagePath+"?limit=100", nil))
+		}
+	})
+}
@@ -21,22 +21,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/k8sutil"
 	"4pd.io/k8s-vgpu/pkg/scheduler/config"
 	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
+// Policies for containers that set the NVIDIA container runtime's environment without
+// asking for vGPUs, see config.UnmanagedGPUEnv.
+const (
+	UnmanagedGPUEnvReject = "reject"
+	UnmanagedGPUEnvStrip  = "strip"
+	UnmanagedGPUEnvAllow  = "allow"
+)
+
+// unmanagedGPUEnvs make the NVIDIA container runtime hand GPUs to a container without the
+// device plugin knowing.
+var unmanagedGPUEnvs = []string{"NVIDIA_VISIBLE_DEVICES", "NVIDIA_DRIVER_CAPABILITIES"}
+
 type webhook struct {
-	decoder *admission.Decoder
+	decoder    *admission.Decoder
+	gpuRequest gpuRequestGetter
+	// profiles are read from config.RequestProfileFile, nil without it
+	profiles *requestProfiles
 }
 
 func NewWebHook() (*admission.Webhook, error) {
+	switch config.UnmanagedGPUEnv {
+	case UnmanagedGPUEnvReject, UnmanagedGPUEnvStrip, UnmanagedGPUEnvAllow, "":
+	default:
+		return nil, fmt.Errorf("unknown unmanaged GPU env policy: %v", config.UnmanagedGPUEnv)
+	}
 	schema := runtime.NewScheme()
 	if err := clientgoscheme.AddToScheme(schema); err != nil {
 		return nil, err
@@ -45,12 +70,84 @@ func NewWebHook() (*admission.Webhook, error) {
 	if err != nil {
 		return nil, err
 	}
-	wh := &admission.Webhook{Handler: &webhook{decoder: decoder}}
+	h := &webhook{decoder: decoder, gpuRequest: newGPURequestGetter()}
+	if config.RequestProfileFile != "" {
+		if h.profiles, err = loadRequestProfiles(config.RequestProfileFile); err != nil {
+			return nil, err
+		}
+		klog.Infof("Read request profiles %v from %v", strings.Join(h.profiles.names(), ", "), config.RequestProfileFile)
+		go h.profiles.watch()
+	}
+	wh := &admission.Webhook{Handler: h}
 	_ = wh.InjectLogger(klogr.New())
 	return wh, nil
 }
 
-func (h *webhook) Handle(_ context.Context, req admission.Request) admission.Response {
+// podDeviceFields is the part of a pod read to tell whether the webhook can let it through
+// without decoding it, the resource quantities are not parsed.
+type podDeviceFields struct {
+	Metadata struct {
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		InitContainers []containerDeviceFields `json:"initContainers"`
+		Containers     []containerDeviceFields `json:"containers"`
+	} `json:"spec"`
+}
+
+type containerDeviceFields struct {
+	Resources struct {
+		Limits   map[string]json.RawMessage `json:"limits"`
+		Requests map[string]json.RawMessage `json:"requests"`
+	} `json:"resources"`
+	Env []struct {
+		Name string `json:"name"`
+	} `json:"env"`
+}
+
+// untouched is whether the pod in raw is allowed as it is without decoding it, as most
+// pods of a cluster are: none of its containers asks for vGPUs or MLUs, no annotation
+// turns into such a request and, unless config.UnmanagedGPUEnv allows them, no container
+// sets unmanagedGPUEnvs.
+func untouched(raw []byte) bool {
+	var pod podDeviceFields
+	if err := json.Unmarshal(raw, &pod); err != nil || len(pod.Spec.Containers) == 0 {
+		return false
+	}
+	for _, name := range []string{util.GPURequestAnnotation, util.VGPUProfileAnnotation} {
+		if _, ok := pod.Metadata.Annotations[name]; ok {
+			return false
+		}
+	}
+	checkEnv := config.UnmanagedGPUEnv != UnmanagedGPUEnvAllow && config.UnmanagedGPUEnv != ""
+	for _, ctrs := range [][]containerDeviceFields{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, ctr := range ctrs {
+			for _, list := range []map[string]json.RawMessage{ctr.Resources.Limits, ctr.Resources.Requests} {
+				for name := range list {
+					if _, gpu := util.ResourceProfile(name); gpu || name == util.MLUResourceCount {
+						return false
+					}
+				}
+			}
+			if !checkEnv {
+				continue
+			}
+			for _, e := range ctr.Env {
+				for _, name := range unmanagedGPUEnvs {
+					if e.Name == name {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (h *webhook) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if untouched(req.Object.Raw) {
+		return admission.Allowed(fmt.Sprintf("no resource %v", util.ResourceName))
+	}
 	pod := &corev1.Pod{}
 	err := h.decoder.Decode(req, pod)
 	if err != nil {
@@ -59,9 +156,25 @@ func (h *webhook) Handle(_ context.Context, req admission.Request) admission.Res
 	if len(pod.Spec.Containers) == 0 {
 		return admission.Denied("pod has no containers")
 	}
-	//klog.V(1).Infof("hook %v pod %v/%v", req.UID, req.Namespace, req.Name)
-	fmt.Printf("hook %v pod %v/%v", req.UID, req.Namespace, req.Name)
-	hasResource := false
+	klog.V(4).Infof("hook %v pod %v", req.UID, util.PodRef(req.Namespace, req.Name))
+	if name, ok := pod.Annotations[util.GPURequestAnnotation]; ok {
+		gpuRequest, err := h.gpuRequest(ctx, req.Namespace, name)
+		if apierrors.IsNotFound(err) {
+			return admission.Denied(fmt.Sprintf("GPURequest %v not found", name))
+		}
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if denied := applyGPURequest(pod, gpuRequest); denied != "" {
+			return admission.Denied(denied)
+		}
+	}
+	if _, ok := pod.Annotations[util.VGPUProfileAnnotation]; ok {
+		if denied := applyRequestProfile(pod, h.profiles); denied != "" {
+			return admission.Denied(denied)
+		}
+	}
+	hasResource, hasGPU := false, false
 	for idx, ctr := range pod.Spec.Containers {
 		c := &pod.Spec.Containers[idx]
 		if ctr.SecurityContext != nil {
@@ -87,7 +200,13 @@ func (h *webhook) Handle(_ context.Context, req admission.Request) admission.Res
 				Value: fmt.Sprint(priority.Value()),
 			})
 		}
-		_, ok = ctr.Resources.Limits[corev1.ResourceName(util.ResourceName)]
+		ok = false
+		for name := range ctr.Resources.Limits {
+			if _, gpu := util.ResourceProfile(string(name)); gpu {
+				ok = true
+			}
+		}
+		hasGPU = hasGPU || ok
 		if !ok {
 			_, ok := ctr.Resources.Limits[corev1.ResourceName(util.MLUResourceCount)]
 			if !ok {
@@ -102,15 +221,150 @@ func (h *webhook) Handle(_ context.Context, req admission.Request) admission.Res
 			})*/
 	}
 
-	if !hasResource {
+	stripped, denied := checkUnmanagedGPUEnv(pod)
+	if len(denied) > 0 {
+		return admission.Denied(denied)
+	}
+	if !hasResource && !stripped {
 		return admission.Allowed(fmt.Sprintf("no resource %v", util.ResourceName))
 	}
+	if !hasResource {
+		return patchPod(req, pod)
+	}
+	if val, ok := pod.Annotations[util.GPUModeAnnotation]; ok {
+		if _, err := util.ParseGPUMode(val); err != nil {
+			return admission.Denied(fmt.Sprintf("annotation %v: %v", util.GPUModeAnnotation, err))
+		}
+	}
+	if val, ok := pod.Annotations[util.MemoryPercentAnnotation]; ok {
+		if _, err := annotations.DecodeMemoryPercent(val); err != nil {
+			return admission.Denied(fmt.Sprintf("annotation %v: %v", util.MemoryPercentAnnotation, err))
+		}
+	}
+	if val, ok := pod.Annotations[util.MemoryBandwidthAnnotation]; ok {
+		if _, err := annotations.DecodeMemoryPercent(val); err != nil {
+			return admission.Denied(fmt.Sprintf("annotation %v: %v", util.MemoryBandwidthAnnotation, err))
+		}
+	}
+	if err := k8sutil.CheckRequests(pod); err != nil {
+		return admission.Denied(err.Error())
+	}
 	if len(config.SchedulerName) > 0 {
 		pod.Spec.SchedulerName = config.SchedulerName
 	}
+	if hasGPU && config.GPUNodeAffinity {
+		requireGPUNode(pod)
+	}
+	return patchPod(req, pod)
+}
+
+func patchPod(req admission.Request, pod *corev1.Pod) admission.Response {
 	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
 	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
 }
+
+// requestsDevices is whether the container asks for vGPUs or MLUs.
+func requestsDevices(ctr *corev1.Container) bool {
+	for name := range ctr.Resources.Limits {
+		if _, gpu := util.ResourceProfile(string(name)); gpu {
+			return true
+		}
+	}
+	_, ok := ctr.Resources.Limits[corev1.ResourceName(util.MLUResourceCount)]
+	return ok
+}
+
+// checkUnmanagedGPUEnv applies config.UnmanagedGPUEnv to the containers that set
+// unmanagedGPUEnvs without asking for vGPUs or MLUs. A container runtime honouring them
+// would hand the container GPUs the scheduler doesn't account. Privileged containers see
+// all devices anyway and are left alone, like NVIDIA_VISIBLE_DEVICES=void or none, which
+// hand out no GPU. It returns whether variables were stripped, or why the pod is denied.
+func checkUnmanagedGPUEnv(pod *corev1.Pod) (stripped bool, denied string) {
+	if config.UnmanagedGPUEnv == UnmanagedGPUEnvAllow || config.UnmanagedGPUEnv == "" {
+		return false, ""
+	}
+	containers := make([]*corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for i := range pod.Spec.InitContainers {
+		containers = append(containers, &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		containers = append(containers, &pod.Spec.Containers[i])
+	}
+	for _, c := range containers {
+		if c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged || requestsDevices(c) {
+			continue
+		}
+		env := c.Env[:0:0]
+		for _, e := range c.Env {
+			if !unmanagedGPUEnv(e) {
+				env = append(env, e)
+				continue
+			}
+			if config.UnmanagedGPUEnv == UnmanagedGPUEnvReject {
+				return false, fmt.Sprintf("container %v sets %v without requesting %v, it would use GPUs outside vGPU accounting", c.Name, e.Name, util.ResourceName)
+			}
+			klog.Infof("Stripping %v from container %v of pod %v, it doesn't request %v", e.Name, c.Name, util.PodRef(pod.Namespace, pod.Name), util.ResourceName)
+			stripped = true
+		}
+		c.Env = env
+	}
+	return stripped, ""
+}
+
+func unmanagedGPUEnv(e corev1.EnvVar) bool {
+	for _, name := range unmanagedGPUEnvs {
+		if e.Name != name {
+			continue
+		}
+		if name == "NVIDIA_VISIBLE_DEVICES" && e.ValueFrom == nil && (e.Value == "void" || e.Value == "none" || e.Value == "") {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// requireGPUNode adds util.GPUNodeLabel to the required node affinity of pod, so
+// kube-scheduler filters out the nodes without GPUs before calling the extender. Node
+// selector terms are ORed, so the requirement goes into each of them; terms requiring
+// the label already, whatever the operator, are left as they are.
+func requireGPUNode(pod *corev1.Pod) {
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      util.GPUNodeLabel,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{util.GPUNodeLabelValue},
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := pod.Spec.Affinity.NodeAffinity
+	if na.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		na.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	selector := na.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+		if requiresLabel(term, util.GPUNodeLabel) {
+			continue
+		}
+		term.MatchExpressions = append(term.MatchExpressions, requirement)
+	}
+}
+
+func requiresLabel(term *corev1.NodeSelectorTerm, key string) bool {
+	for _, e := range term.MatchExpressions {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
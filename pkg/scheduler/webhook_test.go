@@ -0,0 +1,269 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"4pd.io/k8s-vgpu/pkg/scheduler/config"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"gotest.tools/v3/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+var gpuNodeRequirement = corev1.NodeSelectorRequirement{
+	Key:      util.GPUNodeLabel,
+	Operator: corev1.NodeSelectorOpIn,
+	Values:   []string{util.GPUNodeLabelValue},
+}
+
+// setWebhookResources sets the resource names the flags set in the binaries.
+func setWebhookResources(t *testing.T) {
+	oldGPU, oldMLU := util.ResourceName, util.MLUResourceCount
+	t.Cleanup(func() { util.ResourceName, util.MLUResourceCount = oldGPU, oldMLU })
+	util.ResourceName, util.MLUResourceCount = "nvidia.com/gpu", "cambricon.com/mlunum"
+}
+
+func TestRequireGPUNode(t *testing.T) {
+	zone := corev1.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a", "b"}}
+	noSpot := corev1.NodeSelectorRequirement{Key: "spot", Operator: corev1.NodeSelectorOpDoesNotExist}
+	hostname := corev1.NodeSelectorRequirement{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node1"}}
+	ownLabel := corev1.NodeSelectorRequirement{Key: util.GPUNodeLabel, Operator: corev1.NodeSelectorOpExists}
+	preferred := []corev1.PreferredSchedulingTerm{{Weight: 10, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{zone}}}}
+	podAffinity := &corev1.PodAffinity{RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{TopologyKey: "kubernetes.io/hostname"}}}
+
+	for _, tc := range []struct {
+		name     string
+		affinity *corev1.Affinity
+		want     *corev1.Affinity
+	}{{
+		name: "no affinity",
+		want: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{gpuNodeRequirement}},
+			}},
+		}},
+	}, {
+		name:     "pod affinity and preferred node affinity are kept",
+		affinity: &corev1.Affinity{PodAffinity: podAffinity, NodeAffinity: &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: preferred}},
+		want: &corev1.Affinity{PodAffinity: podAffinity, NodeAffinity: &corev1.NodeAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{gpuNodeRequirement}},
+			}},
+		}},
+	}, {
+		name: "every ORed term gets the requirement",
+		affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{zone, noSpot}},
+				{MatchFields: []corev1.NodeSelectorRequirement{hostname}},
+			}},
+		}},
+		want: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{zone, noSpot, gpuNodeRequirement}},
+				{MatchFields: []corev1.NodeSelectorRequirement{hostname}, MatchExpressions: []corev1.NodeSelectorRequirement{gpuNodeRequirement}},
+			}},
+		}},
+	}, {
+		name: "terms requiring the label are left alone",
+		affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{ownLabel, zone}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{noSpot}},
+			}},
+		}},
+		want: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{ownLabel, zone}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{noSpot, gpuNodeRequirement}},
+			}},
+		}},
+	}, {
+		name:     "an empty node selector gets a term",
+		affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{}}},
+		want: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{gpuNodeRequirement}},
+			}},
+		}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Affinity: tc.affinity}}
+			requireGPUNode(pod)
+			assert.DeepEqual(t, pod.Spec.Affinity, tc.want)
+			// a second pass changes nothing
+			requireGPUNode(pod)
+			assert.DeepEqual(t, pod.Spec.Affinity, tc.want)
+		})
+	}
+}
+
+func TestWebhookRequiresGPUNode(t *testing.T) {
+	setWebhookResources(t)
+	old := config.GPUNodeAffinity
+	t.Cleanup(func() { config.GPUNodeAffinity = old })
+	wh, err := NewWebHook()
+	assert.NilError(t, err)
+	handle := func(limits corev1.ResourceList) *corev1.Pod {
+		pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{Limits: limits}}}}}
+		raw, err := json.Marshal(pod)
+		assert.NilError(t, err)
+		resp := wh.Handler.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}})
+		assert.Assert(t, resp.Allowed)
+		for _, p := range resp.Patches {
+			if p.Path == "/spec/affinity" {
+				data, err := json.Marshal(p.Value)
+				assert.NilError(t, err)
+				assert.NilError(t, json.Unmarshal(data, &pod.Spec.Affinity))
+			}
+		}
+		return pod
+	}
+	gpu := corev1.ResourceList{corev1.ResourceName(util.ResourceName): resource.MustParse("1")}
+
+	config.GPUNodeAffinity = true
+	pod := handle(gpu)
+	assert.Assert(t, pod.Spec.Affinity != nil)
+	assert.DeepEqual(t, pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions,
+		[]corev1.NodeSelectorRequirement{gpuNodeRequirement})
+	// MLU nodes aren't labeled
+	pod = handle(corev1.ResourceList{corev1.ResourceName(util.MLUResourceCount): resource.MustParse("1")})
+	assert.Assert(t, pod.Spec.Affinity == nil)
+
+	config.GPUNodeAffinity = false
+	pod = handle(gpu)
+	assert.Assert(t, pod.Spec.Affinity == nil)
+}
+
+func TestWebhookUnmanagedGPUEnv(t *testing.T) {
+	setWebhookResources(t)
+	old := config.UnmanagedGPUEnv
+	t.Cleanup(func() { config.UnmanagedGPUEnv = old })
+	wh, err := NewWebHook()
+	assert.NilError(t, err)
+	privileged := true
+	env := []corev1.EnvVar{{Name: "NVIDIA_VISIBLE_DEVICES", Value: "all"}, {Name: "HOME", Value: "/root"}, {Name: "NVIDIA_DRIVER_CAPABILITIES", Value: "compute,utility"}}
+	gpu := corev1.ResourceList{corev1.ResourceName(util.ResourceName): resource.MustParse("1")}
+	pod := func() *corev1.Pod {
+		return &corev1.Pod{Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Env: env}},
+			Containers: []corev1.Container{
+				{Name: "vgpu", Env: env, Resources: corev1.ResourceRequirements{Limits: gpu}},
+				{Name: "sidecar", Env: []corev1.EnvVar{{Name: "NVIDIA_VISIBLE_DEVICES", Value: "void"}}},
+				{Name: "agent", Env: env, SecurityContext: &corev1.SecurityContext{Privileged: &privileged}},
+			},
+		}}
+	}
+	handle := func(pod *corev1.Pod) admission.Response {
+		raw, err := json.Marshal(pod)
+		assert.NilError(t, err)
+		return wh.Handler.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}})
+	}
+
+	config.UnmanagedGPUEnv = UnmanagedGPUEnvReject
+	resp := handle(pod())
+	assert.Assert(t, !resp.Allowed)
+	assert.Equal(t, string(resp.Result.Reason), "container init sets NVIDIA_VISIBLE_DEVICES without requesting nvidia.com/gpu, it would use GPUs outside vGPU accounting")
+
+	config.UnmanagedGPUEnv = UnmanagedGPUEnvStrip
+	p := pod()
+	stripped, denied := checkUnmanagedGPUEnv(p)
+	assert.Assert(t, stripped)
+	assert.Equal(t, denied, "")
+	assert.DeepEqual(t, p.Spec.InitContainers[0].Env, []corev1.EnvVar{{Name: "HOME", Value: "/root"}})
+	// containers asking for vGPUs, privileged ones and void devices are left alone
+	assert.DeepEqual(t, p.Spec.Containers[0].Env, env)
+	assert.DeepEqual(t, p.Spec.Containers[1].Env, []corev1.EnvVar{{Name: "NVIDIA_VISIBLE_DEVICES", Value: "void"}})
+	assert.DeepEqual(t, p.Spec.Containers[2].Env, env)
+	// a pod without vGPUs is patched too
+	p = &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Env: env}}}}
+	resp = handle(p)
+	assert.Assert(t, resp.Allowed)
+	assert.Assert(t, len(resp.Patches) > 0)
+
+	config.UnmanagedGPUEnv = UnmanagedGPUEnvAllow
+	resp = handle(p)
+	assert.Assert(t, resp.Allowed)
+	assert.Equal(t, len(resp.Patches), 0)
+
+	config.UnmanagedGPUEnv = "drop"
+	_, err = NewWebHook()
+	assert.ErrorContains(t, err, "unknown unmanaged GPU env policy")
+}
+
+func TestWebhookDeniesZeroMemory(t *testing.T) {
+	setWebhookResources(t)
+	old, oldMem, oldPct := config.AllowZeroMemory, util.ResourceMem, util.ResourceMemPercentage
+	t.Cleanup(func() { config.AllowZeroMemory, util.ResourceMem, util.ResourceMemPercentage = old, oldMem, oldPct })
+	util.ResourceMem, util.ResourceMemPercentage = "nvidia.com/gpumem", "nvidia.com/gpumem-percentage"
+	wh, err := NewWebHook()
+	assert.NilError(t, err)
+	raw, err := json.Marshal(&corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+		corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+		corev1.ResourceName(util.ResourceMem):  resource.MustParse("0"),
+	}}}}}})
+	assert.NilError(t, err)
+	handle := func() admission.Response {
+		return wh.Handler.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}})
+	}
+
+	config.AllowZeroMemory = false
+	resp := handle()
+	assert.Assert(t, !resp.Allowed)
+	assert.Equal(t, string(resp.Result.Reason), "container c asks for no device memory, nvidia.com/gpumem or nvidia.com/gpumem-percentage is 0")
+
+	config.AllowZeroMemory = true
+	assert.Assert(t, handle().Allowed)
+}
+
+func TestWebhookGPUMode(t *testing.T) {
+	setWebhookResources(t)
+	old, oldMem := config.AllowZeroMemory, util.ResourceMem
+	t.Cleanup(func() { config.AllowZeroMemory, util.ResourceMem = old, oldMem })
+	util.ResourceMem = "nvidia.com/gpumem"
+	config.AllowZeroMemory = false
+	wh, err := NewWebHook()
+	assert.NilError(t, err)
+	handle := func(mode string) admission.Response {
+		raw, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{util.GPUModeAnnotation: mode}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceName(util.ResourceName): resource.MustParse("1"),
+				corev1.ResourceName(util.ResourceMem):  resource.MustParse("0"),
+			}}}}},
+		})
+		assert.NilError(t, err)
+		return wh.Handler.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}})
+	}
+
+	// whole GPUs, whatever memory the container asks for
+	assert.Assert(t, handle(util.GPUModeDedicated).Allowed)
+	assert.Assert(t, handle(util.GPUModeExclusive).Allowed)
+	assert.Assert(t, !handle(util.GPUModeShared).Allowed)
+	resp := handle("whole")
+	assert.Assert(t, !resp.Allowed)
+	assert.Equal(t, string(resp.Result.Reason), `annotation 4pd.io/gpu-mode: unknown GPU mode "whole", expected shared, dedicated or exclusive`)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+type kubeletPlugin struct {
+	conn    *grpc.ClientConn
+	client  pluginapi.DevicePluginClient
+	devices []*pluginapi.Device
+}
+
+// FakeKubelet serves the kubelet registration service on kubelet.sock in a directory
+// and, like kubelet, dials the plugins registering with it back and watches their devices.
+type FakeKubelet struct {
+	dir    string
+	server *grpc.Server
+
+	mu            sync.Mutex
+	plugins       map[string]*kubeletPlugin
+	registrations []*pluginapi.RegisterRequest
+}
+
+// NewFakeKubelet returns a FakeKubelet for the device plugin directory dir.
+func NewFakeKubelet(dir string) *FakeKubelet {
+	return &FakeKubelet{dir: dir, plugins: make(map[string]*kubeletPlugin)}
+}
+
+// Socket is the path of the registration socket.
+func (k *FakeKubelet) Socket() string {
+	return filepath.Join(k.dir, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// Start creates the registration socket and serves it.
+func (k *FakeKubelet) Start() error {
+	if err := os.Remove(k.Socket()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ln, err := net.Listen("unix", k.Socket())
+	if err != nil {
+		return err
+	}
+	k.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(ln)
+	return nil
+}
+
+// Stop stops serving and drops the connections to the plugins, as a kubelet going down.
+func (k *FakeKubelet) Stop() {
+	if k.server != nil {
+		k.server.Stop()
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for name, p := range k.plugins {
+		p.conn.Close()
+		delete(k.plugins, name)
+	}
+}
+
+// Restart stops the kubelet and starts it again on a new socket.
+func (k *FakeKubelet) Restart() error {
+	k.Stop()
+	return k.Start()
+}
+
+func (k *FakeKubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if req.Version != pluginapi.Version {
+		return nil, fmt.Errorf("requested API version %q is not supported by kubelet. Supported versions are %q", req.Version, pluginapi.SupportedVersions)
+	}
+	conn, err := grpc.Dial(filepath.Join(k.dir, req.Endpoint),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, err
+	}
+	p := &kubeletPlugin{conn: conn, client: pluginapi.NewDevicePluginClient(conn)}
+	k.mu.Lock()
+	if old, ok := k.plugins[req.ResourceName]; ok {
+		old.conn.Close()
+	}
+	k.plugins[req.ResourceName] = p
+	k.registrations = append(k.registrations, req)
+	k.mu.Unlock()
+	// kubelet watches the devices after answering the registration
+	go k.watch(req.ResourceName, p)
+	return &pluginapi.Empty{}, nil
+}
+
+func (k *FakeKubelet) watch(resource string, p *kubeletPlugin) {
+	stream, err := p.client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		return
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		k.mu.Lock()
+		p.devices = res.Devices
+		k.mu.Unlock()
+	}
+}
+
+// Registrations returns the registration requests received so far.
+func (k *FakeKubelet) Registrations() []*pluginapi.RegisterRequest {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]*pluginapi.RegisterRequest(nil), k.registrations...)
+}
+
+// WaitForDevices waits until the devices last listed by the plugin of resource satisfy
+// ready, and returns them.
+func (k *FakeKubelet) WaitForDevices(resource string, timeout time.Duration, ready func([]*pluginapi.Device) bool) ([]*pluginapi.Device, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		k.mu.Lock()
+		var devices []*pluginapi.Device
+		p, ok := k.plugins[resource]
+		if ok {
+			devices = p.devices
+		}
+		k.mu.Unlock()
+		if ok && ready(devices) {
+			return devices, nil
+		}
+		if time.Now().After(deadline) {
+			return devices, fmt.Errorf("devices of %v not ready after %v", resource, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Allocate asks the plugin of resource for the devices with the given IDs, for a pod
+// with one container.
+func (k *FakeKubelet) Allocate(ctx context.Context, resource string, ids ...string) (*pluginapi.AllocateResponse, error) {
+	k.mu.Lock()
+	p, ok := k.plugins[resource]
+	k.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no plugin registered for %v", resource)
+	}
+	return p.client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+}
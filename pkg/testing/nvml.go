@@ -0,0 +1,309 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testing provides fakes of what the device plugin talks to: NVML, kubelet and
+// the vGPU scheduler, so the plugin's wiring can be tested without GPUs or a cluster.
+package testing
+
+import (
+	"fmt"
+	"sync"
+
+	"4pd.io/k8s-vgpu/pkg/device-plugin/nvidiadevice"
+)
+
+// FakeDevice is a GPU of FakeNVML, memory is in MiB.
+type FakeDevice struct {
+	UUID   string
+	Model  string
+	Memory uint64
+	Free   uint64
+	// Utilization is the percentage of time the device is busy
+	Utilization uint
+	// NoXids makes the device too old to report Xid errors
+	NoXids bool
+	// Persistence is whether persistence mode is enabled
+	Persistence bool
+	// Processes are the processes using the device
+	Processes []nvidiadevice.ProcessInfo
+	// Accounting is whether accounting mode is enabled
+	Accounting bool
+	// Accounted are the accounting statistics of the processes by PID, reported while
+	// accounting mode is enabled
+	Accounted map[uint]nvidiadevice.AccountingStats
+	// ComputeMode is the compute mode of the device, DEFAULT unless set
+	ComputeMode nvidiadevice.ComputeMode
+}
+
+type xidWatch struct {
+	stop   <-chan interface{}
+	uuids  map[string]bool
+	events chan<- nvidiadevice.XidEvent
+}
+
+// FakeNVML implements nvidiadevice.NVML with the devices it was given.
+type FakeNVML struct {
+	mu      sync.Mutex
+	devices []FakeDevice
+	watches []*xidWatch
+	inits   int
+	// InitError is returned by Init if set
+	InitError error
+}
+
+// NewFakeNVML returns a FakeNVML with the given devices, at /dev/nvidia0 and so on.
+func NewFakeNVML(devices ...FakeDevice) *FakeNVML {
+	return &FakeNVML{devices: devices}
+}
+
+func (f *FakeNVML) Init() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.InitError != nil {
+		return f.InitError
+	}
+	f.inits++
+	return nil
+}
+
+func (f *FakeNVML) Shutdown() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.inits == 0 {
+		return fmt.Errorf("NVML is not initialized")
+	}
+	f.inits--
+	return nil
+}
+
+// Initialized tells whether Init was called more often than Shutdown.
+func (f *FakeNVML) Initialized() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inits > 0
+}
+
+func (f *FakeNVML) DeviceCount() (uint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint(len(f.devices)), nil
+}
+
+func (f *FakeNVML) Device(index uint) (*nvidiadevice.NVMLDevice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index >= uint(len(f.devices)) {
+		return nil, fmt.Errorf("no device %v", index)
+	}
+	d := f.devices[index]
+	return &nvidiadevice.NVMLDevice{
+		UUID:   d.UUID,
+		Path:   fmt.Sprintf("/dev/nvidia%d", index),
+		Model:  d.Model,
+		Memory: d.Memory,
+	}, nil
+}
+
+func (f *FakeNVML) Query(uuid string) (nvidiadevice.DeviceSample, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID == uuid {
+			return nvidiadevice.DeviceSample{Model: d.Model, Memory: int32(d.Memory), Free: d.Free}, nil
+		}
+	}
+	return nvidiadevice.DeviceSample{}, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) Utilization(uuid string) (uint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID == uuid {
+			return d.Utilization, nil
+		}
+	}
+	return 0, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) Processes(uuid string) ([]nvidiadevice.ProcessInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID == uuid {
+			return append([]nvidiadevice.ProcessInfo(nil), d.Processes...), nil
+		}
+	}
+	return nil, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) PersistenceMode(uuid string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID == uuid {
+			return d.Persistence, nil
+		}
+	}
+	return false, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) SetPersistenceMode(uuid string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.devices {
+		if f.devices[i].UUID == uuid {
+			f.devices[i].Persistence = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) AccountingMode(uuid string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID == uuid {
+			return d.Accounting, nil
+		}
+	}
+	return false, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) SetAccountingMode(uuid string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.devices {
+		if f.devices[i].UUID == uuid {
+			f.devices[i].Accounting = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) AccountingStats(uuid string, pid uint) (nvidiadevice.AccountingStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID != uuid {
+			continue
+		}
+		stats, ok := d.Accounted[pid]
+		if !d.Accounting || !ok {
+			return nvidiadevice.AccountingStats{}, fmt.Errorf("no accounting stats of process %v on %v", pid, uuid)
+		}
+		return stats, nil
+	}
+	return nvidiadevice.AccountingStats{}, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) ComputeMode(uuid string) (nvidiadevice.ComputeMode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.devices {
+		if d.UUID == uuid {
+			return d.ComputeMode, nil
+		}
+	}
+	return 0, fmt.Errorf("no device %v", uuid)
+}
+
+func (f *FakeNVML) SetComputeMode(uuid string, mode nvidiadevice.ComputeMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.devices {
+		if f.devices[i].UUID == uuid {
+			f.devices[i].ComputeMode = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("no device %v", uuid)
+}
+
+// SetMemory changes the total and free memory the device reports from its next sample on.
+func (f *FakeNVML) SetMemory(uuid string, memory, free uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.devices {
+		if f.devices[i].UUID == uuid {
+			f.devices[i].Memory, f.devices[i].Free = memory, free
+		}
+	}
+}
+
+// SetUtilization changes the utilization the device reports.
+func (f *FakeNVML) SetUtilization(uuid string, utilization uint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.devices {
+		if f.devices[i].UUID == uuid {
+			f.devices[i].Utilization = utilization
+		}
+	}
+}
+
+func (f *FakeNVML) WatchXids(stop <-chan interface{}, uuids []string, events chan<- nvidiadevice.XidEvent) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &xidWatch{stop: stop, uuids: make(map[string]bool), events: events}
+	var unsupported []string
+	for _, uuid := range uuids {
+		found := false
+		for _, d := range f.devices {
+			if d.UUID != uuid {
+				continue
+			}
+			found = true
+			if d.NoXids {
+				unsupported = append(unsupported, uuid)
+			} else {
+				w.uuids[uuid] = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no device %v", uuid)
+		}
+	}
+	f.watches = append(f.watches, w)
+	return unsupported, nil
+}
+
+// Xid reports a critical Xid error on the device with uuid, on all devices if uuid is
+// empty. It returns once every health check watching the device received it.
+func (f *FakeNVML) Xid(uuid string, xid uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := nvidiadevice.XidEvent{UUID: uuid, GpuInstanceId: 0xFFFFFFFF, ComputeInstanceId: 0xFFFFFFFF, Xid: xid}
+	watches := f.watches[:0]
+	for _, w := range f.watches {
+		select {
+		case <-w.stop:
+			continue
+		default:
+		}
+		watches = append(watches, w)
+		if uuid != "" && !w.uuids[uuid] {
+			continue
+		}
+		select {
+		case w.events <- e:
+		case <-w.stop:
+		}
+	}
+	f.watches = watches
+}
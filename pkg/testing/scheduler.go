@@ -0,0 +1,102 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testing
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/util"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FakeScheduler stands in for the vGPU scheduler. The device plugin registers its devices
+// in node annotations rather than over gRPC, so the fake reads the registrations from the
+// nodes and assigns devices to pods through pod annotations like the scheduler's Bind.
+type FakeScheduler struct {
+	client kubernetes.Interface
+}
+
+// NewFakeScheduler returns a FakeScheduler working on client.
+func NewFakeScheduler(client kubernetes.Interface) *FakeScheduler {
+	return &FakeScheduler{client: client}
+}
+
+// Registered returns the devices last registered on node, nil if none were.
+func (s *FakeScheduler) Registered(ctx context.Context, node string) ([]*api.DeviceInfo, error) {
+	n, err := s.client.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	val, ok := n.Annotations[util.NodeNvidiaDeviceRegistered]
+	if !ok {
+		return nil, nil
+	}
+	return annotations.DecodeNodeDevices(val)
+}
+
+// WaitForRegistration waits until the devices registered on node satisfy ready, and
+// returns them.
+func (s *FakeScheduler) WaitForRegistration(ctx context.Context, node string, timeout time.Duration, ready func([]*api.DeviceInfo) bool) ([]*api.DeviceInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, err := s.Registered(ctx, node)
+		if err == nil && ready(devices) {
+			return devices, nil
+		}
+		if time.Now().After(deadline) {
+			return devices, fmt.Errorf("registration of %v not ready after %v: %v", node, timeout, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Bind creates pod assigned to node with devices, locking the node as the scheduler does,
+// so the device plugin takes it for the pod to allocate next.
+func (s *FakeScheduler) Bind(ctx context.Context, pod *corev1.Pod, node string, devices util.PodDevices) (*corev1.Pod, error) {
+	n, err := s.client.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	n = n.DeepCopy()
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	n.Annotations[util.NodeLockTime] = time.Now().Format(time.RFC3339)
+	if _, err := s.client.CoreV1().Nodes().Update(ctx, n, metav1.UpdateOptions{}); err != nil {
+		return nil, err
+	}
+
+	pod = pod.DeepCopy()
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	encoded := annotations.EncodePodDevices(devices)
+	pod.Annotations[util.AssignedNodeAnnotations] = node
+	pod.Annotations[util.AssignedIDsAnnotations] = encoded
+	pod.Annotations[util.AssignedIDsToAllocateAnnotations] = encoded
+	pod.Annotations[util.DeviceBindPhase] = util.DeviceBindAllocating
+	pod.Annotations[util.BindTimeAnnotations] = strconv.FormatInt(time.Now().Unix(), 10)
+	pod.Spec.NodeName = node
+	return s.client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+}
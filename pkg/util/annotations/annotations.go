@@ -0,0 +1,446 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package annotations encodes and parses the device assignments and registrations
+// that vGPU components exchange through pod and node annotations. Annotations can be
+// edited by anyone, so every parser validates its input and returns an error instead
+// of trusting the format.
+package annotations
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"k8s.io/klog/v2"
+)
+
+const (
+	deviceSep    = ":"
+	fieldSep     = ","
+	containerSep = ";"
+
+	nodeDeviceFields = 5
+	// plugins that scale device memory append the physical memory as a sixth field
+	nodeDeviceFieldsPhysmem = 6
+	// plugins that cap the tasks sharing a device below its count append the cap after it
+	nodeDeviceFieldsMaxShares = 7
+	// plugins that measured less memory on a device than is allocated on it flag it after
+	// the cap
+	nodeDeviceFieldsOvercommitted = 8
+	containerDeviceFields         = 4
+	containerUsageFields          = 4
+	typeRequestFields             = 3
+	deviceLinkFields              = 3
+
+	// HandshakeTimeLayout is the time format used in node handshake annotations.
+	HandshakeTimeLayout = "2006.01.02 15:04:05"
+)
+
+type ContainerDevice struct {
+	UUID      string
+	Type      string
+	Usedmem   int32
+	Usedcores int32
+}
+
+type ContainerDevices []ContainerDevice
+
+type PodDevices []ContainerDevices
+
+// ParseError describes an annotation value that doesn't match the expected format.
+type ParseError struct {
+	Value  string
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("malformed annotation value %q: %s", e.Value, e.Reason)
+}
+
+func parseInt32(value, field, entry string) (int32, error) {
+	v, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, &ParseError{Value: entry, Reason: fmt.Sprintf("%s %q is not an integer", field, value)}
+	}
+	return int32(v), nil
+}
+
+func splitFields(entry string, want int) ([]string, error) {
+	fields := strings.Split(entry, fieldSep)
+	if len(fields) != want {
+		return nil, &ParseError{Value: entry, Reason: fmt.Sprintf("expected %d fields, got %d", want, len(fields))}
+	}
+	return fields, nil
+}
+
+func EncodeNodeDevices(dlist []*api.DeviceInfo) string {
+	tmp := ""
+	for _, val := range dlist {
+		tmp += val.Id + "," + strconv.FormatInt(int64(val.Count), 10) + "," + strconv.Itoa(int(val.Devmem)) + "," + val.Type + "," + strconv.FormatBool(val.Health)
+		if val.Physmem != 0 || val.Maxshares != 0 || val.Overcommitted {
+			tmp += "," + strconv.Itoa(int(val.Physmem))
+		}
+		if val.Maxshares != 0 || val.Overcommitted {
+			tmp += "," + strconv.Itoa(int(val.Maxshares))
+		}
+		if val.Overcommitted {
+			tmp += "," + strconv.FormatBool(val.Overcommitted)
+		}
+		tmp += ":"
+	}
+	klog.V(3).Infoln("Encoded node Devices", tmp)
+	return tmp
+}
+
+// DecodeNodeDevices parses the devices a device plugin registered on its node,
+// "id,count,devmem,type,health[,physmem[,maxshares[,overcommitted]]]" entries separated by ":".
+func DecodeNodeDevices(str string) ([]*api.DeviceInfo, error) {
+	var retval []*api.DeviceInfo
+	for _, val := range strings.Split(str, deviceSep) {
+		if len(val) == 0 {
+			continue
+		}
+		items := strings.Split(val, fieldSep)
+		if len(items) < nodeDeviceFields || len(items) > nodeDeviceFieldsOvercommitted {
+			return nil, &ParseError{Value: val, Reason: fmt.Sprintf("expected %d to %d fields, got %d", nodeDeviceFields, nodeDeviceFieldsOvercommitted, len(items))}
+		}
+		count, err := parseInt32(items[1], "count", val)
+		if err != nil {
+			return nil, err
+		}
+		devmem, err := parseInt32(items[2], "devmem", val)
+		if err != nil {
+			return nil, err
+		}
+		health, err := strconv.ParseBool(items[4])
+		if err != nil {
+			return nil, &ParseError{Value: val, Reason: fmt.Sprintf("health %q is not a bool", items[4])}
+		}
+		var physmem, maxshares int32
+		if len(items) >= nodeDeviceFieldsPhysmem {
+			physmem, err = parseInt32(items[5], "physmem", val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(items) >= nodeDeviceFieldsMaxShares {
+			maxshares, err = parseInt32(items[6], "maxshares", val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var overcommitted bool
+		if len(items) == nodeDeviceFieldsOvercommitted {
+			overcommitted, err = strconv.ParseBool(items[7])
+			if err != nil {
+				return nil, &ParseError{Value: val, Reason: fmt.Sprintf("overcommitted %q is not a bool", items[7])}
+			}
+		}
+		retval = append(retval, &api.DeviceInfo{
+			Id:            items[0],
+			Count:         count,
+			Devmem:        devmem,
+			Type:          items[3],
+			Health:        health,
+			Physmem:       physmem,
+			Maxshares:     maxshares,
+			Overcommitted: overcommitted,
+		})
+	}
+	return retval, nil
+}
+
+func EncodeContainerDevices(cd ContainerDevices) string {
+	tmp := ""
+	for _, val := range cd {
+		tmp += val.UUID + "," + val.Type + "," + strconv.Itoa(int(val.Usedmem)) + "," + strconv.Itoa(int(val.Usedcores)) + ":"
+	}
+	klog.V(3).Infoln("Encoded container Devices", tmp)
+	return tmp
+}
+
+func EncodePodDevices(pd PodDevices) string {
+	var ss []string
+	for _, cd := range pd {
+		ss = append(ss, EncodeContainerDevices(cd))
+	}
+	return strings.Join(ss, containerSep)
+}
+
+// DecodeContainerDevices parses the devices assigned to one container,
+// "uuid,type,usedmem,usedcores" entries separated by ":".
+func DecodeContainerDevices(str string) (ContainerDevices, error) {
+	contdev := ContainerDevices{}
+	for _, val := range strings.Split(str, deviceSep) {
+		if len(val) == 0 {
+			continue
+		}
+		fields, err := splitFields(val, containerDeviceFields)
+		if err != nil {
+			return nil, err
+		}
+		usedmem, err := parseInt32(fields[2], "usedmem", val)
+		if err != nil {
+			return nil, err
+		}
+		usedcores, err := parseInt32(fields[3], "usedcores", val)
+		if err != nil {
+			return nil, err
+		}
+		contdev = append(contdev, ContainerDevice{
+			UUID:      fields[0],
+			Type:      fields[1],
+			Usedmem:   usedmem,
+			Usedcores: usedcores,
+		})
+	}
+	return contdev, nil
+}
+
+// DecodePodDevices parses the devices assigned to a pod, one group of container
+// devices per container separated by ";". A single container without devices, like
+// ":", reads as a pod without devices, which is how EncodePodDevices writes it.
+func DecodePodDevices(str string) (PodDevices, error) {
+	if len(str) == 0 {
+		return PodDevices{}, nil
+	}
+	var pd PodDevices
+	for _, s := range strings.Split(str, containerSep) {
+		cd, err := DecodeContainerDevices(s)
+		if err != nil {
+			return nil, err
+		}
+		pd = append(pd, cd)
+	}
+	if len(pd) == 1 && len(pd[0]) == 0 {
+		return PodDevices{}, nil
+	}
+	return pd, nil
+}
+
+// ContainerUsage is what a container used of its GPUs lately, as the device plugin
+// of its node reports it.
+type ContainerUsage struct {
+	PodUID    string
+	Container string
+	// PeakMemory is the most device memory in MiB the container held on all its GPUs
+	PeakMemory int32
+	// Cores is the percent of a GPU the kernels of the container kept busy, above 100
+	// for containers keeping more than one GPU busy
+	Cores int32
+}
+
+// EncodeContainerUsage lists the usage of containers for DecodeContainerUsage.
+func EncodeContainerUsage(usage []ContainerUsage) string {
+	var ss []string
+	for _, u := range usage {
+		ss = append(ss, u.PodUID+fieldSep+u.Container+fieldSep+strconv.Itoa(int(u.PeakMemory))+fieldSep+strconv.Itoa(int(u.Cores)))
+	}
+	return strings.Join(ss, deviceSep)
+}
+
+// DecodeContainerUsage parses the usage of the containers on a node,
+// "poduid,container,peakmem,cores" entries separated by ":".
+func DecodeContainerUsage(str string) ([]ContainerUsage, error) {
+	var res []ContainerUsage
+	for _, val := range strings.Split(str, deviceSep) {
+		if len(val) == 0 {
+			continue
+		}
+		fields, err := splitFields(val, containerUsageFields)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields[0]) == 0 || len(fields[1]) == 0 {
+			return nil, &ParseError{Value: val, Reason: "missing pod uid or container"}
+		}
+		mem, err := parseInt32(fields[2], "peakmem", val)
+		if err != nil {
+			return nil, err
+		}
+		cores, err := parseInt32(fields[3], "cores", val)
+		if err != nil {
+			return nil, err
+		}
+		if mem < 0 || cores < 0 {
+			return nil, &ParseError{Value: val, Reason: "negative usage"}
+		}
+		res = append(res, ContainerUsage{PodUID: fields[0], Container: fields[1], PeakMemory: mem, Cores: cores})
+	}
+	return res, nil
+}
+
+// TypeRequest is the memory in MiB and the percent of the cores a container asks for on
+// each GPU whose type contains Type, in place of its resource limits.
+type TypeRequest struct {
+	Type     string
+	Memreq   int32
+	Coresreq int32
+}
+
+// EncodeTypeRequests lists the requests for DecodeTypeRequests.
+func EncodeTypeRequests(reqs []TypeRequest) string {
+	var ss []string
+	for _, r := range reqs {
+		ss = append(ss, r.Type+fieldSep+strconv.Itoa(int(r.Memreq))+fieldSep+strconv.Itoa(int(r.Coresreq)))
+	}
+	return strings.Join(ss, deviceSep)
+}
+
+// DecodeTypeRequests parses the requests of a container by GPU type, "type,mem,cores"
+// entries separated by ":", the first entry whose type matches a GPU applies.
+func DecodeTypeRequests(str string) ([]TypeRequest, error) {
+	var res []TypeRequest
+	for _, val := range strings.Split(str, deviceSep) {
+		if len(val) == 0 {
+			continue
+		}
+		fields, err := splitFields(val, typeRequestFields)
+		if err != nil {
+			return nil, err
+		}
+		if len(strings.TrimSpace(fields[0])) == 0 {
+			return nil, &ParseError{Value: val, Reason: "missing type"}
+		}
+		mem, err := parseInt32(fields[1], "mem", val)
+		if err != nil {
+			return nil, err
+		}
+		cores, err := parseInt32(fields[2], "cores", val)
+		if err != nil {
+			return nil, err
+		}
+		if mem <= 0 || cores < 0 || cores > 100 {
+			return nil, &ParseError{Value: val, Reason: "mem must be positive and cores in [0,100]"}
+		}
+		res = append(res, TypeRequest{Type: strings.TrimSpace(fields[0]), Memreq: mem, Coresreq: cores})
+	}
+	return res, nil
+}
+
+// MaxLinkLevel is the level of the best link between two GPUs, twelve NVLinks.
+const MaxLinkLevel = 18
+
+// DeviceLink is how two GPUs of a node are connected, by the level NVML reports for the
+// P2P link: 1 across CPU sockets, 2 through the same CPU, 3 through a host bridge, 4
+// through several PCIe switches, 5 through one, 6 on the same board and 6+n with n NVLinks.
+// Level 0, unknown, isn't listed.
+type DeviceLink struct {
+	A     string
+	B     string
+	Level int32
+}
+
+// EncodeDeviceLinks lists the links for DecodeDeviceLinks.
+func EncodeDeviceLinks(links []DeviceLink) string {
+	var ss []string
+	for _, l := range links {
+		ss = append(ss, l.A+fieldSep+l.B+fieldSep+strconv.Itoa(int(l.Level)))
+	}
+	return strings.Join(ss, deviceSep)
+}
+
+// DecodeDeviceLinks parses the links between the GPUs of a node, "uuid,uuid,level" entries
+// separated by ":".
+func DecodeDeviceLinks(str string) ([]DeviceLink, error) {
+	var res []DeviceLink
+	for _, val := range strings.Split(str, deviceSep) {
+		if len(val) == 0 {
+			continue
+		}
+		fields, err := splitFields(val, deviceLinkFields)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields[0]) == 0 || len(fields[1]) == 0 || fields[0] == fields[1] {
+			return nil, &ParseError{Value: val, Reason: "expected two distinct uuids"}
+		}
+		level, err := parseInt32(fields[2], "level", val)
+		if err != nil {
+			return nil, err
+		}
+		if level <= 0 || level > MaxLinkLevel {
+			return nil, &ParseError{Value: val, Reason: fmt.Sprintf("level must be in [1,%d]", MaxLinkLevel)}
+		}
+		res = append(res, DeviceLink{A: fields[0], B: fields[1], Level: level})
+	}
+	return res, nil
+}
+
+// DecodeDeviceMemoryExternal parses the device memory in MiB reserved for processes outside
+// vGPU accounting, "uuid=mem" entries separated by ",".
+func DecodeDeviceMemoryExternal(str string) (map[string]int32, error) {
+	res := make(map[string]int32)
+	for _, val := range strings.Split(str, fieldSep) {
+		val = strings.TrimSpace(val)
+		if len(val) == 0 {
+			continue
+		}
+		id, mem, found := strings.Cut(val, "=")
+		if !found || len(id) == 0 {
+			return nil, &ParseError{Value: val, Reason: "expected uuid=mem"}
+		}
+		m, err := parseInt32(mem, "mem", val)
+		if err != nil {
+			return nil, err
+		}
+		if m < 0 {
+			return nil, &ParseError{Value: val, Reason: "negative mem"}
+		}
+		res[id] = m
+	}
+	return res, nil
+}
+
+// DecodeDrainDevices parses the UUIDs of the devices drained on a node, separated by ",".
+func DecodeDrainDevices(str string) []string {
+	var res []string
+	for _, val := range strings.Split(str, fieldSep) {
+		if val = strings.TrimSpace(val); len(val) > 0 {
+			res = append(res, val)
+		}
+	}
+	return res
+}
+
+// DecodeMemoryPercent parses the percentage of device memory a pod asks for, an integer
+// greater than 0 and at most 100.
+func DecodeMemoryPercent(str string) (int32, error) {
+	p, err := parseInt32(strings.TrimSpace(str), "percent", str)
+	if err != nil {
+		return 0, err
+	}
+	if p <= 0 || p > 100 {
+		return 0, &ParseError{Value: str, Reason: "percent must be in (0,100]"}
+	}
+	return p, nil
+}
+
+// ParseHandshakeTime returns the time of a "State_time" handshake annotation.
+func ParseHandshakeTime(str string) (time.Time, error) {
+	_, ts, found := strings.Cut(str, "_")
+	if !found {
+		return time.Time{}, &ParseError{Value: str, Reason: "missing handshake time"}
+	}
+	t, err := time.Parse(HandshakeTimeLayout, ts)
+	if err != nil {
+		return time.Time{}, &ParseError{Value: str, Reason: err.Error()}
+	}
+	return t, nil
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package annotations
+
+import (
+	"testing"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/api"
+	"gotest.tools/v3/assert"
+)
+
+func TestEmptyContainerDevicesCoding(t *testing.T) {
+	cd1 := ContainerDevices{}
+	cd2, err := DecodeContainerDevices(EncodeContainerDevices(cd1))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cd1, cd2)
+}
+
+func TestEmptyPodDeviceCoding(t *testing.T) {
+	pd1 := PodDevices{}
+	pd2, err := DecodePodDevices(EncodePodDevices(pd1))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pd1, pd2)
+}
+
+func TestPodDevicesCoding(t *testing.T) {
+	pd1 := PodDevices{
+		ContainerDevices{{UUID: "GPU-0", Type: "NVIDIA", Usedmem: 1000, Usedcores: 30}},
+		ContainerDevices{},
+		ContainerDevices{{UUID: "GPU-1", Type: "NVIDIA", Usedmem: 2000}, {UUID: "GPU-2", Type: "NVIDIA", Usedmem: 3000}},
+	}
+	pd2, err := DecodePodDevices(EncodePodDevices(pd1))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pd1, pd2)
+}
+
+func TestNodeDevicesCoding(t *testing.T) {
+	d1 := []*api.DeviceInfo{
+		{Id: "GPU-0", Count: 10, Devmem: 16000, Type: "NVIDIA-Tesla V100", Health: true},
+		{Id: "GPU-1", Count: 10, Devmem: 16000, Type: "NVIDIA-Tesla V100"},
+		{Id: "GPU-2", Count: 10, Devmem: 48000, Type: "NVIDIA-Tesla V100", Health: true, Physmem: 16000},
+		{Id: "GPU-3", Count: 10, Devmem: 16000, Type: "NVIDIA-Tesla T4", Health: true, Maxshares: 6},
+		{Id: "GPU-4", Count: 10, Devmem: 32000, Type: "NVIDIA-Tesla T4", Health: true, Physmem: 16000, Maxshares: 6},
+		{Id: "GPU-5", Count: 10, Devmem: 15000, Type: "NVIDIA-Tesla T4", Health: true, Overcommitted: true},
+	}
+	d2, err := DecodeNodeDevices(EncodeNodeDevices(d1))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, d1, d2)
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, s := range []string{
+		"8Gi",
+		"GPU-0,NVIDIA,8Gi,0:",
+		"GPU-0,NVIDIA,1000:",
+		"GPU-0,NVIDIA,1000,0,extra:",
+		"GPU-0,NVIDIA,99999999999,0:",
+	} {
+		_, err := DecodePodDevices(s)
+		assert.ErrorContains(t, err, "malformed annotation value", s)
+	}
+	for _, s := range []string{
+		"GPU-0,10,16000,NVIDIA:",
+		"GPU-0,ten,16000,NVIDIA,true:",
+		"GPU-0,10,16000,NVIDIA,yes:",
+		"GPU-0,10,48000,NVIDIA,true,16Gi:",
+		"GPU-0,10,48000,NVIDIA,true,16000,six:",
+		"GPU-0,10,48000,NVIDIA,true,16000,6,maybe:",
+		"GPU-0,10,48000,NVIDIA,true,16000,6,true,extra:",
+	} {
+		_, err := DecodeNodeDevices(s)
+		assert.ErrorContains(t, err, "malformed annotation value", s)
+	}
+}
+
+func TestDecodeMemoryPercent(t *testing.T) {
+	for _, s := range []string{"1", "25", " 50 ", "100"} {
+		_, err := DecodeMemoryPercent(s)
+		assert.NilError(t, err, s)
+	}
+	p, _ := DecodeMemoryPercent("25")
+	assert.Equal(t, p, int32(25))
+	for _, s := range []string{"", "0", "-1", "101", "25%", "0.5"} {
+		_, err := DecodeMemoryPercent(s)
+		assert.ErrorContains(t, err, "malformed annotation value", s)
+	}
+}
+
+func TestParseHandshakeTime(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	ts, err := ParseHandshakeTime("Requesting_" + now.Format(HandshakeTimeLayout))
+	assert.NilError(t, err)
+	assert.Equal(t, ts.Format(HandshakeTimeLayout), now.Format(HandshakeTimeLayout))
+
+	_, err = ParseHandshakeTime("Reported " + now.String())
+	assert.ErrorContains(t, err, "missing handshake time")
+}
+
+func FuzzDecodePodDevices(f *testing.F) {
+	f.Add("")
+	f.Add(";")
+	f.Add("GPU-0,NVIDIA,1000,30:;GPU-1,NVIDIA,2000,0:GPU-2,MLU,10,0:")
+	f.Add("GPU-0,NVIDIA,8Gi,0:")
+	f.Fuzz(func(t *testing.T, s string) {
+		pd, err := DecodePodDevices(s)
+		if err != nil {
+			return
+		}
+		again, err := DecodePodDevices(EncodePodDevices(pd))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, pd, again)
+	})
+}
+
+func FuzzDecodeNodeDevices(f *testing.F) {
+	f.Add("")
+	f.Add("GPU-0,10,16000,NVIDIA-Tesla V100,true:GPU-1,10,16000,NVIDIA-Tesla V100,false:")
+	f.Add("GPU-0,10,16Gi,NVIDIA,true:")
+	f.Add("GPU-0,10,48000,NVIDIA,true,16000:")
+	f.Add("GPU-0,10,15000,NVIDIA,true,0,0,true:")
+	f.Fuzz(func(t *testing.T, s string) {
+		devs, err := DecodeNodeDevices(s)
+		if err != nil {
+			return
+		}
+		again, err := DecodeNodeDevices(EncodeNodeDevices(devs))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, devs, again)
+	})
+}
+
+func FuzzParseHandshakeTime(f *testing.F) {
+	f.Add("Requesting_2022.11.01 10:00:00")
+	f.Add("Reported 2022-11-01 10:00:00")
+	f.Fuzz(func(t *testing.T, s string) {
+		_, _ = ParseHandshakeTime(s)
+	})
+}
+
+func TestDecodeDeviceMemoryExternal(t *testing.T) {
+	res, err := DecodeDeviceMemoryExternal("GPU-0=1024, GPU-1=512,")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, map[string]int32{"GPU-0": 1024, "GPU-1": 512})
+
+	for _, val := range []string{"GPU-0", "=1024", "GPU-0=1g", "GPU-0=-1"} {
+		_, err := DecodeDeviceMemoryExternal(val)
+		assert.ErrorContains(t, err, "malformed annotation value", val)
+	}
+}
+
+func TestContainerUsageCoding(t *testing.T) {
+	usage := []ContainerUsage{
+		{PodUID: "uid-0", Container: "train", PeakMemory: 12000, Cores: 150},
+		{PodUID: "uid-1", Container: "infer", PeakMemory: 800, Cores: 0},
+	}
+	res, err := DecodeContainerUsage(EncodeContainerUsage(usage))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, usage)
+
+	res, err = DecodeContainerUsage("")
+	assert.NilError(t, err)
+	assert.Equal(t, len(res), 0)
+
+	for _, val := range []string{"uid-0,train,12000", ",train,1,1", "uid-0,train,1g,1", "uid-0,train,1,-1"} {
+		_, err := DecodeContainerUsage(val)
+		assert.ErrorContains(t, err, "malformed annotation value", val)
+	}
+}
+
+func TestTypeRequestsCoding(t *testing.T) {
+	reqs := []TypeRequest{
+		{Type: "A100", Memreq: 10000, Coresreq: 30},
+		{Type: "T4", Memreq: 4000, Coresreq: 0},
+	}
+	res, err := DecodeTypeRequests(EncodeTypeRequests(reqs))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, reqs)
+
+	for _, val := range []string{"T4,4000", ",4000,0", "T4,4g,0", "T4,0,0", "T4,4000,101"} {
+		_, err := DecodeTypeRequests(val)
+		assert.ErrorContains(t, err, "malformed annotation value", val)
+	}
+}
+
+func TestDeviceLinksCoding(t *testing.T) {
+	links := []DeviceLink{
+		{A: "GPU-0", B: "GPU-1", Level: 18},
+		{A: "GPU-0", B: "GPU-2", Level: 1},
+	}
+	res, err := DecodeDeviceLinks(EncodeDeviceLinks(links))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, links)
+
+	for _, val := range []string{"GPU-0,GPU-1", "GPU-0,GPU-0,8", ",GPU-1,8", "GPU-0,GPU-1,x", "GPU-0,GPU-1,0", "GPU-0,GPU-1,19"} {
+		_, err := DecodeDeviceLinks(val)
+		assert.ErrorContains(t, err, "malformed annotation value", val)
+	}
+}
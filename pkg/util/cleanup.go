@@ -0,0 +1,76 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// OwnedNodeAnnotations returns the node annotations vGPU components write themselves.
+// Other annotations under ResourcePrefix, like DeviceMemoryExternalAnnotation, are set by
+// administrators and left alone by cleanup.
+func OwnedNodeAnnotations() []string {
+	return []string{
+		NodeHandshake,
+		NodeNvidiaDeviceRegistered,
+		NodeMLUHandshake,
+		NodeMLUDeviceRegistered,
+		NodeLockTime,
+	}
+}
+
+// RemoveNodeAnnotations removes the annotations with the given keys from node and returns
+// the keys node had. With dryRun node is not changed.
+func RemoveNodeAnnotations(ctx context.Context, client kubernetes.Interface, node *v1.Node, keys []string, dryRun bool) ([]string, error) {
+	return removeNodeMetadata(ctx, client, node, "annotations", node.Annotations, keys, dryRun)
+}
+
+// RemoveNodeLabels removes the labels with the given keys from node and returns the keys
+// node had.
+func RemoveNodeLabels(ctx context.Context, client kubernetes.Interface, node *v1.Node, keys []string) ([]string, error) {
+	return removeNodeMetadata(ctx, client, node, "labels", node.Labels, keys, false)
+}
+
+// removeNodeMetadata removes the keys node has in values, its field of the metadata.
+func removeNodeMetadata(ctx context.Context, client kubernetes.Interface, node *v1.Node, field string, values map[string]string, keys []string, dryRun bool) ([]string, error) {
+	var removed []string
+	patch := make(map[string]interface{})
+	for _, k := range keys {
+		if _, ok := values[k]; ok {
+			removed = append(removed, k)
+			patch[k] = nil
+		}
+	}
+	if len(removed) == 0 || dryRun {
+		return removed, nil
+	}
+	bytes, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{field: patch}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = client.CoreV1().Nodes().Patch(ctx, node.Name, k8stypes.MergePatchType, bytes, metav1.PatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+// ConfigPath is where vGPU components serve the configuration they run with, after
+// flags, config files and defaults were resolved.
+const ConfigPath = "/config"
+
+// ConfigHandler serves the configuration returned by get as indented JSON.
+func ConfigHandler(get func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(get(), "", "  ")
+		if err != nil {
+			klog.Errorf("encode config: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(b, '\n'))
+	})
+}
+
+// NewConfigCmd returns the "config" command, which prints the configuration served by
+// the running component at endpoint, e.g. through kubectl exec.
+func NewConfigCmd(endpoint string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "print the effective configuration of the running process",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printConfig(cmd.OutOrStdout(), endpoint)
+		},
+	}
+	cmd.Flags().StringVar(&endpoint, "endpoint", endpoint, "address of the running process")
+	return cmd
+}
+
+func printConfig(w io.Writer, endpoint string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(endpoint + ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %v: %v", endpoint+ConfigPath, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
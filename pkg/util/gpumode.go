@@ -0,0 +1,65 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The values of GPUModeAnnotation. GPUModeShared pods get slices of GPUs other pods
+// share, GPUModeDedicated pods get whole GPUs with the hook library still enforcing
+// their limits, and GPUModeExclusive pods get whole GPUs without any interception.
+const (
+	GPUModeShared    = "shared"
+	GPUModeDedicated = "dedicated"
+	GPUModeExclusive = "exclusive"
+)
+
+// ParseGPUMode returns the mode set by a GPUModeAnnotation of val.
+func ParseGPUMode(val string) (string, error) {
+	switch mode := strings.TrimSpace(val); mode {
+	case GPUModeShared, GPUModeDedicated, GPUModeExclusive:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown GPU mode %q, expected %v, %v or %v", val, GPUModeShared, GPUModeDedicated, GPUModeExclusive)
+}
+
+// PodGPUMode returns how pod uses its GPUs. GPUModeAnnotation wins over the older
+// ExclusivePassthroughAnnotation, which is read as GPUModeExclusive when it is "true".
+// Pods with neither, or with a GPUModeAnnotation that doesn't parse, are shared; the
+// webhook and the scheduler reject the latter before they get that far.
+func PodGPUMode(pod *v1.Pod) string {
+	if val, ok := pod.Annotations[GPUModeAnnotation]; ok {
+		mode, err := ParseGPUMode(val)
+		if err != nil {
+			return GPUModeShared
+		}
+		return mode
+	}
+	if pod.Annotations[ExclusivePassthroughAnnotation] == "true" {
+		return GPUModeExclusive
+	}
+	return GPUModeShared
+}
+
+// WholeGPUs reports whether pod gets whole GPUs no other pod is placed on.
+func WholeGPUs(pod *v1.Pod) bool {
+	return PodGPUMode(pod) != GPUModeShared
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// APIRequestDuration records the latency of API server calls issued by this project, by operation.
+	APIRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "vgpu_apiserver_request_duration_seconds",
+			Help:    "Latency of API server requests issued by vGPU components",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"operation"},
+	)
+	// APIRequestRetries counts API server calls that were retried after a retriable error.
+	APIRequestRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vgpu_apiserver_request_retries_total",
+			Help: "Number of API server requests retried by vGPU components",
+		},
+		[]string{"operation"},
+	)
+)
+
+// APIMetrics returns the collectors above so binaries can add them to their registry.
+func APIMetrics() []prometheus.Collector {
+	return []prometheus.Collector{APIRequestDuration, APIRequestRetries}
+}
+
+func observeAPIRequest(operation string, start time.Time) {
+	APIRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
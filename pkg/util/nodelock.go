@@ -3,8 +3,11 @@ package util
 import (
 	"context"
 	"fmt"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -28,8 +31,32 @@ func GetClient() kubernetes.Interface {
 	return kubeClient
 }
 
+// SetClient replaces the client used by this package.
+func SetClient(client kubernetes.Interface) {
+	kubeClient = client
+}
+
 // NewClient connects to an API server
 func NewClient() (kubernetes.Interface, error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	return client, err
+}
+
+// NewClientWithKeepalive connects to an API server like NewClient, see SetKeepalive.
+func NewClientWithKeepalive(timeout, keepalive time.Duration) (kubernetes.Interface, error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
+	}
+	SetKeepalive(config, timeout, keepalive)
+	return kubernetes.NewForConfig(config)
+}
+
+func restConfig() (*rest.Config, error) {
 	kubeConfig := os.Getenv("KUBECONFIG")
 	if kubeConfig == "" {
 		kubeConfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
@@ -43,12 +70,31 @@ func NewClient() (kubernetes.Interface, error) {
 			return nil, err
 		}
 	}
-	client, err := kubernetes.NewForConfig(config)
-	return client, err
+	return config, nil
 }
 
-func SetNodeLock(nodeName string) error {
-	ctx := context.Background()
+// SetKeepalive bounds dialing the API server to timeout and has a connection that stayed
+// silent for keepalive probed, closing it unless the probe is answered within timeout.
+// Requests then fail over to a new connection instead of waiting on a half-open one. TCP
+// keepalive probes HTTP/1.1 connections, HTTP/2 pings probe HTTP/2 ones; client-go only
+// takes the ping settings from the environment, so they apply to all clients created
+// afterwards, unless the environment already sets them.
+func SetKeepalive(config *rest.Config, timeout, keepalive time.Duration) {
+	config.Dial = (&net.Dialer{Timeout: timeout, KeepAlive: keepalive}).DialContext
+	seconds := func(d time.Duration) string {
+		return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+	}
+	for env, val := range map[string]string{
+		"HTTP2_READ_IDLE_TIMEOUT_SECONDS": seconds(keepalive),
+		"HTTP2_PING_TIMEOUT_SECONDS":      seconds(timeout),
+	} {
+		if _, ok := os.LookupEnv(env); !ok {
+			os.Setenv(env, val)
+		}
+	}
+}
+
+func SetNodeLock(ctx context.Context, nodeName string) error {
 	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
 		return err
@@ -59,8 +105,9 @@ func SetNodeLock(nodeName string) error {
 	newNode := node.DeepCopy()
 	newNode.ObjectMeta.Annotations[NodeLockTime] = time.Now().Format(time.RFC3339)
 	_, err = kubeClient.CoreV1().Nodes().Update(ctx, newNode, metav1.UpdateOptions{})
-	for i := 0; i < MaxLockRetry && err != nil; i++ {
+	for i := 0; i < MaxLockRetry && err != nil && ctx.Err() == nil; i++ {
 		klog.ErrorS(err, "Failed to update node", "node", nodeName, "retry", i)
+		APIRequestRetries.WithLabelValues("lock-node").Inc()
 		time.Sleep(100 * time.Millisecond)
 		node, err = kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 		if err != nil {
@@ -79,7 +126,10 @@ func SetNodeLock(nodeName string) error {
 }
 
 func ReleaseNodeLock(nodeName string) error {
-	ctx := context.Background()
+	return releaseNodeLock(context.Background(), nodeName)
+}
+
+func releaseNodeLock(ctx context.Context, nodeName string) error {
 	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
 		return err
@@ -110,14 +160,14 @@ func ReleaseNodeLock(nodeName string) error {
 	return nil
 }
 
-func LockNode(nodeName string) error {
-	ctx := context.Background()
+func LockNode(ctx context.Context, nodeName string) error {
+	defer observeAPIRequest("lock-node", time.Now())
 	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 	if _, ok := node.ObjectMeta.Annotations[NodeLockTime]; !ok {
-		return SetNodeLock(nodeName)
+		return SetNodeLock(ctx, nodeName)
 	}
 	lockTime, err := time.Parse(time.RFC3339, node.ObjectMeta.Annotations[NodeLockTime])
 	if err != nil {
@@ -125,12 +175,12 @@ func LockNode(nodeName string) error {
 	}
 	if time.Since(lockTime) > time.Minute*5 {
 		klog.InfoS("Node lock expired", "node", nodeName, "lockTime", lockTime)
-		err = ReleaseNodeLock(nodeName)
+		err = releaseNodeLock(ctx, nodeName)
 		if err != nil {
 			klog.ErrorS(err, "Failed to release node lock", "node", nodeName)
 			return err
 		}
-		return SetNodeLock(nodeName)
+		return SetNodeLock(ctx, nodeName)
 	}
 	return fmt.Errorf("node %s has been locked within 5 minutes", nodeName)
 }
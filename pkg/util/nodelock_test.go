@@ -0,0 +1,162 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// blackholeProxy forwards TCP connections until blackholed, after which the connections
+// it had stay open but silently drop everything, like connections through a crashed
+// gateway. Connections accepted after restore are forwarded again.
+type blackholeProxy struct {
+	listener net.Listener
+	backend  string
+
+	mu    sync.Mutex
+	dead  *int32
+	conns []net.Conn
+}
+
+func newBlackholeProxy(t *testing.T, backend string) *blackholeProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	p := &blackholeProxy{listener: l, backend: backend, dead: new(int32)}
+	t.Cleanup(p.close)
+	go p.serve()
+	return p
+}
+
+func (p *blackholeProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.backend)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.mu.Lock()
+		dead := p.dead
+		p.conns = append(p.conns, conn, upstream)
+		p.mu.Unlock()
+		go forward(conn, upstream, dead)
+		go forward(upstream, conn, dead)
+	}
+}
+
+func forward(dst, src net.Conn, dead *int32) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(dead) == 1 {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (p *blackholeProxy) blackhole() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.StoreInt32(p.dead, 1)
+}
+
+func (p *blackholeProxy) restore() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dead = new(int32)
+}
+
+func (p *blackholeProxy) close() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+}
+
+func TestSetKeepaliveDropsDeadConnection(t *testing.T) {
+	for _, env := range []string{"HTTP2_READ_IDLE_TIMEOUT_SECONDS", "HTTP2_PING_TIMEOUT_SECONDS"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&corev1.Node{
+			TypeMeta:   metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		})
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	proxy := newBlackholeProxy(t, server.Listener.Addr().String())
+
+	config := &rest.Config{
+		Host:            "https://" + proxy.listener.Addr().String(),
+		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+	}
+	SetKeepalive(config, time.Second, time.Second)
+	client, err := kubernetes.NewForConfig(config)
+	assert.NilError(t, err)
+	get := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+		return err
+	}
+	assert.NilError(t, get())
+
+	proxy.blackhole()
+	start := time.Now()
+	assert.Assert(t, get() != nil)
+	assert.Assert(t, time.Since(start) < 2*time.Second)
+
+	// the request above left the connection silent, its unanswered ping closes it and
+	// a later request dials the restored proxy
+	proxy.restore()
+	deadline := time.Now().Add(5 * time.Second)
+	for err = get(); err != nil; err = get() {
+		assert.Assert(t, time.Now().Before(deadline), "still failing: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package openapi writes OpenAPI v3 documents of HTTP endpoints from the Go types they
+// encode with encoding/json, so the document can't drift from the types, and validates
+// JSON against them.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Version is the OpenAPI version of the documents.
+const Version = "3.0.3"
+
+// Document is an OpenAPI document, with the parts of the specification used here.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+// PathItem has the operations of a path, by method.
+type PathItem struct {
+	Get    *Operation `json:"get,omitempty"`
+	Post   *Operation `json:"post,omitempty"`
+	Delete *Operation `json:"delete,omitempty"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is an OpenAPI schema object, with the keywords the Generator writes.
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Nullable    bool               `json:"nullable,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	AllOf       []*Schema          `json:"allOf,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	// AdditionalProperties is the schema of the values of a map
+	AdditionalProperties *Schema `json:"additionalProperties,omitempty"`
+}
+
+// JSON is the media type of all schemas.
+const JSON = "application/json"
+
+// Content returns the content of a request or response of JSON encoded as schema.
+func Content(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{JSON: {Schema: schema}}
+}
+
+// refPrefix starts the references to the schemas of Components.
+const refPrefix = "#/components/schemas/"
+
+// versionPattern matches the last element of the import path of API versions, e.g. v1,
+// whose schemas are named after the element before it too.
+var versionPattern = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// Generator writes the schemas of Go types into Components. Named struct types become
+// components referenced by the package and type name, e.g. scheduler.NodeUsageReport,
+// other types are written inline. A property is required unless its json tag has
+// omitempty or its openapi tag is "optional", for fields left out of some responses.
+//
+// Types of the Kubernetes API, under k8s.io/api, are opaque objects: their schemas are
+// published by the API server.
+type Generator struct {
+	schemas map[string]*Schema
+	types   map[reflect.Type]string
+}
+
+func NewGenerator() *Generator {
+	return &Generator{schemas: make(map[string]*Schema), types: make(map[reflect.Type]string)}
+}
+
+// Components returns the components of the schemas written so far.
+func (g *Generator) Components() Components {
+	return Components{Schemas: g.schemas}
+}
+
+// Describe sets the description of the component of the type of v, written if needed.
+func (g *Generator) Describe(v interface{}, description string) {
+	t := reflect.TypeOf(v)
+	g.Schema(t)
+	if name, ok := g.types[t]; ok {
+		g.schemas[name].Description = description
+	}
+}
+
+// SchemaOf returns the schema of the type of v.
+func (g *Generator) SchemaOf(v interface{}) *Schema {
+	return g.Schema(reflect.TypeOf(v))
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// Schema returns the schema of t, a reference for named struct types.
+func (g *Generator) Schema(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case strings.HasPrefix(t.PkgPath(), "k8s.io/api/") && t.Kind() == reflect.Struct:
+		return g.component(t, func() *Schema {
+			gv := strings.TrimPrefix(t.PkgPath(), "k8s.io/api/")
+			return &Schema{Type: "object", Description: fmt.Sprintf("a %v %v of the Kubernetes API", gv, t.Name())}
+		})
+	case t.Kind() != reflect.Ptr && (t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType)):
+		// encoded its own way
+		return &Schema{Description: fmt.Sprintf("a %v", t)}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte", Nullable: t.Kind() == reflect.Slice}
+		}
+		return &Schema{Type: "array", Items: g.Schema(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.Schema(t.Elem()), Nullable: true}
+	case reflect.Ptr:
+		s := g.Schema(t.Elem())
+		if s.Ref != "" {
+			return &Schema{AllOf: []*Schema{s}, Nullable: true}
+		}
+		res := *s
+		res.Nullable = true
+		return &res
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return g.component(t, func() *Schema { return g.structSchema(t) })
+	}
+	// interfaces, anything
+	return &Schema{}
+}
+
+// component returns a reference to the component of t, written with schema the first time.
+func (g *Generator) component(t reflect.Type, schema func() *Schema) *Schema {
+	if name, ok := g.types[t]; ok {
+		return &Schema{Ref: refPrefix + name}
+	}
+	pkg := path.Base(t.PkgPath())
+	if versionPattern.MatchString(pkg) {
+		pkg = path.Base(path.Dir(t.PkgPath())) + "." + pkg
+	}
+	name := pkg + "." + t.Name()
+	for i := 2; g.schemas[name] != nil; i++ {
+		name = fmt.Sprintf("%v.%v%d", pkg, t.Name(), i)
+	}
+	g.types[t] = name
+	// a placeholder, for types referring to themselves
+	g.schemas[name] = &Schema{}
+	*g.schemas[name] = *schema()
+	return &Schema{Ref: refPrefix + name}
+}
+
+func (g *Generator) structSchema(t reflect.Type) *Schema {
+	res := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	g.addFields(res, t)
+	return res
+}
+
+// addFields adds the fields of struct t to s as encoding/json encodes them, those of
+// embedded structs without a name of their own inline.
+func (g *Generator) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(s, ft)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fs := g.Schema(ft)
+		if hasOption(opts, "string") {
+			fs = &Schema{Type: "string"}
+		}
+		s.Properties[name] = fs
+		if !hasOption(opts, "omitempty") && f.Tag.Get("openapi") != "optional" {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func hasOption(opts, option string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Validator checks JSON against the schemas of a document, with the keywords the
+// Generator writes.
+type Validator struct {
+	Components Components
+	// DisallowUnknownFields rejects properties of objects their schema doesn't list, like
+	// json.Decoder.DisallowUnknownFields. Clients should accept them, servers may add
+	// properties, but a test of the server finds the fields missing from the document.
+	DisallowUnknownFields bool
+}
+
+// Validate checks that data is valid JSON of schema.
+func (v *Validator) Validate(schema *Schema, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var val interface{}
+	if err := dec.Decode(&val); err != nil {
+		return err
+	}
+	return v.validate(schema, val, "$")
+}
+
+func (v *Validator) validate(s *Schema, val interface{}, at string) error {
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, refPrefix)
+		ref, ok := v.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("%v: unknown schema %v", at, s.Ref)
+		}
+		return v.validate(ref, val, at)
+	}
+	if val == nil {
+		if s.Nullable || s.Type == "" && len(s.AllOf) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%v: null is not nullable", at)
+	}
+	for _, sub := range s.AllOf {
+		if err := v.validate(sub, val, at); err != nil {
+			return err
+		}
+	}
+	switch s.Type {
+	case "":
+		return nil
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("%v: %v is not a boolean", at, val)
+		}
+	case "integer":
+		if n, ok := val.(json.Number); !ok || strings.ContainsAny(string(n), ".eE") {
+			return fmt.Errorf("%v: %v is not an integer", at, val)
+		}
+	case "number":
+		if _, ok := val.(json.Number); !ok {
+			return fmt.Errorf("%v: %v is not a number", at, val)
+		}
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("%v: %v is not a string", at, val)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%v: %q is not a date-time", at, str)
+			}
+		}
+		if len(s.Enum) > 0 {
+			known := false
+			for _, e := range s.Enum {
+				known = known || e == str
+			}
+			if !known {
+				return fmt.Errorf("%v: %q is not one of %v", at, str, strings.Join(s.Enum, ", "))
+			}
+		}
+	case "array":
+		items, ok := val.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v: %v is not an array", at, val)
+		}
+		for i, item := range items {
+			if err := v.validate(s.Items, item, fmt.Sprintf("%v[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v: %v is not an object", at, val)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%v: required property %q is missing", at, name)
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ps, ok := s.Properties[name]
+			if !ok {
+				ps = s.AdditionalProperties
+			}
+			if ps == nil {
+				if v.DisallowUnknownFields && s.Properties != nil {
+					return fmt.Errorf("%v: unknown property %q", at, name)
+				}
+				continue
+			}
+			if err := v.validate(ps, obj[name], at+"."+name); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%v: unknown type %v", at, s.Type)
+	}
+	return nil
+}
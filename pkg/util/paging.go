@@ -0,0 +1,178 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Query parameters of the list endpoints, see ParsePageRequest.
+const (
+	PageLimitParam    = "limit"
+	PageContinueParam = "continue"
+	PageFieldsParam   = "fields"
+)
+
+// PageRequest is the page of a list of items sorted by key a request asks for, with
+// "?limit=&continue=&fields=".
+type PageRequest struct {
+	// Limit is the most items in the page, 0 for no limit
+	Limit int
+	// After is the key of the last item of the previous page
+	After string
+	// MaxBytes ends the page before the item that would take the encoded items over it,
+	// whatever Limit, 0 for no limit. A page has one item at least.
+	MaxBytes int
+	// fields are the parts of the items asked for, nil for all
+	fields map[string]bool
+}
+
+// ParsePageRequest reads the page r asks for, with limit items unless it sets the limit.
+// The fields it selects, separated by ",", must be among fields.
+func ParsePageRequest(r *http.Request, limit, maxBytes int, fields ...string) (PageRequest, error) {
+	q := r.URL.Query()
+	p := PageRequest{Limit: limit, MaxBytes: maxBytes}
+	if val := q.Get(PageLimitParam); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("%v %q is not a non-negative integer", PageLimitParam, val)
+		}
+		p.Limit = n
+	}
+	if val := q.Get(PageContinueParam); val != "" {
+		after, err := base64.RawURLEncoding.DecodeString(val)
+		if err != nil {
+			return p, fmt.Errorf("malformed %v token %q", PageContinueParam, val)
+		}
+		p.After = string(after)
+	}
+	if val := q.Get(PageFieldsParam); val != "" {
+		p.fields = make(map[string]bool)
+		for _, f := range strings.Split(val, ",") {
+			f = strings.TrimSpace(f)
+			known := false
+			for _, k := range fields {
+				known = known || k == f
+			}
+			if !known {
+				return p, fmt.Errorf("unknown field %q, must be one of %v", f, strings.Join(fields, ", "))
+			}
+			p.fields[f] = true
+		}
+	}
+	return p, nil
+}
+
+// Selected is whether the request asks for the field of the items.
+func (p PageRequest) Selected(field string) bool {
+	return p.fields == nil || p.fields[field]
+}
+
+// Start returns the index of the first item of the page in the sorted keys.
+func (p PageRequest) Start(keys []string) int {
+	if p.After == "" {
+		return 0
+	}
+	return sort.Search(len(keys), func(i int) bool { return keys[i] > p.After })
+}
+
+// JSONField is a field of the object WriteJSONPage writes ahead of the list.
+type JSONField struct {
+	Name  string
+	Value interface{}
+}
+
+// WriteJSONPage writes an object with the head fields and, in the field named list, the
+// page p of the items whose sorted keys are keys, and, when items are left, the token
+// of the next page in "continue". Items are encoded one at a time as they are written,
+// gzipped when the client accepts it, so the size of the list doesn't add up in memory.
+func WriteJSONPage(w http.ResponseWriter, r *http.Request, p PageRequest, head []JSONField, list string, keys []string, item func(i int) interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		defer gz.Close()
+		out = gz
+	}
+	bw := bufio.NewWriter(out)
+	defer bw.Flush()
+
+	bw.WriteString("{\n")
+	for _, f := range head {
+		b, err := json.MarshalIndent(f.Value, "  ", "  ")
+		if err != nil {
+			klog.Errorf("encode %v: %v", f.Name, err)
+			continue
+		}
+		fmt.Fprintf(bw, "  %q: %s,\n", f.Name, b)
+	}
+	fmt.Fprintf(bw, "  %q: [", list)
+	start, size, n := p.Start(keys), 0, 0
+	next := ""
+	for i := start; i < len(keys); i++ {
+		if p.Limit > 0 && n == p.Limit {
+			next = keys[i-1]
+			break
+		}
+		b, err := json.MarshalIndent(item(i), "    ", "  ")
+		if err != nil {
+			klog.Errorf("encode %v %v: %v", list, keys[i], err)
+			break
+		}
+		if p.MaxBytes > 0 && n > 0 && size+len(b) > p.MaxBytes {
+			next = keys[i-1]
+			break
+		}
+		if n > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n    ")
+		bw.Write(b)
+		size += len(b)
+		n++
+	}
+	if n > 0 {
+		bw.WriteString("\n  ")
+	}
+	bw.WriteString("]")
+	if next != "" {
+		fmt.Fprintf(bw, ",\n  %q: %q", PageContinueParam, base64.RawURLEncoding.EncodeToString([]byte(next)))
+	}
+	bw.WriteString("\n}\n")
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if name, q, _ := strings.Cut(strings.TrimSpace(enc), ";"); name == "gzip" && strings.TrimSpace(q) != "q=0" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+type testPage struct {
+	Total    int      `json:"total"`
+	Items    []string `json:"items"`
+	Continue string   `json:"continue"`
+}
+
+func getPage(t *testing.T, url string, limit, maxBytes int, keys []string) (testPage, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	w := httptest.NewRecorder()
+	p, err := ParsePageRequest(r, limit, maxBytes)
+	assert.NilError(t, err)
+	WriteJSONPage(w, r, p, []JSONField{{Name: "total", Value: len(keys)}}, "items", keys, func(i int) interface{} { return keys[i] })
+	var page testPage
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &page), w.Body.String())
+	return page, w
+}
+
+func TestWriteJSONPage(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+	page, w := getPage(t, "/items", 2, 0, keys)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/json")
+	assert.DeepEqual(t, page.Items, []string{"a", "b"})
+	assert.Equal(t, page.Total, 5)
+	var got []string
+	for url := "/items"; ; {
+		page, _ := getPage(t, url, 2, 0, keys)
+		got = append(got, page.Items...)
+		if page.Continue == "" {
+			break
+		}
+		url = "/items?continue=" + page.Continue
+	}
+	assert.DeepEqual(t, got, keys)
+
+	// the request overrides the limit, 0 serves all
+	page, _ = getPage(t, "/items?limit=0", 2, 0, keys)
+	assert.DeepEqual(t, page.Items, keys)
+	assert.Equal(t, page.Continue, "")
+
+	// items of 3 bytes each, the byte limit ends the page, but not before its first item
+	page, _ = getPage(t, "/items", 0, 7, keys)
+	assert.DeepEqual(t, page.Items, []string{"a", "b"})
+	page, _ = getPage(t, "/items", 0, 1, keys)
+	assert.DeepEqual(t, page.Items, []string{"a"})
+	assert.Assert(t, page.Continue != "")
+
+	page, _ = getPage(t, "/items", 0, 0, nil)
+	assert.DeepEqual(t, page.Items, []string{})
+}
+
+func TestWriteJSONPageGzip(t *testing.T) {
+	keys := []string{"a", "b"}
+	r := httptest.NewRequest(http.MethodGet, "/items", nil)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.9")
+	w := httptest.NewRecorder()
+	WriteJSONPage(w, r, PageRequest{}, nil, "items", keys, func(i int) interface{} { return keys[i] })
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+	gz, err := gzip.NewReader(w.Body)
+	assert.NilError(t, err)
+	var page testPage
+	assert.NilError(t, json.NewDecoder(gz).Decode(&page))
+	assert.DeepEqual(t, page.Items, keys)
+
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	w = httptest.NewRecorder()
+	WriteJSONPage(w, r, PageRequest{}, nil, "items", keys, func(i int) interface{} { return keys[i] })
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "")
+}
+
+func TestParsePageRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/usage?fields=summary,pods", nil)
+	p, err := ParsePageRequest(r, 10, 0, "summary", "devices", "pods")
+	assert.NilError(t, err)
+	assert.Equal(t, p.Limit, 10)
+	assert.Assert(t, p.Selected("summary") && p.Selected("pods") && !p.Selected("devices"))
+
+	for url, want := range map[string]string{
+		"/usage?limit=-1":        `limit "-1" is not a non-negative integer`,
+		"/usage?continue=%25%25": `malformed continue token "%%"`,
+		"/usage?fields=nodes":    `unknown field "nodes", must be one of summary, devices, pods`,
+	} {
+		_, err := ParsePageRequest(httptest.NewRequest(http.MethodGet, url, nil), 10, 0, "summary", "devices", "pods")
+		assert.ErrorContains(t, err, want, url)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// RedactTenantInfo has Redact hash the namespaces and names of pods before they
+// go to the logs, events and traces, for clusters where they identify tenants.
+var RedactTenantInfo bool
+
+// Redact returns name, a namespace or a pod name, the way it may be logged. With
+// RedactTenantInfo it is replaced by a short hash, the same for the same name, so
+// the lines of one pod can still be followed. The hash isn't keyed, whoever can
+// guess a name can find its hash.
+func Redact(name string) string {
+	if !RedactTenantInfo || name == "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "h-" + hex.EncodeToString(sum[:5])
+}
+
+// PodRef returns namespace/name of a pod the way it may be logged.
+func PodRef(namespace, name string) string {
+	return Redact(namespace) + "/" + Redact(name)
+}
+
+// RedactIn replaces the names in s, e.g. quoted by an API server error, with
+// their hashes.
+func RedactIn(s string, names ...string) string {
+	if !RedactTenantInfo {
+		return s
+	}
+	// the longest first, a pod name may contain its namespace
+	names = append([]string(nil), names...)
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, n := range names {
+		if n != "" {
+			s = strings.ReplaceAll(s, n, Redact(n))
+		}
+	}
+	return s
+}
+
+// NewRequestID returns an ID tying the log lines of one request together, it
+// identifies the request, not the pod.
+func NewRequestID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+// DeviceCandidate is what a GPU is ordered by when devices are selected for a container,
+// by the scheduler and, when it picks devices itself, the device plugin.
+type DeviceCandidate struct {
+	UUID string
+	// SharesLeft is the number of tasks the device can still take.
+	SharesLeft int32
+	// FreeMemory is the memory in MiB not allocated yet.
+	FreeMemory int32
+}
+
+// CandidateBefore is whether a is tried before b: the one with more shares left, then
+// with more free memory, then with the lower UUID. It is a total order of devices with
+// distinct UUIDs, so selection doesn't depend on the order devices are listed in.
+func CandidateBefore(a, b DeviceCandidate) bool {
+	if a.SharesLeft != b.SharesLeft {
+		return a.SharesLeft > b.SharesLeft
+	}
+	if a.FreeMemory != b.FreeMemory {
+		return a.FreeMemory > b.FreeMemory
+	}
+	return a.UUID < b.UUID
+}
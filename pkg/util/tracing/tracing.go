@@ -0,0 +1,125 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tracing follows the allocation path of a pod, from the scheduler's filter and
+// bind to the device plugin's Allocate, through the logs. Each step is a span whose end
+// is logged at verbosity LogLevel with the trace ID the steps of a pod share, so the logs
+// of both components can be searched for it. The components don't call each other, so
+// the trace context travels in the pod's util.TraceParentAnnotation, in the W3C
+// traceparent format. Spans aren't exported to a collector.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// LogLevel is the verbosity spans are logged at, with a lower one no spans are started.
+const LogLevel = 4
+
+// Span is an operation of the allocation path. Its methods may be called on a nil span.
+type Span struct {
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	// attrs are key value pairs
+	attrs  []interface{}
+	failed bool
+}
+
+// Start starts a span named name, as a child of the span in traceParent if that is a
+// valid W3C traceparent, else as the root of a new trace. Below LogLevel it returns a nil
+// span, whose methods do nothing.
+func Start(name, traceParent string) *Span {
+	if !klog.V(LogLevel).Enabled() {
+		return nil
+	}
+	s := &Span{name: name, start: time.Now()}
+	if traceID, parentID, ok := ParseTraceParent(traceParent); ok {
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttribute records an attribute logged with the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, key, value)
+}
+
+// SetError marks the span failed, nil leaves it alone. The error itself is logged where
+// it is handled, not with the span.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.failed = true
+}
+
+// End logs the span.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	kv := []interface{}{"traceID", s.TraceID(), "spanID", hex.EncodeToString(s.spanID[:])}
+	if s.parentID != [8]byte{} {
+		kv = append(kv, "parentSpanID", hex.EncodeToString(s.parentID[:]))
+	}
+	kv = append(kv, "duration", time.Since(s.start), "failed", s.failed)
+	klog.V(LogLevel).InfoS("Span "+s.name, append(kv, s.attrs...)...)
+}
+
+// TraceID returns the ID of the trace of the span, "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// TraceParent returns the W3C traceparent for children of the span, "" for a nil span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// ParseTraceParent returns the trace and parent span IDs of a W3C traceparent.
+func ParseTraceParent(str string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	fields := strings.Split(strings.TrimSpace(str), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || len(fields[1]) != 32 || len(fields[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(fields[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(fields[2])); err != nil {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, traceID != [16]byte{} && spanID != [8]byte{}
+}
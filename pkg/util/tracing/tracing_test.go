@@ -0,0 +1,85 @@
+/*
+ * Copyright © 2021 peizhaoyou <peizhaoyou@4paradigm.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/klog/v2"
+)
+
+// logSpans raises the verbosity to LogLevel and returns the log.
+func logSpans(t *testing.T) *bytes.Buffer {
+	var fs flag.FlagSet
+	klog.InitFlags(&fs)
+	t.Cleanup(func() {
+		fs.Set("v", "0")
+		klog.SetOutput(nil)
+		klog.LogToStderr(true)
+	})
+	assert.NilError(t, fs.Set("v", "4"))
+	var logs bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&logs)
+	return &logs
+}
+
+func TestSpansShareTheTraceID(t *testing.T) {
+	logs := logSpans(t)
+	filter := Start("vgpu.filter", "")
+	filter.SetAttribute("k8s.node.name", "node1")
+	filter.End()
+	allocate := Start("vgpu.allocate", filter.TraceParent())
+	allocate.SetError(errors.New("no device"))
+	allocate.End()
+	klog.Flush()
+
+	assert.Equal(t, allocate.TraceID(), filter.TraceID())
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Equal(t, len(lines), 2)
+	assert.Assert(t, strings.Contains(lines[0], `"Span vgpu.filter" traceID="`+filter.TraceID()+`"`), lines[0])
+	assert.Assert(t, strings.Contains(lines[0], `failed=false k8s.node.name="node1"`), lines[0])
+	assert.Assert(t, strings.Contains(lines[1], `"Span vgpu.allocate" traceID="`+filter.TraceID()+`"`), lines[1])
+	assert.Assert(t, strings.Contains(lines[1], `parentSpanID="`+strings.Split(filter.TraceParent(), "-")[2]+`"`), lines[1])
+	assert.Assert(t, strings.Contains(lines[1], "failed=true"), lines[1])
+}
+
+func TestTracingDisabled(t *testing.T) {
+	s := Start("vgpu.filter", "")
+	assert.Assert(t, s == nil)
+	s.SetAttribute("k", "v")
+	s.SetError(errors.New("failed"))
+	s.End()
+	assert.Equal(t, s.TraceParent(), "")
+	assert.Equal(t, s.TraceID(), "")
+}
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Assert(t, ok)
+	assert.Equal(t, traceID[0], byte(0x4b))
+	assert.Equal(t, spanID[7], byte(0xb7))
+	for _, str := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		_, _, ok := ParseTraceParent(str)
+		assert.Assert(t, !ok, str)
+	}
+}
@@ -16,15 +16,19 @@
 
 package util
 
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
 const (
 	//ResourceName = "nvidia.com/gpu"
 	//ResourceName = "4pd.io/vgpu"
-	AssignedTimeAnnotations          = "4pd.io/vgpu-time"
-	AssignedIDsAnnotations           = "4pd.io/vgpu-ids-new"
-	AssignedIDsToAllocateAnnotations = "4pd.io/devices-to-allocate"
-	AssignedNodeAnnotations          = "4pd.io/vgpu-node"
-	BindTimeAnnotations              = "4pd.io/bind-time"
-	DeviceBindPhase                  = "4pd.io/bind-phase"
+	DefaultResourcePrefix = "4pd.io"
 
 	GPUInUse = "nvidia.com/use-gputype"
 	GPUNoUse = "nvidia.com/nouse-gputype"
@@ -56,16 +60,117 @@ const (
 	MluMemSplitLimit       = "CAMBRICON_SPLIT_MEMS"
 	MluMemSplitIndex       = "CAMBRICON_SPLIT_VISIBLE_DEVICES"
 	MluMemSplitEnable      = "CAMBRICON_SPLIT_ENABLE"
-	NodeLockTime           = "4pd.io/mutex.lock"
 	MaxLockRetry           = 5
+	GPUNodeLabelValue      = "enabled"
+
+	// MemoryTierGuaranteed pods are placed on the physical memory of GPUs, MemoryTierBestEffort
+	// pods may use the memory added by scaling it, see MemoryTierAnnotation.
+	MemoryTierGuaranteed = "guaranteed"
+	MemoryTierBestEffort = "besteffort"
+)
+
+// The scheduler asks the device plugins to report their devices every HandshakePollInterval
+// by setting the handshake annotation of their nodes to "Requesting", and takes the devices
+// of a node away when it wasn't answered with "Reported" within HandshakeTimeout.
+const (
+	HandshakePollInterval = 15 * time.Second
+	HandshakeTimeout      = 60 * time.Second
+)
+
+// Annotations and labels written by vGPU components, they are all placed under
+// ResourcePrefix, see SetResourcePrefix.
+var (
+	AssignedTimeAnnotations          string
+	AssignedIDsAnnotations           string
+	AssignedIDsToAllocateAnnotations string
+	AssignedNodeAnnotations          string
+	BindTimeAnnotations              string
+	DeviceBindPhase                  string
+	NodeLockTime                     string
+	AllowManagedMemoryAnnotation     string
+	// StallThresholdAnnotation is how long a container may go without launching a kernel
+	// before the device plugin reports it as stalled, e.g. "10m".
+	StallThresholdAnnotation string
+	// ExclusivePassthroughAnnotation set to "true" gives the pod whole GPUs without the
+	// hook library, the scheduler places nothing else on them.
+	ExclusivePassthroughAnnotation string
+	// GPUModeAnnotation is how the pod uses its GPUs, one of GPUModeShared,
+	// GPUModeDedicated and GPUModeExclusive, see PodGPUMode. It supersedes
+	// ExclusivePassthroughAnnotation.
+	GPUModeAnnotation string
+	// MemoryPercentAnnotation asks for a percentage of the memory of each GPU the pod gets
+	// for its containers that don't request memory, see annotations.DecodeMemoryPercent.
+	MemoryPercentAnnotation string
+	// MemoryBandwidthAnnotation caps the memory bandwidth the containers of the pod use of
+	// each GPU they get in percent, see annotations.DecodeMemoryPercent. The scheduler
+	// keeps the bandwidth of the containers on a GPU within 100%, the device plugin passes
+	// the limit to hook libraries that enforce it.
+	MemoryBandwidthAnnotation string
+	// CoresBurstAnnotation set to "true" lets the containers of the pod use more than their
+	// share of the cores while the GPU is not contended, see the device plugin's LimitSyncer.
+	CoresBurstAnnotation string
+	// GPUUnhealthyTaint keeps pods off nodes whose GPUs are all unhealthy.
+	GPUUnhealthyTaint string
+	// DeviceMemoryExternalAnnotation reserves device memory on a node for processes the
+	// scheduler doesn't account, see annotations.DecodeDeviceMemoryExternal.
+	DeviceMemoryExternalAnnotation string
+	// AllocatedIDsAnnotations lists the devices the device plugin handed to each container
+	// of the pod, the scheduler corrects its accounting with it once the bind succeeded.
+	AllocatedIDsAnnotations string
+	// MaxSharesAnnotation on a node caps the containers sharing each of its GPUs, it
+	// overrides the device plugin's --max-shares-per-device and config file.
+	MaxSharesAnnotation string
+	// DeviceSplitCountAnnotation and DeviceMemoryScalingAnnotation on a node override the
+	// device plugin's --device-split-count and --device-memory-scaling, vgpuctl plan --apply
+	// sets them once the change is safe. The device plugin reads them on start and reload.
+	DeviceSplitCountAnnotation    string
+	DeviceMemoryScalingAnnotation string
+	// DrainDeviceAnnotation on a node lists the UUIDs of GPUs drained for maintenance,
+	// separated by ",". No new container gets a drained GPU until it is removed from the list.
+	DrainDeviceAnnotation string
+	// PlacementKeyAnnotation on a pod has the scheduler prefer the devices pods with the
+	// same key were placed on lately, e.g. where a model may still be warm.
+	PlacementKeyAnnotation string
+	// ColocateGroupAnnotation names a group of pods of a namespace that must share a physical
+	// GPU, e.g. a producer and consumer using CUDA IPC. The first pod placed anchors the group
+	// to its GPU, the scheduler places the others there or nowhere.
+	ColocateGroupAnnotation string
+	// TraceParentAnnotation carries the W3C trace context of the pod's allocation from the
+	// scheduler to the device plugin, see package tracing.
+	TraceParentAnnotation string
+	// DistinctGPUsAnnotation set to "true" on a pod gives each GPU its containers request
+	// a physical GPU of its own, no two of them share one.
+	DistinctGPUsAnnotation string
+	// ContainerUsageAnnotation on a node has the device plugin report the peak memory and
+	// cores its containers used lately, see annotations.DecodeContainerUsage.
+	ContainerUsageAnnotation string
+	// NodeNvidiaTopologyAnnotation on a node has the device plugin report how its GPUs are
+	// connected, see annotations.DecodeDeviceLinks.
+	NodeNvidiaTopologyAnnotation string
+	// MemoryTierAnnotation on a pod is the memory tier the scheduler placed it in by its
+	// priority class, MemoryTierGuaranteed or MemoryTierBestEffort, for the device plugin.
+	MemoryTierAnnotation string
+	// GPURequestAnnotation on a pod names the GPURequest in its namespace the webhook
+	// turns into the resource limits and annotations of the pod.
+	GPURequestAnnotation string
+	// VGPUProfileAnnotation on a pod names the request profile, e.g. "small", the webhook
+	// turns into the resource limits of its containers.
+	VGPUProfileAnnotation string
+	// VGPUProfileTypesAnnotation is set by the webhook to the memory and cores the profile
+	// gives on each GPU type, see annotations.DecodeTypeRequests.
+	VGPUProfileTypesAnnotation string
+	// GPUNodeLabel is set to GPUNodeLabelValue by the device plugin on the nodes it
+	// registers GPUs of, the webhook requires it in the node affinity of vGPU pods.
+	GPUNodeLabel string
 
-	NodeHandshake              = "4pd.io/node-handshake"
-	NodeNvidiaDeviceRegistered = "4pd.io/node-nvidia-register"
-	NodeMLUHandshake           = "4pd.io/node-handshake-mlu"
-	NodeMLUDeviceRegistered    = "4pd.io/node-mlu-register"
+	NodeHandshake              string
+	NodeNvidiaDeviceRegistered string
+	NodeMLUHandshake           string
+	NodeMLUDeviceRegistered    string
 )
 
 var (
+	ResourcePrefix        string
 	ResourceName          string
 	ResourceMem           string
 	ResourceCores         string
@@ -76,11 +181,64 @@ var (
 	MLUResourceCount  string
 	MLUResourceMemory string
 
+	KnownDevice map[string]string
+)
+
+func init() {
+	_ = SetResourcePrefix(DefaultResourcePrefix)
+}
+
+// SetResourcePrefix places all annotations and labels written by vGPU components under
+// prefix, it must be the same for the scheduler and all device plugins in a cluster.
+func SetResourcePrefix(prefix string) error {
+	if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+		return fmt.Errorf("invalid resource prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+	ResourcePrefix = prefix
+	AssignedTimeAnnotations = prefix + "/vgpu-time"
+	AssignedIDsAnnotations = prefix + "/vgpu-ids-new"
+	AssignedIDsToAllocateAnnotations = prefix + "/devices-to-allocate"
+	AssignedNodeAnnotations = prefix + "/vgpu-node"
+	BindTimeAnnotations = prefix + "/bind-time"
+	DeviceBindPhase = prefix + "/bind-phase"
+	NodeLockTime = prefix + "/mutex.lock"
+	AllowManagedMemoryAnnotation = prefix + "/allow-managed-memory"
+	StallThresholdAnnotation = prefix + "/stall-threshold"
+	ExclusivePassthroughAnnotation = prefix + "/exclusive-passthrough"
+	GPUModeAnnotation = prefix + "/gpu-mode"
+	CoresBurstAnnotation = prefix + "/gpucores-burst"
+	MemoryPercentAnnotation = prefix + "/vgpu-memory-percent"
+	MemoryBandwidthAnnotation = prefix + "/vgpu-membw-percent"
+	GPUUnhealthyTaint = prefix + "/gpu-unhealthy"
+	DeviceMemoryExternalAnnotation = prefix + "/device-memory-external"
+	MaxSharesAnnotation = prefix + "/max-shares-per-device"
+	DeviceSplitCountAnnotation = prefix + "/device-split-count"
+	DeviceMemoryScalingAnnotation = prefix + "/device-memory-scaling"
+	AllocatedIDsAnnotations = prefix + "/vgpu-ids-allocated"
+	DrainDeviceAnnotation = prefix + "/drain-device"
+	PlacementKeyAnnotation = prefix + "/placement-key"
+	ColocateGroupAnnotation = prefix + "/vgpu-colocate-group"
+	TraceParentAnnotation = prefix + "/traceparent"
+	DistinctGPUsAnnotation = prefix + "/distinct-gpus"
+	ContainerUsageAnnotation = prefix + "/container-usage"
+	NodeNvidiaTopologyAnnotation = prefix + "/node-nvidia-topology"
+	MemoryTierAnnotation = prefix + "/memory-tier"
+	GPURequestAnnotation = prefix + "/gpu-request"
+	VGPUProfileAnnotation = prefix + "/vgpu-profile"
+	VGPUProfileTypesAnnotation = prefix + "/vgpu-profile-types"
+	GPUNodeLabel = prefix + "/vgpu"
+
+	NodeHandshake = prefix + "/node-handshake"
+	NodeNvidiaDeviceRegistered = prefix + "/node-nvidia-register"
+	NodeMLUHandshake = prefix + "/node-handshake-mlu"
+	NodeMLUDeviceRegistered = prefix + "/node-mlu-register"
+
 	KnownDevice = map[string]string{
 		NodeHandshake:    NodeNvidiaDeviceRegistered,
 		NodeMLUHandshake: NodeMLUDeviceRegistered,
 	}
-)
+	return nil
+}
 
 //	type ContainerDevices struct {
 //	   Devices []string `json:"devices,omitempty"`
@@ -89,21 +247,44 @@ var (
 //	type PodDevices struct {
 //	   Containers []ContainerDevices `json:"containers,omitempty"`
 //	}
-type ContainerDevice struct {
-	UUID      string
-	Type      string
-	Usedmem   int32
-	Usedcores int32
-}
+type ContainerDevice = annotations.ContainerDevice
 
 type ContainerDeviceRequest struct {
 	Nums             int32
 	Type             string
 	Memreq           int32
 	MemPercentagereq int32
-	Coresreq         int32
+	// Slice charges each device its memory divided by its split count, for containers
+	// that ask for a number of vGPUs only
+	Slice    bool
+	Coresreq int32
+	// MemBandwidthreq is the memory bandwidth in percent of each device, 0 if not limited
+	MemBandwidthreq int32
+	// Profile is the device plugin profile the devices must come from, see ResourceProfile
+	Profile string
+	// TypeRequests replace Memreq and Coresreq on the devices of the first type matching
+	TypeRequests []TypeRequest
+	// MemoryScaling caps the memory assigned on each device, with that of the containers
+	// already there, to this multiple of its physical memory, 0 leaves the memory the
+	// device advertises as the cap. It is set by the priority class of the pod.
+	MemoryScaling float64
+}
+
+type TypeRequest = annotations.TypeRequest
+
+// ForType returns the request for a device of type devType, with the memory and cores of
+// the first of TypeRequests whose type devType contains, ignoring case, like
+// nvidia.com/use-gputype.
+func (r ContainerDeviceRequest) ForType(devType string) ContainerDeviceRequest {
+	for _, t := range r.TypeRequests {
+		if strings.Contains(strings.ToUpper(devType), strings.ToUpper(t.Type)) {
+			r.Memreq, r.MemPercentagereq, r.Slice, r.Coresreq = t.Memreq, 101, false, t.Coresreq
+			break
+		}
+	}
+	return r
 }
 
-type ContainerDevices []ContainerDevice
+type ContainerDevices = annotations.ContainerDevices
 
-type PodDevices []ContainerDevices
+type PodDevices = annotations.PodDevices
@@ -23,18 +23,21 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
-	"4pd.io/k8s-vgpu/pkg/api"
+	"4pd.io/k8s-vgpu/pkg/util/annotations"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 )
 
 func GlobalFlagSet() *flag.FlagSet {
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&ResourcePrefix, "resource-prefix", DefaultResourcePrefix, "prefix of the annotations and labels written by vgpu components")
 	fs.StringVar(&ResourceName, "resource-name", "nvidia.com/gpu", "resource name")
 	fs.StringVar(&ResourceMem, "resource-mem", "nvidia.com/gpumem", "gpu memory to allocate")
 	fs.StringVar(&ResourceMemPercentage, "resource-mem-percentage", "nvidia.com/gpumem-percentage", "gpu memory fraction to allocate")
@@ -53,7 +56,13 @@ func GetNode(nodename string) (*v1.Node, error) {
 }
 
 func GetPendingPod(node string) (*v1.Pod, error) {
-	podlist, err := GetClient().CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	return GetPendingPodWithContext(context.Background(), node)
+}
+
+// GetPendingPodWithContext returns the pod the scheduler bound to node whose devices are
+// being allocated, nil if there is none, listing the pods until ctx is done.
+func GetPendingPodWithContext(ctx context.Context, node string) (*v1.Pod, error) {
+	podlist, err := GetClient().CoreV1().Pods("").List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -79,102 +88,13 @@ func GetPendingPod(node string) (*v1.Pod, error) {
 	return nil, nil
 }
 
-func DecodeNodeDevices(str string) []*api.DeviceInfo {
-	if !strings.Contains(str, ":") {
-		return []*api.DeviceInfo{}
-	}
-	tmp := strings.Split(str, ":")
-	var retval []*api.DeviceInfo
-	for _, val := range tmp {
-		if strings.Contains(val, ",") {
-			items := strings.Split(val, ",")
-			count, _ := strconv.Atoi(items[1])
-			devmem, _ := strconv.Atoi(items[2])
-			health, _ := strconv.ParseBool(items[4])
-			i := api.DeviceInfo{
-				Id:     items[0],
-				Count:  int32(count),
-				Devmem: int32(devmem),
-				Type:   items[3],
-				Health: health,
-			}
-			retval = append(retval, &i)
-		}
-	}
-	return retval
-}
-
-func EncodeNodeDevices(dlist []*api.DeviceInfo) string {
-	tmp := ""
-	for _, val := range dlist {
-		tmp += val.Id + "," + strconv.FormatInt(int64(val.Count), 10) + "," + strconv.Itoa(int(val.Devmem)) + "," + val.Type + "," + strconv.FormatBool(val.Health) + ":"
-	}
-	klog.V(3).Infoln("Encoded node Devices", tmp)
-	return tmp
-}
-
-func EncodeContainerDevices(cd ContainerDevices) string {
-	tmp := ""
-	for _, val := range cd {
-		tmp += val.UUID + "," + val.Type + "," + strconv.Itoa(int(val.Usedmem)) + "," + strconv.Itoa(int(val.Usedcores)) + ":"
-	}
-	fmt.Println("Encoded container Devices=", tmp)
-	return tmp
-	//return strings.Join(cd, ",")
-}
-
-func EncodePodDevices(pd PodDevices) string {
-	var ss []string
-	for _, cd := range pd {
-		ss = append(ss, EncodeContainerDevices(cd))
-	}
-	return strings.Join(ss, ";")
-}
-
-func DecodeContainerDevices(str string) ContainerDevices {
-	if len(str) == 0 {
-		return ContainerDevices{}
-	}
-	cd := strings.Split(str, ":")
-	contdev := ContainerDevices{}
-	tmpdev := ContainerDevice{}
-	//fmt.Println("before container device", str)
-	if len(str) == 0 {
-		return contdev
-	}
-	for _, val := range cd {
-		if strings.Contains(val, ",") {
-			//fmt.Println("cd is ", val)
-			tmpstr := strings.Split(val, ",")
-			tmpdev.UUID = tmpstr[0]
-			tmpdev.Type = tmpstr[1]
-			devmem, _ := strconv.ParseInt(tmpstr[2], 10, 32)
-			tmpdev.Usedmem = int32(devmem)
-			devcores, _ := strconv.ParseInt(tmpstr[3], 10, 32)
-			tmpdev.Usedcores = int32(devcores)
-			contdev = append(contdev, tmpdev)
-		}
-	}
-	//fmt.Println("Decoded container device", contdev)
-	return contdev
-}
-
-func DecodePodDevices(str string) PodDevices {
-	if len(str) == 0 {
-		return PodDevices{}
-	}
-	var pd PodDevices
-	for _, s := range strings.Split(str, ";") {
-		cd := DecodeContainerDevices(s)
-		pd = append(pd, cd)
-	}
-	return pd
-}
-
 func GetNextDeviceRequest(dtype string, p v1.Pod) (v1.Container, ContainerDevices, error) {
-	pdevices := DecodePodDevices(p.Annotations[AssignedIDsToAllocateAnnotations])
-	klog.Infoln("pdevices=", pdevices)
 	res := ContainerDevices{}
+	pdevices, err := annotations.DecodePodDevices(p.Annotations[AssignedIDsToAllocateAnnotations])
+	if err != nil {
+		return v1.Container{}, res, fmt.Errorf("pod %v/%v annotation %v: %w", p.Namespace, p.Name, AssignedIDsToAllocateAnnotations, err)
+	}
+	klog.Infoln("pdevices=", pdevices)
 	for idx, val := range pdevices {
 		found := false
 		for _, dev := range val {
@@ -184,6 +104,10 @@ func GetNextDeviceRequest(dtype string, p v1.Pod) (v1.Container, ContainerDevice
 			}
 		}
 		if found {
+			if idx >= len(p.Spec.Containers) {
+				return v1.Container{}, res, fmt.Errorf("pod %v/%v annotation %v assigns devices to container %d, pod has %d containers",
+					p.Namespace, p.Name, AssignedIDsToAllocateAnnotations, idx, len(p.Spec.Containers))
+			}
 			return p.Spec.Containers[idx], res, nil
 		}
 	}
@@ -191,7 +115,16 @@ func GetNextDeviceRequest(dtype string, p v1.Pod) (v1.Container, ContainerDevice
 }
 
 func EraseNextDeviceTypeFromAnnotation(dtype string, p v1.Pod) error {
-	pdevices := DecodePodDevices(p.Annotations[AssignedIDsToAllocateAnnotations])
+	return EraseNextDeviceTypeFromAnnotationWithContext(context.Background(), dtype, p)
+}
+
+// EraseNextDeviceTypeFromAnnotationWithContext takes the devices of type dtype of the next
+// container from the to-allocate annotation of p, patching it until ctx is done.
+func EraseNextDeviceTypeFromAnnotationWithContext(ctx context.Context, dtype string, p v1.Pod) error {
+	pdevices, err := annotations.DecodePodDevices(p.Annotations[AssignedIDsToAllocateAnnotations])
+	if err != nil {
+		return fmt.Errorf("pod %v/%v annotation %v: %w", p.Namespace, p.Name, AssignedIDsToAllocateAnnotations, err)
+	}
 	res := PodDevices{}
 	found := false
 	for _, val := range pdevices {
@@ -216,8 +149,8 @@ func EraseNextDeviceTypeFromAnnotation(dtype string, p v1.Pod) error {
 	}
 	klog.Infoln("After erase res=", res)
 	newannos := make(map[string]string)
-	newannos[AssignedIDsToAllocateAnnotations] = EncodePodDevices(res)
-	return PatchPodAnnotations(&p, newannos)
+	newannos[AssignedIDsToAllocateAnnotations] = annotations.EncodePodDevices(res)
+	return PatchPodAnnotationsWithContext(ctx, &p, newannos)
 }
 
 func PodAllocationTrySuccess(nodeName string, pod *v1.Pod) {
@@ -260,6 +193,11 @@ func PodAllocationFailed(nodeName string, pod *v1.Pod) {
 }
 
 func PatchNodeAnnotations(node *v1.Node, annotations map[string]string) error {
+	return PatchNodeAnnotationsWithContext(context.Background(), node, annotations)
+}
+
+// PatchNodeAnnotationsWithContext patches the given annotations onto node until ctx is done.
+func PatchNodeAnnotationsWithContext(ctx context.Context, node *v1.Node, annotations map[string]string) error {
 	type patchMetadata struct {
 		Annotations map[string]string `json:"annotations,omitempty"`
 	}
@@ -276,14 +214,72 @@ func PatchNodeAnnotations(node *v1.Node, annotations map[string]string) error {
 		return err
 	}
 	_, err = kubeClient.CoreV1().Nodes().
-		Patch(context.Background(), node.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+		Patch(ctx, node.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
 	if err != nil {
 		klog.Infof("patch pod %v failed, %v", node.Name, err)
 	}
 	return err
 }
 
+// PatchNodeMetadataWithContext patches the given annotations and labels onto the node
+// named name in one request until ctx is done.
+func PatchNodeMetadataWithContext(ctx context.Context, name string, annotations, labels map[string]string) error {
+	type patchMetadata struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty"`
+	}
+	type patchNode struct {
+		Metadata patchMetadata `json:"metadata"`
+	}
+
+	p := patchNode{}
+	p.Metadata.Annotations = annotations
+	p.Metadata.Labels = labels
+
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Nodes().
+		Patch(ctx, name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+	if err != nil {
+		klog.Infof("patch node %v failed, %v", name, err)
+	}
+	return err
+}
+
+// PatchNodeLabelsWithContext patches the given labels onto node until ctx is done.
+func PatchNodeLabelsWithContext(ctx context.Context, node *v1.Node, labels map[string]string) error {
+	type patchMetadata struct {
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+	type patchNode struct {
+		Metadata patchMetadata `json:"metadata"`
+	}
+
+	p := patchNode{}
+	p.Metadata.Labels = labels
+
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Nodes().
+		Patch(ctx, node.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+	if err != nil {
+		klog.Infof("patch node %v labels failed, %v", node.Name, err)
+	}
+	return err
+}
+
 func PatchPodAnnotations(pod *v1.Pod, annotations map[string]string) error {
+	return PatchPodAnnotationsWithContext(context.Background(), pod, annotations)
+}
+
+// PatchPodAnnotationsWithContext patches the given annotations onto pod, retrying conflicts and
+// throttling errors with backoff until ctx is done. A strategic merge patch only touches the keys
+// we pass, so concurrent writers of other annotations are never clobbered.
+func PatchPodAnnotationsWithContext(ctx context.Context, pod *v1.Pod, annotations map[string]string) error {
 	type patchMetadata struct {
 		Annotations map[string]string `json:"annotations,omitempty"`
 	}
@@ -299,10 +295,22 @@ func PatchPodAnnotations(pod *v1.Pod, annotations map[string]string) error {
 	if err != nil {
 		return err
 	}
-	_, err = kubeClient.CoreV1().Pods(pod.Namespace).
-		Patch(context.Background(), pod.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+	attempt := 0
+	err = retry.OnError(retry.DefaultBackoff, isRetriableAPIError, func() error {
+		if attempt > 0 {
+			APIRequestRetries.WithLabelValues("patch-pod").Inc()
+		}
+		attempt++
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		defer observeAPIRequest("patch-pod", time.Now())
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).
+			Patch(ctx, pod.Name, k8stypes.StrategicMergePatchType, bytes, metav1.PatchOptions{})
+		return err
+	})
 	if err != nil {
-		klog.Infof("patch pod %v failed, %v", pod.Name, err)
+		klog.Infof("patch pod %v failed, %v", Redact(pod.Name), RedactIn(err.Error(), pod.Name, pod.Namespace))
 	}
 	/*
 		Can't modify Env of pods here
@@ -316,3 +324,45 @@ func PatchPodAnnotations(pod *v1.Pod, annotations map[string]string) error {
 
 	return err
 }
+
+func isRetriableAPIError(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err)
+}
+
+// ProfileResourceName is the resource a device plugin profile exposes its GPUs as,
+// the default profile "" keeps ResourceName.
+func ProfileResourceName(profile string) string {
+	if profile == "" {
+		return ResourceName
+	}
+	return ResourceName + "-" + profile
+}
+
+// ResourceProfile returns the profile of an NVIDIA GPU resource name and whether
+// name is such a resource at all.
+func ResourceProfile(name string) (string, bool) {
+	if name == ResourceName {
+		return "", true
+	}
+	if profile := strings.TrimPrefix(name, ResourceName+"-"); profile != name && profile != "" {
+		return profile, true
+	}
+	return "", false
+}
+
+// ProfileDeviceType appends the profile to the type of a device reported in the node
+// annotation, schedulers unaware of profiles still see an NVIDIA device.
+func ProfileDeviceType(devType, profile string) string {
+	if profile == "" {
+		return devType
+	}
+	return devType + "/" + profile
+}
+
+// SplitProfileDeviceType reverses ProfileDeviceType.
+func SplitProfileDeviceType(devType string) (string, string) {
+	if i := strings.LastIndex(devType, "/"); i >= 0 {
+		return devType[:i], devType[i+1:]
+	}
+	return devType, ""
+}
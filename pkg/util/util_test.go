@@ -17,35 +17,126 @@
 package util
 
 import (
+    "context"
     "fmt"
-    "gotest.tools/v3/assert"
     "testing"
+
+    "gotest.tools/v3/assert"
+    corev1 "k8s.io/api/core/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/client-go/kubernetes/fake"
+    k8stesting "k8s.io/client-go/testing"
 )
 
-func TestEmptyContainerDevicesCoding(t *testing.T) {
-    cd1 := ContainerDevices{}
-    s := EncodeContainerDevices(cd1)
-    fmt.Println(s)
-    cd2 := DecodeContainerDevices(s)
-    assert.DeepEqual(t, cd1, cd2)
+func TestPatchPodAnnotationsRetriesConflicts(t *testing.T) {
+    pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+        Name:        "p",
+        Namespace:   "default",
+        Annotations: map[string]string{"other": "old"},
+    }}
+    client := fake.NewSimpleClientset(pod)
+    conflicts := 0
+    client.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+        if conflicts >= 2 {
+            return false, nil, nil
+        }
+        conflicts++
+        // Another writer updates an unrelated annotation between our attempts.
+        current, _ := client.Tracker().Get(corev1.SchemeGroupVersion.WithResource("pods"), "default", "p")
+        updated := current.(*corev1.Pod).DeepCopy()
+        updated.Annotations["other"] = fmt.Sprintf("new-%d", conflicts)
+        _ = client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("pods"), updated, "default")
+        return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "p", fmt.Errorf("conflict"))
+    })
+    former := kubeClient
+    kubeClient = client
+    defer func() { kubeClient = former }()
+
+    err := PatchPodAnnotationsWithContext(context.Background(), pod, map[string]string{DeviceBindPhase: DeviceBindAllocating})
+    assert.NilError(t, err)
+    assert.Equal(t, conflicts, 2)
+
+    got, err := client.CoreV1().Pods("default").Get(context.Background(), "p", metav1.GetOptions{})
+    assert.NilError(t, err)
+    assert.Equal(t, got.Annotations[DeviceBindPhase], DeviceBindAllocating)
+    assert.Equal(t, got.Annotations["other"], "new-2")
+}
+
+func TestSetResourcePrefix(t *testing.T) {
+    defer SetResourcePrefix(DefaultResourcePrefix)
+    assert.NilError(t, SetResourcePrefix("vgpu.example.com"))
+    assert.Equal(t, AssignedNodeAnnotations, "vgpu.example.com/vgpu-node")
+    assert.Equal(t, KnownDevice[NodeHandshake], "vgpu.example.com/node-nvidia-register")
+    assert.ErrorContains(t, SetResourcePrefix("Not_A_Domain"), "invalid resource prefix")
+    assert.Equal(t, ResourcePrefix, "vgpu.example.com")
 }
 
-func TestEmptyPodDeviceCoding(t *testing.T) {
-    pd1 := PodDevices{}
-    s := EncodePodDevices(pd1)
-    fmt.Println(s)
-    pd2 := DecodePodDevices(s)
-    assert.DeepEqual(t, pd1, pd2)
+func TestGetNextDeviceRequestRejectsMalformedAnnotations(t *testing.T) {
+    pod := corev1.Pod{
+        ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default"},
+        Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+    }
+    for _, anno := range []string{
+        "8Gi",
+        "GPU-0,NVIDIA,8Gi,0:",
+        // the second container doesn't exist
+        ";GPU-0,NVIDIA,1000,0:",
+    } {
+        pod.Annotations = map[string]string{AssignedIDsToAllocateAnnotations: anno}
+        _, _, err := GetNextDeviceRequest(NvidiaGPUDevice, pod)
+        assert.ErrorContains(t, err, AssignedIDsToAllocateAnnotations, anno)
+    }
+}
+
+func TestResourceProfile(t *testing.T) {
+    former := ResourceName
+    ResourceName = "nvidia.com/gpu"
+    defer func() { ResourceName = former }()
+
+    assert.Equal(t, ProfileResourceName(""), "nvidia.com/gpu")
+    assert.Equal(t, ProfileResourceName("training"), "nvidia.com/gpu-training")
+    for name, want := range map[string]string{"nvidia.com/gpu": "", "nvidia.com/gpu-training": "training"} {
+        profile, ok := ResourceProfile(name)
+        assert.Assert(t, ok, name)
+        assert.Equal(t, profile, want)
+    }
+    for _, name := range []string{"nvidia.com/gpumem", "nvidia.com/gpumem-percentage", "nvidia.com/gpu-"} {
+        _, ok := ResourceProfile(name)
+        assert.Assert(t, !ok, name)
+    }
+
+    devType, profile := SplitProfileDeviceType(ProfileDeviceType("NVIDIA-Tesla V100", "training"))
+    assert.Equal(t, devType, "NVIDIA-Tesla V100")
+    assert.Equal(t, profile, "training")
+    devType, profile = SplitProfileDeviceType("NVIDIA-Tesla V100")
+    assert.Equal(t, devType, "NVIDIA-Tesla V100")
+    assert.Equal(t, profile, "")
 }
 
-func TestPodDevicesCoding(t *testing.T) {
-    pd1 := PodDevices{
-        ContainerDevices{"1", "2"},
-        ContainerDevices{},
-        ContainerDevices{"3", "4"},
+func TestPodGPUModePrecedence(t *testing.T) {
+    for _, c := range []struct {
+        annos map[string]string
+        want  string
+    }{
+        {nil, GPUModeShared},
+        {map[string]string{ExclusivePassthroughAnnotation: "true"}, GPUModeExclusive},
+        {map[string]string{ExclusivePassthroughAnnotation: "false"}, GPUModeShared},
+        {map[string]string{GPUModeAnnotation: "dedicated"}, GPUModeDedicated},
+        {map[string]string{GPUModeAnnotation: " exclusive"}, GPUModeExclusive},
+        // the mode wins over the lower-level annotation
+        {map[string]string{GPUModeAnnotation: "shared", ExclusivePassthroughAnnotation: "true"}, GPUModeShared},
+        {map[string]string{GPUModeAnnotation: "dedicated", ExclusivePassthroughAnnotation: "true"}, GPUModeDedicated},
+        {map[string]string{GPUModeAnnotation: "exclusive", ExclusivePassthroughAnnotation: "false"}, GPUModeExclusive},
+        // invalid modes are rejected before, they don't fall back to the lower-level annotation
+        {map[string]string{GPUModeAnnotation: "whole", ExclusivePassthroughAnnotation: "true"}, GPUModeShared},
+    } {
+        pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annos}}
+        assert.Equal(t, PodGPUMode(pod), c.want, fmt.Sprint(c.annos))
+        assert.Equal(t, WholeGPUs(pod), c.want != GPUModeShared, fmt.Sprint(c.annos))
     }
-    s := EncodePodDevices(pd1)
-    fmt.Println(s)
-    pd2 := DecodePodDevices(s)
-    assert.DeepEqual(t, pd1, pd2)
+    _, err := ParseGPUMode("Dedicated")
+    assert.ErrorContains(t, err, `unknown GPU mode "Dedicated"`)
 }